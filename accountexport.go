@@ -0,0 +1,481 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	accountExportInterval = 2 * time.Second
+
+	// accountExportLease is how long a running job may go without making
+	// progress before another pass takes it over, as after a restart.
+	accountExportLease = 5 * time.Minute
+
+	// accountExportRetention is how long a finished archive can be
+	// downloaded.
+	accountExportRetention = 7 * 24 * time.Hour
+
+	// accountExportLinkTTL is how long a download link is good for.
+	accountExportLinkTTL = 15 * time.Minute
+)
+
+// accountExportDone is the status of a job whose archive can be
+// downloaded. Before that a job is "pending", then "running"; one that
+// could not be finished is "failed".
+const accountExportDone = "done"
+
+// AccountExport is the state of a user's account export job.
+type AccountExport struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+	Total    int    `json:"total"`
+	// DownloadURL fetches the archive once the job is done. It expires at
+	// DownloadExpiresAt.
+	DownloadURL       string     `json:"download_url,omitempty"`
+	DownloadExpiresAt *time.Time `json:"download_expires_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	FinishedAt        *time.Time `json:"finished_at,omitempty"`
+	userID            int
+}
+
+type exportedContact struct {
+	RequesterID int        `json:"requester_id"`
+	AddresseeID int        `json:"addressee_id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+type exportedReaction struct {
+	MessageID int       `json:"message_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// accountExportPart is a file of the archive and how to collect it.
+type accountExportPart struct {
+	name    string
+	collect func(ctx context.Context, userID int) (interface{}, error)
+}
+
+var accountExportParts = []accountExportPart{
+	{"profile.json", exportProfile},
+	{"contacts.json", exportContacts},
+	{"messages_sent.json", exportMessagesBy("sender_id")},
+	{"messages_received.json", exportMessagesBy("receiver_id")},
+	{"reactions.json", exportReactions},
+}
+
+func exportProfile(ctx context.Context, userID int) (interface{}, error) {
+	var user User
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id, username, email, COALESCE(avatar_url, ''), created_at, updated_at FROM users WHERE user_id = $1",
+		userID).Scan(&user.ID, &user.Username, &user.Email, &user.AvatarURL, &user.CreatedAt, &user.UpdatedAt)
+	return user, err
+}
+
+func exportContacts(ctx context.Context, userID int) (interface{}, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT requester_id, addressee_id, status, created_at, responded_at FROM contacts
+		WHERE requester_id = $1 OR addressee_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	contacts := []exportedContact{}
+	for rows.Next() {
+		var c exportedContact
+		if err := rows.Scan(&c.RequesterID, &c.AddresseeID, &c.Status, &c.CreatedAt, &c.RespondedAt); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, rows.Err()
+}
+
+// exportMessagesBy collects the user's messages that name them in column.
+func exportMessagesBy(column string) func(context.Context, int) (interface{}, error) {
+	return func(ctx context.Context, userID int) (interface{}, error) {
+		rows, err := db.QueryContext(ctx,
+			`SELECT message_id, sender_id, receiver_id, text, sent_at FROM messages
+			WHERE `+column+` = $1 AND (expires_at IS NULL OR expires_at > NOW())
+			ORDER BY sent_at, message_id`, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		messages := []exportedMessage{}
+		for rows.Next() {
+			var msg exportedMessage
+			if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Text, &msg.SentAt); err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		}
+		return messages, rows.Err()
+	}
+}
+
+func exportReactions(ctx context.Context, userID int) (interface{}, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT message_id, emoji, created_at FROM reactions WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reactions := []exportedReaction{}
+	for rows.Next() {
+		var r exportedReaction
+		if err := rows.Scan(&r.MessageID, &r.Emoji, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
+
+// AccountExporter runs account export jobs one at a time, polling Postgres
+// every Interval, and deletes archives older than Retention.
+type AccountExporter struct {
+	Interval  time.Duration
+	Lease     time.Duration
+	Retention time.Duration
+	Clock     Clock
+}
+
+func NewAccountExporter() *AccountExporter {
+	return &AccountExporter{
+		Interval:  accountExportInterval,
+		Lease:     accountExportLease,
+		Retention: accountExportRetention,
+		Clock:     realClock{},
+	}
+}
+
+// Run works through the queued jobs once every Interval until ctx is
+// cancelled.
+func (e *AccountExporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.Clock.After(e.Interval):
+			if err := e.runPending(ctx); err != nil {
+				log.Println("exporter: failed to run account exports:", err)
+			}
+			if err := e.purge(ctx); err != nil {
+				log.Println("exporter: failed to delete old account exports:", err)
+			}
+		}
+	}
+}
+
+// runPending runs jobs until none is waiting.
+func (e *AccountExporter) runPending(ctx context.Context) error {
+	for {
+		job, err := e.claim(ctx)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if runErr := e.run(ctx, job); runErr != nil {
+			log.Printf("exporter: account export %s failed: %v", job.ID, runErr)
+			_, err := db.ExecContext(ctx,
+				"UPDATE account_exports SET status = 'failed', error = $2, updated_at = $3, finished_at = $3 WHERE export_id = $1",
+				job.ID, runErr.Error(), e.Clock.Now())
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// claim marks the oldest waiting job running and returns it. A running job
+// that has not made progress within the lease is taken over.
+func (e *AccountExporter) claim(ctx context.Context) (AccountExport, error) {
+	now := e.Clock.Now()
+	var job AccountExport
+	err := db.QueryRowContext(ctx,
+		`UPDATE account_exports SET status = 'running', updated_at = $1
+		WHERE export_id = (
+			SELECT export_id FROM account_exports
+			WHERE status = 'pending' OR (status = 'running' AND updated_at < $2)
+			ORDER BY created_at LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING export_id, user_id, progress`, now, now.Add(-e.Lease)).Scan(&job.ID, &job.userID, &job.Progress)
+	return job, err
+}
+
+// run writes the parts of the archive the job does not have yet, then zips
+// them all into the archive.
+func (e *AccountExporter) run(ctx context.Context, job AccountExport) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "exporter.run",
+		trace.WithAttributes(
+			attribute.String("chat.export_id", job.ID),
+			attribute.Int("chat.user_id", job.userID),
+		))
+	defer span.End()
+
+	for i := job.Progress; i < len(accountExportParts); i++ {
+		part := accountExportParts[i]
+		value, err := part.collect(ctx, job.userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", part.name, err)
+		}
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %w", part.name, err)
+		}
+		if err := savePart(ctx, job.ID, part.name, data, i+1, e.Clock.Now()); err != nil {
+			return err
+		}
+	}
+
+	archive, err := zipParts(ctx, job.ID)
+	if err != nil {
+		return err
+	}
+	now := e.Clock.Now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		"UPDATE account_exports SET status = 'done', archive = $2, updated_at = $3, finished_at = $3 WHERE export_id = $1",
+		job.ID, archive, now)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM account_export_parts WHERE export_id = $1", job.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// savePart stores a part of the archive and records how far the job got.
+func savePart(ctx context.Context, exportID, name string, data []byte, progress int, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO account_export_parts (export_id, name, data) VALUES ($1, $2, $3) ON CONFLICT (export_id, name) DO UPDATE SET data = EXCLUDED.data",
+		exportID, name, data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE account_exports SET progress = $2, updated_at = $3 WHERE export_id = $1", exportID, progress, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// zipParts reads the stored parts of a job into a zip archive.
+func zipParts(ctx context.Context, exportID string) ([]byte, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, data FROM account_export_parts WHERE export_id = $1 ORDER BY name", exportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, err
+		}
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// purge deletes the jobs that finished more than Retention ago.
+func (e *AccountExporter) purge(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM account_exports WHERE finished_at < $1", e.Clock.Now().Add(-e.Retention))
+	return err
+}
+
+// signExportDownload returns the signature of a download link for the
+// export that is good until expires.
+func signExportDownload(exportID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+	fmt.Fprintf(mac, "account-export:%s:%d", exportID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportDownloadLink sets the download link of a finished job, expiring
+// after accountExportLinkTTL or with the archive, whichever comes first.
+func exportDownloadLink(job *AccountExport, now time.Time) {
+	if job.Status != accountExportDone || job.FinishedAt == nil {
+		return
+	}
+	expires := now.Add(accountExportLinkTTL)
+	if deleted := job.FinishedAt.Add(accountExportRetention); deleted.Before(expires) {
+		expires = deleted
+	}
+	expires = expires.Truncate(time.Second)
+	job.DownloadURL = fmt.Sprintf("/exports/%s/download?expires=%d&sig=%s",
+		job.ID, expires.Unix(), signExportDownload(job.ID, expires.Unix()))
+	job.DownloadExpiresAt = &expires
+}
+
+func loadAccountExport(ctx context.Context, exportID string) (AccountExport, error) {
+	job := AccountExport{ID: exportID, Total: len(accountExportParts)}
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id, status, progress, created_at, finished_at FROM account_exports WHERE export_id = $1", exportID).
+		Scan(&job.userID, &job.Status, &job.Progress, &job.CreatedAt, &job.FinishedAt)
+	return job, err
+}
+
+// startAccountExport queues an export of everything the server holds about
+// the caller. If one is already under way, that one is returned instead.
+func startAccountExport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.startAccountExport")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	claims := claimsFromContext(ctx)
+	if claims == nil || claims.UserID != userID {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	status := http.StatusAccepted
+	var exportID string
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO account_exports (export_id, user_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'running') DO NOTHING
+		RETURNING export_id`, uuid.NewString(), userID).Scan(&exportID)
+	if err == sql.ErrNoRows {
+		status = http.StatusOK
+		err = db.QueryRowContext(ctx,
+			"SELECT export_id FROM account_exports WHERE user_id = $1 AND status IN ('pending', 'running')", userID).Scan(&exportID)
+	}
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	span.SetAttributes(attribute.String("chat.export_id", exportID))
+	job, err := loadAccountExport(ctx, exportID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusAccepted {
+		recordAudit(ctx, userID, "account_export", exportID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/exports/"+exportID)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// getAccountExport reports how far an export of the caller's account got,
+// with a fresh download link once it is done.
+func getAccountExport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getAccountExport")
+	defer span.End()
+
+	exportID := mux.Vars(r)["jobID"]
+	span.SetAttributes(attribute.String("chat.export_id", exportID))
+	if _, err := uuid.Parse(exportID); err != nil {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	}
+	job, err := loadAccountExport(ctx, exportID)
+	claims := claimsFromContext(ctx)
+	// Other users' exports are reported missing, so that their IDs cannot
+	// be probed for.
+	if err == sql.ErrNoRows || (err == nil && (claims == nil || claims.UserID != job.userID)) {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	exportDownloadLink(&job, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// downloadAccountExport serves a finished archive to whoever holds a
+// download link that has not expired.
+func downloadAccountExport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.downloadAccountExport")
+	defer span.End()
+
+	exportID := mux.Vars(r)["jobID"]
+	span.SetAttributes(attribute.String("chat.export_id", exportID))
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	sig, _ := hex.DecodeString(query.Get("sig"))
+	want, _ := hex.DecodeString(signExportDownload(exportID, expires))
+	if err != nil || !hmac.Equal(sig, want) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if time.Now().Unix() > expires {
+		WriteError(w, http.StatusGone, codeGone, "Download link has expired")
+		return
+	}
+
+	var archive []byte
+	err = db.QueryRowContext(ctx,
+		"SELECT archive FROM account_exports WHERE export_id = $1 AND status = 'done'", exportID).Scan(&archive)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"account-export-%s.zip\"", exportID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Write(archive)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type exportJob struct {
+	userID     int64
+	status     string
+	progress   int64
+	archive    []byte
+	createdAt  time.Time
+	updatedAt  time.Time
+	finishedAt *time.Time
+}
+
+// accountExportStore keeps account_exports and account_export_parts in
+// memory and answers the queries collecting user 4's data with a fixed
+// account, recording which of them ran.
+type accountExportStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*exportJob
+	parts     map[string]map[string][]byte
+	collected []string
+}
+
+func (s *accountExportStore) Connect(context.Context) (driver.Conn, error) {
+	return accountExportConn{store: s}, nil
+}
+
+func (s *accountExportStore) Driver() driver.Driver { return nil }
+
+type accountExportConn struct {
+	fakeConn
+	store *accountExportStore
+}
+
+func (accountExportConn) Begin() (driver.Tx, error) { return noopTx{}, nil }
+
+func (accountExportConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+// tableRows returns rows of the given columns.
+type tableRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *tableRows) Columns() []string { return r.columns }
+func (r *tableRows) Close() error      { return nil }
+
+func (r *tableRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func (c accountExportConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arg := func(i int) driver.Value { return args[i].Value }
+
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO account_exports"):
+		for _, job := range s.jobs {
+			if job.userID == arg(1).(int64) && (job.status == "pending" || job.status == "running") {
+				return &tableRows{columns: []string{"export_id"}}, nil
+			}
+		}
+		s.jobs[arg(0).(string)] = &exportJob{userID: arg(1).(int64), status: "pending", createdAt: insertedAt, updatedAt: insertedAt}
+		return &tableRows{columns: []string{"export_id"}, rows: [][]driver.Value{{arg(0)}}}, nil
+	case strings.HasPrefix(query, "SELECT export_id FROM account_exports"):
+		rows := &tableRows{columns: []string{"export_id"}}
+		for id, job := range s.jobs {
+			if job.userID == arg(0).(int64) && (job.status == "pending" || job.status == "running") {
+				rows.rows = append(rows.rows, []driver.Value{id})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT user_id, status, progress"):
+		rows := &tableRows{columns: []string{"user_id", "status", "progress", "created_at", "finished_at"}}
+		if job, ok := s.jobs[arg(0).(string)]; ok {
+			var finishedAt driver.Value
+			if job.finishedAt != nil {
+				finishedAt = *job.finishedAt
+			}
+			rows.rows = append(rows.rows, []driver.Value{job.userID, job.status, job.progress, job.createdAt, finishedAt})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "UPDATE account_exports SET status = 'running'"):
+		rows := &tableRows{columns: []string{"export_id", "user_id", "progress"}}
+		for id, job := range s.jobs {
+			if job.status == "pending" || (job.status == "running" && job.updatedAt.Before(arg(1).(time.Time))) {
+				job.status, job.updatedAt = "running", arg(0).(time.Time)
+				rows.rows = append(rows.rows, []driver.Value{id, job.userID, job.progress})
+				break
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT name, data FROM account_export_parts"):
+		rows := &tableRows{columns: []string{"name", "data"}}
+		for name, data := range s.parts[arg(0).(string)] {
+			rows.rows = append(rows.rows, []driver.Value{name, data})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT archive"):
+		rows := &tableRows{columns: []string{"archive"}}
+		if job, ok := s.jobs[arg(0).(string)]; ok && job.status == "done" {
+			rows.rows = append(rows.rows, []driver.Value{job.archive})
+		}
+		return rows, nil
+	}
+
+	// The queries collecting the account.
+	if arg(0).(int64) != 4 {
+		return nil, fmt.Errorf("unexpected user %v", arg(0))
+	}
+	fields := strings.Fields(query)
+	s.collected = append(s.collected, fields[slices.Index(fields, "FROM")+1])
+	switch {
+	case strings.Contains(query, "FROM users"):
+		return &tableRows{columns: []string{"user_id", "username", "email", "avatar_url", "created_at", "updated_at"},
+			rows: [][]driver.Value{{int64(4), "dana", "dana@example.com", "", insertedAt, insertedAt}}}, nil
+	case strings.Contains(query, "FROM contacts"):
+		return &tableRows{columns: []string{"requester_id", "addressee_id", "status", "created_at", "responded_at"},
+			rows: [][]driver.Value{{int64(4), int64(5), "accepted", insertedAt, insertedAt}}}, nil
+	case strings.Contains(query, "WHERE sender_id"):
+		return &tableRows{columns: []string{"message_id", "sender_id", "receiver_id", "text", "sent_at"},
+			rows: [][]driver.Value{{int64(10), int64(4), int64(5), "hello, five", insertedAt}}}, nil
+	case strings.Contains(query, "WHERE receiver_id"):
+		return &tableRows{columns: []string{"message_id", "sender_id", "receiver_id", "text", "sent_at"},
+			rows: [][]driver.Value{{int64(11), int64(5), int64(4), "hi, four", insertedAt}}}, nil
+	case strings.Contains(query, "FROM reactions"):
+		return &tableRows{columns: []string{"message_id", "emoji", "created_at"},
+			rows: [][]driver.Value{{int64(11), "👍", insertedAt}}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+func (c accountExportConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arg := func(i int) driver.Value { return args[i].Value }
+
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO audit_log"):
+	case strings.HasPrefix(query, "INSERT INTO account_export_parts"):
+		id := arg(0).(string)
+		if s.parts[id] == nil {
+			s.parts[id] = make(map[string][]byte)
+		}
+		s.parts[id][arg(1).(string)] = arg(2).([]byte)
+	case strings.HasPrefix(query, "UPDATE account_exports SET progress"):
+		job := s.jobs[arg(0).(string)]
+		job.progress, job.updatedAt = arg(1).(int64), arg(2).(time.Time)
+	case strings.HasPrefix(query, "UPDATE account_exports SET status = 'done'"):
+		job := s.jobs[arg(0).(string)]
+		finishedAt := arg(2).(time.Time)
+		job.status, job.archive, job.updatedAt, job.finishedAt = "done", arg(1).([]byte), finishedAt, &finishedAt
+	case strings.HasPrefix(query, "DELETE FROM account_export_parts"):
+		delete(s.parts, arg(0).(string))
+	case strings.HasPrefix(query, "DELETE FROM account_exports"):
+		for id, job := range s.jobs {
+			if job.finishedAt != nil && job.finishedAt.Before(arg(0).(time.Time)) {
+				delete(s.jobs, id)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func initAccountExportStore(t *testing.T) *accountExportStore {
+	store := &accountExportStore{jobs: make(map[string]*exportJob), parts: make(map[string]map[string][]byte)}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func accountExportRequest(t *testing.T, userID int, method, path string) (*httptest.ResponseRecorder, AccountExport) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, userID, method, path, nil))
+	var job AccountExport
+	if strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		json.NewDecoder(bytes.NewReader(rr.Body.Bytes())).Decode(&job)
+	}
+	return rr, job
+}
+
+// unzipExport returns the files of an archive by name.
+func unzipExport(t *testing.T, archive []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestAccountExportArchive(t *testing.T) {
+	initRedis(t)
+	store := initAccountExportStore(t)
+	exporter := NewAccountExporter()
+	// Download links run from the wall clock, and a job that finished
+	// long ago has none.
+	exporter.Clock = newFakeClock(time.Now())
+
+	rr, job := accountExportRequest(t, 4, "POST", "/users/4/export")
+	assert.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	assert.Equal(t, "/exports/"+job.ID, rr.Header().Get("Location"))
+	assert.Equal(t, "pending", job.Status)
+	assert.Equal(t, len(accountExportParts), job.Total)
+	rr, again := accountExportRequest(t, 4, "POST", "/users/4/export")
+	assert.Equal(t, http.StatusOK, rr.Code, "a second request returns the job under way")
+	assert.Equal(t, job.ID, again.ID)
+	rr, _ = accountExportRequest(t, 5, "POST", "/users/4/export")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only the user can export their account")
+	rr, _ = accountExportRequest(t, 5, "GET", "/exports/"+job.ID)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.NoError(t, exporter.runPending(context.Background()))
+	rr, job = accountExportRequest(t, 4, "GET", "/exports/"+job.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "done", job.Status)
+	assert.Equal(t, job.Total, job.Progress)
+	if !assert.NotEmpty(t, job.DownloadURL) {
+		return
+	}
+	assert.Empty(t, store.parts, "the parts are dropped once zipped")
+
+	download := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		return rr
+	}
+	rr = download(job.DownloadURL)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+	files := unzipExport(t, rr.Body.Bytes())
+	assert.Len(t, files, len(accountExportParts))
+
+	var profile User
+	assert.NoError(t, json.Unmarshal([]byte(files["profile.json"]), &profile))
+	assert.Equal(t, User{ID: 4, Username: "dana", Email: "dana@example.com", CreatedAt: insertedAt, UpdatedAt: insertedAt}, profile)
+	var contacts []exportedContact
+	assert.NoError(t, json.Unmarshal([]byte(files["contacts.json"]), &contacts))
+	if assert.Len(t, contacts, 1) {
+		assert.Equal(t, "accepted", contacts[0].Status)
+	}
+	var sent, received []exportedMessage
+	assert.NoError(t, json.Unmarshal([]byte(files["messages_sent.json"]), &sent))
+	assert.NoError(t, json.Unmarshal([]byte(files["messages_received.json"]), &received))
+	assert.Equal(t, []exportedMessage{{ID: 10, SenderID: 4, RecipientID: 5, Text: "hello, five", SentAt: insertedAt}}, sent)
+	assert.Equal(t, []exportedMessage{{ID: 11, SenderID: 5, RecipientID: 4, Text: "hi, four", SentAt: insertedAt}}, received)
+	var reactions []exportedReaction
+	assert.NoError(t, json.Unmarshal([]byte(files["reactions.json"]), &reactions))
+	assert.Equal(t, []exportedReaction{{MessageID: 11, Emoji: "👍", CreatedAt: insertedAt}}, reactions)
+
+	assert.Equal(t, http.StatusForbidden, download(strings.Replace(job.DownloadURL, "sig=", "sig=00", 1)).Code)
+	expired := time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, http.StatusGone, download(fmt.Sprintf("/exports/%s/download?expires=%d&sig=%s", job.ID, expired, signExportDownload(job.ID, expired))).Code)
+
+	// Finished archives are deleted after the retention period.
+	exporter.Clock.(*fakeClock).Advance(exporter.Retention + time.Second)
+	assert.NoError(t, exporter.purge(context.Background()))
+	assert.Equal(t, http.StatusNotFound, download(job.DownloadURL).Code)
+}
+
+func TestAccountExportResumes(t *testing.T) {
+	initRedis(t)
+	store := initAccountExportStore(t)
+	clock := newFakeClock(insertedAt)
+	exporter := NewAccountExporter()
+	exporter.Clock = clock
+
+	// A job interrupted after its first two parts, as a restart leaves it.
+	store.jobs["4b1d2f7e-0000-4000-8000-000000000001"] = &exportJob{userID: 4, status: "running", progress: 2, createdAt: insertedAt, updatedAt: insertedAt}
+	store.parts["4b1d2f7e-0000-4000-8000-000000000001"] = map[string][]byte{
+		"profile.json":  []byte(`"written before"`),
+		"contacts.json": []byte(`[]`),
+	}
+
+	assert.NoError(t, exporter.runPending(context.Background()))
+	assert.Equal(t, "running", store.jobs["4b1d2f7e-0000-4000-8000-000000000001"].status, "a job still within its lease is left alone")
+	assert.Empty(t, store.collected)
+
+	clock.Advance(exporter.Lease + time.Second)
+	assert.NoError(t, exporter.runPending(context.Background()))
+	job := store.jobs["4b1d2f7e-0000-4000-8000-000000000001"]
+	assert.Equal(t, "done", job.status)
+	assert.Equal(t, int64(len(accountExportParts)), job.progress)
+	assert.Equal(t, []string{"messages", "messages", "reactions"}, store.collected, "only the missing parts are collected")
+	files := unzipExport(t, job.archive)
+	assert.Equal(t, `"written before"`, files["profile.json"])
+	assert.Contains(t, files["reactions.json"], "👍")
+}
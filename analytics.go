@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	mathrand "math/rand"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel"
+)
+
+// messageFeatures is everything the analytics rollup is allowed to know about
+// a message. It must never carry message text, its exact length or raw user
+// IDs.
+type messageFeatures struct {
+	Day              time.Time
+	HourOfDay        int
+	LengthBucket     string
+	Kind             string
+	ConversationType string
+	HasAttachment    bool
+	AttachmentTypes  []string
+	HasEmoji         bool
+	SenderHash       string
+}
+
+// lengthBucketMidpoints stand in for the lengths of the messages in each
+// bucket when their average is estimated.
+var lengthBucketMidpoints = map[string]float64{
+	"0-9":     5,
+	"10-49":   30,
+	"50-199":  125,
+	"200-999": 600,
+	"1000+":   1000,
+}
+
+type analyticsSampler struct {
+	enabled bool
+	rate    float64
+	salt    []byte
+	random  func() float64
+}
+
+var sampler = newAnalyticsSampler(cfg)
+
+func newAnalyticsSampler(c Config) *analyticsSampler {
+	salt := []byte(c.AnalyticsSalt)
+	if len(salt) == 0 {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			log.Println("Failed to generate analytics salt, disabling sampling:", err)
+			return &analyticsSampler{}
+		}
+	}
+
+	return &analyticsSampler{
+		enabled: c.AnalyticsEnabled && c.AnalyticsSampleRate > 0,
+		rate:    c.AnalyticsSampleRate,
+		salt:    salt,
+		random:  mathrand.Float64,
+	}
+}
+
+func lengthBucket(n int) string {
+	switch {
+	case n < 10:
+		return "0-9"
+	case n < 50:
+		return "10-49"
+	case n < 200:
+		return "50-199"
+	case n < 1000:
+		return "200-999"
+	default:
+		return "1000+"
+	}
+}
+
+// messageKind is what kind of message msg is for the rollup: the Kind the
+// server gave it, or else a forward, an attachment without text or text.
+func messageKind(msg Message) string {
+	switch {
+	case msg.Kind != "":
+		return msg.Kind
+	case msg.ForwardedFrom != nil:
+		return "forward"
+	case len(msg.Attachments) > 0 && strings.TrimSpace(msg.Text) == "":
+		return "attachment"
+	}
+	return "text"
+}
+
+// conversationType is "room" for room messages and "dm" for direct ones.
+func conversationType(msg Message) string {
+	if msg.RoomID != 0 {
+		return "room"
+	}
+	return "dm"
+}
+
+// attachmentType is the top-level media type of an attachment, or "other"
+// for one that is not a known type.
+func attachmentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "other"
+	}
+	switch major, _, _ := strings.Cut(mediaType, "/"); major {
+	case "image", "video", "audio", "text", "application":
+		return major
+	}
+	return "other"
+}
+
+func containsEmoji(text string) bool {
+	for _, r := range text {
+		if unicode.Is(unicode.So, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *analyticsSampler) hashID(id int) string {
+	h := sha256.New()
+	h.Write(s.salt)
+	h.Write([]byte(strconv.Itoa(id)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// extractFeatures reduces msg to its non-content features. It reports false
+// for messages that must never be sampled, such as end-to-end encrypted ones.
+func (s *analyticsSampler) extractFeatures(msg Message, at time.Time) (messageFeatures, bool) {
+	if msg.Encrypted {
+		return messageFeatures{}, false
+	}
+
+	at = at.UTC()
+	var types []string
+	for _, a := range msg.Attachments {
+		types = append(types, attachmentType(a.ContentType))
+	}
+	return messageFeatures{
+		Day:              time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC),
+		HourOfDay:        at.Hour(),
+		LengthBucket:     lengthBucket(utf8.RuneCountInString(msg.Text)),
+		Kind:             messageKind(msg),
+		ConversationType: conversationType(msg),
+		HasAttachment:    len(msg.Attachments) > 0,
+		AttachmentTypes:  types,
+		HasEmoji:         containsEmoji(msg.Text),
+		SenderHash:       s.hashID(msg.SenderID),
+	}, true
+}
+
+// sampleMessage samples a stored message into the analytics rollup. The
+// message is stored already, so failures are only logged.
+func sampleMessage(ctx context.Context, msg Message, at time.Time) {
+	if err := sampler.record(ctx, msg, at); err != nil {
+		logger(ctx).Println("Failed to record message analytics:", err)
+	}
+}
+
+// record samples msg into the analytics rollup according to the configured
+// sample rate.
+func (s *analyticsSampler) record(ctx context.Context, msg Message, at time.Time) error {
+	if !s.enabled || s.random() >= s.rate {
+		return nil
+	}
+
+	f, ok := s.extractFeatures(msg, at)
+	if !ok {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, `INSERT INTO message_analytics
+		(day, hour_of_day, length_bucket, kind, conversation_type, has_attachment, has_emoji, sender_hash, messages)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 1)
+		ON CONFLICT (day, hour_of_day, length_bucket, kind, conversation_type, has_attachment, has_emoji, sender_hash)
+		DO UPDATE SET messages = message_analytics.messages + 1`,
+		f.Day, f.HourOfDay, f.LengthBucket, f.Kind, f.ConversationType, f.HasAttachment, f.HasEmoji, f.SenderHash)
+	if err != nil {
+		return err
+	}
+	for _, mediaType := range f.AttachmentTypes {
+		_, err := db.ExecContext(ctx, `INSERT INTO attachment_analytics (day, attachment_type, attachments) VALUES ($1, $2, 1)
+			ON CONFLICT (day, attachment_type) DO UPDATE SET attachments = attachment_analytics.attachments + 1`,
+			f.Day, mediaType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyticsSummary sums up the rollup. AverageLength is estimated from
+// the length buckets, as exact lengths are not kept.
+type analyticsSummary struct {
+	SampledMessages    int64            `json:"sampled_messages"`
+	DistinctSenders    int64            `json:"distinct_senders"`
+	AverageLength      float64          `json:"average_length"`
+	EmojiRate          float64          `json:"emoji_rate"`
+	AttachmentRate     float64          `json:"attachment_rate"`
+	ByHour             [24]int64        `json:"by_hour"`
+	ByLengthBucket     map[string]int64 `json:"by_length_bucket"`
+	ByKind             map[string]int64 `json:"by_kind"`
+	ByConversationType map[string]int64 `json:"by_conversation_type"`
+	ByAttachmentType   map[string]int64 `json:"by_attachment_type"`
+	SamplingEnabled    bool             `json:"sampling_enabled"`
+	SampleRate         float64          `json:"sample_rate"`
+}
+
+func getAnalytics(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getAnalytics")
+	defer span.End()
+
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "days must be a positive integer")
+			return
+		}
+		days = n
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	summary := analyticsSummary{
+		ByLengthBucket:     map[string]int64{},
+		ByKind:             map[string]int64{},
+		ByConversationType: map[string]int64{},
+		ByAttachmentType:   map[string]int64{},
+		SamplingEnabled:    sampler.enabled,
+		SampleRate:         sampler.rate,
+	}
+
+	var withEmoji, withAttachment int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(messages), 0), COUNT(DISTINCT sender_hash),
+		COALESCE(SUM(messages) FILTER (WHERE has_emoji), 0),
+		COALESCE(SUM(messages) FILTER (WHERE has_attachment), 0)
+		FROM message_analytics WHERE day >= $1`, since).
+		Scan(&summary.SampledMessages, &summary.DistinctSenders, &withEmoji, &withAttachment)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT hour_of_day, SUM(messages) FROM message_analytics
+		WHERE day >= $1 GROUP BY hour_of_day`, since)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour int
+		var count int64
+		if err := rows.Scan(&hour, &count); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if hour >= 0 && hour < 24 {
+			summary.ByHour[hour] = count
+		}
+	}
+
+	for column, target := range map[string]map[string]int64{
+		"length_bucket":     summary.ByLengthBucket,
+		"kind":              summary.ByKind,
+		"conversation_type": summary.ByConversationType,
+	} {
+		if err := countAnalyticsBy(ctx, column, since, target); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := countAttachmentTypes(ctx, since, summary.ByAttachmentType); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if summary.SampledMessages > 0 {
+		total := float64(summary.SampledMessages)
+		var length float64
+		for bucket, count := range summary.ByLengthBucket {
+			length += lengthBucketMidpoints[bucket] * float64(count)
+		}
+		summary.AverageLength = length / total
+		summary.EmojiRate = float64(withEmoji) / total
+		summary.AttachmentRate = float64(withAttachment) / total
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// countAnalyticsBy sums sampled messages grouped by column. column is always
+// one of a fixed set of names, never user input.
+func countAnalyticsBy(ctx context.Context, column string, since time.Time, into map[string]int64) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+column+", SUM(messages) FROM message_analytics WHERE day >= $1 GROUP BY "+column, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var count int64
+		if err := rows.Scan(&key, &count); err != nil {
+			return err
+		}
+		into[key] = count
+	}
+	return rows.Err()
+}
+
+// countAttachmentTypes sums the sampled attachments grouped by type.
+func countAttachmentTypes(ctx context.Context, since time.Time, into map[string]int64) error {
+	rows, err := db.QueryContext(ctx, "SELECT attachment_type, SUM(attachments) FROM attachment_analytics WHERE day >= $1 GROUP BY attachment_type", since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attachmentType string
+		var count int64
+		if err := rows.Scan(&attachmentType, &count); err != nil {
+			return err
+		}
+		into[attachmentType] = count
+	}
+	return rows.Err()
+}
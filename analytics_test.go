@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractFeaturesExcludesContent(t *testing.T) {
+	s := newAnalyticsSampler(Config{AnalyticsEnabled: true, AnalyticsSampleRate: 1, AnalyticsSalt: "pepper"})
+	msg := Message{SenderID: 424242, RecipientID: 737373, Text: "xylophone quokka zeppelin 🚀"}
+
+	f, ok := s.extractFeatures(msg, time.Date(2024, 5, 1, 13, 30, 0, 0, time.UTC))
+	if !assert.True(t, ok) {
+		return
+	}
+
+	assert.Equal(t, 13, f.HourOfDay)
+	assert.Equal(t, "10-49", f.LengthBucket)
+	assert.True(t, f.HasEmoji)
+	assert.Equal(t, "text", f.Kind)
+	assert.Equal(t, "dm", f.ConversationType)
+
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dump := range []string{string(encoded), fmt.Sprintf("%+v", f)} {
+		for _, word := range strings.Fields(msg.Text) {
+			assert.NotContains(t, dump, word, "message text leaked into features")
+		}
+		assert.NotContains(t, dump, "424242", "raw sender id leaked into features")
+		assert.NotContains(t, dump, "737373", "raw recipient id leaked into features")
+	}
+}
+
+func TestExtractFeaturesDerivesKindAndConversation(t *testing.T) {
+	s := newAnalyticsSampler(Config{AnalyticsSalt: "pepper"})
+	cases := []struct {
+		msg                Message
+		kind, conversation string
+		attachmentTypes    []string
+	}{
+		{Message{SenderID: 1, RoomID: 7, Text: "hi room"}, "text", "room", nil},
+		{Message{SenderID: 1, RoomID: 7, Text: "a joined", Kind: MessageKindSystem}, MessageKindSystem, "room", nil},
+		{Message{SenderID: 1, RecipientID: 2, Text: "back soon", Kind: MessageKindAutoReply}, MessageKindAutoReply, "dm", nil},
+		{Message{SenderID: 1, RecipientID: 2, Text: "look", ForwardedFrom: &ForwardedFrom{}}, "forward", "dm", nil},
+		{Message{SenderID: 1, RecipientID: 2, Attachments: []Attachment{
+			{ContentType: "image/png"}, {ContentType: "application/pdf"}, {ContentType: "nonsense"},
+		}}, "attachment", "dm", []string{"image", "application", "other"}},
+	}
+	for _, tc := range cases {
+		f, ok := s.extractFeatures(tc.msg, time.Now())
+		assert.True(t, ok)
+		assert.Equal(t, tc.kind, f.Kind, tc.msg.Text)
+		assert.Equal(t, tc.conversation, f.ConversationType, tc.msg.Text)
+		assert.Equal(t, tc.attachmentTypes, f.AttachmentTypes, tc.msg.Text)
+	}
+}
+
+func TestExtractFeaturesHashesSenderWithSalt(t *testing.T) {
+	a := newAnalyticsSampler(Config{AnalyticsSalt: "a"})
+	b := newAnalyticsSampler(Config{AnalyticsSalt: "b"})
+	msg := Message{SenderID: 1, RecipientID: 2, Text: "hi"}
+
+	fa, _ := a.extractFeatures(msg, time.Now())
+	fa2, _ := a.extractFeatures(msg, time.Now())
+	fb, _ := b.extractFeatures(msg, time.Now())
+
+	assert.Equal(t, fa.SenderHash, fa2.SenderHash)
+	assert.NotEqual(t, fa.SenderHash, fb.SenderHash)
+}
+
+func TestExtractFeaturesSkipsEncrypted(t *testing.T) {
+	s := newAnalyticsSampler(Config{AnalyticsEnabled: true, AnalyticsSampleRate: 1})
+
+	_, ok := s.extractFeatures(Message{SenderID: 1, RecipientID: 2, Text: "ciphertext", Encrypted: true}, time.Now())
+
+	assert.False(t, ok)
+}
+
+func TestSamplerDisabled(t *testing.T) {
+	s := newAnalyticsSampler(Config{AnalyticsEnabled: false, AnalyticsSampleRate: 1})
+
+	// db is not initialised here, so any write would fail.
+	err := s.record(context.Background(), Message{SenderID: 1, RecipientID: 2, Text: "hi"}, time.Now())
+
+	assert.NoError(t, err)
+}
+
+func TestLengthBucket(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "0-9", lengthBucket(9))
+	assert.Equal(t, "10-49", lengthBucket(10))
+	assert.Equal(t, "200-999", lengthBucket(999))
+	assert.Equal(t, "1000+", lengthBucket(1000))
+}
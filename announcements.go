@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	defaultAnnouncementTTL = time.Hour
+	maxAnnouncementTTL     = 7 * 24 * time.Hour
+	// maxStoredAnnouncements is how many announcements are kept for users
+	// who were offline when they went out.
+	maxStoredAnnouncements = 100
+
+	announcementsKey   = "announcements"
+	announcementSeqKey = "announcements:seq"
+)
+
+// announcementDeliveredKey is the set of users an announcement has been
+// delivered to, so each gets it once whether live or on connect.
+func announcementDeliveredKey(id int64) string {
+	return fmt.Sprintf("announcements:%d:delivered", id)
+}
+
+// Announcement is a notice from the operators to every user, such as a
+// maintenance window. Users who are offline get it on their next connect
+// unless it has expired by then.
+type Announcement struct {
+	Type      string    `json:"type"`
+	ID        int64     `json:"id"`
+	Text      string    `json:"text"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type announcementRequest struct {
+	Text             string `json:"text"`
+	ExpiresInSeconds int    `json:"expires_in_seconds"`
+}
+
+type announcementResult struct {
+	DeliveredLive int `json:"delivered_live"`
+	Queued        int `json:"queued"`
+}
+
+func createAnnouncement(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createAnnouncement")
+	defer span.End()
+
+	var req announcementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "text is required")
+		return
+	}
+	ttl := defaultAnnouncementTTL
+	if req.ExpiresInSeconds != 0 {
+		if req.ExpiresInSeconds < 0 || req.ExpiresInSeconds > int(maxAnnouncementTTL/time.Second) {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("expires_in_seconds must be between 1 and %d", int(maxAnnouncementTTL/time.Second)))
+			return
+		}
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+
+	id, err := redisCli.Incr(ctx, announcementSeqKey).Result()
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to store announcement")
+		return
+	}
+	announcement := Announcement{Type: "announcement", ID: id, Text: req.Text, ExpiresAt: time.Now().Add(ttl).UTC()}
+
+	// It is stored before going out live so that a user connecting
+	// meanwhile gets it either way.
+	if err := storeAnnouncement(ctx, announcement); err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to store announcement")
+		return
+	}
+
+	// It goes out like a broadcast, to the users who have not had it yet.
+	// Those it could not be sent to get it on their next connect.
+	reached, missed, err := fanOut(ctx, announcement, announcement.claim)
+	if err == nil {
+		err = announcement.release(ctx, missed)
+	}
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to deliver announcement")
+		return
+	}
+	delivered := len(reached)
+
+	var users int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND banned_at IS NULL").Scan(&users); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	auditCaller(ctx, "announcement_create", fmt.Sprintf("announcement:%d", announcement.ID))
+	result := announcementResult{DeliveredLive: delivered}
+	if users > delivered {
+		result.Queued = users - delivered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// storeAnnouncement adds an announcement to the list delivered on connect,
+// dropping the oldest once there are more than maxStoredAnnouncements.
+func storeAnnouncement(ctx context.Context, a Announcement) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	pipe := redisCli.TxPipeline()
+	pipe.RPush(ctx, announcementsKey, payload)
+	pipe.LTrim(ctx, announcementsKey, -maxStoredAnnouncements, -1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// claim marks the announcement delivered to the users and returns those
+// who had not had it yet, so that each gets it once whether live or on
+// connect.
+func (a Announcement) claim(ctx context.Context, userIDs []string) ([]string, error) {
+	key := announcementDeliveredKey(a.ID)
+	pipe := redisCli.Pipeline()
+	added := make([]*redis.IntCmd, len(userIDs))
+	for i, userID := range userIDs {
+		added[i] = pipe.SAdd(ctx, key, userID)
+	}
+	pipe.ExpireAt(ctx, key, a.ExpiresAt)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var claimed []string
+	for i, userID := range userIDs {
+		if added[i].Val() == 1 {
+			claimed = append(claimed, userID)
+		}
+	}
+	return claimed, nil
+}
+
+// release takes back the claim on users the announcement could not be sent
+// to, leaving it for their next connect.
+func (a Announcement) release(ctx context.Context, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(userIDs))
+	for i, userID := range userIDs {
+		members[i] = userID
+	}
+	return redisCli.SRem(ctx, announcementDeliveredKey(a.ID), members...).Err()
+}
+
+// pendingAnnouncements returns the announcements that have not expired.
+// Connections look them up before they are registered, so an announcement
+// made meanwhile reaches them live instead.
+func pendingAnnouncements(ctx context.Context) ([]Announcement, error) {
+	payloads, err := redisCli.LRange(ctx, announcementsKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var pending []Announcement
+	for _, payload := range payloads {
+		var a Announcement
+		if err := json.Unmarshal([]byte(payload), &a); err != nil {
+			continue
+		}
+		if a.ExpiresAt.After(now) {
+			pending = append(pending, a)
+		}
+	}
+	return pending, nil
+}
+
+// deliverAnnouncements hands the client those of the pending announcements
+// its user has not had yet.
+func deliverAnnouncements(ctx context.Context, c *client, pending []Announcement) error {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	pipe := redisCli.Pipeline()
+	added := make([]*redis.IntCmd, len(pending))
+	for i, a := range pending {
+		added[i] = pipe.SAdd(ctx, announcementDeliveredKey(a.ID), c.userID)
+		pipe.ExpireAt(ctx, announcementDeliveredKey(a.ID), a.ExpiresAt)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// Whatever does not fit in the queue is left for the next connect.
+	pipe = redisCli.Pipeline()
+	missed := 0
+	for i, a := range pending {
+		if added[i].Val() == 0 {
+			continue
+		}
+		if missed > 0 || !c.tryEnqueue(a) {
+			pipe.SRem(ctx, announcementDeliveredKey(a.ID), c.userID)
+			missed++
+		}
+	}
+	if missed == 0 {
+		return nil
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTransport keeps everything written to it.
+type recordingTransport struct {
+	mu      sync.Mutex
+	written []interface{}
+}
+
+func (t *recordingTransport) write(v interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.written = append(t.written, v)
+	return nil
+}
+
+func (t *recordingTransport) shutdown(int, string) {}
+func (t *recordingTransport) abort()               {}
+
+func (t *recordingTransport) announcements() []Announcement {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []Announcement
+	for _, v := range t.written {
+		if a, ok := v.(Announcement); ok {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// connectMock registers a recording connection for the user the way the
+// WebSocket handler would, announcements on connect included.
+func connectMock(t *testing.T, userID int) *recordingTransport {
+	announcements, err := pendingAnnouncements(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingTransport{}
+	c := registry.RegisterTransport(strconv.Itoa(userID), rec, false)
+	go c.writePump()
+	t.Cleanup(func() {
+		registry.Deregister(c)
+		c.close()
+	})
+	if err := deliverAnnouncements(context.Background(), c, announcements); err != nil {
+		t.Error(err)
+	}
+	return rec
+}
+
+// userCountStore answers the user count with a fixed number.
+type userCountStore struct {
+	users int64
+}
+
+func (s userCountStore) Connect(context.Context) (driver.Conn, error) {
+	return userCountConn{users: s.users}, nil
+}
+
+func (s userCountStore) Driver() driver.Driver { return nil }
+
+type userCountConn struct {
+	fakeConn
+	users int64
+}
+
+func (c userCountConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT COUNT(*) FROM users") {
+		return nil, errors.New("not supported")
+	}
+	return &valueRows{column: "count", value: c.users}, nil
+}
+
+func postAnnouncement(t *testing.T, role string, body string) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), 1, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/admin/announcements", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAnnouncementReachesEveryConnection(t *testing.T) {
+	initRedis(t)
+	db = sql.OpenDB(userCountStore{users: 150})
+	t.Cleanup(func() { db.Close() })
+
+	const connected = 100
+	recs := make([]*recordingTransport, connected)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = connectMock(t, 5000+i)
+		}(i)
+	}
+	wg.Wait()
+	waitForClients(t, connected)
+
+	// Two operators announcing at once must not get in each other's way.
+	results := make([]announcementResult, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := postAnnouncement(t, RoleAdmin, `{"text":"maintenance at 02:00","expires_in_seconds":3600}`)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			json.NewDecoder(rr.Body).Decode(&results[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		assert.Equal(t, announcementResult{DeliveredLive: connected, Queued: 50}, result)
+	}
+
+	for i, rec := range recs {
+		var got []Announcement
+		assert.Eventually(t, func() bool {
+			got = rec.announcements()
+			return len(got) == 2
+		}, 2*time.Second, 5*time.Millisecond, "connection %d", i)
+		for _, a := range got {
+			assert.Equal(t, "announcement", a.Type)
+			assert.Equal(t, "maintenance at 02:00", a.Text)
+		}
+	}
+}
+
+func TestAnnouncementQueuedUntilConnect(t *testing.T) {
+	mr := initRedis(t)
+	db = sql.OpenDB(userCountStore{users: 3})
+	t.Cleanup(func() { db.Close() })
+
+	online := connectMock(t, 5201)
+	waitForClients(t, 1)
+	rr := postAnnouncement(t, RoleAdmin, `{"text":"new terms","expires_in_seconds":60}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = postAnnouncement(t, RoleAdmin, `{"text":"short lived","expires_in_seconds":1}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Eventually(t, func() bool { return len(online.announcements()) == 2 }, 2*time.Second, 5*time.Millisecond)
+
+	// Reconnecting does not repeat what was delivered live.
+	again := connectMock(t, 5201)
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, again.announcements())
+
+	// An offline user gets what has not expired by the time they connect.
+	time.Sleep(1100 * time.Millisecond)
+	mr.FastForward(time.Second)
+	offline := connectMock(t, 5202)
+	assert.Eventually(t, func() bool { return len(offline.announcements()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, "new terms", offline.announcements()[0].Text)
+}
+
+func TestCreateAnnouncementValidation(t *testing.T) {
+	initRedis(t)
+
+	assert.Equal(t, http.StatusForbidden, postAnnouncement(t, RoleUser, `{"text":"hi"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, postAnnouncement(t, RoleAdmin, `{"text":"  "}`).Code)
+	assert.Equal(t, http.StatusBadRequest, postAnnouncement(t, RoleAdmin, `{"text":"hi","expires_in_seconds":-5}`).Code)
+	assert.Equal(t, http.StatusBadRequest, postAnnouncement(t, RoleAdmin, `{"text":"hi","expires_in_seconds":99999999}`).Code)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Codes of APIError that are not more specific than the status. Clients can
+// match on them; the message is meant for humans.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeGone                 = "gone"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeValidationFailed     = "validation_failed"
+	codeRateLimited          = "rate_limited"
+	codeInternal             = "internal_error"
+	codeNotImplemented       = "not_implemented"
+	codeBadGateway           = "bad_gateway"
+	codeUnavailable          = "unavailable"
+)
+
+// APIError is the body of every error response, under "error". Details
+// carries whatever else the client needs to act on the error, such as the
+// current version of a message it failed to edit.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// WriteError answers with status and an APIError. The message goes out as
+// is, so it must never carry an error from the database or Redis.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	WriteErrorDetails(w, status, code, message, nil)
+}
+
+// WriteErrorDetails is WriteError with details.
+func WriteErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	h := w.Header()
+	// Like http.Error, drop headers meant for the body that was not sent.
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIErrorResponse{Error: APIError{Code: code, Message: message, Details: details}})
+}
+
+// statusCode is the generic code for status, for errors that have nothing
+// more specific.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusGone:
+		return codeGone
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return codeValidationFailed
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusNotImplemented:
+		return codeNotImplemented
+	case http.StatusBadGateway:
+		return codeBadGateway
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	return codeInternal
+}
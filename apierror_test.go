@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeAPIError(t *testing.T, rr *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var resp APIErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Error
+}
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+	rr := httptest.NewRecorder()
+	WriteError(rr, http.StatusNotFound, codeNotFound, "Message not found")
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.JSONEq(t, `{"error":{"code":"not_found","message":"Message not found"}}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	WriteErrorDetails(rr, http.StatusConflict, "edit_conflict", "edited", EditConflict{CurrentVersion: 3})
+	assert.JSONEq(t, `{"error":{"code":"edit_conflict","message":"edited","details":{"current_version":3}}}`, rr.Body.String())
+}
+
+func TestDBErrorHidesErrors(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{sql.ErrNoRows, http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("load: %w", sql.ErrNoRows), http.StatusNotFound, codeNotFound},
+		{&pgconn.PgError{Code: uniqueViolation, Message: "duplicate key value violates unique constraint \"rooms_pkey\""}, http.StatusConflict, codeConflict},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, codeUnavailable},
+		{gobreaker.ErrOpenState, http.StatusServiceUnavailable, codeUnavailable},
+		{errors.New("dial tcp 10.0.0.5:5432: connection refused"), http.StatusInternalServerError, codeInternal},
+	} {
+		rr := httptest.NewRecorder()
+		dbError(rr, tc.err, http.StatusInternalServerError)
+
+		assert.Equal(t, tc.status, rr.Code, tc.err.Error())
+		body := rr.Body.String()
+		assert.NotContains(t, body, "10.0.0.5")
+		assert.NotContains(t, body, "rooms_pkey")
+		apiErr := decodeAPIError(t, rr)
+		assert.Equal(t, tc.code, apiErr.Code, tc.err.Error())
+		assert.NotEmpty(t, apiErr.Message)
+	}
+
+	rr := httptest.NewRecorder()
+	dbError(rr, errors.New("relation \"users\" does not exist"), http.StatusNotFound)
+	assert.Equal(t, http.StatusNotFound, rr.Code, "other errors answer the status given")
+	assert.Equal(t, APIError{Code: codeNotFound, Message: "Not Found"}, decodeAPIError(t, rr))
+}
+
+func TestRouterErrorsAreStructured(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{"GET", "/no/such/route", http.StatusNotFound, codeNotFound},
+		{"PATCH", "/users", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"GET", "/sessions", http.StatusUnauthorized, codeUnauthorized},
+		{"GET", "/users/abc", http.StatusBadRequest, codeInvalidRequest},
+	} {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, tc.status, rr.Code, tc.path)
+		assert.Equal(t, tc.code, decodeAPIError(t, rr).Code, tc.path)
+	}
+}
+
+func TestSendMessageErrorCodes(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, 1, "POST", "/messages", Message{SenderID: 1, RecipientID: 2, Text: " "}))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, "invalid_message", decodeAPIError(t, rr).Code)
+}
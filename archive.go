@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultConversationListLimit = 50
+	maxConversationListLimit     = 200
+)
+
+// archivedConversationsKey caches the keys of the conversations the user
+// archived. Postgres has the authoritative list; the set is reloaded from it
+// whenever it is missing.
+func archivedConversationsKey(userID int) string {
+	return fmt.Sprintf("user:%d:archived_conversations", userID)
+}
+
+// ConversationSummary is one of the user's direct conversations or rooms, as
+// listed by GET /conversations.
+type ConversationSummary struct {
+	Key            string    `json:"key"`
+	PeerID         int       `json:"peer_id,omitempty"`
+	RoomID         int       `json:"room_id,omitempty"`
+	RoomName       string    `json:"room_name,omitempty"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	Archived       bool      `json:"archived,omitempty"`
+	// MuteUntil is set when the mute ends by itself.
+	Muted     bool       `json:"muted,omitempty"`
+	MuteUntil *time.Time `json:"mute_until,omitempty"`
+	// Unread counts the messages since the caller last marked it read.
+	Unread int64 `json:"unread,omitempty"`
+	// PeerLastSeenAt is when the peer was last around, if they let the
+	// caller see it.
+	PeerLastSeenAt *time.Time `json:"peer_last_seen_at,omitempty"`
+}
+
+// archivedConversations returns the keys of the conversations the user
+// archived, from Redis if it has them.
+func archivedConversations(ctx context.Context, userID int) (map[string]bool, error) {
+	key := archivedConversationsKey(userID)
+	archived := make(map[string]bool)
+	members, err := redisCli.SMembers(ctx, key).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read archived conversations:", err)
+	} else if len(members) > 0 {
+		for _, member := range members {
+			archived[member] = true
+		}
+		return archived, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT conversation_key FROM conversation_archives WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []interface{}
+	for rows.Next() {
+		var conversation string
+		if err := rows.Scan(&conversation); err != nil {
+			return nil, err
+		}
+		archived[conversation] = true
+		keys = append(keys, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		if err := redisCli.SAdd(ctx, key, keys...).Err(); err != nil {
+			logger(ctx).Println("Failed to cache archived conversations:", err)
+		}
+	}
+	return archived, nil
+}
+
+func archiveConversation(w http.ResponseWriter, r *http.Request) {
+	setConversationArchived(w, r, true)
+}
+
+func unarchiveConversation(w http.ResponseWriter, r *http.Request) {
+	setConversationArchived(w, r, false)
+}
+
+// setConversationArchived archives or unarchives the conversation in the
+// path for the caller only. The other participants do not see a change.
+func setConversationArchived(w http.ResponseWriter, r *http.Request, archive bool) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.setConversationArchived")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	conversation := mux.Vars(r)["key"]
+	span.SetAttributes(attribute.String("chat.conversation", conversation), attribute.Bool("chat.archive", archive))
+	err := canReadConversation(ctx, conversation, claims.UserID)
+	if err == errInvalidConversationKey {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	// Having left a room is no reason to keep it archived.
+	if archive && err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	} else if err != nil && err != errNotRoomMember {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	key := archivedConversationsKey(claims.UserID)
+	var cacheErr error
+	if archive {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO conversation_archives (user_id, conversation_key) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			claims.UserID, conversation)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		cacheErr = redisCli.SAdd(ctx, key, conversation).Err()
+	} else {
+		res, err := db.ExecContext(ctx,
+			"DELETE FROM conversation_archives WHERE user_id = $1 AND conversation_key = $2",
+			claims.UserID, conversation)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			WriteError(w, http.StatusNotFound, codeNotFound, "Conversation is not archived")
+			return
+		}
+		cacheErr = redisCli.SRem(ctx, key, conversation).Err()
+	}
+	if cacheErr != nil {
+		// Dropping the set has the next read reload it from Postgres.
+		logger(ctx).Println("Failed to update archived conversations:", cacheErr)
+		redisCli.Del(ctx, key)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listConversations returns a page of the caller's direct conversations
+// and rooms, most recently active first. Archived ones are left out unless
+// include_archived is true. The cursor is the key of the last conversation
+// of the previous page.
+func listConversations(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listConversations")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultConversationListLimit, maxConversationListLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor := query.Get("cursor")
+	includeArchived := false
+	if value := query.Get("include_archived"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid include_archived")
+			return
+		}
+		includeArchived = b
+	}
+
+	archived, err := archivedConversations(ctx, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	mutes, err := userMutes(ctx, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	conversations, err := loadConversations(ctx, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	unread, err := redisCli.HGetAll(ctx, unreadKey(strconv.Itoa(claims.UserID))).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read unread counts:", err)
+	}
+
+	var peers []int
+	for _, conversation := range conversations {
+		if conversation.PeerID != 0 {
+			peers = append(peers, conversation.PeerID)
+		}
+	}
+	seen, err := lastSeenFor(ctx, claims.UserID, peers)
+	if err != nil {
+		logger(ctx).Println("Failed to look up last seen:", err)
+	}
+
+	now := muteClock.Now()
+	listed := []ConversationSummary{}
+	for _, conversation := range conversations {
+		conversation.Archived = archived[conversation.Key]
+		if at, ok := seen[conversation.PeerID]; ok {
+			conversation.PeerLastSeenAt = &at
+		}
+		conversation.Unread, _ = strconv.ParseInt(unread[conversation.Key], 10, 64)
+		if until, ok := mutes[conversation.Key]; ok && (until == nil || until.After(now)) {
+			conversation.Muted = true
+			conversation.MuteUntil = until
+		}
+		if conversation.Archived && !includeArchived {
+			continue
+		}
+		listed = append(listed, conversation)
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].LastActivityAt.After(listed[j].LastActivityAt)
+	})
+
+	// Conversations are all read to be ordered by activity, so they are
+	// counted and paged as they are.
+	total := int64(len(listed))
+	if cursor != "" {
+		i := slices.IndexFunc(listed, func(c ConversationSummary) bool { return c.Key == cursor })
+		if i < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, errInvalidCursor.Error())
+			return
+		}
+		listed = listed[i+1:]
+	}
+	if len(listed) > limit+1 {
+		listed = listed[:limit+1]
+	}
+
+	writePage(w, newKeyedPage(listed, limit, total, func(c ConversationSummary) string { return c.Key }))
+}
+
+// loadConversations returns the user's direct conversations, dated by their
+// newest message, and rooms, dated by their last activity.
+func loadConversations(ctx context.Context, userID int) ([]ConversationSummary, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id), MAX(created_at) FROM messages
+		WHERE (sender_id = $1 OR receiver_id = $1)
+		AND (NOT request OR sender_id = $1)
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		GROUP BY 1, 2`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []ConversationSummary
+	for rows.Next() {
+		var a, b int
+		var conversation ConversationSummary
+		if err := rows.Scan(&a, &b, &conversation.LastActivityAt); err != nil {
+			return nil, err
+		}
+		conversation.Key = conversationKey(Message{SenderID: a, RecipientID: b})
+		conversation.PeerID = a
+		if a == userID {
+			conversation.PeerID = b
+		}
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx,
+		`SELECT r.room_id, r.name, m.joined_at FROM rooms r
+		JOIN room_members m ON m.room_id = r.room_id
+		WHERE m.user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[int]int)
+	for rows.Next() {
+		var conversation ConversationSummary
+		if err := rows.Scan(&conversation.RoomID, &conversation.RoomName, &conversation.LastActivityAt); err != nil {
+			return nil, err
+		}
+		conversation.Key = conversationKey(Message{RoomID: conversation.RoomID})
+		rooms[conversation.RoomID] = len(conversations)
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scores, err := redisCli.ZRangeWithScores(ctx, userRoomsKey(strconv.Itoa(userID)), 0, -1).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read room activity:", err)
+	}
+	for _, z := range scores {
+		id, _ := strconv.Atoi(z.Member.(string))
+		if i, ok := rooms[id]; ok {
+			conversations[i].LastActivityAt = time.Unix(0, int64(z.Score*float64(time.Second))).UTC()
+		}
+	}
+	return conversations, nil
+}
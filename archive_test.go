@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveConversationRejections(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	router := newRouter()
+
+	serve := func(method, key string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 5, method, "/conversations/"+key+"/archive", nil))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "dm:9:3"))
+	assert.Equal(t, http.StatusBadRequest, serve("DELETE", "chat:1"))
+	assert.Equal(t, http.StatusForbidden, serve("POST", "dm:3:9"), "only participants archive a conversation")
+}
+
+func TestArchivedConversationsReadFromRedis(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	ctx := context.Background()
+	redisCli.SAdd(ctx, archivedConversationsKey(5), "dm:3:5", "room:7")
+
+	archived, err := archivedConversations(ctx, 5)
+	assert.NoError(t, err, "the cached set spares the database")
+	assert.Equal(t, map[string]bool{"dm:3:5": true, "room:7": true}, archived)
+}
+
+func TestConversationArchiveLifecycle(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	alice := insertTestUser(t, "hash")
+	bob := insertTestUser(t, "hash")
+	carol := insertTestUser(t, "hash")
+	for _, msg := range []Message{
+		{SenderID: alice, RecipientID: bob, Text: "old chat"},
+		{SenderID: carol, RecipientID: alice, Text: "newer chat"},
+	} {
+		if _, err := storeMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withBob := conversationKey(Message{SenderID: alice, RecipientID: bob})
+	withCarol := conversationKey(Message{SenderID: alice, RecipientID: carol})
+
+	serve := func(userID int, method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, nil))
+		return rr
+	}
+	list := func(userID int, query string) []ConversationSummary {
+		rr := serve(userID, "GET", "/conversations"+query)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var page Page[ConversationSummary]
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page.Items
+	}
+	keys := func(conversations []ConversationSummary) []string {
+		var keys []string
+		for _, c := range conversations {
+			keys = append(keys, c.Key)
+		}
+		return keys
+	}
+
+	assert.Equal(t, []string{withCarol, withBob}, keys(list(alice, "")))
+
+	assert.Equal(t, http.StatusNoContent, serve(alice, "POST", "/conversations/"+withBob+"/archive").Code)
+	assert.Equal(t, http.StatusNoContent, serve(alice, "POST", "/conversations/"+withBob+"/archive").Code, "archiving twice is harmless")
+	assert.Equal(t, []string{withCarol}, keys(list(alice, "")))
+	assert.Equal(t, []string{withBob}, keys(list(bob, "")), "archiving is per user")
+
+	all := list(alice, "?include_archived=true")
+	if assert.Len(t, all, 2) {
+		assert.False(t, all[0].Archived)
+		assert.True(t, all[1].Archived)
+		assert.Equal(t, bob, all[1].PeerID)
+	}
+
+	// Without the cached set the archive comes from Postgres.
+	redisCli.Del(ctx, archivedConversationsKey(alice))
+	assert.Equal(t, []string{withCarol}, keys(list(alice, "")))
+
+	assert.Equal(t, http.StatusNoContent, serve(alice, "DELETE", "/conversations/"+withBob+"/archive").Code)
+	assert.Equal(t, http.StatusNotFound, serve(alice, "DELETE", "/conversations/"+withBob+"/archive").Code)
+	assert.Equal(t, []string{withCarol, withBob}, keys(list(alice, "")))
+
+	rr := serve(alice, "GET", "/conversations?limit=1")
+	var page Page[ConversationSummary]
+	json.NewDecoder(rr.Body).Decode(&page)
+	assert.Equal(t, []string{withCarol}, keys(page.Items))
+	assert.EqualValues(t, 2, page.Total)
+	if assert.NotNil(t, page.NextCursor) {
+		assert.Equal(t, []string{withBob}, keys(list(alice, "?cursor="+*page.NextCursor)))
+	}
+	assert.Equal(t, http.StatusBadRequest, serve(alice, "GET", "/conversations?cursor=dm:0:0").Code)
+}
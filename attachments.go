@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	maxAttachmentsPerMessage = 5
+
+	// multipartMemoryBytes is how much of a multipart body is held in
+	// memory; the rest of the files spill to temporary files.
+	multipartMemoryBytes = 8 << 20
+)
+
+var errAttachmentsDisabled = errors.New("attachments are not configured")
+
+var errAttachmentNotOwned = errors.New("attachment was not uploaded with this message")
+
+// Attachment is a file sent along with a message. Its contents live in S3
+// under ObjectKey.
+type Attachment struct {
+	ID          int    `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// URL is where the file is downloaded from.
+	URL string `json:"url"`
+	// ThumbnailURL points at a preview of image attachments.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	ObjectKey    string `json:"-"`
+}
+
+// attachmentsJSON selects the attachments of the row of messages at hand
+// as a JSON array, for queries that stream messages and cannot load their
+// attachments afterwards. decodeAttachments reads it back.
+const attachmentsJSON = `COALESCE((SELECT json_agg(json_build_object(
+		'id', a.attachment_id, 'filename', a.filename, 'content_type', a.content_type,
+		'size', a.size_bytes, 'thumbnail_url', a.thumbnail_url, 'object_key', a.object_key)
+		ORDER BY a.attachment_id)
+	FROM attachments a WHERE a.message_id = messages.message_id), '[]')`
+
+// decodeAttachments reads the array selected by attachmentsJSON.
+func decodeAttachments(data []byte) ([]Attachment, error) {
+	var rows []struct {
+		Attachment
+		ObjectKey string `json:"object_key"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	for _, row := range rows {
+		a := row.Attachment
+		a.ObjectKey, a.URL = row.ObjectKey, objectURL(row.ObjectKey)
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// objectUploader is the part of the S3 client that stores attachments.
+type objectUploader interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// attachmentStore is nil unless CHAT_S3_BUCKET is set, in which case
+// attachments are uploaded to that bucket.
+var attachmentStore objectUploader
+
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(awsCfg), nil
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// limitMessageBody is limitBody for POST /messages, which takes room for the
+// largest attachments allowed when the body is multipart.
+func limitMessageBody(next http.HandlerFunc) http.HandlerFunc {
+	plain := limitBody(cfg.MaxBodyBytes, next)
+	withAttachments := limitBody(cfg.MaxBodyBytes+maxAttachmentsPerMessage*cfg.MaxAttachmentSizeBytes, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isMultipart(r) {
+			withAttachments(w, r)
+		} else {
+			plain(w, r)
+		}
+	}
+}
+
+// readMultipartMessage reads a message sent as multipart/form-data: the
+// message as JSON in the "message" field and its files as "attachment"
+// parts. It answers the request itself and returns false if that fails.
+// The caller must remove r.MultipartForm when done.
+func readMultipartMessage(w http.ResponseWriter, r *http.Request) (Message, []*multipart.FileHeader, bool) {
+	var message Message
+	if err := r.ParseMultipartForm(multipartMemoryBytes); err != nil {
+		decodeError(w, err)
+		return message, nil, false
+	}
+
+	values := r.MultipartForm.Value["message"]
+	if len(values) != 1 {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "exactly one message part is required")
+		return message, nil, false
+	}
+	if err := json.Unmarshal([]byte(values[0]), &message); err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return message, nil, false
+	}
+
+	files := r.MultipartForm.File["attachment"]
+	if len(files) > maxAttachmentsPerMessage {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("at most %d attachments are allowed", maxAttachmentsPerMessage))
+		return message, nil, false
+	}
+	for _, file := range files {
+		if file.Size > int64(cfg.MaxAttachmentSizeBytes) {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("attachment %q is larger than %d bytes", file.Filename, cfg.MaxAttachmentSizeBytes))
+			return message, nil, false
+		}
+	}
+	return message, files, true
+}
+
+// objectURL is where clients download the object stored under key.
+func objectURL(key string) string {
+	base := cfg.S3PublicURL
+	if base == "" {
+		base = fmt.Sprintf("https://%s.s3.amazonaws.com", cfg.S3Bucket)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + key
+}
+
+// uploadAttachments stores the files in S3 side by side, with a thumbnail
+// next to each image, and records them in Postgres, not yet tied to a
+// message.
+func uploadAttachments(ctx context.Context, uploaderID int, files []*multipart.FileHeader) ([]Attachment, error) {
+	if attachmentStore == nil {
+		return nil, errAttachmentsDisabled
+	}
+
+	attachments := make([]Attachment, len(files))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, file := range files {
+		g.Go(func() error {
+			f, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			// The declared content type is the client's word; the bytes
+			// decide.
+			sniff := make([]byte, 512)
+			n, _ := io.ReadFull(f, sniff)
+			contentType := http.DetectContentType(sniff[:n])
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			attachment := Attachment{
+				Filename:    filepath.Base(file.Filename),
+				ContentType: contentType,
+				Size:        file.Size,
+				ObjectKey:   fmt.Sprintf("attachments/%d/%s", uploaderID, uuid.NewString()),
+			}
+			_, err = attachmentStore.PutObject(gctx, &s3.PutObjectInput{
+				Bucket:        aws.String(cfg.S3Bucket),
+				Key:           aws.String(attachment.ObjectKey),
+				Body:          f,
+				ContentLength: aws.Int64(attachment.Size),
+				ContentType:   aws.String(attachment.ContentType),
+			})
+			if err != nil {
+				return fmt.Errorf("uploading %s: %w", attachment.Filename, err)
+			}
+			attachment.URL = objectURL(attachment.ObjectKey)
+
+			// An image that cannot be decoded is still a fine attachment,
+			// it just comes without a preview.
+			if hasThumbnail(contentType) {
+				if err := uploadThumbnail(gctx, f, &attachment); err != nil {
+					logger(ctx).Printf("Failed to thumbnail %s: %v", attachment.ObjectKey, err)
+				}
+			}
+			attachments[i] = attachment
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i := range attachments {
+		a := &attachments[i]
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO attachments (uploader_id, object_key, filename, content_type, size_bytes, thumbnail_url)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING attachment_id`,
+			uploaderID, a.ObjectKey, a.Filename, a.ContentType, a.Size, a.ThumbnailURL).Scan(&a.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return attachments, tx.Commit()
+}
+
+// uploadThumbnail stores a thumbnail of the image in f next to the
+// attachment and sets its ThumbnailURL.
+func uploadThumbnail(ctx context.Context, f io.ReadSeeker, attachment *Attachment) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	thumb, contentType, err := makeThumbnail(f)
+	if err != nil {
+		return err
+	}
+	key := thumbnailKey(attachment.ObjectKey)
+	_, err = attachmentStore.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(cfg.S3Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(thumb),
+		ContentLength: aws.Int64(int64(len(thumb))),
+		ContentType:   aws.String(contentType),
+	})
+	if err != nil {
+		return err
+	}
+	attachment.ThumbnailURL = objectURL(key)
+	return nil
+}
+
+// linkAttachments ties uploaded attachments to the message they came with.
+// Only attachments the sender uploaded and that are not tied to a message
+// yet can be linked; any other ID fails with errAttachmentNotOwned.
+func linkAttachments(ctx context.Context, messageID, uploaderID int, attachments []Attachment) error {
+	ids := make([]int64, len(attachments))
+	for i, a := range attachments {
+		ids[i] = int64(a.ID)
+	}
+	res, err := db.ExecContext(ctx,
+		"UPDATE attachments SET message_id = $1 WHERE attachment_id = ANY($2) AND uploader_id = $3 AND message_id IS NULL",
+		messageID, ids, uploaderID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != int64(len(ids)) {
+		return errAttachmentNotOwned
+	}
+	return nil
+}
+
+// loadAttachments fills in the attachments of messages, in upload order.
+func loadAttachments(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	byID := make(map[int]*Message, len(messages))
+	for i := range messages {
+		ids[i] = int64(messages[i].ID)
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, attachment_id, filename, content_type, size_bytes, COALESCE(thumbnail_url, ''), object_key
+		FROM attachments WHERE message_id = ANY($1) ORDER BY attachment_id`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int
+		var a Attachment
+		if err := rows.Scan(&messageID, &a.ID, &a.Filename, &a.ContentType, &a.Size, &a.ThumbnailURL, &a.ObjectKey); err != nil {
+			return err
+		}
+		a.URL = objectURL(a.ObjectKey)
+		if msg := byID[messageID]; msg != nil {
+			msg.Attachments = append(msg.Attachments, a)
+		}
+	}
+	return rows.Err()
+}
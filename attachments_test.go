@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockS3 keeps uploaded objects in memory and records how many uploads ran
+// at the same time.
+type mockS3 struct {
+	err error
+
+	mu          sync.Mutex
+	objects     map[string][]byte
+	types       map[string]string
+	inFlight    int
+	maxInFlight int
+}
+
+func (m *mockS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	m.inFlight++
+	m.maxInFlight = max(m.maxInFlight, m.inFlight)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+	}()
+
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Long enough for the other uploads to start meanwhile.
+	time.Sleep(20 * time.Millisecond)
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[*params.Key] = body
+	m.types[*params.Key] = *params.ContentType
+	return &s3.PutObjectOutput{}, nil
+}
+
+func initMockS3(t *testing.T) *mockS3 {
+	mock := &mockS3{objects: make(map[string][]byte), types: make(map[string]string)}
+	attachmentStore = mock
+	t.Cleanup(func() { attachmentStore = nil })
+	return mock
+}
+
+type testFile struct {
+	name, contentType, content string
+}
+
+func postMultipartMessage(t *testing.T, server *httptest.Server, msg Message, files ...testFile) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	payload, _ := json.Marshal(msg)
+	form.WriteField("message", string(payload))
+	for _, file := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="attachment"; filename="`+file.name+`"`)
+		header.Set("Content-Type", file.contentType)
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, file.content)
+	}
+	form.Close()
+
+	req := authedRequest(t, msg.SenderID, "POST", server.URL+"/messages", nil)
+	req.RequestURI = ""
+	req.Body = io.NopCloser(&body)
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestSendMessageWithAttachments(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 2)
+	mock := initMockS3(t)
+	server := newTestServer(t, newRouter())
+
+	resp := postMultipartMessage(t, server, Message{SenderID: 1, RecipientID: 2, Text: "holiday pics"},
+		testFile{"beach.pdf", "image/jpeg", "%PDF-sand"},
+		testFile{"../../sunset.png", "image/png", "sun"},
+		testFile{"notes.txt", "text/plain", "sunscreen"},
+	)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var msg Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotZero(t, msg.ID)
+	if assert.Len(t, msg.Attachments, 3) {
+		a := msg.Attachments[0]
+		assert.Equal(t, Attachment{ID: a.ID, Filename: "beach.pdf", ContentType: "application/pdf", Size: 9, URL: a.URL}, a,
+			"the content type comes from the bytes, not the client")
+		assert.True(t, strings.HasPrefix(a.URL, objectURL("attachments/1/")), a.URL)
+		assert.Equal(t, "sunset.png", msg.Attachments[1].Filename, "directories are stripped")
+		assert.Equal(t, "text/plain; charset=utf-8", msg.Attachments[1].ContentType)
+		assert.NotEqual(t, msg.Attachments[0].ID, msg.Attachments[1].ID)
+	}
+	assert.EqualValues(t, 1, store.linked.Load(), "the attachments are tied to the message")
+
+	var contents []string
+	for key, content := range mock.objects {
+		assert.True(t, strings.HasPrefix(key, "attachments/1/"), key)
+		contents = append(contents, string(content))
+	}
+	assert.ElementsMatch(t, []string{"%PDF-sand", "sun", "sunscreen"}, contents)
+	assert.Greater(t, mock.maxInFlight, 1, "uploads run in parallel")
+}
+
+func TestSendMessageCannotTakeOverAttachments(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 1, 2)
+	initMockS3(t)
+	server := newTestServer(t, newRouter())
+
+	resp := postMultipartMessage(t, server, Message{SenderID: 1, RecipientID: 2, Text: "mine"}, testFile{"secret.pdf", "application/pdf", "plans"})
+	var sent Message
+	if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, sent.Attachments, 1) {
+		return
+	}
+
+	// Naming someone else's attachment in a JSON body attaches nothing.
+	rr := postMessage(Message{SenderID: 2, RecipientID: 1, Text: "now mine", Attachments: sent.Attachments})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var msg Message
+	if err := json.NewDecoder(rr.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, msg.Attachments)
+	assert.EqualValues(t, 1, store.linked.Load(), "only the upload was linked")
+
+	ctx := context.Background()
+	assert.Equal(t, errAttachmentNotOwned, linkAttachments(ctx, msg.ID, 2, sent.Attachments), "another user's attachment")
+	assert.Equal(t, errAttachmentNotOwned, linkAttachments(ctx, msg.ID, 1, sent.Attachments), "an attachment already linked")
+}
+
+func TestSendMessageRejectsBadAttachments(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 2)
+	mock := initMockS3(t)
+	saved := cfg
+	cfg.MaxAttachmentSizeBytes = 10
+	t.Cleanup(func() { cfg = saved })
+	server := newTestServer(t, newRouter())
+	msg := Message{SenderID: 1, RecipientID: 2, Text: "files"}
+
+	resp := postMultipartMessage(t, server, msg, testFile{"small.txt", "text/plain", "ok"}, testFile{"big.bin", "application/octet-stream", strings.Repeat("x", 11)})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "a file over the size limit")
+
+	files := make([]testFile, maxAttachmentsPerMessage+1)
+	for i := range files {
+		files[i] = testFile{"f.txt", "text/plain", "x"}
+	}
+	resp = postMultipartMessage(t, server, msg, files...)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "too many files")
+	assert.Empty(t, mock.objects, "nothing is uploaded from a rejected request")
+
+	mock.err = errors.New("bucket on fire")
+	resp = postMultipartMessage(t, server, msg, testFile{"a.txt", "text/plain", "a"}, testFile{"b.txt", "text/plain", "b"})
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestSendMessageThumbnailsImages(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 2)
+	mock := initMockS3(t)
+	saved := cfg
+	cfg.S3PublicURL = "https://cdn.example.com/"
+	t.Cleanup(func() { cfg = saved })
+	server := newTestServer(t, newRouter())
+
+	resp := postMultipartMessage(t, server, Message{SenderID: 1, RecipientID: 2, Text: "look"},
+		testFile{"wide.png", "image/png", string(encodeTestImage(t, "png", 300, 150))},
+		testFile{"broken.jpg", "image/jpeg", "\xff\xd8\xffnot really a jpeg"},
+	)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var msg Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, msg.Attachments, 2) {
+		return
+	}
+	assert.Equal(t, "image/jpeg", msg.Attachments[1].ContentType)
+	assert.Empty(t, msg.Attachments[1].ThumbnailURL, "an image that does not decode has no thumbnail")
+	assert.Len(t, mock.objects, 3)
+
+	thumbURL := msg.Attachments[0].ThumbnailURL
+	assert.True(t, strings.HasPrefix(thumbURL, "https://cdn.example.com/attachments/1/"), thumbURL)
+	key := strings.TrimPrefix(thumbURL, "https://cdn.example.com/")
+	assert.True(t, strings.HasSuffix(key, "_thumb"), key)
+	assert.Equal(t, "image/png", mock.types[key])
+	config, format, err := image.DecodeConfig(bytes.NewReader(mock.objects[key]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "png", format)
+	assert.Equal(t, thumbnailSize, config.Width)
+	assert.Equal(t, thumbnailSize, config.Height)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	clientInfoKey contextKey = "client_info"
+
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// AuditEvent is an entry of the audit log. ActorID is nil when nobody is
+// signed in, as for a failed login.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	ActorID   *int      `json:"actor_id"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Auditor records security-relevant events. Record never fails what is
+// being audited: errors are logged and dropped.
+type Auditor interface {
+	Record(ctx context.Context, event AuditEvent)
+}
+
+var auditor Auditor = dbAuditor{}
+
+// dbAuditor appends events to the audit_log table.
+type dbAuditor struct{}
+
+func (dbAuditor) Record(ctx context.Context, event AuditEvent) {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO audit_log (actor_id, action, target, ip, user_agent) VALUES ($1, $2, $3, $4, $5)",
+		event.ActorID, event.Action, event.Target, event.IP, event.UserAgent)
+	if err != nil {
+		logger(ctx).Println("Failed to write audit entry:", err)
+	}
+}
+
+// clientInfo is where a request came from, as the audit log records it.
+type clientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// clientInfoMiddleware keeps the client's address and user agent in the
+// request's context for the audit log.
+func clientInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := clientInfo{IP: clientIP(r), UserAgent: r.UserAgent()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey, info)))
+	})
+}
+
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// recordAudit records that the actor did action to target, with the client
+// of the request in ctx. An actorID of 0 records no actor.
+func recordAudit(ctx context.Context, actorID int, action, target string) {
+	info, _ := ctx.Value(clientInfoKey).(clientInfo)
+	event := AuditEvent{Action: action, Target: target, IP: info.IP, UserAgent: info.UserAgent}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	auditor.Record(ctx, event)
+}
+
+// auditCaller records that the signed-in caller did action to target.
+func auditCaller(ctx context.Context, action, target string) {
+	actorID := 0
+	if claims := claimsFromContext(ctx); claims != nil {
+		actorID = claims.UserID
+	}
+	recordAudit(ctx, actorID, action, target)
+}
+
+// userTarget names a user as the target of an audit entry.
+func userTarget(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// listAudit returns a page of audit entries, newest first. actor_id keeps
+// one actor's entries and from and to bound when they were written. The
+// cursor, or before_id as it was called before, is the ID of the last entry
+// of the previous page.
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listAudit")
+	defer span.End()
+
+	query := r.URL.Query()
+	var actorID *int
+	if value := query.Get("actor_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid actor_id")
+			return
+		}
+		actorID = &id
+	}
+	from, err := parseTimeParam(query.Get("from"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid from: "+err.Error())
+		return
+	}
+	to, err := parseTimeParam(query.Get("to"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid to: "+err.Error())
+		return
+	}
+	limit, err := parseLimit(query, defaultAuditLimit, maxAuditLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	var beforeID *int64
+	if cursor != nil {
+		id := int64(*cursor)
+		beforeID = &id
+	} else if value := query.Get("before_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid before_id")
+			return
+		}
+		beforeID = &id
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT audit_id, actor_id, action, target, ip, user_agent, created_at FROM audit_log
+		WHERE ($1::int IS NULL OR actor_id = $1)
+		AND ($2::timestamptz IS NULL OR created_at >= $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)
+		AND ($4::bigint IS NULL OR audit_id < $4)
+		ORDER BY audit_id DESC
+		LIMIT $5`, actorID, from, to, beforeID, limit+1)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		if err := rows.Scan(&event.ID, &event.ActorID, &event.Action, &event.Target, &event.IP, &event.UserAgent, &event.CreatedAt); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, event)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, "audit:"+query.Get("actor_id")+":"+query.Get("from")+":"+query.Get("to"),
+		`SELECT COUNT(*) FROM audit_log
+		WHERE ($1::int IS NULL OR actor_id = $1)
+		AND ($2::timestamptz IS NULL OR created_at >= $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)`, actorID, from, to)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newKeyedPage(entries, limit, total, func(event AuditEvent) string { return strconv.FormatInt(event.ID, 10) }))
+}
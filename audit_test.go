@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingAuditor keeps the events recorded instead of writing them.
+type recordingAuditor struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (a *recordingAuditor) Record(_ context.Context, event AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+}
+
+func (a *recordingAuditor) recorded() []AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AuditEvent(nil), a.events...)
+}
+
+func initRecordingAuditor(t *testing.T) *recordingAuditor {
+	rec := &recordingAuditor{}
+	auditor = rec
+	t.Cleanup(func() { auditor = dbAuditor{} })
+	return rec
+}
+
+func intPtr(n int) *int { return &n }
+
+func stringPtr(s string) *string { return &s }
+
+func TestAuditLogin(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	rec := initRecordingAuditor(t)
+
+	login := func(password string) int {
+		body, _ := json.Marshal(loginRequest{Username: "vishnu", Password: password})
+		req := httptest.NewRequest("POST", "/auth/login", bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.7:51234"
+		req.Header.Set("User-Agent", "audit-test/1.0")
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, login("wrong"))
+	assert.Equal(t, http.StatusOK, login("password123"))
+
+	assert.Equal(t, []AuditEvent{
+		{Action: "login_failed", Target: "username:vishnu", IP: "192.0.2.7", UserAgent: "audit-test/1.0"},
+		{ActorID: intPtr(42), Action: "login", Target: "user:42", IP: "192.0.2.7", UserAgent: "audit-test/1.0"},
+	}, rec.recorded())
+}
+
+func TestAuditBan(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 801, 802)
+	rec := initRecordingAuditor(t)
+	server := newTestServer(t, newRouter())
+
+	assert.Equal(t, http.StatusOK, postBan(t, server, RoleAdmin, 801, "ban").StatusCode)
+	assert.Equal(t, http.StatusOK, postBan(t, server, RoleAdmin, 801, "unban").StatusCode)
+	assert.Equal(t, http.StatusForbidden, postBan(t, server, RoleUser, 801, "ban").StatusCode)
+
+	events := rec.recorded()
+	if assert.Len(t, events, 2) {
+		for i, action := range []string{"ban", "unban"} {
+			assert.Equal(t, action, events[i].Action)
+			assert.Equal(t, intPtr(1), events[i].ActorID)
+			assert.Equal(t, "user:801", events[i].Target)
+			assert.Equal(t, "127.0.0.1", events[i].IP)
+			assert.NotEmpty(t, events[i].UserAgent)
+		}
+	}
+}
+
+func listAuditRecorded(t *testing.T, role, query string) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), 1, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/admin/audit"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestListAuditRejectsBadFilters(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	assert.Equal(t, http.StatusForbidden, listAuditRecorded(t, RoleUser, "").Code)
+	for _, query := range []string{"?actor_id=x", "?from=yesterday", "?to=2024-13-01", "?before_id=x", "?cursor=x", "?limit=0", "?limit=501"} {
+		assert.Equal(t, http.StatusBadRequest, listAuditRecorded(t, RoleAdmin, query).Code, query)
+	}
+}
+
+func TestListAudit(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	actor, other := insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	start := time.Now().Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		recordAudit(ctx, actor, "login", userTarget(actor))
+	}
+	recordAudit(ctx, other, "login", userTarget(other))
+
+	list := func(query string) []AuditEvent {
+		rr := listAuditRecorded(t, RoleAdmin, query)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var page Page[AuditEvent]
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page.Items
+	}
+
+	mine := list(fmt.Sprintf("?actor_id=%d", actor))
+	if assert.Len(t, mine, 3) {
+		assert.Greater(t, mine[0].ID, mine[1].ID, "newest first")
+		for _, entry := range mine {
+			assert.Equal(t, intPtr(actor), entry.ActorID)
+		}
+	}
+
+	rr := listAuditRecorded(t, RoleAdmin, fmt.Sprintf("?actor_id=%d&limit=2", actor))
+	var page Page[AuditEvent]
+	json.NewDecoder(rr.Body).Decode(&page)
+	assert.EqualValues(t, 3, page.Total)
+	if assert.Len(t, page.Items, 2) && assert.NotNil(t, page.NextCursor) {
+		rest := list(fmt.Sprintf("?actor_id=%d&cursor=%s", actor, *page.NextCursor))
+		if assert.Len(t, rest, 1) {
+			assert.Equal(t, mine[2].ID, rest[0].ID)
+		}
+		rest = list(fmt.Sprintf("?actor_id=%d&before_id=%d", actor, page.Items[1].ID))
+		assert.Len(t, rest, 1, "before_id still pages")
+	}
+
+	from := start.UTC().Format(time.RFC3339)
+	assert.Len(t, list(fmt.Sprintf("?actor_id=%d&from=%s", other, from)), 1)
+	assert.Empty(t, list(fmt.Sprintf("?actor_id=%d&to=%s", other, from)))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type Claims struct {
+	UserID int    `json:"uid"`
+	Role   string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type contextKey string
+
+const claimsKey contextKey = "claims"
+
+func newAccessToken(userID int, role, sessionID string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		UserID: userID,
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.AccessTokenTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.JWTSecret))
+}
+
+func parseToken(tokenString string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// bearerToken reads the token from the Authorization header, falling back to
+// the token query parameter for WebSocket upgrades and event streams, where
+// browsers cannot set headers.
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if ok && token != "" {
+		return token, nil
+	}
+	if websocket.IsWebSocketUpgrade(r) || acceptsEventStream(r) {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token, nil
+		}
+	}
+	return "", errors.New("missing bearer token")
+}
+
+var (
+	errSessionRevoked = errors.New("session revoked")
+	errAccountBanned  = errors.New("account banned")
+)
+
+// checkSession checks that the session of a validly signed token is still
+// live and its user not banned, both of which are kept in Redis. It returns
+// errSessionRevoked, errAccountBanned, or the error checking failed with.
+//
+// While the Redis breaker is open, neither can be checked and checkSession
+// fails open: the token is trusted on its signature and expiry alone, so
+// that an outage does not sign every user out. Sessions revoked and users
+// banned meanwhile are turned away once Redis is back, and access tokens
+// are short-lived. Any other failure to check fails closed.
+func checkSession(ctx context.Context, claims *Claims) error {
+	active, err := sessionActive(ctx, claims.ID)
+	if isBreakerOpen(err) {
+		logger(ctx).Println("Redis unavailable, trusting the token alone:", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !active {
+		return errSessionRevoked
+	}
+	if err := touchSession(ctx, claims.ID); err != nil {
+		logger(ctx).Println("Failed to update session:", err)
+	}
+	banned, err := banActive(ctx, claims.UserID, time.Now())
+	if isBreakerOpen(err) {
+		logger(ctx).Println("Redis unavailable, trusting the token alone:", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if banned {
+		return errAccountBanned
+	}
+	return nil
+}
+
+// requireAuth lets through requests carrying a valid token for a live
+// session, with its claims in the context. See checkSession for what it
+// does while Redis is unavailable.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := bearerToken(r)
+		if err != nil {
+			WriteError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+			return
+		}
+
+		claims, err := parseToken(token)
+		if err != nil {
+			WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid token")
+			return
+		}
+
+		switch err := checkSession(r.Context(), claims); err {
+		case nil:
+		case errSessionRevoked:
+			WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Session revoked")
+			return
+		case errAccountBanned:
+			WriteError(w, http.StatusForbidden, codeForbidden, "Account banned")
+			return
+		default:
+			WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to verify session")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// optionalAuth is requireAuth for routes anyone may call: requests without
+// a token go through with no claims.
+func optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	authed := requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := bearerToken(r); err != nil {
+			next(w, r)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// RequireRole only lets requests through whose token carries the given role.
+// It must run inside requireAuth.
+func RequireRole(role string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFromContext(r.Context())
+			if claims == nil || claims.Role != role {
+				WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// promoteAdmins makes admins of the users with the given usernames, so that
+// a new deployment can have its first admin. It returns how many users it
+// promoted; users who already are admins are left alone.
+func promoteAdmins(ctx context.Context, usernames []string) (int64, error) {
+	if len(usernames) == 0 {
+		return 0, nil
+	}
+	folded := make([]string, len(usernames))
+	for i, username := range usernames {
+		folded[i] = usernameFold(username)
+	}
+	result, err := db.ExecContext(ctx,
+		"UPDATE users SET role = $2 WHERE lower(username) = ANY($1) AND role <> $2 AND deleted_at IS NULL",
+		folded, RoleAdmin)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey).(*Claims)
+	return claims
+}
+
+// canAccessUser reports whether the caller may act on the account with the
+// given ID: either it is their own account or they are an admin.
+func canAccessUser(claims *Claims, userID int) bool {
+	if claims == nil {
+		return false
+	}
+	return claims.UserID == userID || claims.Role == RoleAdmin
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func getAdminRoute(t *testing.T, authorization string) int {
+	req := httptest.NewRequest("GET", "/admin/circuit-breakers", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestAdminRoutesRequireAdminRole(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	adminToken, err := createSession(ctx, 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := createSession(ctx, 2, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, getAdminRoute(t, "Bearer "+adminToken))
+	assert.Equal(t, http.StatusForbidden, getAdminRoute(t, "Bearer "+userToken))
+	assert.Equal(t, http.StatusUnauthorized, getAdminRoute(t, ""))
+	assert.Equal(t, http.StatusUnauthorized, getAdminRoute(t, "Bearer not-a-token"))
+}
+
+func TestRequireAuthFailsOpenWhileRedisIsDown(t *testing.T) {
+	mr := initRedis(t)
+	cb := newBreaker("redis", time.Minute)
+	redisCli.AddHook(redisBreakerHook{cb: cb})
+	token, err := createSession(context.Background(), 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, getAdminRoute(t, "Bearer "+token))
+
+	// Until the breaker opens, a failed check fails closed.
+	mr.Close()
+	for i := 0; i < breakerFailureThreshold; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, getAdminRoute(t, "Bearer "+token))
+	}
+	assert.Equal(t, gobreaker.StateOpen, cb.State())
+
+	// Once it has, the token is trusted on its signature alone.
+	assert.Equal(t, http.StatusOK, getAdminRoute(t, "Bearer "+token))
+	assert.Equal(t, http.StatusUnauthorized, getAdminRoute(t, "Bearer not-a-token"))
+	assert.Equal(t, http.StatusUnauthorized, getAdminRoute(t, ""))
+}
+
+func TestPromoteAdmins(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := insertTestUser(t, string(hash))
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE user_id = $1", userID).Scan(&username); err != nil {
+		t.Fatal(err)
+	}
+
+	token := func() string {
+		rr := postLogin(username, "password123")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var resp loginResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + resp.AccessToken
+	}
+	assert.Equal(t, http.StatusForbidden, getAdminRoute(t, token()), "users start without the admin role")
+
+	n, err := promoteAdmins(ctx, []string{strings.ToUpper(username), "nobody"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, http.StatusOK, getAdminRoute(t, token()))
+
+	n, err = promoteAdmins(ctx, []string{username})
+	assert.NoError(t, err)
+	assert.Zero(t, n, "admins are not promoted again")
+}
+
+func TestCheckJWTSecret(t *testing.T) {
+	assert.Error(t, checkJWTSecret(""), "unset")
+	assert.Error(t, checkJWTSecret(strings.Repeat("k", minJWTSecretBytes-1)), "too short")
+	assert.NoError(t, checkJWTSecret(strings.Repeat("k", minJWTSecretBytes)))
+	assert.NoError(t, checkJWTSecret(cfg.JWTSecret), "the tests sign with a valid key")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/image/draw"
+)
+
+const (
+	avatarSize         = 256
+	maxAvatarSizeBytes = 5 << 20
+)
+
+type avatarResponse struct {
+	AvatarURL string `json:"avatar_url"`
+}
+
+func avatarKey(userID int) string {
+	return fmt.Sprintf("avatars/%d.jpg", userID)
+}
+
+// uploadAvatar replaces the caller's avatar with the JPEG or PNG in the
+// "avatar" field of a multipart form, scaled to avatarSize pixels square.
+func uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.uploadAvatar")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	claims := claimsFromContext(ctx)
+	if claims == nil || claims.UserID != userID {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if attachmentStore == nil {
+		WriteError(w, http.StatusNotImplemented, codeNotImplemented, errAttachmentsDisabled.Error())
+		return
+	}
+
+	if err := r.ParseMultipartForm(multipartMemoryBytes); err != nil {
+		decodeError(w, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["avatar"]
+	if len(files) != 1 {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "exactly one avatar part is required")
+		return
+	}
+	if files[0].Size > maxAvatarSizeBytes {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("avatar is larger than %d bytes", maxAvatarSizeBytes))
+		return
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Failed to read avatar")
+		return
+	}
+	defer f.Close()
+
+	// The declared content type is the client's word; the bytes decide.
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(f, sniff)
+	contentType := http.DetectContentType(sniff[:n])
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		WriteError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "avatar must be a JPEG or PNG image")
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to read avatar")
+		return
+	}
+	avatar, err := makeAvatar(f)
+	if err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
+		return
+	}
+
+	key := avatarKey(userID)
+	_, err = attachmentStore.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(cfg.S3Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(avatar),
+		ContentLength: aws.Int64(int64(len(avatar))),
+		ContentType:   aws.String("image/jpeg"),
+	})
+	if err != nil {
+		logger(ctx).Println("Failed to upload avatar:", err)
+		WriteError(w, http.StatusBadGateway, codeBadGateway, "Failed to upload avatar")
+		return
+	}
+
+	// Every avatar of a user shares a key, so the URL carries a version for
+	// caches to tell them apart.
+	avatarURL := fmt.Sprintf("%s?v=%d", objectURL(key), time.Now().Unix())
+	result, err := db.ExecContext(ctx,
+		"UPDATE users SET avatar_url = $1, updated_at = NOW() WHERE user_id = $2 AND deleted_at IS NULL", avatarURL, userID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err := redisCli.Del(ctx, userCacheKey(userID)).Err(); err != nil {
+		logger(ctx).Println("Failed to invalidate cached user:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(avatarResponse{AvatarURL: avatarURL})
+}
+
+// makeAvatar scales the image in r to avatarSize pixels square, cropped
+// around the centre, and encodes it as JPEG.
+func makeAvatar(r io.ReadSeeker) ([]byte, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, centreSquare(src.Bounds()), draw.Src, nil)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	return buf.Bytes(), err
+}
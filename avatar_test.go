@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// avatarStore remembers the avatar URL set for each user.
+type avatarStore struct {
+	mu   sync.Mutex
+	urls map[int64]string
+}
+
+func (s *avatarStore) Connect(context.Context) (driver.Conn, error) {
+	return avatarConn{store: s}, nil
+}
+
+func (s *avatarStore) Driver() driver.Driver { return nil }
+
+type avatarConn struct {
+	fakeConn
+	store *avatarStore
+}
+
+func (c avatarConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "UPDATE users SET avatar_url") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.urls[args[1].Value.(int64)] = args[0].Value.(string)
+	return driver.RowsAffected(1), nil
+}
+
+func postAvatar(t *testing.T, server *httptest.Server, userID, token string, content []byte) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("avatar", "avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/users/"+userID+"/avatar", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func setUpAvatarTest(t *testing.T) (*httptest.Server, *avatarStore, *mockS3, string) {
+	initRedis(t)
+	mock := initMockS3(t)
+	store := &avatarStore{urls: make(map[int64]string)}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	saved := cfg
+	cfg.S3PublicURL = "https://cdn.example.com"
+	t.Cleanup(func() { cfg = saved })
+
+	token, err := createSession(context.Background(), 9, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, newRouter())
+	return server, store, mock, token
+}
+
+func TestUploadAvatar(t *testing.T) {
+	server, store, mock, token := setUpAvatarTest(t)
+	ctx := context.Background()
+	if err := cacheUser(ctx, User{ID: 9, Username: "nine"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := postAvatar(t, server, "9", token, encodeTestImage(t, "png", 600, 300))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body avatarResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(body.AvatarURL, "https://cdn.example.com/avatars/9.jpg?v="), body.AvatarURL)
+	assert.Equal(t, body.AvatarURL, store.urls[9])
+
+	assert.Equal(t, "image/jpeg", mock.types["avatars/9.jpg"])
+	config, format, err := image.DecodeConfig(bytes.NewReader(mock.objects["avatars/9.jpg"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, avatarSize, config.Width)
+	assert.Equal(t, avatarSize, config.Height)
+
+	cached, err := cachedUser(ctx, 9)
+	assert.NoError(t, err)
+	assert.Nil(t, cached, "the cached profile is dropped")
+}
+
+func TestUploadAvatarRejectsBadInput(t *testing.T) {
+	server, store, mock, token := setUpAvatarTest(t)
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10"/></svg>`)
+	resp := postAvatar(t, server, "9", token, svg)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp = postAvatar(t, server, "10", token, encodeTestImage(t, "png", 10, 10))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "another user's avatar")
+
+	resp = postAvatar(t, server, "9", token, bytes.Repeat([]byte{0}, maxAvatarSizeBytes+1))
+	io.Copy(io.Discard, resp.Body)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "a file over the size limit")
+
+	assert.Empty(t, mock.objects)
+	assert.Empty(t, store.urls)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+// MessageKindAutoReply is the Kind of a message sent from a user's away
+// message. Nothing replies to it automatically, so two away users do not
+// answer each other.
+const MessageKindAutoReply = "auto_reply"
+
+const maxAwayMessageRunes = 500
+
+// awayClock decides whether an away message is within its window.
+var awayClock Clock = realClock{}
+
+// AwayMessage is sent on a user's behalf in reply to direct messages that
+// arrive while they are offline, if it is enabled and now is between
+// ValidFrom and ValidUntil. Either end may be left open.
+type AwayMessage struct {
+	Text       string     `json:"text"`
+	Enabled    bool       `json:"enabled"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// activeAt reports whether the away message is to be sent at now.
+func (a AwayMessage) activeAt(now time.Time) bool {
+	return a.Enabled &&
+		(a.ValidFrom == nil || !now.Before(*a.ValidFrom)) &&
+		(a.ValidUntil == nil || now.Before(*a.ValidUntil))
+}
+
+func awayCooldownKey(senderID, recipientID int) string {
+	return fmt.Sprintf("away:cooldown:%d:%d", senderID, recipientID)
+}
+
+func loadAwayMessage(ctx context.Context, userID int) (AwayMessage, error) {
+	var away AwayMessage
+	err := db.QueryRowContext(ctx,
+		"SELECT text, enabled, valid_from, valid_until FROM away_messages WHERE user_id = $1", userID).
+		Scan(&away.Text, &away.Enabled, &away.ValidFrom, &away.ValidUntil)
+	return away, err
+}
+
+// replyAway answers a direct message to an offline user with their away
+// message, unless its sender got it within cfg.AwayReplyCooldown.
+func replyAway(ctx context.Context, msg Message) {
+	if msg.RoomID != 0 || msg.Kind != "" || msg.SenderID == msg.RecipientID {
+		return
+	}
+	if len(registry.Connections(strconv.Itoa(msg.RecipientID))) > 0 {
+		return
+	}
+	away, err := loadAwayMessage(ctx, msg.RecipientID)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		logger(ctx).Println("Failed to look up away message:", err)
+		return
+	}
+	if !away.activeAt(awayClock.Now()) {
+		return
+	}
+	first, err := redisCli.SetNX(ctx, awayCooldownKey(msg.SenderID, msg.RecipientID), 1, cfg.AwayReplyCooldown).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to check away message cooldown:", err)
+		return
+	} else if !first {
+		return
+	}
+
+	reply, err := storeMessage(ctx, Message{SenderID: msg.RecipientID, RecipientID: msg.SenderID, Text: away.Text, Kind: MessageKindAutoReply})
+	if err != nil {
+		logger(ctx).Println("Failed to store away message:", err)
+		return
+	}
+	publishMessage(ctx, reply)
+}
+
+// updateAwayMessage sets the away message of the user in the path.
+func updateAwayMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updateAwayMessage")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var away AwayMessage
+	if err := json.NewDecoder(r.Body).Decode(&away); err != nil {
+		decodeError(w, err)
+		return
+	}
+	away.Text = strings.TrimSpace(away.Text)
+	if away.Text == "" || utf8.RuneCountInString(away.Text) > maxAwayMessageRunes {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("text must be 1 to %d characters", maxAwayMessageRunes))
+		return
+	}
+	if away.ValidFrom != nil && away.ValidUntil != nil && !away.ValidFrom.Before(*away.ValidUntil) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "valid_until must be after valid_from")
+		return
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO away_messages (user_id, text, enabled, valid_from, valid_until) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET text = EXCLUDED.text, enabled = EXCLUDED.enabled,
+			valid_from = EXCLUDED.valid_from, valid_until = EXCLUDED.valid_until, updated_at = NOW()`,
+		userID, away.Text, away.Enabled, away.ValidFrom, away.ValidUntil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(away)
+}
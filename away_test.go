@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// awayStore keeps users' away messages and counts the messages stored.
+type awayStore struct {
+	mu      sync.Mutex
+	away    map[int64]AwayMessage
+	replies []Message
+}
+
+func (s *awayStore) Connect(context.Context) (driver.Conn, error) {
+	return awayConn{store: s}, nil
+}
+
+func (s *awayStore) Driver() driver.Driver { return nil }
+
+func (s *awayStore) stored() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.replies...)
+}
+
+type awayConn struct {
+	fakeConn
+	store *awayStore
+}
+
+func (awayConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+func (c awayConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT text, enabled, valid_from, valid_until FROM away_messages"):
+		rows := &tableRows{columns: []string{"text", "enabled", "valid_from", "valid_until"}}
+		if away, ok := s.away[args[0].Value.(int64)]; ok {
+			row := []driver.Value{away.Text, away.Enabled, nil, nil}
+			if away.ValidFrom != nil {
+				row[2] = *away.ValidFrom
+			}
+			if away.ValidUntil != nil {
+				row[3] = *away.ValidUntil
+			}
+			rows.rows = append(rows.rows, row)
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT INTO messages"):
+		msg := Message{ID: len(s.replies) + 100, SenderID: int(args[0].Value.(int64)), RecipientID: int(args[1].Value.(int64)), Text: args[2].Value.(string)}
+		s.replies = append(s.replies, msg)
+		return &tableRows{columns: []string{"message_id", "seq", "created_at", "updated_at"},
+			rows: [][]driver.Value{{int64(msg.ID), int64(msg.ID), insertedAt, insertedAt}}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c awayConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "INSERT INTO away_messages") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	away := AwayMessage{Text: args[1].Value.(string), Enabled: args[2].Value.(bool)}
+	if from, ok := args[3].Value.(time.Time); ok {
+		away.ValidFrom = &from
+	}
+	if until, ok := args[4].Value.(time.Time); ok {
+		away.ValidUntil = &until
+	}
+	s.away[args[0].Value.(int64)] = away
+	return driver.RowsAffected(1), nil
+}
+
+func initAwayStore(t *testing.T, away map[int64]AwayMessage) *awayStore {
+	store := &awayStore{away: away}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func useAwayClock(t *testing.T, clock Clock) {
+	previous := awayClock
+	awayClock = clock
+	t.Cleanup(func() { awayClock = previous })
+}
+
+// sendDirect publishes a direct message from 1 to 2 and returns the away
+// replies stored since the last call.
+func sendDirect(store *awayStore, seen *int) []Message {
+	publishMessage(context.Background(), Message{ID: 1, SenderID: 1, RecipientID: 2, Text: "are you there?"})
+	stored := store.stored()
+	replies := stored[*seen:]
+	*seen = len(stored)
+	return replies
+}
+
+func TestAwayReplyCooldown(t *testing.T) {
+	mr := initRedis(t)
+	store := initAwayStore(t, map[int64]AwayMessage{2: {Text: "On holiday until Monday", Enabled: true}})
+	sender, _ := connectRecorder(t, "1")
+	var seen int
+
+	replies := sendDirect(store, &seen)
+	assert.Equal(t, []Message{{ID: 100, SenderID: 2, RecipientID: 1, Text: "On holiday until Monday"}}, replies)
+	got := waitForMessages(t, sender, 1)[0]
+	assert.Equal(t, MessageKindAutoReply, got.Kind)
+	assert.Equal(t, 2, got.SenderID)
+
+	assert.Empty(t, sendDirect(store, &seen), "the sender was answered already")
+	mr.FastForward(cfg.AwayReplyCooldown - time.Second)
+	assert.Empty(t, sendDirect(store, &seen))
+	mr.FastForward(time.Second)
+	assert.Len(t, sendDirect(store, &seen), 1, "the cooldown ran out")
+}
+
+func TestAwayReplyWindow(t *testing.T) {
+	initRedis(t)
+	clock := newFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC))
+	useAwayClock(t, clock)
+	from, until := clock.Now().Add(time.Hour), clock.Now().Add(2*time.Hour)
+	store := initAwayStore(t, map[int64]AwayMessage{2: {Text: "Out of office", Enabled: true, ValidFrom: &from, ValidUntil: &until}})
+	var seen int
+
+	assert.Empty(t, sendDirect(store, &seen), "the window has not opened")
+	clock.Advance(time.Hour)
+	assert.Len(t, sendDirect(store, &seen), 1)
+
+	redisCli.Del(context.Background(), awayCooldownKey(1, 2))
+	clock.Advance(time.Hour)
+	assert.Empty(t, sendDirect(store, &seen), "the window has closed")
+
+	store.mu.Lock()
+	store.away[2] = AwayMessage{Text: "Out of office", Enabled: false}
+	store.mu.Unlock()
+	assert.Empty(t, sendDirect(store, &seen), "a disabled away message is not sent")
+}
+
+func TestAwayReplySkipsOnlineAndAwayUsers(t *testing.T) {
+	initRedis(t)
+	store := initAwayStore(t, map[int64]AwayMessage{
+		1: {Text: "Back soon", Enabled: true},
+		2: {Text: "On holiday", Enabled: true},
+	})
+	var seen int
+
+	// An away reply is never answered with another one.
+	assert.Len(t, sendDirect(store, &seen), 1)
+
+	redisCli.Del(context.Background(), awayCooldownKey(1, 2))
+	connectRecorder(t, "2")
+	assert.Empty(t, sendDirect(store, &seen), "the recipient is online")
+}
+
+func TestUpdateAwayMessage(t *testing.T) {
+	initRedis(t)
+	store := initAwayStore(t, map[int64]AwayMessage{})
+	router := newRouter()
+	serve := func(userID int, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, "PUT", "/users/2/away-message", body))
+		return rr
+	}
+
+	from := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+	rr := serve(2, AwayMessage{Text: " On holiday ", Enabled: true, ValidFrom: &from, ValidUntil: &until})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	store.mu.Lock()
+	assert.Equal(t, AwayMessage{Text: "On holiday", Enabled: true, ValidFrom: &from, ValidUntil: &until}, store.away[2])
+	store.mu.Unlock()
+
+	for _, body := range []AwayMessage{
+		{Enabled: true},
+		{Text: strings.Repeat("z", maxAwayMessageRunes+1)},
+		{Text: "Backwards", ValidFrom: &until, ValidUntil: &from},
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, serve(2, body).Code, body)
+	}
+	assert.Equal(t, http.StatusForbidden, serve(3, AwayMessage{Text: "Not mine"}).Code)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxBanReasonLength = 500
+
+	// bannedUsersKey is a sorted set of the banned users, scored by the Unix
+	// time their ban runs out at, or +inf.
+	bannedUsersKey = "banned_users"
+)
+
+type banRequest struct {
+	Reason        string `json:"reason"`
+	DurationHours int    `json:"duration_hours"`
+}
+
+// Ban is one ban of an account. A ban without ExpiresAt lasts until it is
+// lifted.
+type Ban struct {
+	UserID    int
+	BannedBy  int
+	Reason    string
+	ExpiresAt *time.Time
+}
+
+type banResult struct {
+	UserID       int        `json:"user_id"`
+	Banned       bool       `json:"banned"`
+	Reason       string     `json:"reason,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Disconnected int        `json:"disconnected"`
+}
+
+// banUser bans an account, for duration_hours or until it is lifted: it can
+// no longer log in, call the API or send messages, its sessions are revoked
+// and its sockets closed with 1008. The body is optional. Banning a banned
+// user again records another ban and disconnects it again; the longest ban
+// holds.
+func banUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.banUser")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		decodeError(w, err)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if utf8.RuneCountInString(req.Reason) > maxBanReasonLength {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("reason must be at most %d characters", maxBanReasonLength))
+		return
+	}
+	if req.DurationHours < 0 {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "duration_hours must not be negative")
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if claims.UserID == userID {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "Admins cannot ban themselves")
+		return
+	}
+
+	ban := Ban{UserID: userID, BannedBy: claims.UserID, Reason: req.Reason}
+	if req.DurationHours > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.DurationHours) * time.Hour).UTC()
+		ban.ExpiresAt = &expiresAt
+	}
+	result, err := banAccount(ctx, ban)
+	if !writeBanError(w, err) {
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.disconnected", result.Disconnected))
+	recordAudit(ctx, claims.UserID, "ban", userTarget(userID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+var (
+	errApplyBan       = errors.New("failed to apply ban")
+	errRevokeSessions = errors.New("failed to revoke sessions")
+)
+
+// banAccount records the ban, revokes the user's sessions and closes its
+// sockets. It returns sql.ErrNoRows if there is no such active user.
+func banAccount(ctx context.Context, ban Ban) (banResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return banResult{}, err
+	}
+	defer tx.Rollback()
+	if err := setBanned(ctx, tx, ban.UserID, true); err != nil {
+		return banResult{}, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO bans (user_id, banned_by, reason, expires_at) VALUES ($1, $2, $3, $4)",
+		ban.UserID, ban.BannedBy, ban.Reason, ban.ExpiresAt)
+	if err != nil {
+		return banResult{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return banResult{}, err
+	}
+
+	// The ban is in the cache that sends are checked against and in
+	// banned_users before its sessions go, so that nothing slips through in
+	// between.
+	until := math.Inf(1)
+	if ban.ExpiresAt != nil {
+		until = float64(ban.ExpiresAt.Unix())
+	}
+	pipe := redisCli.TxPipeline()
+	pipe.Set(ctx, userExistsKey(ban.UserID), userBanned, recipientCacheTTL)
+	pipe.ZAddArgs(ctx, bannedUsersKey, redis.ZAddArgs{GT: true, Members: []redis.Z{{Score: until, Member: strconv.Itoa(ban.UserID)}}})
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to cache ban:", err)
+		return banResult{}, errApplyBan
+	}
+	if err := revokeUserSessions(ctx, ban.UserID, ""); err != nil {
+		return banResult{}, errRevokeSessions
+	}
+	return banResult{
+		UserID:       ban.UserID,
+		Banned:       true,
+		Reason:       ban.Reason,
+		ExpiresAt:    ban.ExpiresAt,
+		Disconnected: registry.Disconnect(strconv.Itoa(ban.UserID), websocket.ClosePolicyViolation, "account banned"),
+	}, nil
+}
+
+// banActive reports whether userID is in banned_users with a ban that has
+// not run out by now.
+func banActive(ctx context.Context, userID int, now time.Time) (bool, error) {
+	until, err := redisCli.ZScore(ctx, bannedUsersKey, strconv.Itoa(userID)).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return until > float64(now.Unix()), nil
+}
+
+// writeBanError answers the request and returns false if banAccount failed.
+func writeBanError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == sql.ErrNoRows:
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+	case err == errApplyBan:
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to apply ban")
+	case err == errRevokeSessions:
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to revoke sessions")
+	default:
+		dbError(w, err, http.StatusInternalServerError)
+	}
+	return false
+}
+
+// unbanUser lifts every ban of the user. The user has to log in again.
+func unbanUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.unbanUser")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	if err := liftBans(ctx, userID); err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := forgetBans(ctx, userID); err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to lift ban")
+		return
+	}
+	auditCaller(ctx, "unban", userTarget(userID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(banResult{UserID: userID})
+}
+
+func liftBans(ctx context.Context, userID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := setBanned(ctx, tx, userID, false); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM bans WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetBans drops the user from the ban cache and banned_users.
+func forgetBans(ctx context.Context, userID int) error {
+	pipe := redisCli.TxPipeline()
+	pipe.Del(ctx, userExistsKey(userID))
+	pipe.ZRem(ctx, bannedUsersKey, strconv.Itoa(userID))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// liftExpiredBans deletes the bans that have run out by now and unbans the
+// users left with no other ban.
+func liftExpiredBans(ctx context.Context, now time.Time) error {
+	rows, err := db.QueryContext(ctx,
+		`WITH expired AS (DELETE FROM bans WHERE expires_at <= $1 RETURNING user_id)
+		UPDATE users SET banned_at = NULL
+		WHERE user_id IN (SELECT user_id FROM expired) AND NOT EXISTS (
+			SELECT 1 FROM bans b WHERE b.user_id = users.user_id AND (b.expires_at IS NULL OR b.expires_at > $1)
+		)
+		RETURNING user_id`, now)
+	if err != nil {
+		return err
+	}
+	var lifted []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		lifted = append(lifted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range lifted {
+		if err := forgetBans(ctx, id); err != nil {
+			return err
+		}
+	}
+	return redisCli.ZRemRangeByScore(ctx, bannedUsersKey, "-inf", strconv.FormatInt(now.Unix(), 10)).Err()
+}
+
+// setBanned bans or unbans an account that has not been deleted, returning
+// sql.ErrNoRows if there is none. A ban keeps the time it was first made.
+func setBanned(ctx context.Context, tx *sql.Tx, userID int, banned bool) error {
+	query := "UPDATE users SET banned_at = COALESCE(banned_at, NOW()) WHERE user_id = $1 AND deleted_at IS NULL"
+	if !banned {
+		query = "UPDATE users SET banned_at = NULL WHERE user_id = $1 AND deleted_at IS NULL"
+	}
+	res, err := tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
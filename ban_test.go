@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func postBan(t *testing.T, server *httptest.Server, role string, userID int, action string) *http.Response {
+	return postBanRequest(t, server, role, userID, action, nil)
+}
+
+func postBanRequest(t *testing.T, server *httptest.Server, role string, userID int, action string, body interface{}) *http.Response {
+	token, err := createSession(context.Background(), 1, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/admin/users/"+strconv.Itoa(userID)+"/"+action, payload)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestBanUserDisconnectsAndSilences(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 801, 802)
+	server := newTestServer(t, newRouter())
+
+	conn := dialTestUser(t, server, 801)
+	waitForClients(t, 1)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 801, RecipientID: 802, Text: "before"}).Code)
+
+	resp := postBan(t, server, RoleAdmin, 801, "ban")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result banResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, banResult{UserID: 801, Banned: true, Disconnected: 1}, result)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected policy violation close, got %v", err)
+	sessions, _ := redisCli.SCard(context.Background(), userSessionsKey(801)).Result()
+	assert.Zero(t, sessions, "sessions should be revoked")
+
+	rr := postMessage(Message{SenderID: 801, RecipientID: 802, Text: "after"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), errSenderBanned.Error())
+
+	// Naming another sender in the body does not get around the ban.
+	spoofed, _ := json.Marshal(Message{SenderID: 802, RecipientID: 802, Text: "not me"})
+	rr = httptest.NewRecorder()
+	sendMessage(rr, asUser(httptest.NewRequest("POST", "/messages", bytes.NewReader(spoofed)), 801))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), errSenderBanned.Error())
+
+	// A token issued after the ban took hold does not open a socket.
+	token, err := createSession(context.Background(), 801, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, handshake, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/801?token="+token, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	if handshake != nil {
+		assert.Equal(t, http.StatusForbidden, handshake.StatusCode)
+	}
+
+	resp = postBan(t, server, RoleAdmin, 801, "unban")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 801, RecipientID: 802, Text: "welcome back"}).Code)
+}
+
+func TestMessagesToBannedUser(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 811, 812)
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	server := newTestServer(t, newRouter())
+
+	assert.Equal(t, http.StatusOK, postBan(t, server, RoleAdmin, 812, "ban").StatusCode)
+
+	cfg.MessagesToBannedUsers = true
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 811, RecipientID: 812, Text: "you there?"}).Code)
+
+	cfg.MessagesToBannedUsers = false
+	rr := postMessage(Message{SenderID: 811, RecipientID: 812, Text: "you there?"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), errRecipientBanned.Error())
+}
+
+func TestBanUserRejections(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1, 821)
+	server := newTestServer(t, newRouter())
+
+	assert.Equal(t, http.StatusForbidden, postBan(t, server, RoleUser, 821, "ban").StatusCode)
+	assert.Equal(t, http.StatusNotFound, postBan(t, server, RoleAdmin, 999, "ban").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, postBan(t, server, RoleAdmin, 1, "ban").StatusCode, "admins cannot ban themselves")
+}
+
+func TestBanWithReasonAndExpiry(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 1, 831, 832)
+	server := newTestServer(t, newRouter())
+	ctx := context.Background()
+
+	before := time.Now()
+	resp := postBanRequest(t, server, RoleAdmin, 831, "ban", banRequest{Reason: " spam ", DurationHours: 24})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result banResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "spam", result.Reason)
+	if assert.NotNil(t, result.ExpiresAt) {
+		assert.WithinRange(t, *result.ExpiresAt, before.Add(24*time.Hour-time.Second), time.Now().Add(24*time.Hour))
+	}
+	store.mu.Lock()
+	if assert.Len(t, store.bans, 1) {
+		assert.Equal(t, 1, store.bans[0].BannedBy)
+		assert.Equal(t, "spam", store.bans[0].Reason)
+	}
+	store.mu.Unlock()
+	until, err := redisCli.ZScore(ctx, bannedUsersKey, "831").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(result.ExpiresAt.Unix()), until)
+
+	// A ban without a duration lasts until lifted, and a shorter ban after
+	// it does not cut it short.
+	assert.Equal(t, http.StatusOK, postBan(t, server, RoleAdmin, 832, "ban").StatusCode)
+	assert.Equal(t, http.StatusOK, postBanRequest(t, server, RoleAdmin, 832, "ban", banRequest{DurationHours: 1}).StatusCode)
+	until, _ = redisCli.ZScore(ctx, bannedUsersKey, "832").Result()
+	assert.True(t, math.IsInf(until, 1))
+
+	assert.Equal(t, http.StatusOK, postBan(t, server, RoleAdmin, 832, "unban").StatusCode)
+	assert.Equal(t, redis.Nil, redisCli.ZScore(ctx, bannedUsersKey, "832").Err())
+	store.mu.Lock()
+	assert.Len(t, store.bans, 1, "unbanning removes the user's bans")
+	store.mu.Unlock()
+
+	for _, body := range []interface{}{
+		banRequest{DurationHours: -1},
+		banRequest{Reason: strings.Repeat("x", maxBanReasonLength+1)},
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, postBanRequest(t, server, RoleAdmin, 832, "ban", body).StatusCode)
+	}
+}
+
+func TestBannedUsersRejectedByMiddleware(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 841)
+	ctx := context.Background()
+	// A session that outlived the ban, as one made on another server
+	// between the ban and the revocation could.
+	token, err := createSession(ctx, 841, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		requireAuth(func(w http.ResponseWriter, r *http.Request) {})(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get())
+	redisCli.ZAdd(ctx, bannedUsersKey, &redis.Z{Score: float64(time.Now().Add(time.Hour).Unix()), Member: "841"})
+	assert.Equal(t, http.StatusForbidden, get())
+	redisCli.ZAdd(ctx, bannedUsersKey, &redis.Z{Score: float64(time.Now().Add(-time.Minute).Unix()), Member: "841"})
+	assert.Equal(t, http.StatusOK, get(), "a ban that ran out no longer applies")
+}
+
+func TestLiftExpiredBans(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 1, 851, 852)
+	server := newTestServer(t, newRouter())
+	ctx := context.Background()
+
+	assert.Equal(t, http.StatusOK, postBanRequest(t, server, RoleAdmin, 851, "ban", banRequest{DurationHours: 1}).StatusCode)
+	assert.Equal(t, http.StatusOK, postBanRequest(t, server, RoleAdmin, 852, "ban", banRequest{DurationHours: 48}).StatusCode)
+
+	assert.NoError(t, liftExpiredBans(ctx, time.Now()))
+	assert.Equal(t, int64(2), redisCli.ZCard(ctx, bannedUsersKey).Val(), "no ban has run out yet")
+
+	assert.NoError(t, liftExpiredBans(ctx, time.Now().Add(2*time.Hour)))
+	store.mu.Lock()
+	assert.False(t, store.banned[851])
+	assert.True(t, store.banned[852])
+	store.mu.Unlock()
+	assert.Equal(t, []string{"852"}, redisCli.ZRange(ctx, bannedUsersKey, 0, -1).Val())
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 851, RecipientID: 852, Text: "back"}).Code)
+	assert.Equal(t, http.StatusForbidden, postMessage(Message{SenderID: 852, RecipientID: 851, Text: "still out"}).Code)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// batchColumns is how many bind parameters each row of a batch takes.
+	batchColumns = 5
+	// maxBatchSize keeps a multi-row INSERT under Postgres' limit of 65535
+	// bind parameters, at batchColumns per row.
+	maxBatchSize = 65535 / batchColumns
+
+	batchFlushTimeout = 5 * time.Second
+)
+
+var (
+	errBatcherClosed = errors.New("message batcher closed")
+
+	// errDuplicateMessage is returned by storeMessage, along with the
+	// original message, when the sender already sent one with the same
+	// client_msg_id.
+	errDuplicateMessage = errors.New("duplicate message")
+)
+
+// batcher is nil unless CHAT_BATCH_INSERTS is set, in which case messages
+// are written through it instead of one INSERT each.
+var batcher *MessageBatcher
+
+type insertResult struct {
+	ID        int
+	Seq       int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Err       error
+}
+
+type pendingMessage struct {
+	msg  Message
+	done func(insertResult)
+}
+
+// MessageBatcher collects messages and writes them in multi-row INSERTs,
+// either once MaxSize messages are waiting or FlushInterval after the first
+// one arrived, whichever comes first.
+type MessageBatcher struct {
+	db            *sql.DB
+	maxSize       int
+	flushInterval time.Duration
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan pendingMessage
+	stopped chan struct{}
+}
+
+func NewMessageBatcher(d *sql.DB, maxSize int, flushInterval time.Duration) *MessageBatcher {
+	if maxSize < 1 || maxSize > maxBatchSize {
+		maxSize = maxBatchSize
+	}
+	b := &MessageBatcher{
+		db:            d,
+		maxSize:       maxSize,
+		flushInterval: flushInterval,
+		queue:         make(chan pendingMessage, maxSize),
+		stopped:       make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues msg and calls done with its ID and timestamps once the batch
+// holding it has been written. done runs on the batcher's goroutine and must not block.
+func (b *MessageBatcher) Add(msg Message, done func(insertResult)) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		done(insertResult{Err: errBatcherClosed})
+		return
+	}
+	b.queue <- pendingMessage{msg: msg, done: done}
+}
+
+// Insert queues msg and waits for it to be written, returning it with its
+// ID and timestamps set. If ctx ends first the message may still be written.
+func (b *MessageBatcher) Insert(ctx context.Context, msg Message) (Message, error) {
+	result := make(chan insertResult, 1)
+	b.Add(msg, func(r insertResult) { result <- r })
+	select {
+	case r := <-result:
+		msg.ID, msg.Seq, msg.CreatedAt, msg.UpdatedAt = r.ID, r.Seq, r.CreatedAt, r.UpdatedAt
+		return msg, r.Err
+	case <-ctx.Done():
+		return msg, ctx.Err()
+	}
+}
+
+// Close stops accepting messages and returns once everything already queued
+// has been written.
+func (b *MessageBatcher) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.stopped
+}
+
+func (b *MessageBatcher) run() {
+	defer close(b.stopped)
+
+	var batch []pendingMessage
+	timer := time.NewTimer(b.flushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case p, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) == 1 {
+				timer.Reset(b.flushInterval)
+			}
+			if len(batch) >= b.maxSize {
+				timer.Stop()
+				b.flush(batch)
+				batch = nil
+			}
+		case <-timer.C:
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (b *MessageBatcher) flush(batch []pendingMessage) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), batchFlushTimeout)
+	defer cancel()
+
+	results, err := b.insert(ctx, batch)
+	for i, p := range batch {
+		if err != nil {
+			p.done(insertResult{Err: err})
+		} else {
+			p.done(results[i])
+		}
+	}
+}
+
+// insert writes the batch in one statement. Postgres returns the rows of
+// INSERT ... RETURNING in the order of the VALUES list.
+func (b *MessageBatcher) insert(ctx context.Context, batch []pendingMessage) ([]insertResult, error) {
+	var query strings.Builder
+	query.WriteString("INSERT INTO messages (sender_id, receiver_id, text, expires_at, request) VALUES ")
+	args := make([]interface{}, 0, batchColumns*len(batch))
+	for i, p := range batch {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := batchColumns * i
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+		args = append(args, p.msg.SenderID, p.msg.RecipientID, p.msg.Text, p.msg.ExpiresAt, p.msg.Request)
+	}
+	query.WriteString(" RETURNING message_id, seq, created_at, updated_at")
+
+	rows, err := b.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]insertResult, 0, len(batch))
+	for rows.Next() {
+		var r insertResult
+		if err := rows.Scan(&r.ID, &r.Seq, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(results) != len(batch) {
+		return nil, fmt.Errorf("inserted %d of %d messages", len(results), len(batch))
+	}
+	return results, nil
+}
+
+// storeMessage saves msg and returns it with its ID, sequence number,
+// timestamps and expiry set, going through the batcher when batching is
+// enabled.
+// Messages carrying a client_msg_id are written on their own so a duplicate
+// can be detected. Every message stored is sampled for analytics.
+func storeMessage(ctx context.Context, msg Message) (Message, error) {
+	now := time.Now()
+	setExpiry(&msg, now)
+	msg.Version = 1
+	var err error
+	switch {
+	case msg.ClientMsgID != "":
+		msg, err = storeMessageOnce(ctx, msg)
+	case batcher != nil:
+		msg, err = batcher.Insert(ctx, msg)
+	default:
+		err = db.QueryRowContext(ctx, "INSERT INTO messages (sender_id, receiver_id, text, expires_at, request) VALUES ($1, $2, $3, $4, $5) RETURNING message_id, seq, created_at, updated_at",
+			msg.SenderID, msg.RecipientID, msg.Text, msg.ExpiresAt, msg.Request).Scan(&msg.ID, &msg.Seq, &msg.CreatedAt, &msg.UpdatedAt)
+	}
+	if err == nil {
+		sampleMessage(ctx, msg, now)
+	}
+	return msg, err
+}
+
+// storeMessageOnce inserts msg unless the sender already stored a message
+// with the same client_msg_id, in which case that one is returned with
+// errDuplicateMessage.
+func storeMessageOnce(ctx context.Context, msg Message) (Message, error) {
+	// The sequence number is drawn before the conflict is detected, so a
+	// skipped insert is rolled back to hand it back.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO messages (sender_id, receiver_id, text, client_msg_id, expires_at, request) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING
+		RETURNING message_id, seq, created_at, updated_at`,
+		msg.SenderID, msg.RecipientID, msg.Text, msg.ClientMsgID, msg.ExpiresAt, msg.Request).Scan(&msg.ID, &msg.Seq, &msg.CreatedAt, &msg.UpdatedAt)
+	if err == nil {
+		return msg, tx.Commit()
+	} else if err != sql.ErrNoRows {
+		return msg, err
+	}
+	tx.Rollback()
+
+	err = db.QueryRowContext(ctx,
+		"SELECT message_id, seq, receiver_id, text, expires_at, created_at, updated_at FROM messages WHERE sender_id = $1 AND client_msg_id = $2",
+		msg.SenderID, msg.ClientMsgID).Scan(&msg.ID, &msg.Seq, &msg.RecipientID, &msg.Text, &msg.ExpiresAt, &msg.CreatedAt, &msg.UpdatedAt)
+	if err != nil {
+		return msg, err
+	}
+	return msg, errDuplicateMessage
+}
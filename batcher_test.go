@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// insertConnector answers INSERT ... RETURNING with one sequential ID, used
+// as the sequence number as well, and fixed timestamps per row, counts the
+// statements it runs and remembers the most bind parameters one took.
+type insertConnector struct {
+	queries atomic.Int64
+	nextID  atomic.Int64
+	maxArgs atomic.Int64
+}
+
+func (c *insertConnector) Connect(context.Context) (driver.Conn, error) {
+	return insertConn{connector: c}, nil
+}
+
+func (c *insertConnector) Driver() driver.Driver { return nil }
+
+type insertConn struct {
+	fakeConn
+	connector *insertConnector
+}
+
+func (c insertConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.connector.queries.Add(1)
+	if n := int64(len(args)); n > c.connector.maxArgs.Load() {
+		c.connector.maxArgs.Store(n)
+	}
+	// Users are inserted with three values, messages with five.
+	rows := &idRows{noSeq: strings.HasPrefix(query, "INSERT INTO users")}
+	perRow := 5
+	if rows.noSeq {
+		perRow = 3
+	}
+	for i := 0; i < len(args)/perRow; i++ {
+		rows.ids = append(rows.ids, c.connector.nextID.Add(1))
+	}
+	return rows, nil
+}
+
+// insertedAt is the created_at and updated_at the fake stores report.
+var insertedAt = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// idRows returns message_id, seq, created_at and updated_at, or without seq
+// when noSeq is set, as user inserts have none.
+type idRows struct {
+	ids   []int64
+	noSeq bool
+}
+
+func (r *idRows) Columns() []string {
+	if r.noSeq {
+		return []string{"user_id", "created_at", "updated_at"}
+	}
+	return []string{"message_id", "seq", "created_at", "updated_at"}
+}
+func (r *idRows) Close() error { return nil }
+
+func (r *idRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+	if r.noSeq {
+		dest[0], dest[1], dest[2] = r.ids[0], insertedAt, insertedAt
+	} else {
+		dest[0], dest[1], dest[2], dest[3] = r.ids[0], r.ids[0], insertedAt, insertedAt
+	}
+	r.ids = r.ids[1:]
+	return nil
+}
+
+func TestMessageBatcherFlushesBySize(t *testing.T) {
+	connector := &insertConnector{}
+	testDB := sql.OpenDB(connector)
+	defer testDB.Close()
+	b := NewMessageBatcher(testDB, 3, time.Hour)
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	ids := make([]int, 3)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg, err := b.Insert(context.Background(), Message{SenderID: 1, RecipientID: 2, Text: "hi"})
+			assert.NoError(t, err)
+			ids[i] = msg.ID
+		}(i)
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []int{1, 2, 3}, ids)
+	assert.Equal(t, int64(1), connector.queries.Load())
+}
+
+func TestMessageBatcherFullBatchFitsBindLimit(t *testing.T) {
+	connector := &insertConnector{}
+	testDB := sql.OpenDB(connector)
+	defer testDB.Close()
+	b := NewMessageBatcher(testDB, 1<<20, time.Hour)
+	defer b.Close()
+	assert.Equal(t, maxBatchSize, b.maxSize, "the size is capped")
+
+	batch := make([]pendingMessage, b.maxSize)
+	for i := range batch {
+		batch[i].msg = Message{SenderID: 1, RecipientID: 2, Text: "hi"}
+	}
+	results, err := b.insert(context.Background(), batch)
+	assert.NoError(t, err)
+	assert.Len(t, results, maxBatchSize)
+	assert.EqualValues(t, maxBatchSize*batchColumns, connector.maxArgs.Load())
+	assert.LessOrEqual(t, connector.maxArgs.Load(), int64(65535), "Postgres takes at most 65535 bind parameters")
+}
+
+func TestMessageBatcherFlushesOnInterval(t *testing.T) {
+	connector := &insertConnector{}
+	testDB := sql.OpenDB(connector)
+	defer testDB.Close()
+	b := NewMessageBatcher(testDB, 100, 10*time.Millisecond)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg, err := b.Insert(ctx, Message{SenderID: 1, RecipientID: 2, Text: "hi"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.ID)
+	assert.Equal(t, insertedAt, msg.CreatedAt)
+	assert.Equal(t, insertedAt, msg.UpdatedAt)
+}
+
+func TestMessageBatcherCloseFlushesPending(t *testing.T) {
+	connector := &insertConnector{}
+	testDB := sql.OpenDB(connector)
+	defer testDB.Close()
+	b := NewMessageBatcher(testDB, 100, time.Hour)
+
+	var mu sync.Mutex
+	var results []insertResult
+	for i := 0; i < 5; i++ {
+		b.Add(Message{SenderID: 1, RecipientID: 2, Text: "hi"}, func(r insertResult) {
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		})
+	}
+	b.Close()
+
+	assert.Len(t, results, 5)
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+		assert.NotZero(t, r.ID)
+	}
+	assert.Equal(t, int64(1), connector.queries.Load())
+
+	_, err := b.Insert(context.Background(), Message{SenderID: 1, RecipientID: 2, Text: "late"})
+	assert.ErrorIs(t, err, errBatcherClosed)
+}
+
+func benchmarkUsers(b *testing.B) (int, int) {
+	setupTestContainers(b)
+	hash, err := bcrypt.GenerateFromPassword([]byte("benchmark"), bcrypt.MinCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return insertTestUser(b, string(hash)), insertTestUser(b, string(hash))
+}
+
+func BenchmarkInsertSingleRow(b *testing.B) {
+	sender, recipient := benchmarkUsers(b)
+	defer db.Close()
+	batcher = nil
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := storeMessage(context.Background(), Message{SenderID: sender, RecipientID: recipient, Text: "bench"}); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInsertBatched(b *testing.B) {
+	sender, recipient := benchmarkUsers(b)
+	defer db.Close()
+	batcher = NewMessageBatcher(db, 100, 5*time.Millisecond)
+	defer func() {
+		batcher.Close()
+		batcher = nil
+	}()
+
+	b.ResetTimer()
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := storeMessage(context.Background(), Message{SenderID: sender, RecipientID: recipient, Text: "bench"}); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// limitBody caps the request body at limit bytes. Requests announcing a
+// larger body are turned away before next runs; bodies without a length
+// fail once a read goes past the limit, which decodeError reports as 413.
+func limitBody(limit int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > int64(limit) {
+			WriteError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+		next(w, r)
+	}
+}
+
+// bodyLimit is limitBody as route middleware.
+func bodyLimit(limit int) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return limitBody(limit, next)
+	}
+}
+
+// decodeError answers a request whose JSON body could not be decoded.
+func decodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Request body too large")
+		return
+	}
+	WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+}
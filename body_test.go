@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitBodyRejectsLargeBody(t *testing.T) {
+	initRedis(t)
+	oversized := `{"sender_id": 1, "recipient_id": 2, "text": "` + strings.Repeat("a", cfg.MaxBodyBytes) + `"}`
+
+	req := authedRequest(t, 1, "POST", "/messages", nil)
+	req.Body = io.NopCloser(strings.NewReader(oversized))
+	req.ContentLength = int64(len(oversized))
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// Without a Content-Length the limit is hit while decoding.
+	req = httptest.NewRequest("POST", "/users", io.MultiReader(strings.NewReader(oversized)))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	limitBody(cfg.MaxBodyBytes, CreateUser)(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestLimitBodyAllowsSmallBody(t *testing.T) {
+	var read int
+	handler := limitBody(16, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		read = len(b)
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("0123456789abcdef")))
+
+	assert.Equal(t, 16, read)
+}
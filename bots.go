@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	botQueueSize = 1024
+
+	// maxBotReplyBytes bounds how much of a callback's answer is read.
+	maxBotReplyBytes = 64 << 10
+)
+
+var botInvocations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_bot_invocations_total",
+	Help: "Bot callbacks by outcome, after retries.",
+}, []string{"result"})
+
+// bots is started in main; without it no bot is called.
+var bots *BotDispatcher
+
+// Bot is a user account whose messages are handled by an HTTP callback.
+// The secret is only shown when the bot is registered.
+type Bot struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	CallbackURL string    `json:"callback_url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type createBotRequest struct {
+	UserID      int      `json:"user_id"`
+	CallbackURL string   `json:"callback_url"`
+	Events      []string `json:"events"`
+}
+
+// botReply is what a callback may answer with: text to send back to the
+// user who wrote to the bot.
+type botReply struct {
+	Text string `json:"text"`
+}
+
+// createBot turns an existing account into a bot. The response carries the
+// secret that callbacks are signed with.
+func createBot(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createBot")
+	defer span.End()
+
+	var req createBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if validateWebhookURL(req.CallbackURL) != nil {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "callback_url must be an absolute http or https URL")
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhookEventTypes
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("unknown event type %q", event))
+			return
+		}
+	}
+	if err := checkUserExists(ctx, req.UserID); err == errInvalidRecipient {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "User not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to create secret")
+		return
+	}
+	bot := Bot{UserID: req.UserID, CallbackURL: req.CallbackURL, Secret: secret, Events: req.Events}
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO bots (user_id, callback_url, secret, events) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO NOTHING RETURNING bot_id, created_at`,
+		bot.UserID, bot.CallbackURL, bot.Secret, bot.Events).Scan(&bot.ID, &bot.CreatedAt)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusConflict, codeConflict, "User is already a bot")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	auditCaller(ctx, "bot_create", userTarget(bot.UserID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bot)
+}
+
+// notifyBots hands a stored message to the bot dispatcher, if it runs.
+func notifyBots(msg Message) {
+	if bots != nil {
+		bots.Notify(msg)
+	}
+}
+
+// BotDispatcher calls the bot a message is addressed to and sends what it
+// answers back to the sender, off the request path. Callbacks are signed
+// like webhook deliveries and retried the same way; every invocation is
+// logged in bot_invocations.
+type BotDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	policy retryPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.RWMutex
+	closed   bool
+	messages chan Message
+}
+
+func botRetryPolicy(c Config) retryPolicy {
+	return retryPolicy{
+		Attempts:   c.BotAttempts,
+		Backoff:    c.BotBackoff,
+		MaxBackoff: c.BotMaxBackoff,
+	}
+}
+
+func NewBotDispatcher(d *sql.DB, workers int, timeout time.Duration, policy retryPolicy) *BotDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bd := &BotDispatcher{
+		db:       d,
+		client:   &http.Client{Timeout: timeout},
+		policy:   policy,
+		ctx:      ctx,
+		cancel:   cancel,
+		messages: make(chan Message, botQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		bd.wg.Add(1)
+		go bd.work()
+	}
+	return bd
+}
+
+// Notify queues a message for the bot it is addressed to, if any. It never
+// blocks: when the queue is full the message is dropped.
+func (d *BotDispatcher) Notify(msg Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed || msg.RoomID != 0 || msg.SenderID == msg.RecipientID {
+		return
+	}
+	select {
+	case d.messages <- msg:
+	default:
+		botInvocations.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Close stops accepting messages and abandons callbacks in flight,
+// returning once every worker has stopped.
+func (d *BotDispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.messages)
+	}
+	d.mu.Unlock()
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *BotDispatcher) work() {
+	defer d.wg.Done()
+	for msg := range d.messages {
+		if d.ctx.Err() != nil {
+			return
+		}
+		bot, err := d.lookup(d.ctx, msg)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Println("Failed to look up bot:", err)
+			continue
+		}
+		d.handle(bot, msg)
+	}
+}
+
+// lookup returns the bot msg is addressed to, or sql.ErrNoRows if there is
+// none. Messages from bots never go to another bot, so that two of them
+// cannot answer each other forever.
+func (d *BotDispatcher) lookup(ctx context.Context, msg Message) (Bot, error) {
+	bot := Bot{UserID: msg.RecipientID}
+	err := d.db.QueryRowContext(ctx,
+		`SELECT bot_id, callback_url, secret FROM bots
+		WHERE user_id = $1 AND $3 = ANY(events)
+		AND NOT EXISTS (SELECT 1 FROM bots WHERE user_id = $2)`,
+		msg.RecipientID, msg.SenderID, eventMessageCreated).Scan(&bot.ID, &bot.CallbackURL, &bot.Secret)
+	return bot, err
+}
+
+// botInvocation is a row of bot_invocations.
+type botInvocation struct {
+	attempts   int
+	statusCode int
+	err        error
+	replyID    int
+}
+
+func (d *BotDispatcher) handle(bot Bot, msg Message) {
+	start := time.Now()
+	delivery := webhookDelivery{id: uuid.NewString(), event: eventMessageCreated}
+	payload, err := json.Marshal(webhookPayload{
+		ID:        delivery.id,
+		Event:     eventMessageCreated,
+		CreatedAt: msg.CreatedAt,
+		Data:      msg,
+	})
+	if err != nil {
+		log.Println("Failed to encode bot payload:", err)
+		return
+	}
+	delivery.payload = payload
+
+	inv, reply := d.invoke(d.ctx, bot, delivery)
+	if d.ctx.Err() != nil {
+		return
+	}
+	if inv.err == nil && reply.Text != "" {
+		answer := Message{SenderID: bot.UserID, RecipientID: msg.SenderID, Text: reply.Text}
+		if err := validateMessage(answer); err != nil {
+			inv.err = fmt.Errorf("bot reply: %w", err)
+		} else if answer, err = relayMessage(d.ctx, answer); err != nil {
+			inv.err = fmt.Errorf("bot reply: %w", err)
+		} else {
+			inv.replyID = answer.ID
+		}
+	}
+
+	if inv.err != nil {
+		botInvocations.WithLabelValues("failed").Inc()
+		log.Printf("Bot %d failed on message %d: %v", bot.ID, msg.ID, inv.err)
+	} else {
+		botInvocations.WithLabelValues("succeeded").Inc()
+	}
+	d.record(bot, msg, inv, time.Since(start))
+}
+
+// invoke POSTs the payload to the bot until it answers with a 2xx or the
+// policy runs out of attempts.
+func (d *BotDispatcher) invoke(ctx context.Context, bot Bot, delivery webhookDelivery) (botInvocation, botReply) {
+	var inv botInvocation
+	var reply botReply
+	backoff := d.policy.Backoff
+	for {
+		inv.attempts++
+		inv.statusCode, reply, inv.err = d.post(ctx, bot, delivery)
+		if inv.err == nil || inv.attempts >= d.policy.Attempts {
+			return inv, reply
+		}
+
+		select {
+		case <-ctx.Done():
+			inv.err = ctx.Err()
+			return inv, reply
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = min(backoff*2, d.policy.MaxBackoff)
+	}
+}
+
+func (d *BotDispatcher) post(ctx context.Context, bot Bot, delivery webhookDelivery) (int, botReply, error) {
+	var reply botReply
+	req, err := http.NewRequestWithContext(ctx, "POST", bot.CallbackURL, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.event)
+	req.Header.Set(webhookDeliveryHeader, delivery.id)
+	req.Header.Set(webhookSignatureHeader, signWebhook(bot.Secret, delivery.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, reply, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBotReplyBytes))
+	if err != nil {
+		return resp.StatusCode, reply, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, reply, fmt.Errorf("bot %d answered %s", bot.ID, resp.Status)
+	}
+	// An empty answer means the bot has nothing to say.
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return resp.StatusCode, reply, fmt.Errorf("bot %d answered with invalid JSON: %w", bot.ID, err)
+		}
+	}
+	return resp.StatusCode, reply, nil
+}
+
+func (d *BotDispatcher) record(bot Bot, msg Message, inv botInvocation, took time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var errText string
+	if inv.err != nil {
+		errText = inv.err.Error()
+	}
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO bot_invocations (bot_id, message_id, attempts, status_code, error, reply_message_id, duration_ms)
+		VALUES ($1, $2, $3, NULLIF($4, 0), NULLIF($5, ''), NULLIF($6, 0), $7)`,
+		bot.ID, msg.ID, inv.attempts, inv.statusCode, errText, inv.replyID, took.Milliseconds())
+	if err != nil {
+		log.Println("Failed to log bot invocation:", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// botStore holds one bot and records the messages stored and the
+// invocations logged.
+type botStore struct {
+	bot    Bot
+	nextID atomic.Int64
+
+	mu          sync.Mutex
+	messages    []Message
+	invocations []botInvocation
+}
+
+func (s *botStore) Connect(context.Context) (driver.Conn, error) {
+	return botConn{store: s}, nil
+}
+
+func (s *botStore) Driver() driver.Driver { return nil }
+
+func (s *botStore) logged() ([]Message, []botInvocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages, s.invocations
+}
+
+type botConn struct {
+	fakeConn
+	store *botStore
+}
+
+func (c botConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	if strings.HasPrefix(query, "SELECT bot_id") {
+		rows := &webhookRows{}
+		recipientID, _ := args[0].Value.(int64)
+		senderID, _ := args[1].Value.(int64)
+		if int(recipientID) == s.bot.UserID && int(senderID) != s.bot.UserID {
+			rows.hooks = []Webhook{{ID: s.bot.ID, URL: s.bot.CallbackURL, Secret: s.bot.Secret}}
+		}
+		return rows, nil
+	}
+	if strings.HasPrefix(query, "INSERT INTO messages") {
+		senderID, _ := args[0].Value.(int64)
+		recipientID, _ := args[1].Value.(int64)
+		text, _ := args[2].Value.(string)
+		id := s.nextID.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.messages = append(s.messages, Message{ID: int(id), SenderID: int(senderID), RecipientID: int(recipientID), Text: text})
+		return &idRows{ids: []int64{id}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c botConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "INSERT INTO bot_invocations") {
+		return nil, errors.New("not supported")
+	}
+	inv := botInvocation{}
+	attempts, _ := args[2].Value.(int64)
+	status, _ := args[3].Value.(int64)
+	errText, _ := args[4].Value.(string)
+	replyID, _ := args[5].Value.(int64)
+	inv.attempts, inv.statusCode, inv.replyID = int(attempts), int(status), int(replyID)
+	if errText != "" {
+		inv.err = errors.New(errText)
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.invocations = append(c.store.invocations, inv)
+	return driver.RowsAffected(1), nil
+}
+
+func startBotDispatcher(t *testing.T, callback http.Handler, attempts int) *botStore {
+	server := httptest.NewServer(callback)
+	t.Cleanup(server.Close)
+	store := &botStore{bot: Bot{ID: 3, UserID: 42, CallbackURL: server.URL + "/bot", Secret: "b0t"}}
+	store.nextID.Store(100)
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	policy := retryPolicy{Attempts: attempts, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	d := NewBotDispatcher(db, 2, time.Second, policy)
+	bots = d
+	t.Cleanup(func() {
+		d.Close()
+		bots = nil
+	})
+	return store
+}
+
+func waitForInvocation(t *testing.T, store *botStore) ([]Message, botInvocation) {
+	var messages []Message
+	var invocations []botInvocation
+	assert.Eventually(t, func() bool {
+		messages, invocations = store.logged()
+		return len(invocations) > 0
+	}, 2*time.Second, 5*time.Millisecond)
+	if len(invocations) != 1 {
+		t.Fatalf("expected one invocation, got %d", len(invocations))
+	}
+	return messages, invocations[0]
+}
+
+func TestBotRepliesToSender(t *testing.T) {
+	initRedis(t)
+	var calls atomic.Int64
+	store := startBotDispatcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, signWebhook("b0t", body), r.Header.Get(webhookSignatureHeader))
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload struct {
+			Data Message `json:"data"`
+		}
+		json.Unmarshal(body, &payload)
+		json.NewEncoder(w).Encode(botReply{Text: "echo: " + payload.Data.Text})
+	}), 3)
+
+	notifyBots(Message{ID: 10, SenderID: 1, RecipientID: 42, Text: "hi"})
+	notifyBots(Message{ID: 11, SenderID: 1, RecipientID: 43, Text: "not for the bot"})
+	messages, inv := waitForInvocation(t, store)
+
+	assert.Equal(t, 2, inv.attempts, "the failed call is retried")
+	assert.Equal(t, http.StatusOK, inv.statusCode)
+	assert.NoError(t, inv.err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, Message{ID: 101, SenderID: 42, RecipientID: 1, Text: "echo: hi"}, messages[0])
+		assert.Equal(t, 101, inv.replyID)
+	}
+
+	// The reply is not fed back to the bot.
+	time.Sleep(20 * time.Millisecond)
+	assert.EqualValues(t, 2, calls.Load())
+}
+
+func TestBotFailureIsLogged(t *testing.T) {
+	initRedis(t)
+	var calls atomic.Int64
+	store := startBotDispatcher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}), 2)
+
+	notifyBots(Message{ID: 10, SenderID: 1, RecipientID: 42, Text: "hi"})
+	messages, inv := waitForInvocation(t, store)
+
+	assert.EqualValues(t, 2, calls.Load())
+	assert.Equal(t, 2, inv.attempts)
+	assert.Equal(t, http.StatusInternalServerError, inv.statusCode)
+	assert.Error(t, inv.err)
+	assert.Zero(t, inv.replyID)
+	assert.Empty(t, messages)
+}
+
+func TestCreateBotRejectsBadInput(t *testing.T) {
+	initRedis(t)
+	token, err := createSession(context.Background(), 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter()
+
+	for _, body := range []string{
+		`{"user_id": 42, "callback_url": "ftp://bot.example.com/hook"}`,
+		`{"user_id": 42, "callback_url": "https://bot.example.com/hook", "events": ["message.deleted"]}`,
+	} {
+		req := httptest.NewRequest("POST", "/admin/bots", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, body)
+	}
+}
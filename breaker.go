@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	breakerFailureThreshold = 5
+	breakerOpenTimeout      = 30 * time.Second
+)
+
+var (
+	redisBreaker = newBreaker("redis", breakerOpenTimeout)
+	dbBreaker    = newBreaker("postgres", breakerOpenTimeout)
+)
+
+// newBreaker opens after breakerFailureThreshold consecutive failures and
+// lets a single trial call through once openTimeout has passed.
+func newBreaker(name string, openTimeout time.Duration) *gobreaker.TwoStepCircuitBreaker {
+	return gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: 1,
+		Timeout:     openTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= breakerFailureThreshold
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("circuit breaker %s: %s -> %s", name, from, to)
+		},
+	})
+}
+
+// isBreakerOpen reports whether err was returned by a tripped breaker
+// without the call being attempted.
+func isBreakerOpen(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// dbError reports a failed database call without revealing the error:
+// sql.ErrNoRows answers 404, a unique violation 409, and a timeout or an
+// open breaker 503. Anything else answers status and is logged.
+func dbError(w http.ResponseWriter, err error, status int) {
+	var pgErr *pgconn.PgError
+	switch {
+	case isBreakerOpen(err):
+		w.Header().Set("Retry-After", strconv.Itoa(int(breakerOpenTimeout.Seconds())))
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Database unavailable")
+	case errors.Is(err, context.DeadlineExceeded):
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Database timed out")
+	case errors.Is(err, sql.ErrNoRows):
+		WriteError(w, http.StatusNotFound, codeNotFound, "Not found")
+	case errors.As(err, &pgErr) && pgErr.Code == uniqueViolation:
+		WriteError(w, http.StatusConflict, codeConflict, "Already exists")
+	default:
+		log.Println("Database error:", err)
+		WriteError(w, status, statusCode(status), http.StatusText(status))
+	}
+}
+
+// Redis
+
+type breakerDoneKey struct{}
+
+// redisBreakerHook runs every Redis command and pipeline through a breaker.
+// Error replies from the server count as successes: only failures to reach
+// Redis trip the breaker.
+type redisBreakerHook struct {
+	cb *gobreaker.TwoStepCircuitBreaker
+}
+
+func isRedisFailure(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var replyErr redis.Error
+	return !errors.As(err, &replyErr)
+}
+
+func (h redisBreakerHook) before(ctx context.Context) (context.Context, error) {
+	done, err := h.cb.Allow()
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, breakerDoneKey{}, done), nil
+}
+
+func (h redisBreakerHook) after(ctx context.Context, err error) {
+	if done, ok := ctx.Value(breakerDoneKey{}).(func(bool)); ok {
+		done(!isRedisFailure(err))
+	}
+}
+
+func (h redisBreakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return h.before(ctx)
+}
+
+func (h redisBreakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.after(ctx, cmd.Err())
+	return nil
+}
+
+func (h redisBreakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.before(ctx)
+}
+
+func (h redisBreakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if isRedisFailure(cmd.Err()) {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.after(ctx, err)
+	return nil
+}
+
+// Postgres
+
+// breakerConnector wraps a driver connector so that opening connections and
+// running statements go through a breaker. Errors reported by the server
+// itself, such as constraint violations, do not count as failures.
+type breakerConnector struct {
+	driver.Connector
+	cb *gobreaker.TwoStepCircuitBreaker
+}
+
+func isDBFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	return !errors.As(err, &pgErr)
+}
+
+func guardDB(cb *gobreaker.TwoStepCircuitBreaker, call func() error) error {
+	done, err := cb.Allow()
+	if err != nil {
+		return err
+	}
+	err = call()
+	done(!isDBFailure(err))
+	return err
+}
+
+func (c breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	err := guardDB(c.cb, func() (err error) {
+		conn, err = c.Connector.Connect(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &breakerConn{Conn: conn, cb: c.cb}, nil
+}
+
+type breakerConn struct {
+	driver.Conn
+	cb *gobreaker.TwoStepCircuitBreaker
+}
+
+func (c *breakerConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var rows driver.Rows
+	err := guardDB(c.cb, func() (err error) {
+		rows, err = queryer.QueryContext(ctx, query, args)
+		return err
+	})
+	return rows, err
+}
+
+func (c *breakerConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var result driver.Result
+	err := guardDB(c.cb, func() (err error) {
+		result, err = execer.ExecContext(ctx, query, args)
+		return err
+	})
+	return result, err
+}
+
+func (c *breakerConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	err := guardDB(c.cb, func() (err error) {
+		if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+			stmt, err = preparer.PrepareContext(ctx, query)
+		} else {
+			stmt, err = c.Conn.Prepare(query)
+		}
+		return err
+	})
+	return stmt, err
+}
+
+func (c *breakerConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	err := guardDB(c.cb, func() (err error) {
+		if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+			tx, err = beginner.BeginTx(ctx, opts)
+		} else {
+			tx, err = c.Conn.Begin()
+		}
+		return err
+	})
+	return tx, err
+}
+
+// CheckNamedValue lets the wrapped driver convert arguments itself, so that
+// pgx can take slices and other types database/sql does not know about.
+func (c *breakerConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// Ping lets db.PingContext reach the connection, through the breaker.
+func (c *breakerConn) Ping(ctx context.Context) error {
+	pinger, ok := c.Conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+	return guardDB(c.cb, func() error { return pinger.Ping(ctx) })
+}
+
+// ResetSession goes through the breaker too, as pgx pings the server when
+// the connection has been idle.
+func (c *breakerConn) ResetSession(ctx context.Context) error {
+	resetter, ok := c.Conn.(driver.SessionResetter)
+	if !ok {
+		return nil
+	}
+	return guardDB(c.cb, func() error { return resetter.ResetSession(ctx) })
+}
+
+func (c *breakerConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+type breakerStatus struct {
+	State               string `json:"state"`
+	Requests            uint32 `json:"requests"`
+	TotalSuccesses      uint32 `json:"total_successes"`
+	TotalFailures       uint32 `json:"total_failures"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+}
+
+func statusOf(cb *gobreaker.TwoStepCircuitBreaker) breakerStatus {
+	counts := cb.Counts()
+	return breakerStatus{
+		State:               cb.State().String(),
+		Requests:            counts.Requests,
+		TotalSuccesses:      counts.TotalSuccesses,
+		TotalFailures:       counts.TotalFailures,
+		ConsecutiveFailures: counts.ConsecutiveFailures,
+	}
+}
+
+func getCircuitBreakers(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getCircuitBreakers")
+	defer span.End()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]breakerStatus{
+		redisBreaker.Name(): statusOf(redisBreaker),
+		dbBreaker.Name():    statusOf(dbBreaker),
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOpenTimeout = 50 * time.Millisecond
+
+func TestRedisBreakerTransitions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cb := newBreaker("redis", testOpenTimeout)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	client.AddHook(redisBreakerHook{cb: cb})
+	ctx := context.Background()
+
+	assert.NoError(t, client.Set(ctx, "k", "v", 0).Err())
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+
+	// A missing key is a normal reply, not a failure.
+	assert.Equal(t, redis.Nil, client.Get(ctx, "missing").Err())
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+
+	mr.Close()
+	for i := 0; i < breakerFailureThreshold; i++ {
+		assert.Error(t, client.Get(ctx, "k").Err())
+	}
+	assert.Equal(t, gobreaker.StateOpen, cb.State())
+	assert.ErrorIs(t, client.Get(ctx, "k").Err(), gobreaker.ErrOpenState)
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * testOpenTimeout)
+	assert.Equal(t, gobreaker.StateHalfOpen, cb.State())
+
+	assert.NoError(t, client.Get(ctx, "k").Err())
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+}
+
+type fakeConnector struct {
+	healthy *atomic.Bool
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	if !c.healthy.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return fakeConn{}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestDBBreakerTransitions(t *testing.T) {
+	healthy := &atomic.Bool{}
+	cb := newBreaker("postgres", testOpenTimeout)
+	testDB := sql.OpenDB(breakerConnector{Connector: fakeConnector{healthy: healthy}, cb: cb})
+	defer testDB.Close()
+	ctx := context.Background()
+
+	for i := 0; i < breakerFailureThreshold; i++ {
+		assert.Error(t, testDB.PingContext(ctx))
+	}
+	assert.Equal(t, gobreaker.StateOpen, cb.State())
+	assert.ErrorIs(t, testDB.PingContext(ctx), gobreaker.ErrOpenState)
+
+	healthy.Store(true)
+	time.Sleep(2 * testOpenTimeout)
+	assert.Equal(t, gobreaker.StateHalfOpen, cb.State())
+
+	assert.NoError(t, testDB.PingContext(ctx))
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+}
+
+// pingConn is a connection whose pings fail while the server is down.
+type pingConn struct {
+	fakeConn
+	healthy *atomic.Bool
+}
+
+func (c pingConn) Ping(context.Context) error {
+	if !c.healthy.Load() {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+type pingConnector struct {
+	healthy *atomic.Bool
+}
+
+func (c pingConnector) Connect(context.Context) (driver.Conn, error) {
+	return pingConn{healthy: c.healthy}, nil
+}
+
+func (c pingConnector) Driver() driver.Driver { return nil }
+
+func TestDBBreakerCountsPings(t *testing.T) {
+	healthy := &atomic.Bool{}
+	healthy.Store(true)
+	cb := newBreaker("postgres", time.Minute)
+	testDB := sql.OpenDB(breakerConnector{Connector: pingConnector{healthy: healthy}, cb: cb})
+	defer testDB.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, testDB.PingContext(ctx))
+
+	// The connection is open already, so only its pings reach the server.
+	healthy.Store(false)
+	for i := 0; i < breakerFailureThreshold; i++ {
+		assert.Error(t, testDB.PingContext(ctx))
+	}
+	assert.Equal(t, gobreaker.StateOpen, cb.State())
+	assert.ErrorIs(t, testDB.PingContext(ctx), gobreaker.ErrOpenState)
+}
+
+func TestSendMessageDBBreakerOpen(t *testing.T) {
+	initRedis(t)
+	cb := newBreaker("postgres", time.Minute)
+	db = sql.OpenDB(breakerConnector{Connector: fakeConnector{healthy: &atomic.Bool{}}, cb: cb})
+	defer db.Close()
+
+	for i := 0; i < breakerFailureThreshold; i++ {
+		db.Ping()
+	}
+
+	jsonData, _ := json.Marshal(Message{SenderID: 1, RecipientID: 2, Text: "Hello"})
+	req := httptest.NewRequest("POST", "/messages", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+
+	sendMessage(rr, asUser(req, 1))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "handler returned wrong status code")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
+func TestGetCircuitBreakers(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	getCircuitBreakers(rr, httptest.NewRequest("GET", "/admin/circuit-breakers", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var states map[string]breakerStatus
+	if err := json.NewDecoder(rr.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, states, "redis")
+	assert.Contains(t, states, "postgres")
+	assert.Equal(t, "closed", states["redis"].State)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+type SystemEvent struct {
+	Type   string    `json:"type"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type broadcastRequest struct {
+	Text    string `json:"text"`
+	Persist bool   `json:"persist"`
+}
+
+type broadcastResult struct {
+	Delivered int `json:"delivered"`
+	Queued    int `json:"queued"`
+}
+
+func broadcast(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.broadcast")
+	defer span.End()
+
+	var req broadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "text is required")
+		return
+	}
+
+	event := SystemEvent{Type: "system", Text: req.Text, SentAt: time.Now().UTC()}
+
+	reached, _, err := fanOut(ctx, event, nil)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to send broadcast")
+		return
+	}
+	result := broadcastResult{Delivered: len(reached)}
+	online := make(map[string]bool)
+	for _, userID := range reached {
+		online[userID] = true
+	}
+
+	if req.Persist {
+		// Deleted and banned accounts cannot sign in to read it.
+		rows, err := db.QueryContext(ctx, "SELECT user_id FROM users WHERE deleted_at IS NULL AND banned_at IS NULL")
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		pipe := redisCli.Pipeline()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				dbError(w, err, http.StatusInternalServerError)
+				return
+			}
+			userID := strconv.Itoa(id)
+			if online[userID] {
+				continue
+			}
+			if err := queueOffline(ctx, pipe, userID, event); err != nil {
+				dbError(w, err, http.StatusInternalServerError)
+				return
+			}
+			result.Queued++
+		}
+		if err := rows.Err(); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if result.Queued > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to queue broadcast")
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// fanOut sends v to every user connected to this server. claim, if set,
+// picks those of them who are to get it, and may keep a record of them.
+// It returns the users v reached and those it could not be queued for.
+func fanOut(ctx context.Context, v interface{}, claim func(ctx context.Context, userIDs []string) ([]string, error)) (reached, missed []string, err error) {
+	var userIDs []string
+	registry.Range(func(userID string, _ []*client) bool {
+		userIDs = append(userIDs, userID)
+		return true
+	})
+	if claim != nil && len(userIDs) > 0 {
+		if userIDs, err = claim(ctx, userIDs); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, userID := range userIDs {
+		if len(registry.Send(userID, v)) == 0 {
+			reached = append(reached, userID)
+		} else {
+			missed = append(missed, userID)
+		}
+	}
+	return reached, missed, nil
+}
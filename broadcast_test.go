@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcast(t *testing.T) {
+	initRedis(t)
+	server := newTestServer(t, newRouter())
+
+	conns := []int{101, 102, 103}
+	wsConns := make(map[int]*websocket.Conn)
+	for _, userID := range conns {
+		wsConns[userID] = dialTestUser(t, server, userID)
+	}
+	waitForClients(t, len(conns))
+
+	req := httptest.NewRequest("POST", "/admin/broadcast", bytes.NewBufferString(`{"text":"maintenance in 10 minutes"}`))
+	rr := httptest.NewRecorder()
+
+	broadcast(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+	var result broadcastResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, broadcastResult{Delivered: 3, Queued: 0}, result)
+
+	for userID, conn := range wsConns {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var event SystemEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("user %d did not receive the broadcast: %v", userID, err)
+		}
+		assert.Equal(t, "system", event.Type)
+		assert.Equal(t, "maintenance in 10 minutes", event.Text)
+	}
+}
+
+func TestBroadcastQueuesForOfflineUsers(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	server := newTestServer(t, newRouter())
+
+	userID := insertTestUser(t, "hash")
+	deleted, banned := insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	if _, err := db.Exec("UPDATE users SET deleted_at = NOW() WHERE user_id = $1", deleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET banned_at = NOW() WHERE user_id = $1", banned); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/broadcast", bytes.NewBufferString(`{"text":"we are back","persist":true}`))
+	rr := httptest.NewRecorder()
+
+	broadcast(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+	var result broadcastResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, result.Delivered)
+	assert.GreaterOrEqual(t, result.Queued, 1)
+
+	conn := dialTestUser(t, server, userID)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event SystemEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "we are back", event.Text)
+
+	n, err := redisCli.XLen(context.Background(), inboxKey(strconv.Itoa(userID))).Result()
+	assert.NoError(t, err)
+	assert.Zero(t, n, "delivered events should leave the inbox")
+
+	for _, id := range []int{deleted, banned} {
+		n, err := redisCli.XLen(context.Background(), inboxKey(strconv.Itoa(id))).Result()
+		assert.NoError(t, err)
+		assert.Zero(t, n, "deleted and banned users get no broadcast")
+	}
+}
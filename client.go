@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const sendBufferSize = 256
+
+const (
+	slowClientDrop       = "drop"
+	slowClientDisconnect = "disconnect"
+)
+
+// codeBufferFull is the error code a client is sent when events queued for
+// it were dropped to make room for newer ones.
+const codeBufferFull = "buffer_full"
+
+var errBufferFull = errors.New("events were dropped because the connection fell behind")
+
+var (
+	bufferDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_ws_buffer_drops_total",
+		Help: "Events dropped from or not queued on a WebSocket because its send queue was full.",
+	})
+	slowClientDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_websocket_slow_client_disconnects_total",
+		Help: "WebSockets closed because they could not keep up.",
+	})
+)
+
+// client is a single connection of a user, over a WebSocket or an event
+// stream. All writes go through its send queue and are performed by
+// writePump, so a slow peer never blocks the goroutine that is delivering
+// to it.
+type client struct {
+	userID    string
+	transport transport
+	// sessionID is the login session the connection was opened with, if
+	// known.
+	sessionID string
+	// connectedAt is when the connection was registered.
+	connectedAt time.Time
+	send        chan interface{}
+	// logger logs for the request that opened the connection.
+	logger *log.Logger
+
+	// dropped counts events that did not fit in send.
+	dropped atomic.Int64
+	// bufferFull is set while a buffer_full error waits in the queue, so
+	// that a burst of drops tells the client only once.
+	bufferFull atomic.Bool
+
+	mu     sync.Mutex
+	closed bool
+	kicked bool
+	// While resuming, live events wait in held so that they reach the
+	// client after the replayed backlog.
+	resuming bool
+	held     []interface{}
+}
+
+func newClient(userID string, t transport) *client {
+	return &client{
+		userID:      userID,
+		transport:   t,
+		connectedAt: time.Now(),
+		send:        make(chan interface{}, sendBufferSize),
+		logger:      log.Default(),
+	}
+}
+
+// enqueue queues v for delivery without blocking. When the queue is full,
+// cfg.SlowClientPolicy decides: "drop" makes room by dropping the oldest
+// queued events and tells the client with a buffer_full error,
+// "disconnect" closes the client. It reports false if v was not queued.
+func (c *client) enqueue(v interface{}) bool {
+	if c.tryEnqueue(v) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if cfg.SlowClientPolicy != slowClientDisconnect {
+		c.dropOldest(v)
+		return true
+	}
+	c.dropped.Add(1)
+	bufferDrops.Inc()
+	if !c.kicked {
+		c.kicked = true
+		slowClientDisconnects.Inc()
+		// The close frame may wait behind a full socket buffer, so the
+		// sender does not wait for it.
+		go c.disconnect(websocket.ClosePolicyViolation, "client too slow")
+	}
+	return false
+}
+
+// dropOldest queues v on the full queue in place of its oldest event. A
+// buffer_full error goes ahead of v unless one is still waiting to be
+// written. The caller holds c.mu, so nothing else fills the room made.
+func (c *client) dropOldest(v interface{}) {
+	c.evictOldest()
+	if !c.bufferFull.Load() {
+		c.evictOldest()
+		c.push(newErrorEvent(codeBufferFull, errBufferFull))
+		c.bufferFull.Store(true)
+	}
+	c.push(v)
+}
+
+// evictOldest removes the oldest queued event, if the write pump has not
+// taken it meanwhile. An evicted buffer_full error is queued again by
+// dropOldest and is not counted as a drop.
+func (c *client) evictOldest() {
+	var old interface{}
+	if c.resuming {
+		if len(c.held) == 0 {
+			return
+		}
+		old, c.held = c.held[0], c.held[1:]
+	} else {
+		select {
+		case old = <-c.send:
+		default:
+			return
+		}
+	}
+	if isBufferFull(old) {
+		c.bufferFull.Store(false)
+		return
+	}
+	c.dropped.Add(1)
+	bufferDrops.Inc()
+}
+
+// push queues v where enqueue would, once dropOldest has made room.
+func (c *client) push(v interface{}) {
+	if c.resuming {
+		c.held = append(c.held, v)
+	} else {
+		c.send <- v
+	}
+}
+
+func isBufferFull(v interface{}) bool {
+	e, ok := v.(ErrorEvent)
+	return ok && e.Code == codeBufferFull
+}
+
+// tryEnqueue is enqueue without the slow client policy, for when the queue
+// filling up says nothing about the client.
+func (c *client) tryEnqueue(v interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.resuming {
+		if len(c.held) >= sendBufferSize {
+			return false
+		}
+		c.held = append(c.held, v)
+		return true
+	}
+	select {
+	case c.send <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// finishResume ends the replay and queues the events held back meanwhile.
+// Messages up to lastID were part of the backlog and are not sent again.
+func (c *client) finishResume(lastID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	held := c.held
+	c.resuming, c.held = false, nil
+	if c.closed {
+		return
+	}
+	for _, v := range held {
+		if msg, ok := v.(Message); ok && msg.ID != 0 && msg.ID <= lastID {
+			continue
+		}
+		select {
+		case c.send <- v:
+		default:
+			return
+		}
+	}
+}
+
+// disconnect ends the connection. Its handler then deregisters the client.
+func (c *client) disconnect(code int, reason string) {
+	c.transport.shutdown(code, reason)
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+func (c *client) writePump() {
+	for v := range c.send {
+		// A message that expired while queued is not delivered.
+		if msg, ok := v.(Message); ok && messageExpired(msg, time.Now()) {
+			continue
+		}
+		if isBufferFull(v) {
+			c.bufferFull.Store(false)
+		}
+		if err := c.transport.write(v); err != nil {
+			c.logger.Printf("error writing event to %s: %v", c.userID, err)
+			c.transport.abort()
+			break
+		}
+	}
+	// Drain anything queued after a failed write so enqueue never blocks.
+	for range c.send {
+	}
+}
+
+func inboxKey(userID string) string {
+	return fmt.Sprintf("inbox:%s", userID)
+}
+
+// queueOffline stores v in the user's inbox stream for delivery on their
+// next connect.
+func queueOffline(ctx context.Context, pipe redis.Cmdable, userID string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: inboxKey(userID),
+		Values: map[string]interface{}{"event": payload},
+	}).Err()
+}
+
+// deliverInbox hands everything queued for the client's user to its write
+// pump and removes the delivered entries from the inbox.
+func deliverInbox(ctx context.Context, c *client) error {
+	key := inboxKey(c.userID)
+	entries, err := redisCli.XRange(ctx, key, "-", "+").Result()
+	if err != nil {
+		return err
+	}
+
+	var delivered []string
+	for _, entry := range entries {
+		payload, _ := entry.Values["event"].(string)
+		if !c.tryEnqueue(json.RawMessage(payload)) {
+			break
+		}
+		delivered = append(delivered, entry.ID)
+	}
+	if len(delivered) == 0 {
+		return nil
+	}
+	return redisCli.XDel(ctx, key, delivered...).Err()
+}
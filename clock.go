@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock is the source of time for background jobs, so tests can drive them
+// with a fake one.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
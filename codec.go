@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols a client can ask for to pick the encoding of the
+// events it exchanges. Clients that ask for neither get JSON.
+const (
+	subprotocolJSON    = "chat.v1+json"
+	subprotocolMsgpack = "chat.v1+msgpack"
+)
+
+// Codec encodes and decodes the events sent over a WebSocket.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// FrameType is the WebSocket message type payloads travel in.
+	FrameType() int
+}
+
+// codecFor returns the codec for a negotiated subprotocol.
+func codecFor(subprotocol string) Codec {
+	if subprotocol == subprotocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+// msgpackCodec reads the json struct tags, so both encodings use the same
+// field names.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	// Events queued while the user was offline are stored as JSON and are
+	// transcoded on the way out.
+	if raw, ok := v.(json.RawMessage); ok {
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return nil, err
+		}
+		v = decoded
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	// JSON numbers decode as float64; IDs should still go out as integers.
+	enc.UseCompactFloats(true)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+// readFrame reads the next event from conn into v.
+func readFrame(conn *websocket.Conn, codec Codec, v interface{}) error {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, v)
+}
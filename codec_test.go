@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	t.Parallel()
+	sent := Message{ID: 7, SenderID: 1, RecipientID: 2, Text: "héllo", CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+	for _, codec := range []Codec{jsonCodec{}, msgpackCodec{}} {
+		payload, err := codec.Marshal(sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Message
+		if err := codec.Unmarshal(payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, sent.Text, got.Text)
+		assert.Equal(t, sent.SenderID, got.SenderID)
+		assert.True(t, sent.CreatedAt.Equal(got.CreatedAt))
+	}
+
+	// Both codecs use the same field names.
+	payload, _ := msgpackCodec{}.Marshal(sent)
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, fields, "sender_id")
+	assert.NotContains(t, fields, "room_id", "omitempty is honoured")
+}
+
+func TestMsgpackCodecTranscodesJSON(t *testing.T) {
+	payload, err := msgpackCodec{}.Marshal(json.RawMessage(`{"type":"error","id":5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]interface{}
+	if err := msgpack.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "error", event["type"])
+	assert.EqualValues(t, 5, event["id"])
+	assert.IsType(t, int8(0), event["id"], "numbers stay integers")
+}
+
+func TestWebSocketSubprotocols(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUserWith(t, &websocket.Dialer{Subprotocols: []string{"chat.v2+cbor"}}, server, 901)
+	recipient := dialTestUserWith(t, &websocket.Dialer{Subprotocols: []string{subprotocolJSON, subprotocolMsgpack}}, server, 902)
+	waitForClients(t, 2)
+	assert.Empty(t, sender.Subprotocol(), "unknown subprotocols fall back to JSON")
+	assert.Equal(t, subprotocolMsgpack, recipient.Subprotocol(), "msgpack wins when offered")
+
+	// A JSON sender reaches a msgpack recipient...
+	if err := sender.WriteJSON(Message{SenderID: 901, RecipientID: 902, Text: "from json"}); err != nil {
+		t.Fatal(err)
+	}
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, data, err := recipient.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	var msg Message
+	if err := (msgpackCodec{}).Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "from json", msg.Text)
+
+	// ...and the other way round.
+	payload, _ := msgpackCodec{}.Marshal(Message{SenderID: 902, RecipientID: 901, Text: "from msgpack"})
+	if err := recipient.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal(err)
+	}
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg = Message{}
+	if err := sender.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "from msgpack", msg.Text)
+}
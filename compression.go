@@ -0,0 +1,13 @@
+package main
+
+import "compress/flate"
+
+// compressionLevel returns cfg.WSCompressionLevel, or flate.BestSpeed if it
+// is not a level compress/flate accepts.
+func compressionLevel() int {
+	level := cfg.WSCompressionLevel
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.BestSpeed
+	}
+	return level
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingConn counts the bytes read off the wire.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func countingDialer(compress bool, read *atomic.Int64) *websocket.Dialer {
+	return &websocket.Dialer{
+		EnableCompression: compress,
+		HandshakeTimeout:  time.Second,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, read: read}, err
+		},
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	var plainRead, deflatedRead atomic.Int64
+	sender := dialTestUserWith(t, countingDialer(true, new(atomic.Int64)), server, 701)
+	plain := dialTestUserWith(t, countingDialer(false, &plainRead), server, 702)
+	deflated := dialTestUserWith(t, countingDialer(true, &deflatedRead), server, 702)
+	waitForClients(t, 3)
+	plainRead.Store(0)
+	deflatedRead.Store(0)
+
+	// The sender's frames are compressed too, so this covers both directions.
+	text := strings.Repeat("compressible chat payload ", 150)
+	sender.EnableWriteCompression(true)
+	if err := sender.WriteJSON(Message{SenderID: 701, RecipientID: 702, Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{plain, deflated} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, text, msg.Text)
+	}
+
+	assert.Greater(t, plainRead.Load(), int64(len(text)))
+	assert.Less(t, deflatedRead.Load(), plainRead.Load()/4, "a repetitive payload should shrink on the wire")
+
+	// Control frames are never compressed: the server still answers a ping
+	// on a deflate connection.
+	pong := make(chan struct{})
+	deflated.SetPongHandler(func(string) error { close(pong); return nil })
+	if err := deflated.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	go deflated.ReadMessage()
+	select {
+	case <-pong:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no pong received")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Config struct {
+	JWTSecret string
+
+	// AdminUsernames are made admins at startup, so that a deployment can
+	// have its first admin.
+	AdminUsernames []string
+
+	Addr    string
+	TLSAddr string
+	TLS     TLSConfig
+
+	// GRPCAddr is where the gRPC API for backend services listens, with
+	// the same TLS as the HTTP server. Empty disables it.
+	GRPCAddr string
+
+	// PublicURL is where users reach the chat, for links the server hands
+	// out such as room invites.
+	PublicURL string
+
+	StartupAttempts   int
+	StartupBackoff    time.Duration
+	StartupMaxBackoff time.Duration
+
+	// Access tokens expire AccessTokenTTL after they are issued. A login
+	// session lasts RefreshTokenTTL from its last refresh.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// A username is locked out of login for LoginLockout after
+	// LoginMaxFailures failed attempts within LoginFailureWindow, and so is
+	// a client address after LoginIPMaxFailures.
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginFailureWindow time.Duration
+	LoginLockout       time.Duration
+
+	// PasswordHash is the algorithm of new password hashes, "bcrypt" at
+	// BcryptCost or "argon2id". Logins rehash passwords whose hash is
+	// weaker.
+	PasswordHash string
+	BcryptCost   int
+
+	// Users can log in with the OAuth providers that have a client ID.
+	// OAuthRedirectURL is the page of the frontend they are sent back to
+	// with their tokens, PublicURL if empty.
+	OAuthGoogleClientID     string
+	OAuthGoogleClientSecret string
+	OAuthGitHubClientID     string
+	OAuthGitHubClientSecret string
+	OAuthRedirectURL        string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	// RedisKeyPrefix is put in front of every Redis key, so that
+	// deployments sharing a Redis keep apart.
+	RedisKeyPrefix string
+
+	// SlowClientPolicy is what happens to a WebSocket whose send queue is
+	// full: "drop" drops the oldest queued events and sends a buffer_full
+	// error, leaving the messages to be fetched from history, "disconnect"
+	// closes it with 1008.
+	SlowClientPolicy string
+
+	// WSCompression negotiates permessage-deflate with clients that offer
+	// it. Frames below WSCompressionThreshold bytes are sent uncompressed.
+	WSCompression          bool
+	WSCompressionLevel     int
+	WSCompressionThreshold int
+
+	// MessagesToBannedUsers accepts messages addressed to banned users, who
+	// read them should they be unbanned. Without it they are rejected.
+	MessagesToBannedUsers bool
+
+	// ContactsStrict holds back messages between users who are not
+	// contacts as message requests until the recipient accepts the sender.
+	ContactsStrict bool
+
+	// SystemMessagesUnread counts the system messages of rooms, such as a
+	// member joining, as unread.
+	SystemMessagesUnread bool
+
+	// MaxPins caps the pinned messages of a conversation.
+	MaxPins int
+
+	// RoomStreams fans room messages out through a Redis stream per room,
+	// which every server reads with a consumer group named InstanceID, so
+	// that members connected to any server get them.
+	RoomStreams bool
+	InstanceID  string
+
+	BatchInserts       bool
+	BatchMaxSize       int
+	BatchFlushInterval time.Duration
+
+	MaxMessageBytes        int
+	MaxMessageRunes        int
+	MaxUsernameLength      int
+	MaxEmailLength         int
+	MaxAttachmentSizeBytes int
+	MaxBodyBytes           int
+
+	// S3Bucket receives message attachments. Without it messages cannot
+	// carry any. Credentials and region come from the usual AWS settings.
+	S3Bucket string
+	// S3PublicURL is where clients fetch objects of the bucket from, such
+	// as a CDN in front of it. It defaults to the bucket's own endpoint.
+	S3PublicURL string
+
+	// Webhook deliveries that fail are retried WebhookAttempts times in
+	// all, and a webhook is disabled after WebhookDisableAfter deliveries
+	// in a row failed.
+	WebhookWorkers      int
+	WebhookTimeout      time.Duration
+	WebhookAttempts     int
+	WebhookBackoff      time.Duration
+	WebhookMaxBackoff   time.Duration
+	WebhookDisableAfter int
+
+	// Bot callbacks that fail are retried BotAttempts times in all.
+	BotWorkers    int
+	BotTimeout    time.Duration
+	BotAttempts   int
+	BotBackoff    time.Duration
+	BotMaxBackoff time.Duration
+
+	// Offline users get push notifications through Firebase Cloud
+	// Messaging when FCMProjectID is set, authenticated as the service
+	// account of the key file FCMCredentialsFile. Sends that fail are
+	// retried PushAttempts times in all.
+	FCMProjectID       string
+	FCMCredentialsFile string
+	PushWorkers        int
+	PushTimeout        time.Duration
+	PushAttempts       int
+	PushBackoff        time.Duration
+	PushMaxBackoff     time.Duration
+
+	// AwayReplyCooldown is how long a user's away message is not sent
+	// again to someone who already got it.
+	AwayReplyCooldown time.Duration
+
+	// Messages containing one of FilterRejectWords are refused and those
+	// containing one of FilterFlagWords go to the moderation queue.
+	FilterRejectWords []string
+	FilterFlagWords   []string
+
+	OTelExporter string
+	OTelEndpoint string
+
+	// Message analytics are opt-in: nothing is sampled unless
+	// AnalyticsEnabled is set.
+	AnalyticsEnabled    bool
+	AnalyticsSampleRate float64
+	AnalyticsSalt       string
+
+	// MessageRetention is how long direct and room messages are kept.
+	// Zero keeps them forever.
+	MessageRetention time.Duration
+}
+
+// TLSConfig selects how the server terminates TLS: certificates obtained
+// from Let's Encrypt for AutoTLSDomain, or a certificate and key on disk.
+type TLSConfig struct {
+	CertFile      string
+	KeyFile       string
+	AutoTLS       bool
+	AutoTLSDomain string
+	AutoTLSCache  string
+}
+
+var cfg = loadConfig()
+
+// minJWTSecretBytes is the shortest CHAT_JWT_SECRET the server starts
+// with: an HS256 key should be no shorter than the hash.
+const minJWTSecretBytes = 32
+
+// checkJWTSecret refuses a missing or short token signing key, so that no
+// deployment runs with one that can be guessed.
+func checkJWTSecret(secret string) error {
+	if len(secret) < minJWTSecretBytes {
+		return fmt.Errorf("CHAT_JWT_SECRET must be set to at least %d bytes", minJWTSecretBytes)
+	}
+	return nil
+}
+
+func loadConfig() Config {
+	return Config{
+		JWTSecret: os.Getenv("CHAT_JWT_SECRET"),
+
+		AdminUsernames: getEnvList("CHAT_ADMIN_USERNAMES"),
+
+		Addr:    getEnv("CHAT_ADDR", ":8080"),
+		TLSAddr: getEnv("CHAT_TLS_ADDR", ":8443"),
+		TLS: TLSConfig{
+			CertFile:      getEnv("CHAT_TLS_CERT_FILE", ""),
+			KeyFile:       getEnv("CHAT_TLS_KEY_FILE", ""),
+			AutoTLS:       getEnvBool("CHAT_AUTO_TLS", false),
+			AutoTLSDomain: getEnv("CHAT_AUTO_TLS_DOMAIN", ""),
+			AutoTLSCache:  getEnv("CHAT_AUTO_TLS_CACHE", "autocert-cache"),
+		},
+
+		GRPCAddr: getEnv("CHAT_GRPC_ADDR", ":9090"),
+
+		PublicURL: strings.TrimSuffix(getEnv("CHAT_PUBLIC_URL", "https://chat.example.com"), "/"),
+
+		StartupAttempts:   getEnvInt("CHAT_STARTUP_ATTEMPTS", 10),
+		StartupBackoff:    getEnvDuration("CHAT_STARTUP_BACKOFF", 500*time.Millisecond),
+		StartupMaxBackoff: getEnvDuration("CHAT_STARTUP_MAX_BACKOFF", 10*time.Second),
+
+		AccessTokenTTL:  getEnvDuration("CHAT_ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: getEnvDuration("CHAT_REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		LoginMaxFailures:   getEnvInt("CHAT_LOGIN_MAX_FAILURES", 10),
+		LoginIPMaxFailures: getEnvInt("CHAT_LOGIN_IP_MAX_FAILURES", 50),
+		LoginFailureWindow: getEnvDuration("CHAT_LOGIN_FAILURE_WINDOW", 5*time.Minute),
+		LoginLockout:       getEnvDuration("CHAT_LOGIN_LOCKOUT", 15*time.Minute),
+
+		PasswordHash: getEnv("CHAT_PASSWORD_HASH", passwordHashBcrypt),
+		BcryptCost:   getEnvInt("CHAT_BCRYPT_COST", bcrypt.DefaultCost),
+
+		OAuthGoogleClientID:     getEnv("CHAT_OAUTH_GOOGLE_CLIENT_ID", ""),
+		OAuthGoogleClientSecret: getEnv("CHAT_OAUTH_GOOGLE_CLIENT_SECRET", ""),
+		OAuthGitHubClientID:     getEnv("CHAT_OAUTH_GITHUB_CLIENT_ID", ""),
+		OAuthGitHubClientSecret: getEnv("CHAT_OAUTH_GITHUB_CLIENT_SECRET", ""),
+		OAuthRedirectURL:        getEnv("CHAT_OAUTH_REDIRECT_URL", ""),
+
+		DBMaxOpenConns:    getEnvInt("CHAT_DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("CHAT_DB_MAX_IDLE_CONNS", 10),
+		DBConnMaxLifetime: getEnvDuration("CHAT_DB_CONN_MAX_LIFETIME", 30*time.Minute),
+
+		RedisKeyPrefix: getEnv("CHAT_REDIS_KEY_PREFIX", "chat:"),
+
+		SlowClientPolicy: getEnv("CHAT_SLOW_CLIENT_POLICY", slowClientDrop),
+
+		WSCompression:          getEnvBool("CHAT_WS_COMPRESSION", true),
+		WSCompressionLevel:     getEnvInt("CHAT_WS_COMPRESSION_LEVEL", 1),
+		WSCompressionThreshold: getEnvInt("CHAT_WS_COMPRESSION_THRESHOLD", 512),
+
+		MessagesToBannedUsers: getEnvBool("CHAT_MESSAGES_TO_BANNED_USERS", true),
+		ContactsStrict:        getEnvBool("CHAT_CONTACTS_STRICT", false),
+		SystemMessagesUnread:  getEnvBool("CHAT_SYSTEM_MESSAGES_UNREAD", false),
+		MaxPins:               getEnvInt("CHAT_MAX_PINS", 50),
+
+		RoomStreams: getEnvBool("CHAT_ROOM_STREAMS", false),
+		InstanceID:  getEnv("CHAT_INSTANCE_ID", hostname()),
+
+		BatchInserts:       getEnvBool("CHAT_BATCH_INSERTS", false),
+		BatchMaxSize:       getEnvInt("CHAT_BATCH_MAX_SIZE", 100),
+		BatchFlushInterval: getEnvDuration("CHAT_BATCH_FLUSH_INTERVAL", 5*time.Millisecond),
+
+		MaxMessageBytes:        getEnvInt("CHAT_MAX_MESSAGE_BYTES", 10000),
+		MaxMessageRunes:        getEnvInt("CHAT_MAX_MESSAGE_RUNES", 5000),
+		MaxUsernameLength:      getEnvInt("CHAT_MAX_USERNAME_LENGTH", 50),
+		MaxEmailLength:         getEnvInt("CHAT_MAX_EMAIL_LENGTH", 100),
+		MaxAttachmentSizeBytes: getEnvInt("CHAT_MAX_ATTACHMENT_SIZE_BYTES", 10<<20),
+		MaxBodyBytes:           getEnvInt("CHAT_MAX_BODY_BYTES", 1<<20),
+
+		S3Bucket:    getEnv("CHAT_S3_BUCKET", ""),
+		S3PublicURL: getEnv("CHAT_S3_PUBLIC_URL", ""),
+
+		WebhookWorkers:      getEnvInt("CHAT_WEBHOOK_WORKERS", 4),
+		WebhookTimeout:      getEnvDuration("CHAT_WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookAttempts:     getEnvInt("CHAT_WEBHOOK_ATTEMPTS", 5),
+		WebhookBackoff:      getEnvDuration("CHAT_WEBHOOK_BACKOFF", time.Second),
+		WebhookMaxBackoff:   getEnvDuration("CHAT_WEBHOOK_MAX_BACKOFF", time.Minute),
+		WebhookDisableAfter: getEnvInt("CHAT_WEBHOOK_DISABLE_AFTER", 10),
+
+		BotWorkers:    getEnvInt("CHAT_BOT_WORKERS", 4),
+		BotTimeout:    getEnvDuration("CHAT_BOT_TIMEOUT", 10*time.Second),
+		BotAttempts:   getEnvInt("CHAT_BOT_ATTEMPTS", 3),
+		BotBackoff:    getEnvDuration("CHAT_BOT_BACKOFF", 500*time.Millisecond),
+		BotMaxBackoff: getEnvDuration("CHAT_BOT_MAX_BACKOFF", 5*time.Second),
+
+		FCMProjectID:       getEnv("CHAT_FCM_PROJECT_ID", ""),
+		FCMCredentialsFile: getEnv("CHAT_FCM_CREDENTIALS_FILE", ""),
+		PushWorkers:        getEnvInt("CHAT_PUSH_WORKERS", 4),
+		PushTimeout:        getEnvDuration("CHAT_PUSH_TIMEOUT", 10*time.Second),
+		PushAttempts:       getEnvInt("CHAT_PUSH_ATTEMPTS", 3),
+		PushBackoff:        getEnvDuration("CHAT_PUSH_BACKOFF", 500*time.Millisecond),
+		PushMaxBackoff:     getEnvDuration("CHAT_PUSH_MAX_BACKOFF", 5*time.Second),
+
+		AwayReplyCooldown: getEnvDuration("CHAT_AWAY_REPLY_COOLDOWN", time.Hour),
+
+		FilterRejectWords: getEnvList("CHAT_FILTER_REJECT_WORDS"),
+		FilterFlagWords:   getEnvList("CHAT_FILTER_FLAG_WORDS"),
+
+		OTelExporter: getEnv("CHAT_OTEL_EXPORTER", "otlp"),
+		OTelEndpoint: getEnv("CHAT_OTEL_ENDPOINT", "localhost:4317"),
+
+		AnalyticsEnabled:    getEnvBool("CHAT_ANALYTICS_ENABLED", false),
+		AnalyticsSampleRate: getEnvFloat("CHAT_ANALYTICS_SAMPLE_RATE", 0.1),
+		AnalyticsSalt:       getEnv("CHAT_ANALYTICS_SALT", ""),
+
+		MessageRetention: time.Duration(getEnvInt("CHAT_MESSAGE_RETENTION_DAYS", 0)) * 24 * time.Hour,
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// hostname is the machine's name, or "chat" if it cannot be told.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "chat"
+	}
+	return name
+}
+
+// getEnvList reads a comma-separated list, leaving out empty items.
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %v", key, value, fallback)
+		return fallback
+	}
+	return d
+}
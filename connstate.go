@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ConnectionState is where a WebSocket is in its lifecycle.
+type ConnectionState int
+
+const (
+	// StateConnecting is a request that has not been authorized yet.
+	StateConnecting ConnectionState = iota
+	// StateAuthenticated is an authorized request not yet upgraded.
+	StateAuthenticated
+	// StateActive is a registered connection whose frames are being read.
+	StateActive
+	// StateClosing is a connection that stopped reading and is being
+	// deregistered.
+	StateClosing
+	// StateClosed is the end: the connection, if any, is gone.
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateAuthenticated:
+		return "authenticated"
+	case StateActive:
+		return "active"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// connectionTransitions lists the states each state may move to. A request
+// refused or failing before it is active goes straight to closed; an active
+// connection always passes through closing so that it is deregistered.
+var connectionTransitions = map[ConnectionState][]ConnectionState{
+	StateConnecting:    {StateAuthenticated, StateClosed},
+	StateAuthenticated: {StateActive, StateClosed},
+	StateActive:        {StateClosing},
+	StateClosing:       {StateClosed},
+}
+
+// StateMachine tracks the state of one WebSocket and refuses transitions
+// connectionTransitions does not allow.
+type StateMachine struct {
+	userID string
+	logger *log.Logger
+
+	mu    sync.Mutex
+	state ConnectionState
+}
+
+func newStateMachine(userID string, logger *log.Logger) *StateMachine {
+	return &StateMachine{userID: userID, logger: logger, state: StateConnecting}
+}
+
+func (m *StateMachine) State() ConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Transition moves the machine to the state to and logs it, or returns an
+// error and stays put if to cannot follow the current state.
+func (m *StateMachine) Transition(to ConnectionState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.state
+	for _, allowed := range connectionTransitions[from] {
+		if allowed == to {
+			m.state = to
+			m.logger.Printf("connection of %s: %s -> %s", m.userID, from, to)
+			return nil
+		}
+	}
+	return fmt.Errorf("connection of %s: invalid transition %s -> %s", m.userID, from, to)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var connectionStates = []ConnectionState{StateConnecting, StateAuthenticated, StateActive, StateClosing, StateClosed}
+
+// machineIn returns a machine that has reached state by allowed transitions.
+func machineIn(t *testing.T, state ConnectionState, logs *bytes.Buffer) *StateMachine {
+	path := map[ConnectionState][]ConnectionState{
+		StateConnecting:    nil,
+		StateAuthenticated: {StateAuthenticated},
+		StateActive:        {StateAuthenticated, StateActive},
+		StateClosing:       {StateAuthenticated, StateActive, StateClosing},
+		StateClosed:        {StateAuthenticated, StateActive, StateClosing, StateClosed},
+	}
+	m := newStateMachine("7", log.New(logs, "", 0))
+	for _, to := range path[state] {
+		if err := m.Transition(to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestStateMachineTransitions(t *testing.T) {
+	valid := map[[2]ConnectionState]bool{
+		{StateConnecting, StateAuthenticated}: true,
+		{StateConnecting, StateClosed}:        true,
+		{StateAuthenticated, StateActive}:     true,
+		{StateAuthenticated, StateClosed}:     true,
+		{StateActive, StateClosing}:           true,
+		{StateClosing, StateClosed}:           true,
+	}
+
+	for _, from := range connectionStates {
+		for _, to := range connectionStates {
+			var logs bytes.Buffer
+			m := machineIn(t, from, &logs)
+			logs.Reset()
+
+			err := m.Transition(to)
+			if valid[[2]ConnectionState{from, to}] {
+				assert.NoError(t, err, "%s -> %s", from, to)
+				assert.Equal(t, to, m.State())
+				assert.Equal(t, "connection of 7: "+from.String()+" -> "+to.String()+"\n", logs.String())
+			} else {
+				assert.Error(t, err, "%s -> %s", from, to)
+				assert.Equal(t, from, m.State(), "an invalid transition leaves the state alone")
+				assert.Empty(t, logs.String())
+			}
+		}
+	}
+}
+
+func TestConnectionStateString(t *testing.T) {
+	assert.Equal(t, "active", StateActive.String())
+	assert.Equal(t, "state(9)", ConnectionState(9).String())
+}
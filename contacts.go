@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultContactListLimit = 50
+	maxContactListLimit     = 200
+)
+
+var errContactDeclined = errors.New("recipient declined your contact request")
+
+// Contact is a user the caller has accepted, or who accepted the caller.
+type Contact struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Since    time.Time `json:"since"`
+}
+
+// ContactRequest asks AddresseeID to become a contact of RequesterID.
+// Username is that of the other party.
+type ContactRequest struct {
+	RequesterID int       `json:"requester_id"`
+	AddresseeID int       `json:"addressee_id"`
+	Username    string    `json:"username"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ContactRequestEvent tells a user someone wants to become their contact.
+type ContactRequestEvent struct {
+	Type     string `json:"type"`
+	FromID   int    `json:"from_id"`
+	Username string `json:"username"`
+}
+
+type contactRequestBody struct {
+	Username string `json:"username"`
+}
+
+// contactState reports whether a and b are contacts, and whether b
+// declined a request from a.
+func contactState(ctx context.Context, a, b int) (contacts, declined bool, err error) {
+	err = db.QueryRowContext(ctx,
+		`SELECT COALESCE(bool_or(status = 'accepted'), FALSE),
+			COALESCE(bool_or(requester_id = $1 AND status = 'declined'), FALSE)
+		FROM contacts
+		WHERE (requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1)`,
+		a, b).Scan(&contacts, &declined)
+	return contacts, declined, err
+}
+
+// screenContact applies strict mode to a direct message. A message between
+// users who are not contacts becomes a message request, which the
+// recipient only sees once they accept the sender, and one to a user who
+// declined the sender is refused with errContactDeclined.
+func screenContact(ctx context.Context, msg *Message) error {
+	msg.Request = false
+	if !cfg.ContactsStrict || msg.SenderID == msg.RecipientID {
+		return nil
+	}
+	contacts, declined, err := contactState(ctx, msg.SenderID, msg.RecipientID)
+	if err != nil {
+		return err
+	}
+	if declined {
+		return errContactDeclined
+	}
+	msg.Request = !contacts
+	return nil
+}
+
+// requestContact records a pending request from one user to another and
+// tells the addressee about it. It returns sql.ErrNoRows if there already
+// is a request between them in that direction.
+func requestContact(ctx context.Context, from, to int) (time.Time, error) {
+	var createdAt time.Time
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO contacts (requester_id, addressee_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING RETURNING created_at`, from, to).Scan(&createdAt)
+	if err != nil {
+		return createdAt, err
+	}
+
+	event := ContactRequestEvent{Type: "contact_request", FromID: from}
+	if user, err := loadUser(ctx, from); err == nil {
+		event.Username = user.Username
+	} else {
+		logger(ctx).Println("Failed to load requester:", err)
+	}
+	registry.Send(strconv.Itoa(to), event)
+	dropContactTotals(ctx, to)
+	return createdAt, nil
+}
+
+// dropContactTotals drops the cached counts of the contacts and contact
+// requests of users whose contacts changed.
+func dropContactTotals(ctx context.Context, userIDs ...int) {
+	var keys []string
+	for _, id := range userIDs {
+		keys = append(keys, pageTotalKey("contacts:"+strconv.Itoa(id)), pageTotalKey("contact_requests:"+strconv.Itoa(id)))
+	}
+	if err := redisCli.Del(ctx, keys...).Err(); err != nil {
+		logger(ctx).Println("Failed to drop contact counts:", err)
+	}
+}
+
+// openMessageRequest makes sure the recipient of a message request has a
+// contact request from its sender to answer.
+func openMessageRequest(ctx context.Context, msg Message) {
+	if _, err := requestContact(ctx, msg.SenderID, msg.RecipientID); err != nil && err != sql.ErrNoRows {
+		logger(ctx).Println("Failed to open contact request:", err)
+	}
+}
+
+// answerContactRequest accepts or declines the pending request from
+// requester to addressee. Accepting moves the requester's message requests
+// into the conversation; declining discards them. It returns sql.ErrNoRows
+// if there is no pending request.
+func answerContactRequest(ctx context.Context, requester, addressee int, accept bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := "declined"
+	if accept {
+		status = "accepted"
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE contacts SET status = $3, responded_at = NOW()
+		WHERE requester_id = $1 AND addressee_id = $2 AND status = 'pending'`,
+		requester, addressee, status)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	query := "DELETE FROM messages WHERE sender_id = $1 AND receiver_id = $2 AND request"
+	if accept {
+		query = "UPDATE messages SET request = FALSE WHERE sender_id = $1 AND receiver_id = $2 AND request"
+	}
+	if _, err := tx.ExecContext(ctx, query, requester, addressee); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dropContactTotals(ctx, requester, addressee)
+	return nil
+}
+
+// createContactRequest asks the user with the given username to become the
+// caller's contact. If that user already asked the caller, their request
+// is accepted instead.
+func createContactRequest(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createContactRequest")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var body contactRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if strings.TrimSpace(body.Username) == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "username is required")
+		return
+	}
+
+	var targetID int
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id FROM users WHERE lower(username) = lower($1) AND deleted_at IS NULL AND banned_at IS NULL",
+		body.Username).Scan(&targetID)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound)
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", targetID))
+	if targetID == claims.UserID {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "Cannot add yourself as a contact")
+		return
+	}
+
+	contacts, _, err := contactState(ctx, claims.UserID, targetID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if contacts {
+		WriteError(w, http.StatusConflict, codeConflict, "Already a contact")
+		return
+	}
+
+	request := ContactRequest{RequesterID: claims.UserID, AddresseeID: targetID, Username: body.Username, Status: "pending"}
+	err = answerContactRequest(ctx, targetID, claims.UserID, true)
+	if err == nil {
+		request = ContactRequest{RequesterID: targetID, AddresseeID: claims.UserID, Username: body.Username, Status: "accepted", CreatedAt: time.Now().UTC()}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(request)
+		return
+	} else if err != sql.ErrNoRows {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	request.CreatedAt, err = requestContact(ctx, claims.UserID, targetID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusConflict, codeConflict, "Contact request already sent")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(request)
+}
+
+// listContactRequests returns a page of the pending requests made to the
+// caller, oldest first. The cursor is the requester_id of the last request
+// of the previous page.
+func listContactRequests(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listContactRequests")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	limit, cursor, err := contactListPage(r.URL.Query())
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT c.requester_id, u.username, c.created_at FROM contacts c
+		JOIN users u ON u.user_id = c.requester_id
+		WHERE c.addressee_id = $1 AND c.status = 'pending' AND u.deleted_at IS NULL
+		AND ($3::int IS NULL OR (c.created_at, c.requester_id) >
+			(SELECT created_at, requester_id FROM contacts WHERE requester_id = $3 AND addressee_id = $1))
+		ORDER BY c.created_at, c.requester_id
+		LIMIT $2`, claims.UserID, limit+1, cursor)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []ContactRequest{}
+	for rows.Next() {
+		request := ContactRequest{AddresseeID: claims.UserID, Status: "pending"}
+		if err := rows.Scan(&request.RequesterID, &request.Username, &request.CreatedAt); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, request)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, "contact_requests:"+strconv.Itoa(claims.UserID),
+		`SELECT COUNT(*) FROM contacts c
+		JOIN users u ON u.user_id = c.requester_id
+		WHERE c.addressee_id = $1 AND c.status = 'pending' AND u.deleted_at IS NULL`, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(requests, limit, total, func(request ContactRequest) int { return request.RequesterID }))
+}
+
+func acceptContactRequest(w http.ResponseWriter, r *http.Request) {
+	respondToContactRequest(w, r, true)
+}
+
+func declineContactRequest(w http.ResponseWriter, r *http.Request) {
+	respondToContactRequest(w, r, false)
+}
+
+// respondToContactRequest answers the pending request the user in the path
+// made to the caller.
+func respondToContactRequest(w http.ResponseWriter, r *http.Request, accept bool) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.respondToContactRequest")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	requesterID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", requesterID), attribute.Bool("chat.accept", accept))
+
+	if err := answerContactRequest(ctx, requesterID, claims.UserID, accept); err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Contact request not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !accept {
+		// Declining is how a user blocks someone.
+		recordAudit(ctx, claims.UserID, "contact_decline", userTarget(requesterID))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listContacts returns a page of the caller's contacts by username. The
+// cursor is the user_id of the last contact of the previous page.
+func listContacts(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listContacts")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	limit, cursor, err := contactListPage(r.URL.Query())
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT u.user_id, u.username, c.responded_at FROM contacts c
+		JOIN users u ON u.user_id = CASE WHEN c.requester_id = $1 THEN c.addressee_id ELSE c.requester_id END
+		WHERE (c.requester_id = $1 OR c.addressee_id = $1) AND c.status = 'accepted' AND u.deleted_at IS NULL
+		AND ($3::int IS NULL OR u.username > (SELECT username FROM users WHERE user_id = $3))
+		ORDER BY u.username
+		LIMIT $2`, claims.UserID, limit+1, cursor)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var contact Contact
+		if err := rows.Scan(&contact.UserID, &contact.Username, &contact.Since); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, "contacts:"+strconv.Itoa(claims.UserID),
+		`SELECT COUNT(*) FROM contacts c
+		JOIN users u ON u.user_id = CASE WHEN c.requester_id = $1 THEN c.addressee_id ELSE c.requester_id END
+		WHERE (c.requester_id = $1 OR c.addressee_id = $1) AND c.status = 'accepted' AND u.deleted_at IS NULL`, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(contacts, limit, total, func(contact Contact) int { return contact.UserID }))
+}
+
+// contactListPage reads the limit and cursor of a page of contacts or
+// contact requests.
+func contactListPage(query url.Values) (limit int, cursor *int, err error) {
+	if limit, err = parseLimit(query, defaultContactListLimit, maxContactListLimit); err != nil {
+		return 0, nil, err
+	}
+	cursor, err = parseCursor(query)
+	return limit, cursor, err
+}
+
+// getMessageRequests returns the message requests waiting for the caller,
+// newest first.
+func getMessageRequests(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getMessageRequests")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, seq, sender_id, receiver_id, text, expires_at, created_at, updated_at, version FROM messages
+		WHERE receiver_id = $1 AND request
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY created_at DESC, message_id DESC
+		LIMIT $2`, claims.UserID, maxHistoryLimit)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	writeMessages(ctx, w, rows)
+}
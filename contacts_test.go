@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// contactStore keeps the contacts table in memory, keyed by requester and
+// addressee. Everything else goes to a recipientStore.
+type contactStore struct {
+	recipients *recipientStore
+
+	mu       sync.Mutex
+	statuses map[[2]int64]string
+}
+
+func (s *contactStore) Connect(context.Context) (driver.Conn, error) {
+	return contactConn{recipientConn: recipientConn{store: s.recipients}, store: s}, nil
+}
+
+func (s *contactStore) Driver() driver.Driver { return nil }
+
+func (s *contactStore) set(requester, addressee int64, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[[2]int64{requester, addressee}] = status
+}
+
+func (s *contactStore) status(requester, addressee int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statuses[[2]int64{requester, addressee}]
+}
+
+type contactConn struct {
+	recipientConn
+	store *contactStore
+}
+
+func (c contactConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "contacts") {
+		return c.recipientConn.QueryContext(ctx, query, args)
+	}
+	a, b := args[0].Value.(int64), args[1].Value.(int64)
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(query, "INSERT") {
+		_, exists := s.statuses[[2]int64{a, b}]
+		if !exists {
+			s.statuses[[2]int64{a, b}] = "pending"
+		}
+		return &valueRows{column: "created_at", value: insertedAt, done: exists}, nil
+	}
+	ab, ba := s.statuses[[2]int64{a, b}], s.statuses[[2]int64{b, a}]
+	return &contactStateRows{contacts: ab == "accepted" || ba == "accepted", declined: ab == "declined"}, nil
+}
+
+type contactStateRows struct {
+	contacts, declined bool
+	done               bool
+}
+
+func (r *contactStateRows) Columns() []string { return []string{"contacts", "declined"} }
+func (r *contactStateRows) Close() error      { return nil }
+
+func (r *contactStateRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.contacts, r.declined
+	r.done = true
+	return nil
+}
+
+func initContactStore(t *testing.T, active ...int64) *contactStore {
+	store := &contactStore{
+		recipients: &recipientStore{active: make(map[int64]bool), banned: make(map[int64]bool), clientMsgs: make(map[string]Message)},
+		statuses:   make(map[[2]int64]string),
+	}
+	for _, id := range active {
+		store.recipients.active[id] = true
+	}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func useStrictContacts(t *testing.T) {
+	previous := cfg.ContactsStrict
+	cfg.ContactsStrict = true
+	t.Cleanup(func() { cfg.ContactsStrict = previous })
+}
+
+func TestStrictContactsHoldBackStrangers(t *testing.T) {
+	mr := initRedis(t)
+	store := initContactStore(t, 961, 962, 963)
+	store.set(963, 962, "declined")
+	useStrictContacts(t)
+	server := newTestServer(t, newRouter())
+
+	receiver := dialTestUser(t, server, 962)
+	waitForClients(t, 1)
+
+	rr := postMessage(Message{SenderID: 963, RecipientID: 962, Text: "let me in"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), errContactDeclined.Error())
+
+	// A stranger's message is accepted as a request, and the recipient is
+	// asked about the sender instead of getting it.
+	mr.Set(pageTotalKey("contact_requests:962"), "0")
+	rr = postMessage(Message{SenderID: 961, RecipientID: 962, Text: "hello stranger"})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var msg Message
+	json.NewDecoder(rr.Body).Decode(&msg)
+	assert.True(t, msg.Request)
+	assert.Equal(t, "pending", store.status(961, 962))
+	assert.False(t, mr.Exists(pageTotalKey("contact_requests:962")), "the cached count of requests is dropped")
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ContactRequestEvent
+	if err := receiver.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ContactRequestEvent{Type: "contact_request", FromID: 961}, event)
+
+	declined := dialTestUser(t, server, 963)
+	waitForClients(t, 2)
+	if err := declined.WriteJSON(Message{SenderID: 963, RecipientID: 962, Text: "please"}); err != nil {
+		t.Fatal(err)
+	}
+	declined.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var errEvent ErrorEvent
+	if err := declined.ReadJSON(&errEvent); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "contact_declined", errEvent.Code)
+
+	store.set(961, 962, "accepted")
+	rr = postMessage(Message{SenderID: 961, RecipientID: 962, Text: "hello friend"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	msg = Message{}
+	json.NewDecoder(rr.Body).Decode(&msg)
+	assert.False(t, msg.Request)
+}
+
+func TestContactsIgnoredOutsideStrictMode(t *testing.T) {
+	initRedis(t)
+	store := initContactStore(t, 971, 972)
+	store.set(971, 972, "declined")
+
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 971, RecipientID: 972, Text: "hi"}).Code)
+}
+
+func TestContactRequestFlow(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	useStrictContacts(t)
+	router := newRouter()
+
+	alice := insertTestUser(t, "hash")
+	bob := insertTestUser(t, "hash")
+	carol := insertTestUser(t, "hash")
+	username := func(userID int) string {
+		var name string
+		if err := db.QueryRow("SELECT username FROM users WHERE user_id = $1", userID).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	serve := func(userID int, method, path string, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, body))
+		return rr
+	}
+	history := func(userID, with int) []Message {
+		var page Page[Message]
+		json.NewDecoder(serve(userID, "GET", "/messages?with="+strconv.Itoa(with), nil).Body).Decode(&page)
+		return page.Items
+	}
+
+	assert.Equal(t, http.StatusAccepted, postMessage(Message{SenderID: alice, RecipientID: bob, Text: "hi bob"}).Code)
+	assert.Empty(t, history(bob, alice), "requests stay out of the conversation")
+	assert.Len(t, history(alice, bob), 1, "the sender still sees what they sent")
+
+	var requests []Message
+	json.NewDecoder(serve(bob, "GET", "/messages/requests", nil).Body).Decode(&requests)
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "hi bob", requests[0].Text)
+	}
+	var pending Page[ContactRequest]
+	json.NewDecoder(serve(bob, "GET", "/contacts/requests", nil).Body).Decode(&pending)
+	if assert.Len(t, pending.Items, 1) {
+		assert.Equal(t, alice, pending.Items[0].RequesterID)
+		assert.Equal(t, username(alice), pending.Items[0].Username)
+	}
+	assert.EqualValues(t, 1, pending.Total)
+
+	assert.Equal(t, http.StatusNotFound, serve(alice, "POST", "/contacts/requests/"+strconv.Itoa(bob)+"/accept", nil).Code,
+		"only the addressee answers a request")
+	assert.Equal(t, http.StatusNoContent, serve(bob, "POST", "/contacts/requests/"+strconv.Itoa(alice)+"/accept", nil).Code)
+
+	var contacts Page[Contact]
+	json.NewDecoder(serve(alice, "GET", "/contacts", nil).Body).Decode(&contacts)
+	if assert.Len(t, contacts.Items, 1) {
+		assert.Equal(t, bob, contacts.Items[0].UserID)
+	}
+	assert.EqualValues(t, 1, contacts.Total)
+	pending = Page[ContactRequest]{}
+	json.NewDecoder(serve(bob, "GET", "/contacts/requests", nil).Body).Decode(&pending)
+	assert.Empty(t, pending.Items)
+	assert.Zero(t, pending.Total, "answering drops the cached count")
+	assert.Len(t, history(bob, alice), 1, "accepting moves the request into the conversation")
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: bob, RecipientID: alice, Text: "hi alice"}).Code)
+	assert.Equal(t, http.StatusConflict, serve(alice, "POST", "/contacts/requests", contactRequestBody{Username: username(bob)}).Code)
+
+	rr := serve(carol, "POST", "/contacts/requests", contactRequestBody{Username: username(bob)})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, http.StatusConflict, serve(carol, "POST", "/contacts/requests", contactRequestBody{Username: username(bob)}).Code)
+	assert.Equal(t, http.StatusNoContent, serve(bob, "POST", "/contacts/requests/"+strconv.Itoa(carol)+"/decline", nil).Code)
+	assert.Equal(t, http.StatusForbidden, postMessage(Message{SenderID: carol, RecipientID: bob, Text: "still there?"}).Code)
+
+	assert.Equal(t, http.StatusNotFound, serve(carol, "POST", "/contacts/requests", contactRequestBody{Username: "nobody_" + strconv.Itoa(carol)}).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, serve(carol, "POST", "/contacts/requests", contactRequestBody{Username: username(carol)}).Code)
+}
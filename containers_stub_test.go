@@ -0,0 +1,15 @@
+//go:build !docker
+
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// setupTestContainers skips tests that need Postgres and Redis containers.
+// Run them with go test -tags docker on a machine with Docker.
+func setupTestContainers(t testing.TB) (*sql.DB, *RedisClient, func()) {
+	t.Skip("needs Docker: run with -tags docker")
+	return nil, nil, nil
+}
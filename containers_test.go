@@ -0,0 +1,159 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// templateDB is the database in the Postgres container that holds the
+// schema. Every test gets a copy of it, so tests never see each other's rows.
+const templateDB = "chatdb"
+
+// testContainers are the Postgres and Redis containers shared by the tests
+// in the package. They start with the first test that needs them and stop
+// in TestMain.
+var testContainers struct {
+	once     sync.Once
+	err      error
+	postgres *postgres.PostgresContainer
+	redis    *tcredis.RedisContainer
+	admin    *sql.DB
+	dsn      string
+	redisURL string
+	seq      atomic.Int64
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	ctx := context.Background()
+	if testContainers.admin != nil {
+		testContainers.admin.Close()
+	}
+	if testContainers.postgres != nil {
+		if err := testContainers.postgres.Terminate(ctx); err != nil {
+			log.Println("Failed to stop Postgres container:", err)
+		}
+	}
+	if testContainers.redis != nil {
+		if err := testContainers.redis.Terminate(ctx); err != nil {
+			log.Println("Failed to stop Redis container:", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// startTestContainers starts Postgres and Redis, loads database.sql.txt and
+// the migrations into the template database, and keeps a connection to the
+// postgres database for creating and dropping the copies.
+func startTestContainers() error {
+	ctx := context.Background()
+
+	pg, err := postgres.Run(ctx, "postgres:16-alpine",
+		postgres.WithDatabase(templateDB),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("postgres"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(time.Minute)),
+	)
+	testContainers.postgres = pg
+	if err != nil {
+		return err
+	}
+	host, err := pg.Host(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := pg.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		return err
+	}
+	testContainers.dsn = fmt.Sprintf("host=%s port=%s user=postgres password=postgres sslmode=disable", host, port.Port())
+
+	schema, err := os.ReadFile("database.sql.txt")
+	if err != nil {
+		return err
+	}
+	template, err := sql.Open("pgx", testContainers.dsn+" dbname="+templateDB)
+	if err != nil {
+		return err
+	}
+	if _, err := template.Exec(string(schema)); err != nil {
+		template.Close()
+		return fmt.Errorf("database.sql.txt: %w", err)
+	}
+	err = migrate(template)
+	// CREATE DATABASE ... TEMPLATE needs the template to have no sessions.
+	template.Close()
+	if err != nil {
+		return err
+	}
+
+	testContainers.admin, err = sql.Open("pgx", testContainers.dsn+" dbname=postgres")
+	if err != nil {
+		return err
+	}
+
+	rc, err := tcredis.Run(ctx, "redis:7-alpine")
+	testContainers.redis = rc
+	if err != nil {
+		return err
+	}
+	testContainers.redisURL, err = rc.ConnectionString(ctx)
+	return err
+}
+
+// setupTestContainers points db at a fresh copy of the schema and redisCli at
+// the Redis container under a key prefix of the test's own. Both are torn
+// down when the test ends.
+func setupTestContainers(t testing.TB) (*sql.DB, *RedisClient, func()) {
+	t.Helper()
+	testContainers.once.Do(func() { testContainers.err = startTestContainers() })
+	if testContainers.err != nil {
+		t.Fatal(testContainers.err)
+	}
+
+	name := fmt.Sprintf("test_%d", testContainers.seq.Add(1))
+	if _, err := testContainers.admin.Exec("CREATE DATABASE " + name + " TEMPLATE " + templateDB); err != nil {
+		t.Fatal(err)
+	}
+	testDB, err := sql.Open("pgx", testContainers.dsn+" dbname="+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, err := redis.ParseURL(testContainers.redisURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRedis := NewRedisClient(opt, name+":")
+
+	teardown := func() {
+		testRedis.Close()
+		testDB.Close()
+		if _, err := testContainers.admin.Exec("DROP DATABASE IF EXISTS " + name + " WITH (FORCE)"); err != nil {
+			t.Log("Failed to drop test database:", err)
+		}
+	}
+	t.Cleanup(teardown)
+
+	db, redisCli = testDB, testRedis
+	return testDB, testRedis, teardown
+}
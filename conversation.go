@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Event is anything sent down a connection: a Message or one of the event
+// types.
+type Event interface{}
+
+// Conversation is somewhere messages are sent, so that they and the events
+// about them reach the participants the same way whatever the kind of
+// conversation.
+type Conversation interface {
+	// ID returns the conversation's key, as conversationKey gives it.
+	ID() string
+	// Participants returns the users taking part.
+	Participants(ctx context.Context) ([]int, error)
+	// Broadcast delivers the event to the participants. A message skips
+	// its sender, unless it is a system message, and is marked muted for
+	// those who muted the conversation.
+	Broadcast(ctx context.Context, event Event) error
+}
+
+// DirectConversation is the conversation between two users, the lower id
+// first.
+type DirectConversation struct {
+	UserA, UserB int
+}
+
+func newDirectConversation(a, b int) DirectConversation {
+	if a > b {
+		a, b = b, a
+	}
+	return DirectConversation{UserA: a, UserB: b}
+}
+
+func (c DirectConversation) ID() string {
+	return fmt.Sprintf("dm:%d:%d", c.UserA, c.UserB)
+}
+
+func (c DirectConversation) Participants(context.Context) ([]int, error) {
+	if c.UserA == c.UserB {
+		return []int{c.UserA}, nil
+	}
+	return []int{c.UserA, c.UserB}, nil
+}
+
+func (c DirectConversation) Broadcast(ctx context.Context, event Event) error {
+	participants, _ := c.Participants(ctx)
+	msg, ok := event.(Message)
+	if !ok {
+		return deliverLocally(ctx, event, userIDStrings(participants), nil)
+	}
+	unmuted, muted := splitMuted(ctx, c.ID(), messageRecipients(msg, userIDStrings(participants)))
+	return deliverLocally(ctx, msg, unmuted, muted)
+}
+
+// RoomConversation is a room's conversation.
+type RoomConversation struct {
+	RoomID int
+}
+
+func (c RoomConversation) ID() string {
+	return fmt.Sprintf("room:%d", c.RoomID)
+}
+
+func (c RoomConversation) Participants(ctx context.Context) ([]int, error) {
+	members, err := roomMembers(ctx, c.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		if id, err := strconv.Atoi(member); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Broadcast sends messages through the room's stream when there are room
+// streams; other events go to the members connected here.
+func (c RoomConversation) Broadcast(ctx context.Context, event Event) error {
+	members, err := roomMembers(ctx, c.RoomID)
+	if err != nil {
+		return err
+	}
+	msg, ok := event.(Message)
+	if !ok {
+		return deliverLocally(ctx, event, members, nil)
+	}
+	unmuted, muted := splitMuted(ctx, c.ID(), messageRecipients(msg, members))
+	fanOutRoomMessage(ctx, msg, unmuted, muted)
+	return nil
+}
+
+// conversationOf returns the conversation a message belongs to.
+func conversationOf(msg Message) Conversation {
+	if msg.RoomID != 0 {
+		return RoomConversation{RoomID: msg.RoomID}
+	}
+	return newDirectConversation(msg.SenderID, msg.RecipientID)
+}
+
+// parseConversation returns the conversation with the given key.
+func parseConversation(key string) (Conversation, error) {
+	parts := strings.Split(key, ":")
+	switch {
+	case len(parts) == 2 && parts[0] == "room":
+		roomID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errInvalidConversationKey
+		}
+		return RoomConversation{RoomID: roomID}, nil
+	case len(parts) == 3 && parts[0] == "dm":
+		a, errA := strconv.Atoi(parts[1])
+		b, errB := strconv.Atoi(parts[2])
+		if errA != nil || errB != nil {
+			return nil, errInvalidConversationKey
+		}
+		return newDirectConversation(a, b), nil
+	}
+	return nil, errInvalidConversationKey
+}
+
+// messageRecipients returns the participants a message goes to.
+func messageRecipients(msg Message, participants []string) []string {
+	if msg.Kind == MessageKindSystem {
+		return participants
+	}
+	sender := strconv.Itoa(msg.SenderID)
+	recipients := make([]string, 0, len(participants))
+	for _, id := range participants {
+		if id != sender {
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+// splitMuted divides the recipients of a message in the conversation into
+// those who get it as usual and those who muted the conversation. When the
+// mutes cannot be told, nobody is taken to have muted it.
+func splitMuted(ctx context.Context, conversation string, recipients []string) (unmuted, muted []string) {
+	mutes, err := conversationMutes(ctx, conversation)
+	if err != nil {
+		logger(ctx).Println("Failed to look up conversation mutes:", err)
+	}
+	now := muteClock.Now()
+	unmuted = make([]string, 0, len(recipients))
+	for _, id := range recipients {
+		if until, ok := mutes[id]; mutedAt(until, ok, now) {
+			muted = append(muted, id)
+		} else {
+			unmuted = append(unmuted, id)
+		}
+	}
+	return unmuted, muted
+}
+
+// deliverLocally sends the event to the connections here of the users in
+// recipients and, marked muted when it is a message, of those in muted.
+// Messages are marked dnd for users who are not to be disturbed.
+func deliverLocally(ctx context.Context, event Event, recipients, muted []string) error {
+	var errs []error
+	msg, ok := event.(Message)
+	if !ok {
+		for _, id := range recipients {
+			errs = append(errs, registry.Send(id, event)...)
+		}
+		return errors.Join(errs...)
+	}
+
+	var connected []string
+	for _, ids := range [][]string{recipients, muted} {
+		for _, id := range ids {
+			if len(registry.Connections(id)) > 0 {
+				connected = append(connected, id)
+			}
+		}
+	}
+	dnd := usersInDND(ctx, connected)
+	for _, id := range recipients {
+		msg.DND = dnd[id]
+		errs = append(errs, registry.Send(id, msg)...)
+	}
+	msg.Muted = true
+	for _, id := range muted {
+		msg.DND = dnd[id]
+		errs = append(errs, registry.Send(id, msg)...)
+	}
+	return errors.Join(errs...)
+}
+
+func userIDStrings(ids []int) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = strconv.Itoa(id)
+	}
+	return out
+}
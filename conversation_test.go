@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConversation(t *testing.T) {
+	t.Parallel()
+	conv, err := parseConversation("dm:9:4")
+	assert.NoError(t, err)
+	assert.Equal(t, DirectConversation{UserA: 4, UserB: 9}, conv)
+	assert.Equal(t, "dm:4:9", conv.ID())
+
+	conv, err = parseConversation("room:7")
+	assert.NoError(t, err)
+	assert.Equal(t, RoomConversation{RoomID: 7}, conv)
+
+	for _, key := range []string{"", "dm:4", "dm:a:b", "room:", "room:7:8", "group:1"} {
+		_, err := parseConversation(key)
+		assert.Equal(t, errInvalidConversationKey, err, key)
+	}
+
+	assert.Equal(t, conversationKey(Message{SenderID: 9, RecipientID: 4}), conversationOf(Message{SenderID: 9, RecipientID: 4}).ID())
+	assert.Equal(t, conversationKey(Message{RoomID: 7}), conversationOf(Message{RoomID: 7}).ID())
+}
+
+func TestDirectConversationBroadcast(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	redisCli.HSet(ctx, conversationMutesKey("dm:3:5"), muteCacheLoaded, 0, "5", 0)
+	sender, _ := connectRecorder(t, "3")
+	recipient, _ := connectRecorder(t, "5")
+	conv := newDirectConversation(5, 3)
+
+	participants, err := conv.Participants(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 5}, participants)
+
+	assert.NoError(t, conv.Broadcast(ctx, Message{SenderID: 3, RecipientID: 5, Text: "hi"}))
+	got := waitForMessages(t, recipient, 1)
+	assert.True(t, got[0].Muted, "the recipient muted the conversation")
+
+	assert.NoError(t, conv.Broadcast(ctx, PinEvent{Type: "message_pinned", Conversation: conv.ID(), MessageID: 1}))
+	for _, rec := range []*recordingTransport{sender, recipient} {
+		assert.Eventually(t, func() bool {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			for _, v := range rec.written {
+				if _, ok := v.(PinEvent); ok {
+					return true
+				}
+			}
+			return false
+		}, time.Second, 5*time.Millisecond, "events reach both participants")
+	}
+	assert.Empty(t, sender.messages(), "messages skip their sender")
+}
+
+func TestRoomConversationBroadcast(t *testing.T) {
+	initRoleStore(t)
+	ctx := context.Background()
+	owner, _ := connectRecorder(t, "1")
+	member, _ := connectRecorder(t, "3")
+	conv := RoomConversation{RoomID: 7}
+
+	participants, err := conv.Participants(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int{1, 2, 3, 5, 6}, participants)
+
+	assert.NoError(t, conv.Broadcast(ctx, Message{SenderID: 1, RoomID: 7, Text: "hello"}))
+	assert.Equal(t, "hello", waitForMessages(t, member, 1)[0].Text)
+
+	assert.NoError(t, conv.Broadcast(ctx, Message{SenderID: 1, RoomID: 7, Text: "renamed", Kind: MessageKindSystem}))
+	got := waitForMessages(t, owner, 1)
+	assert.Equal(t, "renamed", got[0].Text, "system messages reach their actor too")
+	assert.Len(t, got, 1)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var conversationExportLimiter = failureLimiter{prefix: "export", limit: 5, window: time.Hour}
+
+// conversationExportRow is a message of an exported conversation. Deleted
+// messages keep their row, with the text and attachments blanked.
+type conversationExportRow struct {
+	ID          int          `json:"id"`
+	SenderID    int          `json:"sender_id"`
+	RecipientID int          `json:"recipient_id"`
+	Text        string       `json:"text"`
+	SentAt      time.Time    `json:"sent_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Deleted     bool         `json:"deleted"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+func (m conversationExportRow) csvRecord() []string {
+	return []string{
+		strconv.Itoa(m.ID),
+		strconv.Itoa(m.SenderID),
+		strconv.Itoa(m.RecipientID),
+		m.Text,
+		m.SentAt.Format(time.RFC3339),
+		m.UpdatedAt.Format(time.RFC3339),
+		strconv.FormatBool(m.Deleted),
+		attachmentURLs(m.Attachments),
+	}
+}
+
+// exportConversation streams the caller's whole direct conversation with
+// the peer in the path as a JSON array or CSV download.
+func exportConversation(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.exportConversation")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	peerID, err := strconv.Atoi(mux.Vars(r)["peer"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid peer id")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "format must be csv or json")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.peer_id", peerID), attribute.String("chat.export_format", format))
+
+	retryAfter, err := conversationExportLimiter.hit(ctx, strconv.Itoa(claims.UserID))
+	if err != nil {
+		logger(ctx).Println("Failed to count export:", err)
+	} else if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, sender_id, receiver_id, text, created_at, updated_at,
+			deleted_at IS NOT NULL OR text = $3, `+attachmentsJSON+`
+		FROM messages
+		WHERE LEAST(sender_id, receiver_id) = LEAST($1::int, $2::int)
+		AND GREATEST(sender_id, receiver_id) = GREATEST($1::int, $2::int)
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY seq, message_id`, claims.UserID, peerID, deletedMessageText)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	recordAudit(ctx, claims.UserID, "conversation_export", conversationKey(Message{SenderID: claims.UserID, RecipientID: peerID}))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"conversation-%d.%s\"", peerID, format))
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	out, flush, closeOut := exportOutput(w, r)
+	defer closeOut()
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(out)
+		csvWriter.Write([]string{"id", "sender_id", "recipient_id", "text", "sent_at", "updated_at", "deleted", "attachments"})
+	} else {
+		// The array is written an element at a time, so that it is never
+		// held whole.
+		out.Write([]byte("["))
+	}
+
+	count := 0
+	for rows.Next() {
+		var msg conversationExportRow
+		var attachments []byte
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Text, &msg.SentAt, &msg.UpdatedAt, &msg.Deleted, &attachments); err != nil {
+			logger(ctx).Println("Failed to scan exported message:", err)
+			return
+		}
+		if msg.Deleted {
+			msg.Text = ""
+		} else if msg.Attachments, err = decodeAttachments(attachments); err != nil {
+			logger(ctx).Println("Failed to read exported attachments:", err)
+			return
+		}
+
+		if csvWriter != nil {
+			err = csvWriter.Write(msg.csvRecord())
+		} else {
+			var data []byte
+			if data, err = json.Marshal(msg); err == nil {
+				if count > 0 {
+					out.Write([]byte(","))
+				}
+				_, err = out.Write(data)
+			}
+		}
+		if err != nil {
+			logger(ctx).Println("Failed to write exported message:", err)
+			return
+		}
+
+		count++
+		if count%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger(ctx).Println("Failed to read exported messages:", err)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+	} else {
+		out.Write([]byte("]"))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exportStore streams a conversation of n messages between users 1 and 2
+// without holding it, with awkward text, a file on the first message and
+// every tenth message deleted, and keeps the audit entries written.
+type exportStore struct {
+	n int
+
+	mu    sync.Mutex
+	audit []string
+}
+
+func (s *exportStore) Connect(context.Context) (driver.Conn, error) {
+	return exportConn{store: s}, nil
+}
+
+func (s *exportStore) Driver() driver.Driver { return nil }
+
+type exportConn struct {
+	fakeConn
+	store *exportStore
+}
+
+func (c exportConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &exportRows{n: c.store.n}, nil
+}
+
+func (c exportConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.audit = append(c.store.audit, fmt.Sprintf("%v %v %v", args[0].Value, args[1].Value, args[2].Value))
+	return driver.RowsAffected(1), nil
+}
+
+type exportRows struct {
+	n, next int
+}
+
+func exportedText(i int) string {
+	return fmt.Sprintf("message %d, with \"quotes\",\nand a second line", i)
+}
+
+func (r *exportRows) Columns() []string {
+	return []string{"message_id", "sender_id", "receiver_id", "text", "created_at", "updated_at", "deleted", "attachments"}
+}
+func (r *exportRows) Close() error { return nil }
+
+func (r *exportRows) Next(dest []driver.Value) error {
+	if r.next == r.n {
+		return io.EOF
+	}
+	r.next++
+	i := r.next
+	dest[0], dest[1], dest[2] = int64(i), int64(1+i%2), int64(2-i%2)
+	dest[3], dest[4], dest[5], dest[6] = exportedText(i), insertedAt, insertedAt.Add(time.Minute), i%10 == 0
+	dest[7] = []byte("[]")
+	if i == 1 {
+		dest[7] = []byte(`[{"id": 5, "filename": "plan.pdf", "content_type": "application/pdf", "size": 3, "thumbnail_url": null, "object_key": "attachments/2/plan"}]`)
+	}
+	if i%10 == 0 {
+		dest[3] = deletedMessageText
+	}
+	return nil
+}
+
+func initExportStore(t *testing.T, n int) *exportStore {
+	store := &exportStore{n: n}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func exportConversationRecorded(t *testing.T, userID int, query string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, userID, "GET", "/conversations/2/export"+query, nil))
+	return rr
+}
+
+func TestExportConversationCSV(t *testing.T) {
+	initRedis(t)
+	const n = 20000
+	store := initExportStore(t, n)
+
+	rr := exportConversationRecorded(t, 1, "?format=csv")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, records, n+1) {
+		return
+	}
+	assert.Equal(t, []string{"id", "sender_id", "recipient_id", "text", "sent_at", "updated_at", "deleted", "attachments"}, records[0])
+	assert.Equal(t, []string{"1", "2", "1", exportedText(1), insertedAt.Format(time.RFC3339), insertedAt.Add(time.Minute).Format(time.RFC3339), "false", objectURL("attachments/2/plan")}, records[1],
+		"commas, quotes and newlines survive the round trip")
+	assert.Equal(t, []string{"10", "1", "2", "", insertedAt.Format(time.RFC3339), insertedAt.Add(time.Minute).Format(time.RFC3339), "true", ""}, records[10],
+		"deleted messages are exported as tombstones")
+	assert.Equal(t, fmt.Sprint(n), records[n][0])
+	assert.Equal(t, []string{"1 conversation_export dm:1:2"}, store.audit)
+}
+
+func TestExportConversationJSON(t *testing.T) {
+	initRedis(t)
+	const n = 20000
+	initExportStore(t, n)
+
+	req := authedRequest(t, 1, "GET", "/conversations/2/export", nil)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var messages []conversationExportRow
+	if err := json.NewDecoder(rr.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, messages, n) {
+		assert.Equal(t, exportedText(1), messages[0].Text)
+		assert.Equal(t, []Attachment{{ID: 5, Filename: "plan.pdf", ContentType: "application/pdf", Size: 3, URL: objectURL("attachments/2/plan")}}, messages[0].Attachments,
+			"files come with where to download them")
+		assert.Empty(t, messages[1].Attachments)
+		assert.True(t, messages[9].Deleted)
+		assert.Empty(t, messages[9].Text)
+		assert.Equal(t, n, messages[n-1].ID)
+	}
+}
+
+func TestExportConversationLimits(t *testing.T) {
+	initRedis(t)
+	store := initExportStore(t, 1)
+
+	assert.Equal(t, http.StatusBadRequest, exportConversationRecorded(t, 1, "?format=xml").Code)
+	for i := int64(0); i < conversationExportLimiter.limit; i++ {
+		assert.Equal(t, http.StatusOK, exportConversationRecorded(t, 1, "?format=csv").Code)
+	}
+	rr := exportConversationRecorded(t, 1, "?format=csv")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, exportConversationRecorded(t, 2, "").Code, "the limit is per user")
+	assert.Len(t, store.audit, int(conversationExportLimiter.limit)+1)
+	assert.True(t, strings.HasPrefix(store.audit[len(store.audit)-1], "2 "))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/XSAM/otelsql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	DB_USER     = "postgres"
+	DB_PASSWORD = "postgres"
+	DB_NAME     = "chatdb"
+)
+
+// openDB connects to Postgres through pgx's database/sql driver, with every
+// connection going through the database breaker and traced by otelsql.
+func openDB(c Config) (*sql.DB, error) {
+	dbinfo := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
+		DB_USER, DB_PASSWORD, DB_NAME)
+	connConfig, err := pgx.ParseConfig(dbinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := stdlib.GetConnector(*connConfig)
+	d := otelsql.OpenDB(breakerConnector{Connector: connector, cb: dbBreaker},
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	configurePool(d, c)
+	return d, nil
+}
+
+// configurePool bounds the pool so a burst of requests queues for a
+// connection instead of opening one per request.
+func configurePool(d *sql.DB, c Config) {
+	d.SetMaxOpenConns(c.DBMaxOpenConns)
+	d.SetMaxIdleConns(c.DBMaxIdleConns)
+	d.SetConnMaxLifetime(c.DBConnMaxLifetime)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowConnector hands out connections whose statements take a while, and
+// keeps track of how many connections are open at once.
+type slowConnector struct {
+	open    atomic.Int64
+	maxOpen atomic.Int64
+}
+
+func (c *slowConnector) Connect(context.Context) (driver.Conn, error) {
+	n := c.open.Add(1)
+	for {
+		max := c.maxOpen.Load()
+		if n <= max || c.maxOpen.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	return &slowConn{connector: c}, nil
+}
+
+func (c *slowConnector) Driver() driver.Driver { return nil }
+
+type slowConn struct {
+	fakeConn
+	connector *slowConnector
+}
+
+func (c *slowConn) Close() error {
+	c.connector.open.Add(-1)
+	return nil
+}
+
+func (c *slowConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	time.Sleep(5 * time.Millisecond)
+	return driver.RowsAffected(1), nil
+}
+
+func TestPoolBoundsConnectionsUnderLoad(t *testing.T) {
+	connector := &slowConnector{}
+	testDB := sql.OpenDB(connector)
+	defer testDB.Close()
+
+	poolConfig := cfg
+	poolConfig.DBMaxOpenConns = 4
+	poolConfig.DBMaxIdleConns = 2
+	configurePool(testDB, poolConfig)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := testDB.ExecContext(context.Background(), "INSERT INTO messages DEFAULT VALUES")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	stats := testDB.Stats()
+	assert.LessOrEqual(t, connector.maxOpen.Load(), int64(4))
+	assert.Equal(t, 4, stats.MaxOpenConnections)
+	assert.Greater(t, stats.WaitCount, int64(0), "requests should have queued for a connection")
+	assert.LessOrEqual(t, stats.Idle, 2)
+}
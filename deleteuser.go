@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	deletedMessageText = "[message deleted]"
+
+	// deletionChallengeTTL is how long a second admin has to confirm an
+	// account deletion started by an admin.
+	deletionChallengeTTL    = 10 * time.Minute
+	deletionChallengeHeader = "X-Deletion-Challenge"
+)
+
+var (
+	errUnknownDeletionChallenge  = errors.New("unknown or expired deletion challenge")
+	errDeletionChallengeMismatch = errors.New("deletion challenge is for another user")
+	errSameAdminConfirmed        = errors.New("deletion must be confirmed by a second admin")
+)
+
+type deletionChallenge struct {
+	Challenge string `json:"challenge"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+func deletionChallengeKey(challenge string) string {
+	return fmt.Sprintf("deletion_challenge:%s", challenge)
+}
+
+// deleteUser erases an account. Users may delete their own; when an admin
+// deletes one, the request only opens a challenge that a different admin
+// has to confirm by repeating it with the challenge in X-Deletion-Challenge.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.deleteUser")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	claims := claimsFromContext(ctx)
+	if !canAccessUser(claims, userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	if claims.Role == RoleAdmin {
+		challenge := r.Header.Get(deletionChallengeHeader)
+		if challenge == "" {
+			openDeletionChallenge(ctx, w, userID, claims.UserID)
+			return
+		}
+		err := confirmDeletionChallenge(ctx, challenge, userID, claims.UserID)
+		switch err {
+		case nil:
+		case errUnknownDeletionChallenge, errDeletionChallengeMismatch, errSameAdminConfirmed:
+			WriteError(w, http.StatusForbidden, codeForbidden, err.Error())
+			return
+		default:
+			WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to check deletion challenge")
+			return
+		}
+	}
+
+	// Sessions go first so that no token of the account outlives it.
+	if err := revokeUserSessions(ctx, userID, ""); err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to revoke sessions")
+		return
+	}
+
+	roomIDs, err := eraseUser(ctx, userID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The account is gone from Postgres; leftovers in Redis can no longer be
+	// reached and the janitor sweeps them later.
+	if err := purgeUserCache(ctx, userID, roomIDs); err != nil {
+		logger(ctx).Println("Failed to purge cached data of deleted user:", err)
+	}
+	registry.Disconnect(strconv.Itoa(userID), websocket.CloseNormalClosure, "account deleted")
+	recordAudit(ctx, claims.UserID, "account_delete", userTarget(userID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func openDeletionChallenge(ctx context.Context, w http.ResponseWriter, userID, requesterID int) {
+	challenge, err := randomToken(16)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to create challenge")
+		return
+	}
+	value := fmt.Sprintf("%d:%d", userID, requesterID)
+	if err := redisCli.Set(ctx, deletionChallengeKey(challenge), value, deletionChallengeTTL).Err(); err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to create challenge")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(deletionChallenge{Challenge: challenge, ExpiresIn: int(deletionChallengeTTL.Seconds())})
+}
+
+// confirmDeletionChallenge consumes the challenge if it was opened for
+// userID by an admin other than confirmerID.
+func confirmDeletionChallenge(ctx context.Context, challenge string, userID, confirmerID int) error {
+	key := deletionChallengeKey(challenge)
+	value, err := redisCli.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return errUnknownDeletionChallenge
+	} else if err != nil {
+		return err
+	}
+
+	target, requester, _ := strings.Cut(value, ":")
+	if target != strconv.Itoa(userID) {
+		return errDeletionChallengeMismatch
+	}
+	if requester == strconv.Itoa(confirmerID) {
+		return errSameAdminConfirmed
+	}
+
+	// Del tells concurrent confirmations apart: only one of them removes it.
+	n, err := redisCli.Del(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUnknownDeletionChallenge
+	}
+	return nil
+}
+
+// eraseUser pseudonymizes the account, blanks the text of every message it
+// sent and takes it out of its rooms, returning their IDs. The message rows
+// stay so that conversations keep their shape. It returns sql.ErrNoRows if
+// there is no such active user.
+func eraseUser(ctx context.Context, userID int) ([]int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET
+			username = 'deleted_user_' || user_id,
+			email = encode(sha256(convert_to(email, 'UTF8')), 'hex'),
+			password_hash = '',
+			oauth_provider = NULL,
+			oauth_sub = NULL,
+			status_text = NULL,
+			availability = NULL,
+			status_expires_at = NULL,
+			last_seen_at = NULL,
+			deleted_at = NOW()
+		WHERE user_id = $1 AND deleted_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE messages SET text = $2 WHERE sender_id = $1", userID, deletedMessageText); err != nil {
+		return nil, err
+	}
+	// Messages still waiting to go out would carry the text after all.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM scheduled_messages WHERE sender_id = $1", userID); err != nil {
+		return nil, err
+	}
+	// Rendered text and link previews would give the blanked text away, and
+	// pins would show it off.
+	for _, table := range []string{"message_renders", "link_previews", "pins"} {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE message_id IN (SELECT message_id FROM messages WHERE sender_id = $1)", userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM contacts WHERE requester_id = $1 OR addressee_id = $1", userID); err != nil {
+		return nil, err
+	}
+	// Account exports are copies of everything above, and the devices would
+	// still get push notifications.
+	for _, table := range []string{"conversation_archives", "notification_prefs", "account_exports", "device_tokens", "user_settings", "away_messages"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+			return nil, err
+		}
+	}
+	// Mentions carry a copy of the room message they come from, and
+	// system messages the user's name.
+	for _, table := range []string{"message_mentions", "room_messages"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE sender_id = $1 OR user_id = $1", userID); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, "DELETE FROM room_members WHERE user_id = $1 RETURNING room_id, role", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roomIDs []int
+	var owned []int64
+	for rows.Next() {
+		var roomID int
+		var role string
+		if err := rows.Scan(&roomID, &role); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+		if role == RoomOwner {
+			owned = append(owned, int64(roomID))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Rooms the user owned pass to their highest ranking, longest member.
+	if len(owned) > 0 {
+		_, err := tx.ExecContext(ctx,
+			`UPDATE room_members m SET role = 'owner'
+			FROM (
+				SELECT DISTINCT ON (room_id) room_id, user_id FROM room_members
+				WHERE room_id = ANY($1)
+				ORDER BY room_id, role, joined_at
+			) o
+			WHERE m.room_id = o.room_id AND m.user_id = o.user_id`, owned)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roomIDs, tx.Commit()
+}
+
+// purgeUserCache drops the user's cached profile, existence check, offline
+// inbox, archived conversations, unread counts and membership of the given
+// rooms.
+func purgeUserCache(ctx context.Context, userID int, roomIDs []int) error {
+	pipe := redisCli.TxPipeline()
+	pipe.Del(ctx,
+		userCacheKey(userID),
+		userSessionsKey(userID),
+		userExistsKey(userID),
+		inboxKey(strconv.Itoa(userID)),
+		userRoomsKey(strconv.Itoa(userID)),
+		archivedConversationsKey(userID),
+		unreadKey(strconv.Itoa(userID)),
+	)
+	for _, roomID := range roomIDs {
+		pipe.SRem(ctx, roomMembersKey(roomID), userID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func deleteUserRequest(t *testing.T, callerID int, role string, userID int, challenge string) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), callerID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("DELETE", "/users/"+strconv.Itoa(userID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(userID)})
+	req.Header.Set("Authorization", "Bearer "+token)
+	if challenge != "" {
+		req.Header.Set(deletionChallengeHeader, challenge)
+	}
+	rr := httptest.NewRecorder()
+	requireAuth(deleteUser)(rr, req)
+	return rr
+}
+
+func TestDeleteUserForbidden(t *testing.T) {
+	initRedis(t)
+
+	rr := deleteUserRequest(t, 1, RoleUser, 2, "")
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestDeleteUserAdminNeedsSecondAdmin(t *testing.T) {
+	initRedis(t)
+
+	rr := deleteUserRequest(t, 100, RoleAdmin, 5, "")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var challenge deletionChallenge
+	if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, challenge.Challenge)
+
+	rr = deleteUserRequest(t, 100, RoleAdmin, 5, challenge.Challenge)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "the requesting admin cannot confirm")
+
+	rr = deleteUserRequest(t, 101, RoleAdmin, 6, challenge.Challenge)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "the challenge is bound to one user")
+
+	ctx := context.Background()
+	assert.NoError(t, confirmDeletionChallenge(ctx, challenge.Challenge, 5, 101))
+	assert.Error(t, confirmDeletionChallenge(ctx, challenge.Challenge, 5, 102), "a challenge is single use")
+}
+
+func TestDeleteUserErasesData(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	userID := insertTestUser(t, "hash")
+	peerID := insertTestUser(t, "hash")
+	for _, m := range []Message{
+		{SenderID: userID, RecipientID: peerID, Text: "secret"},
+		{SenderID: peerID, RecipientID: userID, Text: "reply"},
+	} {
+		if _, err := storeMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cacheUser(ctx, User{ID: userID}); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := deleteUserRequest(t, userID, RoleUser, userID, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	var username, email, passwordHash string
+	var deleted bool
+	err := db.QueryRow("SELECT username, email, password_hash, deleted_at IS NOT NULL FROM users WHERE user_id = $1", userID).
+		Scan(&username, &email, &passwordHash, &deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "deleted_user_"+strconv.Itoa(userID), username)
+	assert.Len(t, email, 64)
+	assert.Empty(t, passwordHash)
+	assert.True(t, deleted)
+
+	var sent, received string
+	db.QueryRow("SELECT text FROM messages WHERE sender_id = $1", userID).Scan(&sent)
+	db.QueryRow("SELECT text FROM messages WHERE receiver_id = $1", userID).Scan(&received)
+	assert.Equal(t, deletedMessageText, sent)
+	assert.Equal(t, "reply", received)
+
+	sessions, _ := redisCli.Exists(ctx, userSessionsKey(userID), userCacheKey(userID)).Result()
+	assert.Zero(t, sessions)
+
+	rr = deleteUserRequest(t, userID, RoleUser, userID, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type disconnectResult struct {
+	Disconnected int `json:"disconnected"`
+}
+
+// UserConnections are the open connections of a user on this instance.
+type UserConnections struct {
+	UserID      string           `json:"user_id"`
+	Sockets     int              `json:"sockets"`
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// ConnectionInfo is the server's view of one connection. QueueDepth is how
+// many events wait for its write pump.
+type ConnectionInfo struct {
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Codec       string    `json:"codec,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	QueueDepth  int       `json:"queue_depth"`
+	Dropped     int64     `json:"dropped,omitempty"`
+}
+
+func connectionInfo(c *client) ConnectionInfo {
+	info := ConnectionInfo{ConnectedAt: c.connectedAt, QueueDepth: len(c.send), Dropped: c.dropped.Load()}
+	if d, ok := c.transport.(describer); ok {
+		t := d.describe()
+		info.RemoteAddr, info.Protocol, info.Codec = t.remoteAddr, t.protocol, t.codec
+	}
+	return info
+}
+
+// listConnections returns the users connected to this instance and their
+// connections, by user ID. Other instances have their own.
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	_, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listConnections")
+	defer span.End()
+
+	users := []UserConnections{}
+	registry.Range(func(userID string, clients []*client) bool {
+		user := UserConnections{UserID: userID, Sockets: len(clients), Connections: make([]ConnectionInfo, len(clients))}
+		for i, c := range clients {
+			user.Connections[i] = connectionInfo(c)
+		}
+		users = append(users, user)
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	span.SetAttributes(attribute.Int("chat.connected_users", len(users)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// disconnectUser kicks a user off every device. Their login sessions are
+// revoked first so the clients cannot reconnect with the tokens they hold.
+func disconnectUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.disconnectUser")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	if err := revokeUserSessions(ctx, userID, ""); err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to revoke sessions")
+		return
+	}
+
+	result := disconnectResult{
+		Disconnected: registry.Disconnect(strconv.Itoa(userID), websocket.ClosePolicyViolation, "disconnected by an administrator"),
+	}
+	span.SetAttributes(attribute.Int("chat.disconnected", result.Disconnected))
+	auditCaller(ctx, "disconnect", userTarget(userID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
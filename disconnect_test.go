@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisconnectUser(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	phone := dialTestUser(t, server, 601)
+	laptop := dialTestUser(t, server, 601)
+	dialTestUser(t, server, 602)
+	waitForClients(t, 3)
+
+	adminToken, err := createSession(context.Background(), 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/admin/connections/601", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result disconnectResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, result.Disconnected)
+
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected policy violation close, got %v", err)
+	}
+	assert.Len(t, registry.Connections("601"), 0)
+	assert.Len(t, registry.Connections("602"), 1)
+
+	sessions, err := redisCli.SCard(context.Background(), userSessionsKey(601)).Result()
+	assert.NoError(t, err)
+	assert.Zero(t, sessions, "sessions should be revoked")
+}
+
+func TestDisconnectUserRequiresAdmin(t *testing.T) {
+	initRedis(t)
+	server := newTestServer(t, newRouter())
+
+	token, err := createSession(context.Background(), 603, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/admin/connections/604", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// adminRequest sends a request to the server as an admin.
+func adminRequest(t *testing.T, server *httptest.Server, method, path string) *http.Response {
+	token, err := createSession(context.Background(), 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(method, server.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestListConnections(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	start := time.Now()
+	dialTestUser(t, server, 611)
+	msgpack := &websocket.Dialer{Subprotocols: []string{subprotocolMsgpack}}
+	dialTestUserWith(t, msgpack, server, 611)
+	other := dialTestUser(t, server, 612)
+	waitForClients(t, 3)
+
+	list := func() map[string]UserConnections {
+		resp := adminRequest(t, server, "GET", "/admin/connections")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var users []UserConnections
+		if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]UserConnections)
+		for _, user := range users {
+			byID[user.UserID] = user
+		}
+		return byID
+	}
+
+	users := list()
+	assert.Len(t, users, 2)
+	assert.Equal(t, 2, users["611"].Sockets)
+	var codecs []string
+	for _, conn := range users["611"].Connections {
+		codecs = append(codecs, conn.Codec)
+		assert.Equal(t, "websocket", conn.Protocol)
+		assert.True(t, strings.HasPrefix(conn.RemoteAddr, "127.0.0.1:"), conn.RemoteAddr)
+		assert.False(t, conn.ConnectedAt.Before(start.Truncate(time.Second)))
+		assert.Zero(t, conn.QueueDepth)
+	}
+	assert.ElementsMatch(t, []string{"json", "msgpack"}, codecs)
+	assert.Equal(t, 1, users["612"].Sockets)
+
+	resp := adminRequest(t, server, "DELETE", "/admin/connections/612")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := other.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected policy violation close, got %v", err)
+	waitForClients(t, 2)
+
+	users = list()
+	assert.Len(t, users, 1, "only the disconnected user is gone")
+	assert.Equal(t, 2, users["611"].Sockets)
+}
+
+func TestListConnectionsWhileClientsComeAndGo(t *testing.T) {
+	initRedis(t)
+	router := newRouter()
+	token, err := createSession(context.Background(), 1, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				c := registry.RegisterTransport(userID, &recordingTransport{}, false)
+				c.enqueue("hi")
+				registry.Deregister(c)
+				c.close()
+			}
+		}(strconv.Itoa(620 + i))
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for listing := true; listing; {
+		select {
+		case <-done:
+			listing = false
+		default:
+		}
+		req := httptest.NewRequest("GET", "/admin/connections", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	waitForClients(t, 0)
+}
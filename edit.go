@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	errEditConflict     = errors.New("message was edited since that version")
+	errNotMessageSender = errors.New("only the sender can edit a message")
+)
+
+type editMessageRequest struct {
+	Text    string `json:"text"`
+	Version int    `json:"version"`
+}
+
+// EditConflict is the details of the error answering an edit of a version
+// that is no longer current.
+type EditConflict struct {
+	CurrentVersion int `json:"current_version"`
+}
+
+// MessageEditedEvent tells both sides of a conversation that a message was
+// edited.
+type MessageEditedEvent struct {
+	Type    string  `json:"type"`
+	Message Message `json:"message"`
+}
+
+// editMessage replaces the text of the caller's message in the path. The
+// request names the version it edits; if someone edited the message since,
+// it is refused with 409 and the current version.
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.editMessage")
+	defer span.End()
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.message_id", messageID))
+
+	var req editMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := validateMessage(Message{Text: req.Text}); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, "invalid_message", err.Error())
+		return
+	}
+	if req.Version < 1 {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "version is required")
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	msg, err := updateMessageText(ctx, claims.UserID, messageID, req.Text, req.Version)
+	switch {
+	case err == sql.ErrNoRows:
+		WriteError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	case err == errNotMessageSender:
+		WriteError(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	case err == errEditConflict:
+		WriteErrorDetails(w, http.StatusConflict, "edit_conflict", err.Error(), EditConflict{CurrentVersion: msg.Version})
+		return
+	case err != nil:
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The edit keeps the message's format and renders it again.
+	edited := []Message{msg}
+	if err := loadRenders(ctx, edited); err != nil {
+		logger(ctx).Println("Failed to load message format:", err)
+	}
+	msg = edited[0]
+	msg.RenderedHTML = ""
+	renderMessage(&msg)
+	storeRender(ctx, msg)
+	if err := updateRecentMessage(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to update recent message:", err)
+	}
+	if err := conversationOf(msg).Broadcast(ctx, MessageEditedEvent{Type: "message_edited", Message: msg}); err != nil {
+		logger(ctx).Println("Failed to notify edit:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// updateMessageText sets the text of the sender's message if it is still at
+// version, and returns the message at its new version. Otherwise it returns
+// sql.ErrNoRows for a message that does not exist or was deleted,
+// errNotMessageSender, or errEditConflict with the message at its current
+// version.
+func updateMessageText(ctx context.Context, senderID, messageID int, text string, version int) (Message, error) {
+	msg := Message{ID: messageID, SenderID: senderID, Text: text}
+	err := db.QueryRowContext(ctx,
+		`UPDATE messages SET text = $1, version = version + 1, updated_at = NOW()
+		WHERE message_id = $2 AND version = $3 AND sender_id = $4 AND deleted_at IS NULL
+		RETURNING seq, receiver_id, expires_at, created_at, updated_at, version`,
+		text, messageID, version, senderID).
+		Scan(&msg.Seq, &msg.RecipientID, &msg.ExpiresAt, &msg.CreatedAt, &msg.UpdatedAt, &msg.Version)
+	if err != sql.ErrNoRows {
+		return msg, err
+	}
+
+	// Nothing was updated: tell why.
+	var owner, current int
+	err = db.QueryRowContext(ctx,
+		"SELECT sender_id, version FROM messages WHERE message_id = $1 AND deleted_at IS NULL", messageID).
+		Scan(&owner, &current)
+	if err != nil {
+		return msg, err
+	}
+	if owner != senderID {
+		return msg, errNotMessageSender
+	}
+	msg.Version = current
+	return msg, errEditConflict
+}
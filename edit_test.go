@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func putMessage(t *testing.T, userID, messageID int, body interface{}) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, userID, "PUT", fmt.Sprintf("/messages/%d", messageID), body))
+	return rr
+}
+
+func TestEditMessageValidation(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, putMessage(t, 1, 7, editMessageRequest{Text: "hi"}).Code, "the version is required")
+	assert.Equal(t, http.StatusUnprocessableEntity, putMessage(t, 1, 7, editMessageRequest{Text: " ", Version: 1}).Code)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("PUT", "/messages/7", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestEditMessageConcurrently(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	sender, recipient := insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	msg, err := storeMessage(ctx, Message{SenderID: sender, RecipientID: recipient, Text: "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, msg.Version)
+
+	const editors = 10
+	codes := make([]int, editors)
+	bodies := make([]string, editors)
+	var wg sync.WaitGroup
+	for i := 0; i < editors; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := putMessage(t, sender, msg.ID, editMessageRequest{Text: fmt.Sprintf("edit %d", i), Version: 1})
+			codes[i], bodies[i] = rr.Code, rr.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	won := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+			assert.JSONEq(t, `{"error":{"code":"edit_conflict","message":"message was edited since that version","details":{"current_version":2}}}`, bodies[i])
+		default:
+			t.Errorf("edit %d: unexpected status %d: %s", i, code, bodies[i])
+		}
+	}
+	assert.Equal(t, 1, won, "only one edit of version 1 goes through")
+
+	rr := putMessage(t, sender, msg.ID, editMessageRequest{Text: "final", Version: 2})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var edited Message
+	json.NewDecoder(rr.Body).Decode(&edited)
+	assert.Equal(t, "final", edited.Text)
+	assert.Equal(t, 3, edited.Version)
+
+	var text string
+	var version int
+	if err := db.QueryRow("SELECT text, version FROM messages WHERE message_id = $1", msg.ID).Scan(&text, &version); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "final", text)
+	assert.Equal(t, 3, version)
+
+	assert.Equal(t, http.StatusForbidden, putMessage(t, recipient, msg.ID, editMessageRequest{Text: "mine now", Version: 3}).Code)
+	assert.Equal(t, http.StatusNotFound, putMessage(t, sender, msg.ID+1000000, editMessageRequest{Text: "gone", Version: 1}).Code)
+}
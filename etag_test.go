@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETagMatches(t *testing.T) {
+	t.Parallel()
+	assert.True(t, etagMatches(`"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"x", W/"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"abc"`, `W/"abc"`))
+	assert.True(t, etagMatches(`*`, `"abc"`))
+	assert.False(t, etagMatches(`"abcd"`, `"abc"`))
+	assert.False(t, etagMatches(`abc`, `"abc"`))
+}
+
+func conditionalGetUser(userID int, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/users/"+strconv.Itoa(userID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(userID)})
+	req.Header.Set("If-None-Match", etag)
+	rr := httptest.NewRecorder()
+	getUser(rr, req)
+	return rr
+}
+
+func TestGetUserNotModified(t *testing.T) {
+	initRedis(t)
+	store := initUserStore(t, User{ID: 7, Username: "vishnu", Email: "vishnu@gmail.com"})
+
+	rr, _ := getUserRequest(7)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	rr = conditionalGetUser(7, etag)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+
+	store.user.Username = "vishnu_reddy"
+	redisCli.Del(context.Background(), userCacheKey(7))
+	rr = conditionalGetUser(7, etag)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "vishnu_reddy")
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+}
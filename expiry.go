@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// maxMessageTTL is the longest ttl_seconds an ephemeral message may have.
+	maxMessageTTL = 7 * 24 * time.Hour
+
+	expirySweepInterval = time.Minute
+	expirySweepBatch    = 500
+)
+
+// setExpiry sets the ExpiresAt of an ephemeral message from its TTL,
+// counting from now. An expiry sent by the client is ignored.
+func setExpiry(msg *Message, now time.Time) {
+	msg.ExpiresAt = nil
+	if msg.TTLSeconds > 0 {
+		expiresAt := now.Add(time.Duration(msg.TTLSeconds) * time.Second).UTC()
+		msg.ExpiresAt = &expiresAt
+	}
+}
+
+// messageExpired reports whether msg is ephemeral and its time is up.
+func messageExpired(msg Message, now time.Time) bool {
+	return msg.ExpiresAt != nil && !msg.ExpiresAt.After(now)
+}
+
+// ExpirySweeper deletes ephemeral messages from Postgres and the recent
+// lists once they have expired, and lifts bans that have run out. Reads skip expired messages on their own,
+// so the sweeper only has to keep up, not be on time.
+type ExpirySweeper struct {
+	Interval time.Duration
+	Batch    int
+	Clock    Clock
+}
+
+func NewExpirySweeper() *ExpirySweeper {
+	return &ExpirySweeper{
+		Interval: expirySweepInterval,
+		Batch:    expirySweepBatch,
+		Clock:    realClock{},
+	}
+}
+
+// Run sweeps once every Interval until ctx is cancelled.
+func (s *ExpirySweeper) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Clock.After(s.Interval):
+			if err := s.sweep(ctx); err != nil {
+				log.Println("sweeper: failed to delete expired messages:", err)
+			}
+			if err := liftExpiredBans(ctx, s.Clock.Now()); err != nil {
+				log.Println("sweeper: failed to lift expired bans:", err)
+			}
+		}
+	}
+}
+
+// expiredMessageDeletes delete a batch of the expired direct and room
+// messages, returning the conversation of each.
+var expiredMessageDeletes = []string{
+	`DELETE FROM messages WHERE message_id IN (
+		SELECT message_id FROM messages WHERE expires_at <= $1 LIMIT $2
+	) RETURNING sender_id, receiver_id, 0`,
+	`DELETE FROM room_messages WHERE message_id IN (
+		SELECT message_id FROM room_messages WHERE expires_at <= $1 LIMIT $2
+	) RETURNING sender_id, 0, room_id`,
+}
+
+// sweep deletes expired messages in batches of Batch until none are left,
+// then drops them from the recent lists of their conversations.
+func (s *ExpirySweeper) sweep(ctx context.Context) error {
+	now := s.Clock.Now()
+	conversations := make(map[string]bool)
+	for _, stmt := range expiredMessageDeletes {
+		for {
+			rows, err := db.QueryContext(ctx, stmt, now, s.Batch)
+			if err != nil {
+				return err
+			}
+			deleted := 0
+			for rows.Next() {
+				var msg Message
+				if err := rows.Scan(&msg.SenderID, &msg.RecipientID, &msg.RoomID); err != nil {
+					rows.Close()
+					return err
+				}
+				conversations[conversationKey(msg)] = true
+				deleted++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if deleted < s.Batch {
+				break
+			}
+		}
+	}
+
+	for conversation := range conversations {
+		if err := purgeExpiredRecent(ctx, conversation, now); err != nil {
+			log.Println("sweeper: failed to purge recent messages:", err)
+		}
+	}
+	return nil
+}
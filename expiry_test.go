@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMessageTTL(t *testing.T) {
+	assert.NoError(t, validateMessage(Message{Text: "hi", TTLSeconds: 60}))
+	assert.Error(t, validateMessage(Message{Text: "hi", TTLSeconds: -1}))
+	assert.Error(t, validateMessage(Message{Text: "hi", TTLSeconds: int(maxMessageTTL/time.Second) + 1}))
+}
+
+func TestEphemeralMessageCarriesExpiry(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 931, 932)
+	server := newTestServer(t, newRouter())
+
+	// An expiry the client makes up is replaced by one from the TTL.
+	forged := time.Now().Add(365 * 24 * time.Hour)
+	before := time.Now()
+	rr := postMessage(Message{SenderID: 931, RecipientID: 932, Text: "gone soon", TTLSeconds: 60, ExpiresAt: &forged})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var msg Message
+	if err := json.NewDecoder(rr.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, msg.ExpiresAt) {
+		assert.WithinRange(t, *msg.ExpiresAt, before.Add(time.Minute), time.Now().Add(time.Minute))
+	}
+
+	sender := dialTestUser(t, server, 931)
+	receiver := dialTestUser(t, server, 932)
+	waitForClients(t, 2)
+	if err := sender.WriteJSON(Message{SenderID: 931, RecipientID: 932, Text: "live", TTLSeconds: 30}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var live Message
+	if err := receiver.ReadJSON(&live); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 30, live.TTLSeconds)
+	assert.NotNil(t, live.ExpiresAt, "clients get the expiry to count down to")
+}
+
+func TestExpiredMessageIsNotDelivered(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	receiver := dialTestUser(t, server, 941)
+	waitForClients(t, 1)
+
+	past := time.Now().Add(-time.Second)
+	registry.Send("941", Message{ID: 1, RecipientID: 941, Text: "too late", ExpiresAt: &past})
+	registry.Send("941", Message{ID: 2, RecipientID: 941, Text: "in time"})
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := receiver.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "in time", msg.Text)
+}
+
+// A message can expire after the replay query picked it but before it is
+// written. It must not reach the client, which still gets past it.
+func TestResumeSkipsMessagesExpiredSinceStored(t *testing.T) {
+	initRedis(t)
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	db = sql.OpenDB(&mailboxStore{messages: []Message{
+		{ID: 1, SenderID: 7, RecipientID: 942, Text: "still here", ExpiresAt: &future},
+		{ID: 2, SenderID: 7, RecipientID: 942, Text: "expired", ExpiresAt: &past},
+	}})
+	t.Cleanup(func() { db.Close() })
+	server := newTestServer(t, newRouter())
+
+	token, err := createSession(context.Background(), 942, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL := fmt.Sprintf("ws%s/ws/942?last_message_id=0&token=%s", strings.TrimPrefix(server.URL, "http"), token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "still here", msg.Text)
+	var done ResumeCompleteEvent
+	if err := conn.ReadJSON(&done); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "resume_complete", done.Type)
+	assert.Equal(t, 1, done.Replayed)
+	assert.Equal(t, 2, done.LastMessageID)
+}
+
+func TestRecentMessagesSkipExpired(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	past := time.Now().Add(-time.Second)
+	for _, msg := range []Message{
+		{ID: 1, SenderID: 1, RecipientID: 2, Text: "old news", ExpiresAt: &past},
+		{ID: 2, SenderID: 2, RecipientID: 1, Text: "current"},
+	} {
+		if err := cacheRecentMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := GetRecentMessages(ctx, "dm:1:2", 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "current", messages[0].Text)
+	}
+
+	assert.NoError(t, purgeExpiredRecent(ctx, "dm:1:2", time.Now()))
+	n, _ := redisCli.LLen(ctx, recentMessagesKey("dm:1:2")).Result()
+	assert.Equal(t, int64(1), n)
+}
+
+// sweepStore answers the sweeper's delete with the conversations of the
+// expired messages it holds, once, and records the cutoffs it was given.
+type sweepStore struct {
+	mu      sync.Mutex
+	expired []Message
+	cutoffs []time.Time
+}
+
+func (s *sweepStore) Connect(context.Context) (driver.Conn, error) {
+	return sweepConn{store: s}, nil
+}
+
+func (s *sweepStore) Driver() driver.Driver { return nil }
+
+type sweepConn struct {
+	fakeConn
+	store *sweepStore
+}
+
+func (c sweepConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "DELETE FROM room_messages") {
+		return &participantRows{rooms: true}, nil
+	}
+	if !strings.HasPrefix(query, "DELETE FROM messages") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	cutoff := args[0].Value.(time.Time)
+	c.store.cutoffs = append(c.store.cutoffs, cutoff)
+	rows := &participantRows{rooms: true}
+	remaining := c.store.expired[:0]
+	for _, msg := range c.store.expired {
+		if messageExpired(msg, cutoff) {
+			rows.messages = append(rows.messages, msg)
+		} else {
+			remaining = append(remaining, msg)
+		}
+	}
+	c.store.expired = remaining
+	return rows, nil
+}
+
+// participantRows are the sender_id and receiver_id of messages, and with
+// rooms their room_id.
+type participantRows struct {
+	messages []Message
+	rooms    bool
+}
+
+func (r *participantRows) Columns() []string {
+	if r.rooms {
+		return []string{"sender_id", "receiver_id", "room_id"}
+	}
+	return []string{"sender_id", "receiver_id"}
+}
+
+func (r *participantRows) Close() error { return nil }
+
+func (r *participantRows) Next(dest []driver.Value) error {
+	if len(r.messages) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = int64(r.messages[0].SenderID), int64(r.messages[0].RecipientID)
+	if r.rooms {
+		dest[2] = int64(r.messages[0].RoomID)
+	}
+	r.messages = r.messages[1:]
+	return nil
+}
+
+func TestExpirySweeperDeletesOnSchedule(t *testing.T) {
+	initRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	soon := clock.Now().Add(30 * time.Second)
+	msg := Message{ID: 1, SenderID: 3, RecipientID: 4, Text: "ephemeral", ExpiresAt: &soon}
+	store := &sweepStore{expired: []Message{msg}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	if err := cacheRecentMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := NewExpirySweeper()
+	sweeper.Clock = clock
+	go sweeper.Run(ctx)
+	clock.waitForTimers(t, 1)
+
+	clock.Advance(expirySweepInterval)
+	clock.waitForTimers(t, 1)
+	store.mu.Lock()
+	assert.Equal(t, []time.Time{clock.Now()}, store.cutoffs)
+	assert.Len(t, store.expired, 0, "the message expired before the sweep")
+	store.mu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		n, _ := redisCli.LLen(ctx, recentMessagesKey("dm:3:4")).Result()
+		return n == 0
+	}, 2*time.Second, 5*time.Millisecond, "the expired message stayed in the recent list")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+// exportFlushEvery is how many rows are written between flushes so the
+// response goes out in chunks instead of being buffered whole.
+const exportFlushEvery = 500
+
+type exportedMessage struct {
+	ID          int          `json:"id"`
+	SenderID    int          `json:"sender_id"`
+	RecipientID int          `json:"recipient_id"`
+	Text        string       `json:"text"`
+	SentAt      time.Time    `json:"sent_at"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+func exportMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.exportMessages")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "csv" && format != "jsonl" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "format must be csv or jsonl")
+		return
+	}
+
+	from, err := parseTimeParam(query.Get("from"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid from: "+err.Error())
+		return
+	}
+	to, err := parseTimeParam(query.Get("to"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid to: "+err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, sender_id, receiver_id, text, sent_at, `+attachmentsJSON+` FROM messages
+		WHERE (sender_id = $1 OR receiver_id = $1)
+		AND ($2::timestamp IS NULL OR sent_at >= $2)
+		AND ($3::timestamp IS NULL OR sent_at < $3)
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY sent_at, message_id`, userID, from, to)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"messages-%d.%s\"", userID, format))
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	out, flush, closeOut := exportOutput(w, r)
+	defer closeOut()
+
+	var (
+		csvWriter *csv.Writer
+		encoder   *json.Encoder
+	)
+	if format == "csv" {
+		csvWriter = csv.NewWriter(out)
+		csvWriter.Write([]string{"id", "sender_id", "recipient_id", "text", "sent_at", "attachments"})
+	} else {
+		encoder = json.NewEncoder(out)
+	}
+
+	count := 0
+	for rows.Next() {
+		var msg exportedMessage
+		var attachments []byte
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Text, &msg.SentAt, &attachments); err != nil {
+			logger(ctx).Println("Failed to scan exported message:", err)
+			return
+		}
+		if msg.Attachments, err = decodeAttachments(attachments); err != nil {
+			logger(ctx).Println("Failed to read exported attachments:", err)
+			return
+		}
+
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{
+				strconv.Itoa(msg.ID),
+				strconv.Itoa(msg.SenderID),
+				strconv.Itoa(msg.RecipientID),
+				msg.Text,
+				msg.SentAt.Format(time.RFC3339),
+				attachmentURLs(msg.Attachments),
+			})
+		} else {
+			err = encoder.Encode(msg)
+		}
+		if err != nil {
+			logger(ctx).Println("Failed to write exported message:", err)
+			return
+		}
+
+		count++
+		if count%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger(ctx).Println("Failed to read exported messages:", err)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+}
+
+// exportOutput returns where to write the body of an export download,
+// gzipped if the client accepts it, a function that sends what was
+// written so far and one to call once the body is done.
+func exportOutput(w http.ResponseWriter, r *http.Request) (io.Writer, func(), func()) {
+	flushResponse := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		return w, flushResponse, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	flush := func() {
+		gz.Flush()
+		flushResponse()
+	}
+	return gz, flush, func() { gz.Close() }
+}
+
+// attachmentURLs is how attachments go in a CSV export: their download
+// URLs, separated by spaces.
+func attachmentURLs(attachments []Attachment) string {
+	urls := make([]string, len(attachments))
+	for i, a := range attachments {
+		urls[i] = a.URL
+	}
+	return strings.Join(urls, " ")
+}
+
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportMessages(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+
+	_, err := db.Exec(`INSERT INTO messages (sender_id, receiver_id, text)
+		SELECT $1, $2, 'message ' || n FROM generate_series(1, 10000) AS n`, senderID, recipientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := createSession(context.Background(), senderID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, expectedLines := range map[string]int{"jsonl": 10000, "csv": 10001} {
+		req := httptest.NewRequest("GET", "/users/"+strconv.Itoa(senderID)+"/export?format="+format, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(senderID)})
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+
+		requireAuth(exportMessages)(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+
+		lines := 0
+		scanner := bufio.NewScanner(rr.Body)
+		for scanner.Scan() {
+			lines++
+		}
+		assert.Equal(t, expectedLines, lines, "line count mismatch for %s", format)
+	}
+}
+
+func TestExportMessagesForbidden(t *testing.T) {
+	initRedis(t)
+
+	token, err := createSession(context.Background(), 1, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/users/2/export", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "2"})
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+
+	requireAuth(exportMessages)(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code, "handler returned wrong status code")
+}
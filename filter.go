@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Verdict is a Filter's decision about a message.
+type Verdict int
+
+const (
+	// VerdictAllow lets the message through.
+	VerdictAllow Verdict = iota
+	// VerdictReject refuses the message: it is neither stored nor
+	// delivered.
+	VerdictReject
+	// VerdictFlag lets the message through and puts it in the moderation
+	// queue.
+	VerdictFlag
+)
+
+var errPolicyViolation = errors.New("message violates the content policy")
+
+// Filter decides whether a message may be sent. It is asked before the
+// message is stored, on every path a message comes in by.
+type Filter interface {
+	Check(ctx context.Context, msg Message) (Verdict, error)
+}
+
+// messageFilter is set in main from the configuration. It allows
+// everything unless a word list is configured.
+var messageFilter Filter = noopFilter{}
+
+func newMessageFilter(c Config) Filter {
+	if len(c.FilterRejectWords) == 0 && len(c.FilterFlagWords) == 0 {
+		return noopFilter{}
+	}
+	return newWordListFilter(c.FilterRejectWords, c.FilterFlagWords)
+}
+
+type noopFilter struct{}
+
+func (noopFilter) Check(context.Context, Message) (Verdict, error) { return VerdictAllow, nil }
+
+// wordListFilter rejects messages containing any of one list of words and
+// flags those containing any of another. Words match whole and ignoring
+// case.
+type wordListFilter struct {
+	reject map[string]bool
+	flag   map[string]bool
+}
+
+func newWordListFilter(reject, flag []string) *wordListFilter {
+	f := &wordListFilter{reject: make(map[string]bool), flag: make(map[string]bool)}
+	for _, word := range reject {
+		f.reject[strings.ToLower(word)] = true
+	}
+	for _, word := range flag {
+		f.flag[strings.ToLower(word)] = true
+	}
+	return f
+}
+
+func (f *wordListFilter) Check(_ context.Context, msg Message) (Verdict, error) {
+	verdict := VerdictAllow
+	words := strings.FieldsFunc(strings.ToLower(msg.Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if f.reject[word] {
+			return VerdictReject, nil
+		}
+		if f.flag[word] {
+			verdict = VerdictFlag
+		}
+	}
+	return verdict, nil
+}
+
+// screenMessage asks the filter about msg. Encrypted messages cannot be
+// read and are let through, and so is everything while the filter fails.
+func screenMessage(ctx context.Context, msg Message) Verdict {
+	if msg.Encrypted {
+		return VerdictAllow
+	}
+	verdict, err := messageFilter.Check(ctx, msg)
+	if err != nil {
+		logger(ctx).Println("Failed to filter message:", err)
+		return VerdictAllow
+	}
+	return verdict
+}
+
+// flagMessage puts a stored direct or room message in the moderation queue
+// on the filter's behalf.
+func flagMessage(ctx context.Context, msg Message) {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO message_reports ("+reportColumn(msg)+", reason) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		msg.ID, reportReasonFlagged)
+	if err != nil {
+		logger(ctx).Println("Failed to flag message:", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// textFilter gives its verdict by the first word of a message: "reject",
+// "flag" or "fail" for a failing check, allowing anything else.
+type textFilter struct{}
+
+func (textFilter) Check(_ context.Context, msg Message) (Verdict, error) {
+	switch strings.Fields(msg.Text)[0] {
+	case "reject":
+		return VerdictReject, nil
+	case "flag":
+		return VerdictFlag, nil
+	case "fail":
+		return VerdictReject, errors.New("filter unavailable")
+	}
+	return VerdictAllow, nil
+}
+
+func useFilter(t *testing.T, f Filter) {
+	saved := messageFilter
+	messageFilter = f
+	t.Cleanup(func() { messageFilter = saved })
+}
+
+func TestWordListFilter(t *testing.T) {
+	f := newWordListFilter([]string{"Spamword"}, []string{"darn"})
+	ctx := context.Background()
+
+	for text, want := range map[string]Verdict{
+		"hello there":               VerdictAllow,
+		"buy SPAMWORD now":          VerdictReject,
+		"well, darn!":               VerdictFlag,
+		"darn it, spamword":         VerdictReject,
+		"darned spamwords are fine": VerdictAllow,
+	} {
+		verdict, err := f.Check(ctx, Message{Text: text})
+		assert.NoError(t, err)
+		assert.Equal(t, want, verdict, text)
+	}
+}
+
+func TestFilterVerdictsOnREST(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 1, 2)
+	useFilter(t, textFilter{})
+
+	rr := postMessage(Message{SenderID: 1, RecipientID: 2, Text: "reject this"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "policy_violation")
+	assert.Zero(t, store.nextID.Load(), "a rejected message is not stored")
+
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "flag this"}).Code)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "fine"}).Code)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "fail open"}).Code)
+	assert.EqualValues(t, 3, store.nextID.Load())
+	assert.Equal(t, []int64{1}, store.flagged, "only the flagged message is queued")
+}
+
+func TestFilterVerdictsOnWebSocket(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 901, 902)
+	useFilter(t, textFilter{})
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 901)
+	receiver := dialTestUser(t, server, 902)
+	waitForClients(t, 2)
+
+	for _, text := range []string{"reject this", "flag this", "fine"} {
+		if err := sender.WriteJSON(Message{SenderID: 901, RecipientID: 902, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ErrorEvent
+	if err := sender.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "policy_violation", event.Code)
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var texts []string
+	var flaggedID int
+	for i := 0; i < 2; i++ {
+		var msg Message
+		if err := receiver.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, msg.Text)
+		if msg.Text == "flag this" {
+			flaggedID = msg.ID
+		}
+	}
+	assert.Equal(t, []string{"flag this", "fine"}, texts, "the rejected message is not delivered")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, []int64{int64(flaggedID)}, store.flagged)
+}
+
+// roomMessageStore stores room messages with increasing IDs and records
+// the ones flagged; every other query fails.
+type roomMessageStore struct {
+	mu      sync.Mutex
+	nextID  int64
+	flagged []int64
+}
+
+func (s *roomMessageStore) Connect(context.Context) (driver.Conn, error) {
+	return roomMessageConn{store: s}, nil
+}
+
+func (s *roomMessageStore) Driver() driver.Driver { return nil }
+
+type roomMessageConn struct {
+	fakeConn
+	store *roomMessageStore
+}
+
+func (c roomMessageConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "INSERT INTO room_messages") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.nextID++
+	return &insertedRows{id: c.store.nextID}, nil
+}
+
+func (c roomMessageConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "INSERT INTO message_reports (room_message_id") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.flagged = append(c.store.flagged, args[0].Value.(int64))
+	return driver.RowsAffected(1), nil
+}
+
+func TestFilterFlagsRoomMessages(t *testing.T) {
+	mr := initRedis(t)
+	mr.SAdd(roomMembersKey(9), "901", "902")
+	store := &roomMessageStore{}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	useFilter(t, textFilter{})
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 901)
+	member := dialTestUser(t, server, 902)
+	waitForClients(t, 2)
+
+	for _, text := range []string{"fine", "flag this"} {
+		if err := sender.WriteJSON(Message{RoomID: 9, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	ids := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		var msg Message
+		if err := member.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		ids[msg.Text] = msg.ID
+	}
+	assert.Equal(t, map[string]int{"fine": 1, "flag this": 2}, ids, "room messages are stored with IDs")
+
+	// The message is flagged once it has gone out.
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.flagged) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, []int64{2}, store.flagged, "the flagged room message is queued")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var errForwardTarget = errors.New("exactly one of recipient_id and room_id is required")
+
+// ForwardedFrom is the message a forward copies. A forward of a forward
+// names the message first forwarded, so chains always point at the
+// original.
+type ForwardedFrom struct {
+	SenderID  int `json:"sender_id"`
+	MessageID int `json:"message_id"`
+}
+
+type forwardRequest struct {
+	RecipientID int `json:"recipient_id"`
+	RoomID      int `json:"room_id"`
+}
+
+// forwardSource loads a direct message to forward with where it was itself
+// forwarded from, if anywhere, and whether it was deleted or has expired.
+// It returns sql.ErrNoRows if there is no such message.
+func forwardSource(ctx context.Context, messageID int) (Message, bool, error) {
+	var msg Message
+	var from ForwardedFrom
+	var deleted bool
+	err := db.QueryRowContext(ctx,
+		`SELECT m.sender_id, m.receiver_id, m.text,
+			COALESCE(f.original_sender_id, m.sender_id), COALESCE(f.original_message_id, m.message_id),
+			m.deleted_at IS NOT NULL OR m.text = $2 OR COALESCE(m.expires_at <= NOW(), false)
+		FROM messages m LEFT JOIN message_forwards f ON f.message_id = m.message_id
+		WHERE m.message_id = $1`, messageID, deletedMessageText).
+		Scan(&msg.SenderID, &msg.RecipientID, &msg.Text, &from.SenderID, &from.MessageID, &deleted)
+	msg.ID, msg.ForwardedFrom = messageID, &from
+	return msg, deleted, err
+}
+
+// storeForward records where a stored message was forwarded from.
+func storeForward(ctx context.Context, msg Message) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO message_forwards (message_id, original_message_id, original_sender_id) VALUES ($1, $2, $3)",
+		msg.ID, msg.ForwardedFrom.MessageID, msg.ForwardedFrom.SenderID)
+	return err
+}
+
+// forwardMessage sends a copy of a direct message the caller is part of to
+// a user or a room, going the way a message sent there would.
+func forwardMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.forwardMessage")
+	defer span.End()
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	var req forwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if (req.RecipientID == 0) == (req.RoomID == 0) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, errForwardTarget.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.message_id", messageID))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	src, deleted, err := forwardSource(ctx, messageID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if claims.UserID != src.SenderID && claims.UserID != src.RecipientID {
+		WriteError(w, http.StatusForbidden, codeForbidden, errNotParticipant.Error())
+		return
+	}
+	if deleted {
+		WriteError(w, http.StatusGone, codeGone, "message has been deleted")
+		return
+	}
+
+	msg := Message{
+		SenderID:      claims.UserID,
+		RecipientID:   req.RecipientID,
+		RoomID:        req.RoomID,
+		Text:          src.Text,
+		ForwardedFrom: src.ForwardedFrom,
+	}
+	if err := validateMessage(msg); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, "invalid_message", err.Error())
+		return
+	}
+	if err := checkSender(ctx, msg.SenderID); err == errSenderBanned {
+		WriteError(w, http.StatusForbidden, "banned", err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	verdict := screenMessage(ctx, msg)
+	if verdict == VerdictReject {
+		WriteError(w, http.StatusUnprocessableEntity, "policy_violation", errPolicyViolation.Error())
+		return
+	}
+
+	if msg.RoomID != 0 {
+		stored, err := relayRoomMessage(ctx, msg)
+		if err == errNotRoomMember {
+			WriteError(w, http.StatusForbidden, "not_a_member", err.Error())
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if verdict == VerdictFlag {
+			flagMessage(ctx, stored)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := checkRecipient(ctx, msg.RecipientID); err == errInvalidRecipient || err == errRecipientBanned {
+		WriteError(w, http.StatusUnprocessableEntity, recipientErrorCode(err), err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := screenContact(ctx, &msg); err == errContactDeclined {
+		WriteError(w, http.StatusForbidden, "contact_declined", err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	renderMessage(&msg)
+	msg, err = storeMessage(ctx, msg)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := storeForward(ctx, msg); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	storeRender(ctx, msg)
+	if verdict == VerdictFlag {
+		flagMessage(ctx, msg)
+	}
+	msg = publishMessage(ctx, msg)
+
+	status := http.StatusCreated
+	if msg.Request {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// loadForwards sets where the messages were forwarded from.
+func loadForwards(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	byID := make(map[int]*Message, len(messages))
+	for i := range messages {
+		ids[i] = int64(messages[i].ID)
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT message_id, original_sender_id, original_message_id FROM message_forwards WHERE message_id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int
+		var from ForwardedFrom
+		if err := rows.Scan(&messageID, &from.SenderID, &from.MessageID); err != nil {
+			return err
+		}
+		if msg := byID[messageID]; msg != nil {
+			msg.ForwardedFrom = &from
+		}
+	}
+	return rows.Err()
+}
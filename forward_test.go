@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func forwardRequestRecorded(t *testing.T, userID int, messageID string, body interface{}) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, userID, "POST", "/messages/"+messageID+"/forward", body))
+	return rr
+}
+
+func TestForwardRejectsBadRequests(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	cases := []struct {
+		messageID string
+		body      interface{}
+		want      int
+	}{
+		{"x", forwardRequest{RecipientID: 2}, http.StatusBadRequest},
+		{"1", forwardRequest{}, http.StatusUnprocessableEntity},
+		{"1", forwardRequest{RecipientID: 2, RoomID: 7}, http.StatusUnprocessableEntity},
+		{"1", "not an object", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rr := forwardRequestRecorded(t, 1, tc.messageID, tc.body)
+		assert.Equal(t, tc.want, rr.Code, "%s %v", tc.messageID, tc.body)
+	}
+}
+
+func TestForwardChains(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	a, b, c, outsider := insertTestUser(t, "hash"), insertTestUser(t, "hash"), insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	original, err := storeMessage(ctx, Message{SenderID: a, RecipientID: b, Text: "pass it on"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := func(userID, messageID, recipientID int) (*httptest.ResponseRecorder, Message) {
+		rr := forwardRequestRecorded(t, userID, strconv.Itoa(messageID), forwardRequest{RecipientID: recipientID})
+		var msg Message
+		if rr.Code == http.StatusCreated {
+			json.NewDecoder(rr.Body).Decode(&msg)
+		}
+		return rr, msg
+	}
+
+	server := newTestServer(t, newRouter())
+	live := dialTestUser(t, server, c)
+	waitForClients(t, 1)
+
+	rr, first := forward(b, original.ID, c)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	want := &ForwardedFrom{SenderID: a, MessageID: original.ID}
+	assert.Equal(t, want, first.ForwardedFrom)
+	assert.Equal(t, b, first.SenderID)
+	assert.Equal(t, "pass it on", first.Text)
+
+	live.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var delivered Message
+	if err := live.ReadJSON(&delivered); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, first.ID, delivered.ID)
+	assert.Equal(t, want, delivered.ForwardedFrom, "the live payload says where it came from")
+
+	rr, second := forward(c, first.ID, a)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, want, second.ForwardedFrom, "a forward of a forward points at the original")
+
+	rr = getMessagesRequest(t, a, fmt.Sprintf("?with=%d", c))
+	var history Page[Message]
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, history.Items, 1) {
+		assert.Equal(t, want, history.Items[0].ForwardedFrom, "the history says where it came from")
+	}
+
+	rr, _ = forward(outsider, original.ID, outsider)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "outsiders cannot forward the conversation's messages")
+	rr, _ = forward(a, 1<<30, b)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.NoError(t, tombstoneMessage(ctx, original))
+	rr, _ = forward(b, original.ID, c)
+	assert.Equal(t, http.StatusGone, rr.Code, "deleted messages cannot be forwarded")
+	rr, _ = forward(a, first.ID, b)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only the forward's own participants can pass it on")
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"realtimechat/chatpb"
+)
+
+// grpcServer implements the gRPC API for backend services. Its streams are
+// clients of the registry like WebSockets are, so messages flow between
+// both.
+type grpcServer struct {
+	chatpb.UnimplementedChatServer
+}
+
+// newGRPCServer returns a server for the gRPC API, using tlsConfig if the
+// HTTP server has one so that tokens never travel in the clear.
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig.Clone())))
+	}
+	srv := grpc.NewServer(opts...)
+	chatpb.RegisterChatServer(srv, grpcServer{})
+	// Reflection lets grpcurl and the like discover the API.
+	reflection.Register(srv)
+	return srv
+}
+
+func serveGRPC(srv *grpc.Server, addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// grpcAuthenticate checks the bearer token in the "authorization" metadata
+// the way requireAuth checks the header, and adds its claims to ctx.
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	token, ok := strings.CutPrefix(metadataValue(ctx, "authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	claims, err := parseToken(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	switch err := checkSession(ctx, claims); err {
+	case nil:
+	case errSessionRevoked:
+		return nil, status.Error(codes.Unauthenticated, "session revoked")
+	case errAccountBanned:
+		return nil, status.Error(codes.PermissionDenied, "account banned")
+	default:
+		return nil, status.Error(codes.Unavailable, "failed to verify session")
+	}
+	return context.WithValue(ctx, claimsKey, claims), nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream is a stream whose context carries the caller's claims.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context { return s.ctx }
+
+func metadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (grpcServer) GetUser(ctx context.Context, req *chatpb.GetUserRequest) (*chatpb.User, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "grpc.GetUser")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("chat.user_id", req.GetId()))
+
+	user, err := loadUser(ctx, int(req.GetId()))
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "user not found")
+	} else if isBreakerOpen(err) {
+		return nil, status.Error(codes.Unavailable, "database unavailable")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &chatpb.User{
+		Id:        int64(user.ID),
+		Username:  user.Username,
+		Email:     user.Email,
+		AvatarUrl: user.AvatarURL,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+	}, nil
+}
+
+// Chat serves one stream as a client of the caller. It mirrors
+// handleWebSocket: events for the user are sent down the stream and the
+// messages received on it are relayed.
+func (grpcServer) Chat(stream chatpb.Chat_ChatServer) error {
+	ctx, span := otel.Tracer(tracerName).Start(stream.Context(), "grpc.Chat")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	span.SetAttributes(attribute.Int("chat.user_id", claims.UserID))
+
+	lastID, resume, err := parseResumeParam(metadataValue(ctx, "last-message-id"))
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid last-message-id")
+	}
+
+	announcements, err := pendingAnnouncements(ctx)
+	if err != nil {
+		logger(ctx).Println("Failed to look up announcements:", err)
+	}
+	t := newGRPCTransport(stream)
+	c := registry.RegisterSession(strconv.Itoa(claims.UserID), claims.ID, t, resume)
+	if resume {
+		resumeClient(ctx, c, claims.UserID, lastID)
+	}
+	watchUserRooms(ctx, c.userID)
+	if err := deliverInbox(ctx, c); err != nil {
+		logger(ctx).Println("Failed to deliver queued events:", err)
+	}
+	if err := deliverAnnouncements(ctx, c, announcements); err != nil {
+		logger(ctx).Println("Failed to deliver announcements:", err)
+	}
+
+	pumped := make(chan struct{})
+	go func() {
+		defer close(pumped)
+		c.writePump()
+	}()
+	go func() {
+		receiveGRPCMessages(ctx, stream, c, claims.UserID)
+		t.abort()
+	}()
+
+	<-t.done
+	registry.Deregister(c)
+	c.close()
+	// The stream must not be written to after this handler returns.
+	<-pumped
+	return t.err()
+}
+
+// receiveGRPCMessages relays the messages the client sends until the
+// stream ends.
+func receiveGRPCMessages(ctx context.Context, stream chatpb.Chat_ChatServer, c *client, userID int) {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		if req.GetMessage() == nil {
+			continue
+		}
+		msg := messageFromProto(req.GetMessage())
+		msg.SenderID = userID
+
+		if err := validateMessage(msg); err != nil {
+			c.enqueue(newErrorEvent("invalid_message", err))
+			continue
+		}
+
+		if err := checkSender(ctx, msg.SenderID); err == errSenderBanned {
+			c.enqueue(newErrorEvent("banned", err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check sender:", err)
+		}
+
+		verdict := screenMessage(ctx, msg)
+		if verdict == VerdictReject {
+			c.enqueue(newErrorEvent("policy_violation", errPolicyViolation))
+			continue
+		}
+
+		if msg.RoomID != 0 {
+			stored, err := relayRoomMessage(ctx, msg)
+			if err == errNotRoomMember {
+				c.enqueue(newErrorEvent("not_a_member", err))
+			} else if err != nil {
+				logger(ctx).Println("Failed to relay room message:", err)
+			} else if verdict == VerdictFlag {
+				flagMessage(ctx, stored)
+			}
+			continue
+		}
+
+		if err := checkRecipient(ctx, msg.RecipientID); recipientErrorCode(err) != "" {
+			c.enqueue(newErrorEvent(recipientErrorCode(err), err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check recipient:", err)
+		}
+		if err := screenContact(ctx, &msg); err == errContactDeclined {
+			c.enqueue(newErrorEvent("contact_declined", err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check contacts:", err)
+		}
+
+		stored, err := relayMessage(ctx, msg)
+		if verdict == VerdictFlag && err == nil {
+			flagMessage(ctx, stored)
+		}
+	}
+}
+
+// grpcTransport sends a client's events down a Chat stream.
+type grpcTransport struct {
+	stream chatpb.Chat_ChatServer
+
+	once   sync.Once
+	done   chan struct{}
+	status *status.Status
+}
+
+func newGRPCTransport(stream chatpb.Chat_ChatServer) *grpcTransport {
+	return &grpcTransport{stream: stream, done: make(chan struct{})}
+}
+
+// write sends v as a Message event if it is a message, and as the JSON a
+// WebSocket would get otherwise.
+func (t *grpcTransport) write(v interface{}) error {
+	event, err := eventToProto(v)
+	if err != nil {
+		return err
+	}
+	return t.stream.Send(event)
+}
+
+func (t *grpcTransport) describe() transportInfo {
+	info := transportInfo{protocol: "grpc", codec: "protobuf"}
+	if p, ok := peer.FromContext(t.stream.Context()); ok {
+		info.remoteAddr = p.Addr.String()
+	}
+	return info
+}
+
+// shutdown ends the stream with the reason as its status.
+func (t *grpcTransport) shutdown(_ int, reason string) {
+	t.end(status.New(codes.Aborted, reason))
+}
+
+func (t *grpcTransport) abort() {
+	t.end(nil)
+}
+
+func (t *grpcTransport) end(s *status.Status) {
+	t.once.Do(func() {
+		t.status = s
+		close(t.done)
+	})
+}
+
+// err is the status the stream ends with, once done is closed.
+func (t *grpcTransport) err() error {
+	return t.status.Err()
+}
+
+func eventToProto(v interface{}) (*chatpb.Event, error) {
+	if msg, ok := v.(Message); ok {
+		return &chatpb.Event{Event: &chatpb.Event_Message{Message: messageToProto(msg)}}, nil
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(payload, &envelope)
+	if envelope.Type == "" {
+		// Messages queued in the inbox come back as JSON.
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		return &chatpb.Event{Event: &chatpb.Event_Message{Message: messageToProto(msg)}}, nil
+	}
+	return &chatpb.Event{Event: &chatpb.Event_Other{Other: &chatpb.JSONEvent{Type: envelope.Type, Payload: payload}}}, nil
+}
+
+func messageToProto(msg Message) *chatpb.Message {
+	return &chatpb.Message{
+		Id:            int64(msg.ID),
+		Seq:           msg.Seq,
+		SenderId:      int64(msg.SenderID),
+		RecipientId:   int64(msg.RecipientID),
+		RoomId:        int64(msg.RoomID),
+		Text:          msg.Text,
+		Encrypted:     msg.Encrypted,
+		ClientMsgId:   msg.ClientMsgID,
+		Traceparent:   msg.TraceParent,
+		Format:        msg.Format,
+		RenderedHtml:  msg.RenderedHTML,
+		TtlSeconds:    int32(msg.TTLSeconds),
+		ExpiresAt:     protoTimePtr(msg.ExpiresAt),
+		Muted:         msg.Muted,
+		Kind:          msg.Kind,
+		ForwardedFrom: forwardedFromToProto(msg.ForwardedFrom),
+		CreatedAt:     protoTime(msg.CreatedAt),
+		UpdatedAt:     protoTime(msg.UpdatedAt),
+	}
+}
+
+func forwardedFromToProto(f *ForwardedFrom) *chatpb.ForwardedFrom {
+	if f == nil {
+		return nil
+	}
+	return &chatpb.ForwardedFrom{SenderId: int64(f.SenderID), MessageId: int64(f.MessageID)}
+}
+
+func messageFromProto(m *chatpb.Message) Message {
+	return Message{
+		SenderID:    int(m.GetSenderId()),
+		RecipientID: int(m.GetRecipientId()),
+		RoomID:      int(m.GetRoomId()),
+		Text:        m.GetText(),
+		Encrypted:   m.GetEncrypted(),
+		ClientMsgID: m.GetClientMsgId(),
+		TraceParent: m.GetTraceparent(),
+		Format:      m.GetFormat(),
+		TTLSeconds:  int(m.GetTtlSeconds()),
+	}
+}
+
+func protoTimePtr(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return protoTime(*t)
+}
+
+// protoTime leaves unset timestamps out rather than sending year 1.
+func protoTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
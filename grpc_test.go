@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+
+	"realtimechat/chatpb"
+)
+
+// startGRPCServer serves the gRPC API on a loopback port, the way it runs
+// next to the HTTP server, and returns a client connected to it.
+func startGRPCServer(t *testing.T) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newGRPCServer(nil)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// grpcContext returns a context carrying a fresh access token for userID.
+func grpcContext(t *testing.T, userID int) context.Context {
+	token, err := createSession(context.Background(), userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func TestGRPCRequiresToken(t *testing.T) {
+	initRedis(t)
+	conn := startGRPCServer(t)
+	client := chatpb.NewChatClient(conn)
+
+	_, err := client.GetUser(context.Background(), &chatpb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer nope")
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCGetUser(t *testing.T) {
+	initRedis(t)
+	conn := startGRPCServer(t)
+	if err := cacheUser(context.Background(), User{ID: 7, Username: "grace", CreatedAt: insertedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := chatpb.NewChatClient(conn).GetUser(grpcContext(t, 1), &chatpb.GetUserRequest{Id: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "grace", user.Username)
+	assert.True(t, insertedAt.Equal(user.CreatedAt.AsTime()))
+}
+
+// TestGRPCListsServices discovers the API through reflection, as grpcurl
+// does before it can call anything.
+func TestGRPCListsServices(t *testing.T) {
+	initRedis(t)
+	conn := startGRPCServer(t)
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(grpcContext(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		names = append(names, service.GetName())
+	}
+	assert.Contains(t, names, "chat.v1.Chat")
+}
+
+func TestGRPCChatExchangesMessagesWithWebSocket(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1, 2)
+	server := newTestServer(t, newRouter())
+	conn := startGRPCServer(t)
+
+	ws := dialTestUser(t, server, 2)
+	stream, err := chatpb.NewChatClient(conn).Chat(grpcContext(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForClients(t, 2)
+
+	// The sender is whoever the token belongs to.
+	err = stream.Send(&chatpb.ChatRequest{Message: &chatpb.Message{SenderId: 99, RecipientId: 2, Text: "from grpc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var received Message
+	if err := ws.ReadJSON(&received); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "from grpc", received.Text)
+	assert.Equal(t, 1, received.SenderID)
+
+	if err := ws.WriteJSON(Message{SenderID: 2, RecipientID: 1, Text: "from ws"}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, event.GetMessage()) {
+		assert.Equal(t, "from ws", event.GetMessage().Text)
+		assert.Equal(t, int64(2), event.GetMessage().SenderId)
+		assert.NotZero(t, event.GetMessage().Id)
+	}
+
+	err = stream.Send(&chatpb.ChatRequest{Message: &chatpb.Message{RecipientId: 2, Text: " "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, event.GetOther()) {
+		assert.Equal(t, "error", event.GetOther().Type)
+		var payload ErrorEvent
+		json.Unmarshal(event.GetOther().Payload, &payload)
+		assert.Equal(t, "invalid_message", payload.Code)
+	}
+
+	stream.CloseSend()
+	waitForClients(t, 1)
+}
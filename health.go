@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type readiness struct {
+	Status   string        `json:"status"`
+	Postgres backendHealth `json:"postgres"`
+	Redis    backendHealth `json:"redis"`
+}
+
+// readyz reports whether the instance can serve traffic. Postgres is
+// required; without Redis the instance still serves chat but runs degraded:
+// sessions cannot be verified, offline inboxes are not delivered and nothing
+// is cached.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ready := readiness{
+		Status:   "ready",
+		Postgres: checkHealth(ctx, db.PingContext),
+		Redis: checkHealth(ctx, func(ctx context.Context) error {
+			return redisCli.Ping(ctx).Err()
+		}),
+	}
+
+	status := http.StatusOK
+	switch {
+	case !ready.Postgres.OK:
+		ready.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	case !ready.Redis.OK:
+		ready.Status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ready)
+}
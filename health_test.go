@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postCreateUser(username string) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(createUserRequest{
+		Username: username,
+		Email:    username + "@example.com",
+		Password: "password123",
+	})
+	rr := httptest.NewRecorder()
+	CreateUser(rr, httptest.NewRequest("POST", "/users", bytes.NewBuffer(jsonData)))
+	return rr
+}
+
+func TestCreateUserSurvivesRedisOutage(t *testing.T) {
+	mr := initRedis(t)
+	db = sql.OpenDB(&insertConnector{})
+	defer db.Close()
+
+	assert.Equal(t, http.StatusOK, postCreateUser("before").Code)
+
+	mr.Close()
+
+	rr := postCreateUser("after")
+	assert.Equal(t, http.StatusOK, rr.Code, "user creation should not depend on Redis")
+	var user User
+	if err := json.NewDecoder(rr.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotZero(t, user.ID)
+}
+
+func fetchReadyz(t *testing.T) (int, readiness) {
+	rr := httptest.NewRecorder()
+	readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+	var ready readiness
+	if err := json.NewDecoder(rr.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, ready
+}
+
+func TestReadyzReportsDegradedWithoutRedis(t *testing.T) {
+	mr := initRedis(t)
+	initFakeDB(t)
+
+	code, ready := fetchReadyz(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", ready.Status)
+
+	mr.Close()
+
+	code, ready = fetchReadyz(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "degraded", ready.Status)
+	assert.False(t, ready.Redis.OK)
+	assert.True(t, ready.Postgres.OK)
+}
+
+func TestReadyzUnavailableWithoutPostgres(t *testing.T) {
+	initRedis(t)
+	db = sql.OpenDB(fakeConnector{healthy: &atomic.Bool{}})
+	defer db.Close()
+
+	code, ready := fetchReadyz(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", ready.Status)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// getMessages returns a page of the caller's messages, newest first. with
+// narrows the history to one conversation. cursor, the next_cursor of the
+// previous page, pages back through it; before does the same with the
+// created_at of the last message of the previous page.
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getMessages")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	var with *int
+	if value := query.Get("with"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid with")
+			return
+		}
+		with = &id
+	}
+
+	limit := defaultHistoryLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit))
+			return
+		}
+		limit = n
+	}
+
+	before, err := parseTimeParam(query.Get("before"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid before: "+err.Error())
+		return
+	}
+
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, seq, sender_id, receiver_id, text, expires_at, created_at, updated_at, version FROM messages
+		WHERE (sender_id = $1 OR receiver_id = $1)
+		AND ($2::int IS NULL OR sender_id = $2 OR receiver_id = $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)
+		AND ($5::int IS NULL OR (created_at, message_id) < (SELECT created_at, message_id FROM messages WHERE message_id = $5))
+		AND (NOT request OR sender_id = $1)
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY created_at DESC, message_id DESC
+		LIMIT $4`, claims.UserID, with, before, limit+1, cursor)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	messages, err := readMessages(ctx, rows)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// The page is tagged with its newest message, so a client polling it
+	// hears of new messages but not of edits or reactions to ones it has.
+	var newest int
+	if len(messages) > 0 {
+		newest = messages[0].ID
+	}
+	if notModified(w, r, fmt.Sprintf(`W/"%d"`, newest)) {
+		return
+	}
+
+	list := fmt.Sprintf("messages:%d", claims.UserID)
+	if with != nil {
+		list += fmt.Sprintf(":%d", *with)
+	}
+	total, err := countTotal(ctx, list,
+		`SELECT COUNT(*) FROM messages
+		WHERE (sender_id = $1 OR receiver_id = $1)
+		AND ($2::int IS NULL OR sender_id = $2 OR receiver_id = $2)
+		AND (NOT request OR sender_id = $1)
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())`, claims.UserID, with)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(messages, limit, total, func(msg Message) int { return msg.ID }))
+}
+
+// syncConversation returns the messages exchanged with peer whose sequence
+// number is above since_seq, oldest first. Clients that have seen
+// everything up to some number fetch the rest in pages of limit.
+func syncConversation(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.syncConversation")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	peerID, err := strconv.Atoi(mux.Vars(r)["peer"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid peer id")
+		return
+	}
+
+	query := r.URL.Query()
+	var sinceSeq int64
+	if value := query.Get("since_seq"); value != "" {
+		sinceSeq, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || sinceSeq < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid since_seq")
+			return
+		}
+	}
+
+	limit := maxHistoryLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit))
+			return
+		}
+		limit = n
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, seq, sender_id, receiver_id, text, expires_at, created_at, updated_at, version FROM messages
+		WHERE LEAST(sender_id, receiver_id) = LEAST($1::int, $2::int)
+		AND GREATEST(sender_id, receiver_id) = GREATEST($1::int, $2::int)
+		AND seq > $3
+		AND (NOT request OR sender_id = $1)
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY seq
+		LIMIT $4`, claims.UserID, peerID, sinceSeq, limit)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	writeMessages(ctx, w, rows)
+}
+
+// writeMessages encodes the rows of a message query, with everything
+// readMessages adds to them, as a JSON array.
+func writeMessages(ctx context.Context, w http.ResponseWriter, rows *sql.Rows) {
+	messages, err := readMessages(ctx, rows)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// readMessages reads the rows of a message query, with their attachments,
+// link previews, rendered HTML, reaction counts and where they were
+// forwarded from.
+func readMessages(ctx context.Context, rows *sql.Rows) ([]Message, error) {
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.Seq, &msg.SenderID, &msg.RecipientID, &msg.Text, &msg.ExpiresAt, &msg.CreatedAt, &msg.UpdatedAt, &msg.Version); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, load := range []func(context.Context, []Message) error{
+		loadAttachments, loadLinkPreviews, loadRenders, loadReactions, loadForwards,
+	} {
+		if err := load(ctx, messages); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func getMessagesRequest(t *testing.T, userID int, query string) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/messages"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	requireAuth(getMessages)(rr, req)
+	return rr
+}
+
+func TestGetMessagesRejectsBadParams(t *testing.T) {
+	initRedis(t)
+
+	for _, query := range []string{"?limit=0", "?limit=" + strconv.Itoa(maxHistoryLimit+1), "?with=abc", "?before=yesterday", "?cursor=0", "?cursor=x"} {
+		rr := getMessagesRequest(t, 1, query)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestSendMessageReturnsTimestamps(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 2)
+
+	rr := postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var msg Message
+	if err := json.NewDecoder(rr.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, insertedAt.Equal(msg.CreatedAt))
+	assert.True(t, insertedAt.Equal(msg.UpdatedAt))
+}
+
+func TestGetMessagesNewestFirst(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	otherID := insertTestUser(t, "hash")
+
+	base := time.Now().Add(-time.Hour)
+	for i, text := range []string{"first", "second", "third"} {
+		_, err := db.Exec("INSERT INTO messages (sender_id, receiver_id, text, created_at) VALUES ($1, $2, $3, $4)",
+			senderID, recipientID, text, base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO messages (sender_id, receiver_id, text) VALUES ($1, $2, 'elsewhere')", senderID, otherID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE messages SET deleted_at = NOW() WHERE sender_id = $1 AND text = 'second'", senderID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := getMessagesRequest(t, recipientID, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var page Page[Message]
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	messages := page.Items
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "third", messages[0].Text)
+		assert.Equal(t, "first", messages[1].Text)
+		assert.True(t, messages[0].CreatedAt.After(messages[1].CreatedAt))
+	}
+	assert.EqualValues(t, 2, page.Total)
+	assert.False(t, page.HasNext)
+	assert.Nil(t, page.NextCursor)
+
+	rr = getMessagesRequest(t, senderID, "?with="+strconv.Itoa(recipientID)+"&limit=1")
+	page = Page[Message]{}
+	json.NewDecoder(rr.Body).Decode(&page)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "third", page.Items[0].Text)
+	}
+	assert.EqualValues(t, 2, page.Total)
+	assert.True(t, page.HasNext)
+	if !assert.NotNil(t, page.NextCursor) {
+		t.FailNow()
+	}
+	assert.Equal(t, strconv.Itoa(page.Items[0].ID), *page.NextCursor)
+
+	// A message sent meanwhile does not shift the next page.
+	if _, err := db.Exec("INSERT INTO messages (sender_id, receiver_id, text) VALUES ($1, $2, 'fourth')", senderID, recipientID); err != nil {
+		t.Fatal(err)
+	}
+	rr = getMessagesRequest(t, senderID, "?with="+strconv.Itoa(recipientID)+"&limit=1&cursor="+*page.NextCursor)
+	page = Page[Message]{}
+	json.NewDecoder(rr.Body).Decode(&page)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "first", page.Items[0].Text)
+	}
+	assert.False(t, page.HasNext)
+	assert.EqualValues(t, 2, page.Total, "the total is cached")
+}
+
+func TestGetMessagesNotModified(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	send := func(text string) {
+		if _, err := db.Exec("INSERT INTO messages (sender_id, receiver_id, text) VALUES ($1, $2, $3)", senderID, recipientID, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(etag string) *httptest.ResponseRecorder {
+		token, err := createSession(context.Background(), recipientID, RoleUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-None-Match", etag)
+		rr := httptest.NewRecorder()
+		requireAuth(getMessages)(rr, req)
+		return rr
+	}
+
+	send("first")
+	rr := get("")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	rr = get(etag)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Empty(t, rr.Body.String())
+
+	send("second")
+	rr = get(etag)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+	var page Page[Message]
+	json.NewDecoder(rr.Body).Decode(&page)
+	if assert.NotEmpty(t, page.Items) {
+		assert.Equal(t, "second", page.Items[0].Text)
+	}
+}
+
+func TestUpdatedAtTrigger(t *testing.T) {
+	setupTestContainers(t)
+
+	userID := insertTestUser(t, "hash")
+	var createdAt, updatedAt time.Time
+	if err := db.QueryRow("SELECT created_at, updated_at FROM users WHERE user_id = $1", userID).Scan(&createdAt, &updatedAt); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, createdAt.IsZero())
+
+	var touched time.Time
+	err := db.QueryRow("UPDATE users SET email = 'changed_' || email WHERE user_id = $1 RETURNING updated_at", userID).Scan(&touched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, touched.After(updatedAt))
+}
+
+func TestSyncConversationRejectsBadParams(t *testing.T) {
+	initRedis(t)
+	token, err := createSession(context.Background(), 1, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"?since_seq=-1", "?since_seq=x", "?limit=0"} {
+		req := httptest.NewRequest("GET", "/conversations/2/sync"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"peer": "2"})
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		requireAuth(syncConversation)(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestConversationSeqConcurrentWriters(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	userA := insertTestUser(t, "hash")
+	userB := insertTestUser(t, "hash")
+	batcher = NewMessageBatcher(db, 10, time.Millisecond)
+	defer func() {
+		batcher.Close()
+		batcher = nil
+	}()
+
+	const writers, perWriter = 20, 25
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				msg := Message{SenderID: userA, RecipientID: userB, Text: "hammer"}
+				if w%2 == 1 {
+					// Both directions belong to the same conversation, and
+					// messages with a client_msg_id skip the batcher.
+					msg = Message{SenderID: userB, RecipientID: userA, Text: "hammer", ClientMsgID: uuid.NewString()}
+				}
+				if _, err := storeMessage(context.Background(), msg); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	token, err := createSession(context.Background(), userA, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []int64
+	for since := int64(0); ; {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/conversations/%d/sync?since_seq=%d", userB, since), nil)
+		req = mux.SetURLVars(req, map[string]string{"peer": strconv.Itoa(userB)})
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		requireAuth(syncConversation)(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var page []Message
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, msg := range page {
+			seqs = append(seqs, msg.Seq)
+		}
+		since = page[len(page)-1].Seq
+	}
+
+	if assert.Len(t, seqs, writers*perWriter) {
+		for i, seq := range seqs {
+			assert.Equal(t, int64(i+1), seq, "sequence must be gapless and free of duplicates")
+		}
+	}
+}
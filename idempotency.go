@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	idempotencyTTL           = 5 * time.Minute
+	maxIdempotencyKeyLength  = 255
+	idempotencyPendingMarker = "pending"
+)
+
+// releasePending drops a claim that never got a response stored, so the
+// client can retry. A stored response is left alone.
+var releasePending = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type idempotentResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+func idempotencyKey(key string) string {
+	return fmt.Sprintf("idem:%s", key)
+}
+
+// claimIdempotency looks at the request's Idempotency-Key header. If the key
+// was already used it answers with the stored response, or 409 while the
+// first request is still running, and reports handled. Otherwise it claims
+// the key and returns it; the caller must pass it to saveIdempotentResponse
+// or releaseIdempotency. Without Redis requests go through unprotected.
+func claimIdempotency(ctx context.Context, w http.ResponseWriter, r *http.Request) (key string, handled bool) {
+	key = r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Idempotency-Key is too long")
+		return "", true
+	}
+
+	claimed, err := redisCli.SetNX(ctx, idempotencyKey(key), idempotencyPendingMarker, idempotencyTTL).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to claim idempotency key:", err)
+		return "", false
+	}
+	if claimed {
+		return key, false
+	}
+
+	stored, err := redisCli.Get(ctx, idempotencyKey(key)).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read idempotency key:", err)
+		return "", false
+	}
+	if stored == idempotencyPendingMarker {
+		WriteError(w, http.StatusConflict, codeConflict, "A request with this Idempotency-Key is in progress")
+		return "", true
+	}
+
+	var resp idempotentResponse
+	if err := json.Unmarshal([]byte(stored), &resp); err != nil {
+		logger(ctx).Println("Failed to decode idempotent response:", err)
+		return "", false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp.Body)
+	return "", true
+}
+
+func saveIdempotentResponse(ctx context.Context, key string, status int, body []byte) {
+	if key == "" {
+		return
+	}
+	data, err := json.Marshal(idempotentResponse{Status: status, Body: body})
+	if err == nil {
+		err = redisCli.Set(ctx, idempotencyKey(key), data, idempotencyTTL).Err()
+	}
+	if err != nil {
+		logger(ctx).Println("Failed to save idempotent response:", err)
+	}
+}
+
+func releaseIdempotency(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := releasePending.Run(ctx, redisCli, []string{idempotencyKey(key)}, idempotencyPendingMarker).Err(); err != nil {
+		logger(ctx).Println("Failed to release idempotency key:", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func postMessageWithKey(msg Message, key string) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(msg)
+	req := httptest.NewRequest("POST", "/messages", bytes.NewBuffer(jsonData))
+	req.Header.Set("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	sendMessage(rr, asUser(req, msg.SenderID))
+	return rr
+}
+
+func TestSendMessageIdempotencyKeyReplays(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 2)
+	msg := Message{SenderID: 1, RecipientID: 2, Text: "only once"}
+
+	first := postMessageWithKey(msg, "5f1c3b8e-7a1d-4e0a-9d6e-2b7f0c9a1e44")
+	assert.Equal(t, http.StatusCreated, first.Code)
+
+	second := postMessageWithKey(msg, "5f1c3b8e-7a1d-4e0a-9d6e-2b7f0c9a1e44")
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+
+	assert.Equal(t, int64(1), store.nextID.Load(), "message should be inserted once")
+
+	third := postMessageWithKey(msg, "0b6f6b39-3f0e-4c55-8f0c-56a4bd1f3e21")
+	assert.Equal(t, http.StatusCreated, third.Code)
+	assert.Equal(t, int64(2), store.nextID.Load())
+}
+
+func TestSendMessageIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	mr := initRedis(t)
+	initRecipientStore(t, 2)
+
+	rr := postMessageWithKey(Message{SenderID: 1, RecipientID: 999, Text: "hi"}, "retry-me")
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.False(t, mr.Exists(idempotencyKey("retry-me")), "a failed request should not hold the key")
+
+	rr = postMessageWithKey(Message{SenderID: 1, RecipientID: 2, Text: "hi"}, "retry-me")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestSendMessageIdempotencyKeyInProgress(t *testing.T) {
+	mr := initRedis(t)
+	initRecipientStore(t, 2)
+	mr.Set(idempotencyKey("busy"), idempotencyPendingMarker)
+
+	rr := postMessageWithKey(Message{SenderID: 1, RecipientID: 2, Text: "hi"}, "busy")
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestSendMessageIdempotencyKeyTooLong(t *testing.T) {
+	initRedis(t)
+
+	rr := postMessageWithKey(Message{SenderID: 1, RecipientID: 2, Text: "hi"}, strings.Repeat("k", maxIdempotencyKeyLength+1))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSendMessageIdempotencySingleRow(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	msg := Message{SenderID: senderID, RecipientID: recipientID, Text: "idempotent"}
+
+	assert.Equal(t, http.StatusCreated, postMessageWithKey(msg, "db-key").Code)
+	assert.Equal(t, http.StatusOK, postMessageWithKey(msg, "db-key").Code)
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE sender_id = $1", senderID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestSendMessageClientMsgIDDeduplicates(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 2)
+	msg := Message{SenderID: 1, RecipientID: 2, Text: "sent twice", ClientMsgID: "3d8e2a6c-1b7f-4f0e-8a3c-5e9d2b1c7a40"}
+
+	first := postMessage(msg)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	second := postMessage(msg)
+	assert.Equal(t, http.StatusOK, second.Code)
+
+	var a, b Message
+	json.Unmarshal(first.Body.Bytes(), &a)
+	json.Unmarshal(second.Body.Bytes(), &b)
+	assert.NotZero(t, a.ID)
+	assert.Equal(t, a.ID, b.ID)
+	assert.Equal(t, int64(1), store.nextID.Load(), "message should be inserted once")
+}
+
+func TestSendMessageRejectsMalformedClientMsgID(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 2)
+
+	rr := postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi", ClientMsgID: "not-a-uuid"})
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestClientMsgIDSingleRow(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	msg := Message{SenderID: senderID, RecipientID: recipientID, Text: "retried", ClientMsgID: uuid.NewString()}
+
+	var ids []int
+	for i := 0; i < 2; i++ {
+		rr := postMessage(msg)
+		var stored Message
+		json.Unmarshal(rr.Body.Bytes(), &stored)
+		ids = append(ids, stored.ID)
+	}
+
+	// The same client_msg_id over the socket is a duplicate as well.
+	server := newTestServer(t, newRouter())
+	sender := dialTestUser(t, server, senderID)
+	if err := sender.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	sender.Close()
+
+	assert.Never(t, func() bool {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM messages WHERE sender_id = $1", senderID).Scan(&count)
+		return count != 1
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, ids[0], ids[1])
+}
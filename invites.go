@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	inviteTokenBytes = 32
+
+	defaultInviteMaxUses = 1
+	maxInviteMaxUses     = 1000
+	defaultInviteTTL     = 7 * 24 * time.Hour
+	maxInviteTTL         = 30 * 24 * time.Hour
+)
+
+var (
+	errInviteRevoked = errors.New("invite has been revoked")
+	errInviteExpired = errors.New("invite has expired")
+	errInviteUsedUp  = errors.New("invite has been used up")
+)
+
+type createInviteRequest struct {
+	// MaxUses defaults to a single use.
+	MaxUses int `json:"max_uses"`
+	// ExpiresAt defaults to a week from now.
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type Invite struct {
+	InviteURL string    `json:"invite_url"`
+	RoomID    int       `json:"room_id"`
+	MaxUses   int       `json:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// InviteInfo is what anyone holding an invite link may see before joining.
+type InviteInfo struct {
+	RoomID      int       `json:"room_id"`
+	RoomName    string    `json:"room_name"`
+	MemberCount int       `json:"member_count"`
+	UsesLeft    int       `json:"uses_left"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type joinRoomRequest struct {
+	Token string `json:"token"`
+}
+
+type inviteRecord struct {
+	roomID    int
+	maxUses   int
+	uses      int
+	expiresAt time.Time
+	revoked   bool
+}
+
+// unusable returns why the invite can no longer be used to join, or nil if
+// it can.
+func (i inviteRecord) unusable(now time.Time) error {
+	switch {
+	case i.revoked:
+		return errInviteRevoked
+	case !i.expiresAt.After(now):
+		return errInviteExpired
+	case i.uses >= i.maxUses:
+		return errInviteUsedUp
+	}
+	return nil
+}
+
+func inviteURL(token string) string {
+	return cfg.PublicURL + "/join/" + token
+}
+
+func loadInvite(ctx context.Context, token string) (inviteRecord, error) {
+	var invite inviteRecord
+	err := db.QueryRowContext(ctx,
+		"SELECT room_id, max_uses, uses, expires_at, revoked_at IS NOT NULL FROM invites WHERE token = $1",
+		token).Scan(&invite.roomID, &invite.maxUses, &invite.uses, &invite.expiresAt, &invite.revoked)
+	return invite, err
+}
+
+// createInvite lets a member of the room make a link others can join it by.
+func createInvite(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createInvite")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	var req createInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	now := time.Now()
+	if req.MaxUses == 0 {
+		req.MaxUses = defaultInviteMaxUses
+	}
+	if req.MaxUses < 1 || req.MaxUses > maxInviteMaxUses {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("max_uses must be between 1 and %d", maxInviteMaxUses))
+		return
+	}
+	expiresAt := now.Add(defaultInviteTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.After(now.Add(maxInviteTTL)) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("expires_at must be in the next %d days", int(maxInviteTTL.Hours()/24)))
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if claims.Role != RoleAdmin {
+		if err := checkRoomMember(ctx, roomID, claims.UserID); err == errNotRoomMember {
+			WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	token, err := randomToken(inviteTokenBytes)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to create invite")
+		return
+	}
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO invites (token, room_id, created_by, max_uses, expires_at)
+		SELECT $1, room_id, $3, $4, $5 FROM rooms WHERE room_id = $2`,
+		token, roomID, claims.UserID, req.MaxUses, expiresAt)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Room not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Invite{InviteURL: inviteURL(token), RoomID: roomID, MaxUses: req.MaxUses, ExpiresAt: expiresAt.UTC()})
+}
+
+// getInvite describes the room an invite leads to. It needs no login, so
+// that the link can be shown before signing in.
+func getInvite(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getInvite")
+	defer span.End()
+
+	invite, err := loadInvite(ctx, mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Invite not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := invite.unusable(time.Now()); err != nil {
+		WriteError(w, http.StatusGone, codeGone, err.Error())
+		return
+	}
+
+	room, err := loadRoomInfo(ctx, invite.roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InviteInfo{
+		RoomID:      room.ID,
+		RoomName:    room.Name,
+		MemberCount: room.MemberCount,
+		UsesLeft:    invite.maxUses - invite.uses,
+		ExpiresAt:   invite.expiresAt,
+	})
+}
+
+// joinRoom adds the caller to the room the invite in the path leads to.
+func joinRoom(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.joinRoom")
+	defer span.End()
+
+	joinWithInvite(ctx, w, mux.Vars(r)["token"])
+}
+
+// joinRoomByToken adds the caller to the room the invite token in the body
+// leads to.
+func joinRoomByToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.joinRoomByToken")
+	defer span.End()
+
+	var req joinRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.Token == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "token is required")
+		return
+	}
+	joinWithInvite(ctx, w, req.Token)
+}
+
+// joinWithInvite adds the caller to the invite's room, using up one of its
+// uses, and answers with the room. Members following an invite again are
+// not counted, even once it can no longer be used.
+func joinWithInvite(ctx context.Context, w http.ResponseWriter, token string) {
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	invite, err := loadInvite(ctx, token)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Invite not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("chat.room_id", invite.roomID))
+
+	err = checkRoomMember(ctx, invite.roomID, claims.UserID)
+	if err == errNotRoomMember {
+		if !joinByInvite(ctx, w, token, invite.roomID, claims.UserID) {
+			return
+		}
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	room, err := loadRoomInfo(ctx, invite.roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// joinByInvite takes a use of the invite and adds the user to the room in
+// one transaction, so that concurrent joins cannot go over max_uses. It
+// writes the error response and returns false if the user cannot join.
+func joinByInvite(ctx context.Context, w http.ResponseWriter, token string, roomID, userID int) bool {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE invites SET uses = uses + 1 WHERE token = $1 AND uses < max_uses AND expires_at > NOW() AND revoked_at IS NULL",
+		token)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	} else if n == 0 {
+		reason := "invite can no longer be used"
+		if invite, err := loadInvite(ctx, token); err == nil {
+			if err := invite.unusable(time.Now()); err != nil {
+				reason = err.Error()
+			}
+		}
+		WriteError(w, http.StatusGone, codeGone, reason)
+		return false
+	}
+	res, err = tx.ExecContext(ctx, "INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", roomID, userID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	} else if n == 0 {
+		// A concurrent join added them first; rolling back gives the use
+		// back.
+		return true
+	}
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if err := redisCli.SAdd(ctx, roomMembersKey(roomID), userID).Err(); err != nil {
+		forgetRoomMembers(ctx, roomID, err)
+	}
+	touchRoom(ctx, roomID, []string{strconv.Itoa(userID)}, time.Now())
+	forgetRoomLists(ctx, roomID)
+	watchJoinedRoom(roomID, []string{strconv.Itoa(userID)})
+	notifyRoom(ctx, RoomEvent{Type: "room_member_added", RoomID: roomID, UserID: userID, Role: RoomMember})
+	announceRoomChange(ctx, roomID, userID, userID, "%[1]s joined the room")
+	return true
+}
+
+// revokeInvite lets the room's admins and owner stop an invite from being
+// used. Members who joined by it stay.
+func revokeInvite(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.revokeInvite")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	if _, ok := requireRoomAdmin(ctx, w, roomID, claimsFromContext(ctx)); !ok {
+		return
+	}
+	res, err := db.ExecContext(ctx,
+		"UPDATE invites SET revoked_at = NOW() WHERE token = $1 AND room_id = $2 AND revoked_at IS NULL",
+		mux.Vars(r)["token"], roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Invite not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
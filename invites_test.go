@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateInviteRejectsBadInput(t *testing.T) {
+	initRedis(t)
+	past := time.Now().Add(-time.Minute)
+	tooLate := time.Now().Add(maxInviteTTL + time.Hour)
+
+	for _, req := range []createInviteRequest{
+		{MaxUses: -1},
+		{MaxUses: maxInviteMaxUses + 1},
+		{ExpiresAt: &past},
+		{ExpiresAt: &tooLate},
+	} {
+		rr := httptest.NewRecorder()
+		requireAuth(createInvite)(rr, mux.SetURLVars(authedRequest(t, 1, "POST", "/rooms/1/invites", req), map[string]string{"id": "1"}))
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "%+v", req)
+	}
+}
+
+func TestInviteUnusable(t *testing.T) {
+	now := time.Now()
+	usable := inviteRecord{maxUses: 2, uses: 1, expiresAt: now.Add(time.Hour)}
+	assert.NoError(t, usable.unusable(now))
+
+	usedUp := usable
+	usedUp.uses = 2
+	assert.Equal(t, errInviteUsedUp, usedUp.unusable(now))
+
+	expired := usedUp
+	expired.expiresAt = now
+	assert.Equal(t, errInviteExpired, expired.unusable(now))
+
+	revoked := expired
+	revoked.revoked = true
+	assert.Equal(t, errInviteRevoked, revoked.unusable(now), "revocation is reported first")
+}
+
+func TestJoinRoomByTokenNeedsToken(t *testing.T) {
+	initRedis(t)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, 1, "POST", "/rooms/join", joinRoomRequest{}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestRoomInviteLifecycle(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	owner := insertTestUser(t, "hash")
+	newcomer := insertTestUser(t, "hash")
+	latecomer := insertTestUser(t, "hash")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, owner, "POST", "/rooms", createRoomRequest{Name: "invite-only"}))
+	var room Room
+	if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	invitesPath := "/rooms/" + strconv.Itoa(room.ID) + "/invites"
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, newcomer, "POST", invitesPath, createInviteRequest{}))
+	assert.Equal(t, http.StatusForbidden, rr.Code, "outsiders cannot invite")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, owner, "POST", invitesPath, createInviteRequest{}))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var invite Invite
+	if err := json.NewDecoder(rr.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, invite.MaxUses)
+	token := strings.TrimPrefix(invite.InviteURL, cfg.PublicURL+"/join/")
+	assert.Len(t, token, 2*inviteTokenBytes)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/join/"+token, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var info InviteInfo
+	json.NewDecoder(rr.Body).Decode(&info)
+	assert.Equal(t, "invite-only", info.RoomName)
+	assert.Equal(t, 1, info.MemberCount)
+	assert.Equal(t, 1, info.UsesLeft)
+
+	join := func(userID int, token string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, "POST", "/join/"+token, nil))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, join(newcomer, token))
+	assert.NoError(t, checkRoomMember(ctx, room.ID, newcomer))
+	assert.Equal(t, http.StatusOK, join(newcomer, token), "joining again does not use the invite up")
+	assert.Equal(t, http.StatusGone, join(latecomer, token))
+	assert.Equal(t, errNotRoomMember, checkRoomMember(ctx, room.ID, latecomer))
+	assert.Equal(t, http.StatusNotFound, join(latecomer, "nope"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/join/"+token, nil))
+	assert.Equal(t, http.StatusGone, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, newcomer, "POST", invitesPath, createInviteRequest{MaxUses: 5}))
+	json.NewDecoder(rr.Body).Decode(&invite)
+	token = strings.TrimPrefix(invite.InviteURL, cfg.PublicURL+"/join/")
+	if _, err := db.Exec("UPDATE invites SET expires_at = NOW() - INTERVAL '1 minute' WHERE token = $1", token); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusGone, join(latecomer, token), "expired invites cannot be used")
+}
+
+func TestRoomInviteUsesAndRevocation(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	owner := insertTestUser(t, "hash")
+	member := insertTestUser(t, "hash")
+	first := insertTestUser(t, "hash")
+	second := insertTestUser(t, "hash")
+	third := insertTestUser(t, "hash")
+	serve := func(userID int, method, path string, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, body))
+		return rr
+	}
+
+	rr := serve(owner, "POST", "/rooms", createRoomRequest{Name: "revocable", MemberIDs: []int{member}})
+	var room Room
+	if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	invitesPath := "/rooms/" + strconv.Itoa(room.ID) + "/invites"
+	createInvite := func(maxUses int) string {
+		var invite Invite
+		json.NewDecoder(serve(member, "POST", invitesPath, createInviteRequest{MaxUses: maxUses}).Body).Decode(&invite)
+		return strings.TrimPrefix(invite.InviteURL, cfg.PublicURL+"/join/")
+	}
+	join := func(userID int, token string) *httptest.ResponseRecorder {
+		return serve(userID, "POST", "/rooms/join", joinRoomRequest{Token: token})
+	}
+
+	ownerConn := dialTestUser(t, server, owner)
+	token := createInvite(2)
+	assert.Equal(t, http.StatusOK, join(first, token).Code)
+	var announced Message
+	ownerConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for announced.Kind != MessageKindSystem {
+		if err := ownerConn.ReadJSON(&announced); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, first, announced.SenderID)
+	assert.Equal(t, room.ID, announced.RoomID)
+	assert.Contains(t, announced.Text, "joined the room")
+	recent, err := GetRecentMessages(ctx, conversationKey(Message{RoomID: room.ID}), 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, recent, 1) {
+		assert.Equal(t, MessageKindSystem, recent[0].Kind)
+	}
+
+	assert.Equal(t, http.StatusOK, join(first, token).Code, "joining again is a no-op")
+	assert.Equal(t, http.StatusOK, join(second, token).Code)
+	rr = join(third, token)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), errInviteUsedUp.Error())
+
+	token = createInvite(10)
+	assert.Equal(t, http.StatusForbidden, serve(member, "DELETE", invitesPath+"/"+token, nil).Code, "members cannot revoke")
+	assert.Equal(t, http.StatusNoContent, serve(owner, "DELETE", invitesPath+"/"+token, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(owner, "DELETE", invitesPath+"/"+token, nil).Code)
+	rr = join(third, token)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), errInviteRevoked.Error())
+	assert.Equal(t, errNotRoomMember, checkRoomMember(ctx, room.ID, third))
+	assert.Equal(t, http.StatusOK, join(second, token).Code, "members following a revoked invite are let through")
+}
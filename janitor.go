@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	janitorInterval  = 6 * time.Hour
+	inboxRetention   = 30 * 24 * time.Hour
+	janitorScanBatch = 500
+
+	// clientMsgIDRetention is how long a client_msg_id is remembered for
+	// deduplicating retried sends.
+	clientMsgIDRetention = 24 * time.Hour
+)
+
+// Janitor periodically removes data that would otherwise grow without
+// bound or outlive the users it belongs to.
+type Janitor struct {
+	Interval             time.Duration
+	InboxRetention       time.Duration
+	ClientMsgIDRetention time.Duration
+	Clock                Clock
+}
+
+func NewJanitor() *Janitor {
+	return &Janitor{
+		Interval:             janitorInterval,
+		InboxRetention:       inboxRetention,
+		ClientMsgIDRetention: clientMsgIDRetention,
+		Clock:                realClock{},
+	}
+}
+
+// Run cleans up once every Interval until ctx is cancelled.
+func (j *Janitor) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.Clock.After(j.Interval):
+			j.cleanup(ctx)
+		}
+	}
+}
+
+func (j *Janitor) cleanup(ctx context.Context) {
+	if err := j.removeOrphanedSessions(ctx); err != nil {
+		log.Println("janitor: failed to remove orphaned sessions:", err)
+	}
+	if err := j.trimInboxes(ctx); err != nil {
+		log.Println("janitor: failed to trim inboxes:", err)
+	}
+	if err := j.expireClientMsgIDs(ctx); err != nil {
+		log.Println("janitor: failed to expire client message ids:", err)
+	}
+}
+
+func scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := redisCli.Scan(ctx, 0, pattern, janitorScanBatch).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// removeOrphanedSessions deletes the cached profile and the login sessions
+// of users that no longer exist in the database.
+func (j *Janitor) removeOrphanedSessions(ctx context.Context) error {
+	userKeys, err := scanKeys(ctx, "user:*")
+	if err != nil {
+		return err
+	}
+
+	userIDs := make(map[int]bool)
+	for _, key := range userKeys {
+		if id, err := strconv.Atoi(strings.Split(key, ":")[1]); err == nil {
+			userIDs[id] = true
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(userIDs))
+	for id := range userIDs {
+		ids = append(ids, int64(id))
+	}
+	rows, err := db.QueryContext(ctx, "SELECT user_id FROM users WHERE user_id = ANY($1) AND deleted_at IS NULL", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		delete(userIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id := range userIDs {
+		sessionIDs, err := redisCli.SMembers(ctx, userSessionsKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		keys, err := sessionKeys(ctx, sessionIDs)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, userCacheKey(id), userSessionsKey(id))
+		if err := redisCli.Del(ctx, keys...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimInboxes drops queued offline events older than InboxRetention.
+func (j *Janitor) trimInboxes(ctx context.Context) error {
+	keys, err := scanKeys(ctx, inboxKey("*"))
+	if err != nil {
+		return err
+	}
+
+	minID := fmt.Sprintf("%d-0", j.Clock.Now().Add(-j.InboxRetention).UnixMilli())
+	for _, key := range keys {
+		if err := redisCli.XTrimMinID(ctx, key, minID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireClientMsgIDs forgets the client_msg_id of messages older than
+// ClientMsgIDRetention, so a retry after that is stored as a new message.
+func (j *Janitor) expireClientMsgIDs(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "UPDATE messages SET client_msg_id = NULL WHERE client_msg_id IS NOT NULL AND created_at < $1",
+		j.Clock.Now().Add(-j.ClientMsgIDRetention))
+	return err
+}
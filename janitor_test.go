@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitorTrimsOnSchedule(t *testing.T) {
+	initFakeDB(t)
+	initRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	janitor := NewJanitor()
+	janitor.Clock = clock
+
+	old := clock.Now().Add(-31 * 24 * time.Hour).UnixMilli()
+	recent := clock.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, id := range []string{fmt.Sprintf("%d-0", old), fmt.Sprintf("%d-0", recent)} {
+		err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: inboxKey("42"), ID: id, Values: map[string]interface{}{"event": "{}"}}).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go janitor.Run(ctx)
+	clock.waitForTimers(t, 1)
+
+	// Nothing happens before the interval has elapsed.
+	clock.Advance(janitorInterval - time.Minute)
+	n, _ := redisCli.XLen(ctx, inboxKey("42")).Result()
+	assert.Equal(t, int64(2), n)
+
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		entries, _ := redisCli.XRange(ctx, inboxKey("42"), "-", "+").Result()
+		return len(entries) == 1 && entries[0].ID == fmt.Sprintf("%d-0", recent)
+	}, 2*time.Second, 5*time.Millisecond, "old inbox entries were not removed")
+}
+
+func TestJanitorRemovesOrphanedSessions(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	userID := insertTestUser(t, "hash")
+	if _, err := createSession(ctx, userID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheUser(ctx, User{ID: userID}); err != nil {
+		t.Fatal(err)
+	}
+
+	var missingID int
+	if err := db.QueryRow("SELECT COALESCE(MAX(user_id), 0) + 1000 FROM users").Scan(&missingID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createSession(ctx, missingID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheUser(ctx, User{ID: missingID}); err != nil {
+		t.Fatal(err)
+	}
+
+	NewJanitor().cleanup(ctx)
+
+	keys, err := redisCli.Keys(ctx, "*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, keys, userCacheKey(userID))
+	assert.Contains(t, keys, userSessionsKey(userID))
+	assert.NotContains(t, keys, userCacheKey(missingID))
+	assert.NotContains(t, keys, userSessionsKey(missingID))
+	for _, key := range keys {
+		if strings.HasPrefix(key, "session:") {
+			owner, _ := redisCli.Get(ctx, key).Int()
+			assert.Equal(t, userID, owner, "session of a deleted user survived")
+		}
+	}
+}
+
+func TestJanitorExpiresClientMsgIDs(t *testing.T) {
+	setupTestContainers(t)
+	ctx := context.Background()
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	_, err := db.Exec(`INSERT INTO messages (sender_id, receiver_id, text, client_msg_id, created_at) VALUES
+		($1, $2, 'old', 'b0a8f3a4-58a4-4f4e-9a57-0d6f4d8e1a01', NOW() - INTERVAL '2 days'),
+		($1, $2, 'new', 'b0a8f3a4-58a4-4f4e-9a57-0d6f4d8e1a02', NOW())`, senderID, recipientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewJanitor().expireClientMsgIDs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	rows, err := db.Query("SELECT text FROM messages WHERE sender_id = $1 AND client_msg_id IS NOT NULL", senderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var text string
+		rows.Scan(&text)
+		remaining = append(remaining, text)
+	}
+	assert.Equal(t, []string{"new"}, remaining)
+}
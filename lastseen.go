@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Who may see a user's last seen time.
+const (
+	LastSeenEveryone = "everyone"
+	LastSeenContacts = "contacts"
+	LastSeenNobody   = "nobody"
+)
+
+// lastSeenWriteInterval is how often a user's last seen time is written to
+// Postgres at most.
+const lastSeenWriteInterval = time.Minute
+
+// PrivacySettings are who may see what about a user.
+type PrivacySettings struct {
+	LastSeen string `json:"last_seen"`
+}
+
+func lastSeenWrittenKey(userID int) string {
+	return fmt.Sprintf("user:%d:last_seen_written", userID)
+}
+
+// recordLastSeen records that the user was around at. It writes at most once
+// per lastSeenWriteInterval; later calls within the interval are dropped.
+func recordLastSeen(ctx context.Context, userID int, at time.Time) {
+	ok, err := redisCli.SetNX(ctx, lastSeenWrittenKey(userID), at.Unix(), lastSeenWriteInterval).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to throttle last seen:", err)
+	} else if !ok {
+		return
+	}
+	writeLastSeen(ctx, userID, at)
+}
+
+// writeLastSeen records that the user was around at, whenever it was last
+// written. A disconnect uses it, since it is the time others see while the
+// user is away.
+func writeLastSeen(ctx context.Context, userID int, at time.Time) {
+	_, err := db.ExecContext(ctx,
+		"UPDATE users SET last_seen_at = $2 WHERE user_id = $1 AND (last_seen_at IS NULL OR last_seen_at < $2)",
+		userID, at)
+	if err != nil {
+		logger(ctx).Println("Failed to record last seen:", err)
+	}
+}
+
+// lastSeenAllowed reports whether a user with the visibility shows their
+// last seen time to someone who is, or is not, their contact.
+func lastSeenAllowed(visibility string, contacts bool) bool {
+	return visibility == LastSeenEveryone || visibility == LastSeenContacts && contacts
+}
+
+// lastSeenVisible reports whether the viewer may see the target's last seen
+// time. It goes both ways: a viewer who hides theirs from the target does
+// not see the target's either.
+func lastSeenVisible(target, viewer string, contacts bool) bool {
+	return lastSeenAllowed(target, contacts) && lastSeenAllowed(viewer, contacts)
+}
+
+// lastSeenFor returns the last seen times of the users that the viewer may
+// see. Viewer 0 is someone signed out, who only sees those shown to
+// everyone.
+func lastSeenFor(ctx context.Context, viewerID int, userIDs []int) (map[int]time.Time, error) {
+	seen := make(map[int]time.Time)
+	if len(userIDs) == 0 {
+		return seen, nil
+	}
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT u.user_id, u.last_seen_at, u.last_seen_visibility, COALESCE(v.last_seen_visibility, 'everyone'),
+			EXISTS (SELECT 1 FROM contacts c WHERE c.status = 'accepted'
+				AND ((c.requester_id = u.user_id AND c.addressee_id = $1) OR (c.requester_id = $1 AND c.addressee_id = u.user_id)))
+		FROM users u LEFT JOIN users v ON v.user_id = $1
+		WHERE u.user_id = ANY($2) AND u.last_seen_at IS NOT NULL AND u.deleted_at IS NULL`,
+		viewerID, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var at time.Time
+		var target, viewer string
+		var contacts bool
+		if err := rows.Scan(&userID, &at, &target, &viewer, &contacts); err != nil {
+			return nil, err
+		}
+		if userID == viewerID || lastSeenVisible(target, viewer, contacts) {
+			seen[userID] = at.UTC()
+		}
+	}
+	return seen, rows.Err()
+}
+
+// getPrivacySettings returns the privacy settings of the user in the path,
+// to that user and to admins.
+func getPrivacySettings(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getPrivacySettings")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var settings PrivacySettings
+	err = db.QueryRowContext(ctx, "SELECT last_seen_visibility FROM users WHERE user_id = $1 AND deleted_at IS NULL", userID).
+		Scan(&settings.LastSeen)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// updatePrivacySettings sets who may see the last seen time of the user in
+// the path.
+func updatePrivacySettings(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updatePrivacySettings")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var settings PrivacySettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if settings.LastSeen != LastSeenEveryone && settings.LastSeen != LastSeenContacts && settings.LastSeen != LastSeenNobody {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, `last_seen must be "everyone", "contacts" or "nobody"`)
+		return
+	}
+	span.SetAttributes(attribute.String("chat.last_seen", settings.LastSeen))
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE users SET last_seen_visibility = $2, updated_at = NOW() WHERE user_id = $1 AND deleted_at IS NULL",
+		userID, settings.LastSeen)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lastSeenStore keeps users' last seen times and visibility, and who are
+// contacts, and answers lastSeenFor the way Postgres would.
+type lastSeenStore struct {
+	mu         sync.Mutex
+	seen       map[int64]time.Time
+	visibility map[int64]string
+	contacts   map[[2]int64]bool
+	writes     int
+}
+
+func (s *lastSeenStore) Connect(context.Context) (driver.Conn, error) {
+	return lastSeenConn{store: s}, nil
+}
+
+func (s *lastSeenStore) Driver() driver.Driver { return nil }
+
+type lastSeenConn struct {
+	fakeConn
+	store *lastSeenStore
+}
+
+func (lastSeenConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+func (s *lastSeenStore) visibilityOf(userID int64) string {
+	if v, ok := s.visibility[userID]; ok {
+		return v
+	}
+	return LastSeenEveryone
+}
+
+func (c lastSeenConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT u.user_id, u.last_seen_at") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	viewer := args[0].Value.(int64)
+	rows := &tableRows{columns: []string{"user_id", "last_seen_at", "target", "viewer", "contacts"}}
+	for _, id := range args[1].Value.([]int64) {
+		at, ok := s.seen[id]
+		if !ok {
+			continue
+		}
+		contacts := s.contacts[[2]int64{id, viewer}] || s.contacts[[2]int64{viewer, id}]
+		rows.rows = append(rows.rows, []driver.Value{id, at, s.visibilityOf(id), s.visibilityOf(viewer), contacts})
+	}
+	return rows, nil
+}
+
+func (c lastSeenConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "UPDATE users SET last_seen_at"):
+		s.writes++
+		s.seen[args[0].Value.(int64)] = args[1].Value.(time.Time)
+	case strings.HasPrefix(query, "UPDATE users SET last_seen_visibility"):
+		s.visibility[args[0].Value.(int64)] = args[1].Value.(string)
+	default:
+		return nil, errors.New("not supported")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func initLastSeenStore(t *testing.T) *lastSeenStore {
+	store := &lastSeenStore{
+		seen:       make(map[int64]time.Time),
+		visibility: make(map[int64]string),
+		contacts:   make(map[[2]int64]bool),
+	}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func TestLastSeenPrivacy(t *testing.T) {
+	initRedis(t)
+	store := initLastSeenStore(t)
+	at := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	// The viewer is user 1, who has user 2 as a contact but not user 3.
+	store.contacts[[2]int64{1, 2}] = true
+	store.seen[2], store.seen[3] = at, at
+
+	everyone, contacts, nobody := LastSeenEveryone, LastSeenContacts, LastSeenNobody
+	for _, tc := range []struct {
+		viewer, target string
+		contact        bool
+		want           bool
+	}{
+		{everyone, everyone, false, true},
+		{everyone, contacts, true, true},
+		{everyone, contacts, false, false},
+		{everyone, nobody, true, false},
+		{contacts, everyone, true, true},
+		{contacts, everyone, false, false},
+		{contacts, contacts, true, true},
+		{nobody, everyone, true, false},
+		{nobody, everyone, false, false},
+	} {
+		target := int64(3)
+		if tc.contact {
+			target = 2
+		}
+		store.visibility[1], store.visibility[target] = tc.viewer, tc.target
+		seen, err := lastSeenFor(context.Background(), 1, []int{int(target)})
+		assert.NoError(t, err)
+		_, ok := seen[int(target)]
+		assert.Equal(t, tc.want, ok, "viewer %s, target %s, contacts %v", tc.viewer, tc.target, tc.contact)
+	}
+
+	store.visibility[2] = LastSeenNobody
+	seen, _ := lastSeenFor(context.Background(), 2, []int{2})
+	assert.Equal(t, map[int]time.Time{2: at}, seen, "users always see their own")
+	store.visibility[3] = LastSeenContacts
+	seen, _ = lastSeenFor(context.Background(), 0, []int{2, 3})
+	assert.Empty(t, seen, "signed out callers only see what is shown to everyone")
+}
+
+func TestRecordLastSeenIsThrottled(t *testing.T) {
+	mr := initRedis(t)
+	store := initLastSeenStore(t)
+	ctx := context.Background()
+	at := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	recordLastSeen(ctx, 1, at)
+	recordLastSeen(ctx, 1, at.Add(10*time.Second))
+	recordLastSeen(ctx, 2, at.Add(20*time.Second))
+	store.mu.Lock()
+	assert.Equal(t, 2, store.writes, "one write per user and minute")
+	assert.Equal(t, at, store.seen[1])
+	store.mu.Unlock()
+
+	mr.FastForward(lastSeenWriteInterval)
+	recordLastSeen(ctx, 1, at.Add(time.Minute))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 3, store.writes)
+	assert.Equal(t, at.Add(time.Minute), store.seen[1])
+}
+
+func TestDisconnectWritesLastSeen(t *testing.T) {
+	initRedis(t)
+	store := initLastSeenStore(t)
+	server := newTestServer(t, newRouter())
+
+	conn := dialTestUser(t, server, 5)
+	waitForClients(t, 1)
+	if err := conn.WriteJSON(Message{RecipientID: 6, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.writes == 1
+	}, 2*time.Second, 5*time.Millisecond, "the frame is recorded")
+
+	// The disconnect is written even within the minute of the frame.
+	conn.Close()
+	waitForClients(t, 0)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 2, store.writes)
+}
+
+func TestUpdatePrivacySettings(t *testing.T) {
+	initRedis(t)
+	store := initLastSeenStore(t)
+	router := newRouter()
+	serve := func(userID int, body interface{}) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, "PUT", "/users/7/privacy", body))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(7, PrivacySettings{LastSeen: LastSeenContacts}))
+	assert.Equal(t, LastSeenContacts, store.visibilityOf(7))
+	assert.Equal(t, http.StatusUnprocessableEntity, serve(7, PrivacySettings{LastSeen: "friends"}))
+	assert.Equal(t, http.StatusForbidden, serve(8, PrivacySettings{LastSeen: LastSeenNobody}))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/html"
+)
+
+const (
+	linkPreviewTimeout  = 3 * time.Second
+	linkPreviewCacheTTL = 24 * time.Hour
+
+	maxPreviewsPerMessage = 3
+	// maxPreviewBodyBytes is how much of a page is read looking for its
+	// metadata, which lives in the head.
+	maxPreviewBodyBytes = 512 << 10
+	// maxPreviewFetches bounds how many messages are previewed at once;
+	// messages arriving beyond it go without.
+	maxPreviewFetches = 16
+
+	maxPreviewTitleRunes       = 300
+	maxPreviewDescriptionRunes = 1000
+)
+
+var (
+	urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+	errForbiddenAddress = errors.New("address is not publicly routable")
+
+	// previewClient fetches pages for link previews. It refuses to connect
+	// to private addresses, checked after DNS resolution so that a name
+	// cannot be pointed at an internal service.
+	previewClient = newPreviewClient(isPublicIP)
+
+	previewSlots = make(chan struct{}, maxPreviewFetches)
+)
+
+// LinkPreview describes a page linked from a message.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+}
+
+func linkPreviewKey(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return fmt.Sprintf("linkpreview:%s", hex.EncodeToString(sum[:]))
+}
+
+func newPreviewClient(allow func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: linkPreviewTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allow(ip) {
+				return errForbiddenAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   linkPreviewTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// isPublicIP reports whether ip may be fetched from: not loopback, private,
+// link-local (which covers cloud metadata endpoints), shared or
+// unspecified.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	// Carrier-grade NAT, RFC 6598.
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// extractURLs returns the distinct http(s) URLs in text, in order, up to
+// maxPreviewsPerMessage.
+func extractURLs(text string) []string {
+	var urls []string
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		// Punctuation ending a sentence is not part of the link.
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		u, err := url.Parse(match)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if !slices.Contains(urls, match) {
+			urls = append(urls, match)
+		}
+		if len(urls) == maxPreviewsPerMessage {
+			break
+		}
+	}
+	return urls
+}
+
+// previewLinks stores previews of the links in msg in the background. It
+// skips encrypted messages, whose text the server cannot read, and gives
+// up right away when too many previews are being fetched.
+func previewLinks(msg Message) {
+	if msg.Encrypted || msg.ID == 0 {
+		return
+	}
+	urls := extractURLs(msg.Text)
+	if len(urls) == 0 {
+		return
+	}
+	select {
+	case previewSlots <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-previewSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(len(urls)+1)*linkPreviewTimeout)
+		defer cancel()
+		if err := storeLinkPreviews(ctx, msg.ID, urls); err != nil {
+			logger(ctx).Println("Failed to store link previews:", err)
+		}
+	}()
+}
+
+func storeLinkPreviews(ctx context.Context, messageID int, urls []string) error {
+	for _, u := range urls {
+		preview, err := linkPreview(ctx, u)
+		if err != nil {
+			logger(ctx).Printf("Failed to preview %s: %v", u, err)
+			continue
+		}
+		_, err = db.ExecContext(ctx,
+			`INSERT INTO link_previews (message_id, url, title, description, image_url)
+			VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+			messageID, preview.URL, preview.Title, preview.Description, preview.ImageURL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkPreview returns the preview of rawURL from the cache, fetching and
+// caching it on a miss.
+func linkPreview(ctx context.Context, rawURL string) (LinkPreview, error) {
+	key := linkPreviewKey(rawURL)
+	if data, err := redisCli.Get(ctx, key).Bytes(); err == nil {
+		var preview LinkPreview
+		if err := json.Unmarshal(data, &preview); err == nil {
+			return preview, nil
+		}
+	} else if err != redis.Nil {
+		logger(ctx).Println("Failed to read link preview cache:", err)
+	}
+
+	preview, err := fetchLinkPreview(ctx, rawURL)
+	if err != nil {
+		return preview, err
+	}
+	data, _ := json.Marshal(preview)
+	if err := redisCli.Set(ctx, key, data, linkPreviewCacheTTL).Err(); err != nil {
+		logger(ctx).Println("Failed to cache link preview:", err)
+	}
+	return preview, nil
+}
+
+func fetchLinkPreview(ctx context.Context, rawURL string) (LinkPreview, error) {
+	preview := LinkPreview{URL: rawURL}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return preview, fmt.Errorf("fetching %s: not an HTML page", rawURL)
+	}
+
+	parsePreview(io.LimitReader(resp.Body, maxPreviewBodyBytes), resp.Request.URL, &preview)
+	return preview, nil
+}
+
+// parsePreview fills in preview from the head of an HTML page found at
+// base: its <title> and the og:description and og:image properties.
+func parsePreview(r io.Reader, base *url.URL, preview *LinkPreview) {
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = preview.Title == ""
+			case "meta":
+				if hasAttr {
+					readMetaTag(z, base, preview)
+				}
+			case "body":
+				return
+			}
+		case html.TextToken:
+			if inTitle {
+				preview.Title = truncateRunes(strings.TrimSpace(string(z.Text())), maxPreviewTitleRunes)
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				return
+			}
+		}
+	}
+}
+
+func readMetaTag(z *html.Tokenizer, base *url.URL, preview *LinkPreview) {
+	var property, content string
+	for {
+		key, value, more := z.TagAttr()
+		switch string(key) {
+		case "property":
+			property = string(value)
+		case "content":
+			content = strings.TrimSpace(string(value))
+		}
+		if !more {
+			break
+		}
+	}
+
+	switch property {
+	case "og:description":
+		preview.Description = truncateRunes(content, maxPreviewDescriptionRunes)
+	case "og:image":
+		if u, err := base.Parse(content); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			preview.ImageURL = u.String()
+		}
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// loadLinkPreviews fills in the link previews of messages.
+func loadLinkPreviews(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	byID := make(map[int]*Message, len(messages))
+	for i := range messages {
+		ids[i] = int64(messages[i].ID)
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT message_id, url, title, description, image_url FROM link_previews WHERE message_id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int
+		var p LinkPreview
+		if err := rows.Scan(&messageID, &p.URL, &p.Title, &p.Description, &p.ImageURL); err != nil {
+			return err
+		}
+		if msg := byID[messageID]; msg != nil {
+			msg.LinkPreviews = append(msg.LinkPreviews, p)
+		}
+	}
+	return rows.Err()
+}
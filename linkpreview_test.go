@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title> Gophers &amp; friends </title>
+  <meta property="og:description" content="All about gophers.">
+  <meta property="og:image" content="/img/gopher.png">
+  <meta property="og:title" content="ignored">
+</head>
+<body><title>not the title</title></body>
+</html>`
+
+// startPreviewServer serves previewPage at /page, and a plain text file at
+// /notes.txt, counting the requests it got. The preview client is allowed
+// to reach it for the duration of the test.
+func startPreviewServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	hits := &atomic.Int64{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, previewPage)
+	})
+	mux.HandleFunc("/notes.txt", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "<title>not html</title>")
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	saved := previewClient
+	previewClient = newPreviewClient(func(net.IP) bool { return true })
+	t.Cleanup(func() { previewClient = saved })
+	return server, hits
+}
+
+func TestExtractURLs(t *testing.T) {
+	t.Parallel()
+	urls := extractURLs(`see https://example.com/a, (http://example.org/b) and https://example.com/a again.
+		ftp://example.net/c https:// https://one.example https://two.example`)
+
+	assert.Equal(t, []string{"https://example.com/a", "http://example.org/b", "https://one.example"}, urls)
+	assert.Empty(t, extractURLs("no links here"))
+}
+
+func TestIsPublicIP(t *testing.T) {
+	t.Parallel()
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "172.16.5.5", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1"} {
+		assert.False(t, isPublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "100.128.0.1", "2606:4700::1111"} {
+		assert.True(t, isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestPreviewClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a private address was fetched")
+	}))
+	defer server.Close()
+
+	resp, err := newPreviewClient(isPublicIP).Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.ErrorIs(t, err, errForbiddenAddress)
+}
+
+func TestLinkPreviewParsesHead(t *testing.T) {
+	initRedis(t)
+	server, hits := startPreviewServer(t)
+	ctx := context.Background()
+
+	preview, err := linkPreview(ctx, server.URL+"/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, LinkPreview{
+		URL:         server.URL + "/page",
+		Title:       "Gophers & friends",
+		Description: "All about gophers.",
+		ImageURL:    server.URL + "/img/gopher.png",
+	}, preview)
+
+	cached, err := linkPreview(ctx, server.URL+"/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, preview, cached)
+	assert.EqualValues(t, 1, hits.Load(), "the second preview comes from the cache")
+}
+
+func TestLinkPreviewRejectsNonHTML(t *testing.T) {
+	initRedis(t)
+	server, _ := startPreviewServer(t)
+
+	_, err := linkPreview(context.Background(), server.URL+"/notes.txt")
+	assert.Error(t, err)
+	_, err = linkPreview(context.Background(), server.URL+"/missing")
+	assert.Error(t, err)
+}
+
+// previewStore records the link previews inserted into it.
+type previewStore struct {
+	mu       sync.Mutex
+	previews map[int64][]LinkPreview
+}
+
+func (s *previewStore) Connect(context.Context) (driver.Conn, error) {
+	return previewConn{store: s}, nil
+}
+
+func (s *previewStore) Driver() driver.Driver { return nil }
+
+func (s *previewStore) stored(messageID int64) []LinkPreview {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.previews[messageID]
+}
+
+type previewConn struct {
+	fakeConn
+	store *previewStore
+}
+
+func (c previewConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "INSERT INTO link_previews") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	id := args[0].Value.(int64)
+	c.store.previews[id] = append(c.store.previews[id], LinkPreview{
+		URL:         args[1].Value.(string),
+		Title:       args[2].Value.(string),
+		Description: args[3].Value.(string),
+		ImageURL:    args[4].Value.(string),
+	})
+	return driver.RowsAffected(1), nil
+}
+
+// waitForPreviews returns once every preview started has been stored, by
+// taking all the slots the fetches hold.
+func waitForPreviews() {
+	for i := 0; i < cap(previewSlots); i++ {
+		previewSlots <- struct{}{}
+	}
+	for i := 0; i < cap(previewSlots); i++ {
+		<-previewSlots
+	}
+}
+
+func TestPreviewLinksStoresPreviews(t *testing.T) {
+	initRedis(t)
+	server, _ := startPreviewServer(t)
+	store := &previewStore{previews: make(map[int64][]LinkPreview)}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	text := "read " + server.URL + "/page and " + server.URL + "/notes.txt"
+	previewLinks(Message{ID: 5, Text: text, Encrypted: true})
+	previewLinks(Message{ID: 6, Text: text})
+
+	waitForPreviews()
+	assert.Len(t, store.stored(6), 1, "only the HTML page is previewed")
+	if previews := store.stored(6); len(previews) == 1 {
+		assert.Equal(t, "Gophers & friends", previews[0].Title)
+	}
+	assert.Empty(t, store.stored(5), "encrypted messages are not previewed")
+}
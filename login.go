@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Failed logins lock out the username tried and, so that one client cannot
+// work through many usernames, the address they came from.
+var (
+	loginLimiter   = failureLimiter{prefix: "login", limit: int64(cfg.LoginMaxFailures), window: cfg.LoginFailureWindow, lockout: cfg.LoginLockout}
+	loginIPLimiter = failureLimiter{prefix: "login_ip", limit: int64(cfg.LoginIPMaxFailures), window: cfg.LoginFailureWindow, lockout: cfg.LoginLockout}
+)
+
+// dummyPasswordHash is compared against when the username does not exist, so
+// unknown and known usernames take about as long to reject.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := hashPassword("not a real password")
+	return []byte(hash)
+})
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.login")
+	defer span.End()
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	// Usernames are the same in any case, and so are their lockouts.
+	username := usernameFold(req.Username)
+	ip := clientIP(r)
+	retryAfter, err := loginLockedOut(ctx, username, ip)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to check rate limit")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	var userID int
+	var role string
+	var banned bool
+	passwordHash := dummyPasswordHash()
+	err = db.QueryRowContext(ctx, "SELECT user_id, password_hash, role, banned_at IS NOT NULL FROM users WHERE lower(username) = lower($1)", username).Scan(&userID, &passwordHash, &role, &banned)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if checkPassword(passwordHash, req.Password) != nil || userID == 0 {
+		recordAudit(ctx, 0, "login_failed", "username:"+username)
+		recordLoginFailure(ctx, userID, username, ip)
+		WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid username or password")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+	// Only tell who knows the password that the account is banned.
+	if banned {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Account banned")
+		return
+	}
+	if passwordNeedsRehash(passwordHash) {
+		rehashPassword(ctx, userID, passwordHash, req.Password)
+	}
+
+	sessionID, err := newSession(ctx, userID)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to create session")
+		return
+	}
+	accessToken, err := newAccessToken(userID, role, sessionID)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to issue token")
+		return
+	}
+	refreshToken, err := createRefreshToken(ctx, sessionID, userID)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to create session")
+		return
+	}
+
+	if err := loginLimiter.reset(ctx, username); err != nil {
+		logger(ctx).Println("Failed to reset login failures:", err)
+	}
+	if err := loginIPLimiter.reset(ctx, ip); err != nil {
+		logger(ctx).Println("Failed to reset login failures:", err)
+	}
+	recordAudit(ctx, userID, "login", userTarget(userID))
+
+	setRefreshCookie(w, refreshToken)
+	writeTokens(w, accessToken)
+}
+
+// rehashPassword replaces the user's password hash with one made with the
+// current settings, unless the password changed in the meantime. Failing
+// only leaves the old hash, so it is logged rather than failing the login.
+func rehashPassword(ctx context.Context, userID int, oldHash []byte, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		logger(ctx).Println("Failed to rehash password:", err)
+		return
+	}
+	_, err = db.ExecContext(ctx, "UPDATE users SET password_hash = $1 WHERE user_id = $2 AND password_hash = $3", hash, userID, string(oldHash))
+	if err != nil {
+		logger(ctx).Println("Failed to rehash password:", err)
+	}
+}
+
+// loginLockedOut returns how long logins to the username or from the address
+// are refused for, or zero if both may try.
+func loginLockedOut(ctx context.Context, username, ip string) (time.Duration, error) {
+	retryAfter, err := loginLimiter.blocked(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	ipRetryAfter, err := loginIPLimiter.blocked(ctx, ip)
+	if err != nil {
+		return 0, err
+	}
+	return max(retryAfter, ipRetryAfter), nil
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// address, and audits the lockouts it causes. userID is 0 for a username
+// nobody has.
+func recordLoginFailure(ctx context.Context, userID int, username, ip string) {
+	locked, err := loginLimiter.fail(ctx, username)
+	if err != nil {
+		logger(ctx).Println("Failed to record login failure:", err)
+	} else if locked {
+		target := "username:" + username
+		if userID != 0 {
+			target = userTarget(userID)
+		}
+		recordAudit(ctx, 0, "account_locked", target)
+	}
+
+	locked, err = loginIPLimiter.fail(ctx, ip)
+	if err != nil {
+		logger(ctx).Println("Failed to record login failure:", err)
+	} else if locked {
+		recordAudit(ctx, 0, "ip_locked", "ip:"+ip)
+	}
+}
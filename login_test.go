@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialStore answers the login query for a single user, and the role
+// query of a refresh by user ID. It takes the rehash of the password.
+type credentialStore struct {
+	userID       int
+	username     string
+	passwordHash []byte
+	role         string
+	banned       bool
+}
+
+func (s *credentialStore) Connect(context.Context) (driver.Conn, error) {
+	return credentialConn{store: s}, nil
+}
+
+func (s *credentialStore) Driver() driver.Driver { return nil }
+
+type credentialConn struct {
+	fakeConn
+	store *credentialStore
+}
+
+func (c credentialConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	if userID, ok := args[0].Value.(int64); ok {
+		rows := &credentialRows{columns: []string{"role", "banned"}}
+		if userID == int64(c.store.userID) {
+			rows.row = []driver.Value{c.store.role, c.store.banned}
+		}
+		return rows, nil
+	}
+	rows := &credentialRows{columns: []string{"user_id", "password_hash", "role", "banned"}}
+	if strings.EqualFold(args[0].Value.(string), c.store.username) {
+		rows.row = []driver.Value{int64(c.store.userID), c.store.passwordHash, c.store.role, c.store.banned}
+	}
+	return rows, nil
+}
+
+func (c credentialConn) ExecContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Result, error) {
+	if args[1].Value == int64(c.store.userID) && args[2].Value == string(c.store.passwordHash) {
+		c.store.passwordHash = []byte(args[0].Value.(string))
+		return driver.RowsAffected(1), nil
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type credentialRows struct {
+	columns []string
+	row     []driver.Value
+}
+
+func (r *credentialRows) Columns() []string { return r.columns }
+func (r *credentialRows) Close() error      { return nil }
+
+func (r *credentialRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+func initCredentialStore(t *testing.T, userID int, username, password string) *credentialStore {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &credentialStore{userID: userID, username: username, passwordHash: hash, role: RoleUser}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func postLogin(username, password string) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(loginRequest{Username: username, Password: password})
+	rr := httptest.NewRecorder()
+	login(rr, httptest.NewRequest("POST", "/auth/login", bytes.NewBuffer(jsonData)))
+	return rr
+}
+
+func TestLogin(t *testing.T) {
+	mr := initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+
+	rr := postLogin("vishnu", "password123")
+	assert.Equal(t, http.StatusOK, rr.Code, "handler returned wrong status code")
+
+	var resp loginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Bearer", resp.TokenType)
+	assert.Equal(t, 900, resp.ExpiresIn)
+	claims, err := parseToken(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 42, claims.UserID)
+	assert.Equal(t, RoleUser, claims.Role)
+
+	cookies := rr.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		cookie := cookies[0]
+		assert.Equal(t, refreshTokenCookie, cookie.Name)
+		assert.True(t, cookie.HttpOnly)
+		assert.True(t, cookie.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+		assert.Equal(t, int(cfg.RefreshTokenTTL.Seconds()), cookie.MaxAge)
+
+		sessionID := mr.HGet(refreshTokenKey(cookie.Value), "session")
+		assert.Equal(t, claims.ID, sessionID, "refresh token should belong to the new session")
+	}
+}
+
+func TestLoginInvalidCredentials(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+
+	rr := postLogin("vishnu", "wrongpassword")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	rr = postLogin("nobody", "password123")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestLoginLocksAccountAfterFailures(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusUnauthorized, postLogin("vishnu", "wrongpassword").Code)
+	}
+
+	rr := postLogin("vishnu", "password123")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "correct password should be refused while locked")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
+func TestLoginIssuesUsersRole(t *testing.T) {
+	initRedis(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = sql.OpenDB(&credentialStore{userID: 42, username: "vishnu", passwordHash: hash, role: RoleAdmin})
+	t.Cleanup(func() { db.Close() })
+
+	rr := postLogin("vishnu", "password123")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp loginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseToken(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, RoleAdmin, claims.Role)
+}
+
+func TestLoginRejectsBannedUser(t *testing.T) {
+	initRedis(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = sql.OpenDB(&credentialStore{userID: 42, username: "vishnu", passwordHash: hash, role: RoleUser, banned: true})
+	t.Cleanup(func() { db.Close() })
+
+	rr := postLogin("vishnu", "password123")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	rr = postLogin("vishnu", "wrongpassword")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "the ban is only revealed to who knows the password")
+}
+
+func TestLoginLockoutCooldown(t *testing.T) {
+	mr := initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	rec := initRecordingAuditor(t)
+
+	for i := 0; i < cfg.LoginMaxFailures; i++ {
+		assert.Equal(t, http.StatusUnauthorized, postLogin("vishnu", "wrongpassword").Code)
+	}
+	locked := 0
+	for _, event := range rec.recorded() {
+		if event.Action == "account_locked" {
+			locked++
+			assert.Equal(t, "user:42", event.Target)
+		}
+	}
+	assert.Equal(t, 1, locked, "the lockout should be audited once")
+
+	rr := postLogin("vishnu", "password123")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, strconv.Itoa(int(cfg.LoginLockout.Seconds())), rr.Header().Get("Retry-After"))
+
+	mr.FastForward(cfg.LoginLockout - time.Second)
+	assert.Equal(t, http.StatusTooManyRequests, postLogin("vishnu", "password123").Code, "still cooling down")
+
+	mr.FastForward(time.Second)
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	assert.False(t, mr.Exists(loginLimiter.key("vishnu")))
+	assert.False(t, mr.Exists(loginIPLimiter.key("192.0.2.1")))
+}
+
+func TestLoginResetsFailuresOnSuccess(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+
+	for i := 0; i < cfg.LoginMaxFailures-1; i++ {
+		assert.Equal(t, http.StatusUnauthorized, postLogin("vishnu", "wrongpassword").Code)
+	}
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	assert.Equal(t, http.StatusUnauthorized, postLogin("vishnu", "wrongpassword").Code, "one more failure should not lock the account")
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+}
+
+func TestLoginLocksOutAddress(t *testing.T) {
+	mr := initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	rec := initRecordingAuditor(t)
+	limiter := loginIPLimiter
+	loginIPLimiter.limit = 3
+	t.Cleanup(func() { loginIPLimiter = limiter })
+
+	loginFrom := func(addr, username, password string) *httptest.ResponseRecorder {
+		jsonData, _ := json.Marshal(loginRequest{Username: username, Password: password})
+		req := httptest.NewRequest("POST", "/auth/login", bytes.NewBuffer(jsonData))
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		login(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, loginFrom("203.0.113.9:4000", fmt.Sprintf("guess%d", i), "password123").Code)
+	}
+	rr := loginFrom("203.0.113.9:4001", "vishnu", "password123")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "every username is refused from the address")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, loginFrom("198.51.100.4:4000", "vishnu", "password123").Code, "other addresses may still log in")
+
+	events := rec.recorded()
+	assert.Equal(t, AuditEvent{Action: "ip_locked", Target: "ip:203.0.113.9"}, events[len(events)-2])
+
+	mr.FastForward(cfg.LoginLockout)
+	assert.Equal(t, http.StatusOK, loginFrom("203.0.113.9:4000", "vishnu", "password123").Code)
+}
+
+func TestLoginRehashesWeakPassword(t *testing.T) {
+	initRedis(t)
+	store := initCredentialStore(t, 42, "vishnu", "password123")
+	defer func(cost int) { cfg.BcryptCost = cost }(cfg.BcryptCost)
+	cfg.BcryptCost = bcrypt.MinCost + 1
+
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	cost, err := bcrypt.Cost(store.passwordHash)
+	assert.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost+1, cost, "login should raise the hash to the configured cost")
+
+	rehashed := string(store.passwordHash)
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	assert.Equal(t, rehashed, string(store.passwordHash), "a hash at the configured cost is kept")
+}
+
+func TestLoginRehashesToArgon2id(t *testing.T) {
+	initRedis(t)
+	store := initCredentialStore(t, 42, "vishnu", "password123")
+	defer func(algorithm string) { cfg.PasswordHash = algorithm }(cfg.PasswordHash)
+	cfg.PasswordHash = passwordHashArgon2id
+
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	assert.True(t, strings.HasPrefix(string(store.passwordHash), "$argon2id$"), string(store.passwordHash))
+
+	assert.Equal(t, http.StatusOK, postLogin("vishnu", "password123").Code)
+	assert.Equal(t, http.StatusUnauthorized, postLogin("vishnu", "wrongpassword").Code)
+}
+
+func TestLoginUsernameIgnoresCase(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+
+	assert.Equal(t, http.StatusOK, postLogin(" Vishnu ", "password123").Code)
+
+	// Spelling the username differently does not get around its lockout.
+	for i := 0; i < 10; i++ {
+		postLogin([]string{"vishnu", "VISHNU"}[i%2], "wrongpassword")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, postLogin("Vishnu", "password123").Code)
+}
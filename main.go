@@ -4,247 +4,892 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	_ "github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
-const (
-	DB_USER     = "postgres"
-	DB_PASSWORD = "postgres"
-	DB_NAME     = "chatdb"
-)
+const shutdownTimeout = 10 * time.Second
 
 var (
 	db       *sql.DB
-	redisCli *redis.Client
+	redisCli *RedisClient
 	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: cfg.WSCompression,
+		// The upgrader picks the first of these the client offers.
+		Subprotocols: []string{subprotocolMsgpack, subprotocolJSON},
 	}
-	clients = make(map[string]*websocket.Conn)
-	lock    = sync.RWMutex{}
+	registry = NewConnectionRegistry()
 )
 
 type User struct {
-	ID       int    `json:"id"`
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Password  string    `json:"-"`
+	AvatarURL string    `json:"avatar_url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Status is nil for users who set none or whose status expired.
+	Status *UserStatus `json:"status,omitempty"`
+	// LastSeenAt is set for callers the user's privacy settings let see
+	// it. It is never cached.
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// createUserRequest is the signup payload. It is separate from User because
+// User never reads or writes the password as JSON.
+type createUserRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
-	Password string `json:"-"`
+	Password string `json:"password"`
 }
 
 type Message struct {
-	SenderID    int    `json:"sender_id"`
-	RecipientID int    `json:"recipient_id"`
-	Text        string `json:"text"`
+	ID          int          `json:"id,omitempty"`
+	Seq         int64        `json:"seq,omitempty"`
+	SenderID    int          `json:"sender_id"`
+	RecipientID int          `json:"recipient_id"`
+	RoomID      int          `json:"room_id,omitempty"`
+	Text        string       `json:"text"`
+	Encrypted   bool         `json:"encrypted,omitempty"`
+	TraceParent string       `json:"traceparent,omitempty"`
+	ClientMsgID string       `json:"client_msg_id,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Reactions counts the reactions to the message by emoji.
+	Reactions    map[string]int64 `json:"reactions,omitempty"`
+	LinkPreviews []LinkPreview    `json:"link_previews,omitempty"`
+	// Format is "plain", the default, or "markdown", in which case
+	// RenderedHTML carries the text as sanitized HTML.
+	Format       string `json:"format,omitempty"`
+	RenderedHTML string `json:"rendered_html,omitempty"`
+	// TTLSeconds makes the message ephemeral: it expires that long after
+	// it is sent, at ExpiresAt, and is then deleted.
+	TTLSeconds int        `json:"ttl_seconds,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	// SendAt schedules the message for later delivery. Only POST /messages
+	// reads it.
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Recipients sends the message to each of these users instead of to
+	// RecipientID. Only POST /messages reads it.
+	Recipients []int `json:"recipients,omitempty"`
+	// Request marks a message from someone the recipient has not accepted
+	// as a contact yet, in strict mode. It is set by the server.
+	Request bool `json:"request,omitempty"`
+	// Muted tells the recipient they muted the conversation, so that the
+	// message is shown without notifying them. It is set by the server.
+	Muted bool `json:"muted,omitempty"`
+	// DND tells the recipient they are not to be disturbed now, by their
+	// notification settings. It is set by the server.
+	DND bool `json:"dnd,omitempty"`
+	// Kind is empty for messages users send and MessageKindSystem for
+	// those the server posts to a room when its members or settings
+	// change. The sender of a system message is the user who made the
+	// change. Away messages sent on a user's behalf are
+	// MessageKindAutoReply. It is set by the server.
+	Kind string `json:"kind,omitempty"`
+	// ForwardedFrom names the message a forwarded message copies. It is
+	// set by the server.
+	ForwardedFrom *ForwardedFrom `json:"forwarded_from,omitempty"`
+	// Version counts the edits of a stored message, from 1. An edit names
+	// the version it changes, so that it cannot overwrite one it missed.
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 func main() {
-	dbinfo := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
-		DB_USER, DB_PASSWORD, DB_NAME)
-	var err error
-	db, err = sql.Open("postgres", dbinfo)
+	if err := checkJWTSecret(cfg.JWTSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTracing, err := initTracing(context.Background(), cfg)
+	if err != nil {
+		log.Fatal("Tracing setup failed:", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	db, err = openDB(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, DB_NAME))
 
-	err = db.Ping()
+	err = connectWithRetry(context.Background(), "postgres", startupRetryPolicy(cfg), db.PingContext)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Database connection failed:", err)
+	}
+
+	if err := migrate(db); err != nil {
+		log.Fatal("Database migration failed:", err)
+	}
+	if n, err := promoteAdmins(context.Background(), cfg.AdminUsernames); err != nil {
+		log.Fatal("Admin bootstrap failed:", err)
+	} else if n > 0 {
+		log.Printf("Promoted %d users to admin", n)
 	}
 
-	redisCli = redis.NewClient(&redis.Options{
+	redisCli = NewRedisClient(&redis.Options{
 		Addr:     "localhost:6379",
 		Password: "",
 		DB:       0,
+	}, cfg.RedisKeyPrefix)
+
+	err = connectWithRetry(context.Background(), "redis", startupRetryPolicy(cfg), func(ctx context.Context) error {
+		return redisCli.Ping(ctx).Err()
 	})
+	if err != nil {
+		log.Println("Redis unavailable, starting in degraded mode:", err)
+	}
+
+	redisCli.AddHook(redisotel.NewTracingHook())
+	redisCli.AddHook(redisBreakerHook{cb: redisBreaker})
 
-	_, err = redisCli.Ping(context.Background()).Result()
+	// Missing sets are reloaded on first use, so a failure here only costs
+	// a few queries later.
+	if err := warmRoomMembers(context.Background()); err != nil {
+		log.Println("Failed to warm room members:", err)
+	}
+
+	if cfg.S3Bucket != "" {
+		attachmentStore, err = newS3Client(context.Background())
+		if err != nil {
+			log.Fatal("S3 setup failed:", err)
+		}
+	}
+
+	if cfg.BatchInserts {
+		batcher = NewMessageBatcher(db, cfg.BatchMaxSize, cfg.BatchFlushInterval)
+	}
+	if cfg.RoomStreams {
+		roomStreams = NewRoomStreams(cfg.InstanceID)
+	}
+
+	messageFilter = newMessageFilter(cfg)
+	webhooks = NewWebhookDispatcher(db, cfg.WebhookWorkers, cfg.WebhookTimeout, webhookRetryPolicy(cfg), cfg.WebhookDisableAfter)
+	bots = NewBotDispatcher(db, cfg.BotWorkers, cfg.BotTimeout, botRetryPolicy(cfg))
+	if cfg.FCMProjectID != "" {
+		client, err := fcmClient(cfg.FCMCredentialsFile, cfg.PushTimeout)
+		if err != nil {
+			log.Fatal("FCM credentials:", err)
+		}
+		pushes = NewPushDispatcher(db, client, fcmSendURL(cfg.FCMProjectID), cfg.PushWorkers, pushRetryPolicy(cfg))
+	}
+
+	go NewJanitor().Run(context.Background())
+	go scheduler.Run(context.Background())
+	go NewExpirySweeper().Run(context.Background())
+	go NewAccountExporter().Run(context.Background())
+	if cfg.MessageRetention > 0 {
+		go NewRetentionPurger(cfg.MessageRetention).Run(context.Background())
+	}
+
+	srv, redirect, err := newServers(cfg, newRouter())
 	if err != nil {
-		log.Fatal("Redis connection failed:", err)
+		log.Fatal("Server setup failed:", err)
+	}
+	go serve(srv)
+	if redirect != nil {
+		go serve(redirect)
 	}
+	fmt.Println("Server started on", srv.Addr)
 
-	r := mux.NewRouter()
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddr != "" {
+		grpcSrv = newGRPCServer(srv.TLSConfig)
+		go serveGRPC(grpcSrv, cfg.GRPCAddr)
+		fmt.Println("gRPC server started on", cfg.GRPCAddr)
+	}
 
-	r.HandleFunc("/users", CreateUser).Methods("POST")
-	r.HandleFunc("/users/{id}", getUser).Methods("GET")
-	r.HandleFunc("/messages", sendMessage).Methods("POST")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
 
-	r.HandleFunc("/ws/{userID}", handleWebSocket)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger(ctx).Println("Server shutdown:", err)
+	}
+	if grpcSrv != nil {
+		// Chat streams only end when their clients leave, so they are
+		// cut rather than waited for.
+		grpcSrv.Stop()
+	}
+	// Flush last so messages accepted during shutdown are not lost.
+	if batcher != nil {
+		batcher.Close()
+	}
+	if roomStreams != nil {
+		roomStreams.Close()
+	}
+	webhooks.Close()
+	bots.Close()
+	if pushes != nil {
+		pushes.Close()
+	}
+}
 
-	fmt.Println("Server started on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	// Middleware does not run when no route matches, so the handlers for
+	// that get the security headers themselves.
+	r.NotFoundHandler = SecurityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Not found")
+	}))
+	r.MethodNotAllowedHandler = SecurityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}))
+	r.Use(SecurityHeadersMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(tracingMiddleware)
+	r.Use(clientInfoMiddleware)
+
+	// public routes take anyone; user routes need a signed in caller, or
+	// answer 401; admin routes need one with the admin role, or answer 403.
+	public := NewRouteGroup(r)
+	user := NewRouteGroup(r, requireAuth)
+	admin := NewRouteGroup(r.PathPrefix("/admin").Subrouter(), requireAuth, RequireRole(RoleAdmin))
+	// Routes taking a JSON body cap it at cfg.MaxBodyBytes.
+	maxBody := bodyLimit(cfg.MaxBodyBytes)
+
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	public.GET("/readyz", readyz)
+
+	public.POST("/auth/login", login, maxBody)
+	public.GET("/auth/oauth/{provider}", oauthLogin, optionalAuth)
+	public.GET("/auth/{provider:google}", oauthLogin, optionalAuth)
+	public.GET("/auth/oauth/{provider}/callback", oauthCallback)
+	public.POST("/token/refresh", refreshTokens)
+	user.GET("/sessions", listSessions)
+	user.DELETE("/sessions/{id}", deleteSession)
+
+	public.POST("/users", CreateUser, maxBody)
+	user.POST("/users/batch", batchUsers, maxBody)
+	public.GET("/users/check", checkUsername)
+	public.GET("/users/{id}", getUser, optionalAuth)
+	user.DELETE("/users/{id}", deleteUser)
+	user.GET("/users/{id}/export", exportMessages)
+	user.POST("/users/{id}/export", startAccountExport)
+	user.GET("/exports/{jobID}", getAccountExport)
+	public.GET("/exports/{jobID}/download", downloadAccountExport)
+	user.GET("/users/{id}/rooms", listUserRooms)
+	user.POST("/users/{id}/avatar", uploadAvatar, bodyLimit(cfg.MaxBodyBytes+maxAvatarSizeBytes))
+	user.POST("/users/{id}/password", changePassword, maxBody)
+	user.GET("/users/{id}/settings", getNotificationSettings)
+	user.PUT("/users/{id}/settings", updateNotificationSettings, maxBody)
+	user.PUT("/users/{id}/status", updateStatus, maxBody)
+	user.GET("/users/{id}/privacy", getPrivacySettings)
+	user.PUT("/users/{id}/privacy", updatePrivacySettings, maxBody)
+	user.PUT("/users/{id}/away-message", updateAwayMessage, maxBody)
+	user.POST("/users/{id}/device-tokens", registerDeviceToken, maxBody)
+	user.DELETE("/users/{id}/device-tokens/{tokenID}", deleteDeviceToken)
+	user.GET("/rooms", listRooms)
+	user.POST("/rooms", createRoom, maxBody)
+	user.POST("/rooms/join", joinRoomByToken, maxBody)
+	user.GET("/rooms/{id}", getRoom)
+	user.PATCH("/rooms/{id}", updateRoom, maxBody)
+	user.DELETE("/rooms/{id}", deleteRoom)
+	user.POST("/rooms/{id}/invites", createInvite, maxBody)
+	user.DELETE("/rooms/{id}/invites/{token}", revokeInvite)
+	user.GET("/rooms/{id}/messages", listRoomMessages)
+	user.GET("/rooms/{id}/pins", listPins)
+	user.POST("/rooms/{id}/pins/{messageID}", pinMessage)
+	user.DELETE("/rooms/{id}/pins/{messageID}", unpinMessage)
+	user.POST("/rooms/{id}/members", addRoomMember, maxBody)
+	user.DELETE("/rooms/{id}/members/{uid}", removeRoomMember)
+	user.PUT("/rooms/{id}/members/{uid}/role", setRoomMemberRole, maxBody)
+	public.GET("/join/{token}", getInvite)
+	user.POST("/join/{token}", joinRoom)
+	user.GET("/contacts", listContacts)
+	user.GET("/contacts/requests", listContactRequests)
+	user.POST("/contacts/requests", createContactRequest, maxBody)
+	user.POST("/contacts/requests/{id}/accept", acceptContactRequest)
+	user.POST("/contacts/requests/{id}/decline", declineContactRequest)
+	user.GET("/conversations", listConversations)
+	user.POST("/conversations/{key}/archive", archiveConversation)
+	user.DELETE("/conversations/{key}/archive", unarchiveConversation)
+	user.POST("/conversations/{key}/mute", muteConversation, maxBody)
+	user.DELETE("/conversations/{key}/mute", unmuteConversation)
+	user.GET("/conversations/{key}/pins", listPins)
+	user.POST("/conversations/{key}/pins/{messageID}", pinMessage)
+	user.DELETE("/conversations/{key}/pins/{messageID}", unpinMessage)
+	user.GET("/conversations/{peer}/export", exportConversation)
+	user.PUT("/conversations/{peer}/settings", updateConversationSettings, maxBody)
+	user.GET("/conversations/{peer}/sync", syncConversation)
+	user.POST("/conversations/{key}/read", markConversationRead)
+	user.GET("/conversations/{key}/recent", getRecentMessages)
+	user.GET("/mentions", listMentions)
+	user.GET("/messages", getMessages)
+	user.POST("/messages", sendMessage, limitMessageBody)
+	user.GET("/messages/requests", getMessageRequests)
+	user.GET("/messages/scheduled", listScheduled)
+	user.DELETE("/messages/scheduled/{id}", cancelScheduled)
+	user.PUT("/messages/{id}", editMessage, maxBody)
+	user.POST("/messages/{id}/forward", forwardMessage, maxBody)
+	user.POST("/messages/{id}/reactions", addReaction, maxBody)
+	user.DELETE("/messages/{id}/reactions/{emoji}", removeReaction)
+	user.POST("/messages/{id}/report", reportMessage, maxBody)
+
+	admin.GET("/analytics", getAnalytics)
+	admin.POST("/announcements", createAnnouncement, maxBody)
+	admin.GET("/audit", listAudit)
+	admin.POST("/bots", createBot, maxBody)
+	admin.POST("/broadcast", broadcast, maxBody)
+	admin.GET("/circuit-breakers", getCircuitBreakers)
+	admin.GET("/connections", listConnections)
+	admin.DELETE("/connections/{userID}", disconnectUser)
+	admin.Handle([]string{http.MethodPost, http.MethodDelete}, "/messages/{id}/hold", setLegalHold)
+	admin.GET("/reports", listReports)
+	admin.POST("/reports/{id}/resolve", resolveReport, maxBody)
+	admin.GET("/stats", getStats)
+	admin.POST("/users/{id}/ban", banUser)
+	admin.POST("/users/{id}/unban", unbanUser)
+
+	user.Handle(nil, "/ws/{userID}", handleWebSocket)
+	user.GET("/events", streamEvents)
+
+	user.POST("/webhooks", createWebhook, maxBody)
+
+	return r
 }
 
 func CreateUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.CreateUser")
+	defer span.End()
+
+	var req createUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		decodeError(w, err)
 		return
 	}
+	user := User{Username: normalizeUsername(req.Username), Email: req.Email, Password: req.Password}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+	if err := validateUser(user); err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if usernameReserved(user.Username) {
+		WriteError(w, http.StatusConflict, "username_reserved", "That username is reserved")
 		return
 	}
 
-	err = db.QueryRow("INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING user_id", user.Username, user.Email, string(hashedPassword)).Scan(&user.ID)
+	if err := validatePassword(user.Password); err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to hash password")
 		return
 	}
 
-	err = setUserSession(user.ID)
+	err = db.QueryRowContext(ctx, "INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING user_id, created_at, updated_at", user.Username, user.Email, hashedPassword).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if column := uniqueUserColumn(err); column != "" {
+		WriteError(w, http.StatusConflict, column+"_already_taken", "That "+column+" is already taken")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to cache user session", http.StatusInternalServerError)
+		dbError(w, err, http.StatusInternalServerError)
 		return
 	}
+	span.SetAttributes(attribute.Int("chat.user_id", user.ID))
+
+	err = cacheUser(ctx, user)
+	if err != nil {
+		logger(ctx).Println("Failed to cache user:", err)
+	}
+	if err := redisCli.Del(ctx, usernameAvailabilityKey(user.Username)).Err(); err != nil {
+		logger(ctx).Println("Failed to clear username availability:", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
+// uniqueViolation is the SQLSTATE Postgres reports for a duplicate key.
+const uniqueViolation = "23505"
+
+// uniqueUserColumn returns "username" or "email" when err is a unique
+// violation on that column of users, and "" otherwise. The constraints are
+// users_username_key and users_email_key in database.sql.txt, or the
+// _unique ones migration 0039 adds where those are missing, and
+// users_username_lower_unique, which makes usernames unique ignoring case.
+func uniqueUserColumn(err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(pgErr.ConstraintName, "users_username_"):
+		return "username"
+	case strings.HasPrefix(pgErr.ConstraintName, "users_email_"):
+		return "email"
+	}
+	return ""
+}
+
 func getUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getUser")
+	defer span.End()
+
 	params := mux.Vars(r)
 	id := params["id"]
+	span.SetAttributes(attribute.String("chat.user_id", id))
 
-	userSession, err := getUserSession(id)
+	userID, err := strconv.Atoi(id)
 	if err != nil {
-		http.Error(w, "Failed to get user session", http.StatusInternalServerError)
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
 		return
 	}
-	if userSession != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(*userSession)
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound)
 		return
 	}
 
-	var user User
-	err = db.QueryRow("SELECT user_id, username, email FROM users WHERE user_id = $1", id).Scan(&user.ID, &user.Username, &user.Email)
+	var viewerID int
+	if claims := claimsFromContext(ctx); claims != nil {
+		viewerID = claims.UserID
+	}
+	if seen, err := lastSeenFor(ctx, viewerID, []int{userID}); err != nil {
+		logger(ctx).Println("Failed to look up last seen:", err)
+	} else if at, ok := seen[userID]; ok {
+		user.LastSeenAt = &at
+	}
+
+	// The profile differs by viewer and changes without touching
+	// updated_at, with the status and last seen time, so the ETag is a
+	// hash of what this caller gets.
+	body, err := json.Marshal(user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to encode user")
+		return
+	}
+	if notModified(w, r, bodyETag(body)) {
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
 
-	err = setUserSession(user.ID)
+// loadUser returns the profile of an active user, from the cache if it has
+// it.
+func loadUser(ctx context.Context, userID int) (User, error) {
+	cached, err := cachedUser(ctx, userID)
 	if err != nil {
-		log.Println("Failed to cache user session:", err)
+		logger(ctx).Println("Failed to read cached user:", err)
+	}
+	if cached != nil {
+		cached.Status = activeStatus(cached.Status, statusClock.Now())
+		return *cached, nil
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	user, err := scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE user_id = $1 AND deleted_at IS NULL", userID))
+	if err != nil {
+		return user, err
+	}
+
+	err = cacheUser(ctx, user)
+	if err != nil {
+		logger(ctx).Println("Failed to cache user:", err)
+	}
+	user.Status = activeStatus(user.Status, statusClock.Now())
+	return user, nil
+}
+
+// userColumns are the columns of a user profile, in the order scanUser
+// reads them.
+const userColumns = "user_id, username, email, COALESCE(avatar_url, ''), created_at, updated_at, status_text, availability, status_expires_at"
+
+// scanUser reads a profile selected as userColumns. An expired status is
+// kept, for the profile to be cached with it.
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	var text, availability sql.NullString
+	var expires sql.NullTime
+	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.AvatarURL, &user.CreatedAt, &user.UpdatedAt, &text, &availability, &expires); err != nil {
+		return user, err
+	}
+	if availability.Valid {
+		user.Status = &UserStatus{Text: text.String, Availability: availability.String}
+		if expires.Valid {
+			at := expires.Time.UTC()
+			user.Status.ExpiresAt = &at
+		}
+	}
+	return user, nil
 }
 
 func sendMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.sendMessage")
+	defer span.End()
+
+	idemKey, handled := claimIdempotency(ctx, w, r)
+	if handled {
+		return
+	}
+	// Failed requests give the key back so that a retry is processed.
+	defer releaseIdempotency(ctx, idemKey)
+
 	var message Message
-	err := json.NewDecoder(r.Body).Decode(&message)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var files []*multipart.FileHeader
+	if isMultipart(r) {
+		var ok bool
+		if message, files, ok = readMultipartMessage(w, r); !ok {
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+	} else if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		decodeError(w, err)
+		return
+	}
+	// The sender is whoever the token belongs to, whatever the body says.
+	message.SenderID = claimsFromContext(ctx).UserID
+	// Attachments only come from the files uploaded with this request.
+	message.Kind, message.ForwardedFrom, message.Attachments = "", nil, nil
+	if len(message.Recipients) > 0 {
+		if len(files) > 0 {
+			// Each copy would need the files linked to it; send them to
+			// one recipient at a time instead.
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "attachments cannot be sent to several recipients at once")
+			return
+		}
+		sendToRecipients(ctx, w, message, idemKey)
 		return
 	}
+	span.SetAttributes(
+		attribute.Int("chat.sender_id", message.SenderID),
+		attribute.Int("chat.recipient_id", message.RecipientID),
+	)
 
-	_, err = db.Exec("INSERT INTO messages (sender_id, receiver_id, text) VALUES ($1, $2, $3)",
-		message.SenderID, message.RecipientID, message.Text)
+	if err := validateMessage(message); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, "invalid_message", err.Error())
+		return
+	}
+	later, err := sendsLater(message, len(files) > 0)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
 		return
 	}
 
-	if err := cacheRecentMessage(message); err != nil {
-		log.Println("Failed to cache recent message:", err)
+	if err := checkSender(ctx, message.SenderID); err == errSenderBanned {
+		WriteError(w, http.StatusForbidden, "banned", err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
 	}
 
+	if err := checkRecipient(ctx, message.RecipientID); err == errInvalidRecipient || err == errRecipientBanned {
+		WriteError(w, http.StatusUnprocessableEntity, recipientErrorCode(err), err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := screenContact(ctx, &message); err == errContactDeclined {
+		WriteError(w, http.StatusForbidden, "contact_declined", err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	verdict := screenMessage(ctx, message)
+	if verdict == VerdictReject {
+		WriteError(w, http.StatusUnprocessableEntity, "policy_violation", errPolicyViolation.Error())
+		return
+	}
+
+	if later {
+		scheduled, err := scheduleMessage(ctx, message, verdict == VerdictFlag)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		body, _ := json.Marshal(scheduled)
+		saveIdempotentResponse(ctx, idemKey, http.StatusAccepted, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+		return
+	}
+
+	if len(files) > 0 {
+		attachments, err := uploadAttachments(ctx, message.SenderID, files)
+		if err == errAttachmentsDisabled {
+			WriteError(w, http.StatusNotImplemented, codeNotImplemented, err.Error())
+			return
+		} else if err != nil {
+			logger(ctx).Println("Failed to upload attachments:", err)
+			WriteError(w, http.StatusBadGateway, codeBadGateway, "Failed to upload attachments")
+			return
+		}
+		message.Attachments = attachments
+	}
+
+	renderMessage(&message)
+	message, err = storeMessage(ctx, message)
+	if err == errDuplicateMessage {
+		// A retry of a send that already went through: answer with the
+		// original message instead of storing it again.
+		body, _ := json.Marshal(message)
+		saveIdempotentResponse(ctx, idemKey, http.StatusOK, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(message.Attachments) > 0 {
+		if err := linkAttachments(ctx, message.ID, message.SenderID, message.Attachments); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	storeRender(ctx, message)
+	if verdict == VerdictFlag {
+		flagMessage(ctx, message)
+	}
+	if message.Request {
+		// The message waits among the recipient's requests instead of
+		// going out.
+		openMessageRequest(ctx, message)
+		body, _ := json.Marshal(message)
+		saveIdempotentResponse(ctx, idemKey, http.StatusAccepted, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+		return
+	}
+	publishMessage(ctx, message)
+
+	body, _ := json.Marshal(message)
+	saveIdempotentResponse(ctx, idemKey, http.StatusCreated, body)
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.handleWebSocket")
+	defer span.End()
+
 	userID := mux.Vars(r)["userID"]
+	span.SetAttributes(attribute.String("chat.user_id", userID))
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	state := newStateMachine(userID, logger(ctx))
+	transition := func(to ConnectionState) {
+		if err := state.Transition(to); err != nil {
+			logger(ctx).Println(err)
+		}
+	}
+
+	claims := claimsFromContext(r.Context())
+	if claims == nil || strconv.Itoa(claims.UserID) != userID {
+		transition(StateClosed)
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	lastID, resume, err := parseResumeParam(r.URL.Query().Get("last_message_id"))
 	if err != nil {
-		log.Println(err)
+		transition(StateClosed)
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid last_message_id")
+		return
+	}
+	transition(StateAuthenticated)
+
+	// The upgrade writes its own response headers.
+	conn, err := upgrader.Upgrade(w, r, http.Header{requestIDHeader: {requestIDFromContext(ctx)}})
+	if err != nil {
+		logger(ctx).Println(err)
+		transition(StateClosed)
 		return
 	}
 	defer conn.Close()
+	conn.SetReadLimit(maxFrameBytes())
+	conn.SetCompressionLevel(compressionLevel())
+
+	announcements, err := pendingAnnouncements(ctx)
+	if err != nil {
+		logger(ctx).Println("Failed to look up announcements:", err)
+	}
+
+	codec := codecFor(conn.Subprotocol())
+	// A resuming client's live messages are held back while the backlog is
+	// written, then follow it once resume_complete is out.
+	c := registry.RegisterSession(userID, claims.ID, newWSTransport(conn), resume)
+	c.logger = logger(ctx)
+	if resume {
+		resumeClient(ctx, c, claims.UserID, lastID)
+	}
+	go c.writePump()
+	watchUserRooms(ctx, userID)
 
-	lock.Lock()
-	clients[userID] = conn
-	lock.Unlock()
+	if err := deliverInbox(ctx, c); err != nil {
+		logger(ctx).Println("Failed to deliver queued events:", err)
+	}
+	if err := deliverAnnouncements(ctx, c, announcements); err != nil {
+		logger(ctx).Println("Failed to deliver announcements:", err)
+	}
+	transition(StateActive)
 
-	for {
+	for state.State() == StateActive {
 		var msg Message
-		err := conn.ReadJSON(&msg)
+		err := readFrame(conn, codec, &msg)
 		if err != nil {
-			log.Printf("error reading JSON message: %v", err)
-			break
+			logger(ctx).Printf("error reading JSON message: %v", err)
+			transition(StateClosing)
+			continue
+		}
+		recordLastSeen(ctx, claims.UserID, time.Now())
+		// Frames are sent as the socket's user, whatever sender_id says.
+		// Only the server posts system messages and forwards.
+		msg.SenderID = claims.UserID
+		msg.Kind, msg.ForwardedFrom, msg.Attachments = "", nil, nil
+
+		if err := validateMessage(msg); err != nil {
+			c.enqueue(newErrorEvent("invalid_message", err))
+			continue
 		}
 
-		if err := cacheRecentMessage(msg); err != nil {
-			log.Println("Failed to cache recent message:", err)
+		if err := checkSender(ctx, claims.UserID); err == errSenderBanned {
+			c.enqueue(newErrorEvent("banned", err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check sender:", err)
 		}
 
-		recipientID := fmt.Sprintf("%d", msg.RecipientID)
-		lock.RLock()
-		recipientConn, ok := clients[recipientID]
-		lock.RUnlock()
+		verdict := screenMessage(ctx, msg)
+		if verdict == VerdictReject {
+			c.enqueue(newErrorEvent("policy_violation", errPolicyViolation))
+			continue
+		}
 
-		if ok {
-			err := recipientConn.WriteJSON(msg)
-			if err != nil {
-				log.Printf("error writing JSON message: %v", err)
-				break
+		if msg.RoomID != 0 {
+			stored, err := relayRoomMessage(ctx, msg)
+			if err == errNotRoomMember {
+				c.enqueue(newErrorEvent("not_a_member", err))
+			} else if err != nil {
+				logger(ctx).Println("Failed to relay room message:", err)
+			} else if verdict == VerdictFlag {
+				flagMessage(ctx, stored)
 			}
-		} else {
-			log.Printf("recipient client not found: %s", recipientID)
+			continue
 		}
-	}
 
-	lock.Lock()
-	delete(clients, userID)
-	lock.Unlock()
-}
+		// If the check itself fails, relay anyway: the message is no worse
+		// off than it would have been before recipients were checked.
+		if err := checkRecipient(ctx, msg.RecipientID); recipientErrorCode(err) != "" {
+			c.enqueue(newErrorEvent(recipientErrorCode(err), err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check recipient:", err)
+		}
+		if err := screenContact(ctx, &msg); err == errContactDeclined {
+			c.enqueue(newErrorEvent("contact_declined", err))
+			continue
+		} else if err != nil {
+			logger(ctx).Println("Failed to check contacts:", err)
+		}
 
-func setUserSession(userID int) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("user:%d:session", userID)
-	return redisCli.Set(ctx, key, "active", time.Hour).Err()
+		stored, err := relayMessage(ctx, msg)
+		if verdict == VerdictFlag && err == nil {
+			flagMessage(ctx, stored)
+		}
+	}
+
+	// Written before the client leaves the registry, so that nothing of the
+	// connection is left running once it is gone.
+	writeLastSeen(ctx, claims.UserID, time.Now())
+	registry.Deregister(c)
+	c.close()
+	transition(StateClosed)
 }
 
-func getUserSession(userID string) (*User, error) {
-	ctx := context.Background()
-	key := fmt.Sprintf("user:%s:session", userID)
-	_, err := redisCli.Get(ctx, key).Result()
-	if err == redis.Nil {
-		return nil, nil
+// relayMessage forwards a message received on a socket to the recipient,
+// tracing it as a child of the span carried in the frame's traceparent. It
+// returns the message as stored.
+func relayMessage(ctx context.Context, msg Message) (Message, error) {
+	ctx, span := otel.Tracer(tracerName).Start(contextWithTraceParent(ctx, msg.TraceParent), "ws.message",
+		trace.WithAttributes(
+			attribute.Int("chat.sender_id", msg.SenderID),
+			attribute.Int("chat.recipient_id", msg.RecipientID),
+		))
+	defer span.End()
+
+	renderMessage(&msg)
+	msg, err := storeMessage(ctx, msg)
+	if err == errDuplicateMessage {
+		// The recipient already got this message the first time round.
+		return msg, err
 	} else if err != nil {
-		return nil, err
+		logger(ctx).Println("Failed to store message:", err)
 	}
+	storeRender(ctx, msg)
+	return publishMessage(ctx, msg), err
+}
 
-	var user User
-	err = db.QueryRow("SELECT user_id, username, email FROM users WHERE user_id = $1", userID).Scan(&user.ID, &user.Username, &user.Email)
-	if err != nil {
-		return nil, err
+// publishMessage hands a stored message to everything that follows a send
+// and delivers it to the recipient's open connections. Offline recipients
+// pick it up from the history when they come back.
+func publishMessage(ctx context.Context, msg Message) Message {
+	if msg.Request {
+		// Nothing else hears of a message request until the recipient
+		// accepts the sender.
+		openMessageRequest(ctx, msg)
+		return msg
+	}
+	countSentMessage(ctx, msg, time.Now())
+	notifyWebhooks(msg)
+	notifyBots(msg)
+	notifyPush(msg)
+	previewLinks(msg)
+	if err := cacheRecentMessage(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to cache recent message:", err)
 	}
 
-	return &user, nil
-}
-
-func cacheRecentMessage(msg Message) error {
-	ctx := context.Background()
-	key := "recent_messages"
-	if err := redisCli.LPush(ctx, key, fmt.Sprintf("%v", msg)).Err(); err != nil {
-		return err
+	countUnread(ctx, msg, []string{strconv.Itoa(msg.RecipientID)})
+	msg.TraceParent = traceParent(ctx)
+	if err := conversationOf(msg).Broadcast(ctx, msg); err != nil {
+		logger(ctx).Printf("failed to deliver to %d: %v", msg.RecipientID, err)
+	} else {
+		messagesDelivered.Add(1)
 	}
-	return nil
+	replyAway(ctx, msg)
+	return msg
 }
@@ -5,20 +5,33 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
+func init() {
+	// The server does not start without a signing key; tests bring their
+	// own.
+	cfg.JWTSecret = "test-secret-at-least-thirty-two-bytes"
+}
+
 func TestCreateUser(t *testing.T) {
-	initDB()
-	defer db.Close()
+	setupTestContainers(t)
 
-	userData := User{
+	userData := createUserRequest{
 		Username: "vishnu",
 		Email:    "vishnu@gmail.com",
 		Password: "password",
@@ -50,9 +63,45 @@ func TestCreateUser(t *testing.T) {
 	assert.Equal(t, userData.Email, user.Email, "email mismatch")
 }
 
+func TestCreateUserDuplicate(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	name := fmt.Sprintf("dup_%d", time.Now().UnixNano())
+	available, err := usernameAvailable(context.Background(), name)
+	assert.NoError(t, err)
+	assert.True(t, available)
+	assert.Equal(t, http.StatusOK, postCreateUser(name).Code)
+	available, err = usernameAvailable(context.Background(), strings.ToUpper(name))
+	assert.NoError(t, err)
+	assert.False(t, available, "signing up should clear the cached answer")
+
+	for _, username := range []string{name, strings.ToUpper(name), " " + name + " "} {
+		rr := postCreateUser(username)
+		assert.Equal(t, http.StatusConflict, rr.Code, username)
+		assert.JSONEq(t, `{"error":{"code":"username_already_taken","message":"That username is already taken"}}`, rr.Body.String())
+	}
+
+	jsonData, _ := json.Marshal(createUserRequest{Username: name + "_2", Email: name + "@example.com", Password: "password123"})
+	rr := httptest.NewRecorder()
+	CreateUser(rr, httptest.NewRequest("POST", "/users", bytes.NewBuffer(jsonData)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.JSONEq(t, `{"error":{"code":"email_already_taken","message":"That email is already taken"}}`, rr.Body.String())
+}
+
+func TestUniqueUserColumn(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "username", uniqueUserColumn(&pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_username_key"}))
+	assert.Equal(t, "username", uniqueUserColumn(&pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_username_unique"}))
+	assert.Equal(t, "username", uniqueUserColumn(&pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_username_lower_unique"}))
+	assert.Equal(t, "email", uniqueUserColumn(fmt.Errorf("insert: %w", &pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_email_key"})))
+	assert.Equal(t, "", uniqueUserColumn(&pgconn.PgError{Code: "23503", ConstraintName: "users_username_key"}))
+	assert.Equal(t, "", uniqueUserColumn(sql.ErrConnDone))
+	assert.Equal(t, "", uniqueUserColumn(nil))
+}
+
 func TestGetUser(t *testing.T) {
-	initDB()
-	defer db.Close()
+	setupTestContainers(t)
 
 	_, err := db.Exec("INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3)", "vishnu", "vishnu@gmail.com", "password")
 	if err != nil {
@@ -81,8 +130,7 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestSendMessage(t *testing.T) {
-	initDB()
-	defer db.Close()
+	setupTestContainers(t)
 
 	message := Message{SenderID: 1, RecipientID: 2, Text: "Hello"}
 
@@ -99,14 +147,13 @@ func TestSendMessage(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
-	sendMessage(rr, req)
+	sendMessage(rr, asUser(req, message.SenderID))
 
 	assert.Equal(t, http.StatusCreated, rr.Code, "handler returned wrong status code")
 }
 
 func TestHandleWebSocket(t *testing.T) {
-	initDB()
-	defer db.Close()
+	setupTestContainers(t)
 
 	req := httptest.NewRequest("GET", "/ws/1", nil)
 	w := httptest.NewRecorder()
@@ -127,11 +174,137 @@ func TestHandleWebSocket(t *testing.T) {
 	}
 }
 
-func initDB() {
-	dbinfo := "user=postgres password=postgres dbname=chatdb sslmode=disable"
-	db, _ = sql.Open("postgres", dbinfo)
-	err := db.Ping()
+// initFakeDB points db at a connector that accepts connections but fails
+// every statement, for tests that run handlers without Postgres.
+func initFakeDB(t *testing.T) {
+	healthy := &atomic.Bool{}
+	healthy.Store(true)
+	db = sql.OpenDB(fakeConnector{healthy: healthy})
+	t.Cleanup(func() { db.Close() })
+}
+
+func initRedis(t testing.TB) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	// Tests reach into miniredis with the bare keys.
+	redisCli = NewRedisClient(&redis.Options{Addr: mr.Addr()}, "")
+	return mr
+}
+
+func insertTestUser(t testing.TB, passwordHash string) int {
+	name := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	var id int
+	err := db.QueryRow("INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING user_id",
+		name, name+"@example.com", passwordHash).Scan(&id)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newTestServer serves handler for the test. When the test ends it waits
+// for the requests still running: httptest's Close does not wait for the
+// hijacked ones, and WebSocket handlers would otherwise go on into the next
+// test with its Redis and database.
+func newTestServer(t testing.TB, handler http.Handler) *httptest.Server {
+	var running sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running.Add(1)
+		defer running.Done()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		running.Wait()
+	})
+	return server
+}
+
+func dialTestUser(t *testing.T, server *httptest.Server, userID int) *websocket.Conn {
+	return dialTestUserWith(t, websocket.DefaultDialer, server, userID)
+}
+
+func dialTestUserWith(t *testing.T, dialer *websocket.Dialer, server *httptest.Server, userID int) *websocket.Conn {
+	token, err := createSession(context.Background(), userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + strconv.Itoa(userID) + "?token=" + token
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitForClients(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if registry.Count() == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d connected clients", n)
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// fakeClock is a Clock whose time only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// waitForTimers blocks until n timers are pending, so Advance is not called
+// before the code under test starts waiting.
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
 	}
+	t.Fatalf("expected %d pending timers", n)
 }
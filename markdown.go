@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	formatPlain    = "plain"
+	formatMarkdown = "markdown"
+)
+
+var (
+	// markdown renders the subset clients may use: CommonMark with
+	// strikethrough and bare links. Raw HTML in the source is dropped.
+	markdown = goldmark.New(goldmark.WithExtensions(extension.Strikethrough, extension.Linkify))
+
+	// htmlPolicy cleans what markdown rendered once more, so that nothing
+	// a renderer bug lets through can run script in a client.
+	htmlPolicy = bluemonday.UGCPolicy()
+)
+
+// renderMarkdown turns Markdown text into sanitized HTML.
+func renderMarkdown(text string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(text), &buf); err != nil {
+		return "", err
+	}
+	return htmlPolicy.Sanitize(buf.String()), nil
+}
+
+// renderMessage sets the RenderedHTML of a Markdown message. Encrypted
+// messages are left to their clients to render.
+func renderMessage(msg *Message) {
+	if msg.Format != formatMarkdown || msg.Encrypted {
+		return
+	}
+	html, err := renderMarkdown(msg.Text)
+	if err != nil {
+		log.Println("Failed to render message:", err)
+		return
+	}
+	msg.RenderedHTML = html
+}
+
+// storeRender saves the rendered HTML of a stored message so that reading
+// it back does not render it again.
+func storeRender(ctx context.Context, msg Message) {
+	if msg.RenderedHTML == "" || msg.ID == 0 {
+		return
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO message_renders (message_id, format, html) VALUES ($1, $2, $3)
+		ON CONFLICT (message_id, format) DO UPDATE SET html = EXCLUDED.html`,
+		msg.ID, msg.Format, msg.RenderedHTML)
+	if err != nil {
+		logger(ctx).Println("Failed to store rendered message:", err)
+	}
+}
+
+// loadRenders fills in the format and rendered HTML of messages. Messages
+// without a render are plain text.
+func loadRenders(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	byID := make(map[int]*Message, len(messages))
+	for i := range messages {
+		ids[i] = int64(messages[i].ID)
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT message_id, format, html FROM message_renders WHERE message_id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int
+		var format, html string
+		if err := rows.Scan(&messageID, &format, &html); err != nil {
+			return err
+		}
+		if msg := byID[messageID]; msg != nil {
+			msg.Format, msg.RenderedHTML = format, html
+		}
+	}
+	return rows.Err()
+}
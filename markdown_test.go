@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	t.Parallel()
+	html, err := renderMarkdown("**bold**, _em_, ~~gone~~ and `code`\n\nsee https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, html, "<strong>bold</strong>")
+	assert.Contains(t, html, "<em>em</em>")
+	assert.Contains(t, html, "<del>gone</del>")
+	assert.Contains(t, html, "<code>code</code>")
+	assert.Contains(t, html, `<a href="https://example.com" rel="nofollow">https://example.com</a>`)
+}
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	t.Parallel()
+	for _, text := range []string{
+		"<script>alert(1)</script>",
+		"hi <img src=x onerror=alert(1)>",
+		"[click](javascript:alert(1))",
+		"[click](JaVaScRiPt:alert(1))",
+		"![img](javascript:alert(1))",
+		"<a href=\"javascript:alert(1)\">x</a>",
+		"<iframe src=\"https://evil.example\"></iframe>",
+		"[x](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)",
+		"<div style=\"background:url(javascript:alert(1))\">x</div>",
+	} {
+		html, err := renderMarkdown(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lower := strings.ToLower(html)
+		for _, bad := range []string{"<script", "onerror", "javascript:", "<iframe", "data:text/html", "style="} {
+			assert.NotContains(t, lower, bad, "%q rendered as %q", text, html)
+		}
+	}
+}
+
+func TestSendMarkdownMessage(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1, 2)
+
+	rr := postMessage(Message{SenderID: 1, RecipientID: 2, Text: "*hi* <script>x</script>", Format: formatMarkdown})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var msg Message
+	if err := json.NewDecoder(rr.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "*hi* <script>x</script>", msg.Text, "the source is kept as sent")
+	assert.Contains(t, msg.RenderedHTML, "<em>hi</em>")
+	assert.NotContains(t, msg.RenderedHTML, "<script")
+
+	rr = postMessage(Message{SenderID: 1, RecipientID: 2, Text: "*hi*"})
+	var plain Message
+	json.NewDecoder(rr.Body).Decode(&plain)
+	assert.Empty(t, plain.RenderedHTML, "plain text is not rendered")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi", Format: "html"}).Code)
+}
+
+func TestWebSocketDeliversRenderedHTML(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 911, 912)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 911)
+	receiver := dialTestUser(t, server, 912)
+	waitForClients(t, 2)
+
+	if err := sender.WriteJSON(Message{SenderID: 911, RecipientID: 912, Text: "# Title", Format: formatMarkdown}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := receiver.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, formatMarkdown, msg.Format)
+	assert.Equal(t, "<h1>Title</h1>\n", msg.RenderedHTML)
+}
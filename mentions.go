@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+// maxMentionsPerMessage bounds how many names of one message are looked up.
+const maxMentionsPerMessage = 20
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_.\-]+)`)
+
+// Mention is a room message that mentioned the user, as listed by
+// GET /mentions.
+type Mention struct {
+	ID        int        `json:"id"`
+	RoomID    int        `json:"room_id"`
+	SenderID  int        `json:"sender_id"`
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MentionEvent tells a member that a room message mentioned them. It is
+// sent even when they muted the room, but not while they are not to be
+// disturbed.
+type MentionEvent struct {
+	Type string `json:"type"`
+	Mention
+}
+
+// parseMentions returns the distinct names mentioned as @name in text, in
+// the order they first appear. Names differing only in case are the same.
+func parseMentions(text string) []string {
+	if !strings.Contains(text, "@") {
+		return nil
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// Punctuation ending a sentence is not part of the name.
+		name := strings.TrimRight(match[1], ".-")
+		if name == "" || seen[usernameFold(name)] {
+			continue
+		}
+		seen[usernameFold(name)] = true
+		names = append(names, name)
+		if len(names) == maxMentionsPerMessage {
+			break
+		}
+	}
+	return names
+}
+
+// recordMentions stores a mention for every member of the room named in the
+// message and sends a MentionEvent to those not in do-not-disturb. Names of users outside the
+// room are ignored, as is the sender mentioning themselves. It returns the
+// IDs of the users mentioned.
+func recordMentions(ctx context.Context, msg Message, members []string) ([]int, error) {
+	names := parseMentions(msg.Text)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	for i, name := range names {
+		names[i] = usernameFold(name)
+	}
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.Atoi(member)
+		if err == nil && id != msg.SenderID {
+			ids = append(ids, int64(id))
+		}
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`INSERT INTO message_mentions (room_id, sender_id, user_id, text, expires_at)
+		SELECT $1, $2, user_id, $3, $4 FROM users
+		WHERE lower(username) = ANY($5) AND user_id = ANY($6) AND deleted_at IS NULL
+		RETURNING mention_id, user_id, created_at`,
+		msg.RoomID, msg.SenderID, msg.Text, msg.ExpiresAt, names, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentioned []int
+	var userIDs []string
+	var mentions []Mention
+	for rows.Next() {
+		var userID int
+		mention := Mention{RoomID: msg.RoomID, SenderID: msg.SenderID, Text: msg.Text, ExpiresAt: msg.ExpiresAt}
+		if err := rows.Scan(&mention.ID, &userID, &mention.CreatedAt); err != nil {
+			return mentioned, err
+		}
+		mentioned = append(mentioned, userID)
+		userIDs = append(userIDs, strconv.Itoa(userID))
+		mentions = append(mentions, mention)
+	}
+	if err := rows.Err(); err != nil {
+		return mentioned, err
+	}
+
+	dnd := usersInDND(ctx, userIDs)
+	for i, id := range userIDs {
+		if !dnd[id] {
+			registry.Send(id, MentionEvent{Type: "mention", Mention: mentions[i]})
+		}
+	}
+	return mentioned, nil
+}
+
+// listMentions returns a page of the mentions of the caller in the rooms
+// they still belong to, newest first.
+func listMentions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listMentions")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultHistoryLimit, maxHistoryLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT mm.mention_id, mm.room_id, mm.sender_id, mm.text, mm.expires_at, mm.created_at FROM message_mentions mm
+		JOIN room_members m ON m.room_id = mm.room_id AND m.user_id = mm.user_id
+		WHERE mm.user_id = $1
+		AND (mm.expires_at IS NULL OR mm.expires_at > NOW())
+		AND ($3::int IS NULL OR (mm.created_at, mm.mention_id) < (SELECT created_at, mention_id FROM message_mentions WHERE mention_id = $3))
+		ORDER BY mm.created_at DESC, mm.mention_id DESC
+		LIMIT $2`, claims.UserID, limit+1, cursor)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	mentions := []Mention{}
+	for rows.Next() {
+		var mention Mention
+		if err := rows.Scan(&mention.ID, &mention.RoomID, &mention.SenderID, &mention.Text, &mention.ExpiresAt, &mention.CreatedAt); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		mentions = append(mentions, mention)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, "mentions:"+strconv.Itoa(claims.UserID),
+		`SELECT COUNT(*) FROM message_mentions mm
+		JOIN room_members m ON m.room_id = mm.room_id AND m.user_id = mm.user_id
+		WHERE mm.user_id = $1
+		AND (mm.expires_at IS NULL OR mm.expires_at > NOW())`, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(mentions, limit, total, func(mention Mention) int { return mention.ID }))
+}
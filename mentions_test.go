@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// mentionStore stores room messages, resolves mentions against a fixed set
+// of usernames and keeps the IDs of the users mentioned. Every other query
+// fails.
+type mentionStore struct {
+	users map[string]int64
+
+	mu        sync.Mutex
+	nextID    int64
+	mentioned []int64
+}
+
+func (s *mentionStore) Connect(context.Context) (driver.Conn, error) {
+	return mentionConn{store: s}, nil
+}
+
+func (s *mentionStore) Driver() driver.Driver { return nil }
+
+type mentionConn struct {
+	fakeConn
+	store *mentionStore
+}
+
+func (c mentionConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "INSERT INTO room_messages") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.nextID++
+		return &insertedRows{id: c.store.nextID}, nil
+	}
+	if !strings.HasPrefix(query, "INSERT INTO message_mentions") {
+		return nil, errors.New("not supported")
+	}
+	members := make(map[int64]bool)
+	for _, id := range args[5].Value.([]int64) {
+		members[id] = true
+	}
+	rows := &mentionRows{}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	for _, name := range args[4].Value.([]string) {
+		if id, ok := c.store.users[name]; ok && members[id] {
+			c.store.mentioned = append(c.store.mentioned, id)
+			rows.userIDs = append(rows.userIDs, id)
+		}
+	}
+	return rows, nil
+}
+
+func (mentionConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+type mentionRows struct {
+	userIDs []int64
+}
+
+func (r *mentionRows) Columns() []string { return []string{"mention_id", "user_id", "created_at"} }
+func (r *mentionRows) Close() error      { return nil }
+
+func (r *mentionRows) Next(dest []driver.Value) error {
+	if len(r.userIDs) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1], dest[2] = r.userIDs[0], r.userIDs[0], insertedAt
+	r.userIDs = r.userIDs[1:]
+	return nil
+}
+
+// readEventTypes reads frames until the connection has been quiet for a
+// moment and returns their types, "message" for those without one.
+func readEventTypes(t *testing.T, conn *websocket.Conn) []string {
+	var types []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		var frame map[string]interface{}
+		if err := conn.ReadJSON(&frame); err != nil {
+			sort.Strings(types)
+			return types
+		}
+		if kind, ok := frame["type"].(string); ok {
+			types = append(types, kind)
+		} else {
+			types = append(types, "message")
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{"bob", "carol", "dave.smith"},
+		parseMentions("@bob, @carol. mail bob@example.com or @bob and @dave.smith."))
+	assert.Equal(t, []string{"Bob"}, parseMentions("@Bob and @bob are the same"))
+	assert.Nil(t, parseMentions("no mentions here"))
+}
+
+func TestRoomMentionsNotifyMembers(t *testing.T) {
+	mr := initRedis(t)
+	store := &mentionStore{users: map[string]int64{"bob": 822, "carol": 823, "dave": 824, "eve": 825}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	mr.SAdd(roomMembersKey(14), "821", "822", "823", "824")
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 821)
+	bob := dialTestUser(t, server, 822)
+	carol := dialTestUser(t, server, 823)
+	dave := dialTestUser(t, server, 824)
+	eve := dialTestUser(t, server, 825)
+	waitForClients(t, 5)
+
+	if err := sender.WriteJSON(Message{SenderID: 821, RoomID: 14, Text: "@bob @Carol meet @eve, @BOB."}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"mention", "message"}, readEventTypes(t, bob), "bob is mentioned once however often he is named")
+	assert.Equal(t, []string{"mention", "message"}, readEventTypes(t, carol))
+	assert.Equal(t, []string{"message"}, readEventTypes(t, dave))
+	assert.Empty(t, readEventTypes(t, eve), "mentions of non-members are ignored")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.ElementsMatch(t, []int64{822, 823}, store.mentioned)
+}
+
+func TestMentionsInMutedRoom(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	owner := insertTestUser(t, "hash")
+	member := insertTestUser(t, "hash")
+	outsider := insertTestUser(t, "hash")
+	serve := func(userID int, method, path string, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, body))
+		return rr
+	}
+
+	rr := serve(owner, "POST", "/rooms", createRoomRequest{Name: "mentions", MemberIDs: []int{member}})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var room Room
+	if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	key := conversationKey(Message{RoomID: room.ID})
+	assert.Equal(t, http.StatusOK, serve(member, "POST", "/conversations/"+key+"/mute", muteRequest{}).Code)
+
+	var memberName, outsiderName string
+	db.QueryRow("SELECT username FROM users WHERE user_id = $1", member).Scan(&memberName)
+	db.QueryRow("SELECT username FROM users WHERE user_id = $1", outsider).Scan(&outsiderName)
+	text := "@" + memberName + " and @" + outsiderName
+	if _, err := relayRoomMessage(ctx, Message{SenderID: owner, RoomID: room.ID, Text: text}); err != nil {
+		t.Fatal(err)
+	}
+
+	var page Page[Mention]
+	json.NewDecoder(serve(member, "GET", "/mentions", nil).Body).Decode(&page)
+	if assert.Len(t, page.Items, 1, "a muted room still records mentions") {
+		assert.Equal(t, room.ID, page.Items[0].RoomID)
+		assert.Equal(t, owner, page.Items[0].SenderID)
+		assert.Equal(t, text, page.Items[0].Text)
+	}
+	assert.EqualValues(t, 1, page.Total)
+	assert.False(t, page.HasNext)
+	page = Page[Mention]{}
+	json.NewDecoder(serve(outsider, "GET", "/mentions", nil).Body).Decode(&page)
+	assert.Empty(t, page.Items)
+}
+
+func TestMentionAlertsWaitOutDND(t *testing.T) {
+	initRedis(t)
+	store := &mentionStore{users: map[string]int64{"bob": 832, "carol": 833}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	cacheNotificationSettings(t, "832", NotificationSettings{DND: true})
+	cacheNotificationSettings(t, "833", NotificationSettings{})
+	bob, _ := connectRecorder(t, "832")
+	carol, _ := connectRecorder(t, "833")
+
+	mentioned, err := recordMentions(context.Background(), Message{SenderID: 831, RoomID: 15, Text: "@bob @carol"}, []string{"831", "832", "833"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int{832, 833}, mentioned, "the mention is recorded all the same")
+
+	mentionEvents := func(rec *recordingTransport) int {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		n := 0
+		for _, v := range rec.written {
+			if _, ok := v.(MentionEvent); ok {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Eventually(t, func() bool { return mentionEvents(carol) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Zero(t, mentionEvents(bob))
+}
@@ -0,0 +1,23 @@
+-- Sampled messages are rolled up by hour and a few coarse traits, never by
+-- their text. A row can hold a single message, whose exact length would
+-- then be on record, so only the length bucket is kept.
+CREATE TABLE message_analytics (
+    day DATE NOT NULL,
+    hour_of_day SMALLINT NOT NULL,
+    length_bucket VARCHAR(20) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    conversation_type VARCHAR(20) NOT NULL,
+    has_attachment BOOLEAN NOT NULL,
+    has_emoji BOOLEAN NOT NULL,
+    sender_hash VARCHAR(64) NOT NULL,
+    messages INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, hour_of_day, length_bucket, kind, conversation_type, has_attachment, has_emoji, sender_hash)
+);
+
+-- Attachments are counted by type apart from the messages that carry them.
+CREATE TABLE attachment_analytics (
+    day DATE NOT NULL,
+    attachment_type VARCHAR(20) NOT NULL,
+    attachments INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, attachment_type)
+);
@@ -0,0 +1,30 @@
+UPDATE users SET created_at = NOW() WHERE created_at IS NULL;
+
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+    ALTER COLUMN created_at SET DEFAULT NOW(),
+    ALTER COLUMN created_at SET NOT NULL,
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+ALTER TABLE messages
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN deleted_at TIMESTAMPTZ;
+
+UPDATE messages SET created_at = sent_at, updated_at = sent_at WHERE sent_at IS NOT NULL;
+
+CREATE INDEX messages_sender_created_at_idx ON messages (sender_id, created_at DESC);
+CREATE INDEX messages_receiver_created_at_idx ON messages (receiver_id, created_at DESC);
+
+CREATE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TRIGGER messages_set_updated_at BEFORE UPDATE ON messages
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN client_msg_id UUID;
+
+CREATE UNIQUE INDEX messages_sender_client_msg_id_idx ON messages (sender_id, client_msg_id)
+    WHERE client_msg_id IS NOT NULL;
@@ -0,0 +1,48 @@
+-- Messages are numbered per conversation, the unordered pair of users, so
+-- clients can order them however they arrived and sync from a known point.
+CREATE TABLE conversation_sequences (
+    user_a INT NOT NULL,
+    user_b INT NOT NULL,
+    last_seq BIGINT NOT NULL,
+    PRIMARY KEY (user_a, user_b)
+);
+
+ALTER TABLE messages ADD COLUMN seq BIGINT;
+
+ALTER TABLE messages DISABLE TRIGGER messages_set_updated_at;
+UPDATE messages m SET seq = numbered.seq
+FROM (
+    SELECT message_id, ROW_NUMBER() OVER (
+        PARTITION BY LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id)
+        ORDER BY created_at, message_id
+    ) AS seq
+    FROM messages
+) numbered
+WHERE m.message_id = numbered.message_id;
+ALTER TABLE messages ENABLE TRIGGER messages_set_updated_at;
+
+INSERT INTO conversation_sequences (user_a, user_b, last_seq)
+SELECT LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id), MAX(seq)
+FROM messages
+GROUP BY 1, 2;
+
+ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+
+CREATE UNIQUE INDEX messages_conversation_seq_idx
+    ON messages (LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id), seq);
+
+-- The counter row is locked until the inserting transaction ends, so
+-- concurrent writers to one conversation queue up behind each other, and a
+-- rolled back insert gives its number back.
+CREATE FUNCTION assign_conversation_seq() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO conversation_sequences (user_a, user_b, last_seq)
+    VALUES (LEAST(NEW.sender_id, NEW.receiver_id), GREATEST(NEW.sender_id, NEW.receiver_id), 1)
+    ON CONFLICT (user_a, user_b) DO UPDATE SET last_seq = conversation_sequences.last_seq + 1
+    RETURNING last_seq INTO NEW.seq;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_assign_seq BEFORE INSERT ON messages
+    FOR EACH ROW EXECUTE FUNCTION assign_conversation_seq();
@@ -0,0 +1,15 @@
+CREATE TABLE rooms (
+    room_id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_by INT NOT NULL REFERENCES users(user_id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE room_members (
+    room_id INT NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(user_id),
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (room_id, user_id)
+);
+
+CREATE INDEX room_members_user_id_idx ON room_members (user_id);
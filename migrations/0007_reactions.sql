@@ -0,0 +1,7 @@
+CREATE TABLE reactions (
+    message_id INT NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(user_id),
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
@@ -0,0 +1 @@
+ALTER TABLE attachments ADD COLUMN thumbnail_url TEXT;
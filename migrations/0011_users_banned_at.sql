@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN banned_at TIMESTAMPTZ;
@@ -0,0 +1,13 @@
+CREATE TABLE message_reports (
+    report_id SERIAL PRIMARY KEY,
+    message_id INT NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    reporter_id INT NOT NULL REFERENCES users(user_id),
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ,
+    resolved_by INT REFERENCES users(user_id),
+    resolution TEXT,
+    UNIQUE (message_id, reporter_id)
+);
+
+CREATE INDEX message_reports_open_idx ON message_reports (created_at) WHERE resolved_at IS NULL;
@@ -0,0 +1,22 @@
+CREATE TABLE bots (
+    bot_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE REFERENCES users(user_id) ON DELETE CASCADE,
+    callback_url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE bot_invocations (
+    invocation_id BIGSERIAL PRIMARY KEY,
+    bot_id INT NOT NULL REFERENCES bots(bot_id) ON DELETE CASCADE,
+    message_id INT NOT NULL,
+    attempts INT NOT NULL,
+    status_code INT,
+    error TEXT,
+    reply_message_id INT,
+    duration_ms BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX bot_invocations_bot_idx ON bot_invocations (bot_id, created_at);
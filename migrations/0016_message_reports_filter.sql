@@ -0,0 +1,2 @@
+-- Reports filed by the message filter have no reporter.
+ALTER TABLE message_reports ALTER COLUMN reporter_id DROP NOT NULL;
@@ -0,0 +1,10 @@
+CREATE TYPE message_format AS ENUM ('plain', 'markdown');
+
+-- Rendered forms of messages, so that reads do not render them again. A
+-- message without a row is plain text.
+CREATE TABLE message_renders (
+    message_id INT NOT NULL REFERENCES messages(message_id) ON DELETE CASCADE,
+    format message_format NOT NULL,
+    html TEXT NOT NULL,
+    PRIMARY KEY (message_id, format)
+);
@@ -0,0 +1,25 @@
+CREATE TYPE scheduled_status AS ENUM ('scheduled', 'sending', 'sent', 'cancelled');
+
+-- Messages waiting for their send_at. The client_msg_id is the one the
+-- message is stored under when it goes out, so that promoting a row twice
+-- stores and delivers it once.
+CREATE TABLE scheduled_messages (
+    scheduled_id SERIAL PRIMARY KEY,
+    sender_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    receiver_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    text TEXT NOT NULL,
+    format message_format NOT NULL DEFAULT 'plain',
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+    client_msg_id UUID NOT NULL,
+    flagged BOOLEAN NOT NULL DEFAULT FALSE,
+    send_at TIMESTAMPTZ NOT NULL,
+    status scheduled_status NOT NULL DEFAULT 'scheduled',
+    message_id INT REFERENCES messages(message_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (sender_id, client_msg_id)
+);
+
+CREATE INDEX scheduled_messages_due_idx ON scheduled_messages (send_at)
+    WHERE status IN ('scheduled', 'sending');
+CREATE INDEX scheduled_messages_sender_idx ON scheduled_messages (sender_id, send_at)
+    WHERE status = 'scheduled';
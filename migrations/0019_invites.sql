@@ -0,0 +1,11 @@
+CREATE TABLE invites (
+    token TEXT PRIMARY KEY,
+    room_id INT NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+    created_by INT NOT NULL REFERENCES users(user_id),
+    max_uses INT NOT NULL CHECK (max_uses > 0),
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX invites_room_id_idx ON invites (room_id);
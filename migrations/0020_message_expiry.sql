@@ -0,0 +1,6 @@
+ALTER TABLE messages ADD COLUMN expires_at TIMESTAMPTZ;
+
+CREATE INDEX messages_expires_at_idx ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+-- A scheduled message's expiry counts from when it is sent.
+ALTER TABLE scheduled_messages ADD COLUMN ttl_seconds INT NOT NULL DEFAULT 0;
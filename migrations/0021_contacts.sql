@@ -0,0 +1,19 @@
+CREATE TYPE contact_status AS ENUM ('pending', 'accepted', 'declined');
+
+CREATE TABLE contacts (
+    requester_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    addressee_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    status contact_status NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMPTZ,
+    PRIMARY KEY (requester_id, addressee_id),
+    CHECK (requester_id <> addressee_id)
+);
+
+CREATE INDEX contacts_addressee_idx ON contacts (addressee_id, status);
+
+-- Messages from someone who is not yet a contact of the recipient wait
+-- here until the recipient accepts them.
+ALTER TABLE messages ADD COLUMN request BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX messages_requests_idx ON messages (receiver_id, sender_id) WHERE request;
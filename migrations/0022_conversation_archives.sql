@@ -0,0 +1,6 @@
+CREATE TABLE conversation_archives (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    conversation_key TEXT NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, conversation_key)
+);
@@ -0,0 +1,12 @@
+-- Room messages are not stored, so a mention keeps its own copy of the text.
+CREATE TABLE message_mentions (
+    mention_id SERIAL PRIMARY KEY,
+    room_id INT NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+    sender_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    text TEXT NOT NULL,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX message_mentions_user_idx ON message_mentions (user_id, created_at DESC);
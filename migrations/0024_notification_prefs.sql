@@ -0,0 +1,9 @@
+-- A row mutes notifications from the conversation for the user, until
+-- muted_until or, when it is NULL, until the user unmutes it.
+CREATE TABLE notification_prefs (
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    conversation_key TEXT NOT NULL,
+    muted_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, conversation_key)
+);
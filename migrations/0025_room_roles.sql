@@ -0,0 +1,15 @@
+-- Declared from the highest role down, so that ORDER BY role ranks them.
+CREATE TYPE room_role AS ENUM ('owner', 'admin', 'member');
+
+ALTER TABLE room_members ADD COLUMN role room_role NOT NULL DEFAULT 'member';
+
+-- Each room is owned by its creator or, if they left, its longest member.
+UPDATE room_members m SET role = 'owner'
+FROM (
+    SELECT DISTINCT ON (m.room_id) m.room_id, m.user_id
+    FROM room_members m JOIN rooms r ON r.room_id = m.room_id
+    ORDER BY m.room_id, m.user_id = r.created_by DESC, m.joined_at
+) o
+WHERE m.room_id = o.room_id AND m.user_id = o.user_id;
+
+CREATE UNIQUE INDEX room_members_owner_idx ON room_members (room_id) WHERE role = 'owner';
@@ -0,0 +1 @@
+ALTER TABLE invites ADD COLUMN revoked_at TIMESTAMPTZ;
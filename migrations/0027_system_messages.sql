@@ -0,0 +1,17 @@
+CREATE TYPE message_kind AS ENUM ('text', 'system');
+
+-- Room messages users send live in Redis only. The system messages telling
+-- who joined, left or changed the room are kept here, so that its history
+-- outlasts the recent list.
+CREATE TABLE room_messages (
+    message_id SERIAL PRIMARY KEY,
+    room_id INT NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+    kind message_kind NOT NULL,
+    sender_id INT NOT NULL REFERENCES users(user_id),
+    -- user_id is the member the message is about, if any.
+    user_id INT REFERENCES users(user_id),
+    text TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX room_messages_room_id_idx ON room_messages (room_id, created_at DESC);
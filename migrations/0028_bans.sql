@@ -0,0 +1,13 @@
+-- users.banned_at says whether an account is banned; bans keeps who banned
+-- it, why and until when. A ban without expires_at lasts until lifted.
+CREATE TABLE bans (
+    ban_id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id),
+    banned_by INT REFERENCES users(user_id),
+    reason TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX bans_user_id_idx ON bans (user_id);
+CREATE INDEX bans_expires_at_idx ON bans (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,16 @@
+-- A pin holds either a direct message or a stored room message, so that
+-- deleting the message unpins it.
+CREATE TABLE pins (
+    pin_id SERIAL PRIMARY KEY,
+    conversation_key TEXT NOT NULL,
+    message_id INT REFERENCES messages(message_id) ON DELETE CASCADE,
+    room_message_id INT REFERENCES room_messages(message_id) ON DELETE CASCADE,
+    pinned_by INT REFERENCES users(user_id),
+    position INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK ((message_id IS NULL) <> (room_message_id IS NULL)),
+    UNIQUE (conversation_key, message_id),
+    UNIQUE (conversation_key, room_message_id)
+);
+
+CREATE INDEX pins_conversation_key_idx ON pins (conversation_key, position);
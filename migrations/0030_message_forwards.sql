@@ -0,0 +1,7 @@
+-- Forwarded messages name the message they copy and its sender. A forward
+-- of a forward names the original, which may since have been deleted.
+CREATE TABLE message_forwards (
+    message_id INT PRIMARY KEY REFERENCES messages(message_id) ON DELETE CASCADE,
+    original_message_id INT NOT NULL,
+    original_sender_id INT NOT NULL REFERENCES users(user_id)
+);
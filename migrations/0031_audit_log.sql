@@ -0,0 +1,11 @@
+-- audit_log is appended to and never updated. actor_id has no foreign key so
+-- that entries outlive the accounts they name.
+CREATE TABLE audit_log (
+    audit_id BIGSERIAL PRIMARY KEY,
+    actor_id INT,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_actor_id_idx ON audit_log (actor_id, created_at);
@@ -0,0 +1,30 @@
+CREATE TYPE account_export_status AS ENUM ('pending', 'running', 'done', 'failed');
+
+-- Account exports a user asked for. The worker writes each part of the
+-- archive to account_export_parts as it goes, bumping progress, so that a
+-- job picked up again after a restart carries on from the last part
+-- written. Once every part is in, they are zipped into archive.
+CREATE TABLE account_exports (
+    export_id UUID PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    status account_export_status NOT NULL DEFAULT 'pending',
+    progress INT NOT NULL DEFAULT 0,
+    archive BYTEA,
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+-- A user has at most one export in progress.
+CREATE UNIQUE INDEX account_exports_active_idx ON account_exports (user_id)
+    WHERE status IN ('pending', 'running');
+CREATE INDEX account_exports_queue_idx ON account_exports (created_at)
+    WHERE status IN ('pending', 'running');
+
+CREATE TABLE account_export_parts (
+    export_id UUID NOT NULL REFERENCES account_exports(export_id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    data BYTEA NOT NULL,
+    PRIMARY KEY (export_id, name)
+);
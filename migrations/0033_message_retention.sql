@@ -0,0 +1,4 @@
+-- Messages under legal hold are kept past the retention period.
+ALTER TABLE messages ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX messages_created_at_idx ON messages (created_at);
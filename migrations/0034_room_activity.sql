@@ -0,0 +1,9 @@
+-- last_activity_at moves with every room message, which last_message_text
+-- and last_message_at keep for room listings.
+ALTER TABLE rooms ADD COLUMN last_activity_at TIMESTAMPTZ;
+UPDATE rooms SET last_activity_at = created_at;
+ALTER TABLE rooms ALTER COLUMN last_activity_at SET NOT NULL;
+ALTER TABLE rooms ALTER COLUMN last_activity_at SET DEFAULT NOW();
+
+ALTER TABLE rooms ADD COLUMN last_message_text TEXT;
+ALTER TABLE rooms ADD COLUMN last_message_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,8 @@
+-- Users who log in with Google. Their password_hash is empty, which no
+-- password matches.
+ALTER TABLE users
+    ADD COLUMN oauth_provider TEXT,
+    ADD COLUMN oauth_sub TEXT,
+    ADD CONSTRAINT users_oauth_identity_complete CHECK ((oauth_provider IS NULL) = (oauth_sub IS NULL));
+
+CREATE UNIQUE INDEX users_oauth_identity ON users (oauth_provider, oauth_sub) WHERE oauth_provider IS NOT NULL;
@@ -0,0 +1,19 @@
+-- database.sql.txt declares username and email UNIQUE, but databases created
+-- from older copies of it may lack the constraints. Add them where missing.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint c
+        JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+        WHERE c.conrelid = 'users'::regclass AND c.contype = 'u' AND cardinality(c.conkey) = 1 AND a.attname = 'username'
+    ) THEN
+        ALTER TABLE users ADD CONSTRAINT users_username_unique UNIQUE (username);
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint c
+        JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+        WHERE c.conrelid = 'users'::regclass AND c.contype = 'u' AND cardinality(c.conkey) = 1 AND a.attname = 'email'
+    ) THEN
+        ALTER TABLE users ADD CONSTRAINT users_email_unique UNIQUE (email);
+    END IF;
+END $$;
@@ -0,0 +1,2 @@
+-- Availability checks compare usernames ignoring case.
+CREATE INDEX users_username_lower_idx ON users (lower(username));
@@ -0,0 +1,21 @@
+-- Usernames are unique ignoring case. Accounts that already differ only in
+-- case cannot be merged automatically: list them and stop, so that an admin
+-- renames all but one of each group before the server starts.
+DO $$
+DECLARE
+    collisions TEXT;
+BEGIN
+    SELECT string_agg(names, '; ') INTO collisions FROM (
+        SELECT string_agg(username || ' (' || user_id || ')', ', ' ORDER BY user_id) AS names
+        FROM users
+        GROUP BY lower(username)
+        HAVING count(*) > 1
+    ) groups;
+    IF collisions IS NOT NULL THEN
+        RAISE EXCEPTION 'usernames differing only in case: %', collisions
+            USING HINT = 'Rename all but one user of each group, then restart to apply this migration.';
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS users_username_lower_idx;
+CREATE UNIQUE INDEX users_username_lower_unique ON users (lower(username));
@@ -0,0 +1,14 @@
+-- Devices that get push notifications through Firebase Cloud Messaging while
+-- their user is offline. A token belongs to one device, so registering it
+-- again moves it to whoever registered it last.
+CREATE TYPE device_platform AS ENUM ('ios', 'android', 'web');
+
+CREATE TABLE device_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    token TEXT NOT NULL UNIQUE,
+    platform device_platform NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX device_tokens_user_id ON device_tokens (user_id);
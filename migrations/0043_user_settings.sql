@@ -0,0 +1,13 @@
+-- Do-not-disturb settings of users. Quiet hours run daily from quiet_start to
+-- quiet_end, in minutes after midnight in timezone, and end the next day
+-- when quiet_end is before quiet_start.
+CREATE TABLE user_settings (
+    user_id INT PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    dnd BOOLEAN NOT NULL DEFAULT FALSE,
+    quiet_start SMALLINT CHECK (quiet_start BETWEEN 0 AND 1439),
+    quiet_end SMALLINT CHECK (quiet_end BETWEEN 0 AND 1439),
+    timezone TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK ((quiet_start IS NULL) = (quiet_end IS NULL) AND (quiet_start IS NULL) = (timezone IS NULL)),
+    CHECK (quiet_start <> quiet_end)
+);
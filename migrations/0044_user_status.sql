@@ -0,0 +1,10 @@
+-- What users say about themselves beyond being online. A user without an
+-- availability has no status; one whose status_expires_at passed has none
+-- either, though the row keeps it until it is next set.
+CREATE TYPE availability AS ENUM ('available', 'busy', 'away');
+
+ALTER TABLE users
+    ADD COLUMN status_text TEXT,
+    ADD COLUMN availability availability,
+    ADD COLUMN status_expires_at TIMESTAMPTZ,
+    ADD CHECK (availability IS NOT NULL OR (status_text IS NULL AND status_expires_at IS NULL));
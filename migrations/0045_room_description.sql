@@ -0,0 +1,2 @@
+-- What a room is about, set by its admins after creating it.
+ALTER TABLE rooms ADD COLUMN description VARCHAR(500) NOT NULL DEFAULT '';
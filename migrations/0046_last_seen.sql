@@ -0,0 +1,7 @@
+-- When users were last connected or active, and who may see it. Writes are
+-- throttled, so last_seen_at may lag by up to a minute.
+CREATE TYPE last_seen_visibility AS ENUM ('everyone', 'contacts', 'nobody');
+
+ALTER TABLE users
+    ADD COLUMN last_seen_at TIMESTAMPTZ,
+    ADD COLUMN last_seen_visibility last_seen_visibility NOT NULL DEFAULT 'everyone';
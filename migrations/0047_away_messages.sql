@@ -0,0 +1,11 @@
+-- Replies sent on a user's behalf to direct messages that arrive while they
+-- are offline, between valid_from and valid_until when those are set.
+CREATE TABLE away_messages (
+    user_id INT PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    text TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    valid_from TIMESTAMPTZ,
+    valid_until TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (valid_from IS NULL OR valid_until IS NULL OR valid_from < valid_until)
+);
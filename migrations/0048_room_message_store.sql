@@ -0,0 +1,12 @@
+-- Room messages users send are stored next to the system messages, so that
+-- they have IDs to be pinned and flagged by, and expire like direct ones.
+ALTER TABLE room_messages ADD COLUMN expires_at TIMESTAMPTZ;
+
+CREATE INDEX room_messages_expires_at_idx ON room_messages (expires_at) WHERE expires_at IS NOT NULL;
+
+-- A report is about either a direct message or a stored room message.
+ALTER TABLE message_reports
+    ALTER COLUMN message_id DROP NOT NULL,
+    ADD COLUMN room_message_id INT REFERENCES room_messages(message_id) ON DELETE CASCADE,
+    ADD CHECK ((message_id IS NULL) <> (room_message_id IS NULL)),
+    ADD UNIQUE (room_message_id, reporter_id);
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxRecipients caps the recipients of one POST /messages.
+const maxRecipients = 50
+
+// recipientLimiter counts the recipients a sender reaches through
+// multi-recipient sends, rather than the requests.
+var recipientLimiter = failureLimiter{prefix: "recipients", limit: 500, window: time.Minute}
+
+// RecipientFailure is a recipient a multi-recipient send skipped, and why.
+type RecipientFailure struct {
+	RecipientID int    `json:"recipient_id"`
+	Error       string `json:"error"`
+}
+
+// MultiSendResult answers a multi-recipient send.
+type MultiSendResult struct {
+	Sent   int                `json:"sent"`
+	Failed []RecipientFailure `json:"failed"`
+}
+
+// recipientFailure names why a recipient was skipped, or returns "" for
+// errors that fail the whole send.
+func recipientFailure(err error) string {
+	switch err {
+	case errInvalidRecipient:
+		return "not_found"
+	case errRecipientBanned:
+		return "banned"
+	case errContactDeclined:
+		return "blocked"
+	}
+	return ""
+}
+
+// sendToRecipients sends message to each of its Recipients, for
+// sendMessage. Recipients who cannot be sent to are reported as failed;
+// the messages to all the others are stored in one transaction, so that
+// either they all go out or none do.
+func sendToRecipients(ctx context.Context, w http.ResponseWriter, message Message, idemKey string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.Int("chat.sender_id", message.SenderID),
+		attribute.Int("chat.recipients", len(message.Recipients)),
+	)
+
+	if message.RecipientID != 0 {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "recipient_id and recipients cannot be used together")
+		return
+	}
+	if message.ClientMsgID != "" {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "client_msg_id cannot be used with recipients; send an Idempotency-Key")
+		return
+	}
+	if message.SendAt != nil && message.SendAt.After(scheduler.Clock.Now()) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "messages to several recipients cannot be scheduled")
+		return
+	}
+	recipients := slices.Clone(message.Recipients)
+	slices.Sort(recipients)
+	recipients = slices.Compact(recipients)
+	if len(recipients) > maxRecipients {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("at most %d recipients", maxRecipients))
+		return
+	}
+	message.Recipients = nil
+	if err := validateMessage(message); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, "invalid_message", err.Error())
+		return
+	}
+
+	retryAfter, err := recipientLimiter.take(ctx, strconv.Itoa(message.SenderID), int64(len(recipients)))
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to check rate limit")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	if err := checkSender(ctx, message.SenderID); err == errSenderBanned {
+		WriteError(w, http.StatusForbidden, "banned", err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	verdict := screenMessage(ctx, message)
+	if verdict == VerdictReject {
+		WriteError(w, http.StatusUnprocessableEntity, "policy_violation", errPolicyViolation.Error())
+		return
+	}
+	renderMessage(&message)
+
+	result := MultiSendResult{Failed: []RecipientFailure{}}
+	var messages []Message
+	for _, recipientID := range recipients {
+		msg := message
+		msg.RecipientID = recipientID
+		err := checkRecipient(ctx, recipientID)
+		if err == nil {
+			err = screenContact(ctx, &msg)
+		}
+		if reason := recipientFailure(err); reason != "" {
+			result.Failed = append(result.Failed, RecipientFailure{RecipientID: recipientID, Error: reason})
+			continue
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		messages = append(messages, msg)
+	}
+
+	messages, err = storeMessages(ctx, messages)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, msg := range messages {
+		storeRender(ctx, msg)
+		if verdict == VerdictFlag {
+			flagMessage(ctx, msg)
+		}
+		publishMessage(ctx, msg)
+	}
+	result.Sent = len(messages)
+
+	body, _ := json.Marshal(result)
+	saveIdempotentResponse(ctx, idemKey, http.StatusCreated, body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// storeMessages saves the messages in one transaction and returns them the
+// way storeMessage does. If any insert fails, none of them is stored.
+func storeMessages(ctx context.Context, messages []Message) ([]Message, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	stored := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		setExpiry(&msg, now)
+		msg.Version = 1
+		err := tx.QueryRowContext(ctx, "INSERT INTO messages (sender_id, receiver_id, text, expires_at, request) VALUES ($1, $2, $3, $4, $5) RETURNING message_id, seq, created_at, updated_at",
+			msg.SenderID, msg.RecipientID, msg.Text, msg.ExpiresAt, msg.Request).Scan(&msg.ID, &msg.Seq, &msg.CreatedAt, &msg.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("store message to %d: %w", msg.RecipientID, err)
+		}
+		stored = append(stored, msg)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, msg := range stored {
+		sampleMessage(ctx, msg, now)
+	}
+	return stored, nil
+}
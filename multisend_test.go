@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// multiSendStore is a recipientStore whose message inserts take part in
+// transactions: they are kept on commit and dropped on rollback. Inserts of
+// messages to failFor fail.
+type multiSendStore struct {
+	*recipientStore
+	failFor int64
+
+	mu     sync.Mutex
+	stored []int64
+}
+
+func (s *multiSendStore) Connect(context.Context) (driver.Conn, error) {
+	return &multiSendConn{recipientConn: recipientConn{store: s.recipientStore}, store: s}, nil
+}
+
+type multiSendConn struct {
+	recipientConn
+	store   *multiSendStore
+	pending []int64
+}
+
+func (c *multiSendConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *multiSendConn) Commit() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.stored = append(c.store.stored, c.pending...)
+	c.pending = nil
+	return nil
+}
+
+func (c *multiSendConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+func (c *multiSendConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "INSERT INTO messages") {
+		return c.recipientConn.QueryContext(ctx, query, args)
+	}
+	recipientID := args[1].Value.(int64)
+	if recipientID == c.store.failFor {
+		return nil, errors.New("insert failed")
+	}
+	c.pending = append(c.pending, recipientID)
+	return &idRows{ids: []int64{c.store.nextID.Add(1)}}, nil
+}
+
+func (s *multiSendStore) recipients() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.stored...)
+}
+
+func initMultiSendStore(t *testing.T, active ...int64) *multiSendStore {
+	store := &multiSendStore{recipientStore: initRecipientStore(t, active...)}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func postRecipients(senderID int, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	sendMessage(rr, asUser(httptest.NewRequest("POST", "/messages", bytes.NewBufferString(body)), senderID))
+	return rr
+}
+
+func TestSendToRecipients(t *testing.T) {
+	initRedis(t)
+	store := initMultiSendStore(t, 1, 2, 3, 4)
+	store.banned[4] = true
+	cfg.MessagesToBannedUsers = false
+	t.Cleanup(func() { cfg.MessagesToBannedUsers = true })
+	rec, _ := connectRecorder(t, "2")
+
+	rr := postRecipients(1, `{"sender_id":3,"recipients":[3,2,999,4,3],"text":"maintenance at noon"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"sent":2,"failed":[
+		{"recipient_id":4,"error":"banned"},
+		{"recipient_id":999,"error":"not_found"}
+	]}`, rr.Body.String())
+	assert.Equal(t, []int64{2, 3}, store.recipients())
+
+	delivered := waitForMessages(t, rec, 1)
+	assert.Equal(t, "maintenance at noon", delivered[0].Text)
+	assert.Equal(t, 2, delivered[0].RecipientID)
+	assert.Equal(t, 1, delivered[0].SenderID, "sender_id in the body is not who sent it")
+}
+
+func TestSendToRecipientsRollsBack(t *testing.T) {
+	initRedis(t)
+	store := initMultiSendStore(t, 1, 2, 3, 4)
+	store.failFor = 3
+	rec, _ := connectRecorder(t, "2")
+
+	rr := postRecipients(1, `{"recipients":[2,3,4],"text":"hi"}`)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Empty(t, store.recipients(), "no message is kept when one fails")
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, rec.messages(), "nothing is delivered")
+
+	store.failFor = 0
+	rr = postRecipients(1, `{"recipients":[2,3,4],"text":"hi"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, []int64{2, 3, 4}, store.recipients())
+}
+
+func TestSendToRecipientsValidation(t *testing.T) {
+	initRedis(t)
+	initMultiSendStore(t, 1, 2)
+
+	tooMany := make([]int, maxRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = i + 1
+	}
+	body, _ := json.Marshal(Message{SenderID: 1, Recipients: tooMany, Text: "hi"})
+	assert.Equal(t, http.StatusUnprocessableEntity, postRecipients(1, string(body)).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, postRecipients(1, `{"recipient_id":2,"recipients":[2],"text":"hi"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, postRecipients(1, `{"recipients":[2],"text":" "}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		postRecipients(1, `{"recipients":[2],"text":"hi","client_msg_id":"0b6bd7c1-1a4c-4a36-8a4a-5e8f2f0c1d2e"}`).Code)
+}
+
+func TestSendToRecipientsRejectsAttachments(t *testing.T) {
+	initRedis(t)
+	store := initMultiSendStore(t, 1, 2, 3)
+	mock := initMockS3(t)
+	server := newTestServer(t, newRouter())
+
+	resp := postMultipartMessage(t, server, Message{SenderID: 1, Recipients: []int{2, 3}, Text: "slides"},
+		testFile{"slides.pdf", "application/pdf", "%PDF-"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "files are not dropped silently")
+	assert.Empty(t, store.recipients())
+	assert.Empty(t, mock.objects)
+}
+
+func TestSendToRecipientsRateLimited(t *testing.T) {
+	initRedis(t)
+	initMultiSendStore(t, 1, 2, 3, 4, 5)
+
+	recipients := `{"recipients":[2,3,4,5],"text":"hi"}`
+	for i := int64(0); i < recipientLimiter.limit/4; i++ {
+		assert.Equal(t, http.StatusCreated, postRecipients(1, recipients).Code)
+	}
+	rr := postRecipients(1, recipients)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "the limit counts recipients, not requests")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusCreated, postRecipients(2, `{"recipients":[1],"text":"hi"}`).Code)
+}
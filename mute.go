@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxMuteMinutes = 365 * 24 * 60
+
+	// muteCacheTTL bounds how long an idle conversation's mutes stay in
+	// Redis.
+	muteCacheTTL = 24 * time.Hour
+	// muteCacheLoaded marks a conversation's mutes as loaded, so that a
+	// conversation nobody muted is not looked up again.
+	muteCacheLoaded = "loaded"
+)
+
+// muteClock decides whether a timed mute is still on and whether quiet
+// hours last.
+var muteClock Clock = realClock{}
+
+type muteRequest struct {
+	DurationMinutes int `json:"duration_minutes"`
+}
+
+type conversationSettingsRequest struct {
+	Muted     bool       `json:"muted"`
+	MuteUntil *time.Time `json:"mute_until"`
+}
+
+// ConversationSettings are the caller's preferences for a direct
+// conversation. MuteUntil is nil while it is muted until further notice.
+type ConversationSettings struct {
+	PeerID    int        `json:"peer_id"`
+	Muted     bool       `json:"muted"`
+	MuteUntil *time.Time `json:"mute_until,omitempty"`
+}
+
+// conversationMutesKey caches who muted a conversation, as a hash from user
+// ID to the Unix time the mute ends, 0 for none. Postgres has the
+// authoritative list; the hash is dropped whenever it changes.
+func conversationMutesKey(conversation string) string {
+	return fmt.Sprintf("conversation:%s:mutes", conversation)
+}
+
+// conversationMutes returns who muted the conversation and until when, from
+// Redis if it has them.
+func conversationMutes(ctx context.Context, conversation string) (map[string]int64, error) {
+	key := conversationMutesKey(conversation)
+	fields, err := redisCli.HGetAll(ctx, key).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read conversation mutes:", err)
+	} else if _, ok := fields[muteCacheLoaded]; ok {
+		mutes := make(map[string]int64, len(fields))
+		for field, value := range fields {
+			if field != muteCacheLoaded {
+				mutes[field], _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		return mutes, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT user_id, muted_until FROM notification_prefs WHERE conversation_key = $1", conversation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mutes := make(map[string]int64)
+	values := []interface{}{muteCacheLoaded, 0}
+	for rows.Next() {
+		var userID int
+		var until sql.NullTime
+		if err := rows.Scan(&userID, &until); err != nil {
+			return nil, err
+		}
+		var end int64
+		if until.Valid {
+			end = until.Time.Unix()
+		}
+		mutes[strconv.Itoa(userID)] = end
+		values = append(values, userID, end)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := redisCli.TxPipeline()
+	pipe.HSet(ctx, key, values...)
+	pipe.Expire(ctx, key, muteCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to cache conversation mutes:", err)
+	}
+	return mutes, nil
+}
+
+// mutedAt reports whether a mute ending at until, as stored by
+// conversationMutes, is on at now.
+func mutedAt(until int64, ok bool, now time.Time) bool {
+	return ok && (until == 0 || now.Unix() < until)
+}
+
+// isMuted reports whether the user muted the conversation. When that cannot
+// be told, the conversation is taken to be unmuted.
+func isMuted(ctx context.Context, conversation string, userID int) bool {
+	mutes, err := conversationMutes(ctx, conversation)
+	if err != nil {
+		logger(ctx).Println("Failed to look up conversation mutes:", err)
+		return false
+	}
+	until, ok := mutes[strconv.Itoa(userID)]
+	return mutedAt(until, ok, muteClock.Now())
+}
+
+// setMute mutes the conversation for the user until the given time or, when
+// it is nil, until further notice.
+func setMute(ctx context.Context, userID int, conversation string, until *time.Time) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO notification_prefs (user_id, conversation_key, muted_until) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, conversation_key) DO UPDATE SET muted_until = EXCLUDED.muted_until`,
+		userID, conversation, until)
+	if err != nil {
+		return err
+	}
+	forgetMutes(ctx, conversation)
+	return nil
+}
+
+// clearMute unmutes the conversation for the user and reports whether it
+// was muted.
+func clearMute(ctx context.Context, userID int, conversation string) (bool, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM notification_prefs WHERE user_id = $1 AND conversation_key = $2",
+		userID, conversation)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	forgetMutes(ctx, conversation)
+	return n > 0, nil
+}
+
+// userMutes returns when each conversation the user muted is unmuted, nil
+// for those muted until further notice. Expired mutes are included.
+func userMutes(ctx context.Context, userID int) (map[string]*time.Time, error) {
+	rows, err := db.QueryContext(ctx, "SELECT conversation_key, muted_until FROM notification_prefs WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mutes := make(map[string]*time.Time)
+	for rows.Next() {
+		var conversation string
+		var until *time.Time
+		if err := rows.Scan(&conversation, &until); err != nil {
+			return nil, err
+		}
+		mutes[conversation] = until
+	}
+	return mutes, rows.Err()
+}
+
+func forgetMutes(ctx context.Context, conversation string) {
+	if err := redisCli.Del(ctx, conversationMutesKey(conversation)).Err(); err != nil {
+		logger(ctx).Println("Failed to drop conversation mutes:", err)
+	}
+}
+
+// ConversationMute reports until when a conversation is muted; MutedUntil
+// is nil while it is muted until further notice.
+type ConversationMute struct {
+	Key        string     `json:"key"`
+	MutedUntil *time.Time `json:"muted_until"`
+}
+
+// muteConversation stops notifications from the conversation in the path
+// reaching the caller, for duration_minutes or, when it is 0 or left out,
+// until they unmute it. Messages are still delivered to their connections.
+func muteConversation(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.muteConversation")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var req muteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		decodeError(w, err)
+		return
+	}
+	if req.DurationMinutes < 0 || req.DurationMinutes > maxMuteMinutes {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("duration_minutes must be between 0 and %d", maxMuteMinutes))
+		return
+	}
+
+	conversation := mux.Vars(r)["key"]
+	span.SetAttributes(attribute.String("chat.conversation", conversation), attribute.Int("chat.mute_minutes", req.DurationMinutes))
+	if err := canReadConversation(ctx, conversation, claims.UserID); err == errInvalidConversationKey {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	} else if err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	mute := ConversationMute{Key: conversation}
+	if req.DurationMinutes > 0 {
+		until := muteClock.Now().Add(time.Duration(req.DurationMinutes) * time.Minute).UTC()
+		mute.MutedUntil = &until
+	}
+	if err := setMute(ctx, claims.UserID, conversation, mute.MutedUntil); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mute)
+}
+
+// unmuteConversation lets notifications from the conversation in the path
+// reach the caller again.
+func unmuteConversation(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.unmuteConversation")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	conversation := mux.Vars(r)["key"]
+	span.SetAttributes(attribute.String("chat.conversation", conversation))
+	if muted, err := clearMute(ctx, claims.UserID, conversation); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	} else if !muted {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Conversation is not muted")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateConversationSettings sets the caller's preferences for their direct
+// conversation with the peer in the path. A mute with mute_until ends by
+// itself at that time.
+func updateConversationSettings(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updateConversationSettings")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	peerID, err := strconv.Atoi(mux.Vars(r)["peer"])
+	if err != nil || peerID == claims.UserID {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid peer id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.peer_id", peerID))
+
+	var req conversationSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.MuteUntil != nil && (!req.Muted || !req.MuteUntil.After(muteClock.Now())) {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "mute_until must be in the future and needs muted")
+		return
+	}
+
+	if err := checkUserExists(ctx, peerID); err == errInvalidRecipient {
+		WriteError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	conversation := conversationKey(Message{SenderID: claims.UserID, RecipientID: peerID})
+	settings := ConversationSettings{PeerID: peerID, Muted: req.Muted}
+	if req.Muted {
+		if req.MuteUntil != nil {
+			until := req.MuteUntil.UTC()
+			settings.MuteUntil = &until
+		}
+		err = setMute(ctx, claims.UserID, conversation, settings.MuteUntil)
+	} else {
+		_, err = clearMute(ctx, claims.UserID, conversation)
+	}
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuteConversationRejections(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	router := newRouter()
+
+	serve := func(key string, body interface{}) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 5, "POST", "/conversations/"+key+"/mute", body))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, serve("dm:9:3", muteRequest{}))
+	assert.Equal(t, http.StatusBadRequest, serve("dm:3:5", muteRequest{DurationMinutes: -1}))
+	assert.Equal(t, http.StatusBadRequest, serve("dm:3:5", muteRequest{DurationMinutes: maxMuteMinutes + 1}))
+	assert.Equal(t, http.StatusForbidden, serve("dm:3:9", muteRequest{}), "only participants mute a conversation")
+}
+
+func TestMuteSuppressesNotificationsOnly(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	server := newTestServer(t, newRouter())
+
+	alice := insertTestUser(t, "hash")
+	bob := insertTestUser(t, "hash")
+	_, err := db.Exec("INSERT INTO webhooks (user_id, url, secret, event_types) VALUES ($1, $2, $3, $4)",
+		bob, "https://example.com/hook", "secret", []string{eventMessageCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := conversationKey(Message{SenderID: alice, RecipientID: bob})
+	dispatcher := &WebhookDispatcher{db: db}
+	subscribed := func() bool {
+		hooks, err := dispatcher.subscribers(ctx, bob, eventMessageCreated, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(hooks) > 0
+	}
+	mute := func(body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(rr, authedRequest(t, bob, "POST", "/conversations/"+key+"/mute", body))
+		return rr
+	}
+	unmute := func() int {
+		rr := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(rr, authedRequest(t, bob, "DELETE", "/conversations/"+key+"/mute", nil))
+		return rr.Code
+	}
+
+	assert.True(t, subscribed())
+	rr := mute(muteRequest{})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var muted ConversationMute
+	json.NewDecoder(rr.Body).Decode(&muted)
+	assert.Equal(t, ConversationMute{Key: key}, muted, "0 mutes until further notice")
+	assert.False(t, subscribed())
+
+	// Messages still reach the muted recipient's connections.
+	receiver := dialTestUser(t, server, bob)
+	sender := dialTestUser(t, server, alice)
+	waitForClients(t, 2)
+	if err := sender.WriteJSON(Message{SenderID: alice, RecipientID: bob, Text: "still here"}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := receiver.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "still here", msg.Text)
+
+	rr = mute(muteRequest{DurationMinutes: 60})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	muted = ConversationMute{}
+	json.NewDecoder(rr.Body).Decode(&muted)
+	if assert.NotNil(t, muted.MutedUntil) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *muted.MutedUntil, time.Minute)
+	}
+	assert.False(t, subscribed())
+
+	_, err = db.Exec("UPDATE notification_prefs SET muted_until = NOW() - INTERVAL '1 minute' WHERE user_id = $1", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, subscribed(), "an expired mute no longer applies")
+
+	assert.Equal(t, http.StatusNoContent, unmute())
+	assert.Equal(t, http.StatusNotFound, unmute())
+}
+
+func useMuteClock(t *testing.T, clock Clock) {
+	previous := muteClock
+	muteClock = clock
+	t.Cleanup(func() { muteClock = previous })
+}
+
+func TestConversationSettingsRejections(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	useMuteClock(t, newFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)))
+	router := newRouter()
+
+	serve := func(peer string, body interface{}) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 5, "PUT", "/conversations/"+peer+"/settings", body))
+		return rr.Code
+	}
+	past := time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC)
+	future := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	assert.Equal(t, http.StatusBadRequest, serve("5", conversationSettingsRequest{Muted: true}))
+	assert.Equal(t, http.StatusBadRequest, serve("x", conversationSettingsRequest{Muted: true}))
+	assert.Equal(t, http.StatusBadRequest, serve("6", conversationSettingsRequest{Muted: true, MuteUntil: &past}))
+	assert.Equal(t, http.StatusBadRequest, serve("6", conversationSettingsRequest{MuteUntil: &future}))
+}
+
+func TestTimedMuteEndsByItself(t *testing.T) {
+	initRedis(t)
+	initContactStore(t, 991, 992)
+	clock := newFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	useMuteClock(t, clock)
+	// The cached mutes spare the database.
+	redisCli.HSet(context.Background(), conversationMutesKey("dm:991:992"),
+		muteCacheLoaded, 0, "992", clock.Now().Add(time.Hour).Unix())
+	server := newTestServer(t, newRouter())
+
+	receiver := dialTestUser(t, server, 992)
+	sender := dialTestUser(t, server, 991)
+	waitForClients(t, 2)
+	receive := func(text string) Message {
+		if err := sender.WriteJSON(Message{SenderID: 991, RecipientID: 992, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg Message
+		if err := receiver.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	msg := receive("shh")
+	assert.Equal(t, "shh", msg.Text)
+	assert.True(t, msg.Muted, "muted messages are still delivered, flagged")
+
+	clock.Advance(time.Hour)
+	msg = receive("loud")
+	assert.Equal(t, "loud", msg.Text)
+	assert.False(t, msg.Muted)
+}
+
+func TestConversationSettingsListed(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	clock := newFakeClock(time.Now())
+	useMuteClock(t, clock)
+	router := newRouter()
+
+	alice := insertTestUser(t, "hash")
+	bob := insertTestUser(t, "hash")
+	if _, err := storeMessage(context.Background(), Message{SenderID: alice, RecipientID: bob, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, alice, method, path, body))
+		return rr
+	}
+	listed := func() ConversationSummary {
+		var page Page[ConversationSummary]
+		json.NewDecoder(serve("GET", "/conversations", nil).Body).Decode(&page)
+		if len(page.Items) != 1 {
+			t.Fatalf("expected one conversation, got %d", len(page.Items))
+		}
+		return page.Items[0]
+	}
+
+	until := clock.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rr := serve("PUT", "/conversations/"+strconv.Itoa(bob)+"/settings", conversationSettingsRequest{Muted: true, MuteUntil: &until})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	conversation := listed()
+	assert.True(t, conversation.Muted)
+	if assert.NotNil(t, conversation.MuteUntil) {
+		assert.True(t, until.Equal(*conversation.MuteUntil))
+	}
+	assert.True(t, isMuted(context.Background(), conversation.Key, alice))
+
+	clock.Advance(time.Hour)
+	assert.False(t, listed().Muted, "the mute ends without the client asking")
+	assert.False(t, isMuted(context.Background(), conversation.Key, alice))
+
+	rr = serve("PUT", "/conversations/"+strconv.Itoa(bob)+"/settings", conversationSettingsRequest{Muted: true})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	conversation = listed()
+	assert.True(t, conversation.Muted)
+	assert.Nil(t, conversation.MuteUntil)
+
+	assert.Equal(t, http.StatusOK, serve("PUT", "/conversations/"+strconv.Itoa(bob)+"/settings", conversationSettingsRequest{}).Code)
+	assert.False(t, listed().Muted)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+)
+
+// oauthStateCookie ties the callback to the browser that started the login,
+// so that nobody can log a victim into the attacker's account.
+const oauthStateCookie = "oauth_state"
+
+// oauthStateTTL is how long a login may take at the provider.
+const oauthStateTTL = 10 * time.Minute
+
+// maxOAuthProfileBytes caps the profile responses read from providers.
+const maxOAuthProfileBytes = 1 << 20
+
+var errEmailTaken = errors.New("email belongs to another account")
+
+// oauthLinkKey holds the user who started the login with the given state
+// while signed in, and so may link the identity to their account.
+func oauthLinkKey(state string) string {
+	return "oauth:link:" + state
+}
+
+// oauthProfile is who the provider says the user is. Subject is the
+// provider's stable ID for them.
+type oauthProfile struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// oauthProvider is an OAuth2 identity provider. profile fetches the user's
+// identity from apiURL with a client carrying their token.
+type oauthProvider struct {
+	config  oauth2.Config
+	apiURL  string
+	profile func(ctx context.Context, client *http.Client, apiURL string) (oauthProfile, error)
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"google": {
+		config: oauth2.Config{
+			ClientID:     cfg.OAuthGoogleClientID,
+			ClientSecret: cfg.OAuthGoogleClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURL:  "https://oauth2.googleapis.com/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			RedirectURL: cfg.PublicURL + "/auth/oauth/google/callback",
+			Scopes:      []string{"openid", "email", "profile"},
+		},
+		apiURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+		profile: googleProfile,
+	},
+	"github": {
+		config: oauth2.Config{
+			ClientID:     cfg.OAuthGitHubClientID,
+			ClientSecret: cfg.OAuthGitHubClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://github.com/login/oauth/authorize",
+				TokenURL:  "https://github.com/login/oauth/access_token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			RedirectURL: cfg.PublicURL + "/auth/oauth/github/callback",
+			Scopes:      []string{"read:user", "user:email"},
+		},
+		apiURL:  "https://api.github.com",
+		profile: githubProfile,
+	},
+}
+
+// enabledOAuthProvider returns the provider of the name, or nil if there is
+// none or it has no client ID configured.
+func enabledOAuthProvider(name string) *oauthProvider {
+	provider := oauthProviders[name]
+	if provider == nil || provider.config.ClientID == "" {
+		return nil
+	}
+	return provider
+}
+
+// oauthLogin sends the browser to the provider to log in. A signed in
+// caller is remembered with the state, so that the callback may link the
+// identity to their account.
+func oauthLogin(w http.ResponseWriter, r *http.Request) {
+	provider := enabledOAuthProvider(mux.Vars(r)["provider"])
+	if provider == nil {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Unknown login provider")
+		return
+	}
+
+	state, err := randomToken(16)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to start login")
+		return
+	}
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		if err := redisCli.Set(r.Context(), oauthLinkKey(state), claims.UserID, oauthStateTTL).Err(); err != nil {
+			WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to start login")
+			return
+		}
+	}
+	// Lax, not Strict: the cookie has to come back with the provider's
+	// redirect, which is a navigation from another site.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.config.AuthCodeURL(state), http.StatusFound)
+}
+
+// oauthCallback finishes a login at the provider: it exchanges the code for
+// a token, finds or creates the user of the identity and sends the browser
+// to cfg.OAuthRedirectURL with an access token in the fragment, or an error
+// code if the login failed.
+func oauthCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.oauthCallback")
+	defer span.End()
+
+	name := mux.Vars(r)["provider"]
+	provider := enabledOAuthProvider(name)
+	if provider == nil {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Unknown login provider")
+		return
+	}
+	span.SetAttributes(attribute.String("chat.oauth_provider", name))
+
+	query := r.URL.Query()
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || query.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		WriteError(w, http.StatusBadRequest, "invalid_oauth_state", "Login expired or was not started here, try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/oauth", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+
+	if query.Get("error") != "" {
+		redirectOAuthError(w, r, "access_denied")
+		return
+	}
+	token, err := provider.config.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		logger(ctx).Printf("Failed to exchange %s login code: %v", name, err)
+		redirectOAuthError(w, r, "oauth_failed")
+		return
+	}
+	profile, err := provider.profile(ctx, provider.config.Client(ctx, token), provider.apiURL)
+	if err != nil {
+		logger(ctx).Printf("Failed to fetch %s profile: %v", name, err)
+		redirectOAuthError(w, r, "oauth_failed")
+		return
+	}
+	// The email is what a new account gets and what links an existing one,
+	// so only one the provider checked will do.
+	if profile.Subject == "" || profile.Email == "" || !profile.EmailVerified {
+		redirectOAuthError(w, r, "email_unverified")
+		return
+	}
+
+	linkTo, err := redisCli.GetDel(ctx, oauthLinkKey(cookie.Value)).Int()
+	if err != nil && err != redis.Nil {
+		logger(ctx).Println("Failed to look up OAuth link:", err)
+		redirectOAuthError(w, r, "server_error")
+		return
+	}
+	user, err := upsertOAuthUser(ctx, name, profile, linkTo)
+	if err == errEmailTaken {
+		redirectOAuthError(w, r, "email_taken")
+		return
+	} else if err != nil {
+		logger(ctx).Printf("Failed to find %s user: %v", name, err)
+		redirectOAuthError(w, r, "server_error")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", user.id))
+	if user.banned {
+		redirectOAuthError(w, r, "banned")
+		return
+	}
+
+	sessionID, err := newSession(ctx, user.id)
+	if err != nil {
+		redirectOAuthError(w, r, "server_error")
+		return
+	}
+	accessToken, err := newAccessToken(user.id, user.role, sessionID)
+	if err != nil {
+		redirectOAuthError(w, r, "server_error")
+		return
+	}
+	refreshToken, err := createRefreshToken(ctx, sessionID, user.id)
+	if err != nil {
+		redirectOAuthError(w, r, "server_error")
+		return
+	}
+
+	if user.linked {
+		recordAudit(ctx, user.id, "oauth_link", userTarget(user.id))
+	}
+	recordAudit(ctx, user.id, "login", userTarget(user.id))
+
+	setRefreshCookie(w, refreshToken)
+	// The fragment stays in the browser: it is not sent to the frontend's
+	// server nor passed on in Referer.
+	fragment := url.Values{
+		"access_token": {accessToken},
+		"token_type":   {"Bearer"},
+		"expires_in":   {strconv.Itoa(int(cfg.AccessTokenTTL.Seconds()))},
+	}
+	http.Redirect(w, r, oauthRedirectURL()+"#"+fragment.Encode(), http.StatusFound)
+}
+
+func oauthRedirectURL() string {
+	if cfg.OAuthRedirectURL != "" {
+		return cfg.OAuthRedirectURL
+	}
+	return cfg.PublicURL + "/"
+}
+
+func redirectOAuthError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, oauthRedirectURL()+"#"+url.Values{"error": {code}}.Encode(), http.StatusFound)
+}
+
+// oauthUser is the account an identity logged into. linked is set when the
+// identity was just linked to an account that had its email.
+type oauthUser struct {
+	id     int
+	role   string
+	banned bool
+	linked bool
+}
+
+// upsertOAuthUser returns the account of the identity. An identity seen for
+// the first time is linked to linkTo, the user who started the login signed
+// in, if that account has its email and no other identity. Otherwise it
+// gets a new account without a password, or errEmailTaken if another
+// account has the email: taking that one over needs its owner signed in.
+func upsertOAuthUser(ctx context.Context, provider string, profile oauthProfile, linkTo int) (oauthUser, error) {
+	var user oauthUser
+	err := db.QueryRowContext(ctx, "SELECT user_id, role, banned_at IS NOT NULL FROM users WHERE oauth_provider = $1 AND oauth_sub = $2 AND deleted_at IS NULL",
+		provider, profile.Subject).Scan(&user.id, &user.role, &user.banned)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if linkTo != 0 {
+		err = db.QueryRowContext(ctx, "UPDATE users SET oauth_provider = $1, oauth_sub = $2 WHERE user_id = $3 AND lower(email) = lower($4) AND oauth_provider IS NULL AND deleted_at IS NULL RETURNING user_id, role, banned_at IS NOT NULL",
+			provider, profile.Subject, linkTo, profile.Email).Scan(&user.id, &user.role, &user.banned)
+		if err == nil {
+			user.linked = true
+			return user, nil
+		} else if err != sql.ErrNoRows {
+			return user, err
+		}
+	}
+
+	// The unique constraint on email is case sensitive, and an account
+	// with the email in any case is not to be shadowed by a new one.
+	var taken bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND deleted_at IS NULL)", profile.Email).Scan(&taken)
+	if err != nil {
+		return user, err
+	} else if taken {
+		return user, errEmailTaken
+	}
+
+	// The username the provider knows may be taken here; try it with a
+	// random suffix a few times before giving up. A reserved one is kept
+	// from sign-ups as at registration, and goes straight to the suffix.
+	base := oauthUsername(profile)
+	username := base
+	if usernameReserved(username) {
+		if username, err = suffixUsername(base); err != nil {
+			return user, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		err = db.QueryRowContext(ctx, "INSERT INTO users (username, email, password_hash, oauth_provider, oauth_sub) VALUES ($1, $2, '', $3, $4) RETURNING user_id, role",
+			username, profile.Email, provider, profile.Subject).Scan(&user.id, &user.role)
+		switch uniqueUserColumn(err) {
+		case "email":
+			return user, errEmailTaken
+		case "username":
+			if attempt < 4 {
+				if username, err = suffixUsername(base); err != nil {
+					return user, err
+				}
+				continue
+			}
+		}
+		return user, err
+	}
+}
+
+// suffixUsername is base with a random suffix, which oauthUsername leaves
+// room for.
+func suffixUsername(base string) (string, error) {
+	suffix, err := randomToken(2)
+	return base + "_" + suffix, err
+}
+
+// oauthUsername makes a username out of what the provider calls the user,
+// or the start of their email, keeping letters, digits, '.', '_' and '-'
+// and leaving room for a suffix.
+func oauthUsername(profile oauthProfile) string {
+	name := profile.Username
+	if name == "" {
+		name, _, _ = strings.Cut(profile.Email, "@")
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	username := []rune(b.String())
+	if max := cfg.MaxUsernameLength - 5; len(username) > max {
+		username = username[:max]
+	}
+	if len(username) == 0 {
+		return "user"
+	}
+	return string(username)
+}
+
+// fetchOAuthJSON decodes the JSON at url, fetched with the user's client.
+func fetchOAuthJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOAuthProfileBytes)).Decode(v)
+}
+
+// googleProfile reads the OpenID Connect userinfo.
+func googleProfile(ctx context.Context, client *http.Client, apiURL string) (oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := fetchOAuthJSON(ctx, client, apiURL, &info); err != nil {
+		return oauthProfile{}, err
+	}
+	return oauthProfile{Subject: info.Sub, Email: info.Email, EmailVerified: info.EmailVerified}, nil
+}
+
+// githubProfile reads the user and their primary email, which GitHub only
+// tells verified or not in the list of emails.
+func githubProfile(ctx context.Context, client *http.Client, apiURL string) (oauthProfile, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := fetchOAuthJSON(ctx, client, apiURL+"/user", &user); err != nil {
+		return oauthProfile{}, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := fetchOAuthJSON(ctx, client, apiURL+"/user/emails", &emails); err != nil {
+		return oauthProfile{}, err
+	}
+
+	profile := oauthProfile{Subject: strconv.FormatInt(user.ID, 10), Username: user.Login}
+	if user.ID == 0 {
+		profile.Subject = ""
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+type oauthStoreUser struct {
+	id            int64
+	username      string
+	email         string
+	passwordHash  string
+	banned        bool
+	provider, sub string
+}
+
+// oauthStore keeps users in memory and answers the queries of OAuth logins,
+// refusing duplicate usernames and emails like the constraints would.
+type oauthStore struct {
+	mu    sync.Mutex
+	users []*oauthStoreUser
+}
+
+func (s *oauthStore) Connect(context.Context) (driver.Conn, error) {
+	return oauthConn{store: s}, nil
+}
+
+func (s *oauthStore) Driver() driver.Driver { return nil }
+
+func (s *oauthStore) user(provider, sub string) *oauthStoreUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.provider == provider && u.sub == sub {
+			return u
+		}
+	}
+	return nil
+}
+
+type oauthConn struct {
+	fakeConn
+	store *oauthStore
+}
+
+func (c oauthConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arg := func(i int) string { return args[i].Value.(string) }
+
+	switch {
+	case strings.HasPrefix(query, "SELECT user_id, role"):
+		rows := &tableRows{columns: []string{"user_id", "role", "banned"}}
+		for _, u := range s.users {
+			if u.provider == arg(0) && u.sub == arg(1) {
+				rows.rows = append(rows.rows, []driver.Value{u.id, RoleUser, u.banned})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "UPDATE users SET oauth_provider"):
+		rows := &tableRows{columns: []string{"user_id", "role", "banned"}}
+		for _, u := range s.users {
+			if u.id == args[2].Value.(int64) && strings.EqualFold(u.email, arg(3)) && u.provider == "" {
+				u.provider, u.sub = arg(0), arg(1)
+				rows.rows = append(rows.rows, []driver.Value{u.id, RoleUser, u.banned})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email)"):
+		taken := false
+		for _, u := range s.users {
+			taken = taken || strings.EqualFold(u.email, arg(0))
+		}
+		return &tableRows{columns: []string{"exists"}, rows: [][]driver.Value{{taken}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO users"):
+		for _, u := range s.users {
+			if u.username == arg(0) {
+				return nil, &pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_username_key"}
+			}
+			if u.email == arg(1) {
+				return nil, &pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_email_key"}
+			}
+		}
+		u := &oauthStoreUser{id: int64(len(s.users) + 1), username: arg(0), email: arg(1), provider: arg(2), sub: arg(3)}
+		s.users = append(s.users, u)
+		return &tableRows{columns: []string{"user_id", "role"}, rows: [][]driver.Value{{u.id, RoleUser}}}, nil
+	}
+	return &tableRows{}, nil
+}
+
+func initOAuthStore(t *testing.T, users ...*oauthStoreUser) *oauthStore {
+	store := &oauthStore{users: users}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+// initOAuthProvider points the provider at a mock of its token endpoint and
+// API, which answers with the profile.
+func initOAuthProvider(t *testing.T, name string, profile map[string]interface{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"provider-token","token_type":"Bearer"}`))
+	})
+	api := func(body interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer provider-token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(body)
+		}
+	}
+	mux.HandleFunc("/userinfo", api(profile))
+	mux.HandleFunc("/user", api(profile))
+	mux.HandleFunc("/user/emails", api(profile["emails"]))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	saved := oauthProviders[name]
+	provider := *saved
+	provider.config.ClientID = "client-id"
+	provider.config.ClientSecret = "client-secret"
+	provider.config.Endpoint.AuthURL = "https://" + name + ".example.com/authorize"
+	provider.config.Endpoint.TokenURL = server.URL + "/token"
+	provider.apiURL = server.URL
+	if name == "google" {
+		provider.apiURL = server.URL + "/userinfo"
+	}
+	oauthProviders[name] = &provider
+	t.Cleanup(func() { oauthProviders[name] = saved })
+}
+
+// oauthRoundTrip starts a login with the provider and comes back to the
+// callback with the code, returning the fragment the browser is sent to.
+func oauthRoundTrip(t *testing.T, provider, code string) url.Values {
+	return oauthRoundTripFrom(t, httptest.NewRequest("GET", "/auth/oauth/"+provider, nil), provider, code)
+}
+
+// oauthRoundTripFrom is oauthRoundTrip starting the login with start.
+func oauthRoundTripFrom(t *testing.T, start *http.Request, provider, code string) url.Values {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, start)
+	if !assert.Equal(t, http.StatusFound, rr.Code) {
+		t.FailNow()
+	}
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	state := location.Query().Get("state")
+
+	req := httptest.NewRequest("GET", "/auth/oauth/"+provider+"/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if !assert.Equal(t, http.StatusFound, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	redirect, _ := url.Parse(rr.Header().Get("Location"))
+	assert.Equal(t, oauthRedirectURL(), redirect.Scheme+"://"+redirect.Host+redirect.Path)
+	fragment, err := url.ParseQuery(redirect.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+func oauthUserID(t *testing.T, fragment url.Values) int {
+	claims, err := parseToken(fragment.Get("access_token"))
+	if err != nil {
+		t.Fatalf("no access token in %v: %v", fragment, err)
+	}
+	return claims.UserID
+}
+
+var googleProfileJSON = map[string]interface{}{"sub": "g-123", "email": "vishnu@example.com", "email_verified": true}
+
+func TestOAuthLoginRedirectsToProvider(t *testing.T) {
+	initRedis(t)
+	initOAuthProvider(t, "google", googleProfileJSON)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/auth/oauth/google", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "google.example.com", location.Host)
+	assert.Equal(t, "client-id", location.Query().Get("client_id"))
+	assert.Equal(t, cfg.PublicURL+"/auth/oauth/google/callback", location.Query().Get("redirect_uri"))
+
+	cookies := rr.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, oauthStateCookie, cookies[0].Name)
+		assert.Equal(t, location.Query().Get("state"), cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+	}
+
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/auth/oauth/myspace", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestOAuthGoogleCreatesUser(t *testing.T) {
+	initRedis(t)
+	rec := initRecordingAuditor(t)
+	store := initOAuthStore(t)
+	initOAuthProvider(t, "google", googleProfileJSON)
+
+	fragment := oauthRoundTrip(t, "google", "good-code")
+	userID := oauthUserID(t, fragment)
+	assert.Equal(t, "Bearer", fragment.Get("token_type"))
+
+	user := store.user("google", "g-123")
+	if assert.NotNil(t, user) {
+		assert.Equal(t, int64(userID), user.id)
+		assert.Equal(t, "vishnu", user.username)
+		assert.Equal(t, "vishnu@example.com", user.email)
+	}
+
+	// Logging in again finds the same account.
+	assert.Equal(t, userID, oauthUserID(t, oauthRoundTrip(t, "google", "good-code")))
+	assert.Len(t, store.users, 1)
+
+	events := rec.recorded()
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, "login", events[len(events)-1].Action)
+	}
+}
+
+func TestOAuthGitHubLinksExistingAccount(t *testing.T) {
+	initRedis(t)
+	rec := initRecordingAuditor(t)
+	store := initOAuthStore(t, &oauthStoreUser{id: 7, username: "vishnu", email: "Vishnu@Example.com", passwordHash: "$2a$10$hash"})
+	initOAuthProvider(t, "github", map[string]interface{}{
+		"id":    4242,
+		"login": "vishnu-gh",
+		"emails": []map[string]interface{}{
+			{"email": "old@example.com", "primary": false, "verified": true},
+			{"email": "vishnu@example.com", "primary": true, "verified": true},
+		},
+	})
+
+	// Without signing in first, the email is someone else's.
+	assert.Equal(t, "email_taken", oauthRoundTrip(t, "github", "good-code").Get("error"))
+	assert.Nil(t, store.user("github", "4242"))
+
+	assert.Equal(t, 7, oauthUserID(t, oauthRoundTripFrom(t, authedRequest(t, 7, "GET", "/auth/oauth/github", nil), "github", "good-code")))
+	user := store.user("github", "4242")
+	if assert.NotNil(t, user, "the identity should be linked to the account with its email") {
+		assert.Equal(t, int64(7), user.id)
+		assert.Equal(t, "$2a$10$hash", user.passwordHash, "linking keeps the password")
+	}
+	assert.Len(t, store.users, 1)
+
+	var actions []string
+	for _, event := range rec.recorded() {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{"oauth_link", "login"}, actions)
+}
+
+func TestOAuthEmailLinkedToAnotherProvider(t *testing.T) {
+	initRedis(t)
+	initOAuthStore(t, &oauthStoreUser{id: 7, username: "vishnu", email: "vishnu@example.com", provider: "google", sub: "g-123"})
+	initOAuthProvider(t, "github", map[string]interface{}{
+		"id":     4242,
+		"login":  "vishnu",
+		"emails": []map[string]interface{}{{"email": "vishnu@example.com", "primary": true, "verified": true}},
+	})
+
+	fragment := oauthRoundTripFrom(t, authedRequest(t, 7, "GET", "/auth/oauth/github", nil), "github", "good-code")
+	assert.Equal(t, "email_taken", fragment.Get("error"))
+	assert.Empty(t, fragment.Get("access_token"))
+}
+
+func TestOAuthLinkNeedsTheAccountWithTheEmail(t *testing.T) {
+	initRedis(t)
+	store := initOAuthStore(t,
+		&oauthStoreUser{id: 7, username: "vishnu", email: "vishnu@example.com"},
+		&oauthStoreUser{id: 8, username: "mallory", email: "mallory@example.com"},
+	)
+	initOAuthProvider(t, "google", googleProfileJSON)
+
+	fragment := oauthRoundTripFrom(t, authedRequest(t, 8, "GET", "/auth/google", nil), "google", "good-code")
+	assert.Equal(t, "email_taken", fragment.Get("error"))
+	assert.Nil(t, store.user("google", "g-123"), "signing in as another user must not take over the account")
+
+	assert.Equal(t, 7, oauthUserID(t, oauthRoundTripFrom(t, authedRequest(t, 7, "GET", "/auth/google", nil), "google", "good-code")))
+}
+
+func TestOAuthUsernameTaken(t *testing.T) {
+	initRedis(t)
+	store := initOAuthStore(t, &oauthStoreUser{id: 1, username: "vishnu", email: "someone@example.com"})
+	initOAuthProvider(t, "google", googleProfileJSON)
+
+	oauthRoundTrip(t, "google", "good-code")
+	user := store.user("google", "g-123")
+	if assert.NotNil(t, user) {
+		assert.True(t, strings.HasPrefix(user.username, "vishnu_"), user.username)
+	}
+}
+
+func TestOAuthReservedUsername(t *testing.T) {
+	initRedis(t)
+	store := initOAuthStore(t)
+	initOAuthProvider(t, "google", map[string]interface{}{"sub": "g-123", "email": "Admin@example.com", "email_verified": true})
+
+	oauthRoundTrip(t, "google", "good-code")
+	user := store.user("google", "g-123")
+	if assert.NotNil(t, user) {
+		assert.True(t, strings.HasPrefix(user.username, "Admin_"), user.username)
+		assert.False(t, usernameReserved(user.username))
+	}
+}
+
+func TestOAuthUnverifiedEmail(t *testing.T) {
+	initRedis(t)
+	store := initOAuthStore(t, &oauthStoreUser{id: 7, username: "vishnu", email: "vishnu@example.com"})
+	initOAuthProvider(t, "google", map[string]interface{}{"sub": "g-123", "email": "vishnu@example.com", "email_verified": false})
+
+	fragment := oauthRoundTrip(t, "google", "good-code")
+	assert.Equal(t, "email_unverified", fragment.Get("error"))
+	assert.Nil(t, store.user("google", "g-123"), "an unverified email must not take over the account")
+}
+
+func TestOAuthCallbackFailures(t *testing.T) {
+	initRedis(t)
+	initOAuthStore(t)
+	initOAuthProvider(t, "google", googleProfileJSON)
+
+	assert.Equal(t, "oauth_failed", oauthRoundTrip(t, "google", "bad-code").Get("error"))
+
+	// Without the state cookie, the callback could be a forged login.
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/auth/oauth/google/callback?code=good-code&state=guessed", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid_oauth_state")
+}
+
+func TestOAuthUsername(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "vishnu.reddy", oauthUsername(oauthProfile{Email: "vishnu.reddy@example.com"}))
+	assert.Equal(t, "octo-cat", oauthUsername(oauthProfile{Username: "octo-cat", Email: "x@example.com"}))
+	assert.Equal(t, "user", oauthUsername(oauthProfile{Email: "+++@example.com"}))
+	assert.Len(t, oauthUsername(oauthProfile{Username: strings.Repeat("a", 200)}), cfg.MaxUsernameLength-5)
+}
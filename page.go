@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// pageTotalTTL is how long the total of a list is cached. Lists change
+// under the cache, so a total may be that much behind.
+const pageTotalTTL = 30 * time.Second
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// Page is a page of a list endpoint. NextCursor is the ID of the last item,
+// which the client passes as cursor to get the page after it; it is null
+// on the last page. Total counts the whole list, not just this page.
+type Page[T any] struct {
+	Items      []T     `json:"items"`
+	Total      int64   `json:"total"`
+	NextCursor *string `json:"next_cursor"`
+	HasNext    bool    `json:"has_next"`
+}
+
+// newPage makes a page of items read with a limit of one more than limit,
+// so that the extra item tells whether there is a next page. id returns the
+// cursor of an item.
+func newPage[T any](items []T, limit int, total int64, id func(T) int) Page[T] {
+	return newKeyedPage(items, limit, total, func(item T) string { return strconv.Itoa(id(item)) })
+}
+
+// newKeyedPage is newPage for lists whose items are not known by a number;
+// key returns the cursor of an item.
+func newKeyedPage[T any](items []T, limit int, total int64, key func(T) string) Page[T] {
+	page := Page[T]{Items: items, Total: total}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.HasNext = true
+		cursor := key(page.Items[limit-1])
+		page.NextCursor = &cursor
+	}
+	return page
+}
+
+func writePage[T any](w http.ResponseWriter, page Page[T]) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseLimit reads the limit of a page request, def if there is none.
+func parseLimit(query url.Values, def, max int) (int, error) {
+	value := query.Get("limit")
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(max))
+	}
+	return n, nil
+}
+
+// parseCursor reads the cursor of a page request, returning nil for the
+// first page.
+func parseCursor(query url.Values) (*int, error) {
+	value := query.Get("cursor")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 1 {
+		return nil, errInvalidCursor
+	}
+	return &id, nil
+}
+
+func pageTotalKey(list string) string {
+	return fmt.Sprintf("page_total:%s", list)
+}
+
+// countTotal returns the result of the COUNT query, cached under the list's
+// name for pageTotalTTL. When Redis fails the query is run every time.
+func countTotal(ctx context.Context, list, query string, args ...interface{}) (int64, error) {
+	key := pageTotalKey(list)
+	total, err := redisCli.Get(ctx, key).Int64()
+	if err == nil {
+		return total, nil
+	} else if err != redis.Nil {
+		logger(ctx).Println("Failed to read list total:", err)
+	}
+
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&total); err != nil {
+		return 0, err
+	}
+	if err := redisCli.Set(ctx, key, total, pageTotalTTL).Err(); err != nil {
+		logger(ctx).Println("Failed to cache list total:", err)
+	}
+	return total, nil
+}
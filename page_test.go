@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// totalStore answers COUNT queries with its total and counts them.
+type totalStore struct {
+	total   atomic.Int64
+	queries atomic.Int64
+}
+
+func (s *totalStore) Connect(context.Context) (driver.Conn, error) {
+	return totalConn{store: s}, nil
+}
+
+func (s *totalStore) Driver() driver.Driver { return nil }
+
+type totalConn struct {
+	fakeConn
+	store *totalStore
+}
+
+func (c totalConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT COUNT(*)") {
+		return nil, errors.New("not supported")
+	}
+	c.store.queries.Add(1)
+	return &tableRows{columns: []string{"count"}, rows: [][]driver.Value{{c.store.total.Load()}}}, nil
+}
+
+func TestNewPage(t *testing.T) {
+	id := func(n int) int { return n }
+
+	page := newPage([]int{5, 4, 3}, 2, 10, id)
+	assert.Equal(t, []int{5, 4}, page.Items)
+	assert.True(t, page.HasNext)
+	if assert.NotNil(t, page.NextCursor) {
+		assert.Equal(t, "4", *page.NextCursor, "the cursor is the last item on the page")
+	}
+	assert.EqualValues(t, 10, page.Total)
+
+	page = newPage([]int{2, 1}, 2, 10, id)
+	assert.Equal(t, []int{2, 1}, page.Items)
+	assert.False(t, page.HasNext)
+	assert.Nil(t, page.NextCursor)
+
+	body, _ := json.Marshal(newPage[int](nil, 2, 0, id))
+	assert.JSONEq(t, `{"items": [], "total": 0, "next_cursor": null, "has_next": false}`, string(body))
+}
+
+func TestParseCursor(t *testing.T) {
+	cursor, err := parseCursor(url.Values{})
+	assert.NoError(t, err)
+	assert.Nil(t, cursor)
+
+	cursor, err = parseCursor(url.Values{"cursor": {"42"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 42, *cursor)
+	}
+
+	for _, value := range []string{"0", "-1", "abc"} {
+		_, err := parseCursor(url.Values{"cursor": {value}})
+		assert.ErrorIs(t, err, errInvalidCursor, value)
+	}
+}
+
+func TestCountTotalIsCached(t *testing.T) {
+	mr := initRedis(t)
+	store := &totalStore{}
+	db = sql.OpenDB(store)
+	defer db.Close()
+	ctx := context.Background()
+
+	store.total.Store(3)
+	total, err := countTotal(ctx, "things", "SELECT COUNT(*) FROM things")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, total)
+
+	store.total.Store(4)
+	total, _ = countTotal(ctx, "things", "SELECT COUNT(*) FROM things")
+	assert.EqualValues(t, 3, total, "the cached total is used")
+	assert.EqualValues(t, 1, store.queries.Load())
+
+	mr.FastForward(pageTotalTTL + time.Second)
+	total, _ = countTotal(ctx, "things", "SELECT COUNT(*) FROM things")
+	assert.EqualValues(t, 4, total)
+	assert.EqualValues(t, 2, store.queries.Load())
+}
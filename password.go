@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordBytes = 72
+)
+
+var passwordChangeLimiter = failureLimiter{prefix: "password", limit: 5, window: 15 * time.Minute}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters")
+	}
+	if len(password) > maxPasswordBytes {
+		return errors.New("password must be at most 72 bytes")
+	}
+	return nil
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.changePassword")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if claims == nil || claims.UserID != userID {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	subject := strconv.Itoa(userID)
+	retryAfter, err := passwordChangeLimiter.blocked(ctx, subject)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to check rate limit")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	var passwordHash string
+	err = db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE user_id = $1", userID).Scan(&passwordHash)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound)
+		return
+	}
+
+	if err := checkPassword([]byte(passwordHash), req.CurrentPassword); err != nil {
+		if _, err := passwordChangeLimiter.fail(ctx, subject); err != nil {
+			logger(ctx).Println("Failed to record password change failure:", err)
+		}
+		WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Current password is incorrect")
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to hash password")
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE users SET password_hash = $1 WHERE user_id = $2", hashedPassword, userID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(ctx, userID, claims.ID); err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to revoke sessions")
+		return
+	}
+
+	if err := passwordChangeLimiter.reset(ctx, subject); err != nil {
+		logger(ctx).Println("Failed to reset password change failures:", err)
+	}
+	recordAudit(ctx, claims.UserID, "password_change", userTarget(userID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidatePassword(t *testing.T) {
+	t.Parallel()
+	assert.Error(t, validatePassword("short"))
+	assert.NoError(t, validatePassword("longenough"))
+	assert.Error(t, validatePassword(strings.Repeat("a", 73)))
+}
+
+func changePasswordRequestFor(userID int, token string, body changePasswordRequest) *http.Request {
+	jsonData, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/users/"+strconv.Itoa(userID)+"/password", bytes.NewBuffer(jsonData))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(userID)})
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestChangePassword(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("oldpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := insertTestUser(t, string(hash))
+
+	ctx := context.Background()
+	currentToken, err := createSession(ctx, userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := createSession(ctx, userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	requireAuth(changePassword)(rr, changePasswordRequestFor(userID, currentToken,
+		changePasswordRequest{CurrentPassword: "oldpassword", NewPassword: "newpassword"}))
+	assert.Equal(t, http.StatusNoContent, rr.Code, "handler returned wrong status code")
+
+	var storedHash string
+	if err := db.QueryRow("SELECT password_hash FROM users WHERE user_id = $1", userID).Scan(&storedHash); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(storedHash), []byte("newpassword")))
+
+	// The session used for the change survives, every other one is revoked.
+	rr = httptest.NewRecorder()
+	requireAuth(changePassword)(rr, changePasswordRequestFor(userID, otherToken,
+		changePasswordRequest{CurrentPassword: "newpassword", NewPassword: "otherpassword"}))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "revoked session was accepted")
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ws/{userID}", requireAuth(handleWebSocket))
+	server := newTestServer(t, r)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + strconv.Itoa(userID) + "?token="
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+otherToken, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "websocket accepted a revoked token")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+currentToken, nil)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func TestChangePasswordRateLimited(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("oldpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := insertTestUser(t, string(hash))
+
+	token, err := createSession(context.Background(), userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := changePasswordRequest{CurrentPassword: "wrongpassword", NewPassword: "newpassword"}
+	for i := int64(0); i < passwordChangeLimiter.limit; i++ {
+		rr := httptest.NewRecorder()
+		requireAuth(changePassword)(rr, changePasswordRequestFor(userID, token, wrong))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, "handler returned wrong status code")
+	}
+
+	// Even the right password is refused until the window passes.
+	rr := httptest.NewRecorder()
+	requireAuth(changePassword)(rr, changePasswordRequestFor(userID, token,
+		changePasswordRequest{CurrentPassword: "oldpassword", NewPassword: "newpassword"}))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "handler returned wrong status code")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
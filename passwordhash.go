@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordHashBcrypt   = "bcrypt"
+	passwordHashArgon2id = "argon2id"
+)
+
+// argon2id parameters of new hashes, as recommended by RFC 9106 for
+// memory-constrained servers: 64 MiB, three passes.
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	errPasswordMismatch = errors.New("password does not match")
+	errUnknownHash      = errors.New("unknown password hash format")
+)
+
+// argon2Hash is a parsed argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// hashPassword hashes the password with cfg.PasswordHash, bcrypt at
+// cfg.BcryptCost unless it is "argon2id".
+func hashPassword(password string) (string, error) {
+	if cfg.PasswordHash == passwordHashArgon2id {
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cfg.BcryptCost)
+	return string(hash), err
+}
+
+// checkPassword returns nil if the password matches the hash, whichever
+// algorithm made it, and errPasswordMismatch if it does not.
+func checkPassword(hash []byte, password string) error {
+	if strings.HasPrefix(string(hash), "$argon2id$") {
+		h, err := parseArgon2Hash(string(hash))
+		if err != nil {
+			return err
+		}
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		if subtle.ConstantTimeCompare(key, h.key) != 1 {
+			return errPasswordMismatch
+		}
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return errPasswordMismatch
+	}
+	return err
+}
+
+// passwordNeedsRehash tells whether a hash is weaker than what hashPassword
+// makes now: bcrypt below cfg.BcryptCost, bcrypt when argon2id is
+// configured, or argon2id with lighter parameters. An argon2id hash is
+// never turned back into bcrypt.
+func passwordNeedsRehash(hash []byte) bool {
+	if strings.HasPrefix(string(hash), "$argon2id$") {
+		h, err := parseArgon2Hash(string(hash))
+		if err != nil {
+			return false
+		}
+		return cfg.PasswordHash == passwordHashArgon2id &&
+			(h.memory < argon2Memory || h.time < argon2Time || len(h.key) < argon2KeyLen)
+	}
+	if cfg.PasswordHash == passwordHashArgon2id {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost < cfg.BcryptCost
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != passwordHashArgon2id {
+		return h, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, errUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, errUnknownHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, errUnknownHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errUnknownHash
+	}
+	return h, nil
+}
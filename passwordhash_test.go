@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPasswordMixedAlgorithms(t *testing.T) {
+	defer func(algorithm string, cost int) { cfg.PasswordHash, cfg.BcryptCost = algorithm, cost }(cfg.PasswordHash, cfg.BcryptCost)
+	cfg.BcryptCost = bcrypt.MinCost
+
+	cfg.PasswordHash = passwordHashBcrypt
+	bcryptHash, err := hashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PasswordHash = passwordHashArgon2id
+	argon2Hash, err := hashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(bcryptHash, "$2a$"), bcryptHash)
+	assert.True(t, strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=65536,t=3,p=4$"), argon2Hash)
+
+	// Either configuration verifies hashes of both algorithms.
+	for _, algorithm := range []string{passwordHashBcrypt, passwordHashArgon2id} {
+		cfg.PasswordHash = algorithm
+		for _, hash := range []string{bcryptHash, argon2Hash} {
+			assert.NoError(t, checkPassword([]byte(hash), "password123"))
+			assert.Equal(t, errPasswordMismatch, checkPassword([]byte(hash), "password124"))
+		}
+	}
+
+	assert.Equal(t, errUnknownHash, checkPassword([]byte("$argon2id$v=19$garbage"), "password123"))
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	defer func(algorithm string, cost int) { cfg.PasswordHash, cfg.BcryptCost = algorithm, cost }(cfg.PasswordHash, cfg.BcryptCost)
+	weak, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	strong, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost+1)
+	lightArgon2 := []byte("$argon2id$v=19$m=4096,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5")
+
+	cfg.PasswordHash = passwordHashBcrypt
+	cfg.BcryptCost = bcrypt.MinCost + 1
+	assert.True(t, passwordNeedsRehash(weak))
+	assert.False(t, passwordNeedsRehash(strong))
+	assert.False(t, passwordNeedsRehash(lightArgon2), "argon2id is not downgraded to bcrypt")
+
+	cfg.PasswordHash = passwordHashArgon2id
+	assert.True(t, passwordNeedsRehash(strong))
+	assert.True(t, passwordNeedsRehash(lightArgon2))
+	current, err := hashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, passwordNeedsRehash([]byte(current)))
+}
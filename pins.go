@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultPinListLimit = 50
+	maxPinListLimit     = 200
+)
+
+var (
+	errPinnedMessageNotFound = errors.New("message not found in this conversation")
+	errPinnedMessageDeleted  = errors.New("message has been deleted")
+	errPinCapReached         = errors.New("too many pinned messages")
+)
+
+// Pin is a pinned message of a conversation. Pins are listed in the order
+// they were made.
+type Pin struct {
+	Position int       `json:"position"`
+	PinnedBy int       `json:"pinned_by,omitempty"`
+	PinnedAt time.Time `json:"pinned_at"`
+	Message  Message   `json:"message"`
+}
+
+// PinEvent tells the members of a conversation that a message was pinned
+// or unpinned.
+type PinEvent struct {
+	Type         string `json:"type"`
+	Conversation string `json:"conversation"`
+	MessageID    int    `json:"message_id"`
+	UserID       int    `json:"user_id,omitempty"`
+}
+
+// pinTarget is the conversation and message a pin route names. Rooms pin
+// their stored messages, the ones members sent and the system messages,
+// direct conversations their messages.
+type pinTarget struct {
+	conversation string
+	roomID       int
+	messageID    int
+}
+
+// column is the column of pins that holds the target's message.
+func (t pinTarget) column() string {
+	if t.roomID != 0 {
+		return "room_message_id"
+	}
+	return "message_id"
+}
+
+// parsePinTarget reads the room or conversation key and the message of a
+// pin route. A conversation key must name a direct conversation.
+func parsePinTarget(r *http.Request, withMessage bool) (pinTarget, error) {
+	vars := mux.Vars(r)
+	var t pinTarget
+	if id, ok := vars["id"]; ok {
+		roomID, err := strconv.Atoi(id)
+		if err != nil {
+			return t, errors.New("Invalid room id")
+		}
+		t.roomID, t.conversation = roomID, conversationKey(Message{RoomID: roomID})
+	} else {
+		t.conversation = vars["key"]
+		if !strings.HasPrefix(t.conversation, "dm:") {
+			return t, errInvalidConversationKey
+		}
+	}
+	if withMessage {
+		messageID, err := strconv.Atoi(vars["messageID"])
+		if err != nil {
+			return t, errors.New("Invalid message id")
+		}
+		t.messageID = messageID
+	}
+	return t, nil
+}
+
+// authorizePins answers the request and returns false unless the caller
+// may see the pins of the conversation or, with manage, change them. Room
+// members see a room's pins and its admins change them; both participants
+// of a direct conversation do both.
+func authorizePins(ctx context.Context, w http.ResponseWriter, claims *Claims, t pinTarget, manage bool) bool {
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return false
+	}
+	if t.roomID != 0 && manage {
+		_, ok := requireRoomAdmin(ctx, w, t.roomID, claims)
+		return ok
+	}
+	if t.roomID != 0 && claims.Role == RoleAdmin {
+		return true
+	}
+	if err := canReadConversation(ctx, t.conversation, claims.UserID); err == errInvalidConversationKey {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return false
+	} else if err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return false
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// checkPinnable returns errPinnedMessageNotFound unless the message belongs
+// to the conversation, and errPinnedMessageDeleted if it was deleted or has
+// expired.
+func checkPinnable(ctx context.Context, t pinTarget) error {
+	if t.roomID != 0 {
+		var deleted bool
+		err := db.QueryRowContext(ctx,
+			`SELECT text = $3 OR COALESCE(expires_at <= NOW(), false)
+			FROM room_messages WHERE message_id = $1 AND room_id = $2`, t.messageID, t.roomID, deletedMessageText).Scan(&deleted)
+		if err == sql.ErrNoRows {
+			return errPinnedMessageNotFound
+		} else if err != nil {
+			return err
+		}
+		if deleted {
+			return errPinnedMessageDeleted
+		}
+		return nil
+	}
+
+	var msg Message
+	var deleted bool
+	err := db.QueryRowContext(ctx,
+		`SELECT sender_id, receiver_id,
+			deleted_at IS NOT NULL OR text = $2 OR COALESCE(expires_at <= NOW(), false)
+		FROM messages WHERE message_id = $1`, t.messageID, deletedMessageText).Scan(&msg.SenderID, &msg.RecipientID, &deleted)
+	if err == sql.ErrNoRows || (err == nil && conversationKey(msg) != t.conversation) {
+		return errPinnedMessageNotFound
+	} else if err != nil {
+		return err
+	}
+	if deleted {
+		return errPinnedMessageDeleted
+	}
+	return nil
+}
+
+// insertPin pins the target's message after the conversation's other pins
+// and reports whether it was not pinned already. It returns
+// errPinCapReached if the conversation has cfg.MaxPins pins. Pins of the
+// same conversation take a lock on its key in turn, so that concurrent ones
+// cannot both count the pins below the cap.
+func insertPin(ctx context.Context, t pinTarget, userID int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", t.conversation); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO pins (conversation_key, `+t.column()+`, pinned_by, position)
+		SELECT $1, $2, $3, COALESCE(MAX(position), 0) + 1 FROM pins WHERE conversation_key = $1
+		HAVING COUNT(*) < $4
+		ON CONFLICT DO NOTHING`, t.conversation, t.messageID, userID, cfg.MaxPins)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, tx.Commit()
+	}
+
+	var pinned bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pins WHERE conversation_key = $1 AND "+t.column()+" = $2)",
+		t.conversation, t.messageID).Scan(&pinned)
+	if err != nil {
+		return false, err
+	}
+	if !pinned {
+		return false, errPinCapReached
+	}
+	return false, nil
+}
+
+// notifyPin sends the event to the members of its conversation and drops
+// the cached count of its pins.
+func notifyPin(ctx context.Context, event PinEvent) {
+	if err := redisCli.Del(ctx, pageTotalKey("pins:"+event.Conversation)).Err(); err != nil {
+		logger(ctx).Println("Failed to drop pin count:", err)
+	}
+	conv, err := parseConversation(event.Conversation)
+	if err == nil {
+		err = conv.Broadcast(ctx, event)
+	}
+	if err != nil {
+		logger(ctx).Println("Failed to notify pin:", err)
+	}
+}
+
+// pinMessage pins a message of the room or direct conversation in the path,
+// after the ones pinned before it. Pinning a pinned message does nothing.
+func pinMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.pinMessage")
+	defer span.End()
+
+	t, err := parsePinTarget(r, true)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.String("chat.conversation", t.conversation), attribute.Int("chat.message_id", t.messageID))
+
+	claims := claimsFromContext(ctx)
+	if !authorizePins(ctx, w, claims, t, true) {
+		return
+	}
+	if err := checkPinnable(ctx, t); err == errPinnedMessageNotFound {
+		WriteError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err == errPinnedMessageDeleted {
+		WriteError(w, http.StatusGone, codeGone, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	pinned, err := insertPin(ctx, t, claims.UserID)
+	if err == errPinCapReached {
+		WriteError(w, http.StatusConflict, codeConflict, fmt.Sprintf("a conversation can have at most %d pinned messages", cfg.MaxPins))
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !pinned {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	notifyPin(ctx, PinEvent{Type: "message_pinned", Conversation: t.conversation, MessageID: t.messageID, UserID: claims.UserID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unpinMessage unpins a message of the room or direct conversation in the
+// path.
+func unpinMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.unpinMessage")
+	defer span.End()
+
+	t, err := parsePinTarget(r, true)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.String("chat.conversation", t.conversation), attribute.Int("chat.message_id", t.messageID))
+
+	claims := claimsFromContext(ctx)
+	if !authorizePins(ctx, w, claims, t, true) {
+		return
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM pins WHERE conversation_key = $1 AND "+t.column()+" = $2", t.conversation, t.messageID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Pin not found")
+		return
+	}
+	notifyPin(ctx, PinEvent{Type: "message_unpinned", Conversation: t.conversation, MessageID: t.messageID, UserID: claims.UserID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPins returns a page of the pins of the room or direct conversation in
+// the path with the messages they hold. cursor, the next_cursor of the
+// previous page, is the message of the last pin on it.
+func listPins(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listPins")
+	defer span.End()
+
+	t, err := parsePinTarget(r, false)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.String("chat.conversation", t.conversation))
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultPinListLimit, maxPinListLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if !authorizePins(ctx, w, claimsFromContext(ctx), t, false) {
+		return
+	}
+
+	after := `($2::int IS NULL OR (p.position, p.pin_id) >
+			(SELECT position, pin_id FROM pins WHERE conversation_key = $1 AND ` + t.column() + ` = $2))`
+	stmt := `SELECT p.position, COALESCE(p.pinned_by, 0), p.created_at,
+			m.message_id, '', m.sender_id, m.receiver_id, 0, m.text, m.created_at, m.updated_at
+		FROM pins p JOIN messages m ON m.message_id = p.message_id
+		WHERE p.conversation_key = $1 AND ` + after + `
+		ORDER BY p.position, p.pin_id
+		LIMIT $3`
+	if t.roomID != 0 {
+		stmt = `SELECT p.position, COALESCE(p.pinned_by, 0), p.created_at,
+			m.message_id, m.kind, m.sender_id, 0, m.room_id, m.text, m.created_at, m.created_at
+		FROM pins p JOIN room_messages m ON m.message_id = p.room_message_id
+		WHERE p.conversation_key = $1 AND ` + after + `
+		ORDER BY p.position, p.pin_id
+		LIMIT $3`
+	}
+	rows, err := db.QueryContext(ctx, stmt, t.conversation, cursor, limit+1)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	pins := []Pin{}
+	for rows.Next() {
+		var pin Pin
+		msg := &pin.Message
+		err := rows.Scan(&pin.Position, &pin.PinnedBy, &pin.PinnedAt,
+			&msg.ID, &msg.Kind, &msg.SenderID, &msg.RecipientID, &msg.RoomID, &msg.Text, &msg.CreatedAt, &msg.UpdatedAt)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		msg.Kind = roomMessageKind(msg.Kind)
+		pins = append(pins, pin)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, "pins:"+t.conversation, "SELECT COUNT(*) FROM pins WHERE conversation_key = $1", t.conversation)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(pins, limit, total, func(pin Pin) int { return pin.Message.ID }))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pinStore is a roleStore whose room 7 has stored messages 1 to 3 and that
+// keeps the pins of the room, honouring the cap it is given.
+type pinStore struct {
+	*roleStore
+	pinned []int64
+}
+
+func (s *pinStore) Connect(context.Context) (driver.Conn, error) {
+	return pinConn{roleConn: roleConn{store: s.roleStore}, store: s}, nil
+}
+
+type pinConn struct {
+	roleConn
+	store *pinStore
+}
+
+func (c pinConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT text = $3"):
+		id := args[0].Value.(int64)
+		return &valueRows{column: "deleted", value: false, done: id < 1 || id > 3}, nil
+	case strings.HasPrefix(query, "SELECT EXISTS (SELECT 1 FROM pins"):
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		return &valueRows{column: "exists", value: c.store.index(args[1].Value.(int64)) >= 0}, nil
+	}
+	return c.roleConn.QueryContext(ctx, query, args)
+}
+
+func (c pinConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.store
+	switch {
+	case strings.HasPrefix(query, "SELECT pg_advisory_xact_lock"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(query, "INSERT INTO pins"):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id := args[1].Value.(int64)
+		if s.index(id) >= 0 || int64(len(s.pinned)) >= args[3].Value.(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		s.pinned = append(s.pinned, id)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM pins"):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		i := s.index(args[1].Value.(int64))
+		if i < 0 {
+			return driver.RowsAffected(0), nil
+		}
+		s.pinned = append(s.pinned[:i], s.pinned[i+1:]...)
+		return driver.RowsAffected(1), nil
+	}
+	return c.roleConn.ExecContext(ctx, query, args)
+}
+
+func (s *pinStore) index(messageID int64) int {
+	for i, id := range s.pinned {
+		if id == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRoomPins(t *testing.T) {
+	store := &pinStore{roleStore: initRoleStore(t)}
+	db.Close()
+	db = sql.OpenDB(store)
+	defer func(max int) { cfg.MaxPins = max }(cfg.MaxPins)
+	cfg.MaxPins = 2
+	server := newTestServer(t, newRouter())
+	member := dialTestUser(t, server, 3)
+	waitForClients(t, 1)
+
+	do := func(actor int, method, path string) int {
+		rr := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(rr, authedRequest(t, actor, method, path, nil))
+		return rr.Code
+	}
+	readEvent := func() PinEvent {
+		member.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var event PinEvent
+		if err := member.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	assert.Equal(t, http.StatusNoContent, do(2, "POST", "/rooms/7/pins/1"))
+	assert.Equal(t, PinEvent{Type: "message_pinned", Conversation: "room:7", MessageID: 1, UserID: 2}, readEvent())
+	assert.Equal(t, http.StatusNoContent, do(1, "POST", "/rooms/7/pins/1"), "pinning again does nothing")
+	assert.Equal(t, http.StatusForbidden, do(3, "POST", "/rooms/7/pins/2"), "members cannot pin")
+	assert.Equal(t, http.StatusNotFound, do(1, "POST", "/rooms/7/pins/9"))
+	assert.Equal(t, http.StatusBadRequest, do(1, "POST", "/rooms/7/pins/x"))
+
+	assert.Equal(t, http.StatusNoContent, do(1, "POST", "/rooms/7/pins/2"))
+	assert.Equal(t, PinEvent{Type: "message_pinned", Conversation: "room:7", MessageID: 2, UserID: 1}, readEvent())
+	assert.Equal(t, http.StatusConflict, do(1, "POST", "/rooms/7/pins/3"), "the room is at the cap")
+
+	assert.Equal(t, http.StatusForbidden, do(3, "DELETE", "/rooms/7/pins/1"))
+	assert.Equal(t, http.StatusNoContent, do(2, "DELETE", "/rooms/7/pins/1"))
+	assert.Equal(t, PinEvent{Type: "message_unpinned", Conversation: "room:7", MessageID: 1, UserID: 2}, readEvent())
+	assert.Equal(t, http.StatusNotFound, do(2, "DELETE", "/rooms/7/pins/1"))
+	assert.Equal(t, http.StatusNoContent, do(1, "POST", "/rooms/7/pins/3"), "unpinning makes room")
+	assert.Equal(t, []int64{2, 3}, store.pinned)
+}
+
+func TestDirectPinsRejections(t *testing.T) {
+	initRedis(t)
+	router := newRouter()
+	cases := []struct {
+		path string
+		want int
+	}{
+		{"/conversations/dm:1:2/pins/x", http.StatusBadRequest},
+		{"/conversations/room:7/pins/1", http.StatusBadRequest},
+		{"/conversations/dm:2:1/pins/1", http.StatusBadRequest},
+		{"/conversations/dm:2:3/pins/1", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 1, "POST", tc.path, nil))
+		assert.Equal(t, tc.want, rr.Code, tc.path)
+	}
+}
+
+func TestPinsDeletionCascade(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	a, b, outsider := insertTestUser(t, "hash"), insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	var sent []Message
+	for _, text := range []string{"first", "second", "third"} {
+		msg, err := storeMessage(ctx, Message{SenderID: a, RecipientID: b, Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	conversation := conversationKey(sent[0])
+	pinPath := func(msg Message) string {
+		return fmt.Sprintf("/conversations/%s/pins/%d", conversation, msg.ID)
+	}
+	do := func(userID int, method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, nil))
+		return rr
+	}
+	pinned := func() []string {
+		rr := do(b, "GET", "/conversations/"+conversation+"/pins")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var pins Page[Pin]
+		if err := json.NewDecoder(rr.Body).Decode(&pins); err != nil {
+			t.Fatal(err)
+		}
+		texts := []string{}
+		for _, pin := range pins.Items {
+			texts = append(texts, pin.Message.Text)
+		}
+		return texts
+	}
+
+	defer func(max int) { cfg.MaxPins = max }(cfg.MaxPins)
+	cfg.MaxPins = 2
+	assert.Equal(t, http.StatusNoContent, do(b, "POST", pinPath(sent[1])).Code)
+	assert.Equal(t, http.StatusNoContent, do(a, "POST", pinPath(sent[0])).Code)
+	assert.Equal(t, http.StatusConflict, do(a, "POST", pinPath(sent[2])).Code)
+	assert.Equal(t, http.StatusForbidden, do(outsider, "POST", pinPath(sent[2])).Code)
+	assert.Equal(t, []string{"second", "first"}, pinned())
+
+	// Deleting a message unpins it, be it tombstoned or deleted outright as
+	// the expiry sweeper does.
+	assert.NoError(t, tombstoneMessage(ctx, sent[1]))
+	assert.Equal(t, []string{"first"}, pinned())
+	assert.Equal(t, http.StatusGone, do(a, "POST", pinPath(sent[1])).Code, "deleted messages cannot be pinned")
+	if _, err := db.Exec("DELETE FROM messages WHERE message_id = $1", sent[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, pinned())
+	assert.Equal(t, http.StatusNotFound, do(a, "POST", pinPath(sent[0])).Code)
+}
+
+func TestPinCapHoldsUnderConcurrentPins(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	a, b := insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	var sent []Message
+	for i := 0; i < 8; i++ {
+		msg, err := storeMessage(ctx, Message{SenderID: a, RecipientID: b, Text: fmt.Sprint("message ", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	conversation := conversationKey(sent[0])
+
+	defer func(max int) { cfg.MaxPins = max }(cfg.MaxPins)
+	cfg.MaxPins = 3
+	var wg sync.WaitGroup
+	for _, msg := range sent {
+		req := authedRequest(t, a, "POST", fmt.Sprintf("/conversations/%s/pins/%d", conversation, msg.ID), nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	var pins int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pins WHERE conversation_key = $1", conversation).Scan(&pins); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cfg.MaxPins, pins)
+}
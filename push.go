@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	pushQueueSize = 1024
+
+	// fcmScope is what the service account's access token must allow.
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// googleTokenURL is where service accounts get access tokens, unless
+	// their key file names another.
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+
+	// maxPushPreviewRunes is how much of the text a notification shows.
+	maxPushPreviewRunes = 100
+)
+
+var devicePlatforms = []string{"ios", "android", "web"}
+
+var pushDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_push_deliveries_total",
+	Help: "Push notifications by outcome, after retries.",
+}, []string{"result"})
+
+// pushes is started in main when FCM is configured; without it nobody gets
+// push notifications.
+var pushes *PushDispatcher
+
+// DeviceToken is where FCM reaches one of the user's devices.
+type DeviceToken struct {
+	ID        int       `json:"id"`
+	Token     string    `json:"token"`
+	Platform  string    `json:"platform"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type registerDeviceTokenRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+// registerDeviceToken adds a device of the user. A token registered before,
+// by this user or another one, moves to this user: the device changed
+// hands or its app logged in again.
+func registerDeviceToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.registerDeviceToken")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var req registerDeviceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.Token == "" || len(req.Token) > 4096 {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "token must be 1 to 4096 bytes")
+		return
+	}
+	if !slices.Contains(devicePlatforms, req.Platform) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, `platform must be "ios", "android" or "web"`)
+		return
+	}
+
+	token := DeviceToken{Token: req.Token, Platform: req.Platform}
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO device_tokens (user_id, token, platform) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET user_id = EXCLUDED.user_id, platform = EXCLUDED.platform, created_at = NOW()
+		RETURNING id, created_at`, userID, req.Token, req.Platform).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// deleteDeviceToken removes a device of the user, such as on logout.
+func deleteDeviceToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.deleteDeviceToken")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	tokenID, err := strconv.Atoi(vars["tokenID"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid device token id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM device_tokens WHERE id = $1 AND user_id = $2", tokenID, userID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Device token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyPush hands a delivered message to the dispatcher, if it runs.
+func notifyPush(msg Message) {
+	if pushes != nil {
+		pushes.Notify(msg)
+	}
+}
+
+// fcmRequest is the body of an FCM v1 send.
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification fcmNotification   `json:"notification"`
+	Data         map[string]string `json:"data"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type pushDelivery struct {
+	token   DeviceToken
+	message Message
+}
+
+// errStaleDeviceToken is FCM saying the token no longer reaches a device.
+var errStaleDeviceToken = errors.New("device token is no longer registered")
+
+// PushDispatcher sends FCM notifications of messages to the devices of
+// recipients who have no connection open here, off the request path.
+// Recipients who muted the conversation are left alone. A send that fails
+// for a reason other than the token is retried with exponential backoff;
+// tokens FCM no longer knows are deleted.
+type PushDispatcher struct {
+	db      *sql.DB
+	client  *http.Client
+	sendURL string
+	policy  retryPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu         sync.RWMutex
+	closed     bool
+	messages   chan Message
+	deliveries chan pushDelivery
+}
+
+func pushRetryPolicy(c Config) retryPolicy {
+	return retryPolicy{
+		Attempts:   c.PushAttempts,
+		Backoff:    c.PushBackoff,
+		MaxBackoff: c.PushMaxBackoff,
+	}
+}
+
+// fcmSendURL is where notifications for the Firebase project are sent.
+func fcmSendURL(projectID string) string {
+	return "https://fcm.googleapis.com/v1/projects/" + projectID + "/messages:send"
+}
+
+// fcmClient returns a client that authenticates as the service account of
+// the key file, exchanging a JWT signed with its key for access tokens.
+func fcmClient(credentialsFile string, timeout time.Duration) (*http.Client, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", credentialsFile, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("%s: not a service account key", credentialsFile)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = googleTokenURL
+	}
+	conf := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Scopes:       []string{fcmScope},
+		TokenURL:     key.TokenURI,
+	}
+	// The token requests go through the same timeout as the sends.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: timeout})
+	client := conf.Client(ctx)
+	client.Timeout = timeout
+	return client, nil
+}
+
+func NewPushDispatcher(d *sql.DB, client *http.Client, sendURL string, workers int, policy retryPolicy) *PushDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pd := &PushDispatcher{
+		db:         d,
+		client:     client,
+		sendURL:    sendURL,
+		policy:     policy,
+		ctx:        ctx,
+		cancel:     cancel,
+		messages:   make(chan Message, pushQueueSize),
+		deliveries: make(chan pushDelivery, pushQueueSize),
+	}
+	pd.wg.Add(1)
+	go pd.route()
+	for i := 0; i < workers; i++ {
+		pd.wg.Add(1)
+		go pd.work()
+	}
+	return pd
+}
+
+// Notify queues a message for the devices of its offline recipients. It
+// never blocks: when the queue is full the message is dropped.
+func (d *PushDispatcher) Notify(msg Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.messages <- msg:
+	default:
+		pushDeliveries.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Close stops accepting messages and abandons retries, returning once every
+// worker has stopped.
+func (d *PushDispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.messages)
+	}
+	d.mu.Unlock()
+	d.cancel()
+	d.wg.Wait()
+}
+
+// route looks up the devices of each message's offline recipients and
+// queues a delivery for each of them.
+func (d *PushDispatcher) route() {
+	defer d.wg.Done()
+	defer close(d.deliveries)
+	for msg := range d.messages {
+		if d.ctx.Err() != nil {
+			return
+		}
+		// System messages such as a member joining are not worth a
+		// notification.
+		if msg.Kind == MessageKindSystem {
+			continue
+		}
+		offline, err := offlineRecipients(d.ctx, msg)
+		if err != nil {
+			log.Println("Failed to look up push recipients:", err)
+			continue
+		}
+		if len(offline) == 0 {
+			continue
+		}
+		tokens, err := d.deviceTokens(d.ctx, offline)
+		if err != nil {
+			log.Println("Failed to look up device tokens:", err)
+			continue
+		}
+		for _, token := range tokens {
+			select {
+			case d.deliveries <- pushDelivery{token: token, message: msg}:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// offlineRecipients returns the recipients of the message who have no
+// connection open here, did not mute the conversation and are not in
+// do-not-disturb.
+func offlineRecipients(ctx context.Context, msg Message) ([]int64, error) {
+	participants, err := conversationOf(msg).Participants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unmuted, _ := splitMuted(ctx, conversationKey(msg), messageRecipients(msg, userIDStrings(participants)))
+	var ids []string
+	for _, id := range unmuted {
+		if len(registry.Connections(id)) == 0 {
+			ids = append(ids, id)
+		}
+	}
+	dnd := usersInDND(ctx, ids)
+	var offline []int64
+	for _, id := range ids {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && !dnd[id] {
+			offline = append(offline, n)
+		}
+	}
+	return offline, nil
+}
+
+func (d *PushDispatcher) deviceTokens(ctx context.Context, userIDs []int64) ([]DeviceToken, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id, token, platform FROM device_tokens WHERE user_id = ANY($1)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []DeviceToken
+	for rows.Next() {
+		var token DeviceToken
+		if err := rows.Scan(&token.ID, &token.Token, &token.Platform); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (d *PushDispatcher) work() {
+	defer d.wg.Done()
+	for delivery := range d.deliveries {
+		err := d.deliver(d.ctx, delivery)
+		switch {
+		case err == nil:
+			pushDeliveries.WithLabelValues("delivered").Inc()
+		case errors.Is(err, context.Canceled):
+		case errors.Is(err, errStaleDeviceToken):
+			pushDeliveries.WithLabelValues("stale").Inc()
+			d.removeToken(delivery.token)
+		default:
+			pushDeliveries.WithLabelValues("failed").Inc()
+			log.Printf("Push to device token %d failed: %v", delivery.token.ID, err)
+		}
+	}
+}
+
+// deliver sends the notification until FCM accepts it, refuses it for good
+// or the policy runs out of attempts, and returns the last error.
+func (d *PushDispatcher) deliver(ctx context.Context, delivery pushDelivery) error {
+	body, err := json.Marshal(fcmRequest{Message: pushMessage(delivery.token.Token, delivery.message)})
+	if err != nil {
+		return err
+	}
+	backoff := d.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(ctx, body)
+		if err == nil || !retry || attempt >= d.policy.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = min(backoff*2, d.policy.MaxBackoff)
+	}
+}
+
+// post sends one notification. It reports whether a failure is worth
+// retrying: FCM being unavailable or throttling is, a rejected request is
+// not.
+func (d *PushDispatcher) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.sendURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, errStaleDeviceToken
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("FCM answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("FCM answered %s", resp.Status)
+}
+
+// removeToken deletes a token FCM no longer knows, unless it was registered
+// again in the meantime.
+func (d *PushDispatcher) removeToken(token DeviceToken) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := d.db.ExecContext(ctx, "DELETE FROM device_tokens WHERE id = $1 AND token = $2", token.ID, token.Token); err != nil {
+		log.Println("Failed to remove stale device token:", err)
+	}
+}
+
+// pushMessage is the notification of msg for the device. Encrypted texts
+// cannot be shown, and others are cut to a preview.
+func pushMessage(token string, msg Message) fcmMessage {
+	body := msg.Text
+	if msg.Encrypted {
+		body = "Encrypted message"
+	} else if utf8.RuneCountInString(body) > maxPushPreviewRunes {
+		body = string([]rune(body)[:maxPushPreviewRunes]) + "…"
+	}
+	return fcmMessage{
+		Token:        token,
+		Notification: fcmNotification{Title: "New message", Body: body},
+		Data: map[string]string{
+			"message_id":   strconv.Itoa(msg.ID),
+			"sender_id":    strconv.Itoa(msg.SenderID),
+			"conversation": conversationKey(msg),
+		},
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type storedDeviceToken struct {
+	DeviceToken
+	userID int64
+}
+
+// pushStore holds device tokens and records the ones removed as stale.
+type pushStore struct {
+	mu      sync.Mutex
+	nextID  int
+	tokens  []storedDeviceToken
+	removed []int
+}
+
+func (s *pushStore) Connect(context.Context) (driver.Conn, error) {
+	return pushConn{store: s}, nil
+}
+
+func (s *pushStore) Driver() driver.Driver { return nil }
+
+func (s *pushStore) add(userID int64, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.tokens = append(s.tokens, storedDeviceToken{DeviceToken{ID: s.nextID, Token: token, Platform: "android"}, userID})
+}
+
+func (s *pushStore) stored() []storedDeviceToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]storedDeviceToken(nil), s.tokens...)
+}
+
+func (s *pushStore) removedIDs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.removed...)
+}
+
+type pushConn struct {
+	fakeConn
+	store *pushStore
+}
+
+func (pushConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+func (c pushConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT id, token, platform FROM device_tokens"):
+		rows := &tableRows{columns: []string{"id", "token", "platform"}}
+		for _, t := range s.tokens {
+			for _, id := range args[0].Value.([]int64) {
+				if t.userID == id {
+					rows.rows = append(rows.rows, []driver.Value{int64(t.ID), t.Token, t.Platform})
+				}
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT INTO device_tokens"):
+		userID, token, platform := args[0].Value.(int64), args[1].Value.(string), args[2].Value.(string)
+		for i, t := range s.tokens {
+			if t.Token == token {
+				s.tokens[i].userID, s.tokens[i].Platform = userID, platform
+				return &tableRows{columns: []string{"id", "created_at"}, rows: [][]driver.Value{{int64(t.ID), insertedAt}}}, nil
+			}
+		}
+		s.nextID++
+		s.tokens = append(s.tokens, storedDeviceToken{DeviceToken{ID: s.nextID, Token: token, Platform: platform}, userID})
+		return &tableRows{columns: []string{"id", "created_at"}, rows: [][]driver.Value{{int64(s.nextID), insertedAt}}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c pushConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "DELETE FROM device_tokens") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := args[0].Value.(int64)
+	for i, t := range s.tokens {
+		if int64(t.ID) != id {
+			continue
+		}
+		if strings.Contains(query, "token = $2") && t.Token != args[1].Value.(string) ||
+			strings.Contains(query, "user_id = $2") && t.userID != args[1].Value.(int64) {
+			break
+		}
+		s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+		if strings.Contains(query, "token = $2") {
+			s.removed = append(s.removed, t.ID)
+		}
+		return driver.RowsAffected(1), nil
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// fcmServer stands in for FCM, answering each send with the next status of
+// statuses and 200 once they run out.
+type fcmServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	sent     []fcmMessage
+}
+
+func newFCMServer(t *testing.T, statuses ...int) *fcmServer {
+	s := &fcmServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req fcmRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		s.mu.Lock()
+		s.sent = append(s.sent, req.Message)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fcmServer) messages() []fcmMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fcmMessage(nil), s.sent...)
+}
+
+func startPushDispatcher(t *testing.T, fcm *fcmServer) *pushStore {
+	store := &pushStore{}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	policy := retryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	d := NewPushDispatcher(db, fcm.Client(), fcm.URL+"/v1/projects/chat/messages:send", 2, policy)
+	pushes = d
+	t.Cleanup(func() {
+		d.Close()
+		pushes = nil
+	})
+	return store
+}
+
+func TestPushToOfflineRoomMembers(t *testing.T) {
+	mr := initRedis(t)
+	fcm := newFCMServer(t)
+	store := startPushDispatcher(t, fcm)
+	mr.SAdd(roomMembersKey(9), "1", "2", "3")
+	store.add(1, "sender-phone")
+	store.add(2, "offline-phone")
+	store.add(3, "online-phone")
+	connectRecorder(t, "3")
+
+	notifyPush(Message{ID: 50, SenderID: 1, RoomID: 9, Text: "lunch?"})
+
+	assert.Eventually(t, func() bool { return len(fcm.messages()) > 0 }, 2*time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	sent := fcm.messages()
+	if assert.Len(t, sent, 1, "only the offline member who did not send it is notified") {
+		assert.Equal(t, "offline-phone", sent[0].Token)
+		assert.Equal(t, "lunch?", sent[0].Notification.Body)
+		assert.Equal(t, map[string]string{"message_id": "50", "sender_id": "1", "conversation": "room:9"}, sent[0].Data)
+	}
+}
+
+func TestPushSkipsUsersInDND(t *testing.T) {
+	mr := initRedis(t)
+	// The clock is set first so that it outlives the dispatcher.
+	useMuteClock(t, newFakeClock(time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)))
+	fcm := newFCMServer(t)
+	store := startPushDispatcher(t, fcm)
+	mr.SAdd(roomMembersKey(9), "1", "2", "3")
+	store.add(2, "sleeping-phone")
+	store.add(3, "awake-phone")
+	cacheNotificationSettings(t, "2", NotificationSettings{QuietHours: &QuietHours{Start: "22:00", End: "06:00", Timezone: "UTC"}})
+	cacheNotificationSettings(t, "3", NotificationSettings{})
+
+	notifyPush(Message{ID: 50, SenderID: 1, RoomID: 9, Text: "anyone up?"})
+
+	assert.Eventually(t, func() bool { return len(fcm.messages()) > 0 }, 2*time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	sent := fcm.messages()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "awake-phone", sent[0].Token, "quiet hours hold back pushes")
+	}
+}
+
+func TestPushHidesEncryptedText(t *testing.T) {
+	initRedis(t)
+	fcm := newFCMServer(t)
+	store := startPushDispatcher(t, fcm)
+	store.add(2, "phone")
+
+	notifyPush(Message{ID: 50, SenderID: 1, RecipientID: 2, Text: "c2VjcmV0", Encrypted: true})
+	notifyPush(Message{ID: 51, SenderID: 1, RecipientID: 2, Text: strings.Repeat("a", 150)})
+
+	assert.Eventually(t, func() bool { return len(fcm.messages()) == 2 }, 2*time.Second, 5*time.Millisecond)
+	bodies := map[string]string{}
+	for _, m := range fcm.messages() {
+		bodies[m.Data["message_id"]] = m.Notification.Body
+	}
+	assert.Equal(t, "Encrypted message", bodies["50"])
+	assert.Equal(t, strings.Repeat("a", maxPushPreviewRunes)+"…", bodies["51"])
+}
+
+func TestPushRemovesStaleToken(t *testing.T) {
+	initRedis(t)
+	fcm := newFCMServer(t, http.StatusNotFound)
+	store := startPushDispatcher(t, fcm)
+	store.add(2, "gone")
+
+	notifyPush(Message{ID: 50, SenderID: 1, RecipientID: 2, Text: "hi"})
+
+	assert.Eventually(t, func() bool { return len(store.removedIDs()) > 0 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []int{1}, store.removedIDs())
+	assert.Empty(t, store.stored())
+	assert.Len(t, fcm.messages(), 1, "a stale token is not retried")
+}
+
+func TestPushRetriesUnavailable(t *testing.T) {
+	initRedis(t)
+	fcm := newFCMServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	store := startPushDispatcher(t, fcm)
+	store.add(2, "phone")
+
+	notifyPush(Message{ID: 50, SenderID: 1, RecipientID: 2, Text: "hi"})
+
+	assert.Eventually(t, func() bool { return len(fcm.messages()) == 3 }, 2*time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, fcm.messages(), 3)
+	assert.Len(t, store.stored(), 1, "the token is kept")
+}
+
+func TestFCMClientUsesServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assertion atomic.Value
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assertion.Store(r.PostForm.Get("assertion"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "ya29.token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer tokenServer.Close()
+	var authorization atomic.Value
+	fcm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+	}))
+	defer fcm.Close()
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "chat@project.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    tokenServer.URL,
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, credentials, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := fcmClient(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(fcm.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, "Bearer ya29.token", authorization.Load())
+	assert.Len(t, strings.Split(assertion.Load().(string), "."), 3, "the token is asked for with a signed JWT")
+
+	os.WriteFile(path, []byte(`{"type": "authorized_user"}`), 0o600)
+	_, err = fcmClient(path, time.Second)
+	assert.Error(t, err)
+}
+
+func TestDeviceTokenEndpoints(t *testing.T) {
+	initRedis(t)
+	store := &pushStore{}
+	db = sql.OpenDB(store)
+	defer db.Close()
+	router := newRouter()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, 7, "POST", "/users/7/device-tokens", registerDeviceTokenRequest{Token: "abc", Platform: "ios"}))
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var token DeviceToken
+	json.NewDecoder(rr.Body).Decode(&token)
+	assert.Equal(t, DeviceToken{ID: 1, Token: "abc", Platform: "ios", CreatedAt: insertedAt}, token)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, 7, "POST", "/users/7/device-tokens", registerDeviceTokenRequest{Token: "abc", Platform: "blackberry"}))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, 8, "POST", "/users/7/device-tokens", registerDeviceTokenRequest{Token: "abc", Platform: "ios"}))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Another user's token cannot be deleted through one's own account.
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, 8, "DELETE", "/users/8/device-tokens/1", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, authedRequest(t, 7, "DELETE", "/users/7/device-tokens/1", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, store.stored())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// failureLimiter counts failed attempts per subject in Redis and blocks the
+// subject once limit failures happen within window. With a lockout the block
+// lasts that long from the failure that caused it, otherwise until the
+// window ends.
+type failureLimiter struct {
+	prefix  string
+	limit   int64
+	window  time.Duration
+	lockout time.Duration
+}
+
+func (l failureLimiter) key(subject string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", l.prefix, subject)
+}
+
+// blocked returns how long the subject must wait before trying again, or zero
+// if it is not currently blocked.
+func (l failureLimiter) blocked(ctx context.Context, subject string) (time.Duration, error) {
+	key := l.key(subject)
+	count, err := redisCli.Get(ctx, key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if count < l.limit {
+		return 0, nil
+	}
+
+	ttl, err := redisCli.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		ttl = l.window
+	}
+	return ttl, nil
+}
+
+// fail counts a failure by the subject and reports whether it is the one
+// that blocked the subject.
+func (l failureLimiter) fail(ctx context.Context, subject string) (bool, error) {
+	key := l.key(subject)
+	count, err := redisCli.Incr(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	locked := count == l.limit
+	switch {
+	case locked && l.lockout > 0:
+		return locked, redisCli.Expire(ctx, key, l.lockout).Err()
+	case count == 1:
+		return locked, redisCli.Expire(ctx, key, l.window).Err()
+	}
+	return locked, nil
+}
+
+// hit counts an attempt by the subject, successful or not, and returns how
+// long the subject must wait if the attempt went over the limit, or zero.
+func (l failureLimiter) hit(ctx context.Context, subject string) (time.Duration, error) {
+	return l.take(ctx, subject, 1)
+}
+
+// take is hit for an attempt that counts n times against the limit.
+func (l failureLimiter) take(ctx context.Context, subject string, n int64) (time.Duration, error) {
+	key := l.key(subject)
+	count, err := redisCli.IncrBy(ctx, key, n).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == n {
+		if err := redisCli.Expire(ctx, key, l.window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	if count <= l.limit {
+		return 0, nil
+	}
+
+	ttl, err := redisCli.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		ttl = l.window
+	}
+	return ttl, nil
+}
+
+func (l failureLimiter) reset(ctx context.Context, subject string) error {
+	return redisCli.Del(ctx, l.key(subject)).Err()
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	WriteError(w, http.StatusTooManyRequests, codeRateLimited, "Too many attempts, try again later")
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	reactionsCacheTTL = 24 * time.Hour
+
+	// maxEmojiPerMessage caps the distinct emoji a message can collect.
+	maxEmojiPerMessage = 25
+
+	// reactionsLoadedField is set in every hash loaded from Postgres, so
+	// that a message without reactions is told apart from one that is not
+	// cached. No emoji is empty.
+	reactionsLoadedField = ""
+)
+
+var errNotParticipant = errors.New("not a participant of this conversation")
+
+// reactionLimiter caps how often a user adds or removes reactions on one
+// message, keyed by user and message.
+var reactionLimiter = failureLimiter{prefix: "reactions", limit: 10, window: time.Minute}
+
+// adjustReaction adds ARGV[2] to the count of emoji ARGV[1] and drops the
+// field once it reaches zero. A hash that is not loaded is left alone: it
+// is read from Postgres, which already has the change, on first access.
+var adjustReaction = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local n = redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+if n <= 0 then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return n`)
+
+type reactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+// reactionsKey holds a message's reaction counts, one field per emoji.
+func reactionsKey(messageID int) string {
+	return fmt.Sprintf("msg:%d:reactions", messageID)
+}
+
+// addReaction reacts to a message with an emoji on behalf of the caller,
+// who must have sent or received it. Reacting twice with the same emoji
+// counts once.
+func addReaction(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.addReaction")
+	defer span.End()
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.message_id", messageID))
+
+	var req reactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := validateEmoji(req.Emoji); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if !checkMessageAccess(ctx, w, claims, messageID) {
+		return
+	}
+	if !allowReaction(ctx, w, claims.UserID, messageID) {
+		return
+	}
+	if full, err := emojiLimitReached(ctx, messageID, req.Emoji); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	} else if full {
+		w.Header().Set("Retry-After", strconv.Itoa(int(reactionLimiter.window.Seconds())))
+		WriteError(w, http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("a message takes at most %d different emoji", maxEmojiPerMessage))
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO reactions (message_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		messageID, claims.UserID, req.Emoji)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		updateReactionCount(ctx, messageID, req.Emoji, 1)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeReaction takes back one of the caller's reactions.
+func removeReaction(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.removeReaction")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	messageID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.message_id", messageID))
+
+	claims := claimsFromContext(ctx)
+	if !checkMessageAccess(ctx, w, claims, messageID) {
+		return
+	}
+	if !allowReaction(ctx, w, claims.UserID, messageID) {
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3",
+		messageID, claims.UserID, vars["emoji"])
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Reaction not found")
+		return
+	}
+	updateReactionCount(ctx, messageID, vars["emoji"], -1)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkMessageAccess answers the request and returns false unless the
+// caller sent or received the message. Expired messages are not found.
+func checkMessageAccess(ctx context.Context, w http.ResponseWriter, claims *Claims, messageID int) bool {
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return false
+	}
+	var senderID, recipientID int
+	err := db.QueryRowContext(ctx, `SELECT sender_id, receiver_id FROM messages
+		WHERE message_id = $1 AND deleted_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`, messageID).
+		Scan(&senderID, &recipientID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return false
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if claims.UserID != senderID && claims.UserID != recipientID {
+		WriteError(w, http.StatusForbidden, codeForbidden, errNotParticipant.Error())
+		return false
+	}
+	return true
+}
+
+// allowReaction counts a reaction change by the user on the message and
+// answers the request with 429 once they make too many.
+func allowReaction(ctx context.Context, w http.ResponseWriter, userID, messageID int) bool {
+	retryAfter, err := reactionLimiter.hit(ctx, fmt.Sprintf("%d:%d", userID, messageID))
+	if err != nil {
+		logger(ctx).Println("Failed to count reaction:", err)
+		return true
+	}
+	if retryAfter > 0 {
+		writeTooManyRequests(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+// emojiLimitReached reports whether reacting with emoji would give the
+// message more than maxEmojiPerMessage different emoji. Concurrent
+// reactions may overshoot the cap slightly.
+func emojiLimitReached(ctx context.Context, messageID int, emoji string) (bool, error) {
+	key := reactionsKey(messageID)
+	n, err := redisCli.HLen(ctx, key).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to count emoji:", err)
+	}
+	if err != nil || n == 0 {
+		messages := []Message{{ID: messageID}}
+		if err := loadReactions(ctx, messages); err != nil {
+			return false, err
+		}
+		_, ok := messages[0].Reactions[emoji]
+		return !ok && len(messages[0].Reactions) >= maxEmojiPerMessage, nil
+	}
+	ok, err := redisCli.HExists(ctx, key, emoji).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to count emoji:", err)
+		return false, nil
+	}
+	// The hash has a field marking it loaded besides the emoji.
+	return !ok && n-1 >= maxEmojiPerMessage, nil
+}
+
+// updateReactionCount applies a change that is already in Postgres to the
+// cached counts. If it fails the cached hash is dropped so that the next
+// read reloads it.
+func updateReactionCount(ctx context.Context, messageID int, emoji string, delta int) {
+	key := reactionsKey(messageID)
+	if err := adjustReaction.Run(ctx, redisCli, []string{key}, emoji, delta).Err(); err != nil {
+		logger(ctx).Println("Failed to update reaction count:", err)
+		if err := redisCli.Del(ctx, key).Err(); err != nil {
+			logger(ctx).Println("Failed to drop reaction counts:", err)
+		}
+	}
+}
+
+// loadReactions sets the reaction counts of the messages, reading all of
+// them from Redis in one round trip and loading those not cached yet from
+// Postgres.
+func loadReactions(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	pipe := redisCli.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(messages))
+	for i, msg := range messages {
+		cmds[i] = pipe.HGetAll(ctx, reactionsKey(msg.ID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to read reaction counts:", err)
+		cmds = nil
+	}
+
+	var missing []int64
+	for i := range messages {
+		if cmds == nil || len(cmds[i].Val()) == 0 {
+			missing = append(missing, int64(messages[i].ID))
+			continue
+		}
+		for emoji, value := range cmds[i].Val() {
+			if emoji == reactionsLoadedField {
+				continue
+			}
+			if n, _ := strconv.ParseInt(value, 10, 64); n > 0 {
+				if messages[i].Reactions == nil {
+					messages[i].Reactions = make(map[string]int64)
+				}
+				messages[i].Reactions[emoji] = n
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	counts, err := queryReactions(ctx, missing)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if c, ok := counts[messages[i].ID]; ok {
+			messages[i].Reactions = c
+		}
+	}
+
+	// HSETNX keeps counts that a concurrent load or update wrote first.
+	pipe = redisCli.Pipeline()
+	for _, id := range missing {
+		key := reactionsKey(int(id))
+		pipe.HSetNX(ctx, key, reactionsLoadedField, 0)
+		for emoji, n := range counts[int(id)] {
+			pipe.HSetNX(ctx, key, emoji, n)
+		}
+		pipe.Expire(ctx, key, reactionsCacheTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to cache reaction counts:", err)
+	}
+	return nil
+}
+
+// queryReactions counts the reactions of the messages in Postgres. Messages
+// without any are left out.
+func queryReactions(ctx context.Context, messageIDs []int64) (map[int]map[string]int64, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT message_id, emoji, COUNT(*) FROM reactions WHERE message_id = ANY($1) GROUP BY message_id, emoji", messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]map[string]int64)
+	for rows.Next() {
+		var id int
+		var emoji string
+		var n int64
+		if err := rows.Scan(&id, &emoji, &n); err != nil {
+			return nil, err
+		}
+		if counts[id] == nil {
+			counts[id] = make(map[string]int64)
+		}
+		counts[id][emoji] = n
+	}
+	return counts, rows.Err()
+}
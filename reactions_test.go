@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadReactionsFromCache(t *testing.T) {
+	mr := initRedis(t)
+	// Every query fails, so the counts can only come from Redis.
+	initFakeDB(t)
+	mr.HSet(reactionsKey(1), reactionsLoadedField, "0", "👍", "2", "🎉", "1")
+	mr.HSet(reactionsKey(2), reactionsLoadedField, "0")
+
+	messages := []Message{{ID: 1}, {ID: 2}}
+	assert.NoError(t, loadReactions(context.Background(), messages))
+	assert.Equal(t, map[string]int64{"👍": 2, "🎉": 1}, messages[0].Reactions)
+	assert.Nil(t, messages[1].Reactions)
+
+	assert.Error(t, loadReactions(context.Background(), []Message{{ID: 3}}), "uncached counts come from Postgres")
+}
+
+func TestUpdateReactionCount(t *testing.T) {
+	mr := initRedis(t)
+	ctx := context.Background()
+
+	updateReactionCount(ctx, 1, "👍", 1)
+	assert.False(t, mr.Exists(reactionsKey(1)), "a hash that is not loaded stays that way")
+
+	mr.HSet(reactionsKey(1), reactionsLoadedField, "0")
+	updateReactionCount(ctx, 1, "👍", 1)
+	updateReactionCount(ctx, 1, "👍", 1)
+	assert.Equal(t, "2", mr.HGet(reactionsKey(1), "👍"))
+
+	updateReactionCount(ctx, 1, "👍", -1)
+	updateReactionCount(ctx, 1, "👍", -1)
+	fields, _ := mr.HKeys(reactionsKey(1))
+	assert.Equal(t, []string{reactionsLoadedField}, fields, "a count of zero is removed")
+}
+
+func sendReaction(t *testing.T, userID int, method string, messageID int, emoji string) int {
+	return sendReactionRecorded(t, userID, method, messageID, emoji).Code
+}
+
+func sendReactionRecorded(t *testing.T, userID int, method string, messageID int, emoji string) *httptest.ResponseRecorder {
+	path := "/messages/" + strconv.Itoa(messageID) + "/reactions"
+	vars := map[string]string{"id": strconv.Itoa(messageID)}
+	var body interface{} = reactionRequest{Emoji: emoji}
+	handler := addReaction
+	if method == "DELETE" {
+		path += "/" + url.PathEscape(emoji)
+		vars["emoji"] = emoji
+		body, handler = nil, removeReaction
+	}
+	rr := httptest.NewRecorder()
+	requireAuth(handler)(rr, mux.SetURLVars(authedRequest(t, userID, method, path, body), vars))
+	return rr
+}
+
+// reactionStore lets users 1 and 2 react to any message and records the
+// changes. Every other query fails.
+type reactionStore struct {
+	mu      sync.Mutex
+	changes int
+}
+
+func (s *reactionStore) Connect(context.Context) (driver.Conn, error) {
+	return reactionConn{store: s}, nil
+}
+
+func (s *reactionStore) Driver() driver.Driver { return nil }
+
+type reactionConn struct {
+	fakeConn
+	store *reactionStore
+}
+
+func (reactionConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "SELECT sender_id, receiver_id FROM messages") {
+		return &participantRows{messages: []Message{{SenderID: 1, RecipientID: 2}}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c reactionConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if strings.HasPrefix(query, "INSERT INTO reactions") || strings.HasPrefix(query, "DELETE FROM reactions") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.changes++
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func initReactionStore(t *testing.T) *reactionStore {
+	store := &reactionStore{}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func TestReactionChangesRateLimited(t *testing.T) {
+	mr := initRedis(t)
+	store := initReactionStore(t)
+	mr.HSet(reactionsKey(1), reactionsLoadedField, "0")
+	mr.HSet(reactionsKey(2), reactionsLoadedField, "0")
+
+	for i := int64(0); i < reactionLimiter.limit/2; i++ {
+		assert.Equal(t, http.StatusNoContent, sendReaction(t, 1, "POST", 1, "👍"))
+		assert.Equal(t, http.StatusNoContent, sendReaction(t, 1, "DELETE", 1, "👍"))
+	}
+	rr := sendReactionRecorded(t, 1, "POST", 1, "👍")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, sendReaction(t, 1, "DELETE", 1, "👍"))
+	assert.Equal(t, int(reactionLimiter.limit), store.changes)
+
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 1, "POST", 2, "👍"), "the limit is per message")
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 2, "POST", 1, "👍"), "and per user")
+
+	mr.FastForward(reactionLimiter.window)
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 1, "POST", 1, "👍"))
+}
+
+func TestReactionEmojiCapped(t *testing.T) {
+	mr := initRedis(t)
+	store := initReactionStore(t)
+	mr.HSet(reactionsKey(1), reactionsLoadedField, "0")
+	for i := 0; i < maxEmojiPerMessage; i++ {
+		mr.HSet(reactionsKey(1), string(rune(0x1F600+i)), "1")
+	}
+
+	rr := sendReactionRecorded(t, 1, "POST", 1, "🎉")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.Equal(t, 0, store.changes)
+
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 2, "POST", 1, "😀"), "emoji already there can still be added")
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 2, "DELETE", 1, "😀"))
+	mr.HDel(reactionsKey(1), "😁")
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, 1, "POST", 1, "🎉"), "a freed slot takes a new emoji")
+}
+
+func TestReactionsLifecycle(t *testing.T) {
+	setupTestContainers(t)
+	mr := initRedis(t)
+	ctx := context.Background()
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	outsiderID := insertTestUser(t, "hash")
+	msg, err := storeMessage(ctx, Message{SenderID: senderID, RecipientID: recipientID, Text: "react to me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reactions := func() map[string]int64 {
+		rr := getMessagesRequest(t, senderID, "?with="+strconv.Itoa(recipientID))
+		var page Page[Message]
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if !assert.Len(t, page.Items, 1) {
+			t.FailNow()
+		}
+		return page.Items[0].Reactions
+	}
+
+	assert.Nil(t, reactions())
+	assert.True(t, mr.Exists(reactionsKey(msg.ID)), "the first read loads the counts")
+
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, recipientID, "POST", msg.ID, "👍"))
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, recipientID, "POST", msg.ID, "👍"), "reacting twice counts once")
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, senderID, "POST", msg.ID, "👍"))
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, senderID, "POST", msg.ID, "🎉"))
+	assert.Equal(t, http.StatusForbidden, sendReaction(t, outsiderID, "POST", msg.ID, "👍"))
+	assert.Equal(t, http.StatusUnprocessableEntity, sendReaction(t, senderID, "POST", msg.ID, ""))
+	assert.Equal(t, http.StatusNotFound, sendReaction(t, senderID, "POST", msg.ID+1000000, "👍"))
+	assert.Equal(t, map[string]int64{"👍": 2, "🎉": 1}, reactions())
+
+	assert.Equal(t, http.StatusNoContent, sendReaction(t, senderID, "DELETE", msg.ID, "🎉"))
+	assert.Equal(t, http.StatusNotFound, sendReaction(t, senderID, "DELETE", msg.ID, "🎉"))
+	assert.Equal(t, map[string]int64{"👍": 2}, reactions())
+
+	// A flushed cache is rebuilt from Postgres.
+	mr.FlushAll()
+	assert.Equal(t, map[string]int64{"👍": 2}, reactions())
+}
+
+func percentile99(durations []time.Duration) time.Duration {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[(len(durations)*99+99)/100-1]
+}
+
+// BenchmarkReactionCounts reads the reaction counts of a page of messages
+// both with the join GET /messages used to run and from the cached hashes,
+// and fails unless the cache lowers the p99 latency.
+func BenchmarkReactionCounts(b *testing.B) {
+	senderID, recipientID := benchmarkUsers(b)
+	defer db.Close()
+	initRedis(b)
+	ctx := context.Background()
+
+	page := make([]Message, defaultHistoryLimit)
+	ids := make([]int64, len(page))
+	for i := range page {
+		msg, err := storeMessage(ctx, Message{SenderID: senderID, RecipientID: recipientID, Text: "bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, userID := range []int{senderID, recipientID} {
+			for _, emoji := range []string{"👍", "🎉", "😂"} {
+				if _, err := db.Exec("INSERT INTO reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)", msg.ID, userID, emoji); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		page[i], ids[i] = Message{ID: msg.ID}, int64(msg.ID)
+	}
+	if err := loadReactions(ctx, page); err != nil {
+		b.Fatal(err)
+	}
+
+	joined := make([]time.Duration, 0, b.N)
+	cached := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		rows, err := db.QueryContext(ctx,
+			`SELECT m.message_id, r.emoji, COUNT(r.emoji) FROM messages m
+			LEFT JOIN reactions r ON r.message_id = m.message_id
+			WHERE m.message_id = ANY($1)
+			GROUP BY m.message_id, r.emoji`, ids)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		joined = append(joined, time.Since(start))
+
+		start = time.Now()
+		for j := range page {
+			page[j].Reactions = nil
+		}
+		if err := loadReactions(ctx, page); err != nil {
+			b.Fatal(err)
+		}
+		cached = append(cached, time.Since(start))
+	}
+	b.StopTimer()
+
+	joinedP99, cachedP99 := percentile99(joined), percentile99(cached)
+	b.ReportMetric(float64(joinedP99.Nanoseconds()), "join-p99-ns")
+	b.ReportMetric(float64(cachedP99.Nanoseconds()), "cached-p99-ns")
+	if b.N >= 100 && cachedP99 >= joinedP99 {
+		b.Errorf("cached p99 %v is not below the join's %v", cachedP99, joinedP99)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// recentMessagesPerConversation is how many of a conversation's newest
+	// messages are kept in Redis.
+	recentMessagesPerConversation = 200
+	defaultRecentCount            = 20
+)
+
+var errInvalidConversationKey = errors.New("conversation key must be dm:{id}:{id} or room:{id}")
+
+// conversationKey names the conversation msg belongs to: "room:{id}" for
+// room messages and "dm:{low}:{high}" for direct ones, so both directions
+// share a key.
+func conversationKey(msg Message) string {
+	if msg.RoomID != 0 {
+		return fmt.Sprintf("room:%d", msg.RoomID)
+	}
+	a, b := msg.SenderID, msg.RecipientID
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("dm:%d:%d", a, b)
+}
+
+func recentMessagesKey(conversation string) string {
+	return fmt.Sprintf("recent:%s", conversation)
+}
+
+// cacheRecentMessage pushes msg onto its conversation's list of recent
+// messages, newest first, and trims the list.
+func cacheRecentMessage(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := recentMessagesKey(conversationKey(msg))
+	pipe := redisCli.TxPipeline()
+	pipe.LPush(ctx, key, payload)
+	pipe.LTrim(ctx, key, 0, recentMessagesPerConversation-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// updateRecentMessage replaces the cached copy of msg, if its conversation's
+// list still holds one, after an edit.
+func updateRecentMessage(ctx context.Context, msg Message) error {
+	key := recentMessagesKey(conversationKey(msg))
+	values, err := redisCli.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		var cached Message
+		if err := json.Unmarshal([]byte(value), &cached); err != nil || cached.ID != msg.ID {
+			continue
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return redisCli.LSet(ctx, key, int64(i), payload).Err()
+	}
+	return nil
+}
+
+// GetRecentMessages returns up to count cached messages of the
+// conversation, newest first, skipping the offset newest. Expired messages
+// the sweeper has not removed yet are left out, so a page may come back
+// short.
+func GetRecentMessages(ctx context.Context, conversationKey string, offset, count int64) ([]Message, error) {
+	values, err := redisCli.LRange(ctx, recentMessagesKey(conversationKey), offset, offset+count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	messages := make([]Message, 0, len(values))
+	for _, value := range values {
+		var msg Message
+		if err := json.Unmarshal([]byte(value), &msg); err != nil {
+			return nil, err
+		}
+		if !messageExpired(msg, now) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// purgeExpiredRecent removes the messages that expired by now from the
+// conversation's list of recent messages.
+func purgeExpiredRecent(ctx context.Context, conversation string, now time.Time) error {
+	key := recentMessagesKey(conversation)
+	values, err := redisCli.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := redisCli.Pipeline()
+	for _, value := range values {
+		var msg Message
+		if err := json.Unmarshal([]byte(value), &msg); err == nil && messageExpired(msg, now) {
+			pipe.LRem(ctx, key, 1, value)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// canReadConversation returns errInvalidConversationKey for a malformed key
+// and errNotRoomMember if the user takes no part in the conversation.
+func canReadConversation(ctx context.Context, key string, userID int) error {
+	parts := strings.Split(key, ":")
+	switch {
+	case len(parts) == 3 && parts[0] == "dm":
+		a, errA := strconv.Atoi(parts[1])
+		b, errB := strconv.Atoi(parts[2])
+		if errA != nil || errB != nil || a > b {
+			return errInvalidConversationKey
+		}
+		if userID != a && userID != b {
+			return errNotRoomMember
+		}
+		return nil
+	case len(parts) == 2 && parts[0] == "room":
+		roomID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return errInvalidConversationKey
+		}
+		return checkRoomMember(ctx, roomID, userID)
+	}
+	return errInvalidConversationKey
+}
+
+func getRecentMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getRecentMessages")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if err := canReadConversation(ctx, key, claims.UserID); err == errInvalidConversationKey {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	} else if err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	offset, count := int64(0), int64(defaultRecentCount)
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+			return
+		}
+		offset = n
+	}
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 || n > recentMessagesPerConversation {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, "count must be between 1 and "+strconv.Itoa(recentMessagesPerConversation))
+			return
+		}
+		count = n
+	}
+
+	messages, err := GetRecentMessages(ctx, key, offset, count)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to read recent messages")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
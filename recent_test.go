@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRecentMessagesPages(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+
+	for i := 0; i < 250; i++ {
+		sender, recipient := 1, 2
+		if i%2 == 1 {
+			sender, recipient = 2, 1
+		}
+		msg := Message{ID: i + 1, SenderID: sender, RecipientID: recipient, Text: fmt.Sprintf("message %d", i)}
+		if err := cacheRecentMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, _ := redisCli.LLen(ctx, recentMessagesKey("dm:1:2")).Result()
+	assert.Equal(t, int64(recentMessagesPerConversation), n)
+
+	first, err := GetRecentMessages(ctx, "dm:1:2", 0, 20)
+	assert.NoError(t, err)
+	second, err := GetRecentMessages(ctx, "dm:1:2", 20, 20)
+	assert.NoError(t, err)
+
+	seen := make(map[int]bool)
+	for i, msg := range append(first, second...) {
+		assert.Equal(t, 250-i, msg.ID, "pages must be newest first and contiguous")
+		assert.False(t, seen[msg.ID], "message %d returned twice", msg.ID)
+		seen[msg.ID] = true
+	}
+	assert.Len(t, seen, 40)
+
+	rest, err := GetRecentMessages(ctx, "dm:1:2", 190, 20)
+	assert.NoError(t, err)
+	assert.Len(t, rest, 10, "only the newest 200 messages are kept")
+}
+
+func TestGetRecentMessagesEndpoint(t *testing.T) {
+	initRedis(t)
+	cacheRecentMessage(context.Background(), Message{ID: 1, SenderID: 3, RecipientID: 4, Text: "hi"})
+
+	request := func(userID int, key, query string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(authedRequest(t, userID, "GET", "/conversations/"+key+"/recent"+query, nil), map[string]string{"key": key})
+		rr := httptest.NewRecorder()
+		requireAuth(getRecentMessages)(rr, req)
+		return rr
+	}
+
+	rr := request(4, "dm:3:4", "?offset=0&count=20")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var messages []Message
+	json.NewDecoder(rr.Body).Decode(&messages)
+	assert.Equal(t, []Message{{ID: 1, SenderID: 3, RecipientID: 4, Text: "hi"}}, messages)
+
+	assert.Equal(t, http.StatusForbidden, request(5, "dm:3:4", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(4, "dm:4:3", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(4, "dm:3:4", "?count=0").Code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// Unknown IDs are remembered for less time so a newly registered user
+	// can be messaged almost immediately.
+	recipientCacheTTL        = 30 * time.Second
+	unknownRecipientCacheTTL = 5 * time.Second
+)
+
+// Cached values of userExistsKey.
+const (
+	userActive  = "1"
+	userMissing = "0"
+	userBanned  = "banned"
+)
+
+var (
+	errInvalidRecipient = errors.New("recipient does not exist")
+	errRecipientBanned  = errors.New("recipient is banned")
+	errSenderBanned     = errors.New("sender is banned")
+)
+
+func userExistsKey(userID int) string {
+	return fmt.Sprintf("user:%d:exists", userID)
+}
+
+// userStatus tells whether userID belongs to an active account, a banned
+// one, or none that has not been deleted. The answer is cached briefly in
+// Redis; Redis errors only cost a lookup.
+func userStatus(ctx context.Context, userID int) (string, error) {
+	key := userExistsKey(userID)
+	cached, err := redisCli.Get(ctx, key).Result()
+	if err == nil {
+		return cached, nil
+	}
+	if err != redis.Nil {
+		logger(ctx).Println("Failed to read recipient cache:", err)
+	}
+
+	var banned bool
+	status, ttl := userActive, recipientCacheTTL
+	err = db.QueryRowContext(ctx, "SELECT banned_at IS NOT NULL FROM users WHERE user_id = $1 AND deleted_at IS NULL", userID).Scan(&banned)
+	if err == sql.ErrNoRows {
+		status, ttl = userMissing, unknownRecipientCacheTTL
+	} else if err != nil {
+		return "", err
+	} else if banned {
+		status = userBanned
+	}
+
+	if err := redisCli.Set(ctx, key, status, ttl).Err(); err != nil {
+		logger(ctx).Println("Failed to cache recipient:", err)
+	}
+	return status, nil
+}
+
+// checkUserExists returns errInvalidRecipient unless userID belongs to an
+// account that has not been deleted.
+func checkUserExists(ctx context.Context, userID int) error {
+	status, err := userStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if status == userMissing {
+		return errInvalidRecipient
+	}
+	return nil
+}
+
+// checkRecipient is checkUserExists for the recipient of a message.
+// Messaging yourself is allowed; messaging a banned user only if
+// cfg.MessagesToBannedUsers is set, else it returns errRecipientBanned.
+func checkRecipient(ctx context.Context, userID int) error {
+	status, err := userStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == userMissing:
+		return errInvalidRecipient
+	case status == userBanned && !cfg.MessagesToBannedUsers:
+		return errRecipientBanned
+	}
+	return nil
+}
+
+// checkSender returns errSenderBanned if userID is banned. userID is the
+// authenticated caller, never a sender ID read from the request, so that
+// a banned user cannot send by claiming to be someone else.
+func checkSender(ctx context.Context, userID int) error {
+	status, err := userStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if status == userBanned {
+		return errSenderBanned
+	}
+	return nil
+}
+
+// recipientErrorCode is the code of the error event that reports err from
+// checkRecipient to a socket, or "" if err is not the client's fault.
+func recipientErrorCode(err error) string {
+	switch err {
+	case errInvalidRecipient:
+		return "invalid_recipient"
+	case errRecipientBanned:
+		return "recipient_banned"
+	}
+	return ""
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recipientStore knows which user IDs are active and which of them are
+// banned. It answers the status lookup, bans and message and attachment
+// inserts, counting the lookups, remembers client_msg_ids the way the
+// unique index on messages does, links attachments only for their
+// uploader and records the messages flagged and the bans made.
+type recipientStore struct {
+	active map[int64]bool
+	checks atomic.Int64
+	nextID atomic.Int64
+	linked atomic.Int64
+
+	mu         sync.Mutex
+	banned     map[int64]bool
+	clientMsgs map[string]Message
+	uploaders  map[int64]int64
+	flagged    []int64
+	bans       []Ban
+}
+
+func (s *recipientStore) Connect(context.Context) (driver.Conn, error) {
+	return recipientConn{store: s}, nil
+}
+
+func (s *recipientStore) Driver() driver.Driver { return nil }
+
+type recipientConn struct {
+	fakeConn
+	store *recipientStore
+}
+
+// Begin hands out transactions that do nothing; the store has no rollback.
+func (recipientConn) Begin() (driver.Tx, error) { return noopTx{}, nil }
+
+type noopTx struct{}
+
+func (noopTx) Commit() error   { return nil }
+func (noopTx) Rollback() error { return nil }
+
+func (c recipientConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "SELECT banned_at") {
+		c.store.checks.Add(1)
+		id, _ := args[0].Value.(int64)
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		return &valueRows{column: "banned", value: c.store.banned[id], done: !c.store.active[id]}, nil
+	}
+	if strings.HasPrefix(query, "WITH expired AS (DELETE FROM bans") {
+		return c.store.liftExpiredBans(args[0].Value.(time.Time)), nil
+	}
+	if strings.HasPrefix(query, "SELECT message_id") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		msg := c.store.clientMsgs[args[1].Value.(string)]
+		return &messageRows{msg: &msg}, nil
+	}
+	if strings.Contains(query, "FROM notification_prefs") {
+		// Nobody muted anything.
+		return &idRows{}, nil
+	}
+	if strings.Contains(query, "FROM away_messages") {
+		// Nobody is away.
+		return &idRows{}, nil
+	}
+	if strings.HasPrefix(query, "INSERT INTO attachments") {
+		id := c.store.nextID.Add(1)
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.uploaders[id] = args[0].Value.(int64)
+		return &valueRows{column: "attachment_id", value: id}, nil
+	}
+	if strings.Contains(query, "client_msg_id") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		clientMsgID := args[3].Value.(string)
+		if _, ok := c.store.clientMsgs[clientMsgID]; ok {
+			return &idRows{}, nil
+		}
+		id := c.store.nextID.Add(1)
+		recipientID, _ := args[1].Value.(int64)
+		text, _ := args[2].Value.(string)
+		msg := Message{ID: int(id), RecipientID: int(recipientID), Text: text}
+		if expiresAt, ok := args[4].Value.(time.Time); ok {
+			msg.ExpiresAt = &expiresAt
+		}
+		c.store.clientMsgs[clientMsgID] = msg
+		return &idRows{ids: []int64{id}}, nil
+	}
+	return &idRows{ids: []int64{c.store.nextID.Add(1)}}, nil
+}
+
+// CheckNamedValue converts arguments as database/sql would, but lets slices
+// through the way pgx accepts them for Postgres arrays.
+func (recipientConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+// ExecContext only runs the statements tying attachments to their message,
+// banning users and flagging messages.
+func (c recipientConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.HasPrefix(query, "UPDATE attachments") {
+		c.store.linked.Add(1)
+		uploaderID := args[2].Value.(int64)
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		var n int64
+		for _, id := range args[1].Value.([]int64) {
+			// A linked attachment is forgotten: its message_id is set.
+			if owner, ok := c.store.uploaders[id]; ok && owner == uploaderID {
+				delete(c.store.uploaders, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	if strings.HasPrefix(query, "UPDATE users SET banned_at") {
+		id, _ := args[0].Value.(int64)
+		if !c.store.active[id] {
+			return driver.RowsAffected(0), nil
+		}
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.banned[id] = !strings.Contains(query, "banned_at = NULL")
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(query, "INSERT INTO bans") {
+		ban := Ban{UserID: int(args[0].Value.(int64)), BannedBy: int(args[1].Value.(int64)), Reason: args[2].Value.(string)}
+		if expiresAt, ok := args[3].Value.(time.Time); ok {
+			ban.ExpiresAt = &expiresAt
+		}
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.bans = append(c.store.bans, ban)
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(query, "DELETE FROM bans") {
+		id := int(args[0].Value.(int64))
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.bans = slices.DeleteFunc(c.store.bans, func(ban Ban) bool { return ban.UserID == id })
+		return driver.RowsAffected(1), nil
+	}
+	if strings.HasPrefix(query, "INSERT INTO message_reports") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.flagged = append(c.store.flagged, args[0].Value.(int64))
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("not supported")
+}
+
+// liftExpiredBans drops the bans that have run out by now and unbans the
+// users they leave with none.
+func (s *recipientStore) liftExpiredBans(now time.Time) driver.Rows {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := make(map[int]bool)
+	s.bans = slices.DeleteFunc(s.bans, func(ban Ban) bool {
+		if ban.ExpiresAt != nil && !ban.ExpiresAt.After(now) {
+			expired[ban.UserID] = true
+			return true
+		}
+		return false
+	})
+	for _, ban := range s.bans {
+		delete(expired, ban.UserID)
+	}
+	rows := &valueRows{column: "user_id", done: true}
+	for id := range expired {
+		s.banned[int64(id)] = false
+		// The tests lift one ban at a time.
+		rows.value, rows.done = int64(id), false
+	}
+	return rows
+}
+
+type valueRows struct {
+	column string
+	value  driver.Value
+	done   bool
+}
+
+func (r *valueRows) Columns() []string { return []string{r.column} }
+func (r *valueRows) Close() error      { return nil }
+
+func (r *valueRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0] = r.value
+	r.done = true
+	return nil
+}
+
+// messageRows is the result of looking up a message by its client_msg_id.
+type messageRows struct {
+	msg *Message
+}
+
+func (r *messageRows) Columns() []string {
+	return []string{"message_id", "seq", "receiver_id", "text", "expires_at", "created_at", "updated_at"}
+}
+func (r *messageRows) Close() error { return nil }
+
+func (r *messageRows) Next(dest []driver.Value) error {
+	if r.msg == nil {
+		return io.EOF
+	}
+	dest[0], dest[1], dest[2], dest[3] = int64(r.msg.ID), int64(r.msg.ID), int64(r.msg.RecipientID), r.msg.Text
+	dest[4], dest[5], dest[6] = nil, insertedAt, insertedAt
+	if r.msg.ExpiresAt != nil {
+		dest[4] = *r.msg.ExpiresAt
+	}
+	r.msg = nil
+	return nil
+}
+
+func initRecipientStore(t *testing.T, active ...int64) *recipientStore {
+	store := &recipientStore{active: make(map[int64]bool), banned: make(map[int64]bool), clientMsgs: make(map[string]Message), uploaders: make(map[int64]int64)}
+	for _, id := range active {
+		store.active[id] = true
+	}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func postMessage(msg Message) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(msg)
+	rr := httptest.NewRecorder()
+	sendMessage(rr, asUser(httptest.NewRequest("POST", "/messages", bytes.NewBuffer(jsonData)), msg.SenderID))
+	return rr
+}
+
+func TestSendMessageUnknownRecipient(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1, 2)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, postMessage(Message{SenderID: 1, RecipientID: 999, Text: "hi"}).Code)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi"}).Code)
+}
+
+func TestSendMessageToSelfAllowed(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1)
+
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 1, Text: "note to self"}).Code)
+}
+
+func TestSendMessageTakesSenderFromToken(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 1, 2, 3)
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, 3, "POST", "/messages", Message{SenderID: 1, RecipientID: 2, Text: "from 1, honest"}))
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var sent Message
+	json.Unmarshal(rr.Body.Bytes(), &sent)
+	assert.Equal(t, 3, sent.SenderID, "sender_id in the body is not who sent it")
+
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("POST", "/messages", strings.NewReader(`{"sender_id":1,"recipient_id":2,"text":"hi"}`)))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRecipientCheckIsCached(t *testing.T) {
+	initRedis(t)
+	store := initRecipientStore(t, 2)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi"}).Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, postMessage(Message{SenderID: 1, RecipientID: 3, Text: "hi"}).Code)
+	}
+
+	// The sender is checked for a ban through the same cache.
+	assert.Equal(t, int64(3), store.checks.Load(), "each user should be looked up once")
+}
+
+func TestWebSocketInvalidRecipient(t *testing.T) {
+	initRedis(t)
+	initRecipientStore(t, 701)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 701)
+	waitForClients(t, 1)
+
+	if err := sender.WriteJSON(Message{SenderID: 701, RecipientID: 999, Text: "hello?"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ErrorEvent
+	if err := sender.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "invalid_recipient", event.Code)
+}
+
+func TestSendMessageDeletedRecipient(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	if _, err := db.Exec("UPDATE users SET deleted_at = NOW() WHERE user_id = $1", recipientID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postMessage(Message{SenderID: senderID, RecipientID: recipientID, Text: "hi"})
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "handler returned wrong status code")
+}
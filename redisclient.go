@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisClient is the client the server talks to Redis with. Every key a
+// command names, in pipelines too, is put under the client's prefix, so
+// that several deployments can share one Redis without seeing each other's
+// keys. Keys the server reads back, from SCAN and KEYS, lose the prefix
+// again, as do the streams XREAD and XREADGROUP return.
+type RedisClient struct {
+	*redis.Client
+	prefix string
+}
+
+func NewRedisClient(opt *redis.Options, prefix string) *RedisClient {
+	c := &RedisClient{Client: redis.NewClient(opt), prefix: prefix}
+	if prefix != "" {
+		c.AddHook(keyPrefixHook{prefix: prefix})
+	}
+	return c
+}
+
+// Prefix returns what the client puts in front of every key.
+func (c *RedisClient) Prefix() string {
+	return c.prefix
+}
+
+// Commands whose arguments name no key.
+var unkeyedCommands = map[string]bool{
+	"ping": true, "info": true, "flushall": true, "flushdb": true, "dbsize": true,
+	"multi": true, "exec": true, "discard": true, "unwatch": true,
+	"echo": true, "time": true, "select": true, "auth": true, "hello": true,
+	"client": true, "config": true, "command": true,
+}
+
+// Commands every argument of which is a key.
+var allKeysCommands = map[string]bool{
+	"del": true, "unlink": true, "exists": true, "touch": true, "mget": true, "watch": true,
+}
+
+type keyPrefixHook struct {
+	prefix string
+}
+
+// keyPositions returns the indexes of the arguments of a command that are
+// keys. Any command not listed here takes its first argument as the key.
+func keyPositions(args []interface{}) []int {
+	name := strings.ToLower(argString(args, 0))
+	var positions []int
+	switch {
+	case unkeyedCommands[name], len(args) < 2:
+	case allKeysCommands[name]:
+		for i := 1; i < len(args); i++ {
+			positions = append(positions, i)
+		}
+	case name == "mset" || name == "msetnx":
+		for i := 1; i < len(args); i += 2 {
+			positions = append(positions, i)
+		}
+	case name == "rename" || name == "renamenx" || name == "smove" || name == "rpoplpush" ||
+		name == "lmove" || name == "zrangestore":
+		positions = []int{1, 2}
+	case name == "xgroup" || name == "xinfo" || name == "object":
+		// A subcommand comes first.
+		positions = []int{2}
+	case name == "zunionstore" || name == "zinterstore" || name == "zdiffstore":
+		positions = []int{1}
+		n, _ := strconv.Atoi(argString(args, 2))
+		for i := 3; i < 3+n && i < len(args); i++ {
+			positions = append(positions, i)
+		}
+	case name == "zunion" || name == "zinter" || name == "zdiff":
+		n, _ := strconv.Atoi(argString(args, 1))
+		for i := 2; i < 2+n && i < len(args); i++ {
+			positions = append(positions, i)
+		}
+	case name == "eval" || name == "evalsha" || name == "eval_ro" || name == "evalsha_ro":
+		// The script comes first, then the number of keys.
+		n, _ := strconv.Atoi(argString(args, 2))
+		for i := 3; i < 3+n && i < len(args); i++ {
+			positions = append(positions, i)
+		}
+	case name == "xread" || name == "xreadgroup":
+		// The streams follow STREAMS, then as many IDs.
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(argString(args, i), "streams") {
+				n := (len(args) - i - 1) / 2
+				for j := i + 1; j <= i+n; j++ {
+					positions = append(positions, j)
+				}
+				break
+			}
+		}
+	case name == "scan" || name == "keys":
+		// Patterns are handled by prefixPattern.
+	default:
+		positions = []int{1}
+	}
+	return positions
+}
+
+func argString(args []interface{}, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+	switch v := args[i].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+func (h keyPrefixHook) prefixKeys(cmd redis.Cmder) {
+	args := cmd.Args()
+	for _, i := range keyPositions(args) {
+		args[i] = h.prefix + argString(args, i)
+	}
+	switch cmd.Name() {
+	case "keys":
+		args[1] = h.prefixPattern(argString(args, 1))
+	case "scan":
+		// The server always scans with a pattern.
+		for i := 2; i+1 < len(args); i++ {
+			if strings.EqualFold(argString(args, i), "match") {
+				args[i+1] = h.prefixPattern(argString(args, i+1))
+			}
+		}
+	}
+}
+
+// prefixPattern puts a pattern under the prefix. The SCAN iterator sends
+// the same arguments for every page, so a pattern is only prefixed once.
+func (h keyPrefixHook) prefixPattern(pattern string) string {
+	if strings.HasPrefix(pattern, h.prefix) {
+		return pattern
+	}
+	return h.prefix + pattern
+}
+
+func (h keyPrefixHook) stripKeys(cmd redis.Cmder) {
+	switch cmd := cmd.(type) {
+	case *redis.ScanCmd:
+		page, cursor := cmd.Val()
+		for i := range page {
+			page[i] = strings.TrimPrefix(page[i], h.prefix)
+		}
+		cmd.SetVal(page, cursor)
+	case *redis.XStreamSliceCmd:
+		for i := range cmd.Val() {
+			cmd.Val()[i].Stream = strings.TrimPrefix(cmd.Val()[i].Stream, h.prefix)
+		}
+	case *redis.StringSliceCmd:
+		if cmd.Name() == "keys" {
+			keys := cmd.Val()
+			for i := range keys {
+				keys[i] = strings.TrimPrefix(keys[i], h.prefix)
+			}
+		}
+	}
+}
+
+func (h keyPrefixHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.prefixKeys(cmd)
+	return ctx, nil
+}
+
+func (h keyPrefixHook) AfterProcess(_ context.Context, cmd redis.Cmder) error {
+	h.stripKeys(cmd)
+	return nil
+}
+
+func (h keyPrefixHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		h.prefixKeys(cmd)
+	}
+	return ctx, nil
+}
+
+func (h keyPrefixHook) AfterProcessPipeline(_ context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		h.stripKeys(cmd)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyPositions(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		args []interface{}
+		want []int
+	}{
+		{[]interface{}{"get", "k"}, []int{1}},
+		{[]interface{}{"set", "k", "v", "ex", 10}, []int{1}},
+		{[]interface{}{"del", "a", "b"}, []int{1, 2}},
+		{[]interface{}{"mget", "a", "b", "c"}, []int{1, 2, 3}},
+		{[]interface{}{"zunionstore", "dest", 2, "a", "b", "aggregate", "sum"}, []int{1, 3, 4}},
+		{[]interface{}{"xreadgroup", "group", "g", "c", "count", 1, "streams", "a", "b", ">", ">"}, []int{7, 8}},
+		{[]interface{}{"xgroup", "create", "s", "g", "0"}, []int{2}},
+		{[]interface{}{"eval", "return 1", 2, "a", "b", "arg"}, []int{3, 4}},
+		{[]interface{}{"evalsha", "abc123", 1, "a", "arg"}, []int{3}},
+		{[]interface{}{"ping"}, nil},
+		{[]interface{}{"info", "memory"}, nil},
+		{[]interface{}{"multi"}, nil},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, keyPositions(tc.args), "%v", tc.args)
+	}
+}
+
+func TestRedisKeyPrefixApplied(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := NewRedisClient(&redis.Options{Addr: mr.Addr()}, "staging:")
+	defer client.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, client.Set(ctx, "greeting", "hi", 0).Err())
+	assert.Equal(t, "hi", client.Get(ctx, "greeting").Val())
+	assert.NoError(t, client.LPush(ctx, "list", "a", "b").Err())
+	assert.Equal(t, []string{"b", "a"}, client.LRange(ctx, "list", 0, -1).Val())
+	assert.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: "stream", Values: map[string]interface{}{"n": 1}}).Err())
+	assert.NoError(t, client.XGroupCreate(ctx, "stream", "readers", "0").Err())
+	streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "readers", Consumer: "c", Streams: []string{"stream", ">"}, Count: 1, Block: -1}).Result()
+	if assert.NoError(t, err) && assert.Len(t, streams, 1) {
+		assert.Equal(t, "stream", streams[0].Stream)
+		assert.Len(t, streams[0].Messages, 1)
+	}
+	assert.NoError(t, client.SAdd(ctx, "set", "x", "y").Err())
+	assert.NoError(t, client.SRem(ctx, "set", "y").Err())
+	assert.Equal(t, []string{"x"}, client.SMembers(ctx, "set").Val())
+	assert.NoError(t, client.HIncrBy(ctx, "hash", "f", 2).Err())
+	assert.NoError(t, client.HIncrBy(ctx, "hash", "g", 1).Err())
+	assert.NoError(t, client.HDel(ctx, "hash", "g").Err())
+	assert.Equal(t, map[string]string{"f": "2"}, client.HGetAll(ctx, "hash").Val())
+	assert.Equal(t, int64(1), client.Incr(ctx, "counter").Val())
+
+	pipe := client.TxPipeline()
+	pipe.ZIncrBy(ctx, "a", 1, "m")
+	pipe.ZIncrBy(ctx, "b", 2, "m")
+	pipe.ZUnionStore(ctx, "union", &redis.ZStore{Keys: []string{"a", "b"}})
+	score := pipe.ZScore(ctx, "union", "m")
+	_, err = pipe.Exec(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), score.Val())
+	assert.Equal(t, []interface{}{"hi", nil}, client.MGet(ctx, "greeting", "missing").Val())
+
+	keys := mr.Keys()
+	assert.Len(t, keys, 9)
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, "staging:"), key)
+	}
+
+	// Keys read back lose the prefix, over several pages of SCAN too.
+	var scanned []string
+	iter := client.Scan(ctx, 0, "*", 2).Iterator()
+	for iter.Next(ctx) {
+		scanned = append(scanned, iter.Val())
+	}
+	assert.NoError(t, iter.Err())
+	sort.Strings(scanned)
+	assert.Equal(t, []string{"a", "b", "counter", "greeting", "hash", "list", "set", "stream", "union"}, scanned)
+	assert.ElementsMatch(t, []string{"set"}, client.Keys(ctx, "se*").Val())
+}
+
+func TestRedisKeyPrefixScripts(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := NewRedisClient(&redis.Options{Addr: mr.Addr()}, "staging:")
+	defer client.Close()
+	ctx := context.Background()
+
+	// Run tries EVALSHA first and falls back to EVAL; both name the key.
+	assert.NoError(t, client.Set(ctx, "claim", idempotencyPendingMarker, 0).Err())
+	n, err := releasePending.Run(ctx, client, []string{"claim"}, idempotencyPendingMarker).Int()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.False(t, mr.Exists("staging:claim"))
+
+	assert.NoError(t, client.Set(ctx, "other", idempotencyPendingMarker, 0).Err())
+	n, err = releasePending.Run(ctx, client, []string{"other"}, idempotencyPendingMarker).Int()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n, "the cached script is run by its hash")
+	assert.Equal(t, []string{}, mr.Keys())
+}
+
+func TestRedisKeyPrefixesIsolated(t *testing.T) {
+	mr := miniredis.RunT(t)
+	production := NewRedisClient(&redis.Options{Addr: mr.Addr()}, "prod:")
+	defer production.Close()
+	staging := NewRedisClient(&redis.Options{Addr: mr.Addr()}, "staging:")
+	defer staging.Close()
+	ctx := context.Background()
+
+	production.Set(ctx, "user:1", "production", 0)
+	staging.Set(ctx, "user:1", "staging", 0)
+	production.SAdd(ctx, "room:1:members", "1", "2")
+	staging.Incr(ctx, "counter")
+
+	assert.Equal(t, "production", production.Get(ctx, "user:1").Val())
+	assert.Equal(t, "staging", staging.Get(ctx, "user:1").Val())
+	assert.Empty(t, staging.SMembers(ctx, "room:1:members").Val())
+	assert.Equal(t, int64(0), production.Exists(ctx, "counter").Val())
+
+	staging.Del(ctx, "user:1")
+	assert.Equal(t, "production", production.Get(ctx, "user:1").Val(), "deleting in one deployment leaves the other alone")
+
+	keys, err := scanKeysWith(ctx, production, "*")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user:1", "room:1:members"}, keys)
+}
+
+func scanKeysWith(ctx context.Context, client *RedisClient, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 1).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
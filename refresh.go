@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// refreshTokenCookie carries the refresh token. It is only sent to the
+// refresh endpoint.
+const (
+	refreshTokenCookie = "refresh_token"
+	refreshTokenPath   = "/token"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token was already used, log in again")
+)
+
+// markRefreshTokenUsed marks a refresh token as exchanged and returns its
+// session and user with 1, or with 2 if it had been exchanged before. It
+// returns 0 for a token that does not exist.
+var markRefreshTokenUsed = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {0, "", ""}
+end
+local fields = redis.call("HMGET", KEYS[1], "session", "user_id")
+if redis.call("HSETNX", KEYS[1], "used_at", ARGV[1]) == 0 then
+	return {2, fields[1], fields[2]}
+end
+return {1, fields[1], fields[2]}`)
+
+// refreshTokenOwner returns the session and user of a refresh token, whether
+// it was exchanged already or not.
+func refreshTokenOwner(ctx context.Context, token string) (sessionID string, userID int, err error) {
+	fields, err := redisCli.HMGet(ctx, refreshTokenKey(token), "session", "user_id").Result()
+	if err != nil {
+		return "", 0, err
+	}
+	sessionID, _ = fields[0].(string)
+	userIDField, _ := fields[1].(string)
+	userID, _ = strconv.Atoi(userIDField)
+	if sessionID == "" || userID == 0 {
+		return "", 0, errInvalidRefreshToken
+	}
+	return sessionID, userID, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one of the same
+// session, which it extends. A token can only be exchanged once: presenting
+// it again means someone else has a copy, so the whole session is revoked
+// and errRefreshTokenReused returned.
+func rotateRefreshToken(ctx context.Context, token string) (string, error) {
+	result, err := markRefreshTokenUsed.Run(ctx, redisCli, []string{refreshTokenKey(token)}, time.Now().UTC().Format(time.RFC3339Nano)).Slice()
+	if err != nil {
+		return "", err
+	}
+	state, _ := result[0].(int64)
+	sessionID, _ := result[1].(string)
+	userIDField, _ := result[2].(string)
+	userID, _ := strconv.Atoi(userIDField)
+
+	switch state {
+	case 0:
+		return "", errInvalidRefreshToken
+	case 2:
+		if err := revokeSession(ctx, userID, sessionID); err != nil {
+			return "", err
+		}
+		registry.DisconnectSession(strconv.Itoa(userID), sessionID, websocket.ClosePolicyViolation, "session revoked")
+		return "", errRefreshTokenReused
+	}
+
+	active, err := sessionActive(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	if !active {
+		return "", errInvalidRefreshToken
+	}
+	if err := extendSession(ctx, userID, sessionID); err != nil {
+		return "", err
+	}
+	return createRefreshToken(ctx, sessionID, userID)
+}
+
+// refreshTokens exchanges the refresh token cookie for a new access token
+// and refresh token.
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.refreshTokens")
+	defer span.End()
+
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err != nil || cookie.Value == "" {
+		WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Missing refresh token")
+		return
+	}
+
+	sessionID, userID, err := refreshTokenOwner(ctx, cookie.Value)
+	if err == errInvalidRefreshToken {
+		clearRefreshCookie(w)
+		WriteError(w, http.StatusUnauthorized, "invalid_refresh_token", err.Error())
+		return
+	} else if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to refresh session")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	// The role is read again so that a changed role reaches the new token.
+	// This happens before the token is used up, so that a failure here
+	// leaves it good for a retry.
+	var role string
+	var banned bool
+	err = db.QueryRowContext(ctx, "SELECT role, banned_at IS NOT NULL FROM users WHERE user_id = $1 AND deleted_at IS NULL", userID).Scan(&role, &banned)
+	if err == sql.ErrNoRows {
+		clearRefreshCookie(w)
+		WriteError(w, http.StatusUnauthorized, "invalid_refresh_token", errInvalidRefreshToken.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		WriteError(w, http.StatusForbidden, "banned", "Account banned")
+		return
+	}
+
+	refreshToken, err := rotateRefreshToken(ctx, cookie.Value)
+	switch err {
+	case nil:
+	case errRefreshTokenReused:
+		recordAudit(ctx, 0, "refresh_token_reuse", userTarget(userID))
+		clearRefreshCookie(w)
+		WriteError(w, http.StatusUnauthorized, "refresh_token_reused", err.Error())
+		return
+	case errInvalidRefreshToken:
+		clearRefreshCookie(w)
+		WriteError(w, http.StatusUnauthorized, "invalid_refresh_token", err.Error())
+		return
+	default:
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to refresh session")
+		return
+	}
+
+	accessToken, err := newAccessToken(userID, role, sessionID)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to issue token")
+		return
+	}
+	setRefreshCookie(w, refreshToken)
+	writeTokens(w, accessToken)
+}
+
+func setRefreshCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    token,
+		Path:     refreshTokenPath,
+		MaxAge:   int(cfg.RefreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearRefreshCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Path:     refreshTokenPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func writeTokens(w http.ResponseWriter, accessToken string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loginResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(cfg.AccessTokenTTL.Seconds()),
+	})
+}
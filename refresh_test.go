@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loginRefreshToken logs in and returns the refresh token cookie.
+func loginRefreshToken(t *testing.T) *http.Cookie {
+	rr := postLogin("vishnu", "password123")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", rr.Code, rr.Body)
+	}
+	return refreshCookie(t, rr)
+}
+
+func refreshCookie(t *testing.T, rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == refreshTokenCookie {
+			return cookie
+		}
+	}
+	t.Fatal("no refresh token cookie")
+	return nil
+}
+
+func postRefresh(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/token/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: token})
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	first := loginRefreshToken(t)
+
+	rr := postRefresh(first.Value)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp loginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseToken(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 42, claims.UserID)
+
+	second := refreshCookie(t, rr)
+	assert.NotEqual(t, first.Value, second.Value, "refresh should issue a new token")
+	assert.Equal(t, refreshTokenPath, second.Path)
+
+	rr = postRefresh(second.Value)
+	assert.Equal(t, http.StatusOK, rr.Code, "the new token should be good for the next refresh")
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	rec := initRecordingAuditor(t)
+	first := loginRefreshToken(t)
+
+	rr := postRefresh(first.Value)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	second := refreshCookie(t, rr)
+	var resp loginResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+
+	rr = postRefresh(first.Value)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "refresh_token_reused")
+	assert.Equal(t, -1, refreshCookie(t, rr).MaxAge, "the cookie should be cleared")
+
+	// The whole family is gone, including the token the thief may hold.
+	assert.Equal(t, http.StatusUnauthorized, postRefresh(second.Value).Code)
+
+	// So is the session the access tokens were bound to.
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	events := rec.recorded()
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, "refresh_token_reuse", events[len(events)-1].Action)
+	}
+}
+
+func TestRefreshTokenExpires(t *testing.T) {
+	mr := initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	defer func(ttl time.Duration) { cfg.RefreshTokenTTL = ttl }(cfg.RefreshTokenTTL)
+	cfg.RefreshTokenTTL = time.Hour
+	token := loginRefreshToken(t)
+	assert.Equal(t, 3600, token.MaxAge)
+
+	mr.FastForward(time.Hour + time.Second)
+
+	rr := postRefresh(token.Value)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid_refresh_token")
+}
+
+func TestRefreshAccessTokenExpiry(t *testing.T) {
+	initRedis(t)
+	initCredentialStore(t, 42, "vishnu", "password123")
+	defer func(ttl time.Duration) { cfg.AccessTokenTTL = ttl }(cfg.AccessTokenTTL)
+	cfg.AccessTokenTTL = time.Minute
+	token := loginRefreshToken(t)
+
+	rr := postRefresh(token.Value)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp loginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 60, resp.ExpiresIn)
+	claims, err := parseToken(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.WithinDuration(t, time.Now().Add(time.Minute), claims.ExpiresAt.Time, 5*time.Second)
+}
+
+func TestRefreshMissingToken(t *testing.T) {
+	initRedis(t)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("POST", "/token/refresh", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, postRefresh("unknown").Code)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const closeWriteTimeout = time.Second
+
+var (
+	errNotConnected  = errors.New("user has no open connections")
+	errSendQueueFull = errors.New("send queue full")
+	errConnClosed    = errors.New("connection closed")
+)
+
+// connSet is the immutable list of a user's connections. Changes replace
+// the whole set so readers never need a lock.
+type connSet struct {
+	clients []*client
+}
+
+// ConnectionRegistry tracks the open WebSocket connections of every user.
+// A user may be connected from several devices at once.
+type ConnectionRegistry struct {
+	conns sync.Map // userID -> *connSet
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{}
+}
+
+// Register adds conn to the user's connections and returns the client that
+// writes to it. The caller is expected to start its writePump.
+func (r *ConnectionRegistry) Register(userID string, conn *websocket.Conn) *client {
+	return r.RegisterTransport(userID, newWSTransport(conn), false)
+}
+
+// RegisterResuming is Register for a client that first replays what it
+// missed. Anything sent to it is held back until finishResume.
+func (r *ConnectionRegistry) RegisterResuming(userID string, conn *websocket.Conn) *client {
+	return r.RegisterTransport(userID, newWSTransport(conn), true)
+}
+
+// RegisterTransport adds a connection of any kind. If resuming is set it
+// behaves like RegisterResuming.
+func (r *ConnectionRegistry) RegisterTransport(userID string, t transport, resuming bool) *client {
+	return r.RegisterSession(userID, "", t, resuming)
+}
+
+// RegisterSession is RegisterTransport for a connection authenticated with
+// the login session sessionID, so that DisconnectSession can close it.
+func (r *ConnectionRegistry) RegisterSession(userID, sessionID string, t transport, resuming bool) *client {
+	c := newClient(userID, t)
+	c.sessionID = sessionID
+	c.resuming = resuming
+	return r.add(c)
+}
+
+func (r *ConnectionRegistry) add(c *client) *client {
+	userID := c.userID
+	for {
+		value, loaded := r.conns.LoadOrStore(userID, &connSet{clients: []*client{c}})
+		if !loaded {
+			return c
+		}
+		old := value.(*connSet)
+		next := &connSet{clients: make([]*client, 0, len(old.clients)+1)}
+		next.clients = append(append(next.clients, old.clients...), c)
+		if r.conns.CompareAndSwap(userID, old, next) {
+			return c
+		}
+	}
+}
+
+// Deregister removes the client from its user's connections. It does not
+// close the connection.
+func (r *ConnectionRegistry) Deregister(c *client) {
+	userID := c.userID
+	for {
+		value, ok := r.conns.Load(userID)
+		if !ok {
+			return
+		}
+		old := value.(*connSet)
+		next := &connSet{}
+		for _, other := range old.clients {
+			if other != c {
+				next.clients = append(next.clients, other)
+			}
+		}
+		if len(next.clients) == len(old.clients) {
+			return
+		}
+		if len(next.clients) == 0 {
+			if r.conns.CompareAndDelete(userID, old) {
+				return
+			}
+		} else if r.conns.CompareAndSwap(userID, old, next) {
+			return
+		}
+	}
+}
+
+// Disconnect removes all of the user's connections and closes each one with
+// a close frame carrying code and reason. It returns how many were closed.
+func (r *ConnectionRegistry) Disconnect(userID string, code int, reason string) int {
+	value, ok := r.conns.LoadAndDelete(userID)
+	if !ok {
+		return 0
+	}
+	clients := value.(*connSet).clients
+	for _, c := range clients {
+		c.disconnect(code, reason)
+	}
+	return len(clients)
+}
+
+// DisconnectSession removes the user's connections authenticated with the
+// session and closes them like Disconnect. It returns how many were closed.
+func (r *ConnectionRegistry) DisconnectSession(userID, sessionID string, code int, reason string) int {
+	if sessionID == "" {
+		return 0
+	}
+	n := 0
+	for _, c := range r.Connections(userID) {
+		if c.sessionID != sessionID {
+			continue
+		}
+		r.Deregister(c)
+		c.disconnect(code, reason)
+		n++
+	}
+	return n
+}
+
+// Connections returns the user's open connections.
+func (r *ConnectionRegistry) Connections(userID string) []*client {
+	value, ok := r.conns.Load(userID)
+	if !ok {
+		return nil
+	}
+	return value.(*connSet).clients
+}
+
+// Send queues v on every connection of the user and returns one error per
+// connection it could not be queued on. A user with no connections gets
+// errNotConnected.
+func (r *ConnectionRegistry) Send(userID string, v interface{}) []error {
+	clients := r.Connections(userID)
+	if len(clients) == 0 {
+		return []error{errNotConnected}
+	}
+	var errs []error
+	for _, c := range clients {
+		if !c.enqueue(v) {
+			errs = append(errs, sendError(c))
+		}
+	}
+	return errs
+}
+
+// BroadcastToMany queues v for each of the given users, skipping those that
+// are offline or whose queues are full.
+func (r *ConnectionRegistry) BroadcastToMany(userIDs []string, v interface{}) {
+	for _, userID := range userIDs {
+		r.Send(userID, v)
+	}
+}
+
+// Range calls f for every connected user until f returns false.
+func (r *ConnectionRegistry) Range(f func(userID string, clients []*client) bool) {
+	r.conns.Range(func(key, value interface{}) bool {
+		return f(key.(string), value.(*connSet).clients)
+	})
+}
+
+// Count returns the number of open connections across all users.
+func (r *ConnectionRegistry) Count() int {
+	n := 0
+	r.Range(func(_ string, clients []*client) bool {
+		n += len(clients)
+		return true
+	})
+	return n
+}
+
+func sendError(c *client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errConnClosed
+	}
+	return errSendQueueFull
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrySendToEveryDevice(t *testing.T) {
+	r := NewConnectionRegistry()
+	phone, laptop := &websocket.Conn{}, &websocket.Conn{}
+	phoneClient := r.Register("1", phone)
+	laptopClient := r.Register("1", laptop)
+
+	assert.Empty(t, r.Send("1", "hello"))
+	assert.Equal(t, "hello", <-phoneClient.send)
+	assert.Equal(t, "hello", <-laptopClient.send)
+
+	r.Deregister(phoneClient)
+	assert.Equal(t, []*client{laptopClient}, r.Connections("1"))
+
+	r.Deregister(laptopClient)
+	assert.Equal(t, []error{errNotConnected}, r.Send("1", "hello"))
+	assert.Equal(t, 0, r.Count())
+}
+
+func TestRegistrySendReportsClosedConnections(t *testing.T) {
+	r := NewConnectionRegistry()
+	full := r.Register("1", &websocket.Conn{})
+	closed := r.Register("1", &websocket.Conn{})
+	closed.close()
+
+	for i := 0; i < sendBufferSize; i++ {
+		r.Send("1", i)
+	}
+	errs := r.Send("1", "overflow")
+	assert.Equal(t, []error{errConnClosed}, errs, "a full queue drops its oldest event instead")
+	assert.Equal(t, 2, <-full.send, "the oldest events made room for the overflow and a buffer_full error")
+}
+
+func TestRegistryBroadcastToMany(t *testing.T) {
+	r := NewConnectionRegistry()
+	a := r.Register("a", &websocket.Conn{})
+	b := r.Register("b", &websocket.Conn{})
+	c := r.Register("c", &websocket.Conn{})
+
+	r.BroadcastToMany([]string{"a", "b", "offline"}, "news")
+
+	assert.Len(t, a.send, 1)
+	assert.Len(t, b.send, 1)
+	assert.Len(t, c.send, 0)
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	r := NewConnectionRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("%d", i%5)
+			c := r.Register(userID, &websocket.Conn{})
+			go func() {
+				for range c.send {
+				}
+			}()
+			r.Send(userID, "ping")
+			r.BroadcastToMany([]string{"0", "1", "2"}, "pong")
+			r.Count()
+			r.Deregister(c)
+			c.close()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, r.Count())
+	r.Range(func(userID string, _ []*client) bool {
+		t.Errorf("user %s still registered", userID)
+		return true
+	})
+}
+
+func TestWebSocketDeliversToAllDevices(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 501)
+	phone := dialTestUser(t, server, 502)
+	laptop := dialTestUser(t, server, 502)
+	waitForClients(t, 3)
+
+	if err := sender.WriteJSON(Message{SenderID: 501, RecipientID: 502, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "hi", msg.Text)
+	}
+}
+
+func TestSlowClientPolicy(t *testing.T) {
+	for _, policy := range []string{slowClientDrop, slowClientDisconnect} {
+		t.Run(policy, func(t *testing.T) {
+			initRedis(t)
+			initFakeDB(t)
+			previous := cfg.SlowClientPolicy
+			cfg.SlowClientPolicy = policy
+			t.Cleanup(func() { cfg.SlowClientPolicy = previous })
+			server := newTestServer(t, newRouter())
+
+			// The client never reads, so once the socket buffers are full
+			// its write pump stalls and the send queue fills up.
+			dialTestUser(t, server, 601)
+			waitForClients(t, 1)
+			c := registry.Connections("601")[0]
+
+			payload := strings.Repeat("x", 64<<10)
+			start := time.Now()
+			var errs []error
+			for i := 0; i < 2000 && c.dropped.Load() == 0; i++ {
+				errs = append(errs, registry.Send("601", payload)...)
+			}
+			assert.NotZero(t, c.dropped.Load(), "the send queue never filled")
+			assert.Less(t, time.Since(start), 2*time.Second, "senders must not block on a slow client")
+			if policy == slowClientDisconnect {
+				assert.Equal(t, []error{errSendQueueFull}, errs)
+			} else {
+				assert.Empty(t, errs, "the oldest events make room for new ones")
+			}
+
+			if policy == slowClientDisconnect {
+				waitForClients(t, 0)
+			} else {
+				assert.Len(t, registry.Connections("601"), 1)
+				registry.Disconnect("601", websocket.CloseGoingAway, "")
+				waitForClients(t, 0)
+			}
+		})
+	}
+}
+
+// stalledTransport blocks every write until released.
+type stalledTransport struct {
+	recordingTransport
+	release chan struct{}
+}
+
+func (t *stalledTransport) write(v interface{}) error {
+	<-t.release
+	return t.recordingTransport.write(v)
+}
+
+func TestFullQueueDropsOldestEvents(t *testing.T) {
+	previous := cfg.SlowClientPolicy
+	cfg.SlowClientPolicy = slowClientDrop
+	t.Cleanup(func() { cfg.SlowClientPolicy = previous })
+
+	stalled := &stalledTransport{release: make(chan struct{})}
+	c := newClient("602", stalled)
+	done := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(done)
+	}()
+
+	const sent = 4 * sendBufferSize
+	start := time.Now()
+	for id := 1; id <= sent; id++ {
+		assert.True(t, c.enqueue(Message{ID: id, Text: "hi"}))
+	}
+	assert.Less(t, time.Since(start), time.Second, "senders must not block on a slow recipient")
+
+	close(stalled.release)
+	c.close()
+	<-done
+
+	var ids []int
+	var errs []ErrorEvent
+	for _, v := range stalled.written {
+		switch v := v.(type) {
+		case Message:
+			ids = append(ids, v.ID)
+		case ErrorEvent:
+			errs = append(errs, v)
+		}
+	}
+	assert.Equal(t, []ErrorEvent{newErrorEvent(codeBufferFull, errBufferFull)}, errs, "one error for the whole burst")
+	assert.Equal(t, sent, ids[len(ids)-1], "the newest message is kept")
+	assert.NotContains(t, ids, 2, "the oldest queued messages are dropped")
+	assert.EqualValues(t, sent-len(ids), c.dropped.Load())
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	reportActionNone          = "none"
+	reportActionDeleteMessage = "delete_message"
+	reportActionBanSender     = "ban_sender"
+
+	// reportReasonFlagged marks the reports the message filter files.
+	reportReasonFlagged = "flagged"
+
+	// reportContextMessages is how many messages on either side of a
+	// reported one are shown with it.
+	reportContextMessages = 2
+
+	defaultReportListLimit = 20
+	maxReportListLimit     = 100
+)
+
+var (
+	reportReasons = []string{"spam", "harassment", "hate", "violence", "other"}
+	reportActions = []string{reportActionNone, reportActionDeleteMessage, reportActionBanSender}
+
+	errReportResolved = errors.New("report is already resolved")
+)
+
+// Report is a user's complaint about a message, or the message filter's.
+// Reports the filter filed have no ReporterID. Reports of room messages,
+// which only the filter files, carry the RoomID and the ID of the message
+// among the room's.
+type Report struct {
+	ID         int        `json:"id"`
+	MessageID  int        `json:"message_id"`
+	RoomID     int        `json:"room_id,omitempty"`
+	ReporterID int        `json:"reporter_id,omitempty"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy *int       `json:"resolved_by,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+type reportRequest struct {
+	Reason string `json:"reason"`
+}
+
+type resolveReportRequest struct {
+	Action string `json:"action"`
+}
+
+// reportedMessage is an entry of the moderation queue: a message, its open
+// reports and the messages around it in its conversation.
+type reportedMessage struct {
+	Message Message   `json:"message"`
+	Reports []Report  `json:"reports"`
+	Context []Message `json:"context"`
+}
+
+// reportMessage reports a message the caller sent or received. Reporting
+// the same message again returns the existing report.
+func reportMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.reportMessage")
+	defer span.End()
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.message_id", messageID))
+
+	var req reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if !slices.Contains(reportReasons, req.Reason) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "reason must be one of spam, harassment, hate, violence, other")
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if !checkMessageAccess(ctx, w, claims, messageID) {
+		return
+	}
+
+	// The no-op update makes RETURNING yield the existing row on a
+	// duplicate; xmax is 0 only for a row this statement inserted.
+	report := Report{MessageID: messageID, ReporterID: claims.UserID}
+	var created bool
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO message_reports (message_id, reporter_id, reason) VALUES ($1, $2, $3)
+		ON CONFLICT (message_id, reporter_id) DO UPDATE SET reporter_id = EXCLUDED.reporter_id
+		RETURNING report_id, reason, created_at, xmax = 0`,
+		messageID, claims.UserID, req.Reason).Scan(&report.ID, &report.Reason, &report.CreatedAt, &created)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// reportColumn is the column of message_reports that holds msg.
+func reportColumn(msg Message) string {
+	if msg.RoomID != 0 {
+		return "room_message_id"
+	}
+	return "message_id"
+}
+
+// reportedMessageColumns select the message a report is about from the
+// messages m or room_messages rm joined to it.
+const reportedMessageColumns = `COALESCE(m.message_id, rm.message_id), COALESCE(m.seq, 0),
+	COALESCE(m.sender_id, rm.sender_id), COALESCE(m.receiver_id, 0), COALESCE(rm.room_id, 0)`
+
+// listReports returns a page of the messages with open reports, oldest
+// report first, each with the messages around it. The cursor is the ID of
+// the first report of the last message of the previous page.
+func listReports(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listReports")
+	defer span.End()
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultReportListLimit, maxReportListLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT r.report_id, COALESCE(r.reporter_id, 0), r.reason, r.created_at,
+			`+reportedMessageColumns+`, COALESCE(m.text, rm.text),
+			COALESCE(m.created_at, rm.created_at), COALESCE(m.updated_at, rm.created_at)
+		FROM message_reports r
+		LEFT JOIN messages m ON m.message_id = r.message_id
+		LEFT JOIN room_messages rm ON rm.message_id = r.room_message_id
+		WHERE r.resolved_at IS NULL
+		ORDER BY r.created_at, r.report_id`)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	queue := []*reportedMessage{}
+	byMessage := make(map[string]*reportedMessage)
+	for rows.Next() {
+		var report Report
+		var msg Message
+		err := rows.Scan(&report.ID, &report.ReporterID, &report.Reason, &report.CreatedAt,
+			&msg.ID, &msg.Seq, &msg.SenderID, &msg.RecipientID, &msg.RoomID, &msg.Text, &msg.CreatedAt, &msg.UpdatedAt)
+		if err != nil {
+			logger(ctx).Println("Failed to scan report:", err)
+			WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to load reports")
+			return
+		}
+		report.MessageID, report.RoomID = msg.ID, msg.RoomID
+		key := reportColumn(msg) + ":" + strconv.Itoa(msg.ID)
+		entry := byMessage[key]
+		if entry == nil {
+			entry = &reportedMessage{Message: msg}
+			byMessage[key] = entry
+			queue = append(queue, entry)
+		}
+		entry.Reports = append(entry.Reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Reports are all read to be grouped by message, so the queue is
+	// counted and paged as it is.
+	total := int64(len(queue))
+	firstReport := func(entry *reportedMessage) int { return entry.Reports[0].ID }
+	if cursor != nil {
+		i := slices.IndexFunc(queue, func(entry *reportedMessage) bool { return firstReport(entry) == *cursor })
+		if i < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, errInvalidCursor.Error())
+			return
+		}
+		queue = queue[i+1:]
+	}
+	if len(queue) > limit+1 {
+		queue = queue[:limit+1]
+	}
+	page := newPage(queue, limit, total, firstReport)
+
+	for _, entry := range page.Items {
+		entry.Context, err = surroundingMessages(ctx, entry.Message)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writePage(w, page)
+}
+
+// surroundingMessages returns the messages of msg's conversation numbered
+// within reportContextMessages of it, in order.
+func surroundingMessages(ctx context.Context, msg Message) ([]Message, error) {
+	if msg.RoomID != 0 {
+		return surroundingRoomMessages(ctx, msg)
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, seq, sender_id, receiver_id, text, created_at, updated_at FROM messages
+		WHERE LEAST(sender_id, receiver_id) = LEAST($1::int, $2::int)
+		AND GREATEST(sender_id, receiver_id) = GREATEST($1::int, $2::int)
+		AND seq BETWEEN $3::bigint - $4 AND $3::bigint + $4 AND seq <> $3
+		AND deleted_at IS NULL
+		ORDER BY seq`, msg.SenderID, msg.RecipientID, msg.Seq, reportContextMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Seq, &m.SenderID, &m.RecipientID, &m.Text, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// surroundingRoomMessages returns the reportContextMessages stored messages
+// of msg's room on either side of it, in order.
+func surroundingRoomMessages(ctx context.Context, msg Message) ([]Message, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, kind, sender_id, text, created_at FROM (
+			(SELECT * FROM room_messages WHERE room_id = $1 AND message_id < $2 ORDER BY message_id DESC LIMIT $3)
+			UNION ALL
+			(SELECT * FROM room_messages WHERE room_id = $1 AND message_id > $2 ORDER BY message_id LIMIT $3)
+		) AS around
+		WHERE expires_at IS NULL OR expires_at > NOW()
+		ORDER BY message_id`, msg.RoomID, msg.ID, reportContextMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []Message{}
+	for rows.Next() {
+		m := Message{RoomID: msg.RoomID}
+		if err := rows.Scan(&m.ID, &m.Kind, &m.SenderID, &m.Text, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.Kind = roomMessageKind(m.Kind)
+		m.UpdatedAt = m.CreatedAt
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// resolveReport closes a report, and every other open report of the same
+// message, after taking the moderator's action on it: nothing, deleting the
+// message or banning its sender.
+func resolveReport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.resolveReport")
+	defer span.End()
+
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid report id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.report_id", reportID))
+
+	var req resolveReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if !slices.Contains(reportActions, req.Action) {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "action must be one of none, delete_message, ban_sender")
+		return
+	}
+	span.SetAttributes(attribute.String("chat.report_action", req.Action))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	report, msg, err := openReport(ctx, reportID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Report not found")
+		return
+	} else if err == errReportResolved {
+		WriteError(w, http.StatusConflict, codeConflict, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Action {
+	case reportActionDeleteMessage:
+		if err := tombstoneMessage(ctx, msg); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	case reportActionBanSender:
+		if msg.SenderID == claims.UserID {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "Admins cannot ban themselves")
+			return
+		}
+		// A sender who has since deleted the account is gone already.
+		if _, err := banAccount(ctx, Ban{UserID: msg.SenderID, BannedBy: claims.UserID, Reason: report.Reason}); err != sql.ErrNoRows && !writeBanError(w, err) {
+			return
+		}
+	}
+
+	err = db.QueryRowContext(ctx,
+		`UPDATE message_reports SET resolved_at = NOW(), resolved_by = $2, resolution = $3
+		WHERE `+reportColumn(msg)+` = $1 AND resolved_at IS NULL
+		RETURNING NOW()`, report.MessageID, claims.UserID, req.Action).Scan(&report.ResolvedAt)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusConflict, codeConflict, errReportResolved.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	report.ResolvedBy = &claims.UserID
+	report.Resolution = req.Action
+	target := "message:"
+	if msg.RoomID != 0 {
+		target = "room_message:"
+	}
+	recordAudit(ctx, claims.UserID, "report_resolve:"+req.Action, target+strconv.Itoa(report.MessageID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// openReport loads a report with the message it is about. It returns
+// errReportResolved if the report is closed.
+func openReport(ctx context.Context, reportID int) (Report, Message, error) {
+	report := Report{ID: reportID}
+	var msg Message
+	var resolvedAt sql.NullTime
+	err := db.QueryRowContext(ctx,
+		`SELECT COALESCE(r.reporter_id, 0), r.reason, r.created_at, r.resolved_at, `+reportedMessageColumns+`
+		FROM message_reports r
+		LEFT JOIN messages m ON m.message_id = r.message_id
+		LEFT JOIN room_messages rm ON rm.message_id = r.room_message_id
+		WHERE r.report_id = $1`, reportID).
+		Scan(&report.ReporterID, &report.Reason, &report.CreatedAt, &resolvedAt,
+			&msg.ID, &msg.Seq, &msg.SenderID, &msg.RecipientID, &msg.RoomID)
+	if err != nil {
+		return report, msg, err
+	}
+	report.MessageID, report.RoomID = msg.ID, msg.RoomID
+	if resolvedAt.Valid {
+		return report, msg, errReportResolved
+	}
+	return report, msg, nil
+}
+
+// tombstoneMessage replaces the text of a message the way deleting its
+// sender's account does, drops its rendered HTML and the previews of its
+// links and unpins it. The row stays so that the conversation keeps its
+// shape.
+func tombstoneMessage(ctx context.Context, msg Message) error {
+	if msg.RoomID != 0 {
+		return tombstoneRoomMessage(ctx, msg)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE messages SET text = $2 WHERE message_id = $1", msg.ID, deletedMessageText); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM link_previews WHERE message_id = $1", msg.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_renders WHERE message_id = $1", msg.ID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM pins WHERE message_id = $1", msg.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	tombstoned(ctx, msg, res)
+	return nil
+}
+
+// tombstoneRoomMessage replaces the text of a stored room message and
+// unpins it.
+func tombstoneRoomMessage(ctx context.Context, msg Message) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE room_messages SET text = $2 WHERE message_id = $1", msg.ID, deletedMessageText); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM pins WHERE room_message_id = $1", msg.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	tombstoned(ctx, msg, res)
+	return nil
+}
+
+// tombstoned tells the conversation of a tombstoned message that it was
+// unpinned, if unpinning it removed a pin, and updates the recent list.
+func tombstoned(ctx context.Context, msg Message, unpinned sql.Result) {
+	if n, _ := unpinned.RowsAffected(); n > 0 {
+		notifyPin(ctx, PinEvent{Type: "message_unpinned", Conversation: conversationKey(msg), MessageID: msg.ID})
+	}
+	if err := tombstoneRecentMessage(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to update recent messages:", err)
+	}
+}
+
+// tombstoneRecentMessage replaces the text of msg in its conversation's
+// list of recent messages, if it is still there.
+func tombstoneRecentMessage(ctx context.Context, msg Message) error {
+	key := recentMessagesKey(conversationKey(msg))
+	values, err := redisCli.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		var cached Message
+		if err := json.Unmarshal([]byte(value), &cached); err != nil || cached.ID != msg.ID {
+			continue
+		}
+		cached.Text = deletedMessageText
+		cached.LinkPreviews = nil
+		cached.Format, cached.RenderedHTML = "", ""
+		payload, err := json.Marshal(cached)
+		if err != nil {
+			return err
+		}
+		return redisCli.LSet(ctx, key, int64(i), payload).Err()
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func moderationRequest(t *testing.T, router http.Handler, userID int, role, method, path string, body interface{}) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), userID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestReportRejectsUnknownReason(t *testing.T) {
+	initRedis(t)
+	router := newRouter()
+
+	rr := moderationRequest(t, router, 1, RoleUser, "POST", "/messages/1/report", reportRequest{Reason: "boring"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	rr = moderationRequest(t, router, 1, RoleUser, "GET", "/admin/reports", nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only admins see the queue")
+
+	rr = moderationRequest(t, router, 1, RoleAdmin, "POST", "/admin/reports/1/resolve", resolveReportRequest{Action: "shrug"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestReportResolvedByDeletingMessage(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+	router := newRouter()
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	adminID := insertTestUser(t, "hash")
+	outsiderID := insertTestUser(t, "hash")
+	var sent []Message
+	for _, text := range []string{"hello", "how are you", "something nasty", "sorry", "bye"} {
+		msg, err := storeMessage(ctx, Message{SenderID: senderID, RecipientID: recipientID, Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	reported := sent[2]
+	reportPath := "/messages/" + strconv.Itoa(reported.ID) + "/report"
+
+	rr := moderationRequest(t, router, recipientID, RoleUser, "POST", reportPath, reportRequest{Reason: "harassment"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var report Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = moderationRequest(t, router, recipientID, RoleUser, "POST", reportPath, reportRequest{Reason: "spam"})
+	assert.Equal(t, http.StatusOK, rr.Code, "reporting again is idempotent")
+	var again Report
+	json.NewDecoder(rr.Body).Decode(&again)
+	assert.Equal(t, report.ID, again.ID)
+	assert.Equal(t, "harassment", again.Reason)
+
+	rr = moderationRequest(t, router, outsiderID, RoleUser, "POST", reportPath, reportRequest{Reason: "spam"})
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only participants can report")
+
+	rr = moderationRequest(t, router, adminID, RoleAdmin, "GET", "/admin/reports", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var queue Page[reportedMessage]
+	if err := json.NewDecoder(rr.Body).Decode(&queue); err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 1, queue.Total)
+	var entry *reportedMessage
+	for i := range queue.Items {
+		if queue.Items[i].Message.ID == reported.ID {
+			entry = &queue.Items[i]
+		}
+	}
+	if !assert.NotNil(t, entry, "the reported message is queued") {
+		return
+	}
+	assert.Len(t, entry.Reports, 1)
+	var contextTexts []string
+	for _, msg := range entry.Context {
+		contextTexts = append(contextTexts, msg.Text)
+	}
+	assert.Equal(t, []string{"hello", "how are you", "sorry", "bye"}, contextTexts)
+
+	resolvePath := "/admin/reports/" + strconv.Itoa(report.ID) + "/resolve"
+	rr = moderationRequest(t, router, adminID, RoleAdmin, "POST", resolvePath, resolveReportRequest{Action: reportActionDeleteMessage})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resolved Report
+	json.NewDecoder(rr.Body).Decode(&resolved)
+	assert.Equal(t, reportActionDeleteMessage, resolved.Resolution)
+	assert.NotNil(t, resolved.ResolvedAt)
+
+	rr = moderationRequest(t, router, adminID, RoleAdmin, "POST", resolvePath, resolveReportRequest{Action: reportActionNone})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = getMessagesRequest(t, recipientID, "?with="+strconv.Itoa(senderID))
+	var history Page[Message]
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	texts := make(map[int]string)
+	for _, msg := range history.Items {
+		texts[msg.ID] = msg.Text
+	}
+	assert.Len(t, history.Items, len(sent), "the deleted message keeps its place")
+	assert.Equal(t, deletedMessageText, texts[reported.ID])
+	assert.Equal(t, "sorry", texts[sent[3].ID])
+}
+
+// reportQueueConn answers the moderation queue with two reports of direct
+// message 10 and one each of direct message 11 and room message 10, and
+// nothing around them.
+type reportQueueConn struct {
+	fakeConn
+}
+
+func (reportQueueConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT r.report_id") {
+		return &tableRows{columns: []string{"message_id", "seq", "sender_id", "receiver_id", "text", "created_at", "updated_at"}}, nil
+	}
+	report := func(id, messageID, roomID int64) []driver.Value {
+		receiverID := int64(2)
+		if roomID != 0 {
+			receiverID = 0
+		}
+		return []driver.Value{id, int64(2), "spam", insertedAt, messageID, int64(0), int64(1), receiverID, roomID, "buy now", insertedAt, insertedAt}
+	}
+	return &tableRows{
+		columns: []string{"report_id", "reporter_id", "reason", "created_at",
+			"message_id", "seq", "sender_id", "receiver_id", "room_id", "text", "created_at", "updated_at"},
+		rows: [][]driver.Value{report(1, 10, 0), report(2, 10, 0), report(3, 11, 0), report(4, 10, 7)},
+	}, nil
+}
+
+type reportQueueStore struct{}
+
+func (reportQueueStore) Connect(context.Context) (driver.Conn, error) { return reportQueueConn{}, nil }
+func (reportQueueStore) Driver() driver.Driver                        { return nil }
+
+func TestListReportsPages(t *testing.T) {
+	initRedis(t)
+	db = sql.OpenDB(reportQueueStore{})
+	t.Cleanup(func() { db.Close() })
+	router := newRouter()
+	list := func(query string) Page[reportedMessage] {
+		rr := moderationRequest(t, router, 1, RoleAdmin, "GET", "/admin/reports"+query, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var page Page[reportedMessage]
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page
+	}
+
+	page := list("?limit=2")
+	assert.EqualValues(t, 3, page.Total, "reports are counted by message")
+	if assert.Len(t, page.Items, 2) && assert.NotNil(t, page.NextCursor) {
+		assert.Len(t, page.Items[0].Reports, 2)
+		assert.Equal(t, 11, page.Items[1].Message.ID)
+		assert.Equal(t, "3", *page.NextCursor, "the cursor is the first report of the last message")
+
+		page = list("?limit=2&cursor=" + *page.NextCursor)
+		if assert.Len(t, page.Items, 1) {
+			assert.Equal(t, 7, page.Items[0].Message.RoomID, "a room message is not mixed up with a direct one")
+		}
+		assert.False(t, page.HasNext)
+	}
+
+	rr := moderationRequest(t, router, 1, RoleAdmin, "GET", "/admin/reports?cursor=2", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "not the first report of a message")
+}
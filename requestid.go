@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	requestIDKey contextKey = "request_id"
+)
+
+// validRequestID is what a client may send as its own request ID. Anything
+// else is replaced, so that the logs cannot be forged with it.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDMiddleware gives every request an ID, the client's X-Request-ID
+// if it sent a usable one, and echoes it in the response. Lines logged
+// through logger with the request's context carry it.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logger returns the standard logger, or one that puts the request ID in
+// front of every message when ctx belongs to a request.
+func logger(ctx context.Context) *log.Logger {
+	id := requestIDFromContext(ctx)
+	if id == "" {
+		return log.Default()
+	}
+	return log.New(log.Writer(), "request_id="+id+" ", log.Flags()|log.Lmsgprefix)
+}
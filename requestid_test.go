@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer the logger and the test can share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	var buf syncBuffer
+	saved := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(saved) })
+	return &buf
+}
+
+func TestRequestIDEchoed(t *testing.T) {
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, w.Header().Get(requestIDHeader), requestIDFromContext(r.Context()))
+	}))
+	get := func(id string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get(requestIDHeader)
+	}
+
+	assert.Equal(t, "client-chosen.id:1", get("client-chosen.id:1"))
+	for _, id := range []string{"", "has spaces", "line\nbreak", strings.Repeat("x", 129)} {
+		generated := get(id)
+		_, err := uuid.Parse(generated)
+		assert.NoError(t, err, "%q should be replaced", id)
+	}
+	assert.NotEqual(t, get(""), get(""))
+}
+
+func TestRequestIDInLogLines(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+	buf := captureLog(t)
+
+	token, err := createSession(context.Background(), 961, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{requestIDHeader: {"ws-961"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/961?token="+token, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ws-961", resp.Header.Get(requestIDHeader))
+	waitForClients(t, 1)
+
+	// Without a database every step of the send logs a failure.
+	if err := conn.WriteJSON(Message{SenderID: 961, RecipientID: 962, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), "Failed to store message")
+	}, 2*time.Second, 5*time.Millisecond)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), "error reading JSON message")
+	}, 2*time.Second, 5*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Greater(t, len(lines), 2)
+	for _, line := range lines {
+		assert.Contains(t, line, " request_id=ws-961 ", "every line of the connection carries its ID")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// resumeBatchSize is how many missed messages are read from Postgres at a
+// time while replaying.
+const resumeBatchSize = 500
+
+var errResumeFailed = errors.New("missed messages could not be replayed")
+
+// ResumeCompleteEvent tells a resuming client that everything it missed has
+// been replayed and what follows is live.
+type ResumeCompleteEvent struct {
+	Type          string `json:"type"`
+	Replayed      int    `json:"replayed"`
+	LastMessageID int    `json:"last_message_id"`
+}
+
+// parseResumeParam reads last_message_id from a WebSocket upgrade request.
+// ok is false when the client did not ask to resume.
+func parseResumeParam(value string) (lastID int, ok bool, err error) {
+	if value == "" {
+		return 0, false, nil
+	}
+	lastID, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, false, err
+	}
+	if lastID < 0 {
+		return 0, false, errors.New("last_message_id must not be negative")
+	}
+	return lastID, true, nil
+}
+
+// replayMissed writes every message the user received after lastID straight
+// to the connection, oldest first. It returns the ID of the last message
+// written and how many there were. It must run before the client's
+// writePump starts.
+func replayMissed(ctx context.Context, c *client, userID, lastID int) (int, int, error) {
+	replayed := 0
+	for {
+		rows, err := db.QueryContext(ctx,
+			`SELECT message_id, seq, sender_id, receiver_id, text, expires_at, created_at, updated_at FROM messages
+			WHERE receiver_id = $1 AND message_id > $2 AND NOT request AND deleted_at IS NULL
+			AND (expires_at IS NULL OR expires_at > NOW())
+			ORDER BY message_id
+			LIMIT $3`, userID, lastID, resumeBatchSize)
+		if err != nil {
+			return lastID, replayed, err
+		}
+
+		var batch []Message
+		for rows.Next() {
+			var msg Message
+			if err := rows.Scan(&msg.ID, &msg.Seq, &msg.SenderID, &msg.RecipientID, &msg.Text, &msg.ExpiresAt, &msg.CreatedAt, &msg.UpdatedAt); err != nil {
+				rows.Close()
+				return lastID, replayed, err
+			}
+			batch = append(batch, msg)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return lastID, replayed, err
+		}
+
+		for _, msg := range batch {
+			// The message may have expired since the query ran.
+			if messageExpired(msg, time.Now()) {
+				lastID = msg.ID
+				continue
+			}
+			if err := c.transport.write(msg); err != nil {
+				return lastID, replayed, err
+			}
+			lastID = msg.ID
+			replayed++
+		}
+		if len(batch) < resumeBatchSize {
+			return lastID, replayed, nil
+		}
+	}
+}
+
+// resumeClient replays what the client missed since lastID, tells it how
+// that went and then queues the live events held back meanwhile. It runs
+// before the client's write pump starts.
+func resumeClient(ctx context.Context, c *client, userID, lastID int) {
+	replayedTo, replayed, err := replayMissed(ctx, c, userID, lastID)
+	if err != nil {
+		logger(ctx).Println("Failed to replay missed messages:", err)
+		c.transport.write(newErrorEvent("resume_failed", errResumeFailed))
+	} else {
+		c.transport.write(ResumeCompleteEvent{Type: "resume_complete", Replayed: replayed, LastMessageID: replayedTo})
+	}
+	c.finishResume(replayedTo)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumingClientHoldsLiveEvents(t *testing.T) {
+	r := NewConnectionRegistry()
+	c := r.RegisterResuming("1", &websocket.Conn{})
+
+	r.Send("1", Message{ID: 4, Text: "also in the backlog"})
+	r.Send("1", Message{ID: 6, Text: "live"})
+	r.Send("1", "event")
+	assert.Empty(t, c.send, "nothing may overtake the backlog")
+
+	c.finishResume(5)
+	assert.Equal(t, Message{ID: 6, Text: "live"}, <-c.send)
+	assert.Equal(t, "event", <-c.send)
+	assert.Empty(t, c.send)
+
+	r.Send("1", "after")
+	assert.Equal(t, "after", <-c.send)
+}
+
+func TestWebSocketRejectsInvalidResumeParam(t *testing.T) {
+	initRedis(t)
+	server := newTestServer(t, newRouter())
+
+	token, err := createSession(context.Background(), 1, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/1?last_message_id=abc&token=" + token
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebSocketResumeReplaysMissedMessages(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	server := newTestServer(t, newRouter())
+
+	senderID := insertTestUser(t, "hash")
+	recipientID := insertTestUser(t, "hash")
+	ctx := context.Background()
+
+	seen, err := storeMessage(ctx, Message{SenderID: senderID, RecipientID: recipientID, Text: "before the drop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missed []int
+	for i := 0; i < 5; i++ {
+		msg, err := storeMessage(ctx, Message{SenderID: senderID, RecipientID: recipientID, Text: fmt.Sprintf("missed %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		missed = append(missed, msg.ID)
+	}
+
+	token, err := createSession(ctx, recipientID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL := fmt.Sprintf("ws%s/ws/%d?last_message_id=%d&token=%s", strings.TrimPrefix(server.URL, "http"), recipientID, seen.ID, token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var replayed []int
+	for i := range missed {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "missed "+strconv.Itoa(i), msg.Text)
+		replayed = append(replayed, msg.ID)
+	}
+	assert.Equal(t, missed, replayed)
+
+	var done ResumeCompleteEvent
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(payload, &done)
+	assert.Equal(t, ResumeCompleteEvent{Type: "resume_complete", Replayed: 5, LastMessageID: missed[4]}, done)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	retentionInterval = time.Hour
+	retentionBatch    = 1000
+)
+
+var retentionPurged = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "chat_retention_purged_messages_total",
+	Help: "Direct and room messages deleted for being older than the retention period.",
+})
+
+// RetentionPurger deletes direct and room messages older than Retention,
+// except the pinned ones and direct messages under legal hold. It deletes
+// Batch rows at a time, so that no statement holds its locks for long.
+type RetentionPurger struct {
+	Retention time.Duration
+	Interval  time.Duration
+	Batch     int
+	Clock     Clock
+}
+
+func NewRetentionPurger(retention time.Duration) *RetentionPurger {
+	return &RetentionPurger{
+		Retention: retention,
+		Interval:  retentionInterval,
+		Batch:     retentionBatch,
+		Clock:     realClock{},
+	}
+}
+
+// Run purges once every Interval until ctx is cancelled.
+func (p *RetentionPurger) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.Clock.After(p.Interval):
+			purged, err := p.purge(ctx)
+			if err != nil {
+				log.Println("retention: failed to purge messages:", err)
+			}
+			if purged > 0 {
+				log.Printf("retention: purged %d messages", purged)
+			}
+		}
+	}
+}
+
+// retentionDeletes delete a batch of the unpinned direct and room messages
+// sent before the cutoff, returning the ID and conversation of each.
+var retentionDeletes = []string{
+	`DELETE FROM messages WHERE message_id IN (
+		SELECT message_id FROM messages m
+		WHERE created_at < $1 AND NOT legal_hold
+		AND NOT EXISTS (SELECT 1 FROM pins WHERE pins.message_id = m.message_id)
+		ORDER BY message_id LIMIT $2
+	) RETURNING message_id, sender_id, receiver_id, 0`,
+	`DELETE FROM room_messages WHERE message_id IN (
+		SELECT message_id FROM room_messages m
+		WHERE created_at < $1
+		AND NOT EXISTS (SELECT 1 FROM pins WHERE pins.room_message_id = m.message_id)
+		ORDER BY message_id LIMIT $2
+	) RETURNING message_id, sender_id, 0, room_id`,
+}
+
+// purge deletes the messages sent before the cutoff in batches until none
+// are left, then drops them from Redis. It returns how many it deleted.
+func (p *RetentionPurger) purge(ctx context.Context) (int, error) {
+	cutoff := p.Clock.Now().Add(-p.Retention)
+	purged := make(map[string][]int)
+	total := 0
+	defer p.forget(ctx, purged)
+	for _, stmt := range retentionDeletes {
+		for {
+			rows, err := db.QueryContext(ctx, stmt, cutoff, p.Batch)
+			if err != nil {
+				return total, err
+			}
+			deleted := 0
+			for rows.Next() {
+				var msg Message
+				if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.RoomID); err != nil {
+					rows.Close()
+					return total, err
+				}
+				conversation := conversationKey(msg)
+				purged[conversation] = append(purged[conversation], msg.ID)
+				deleted++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return total, err
+			}
+			total += deleted
+			retentionPurged.Add(float64(deleted))
+			if deleted < p.Batch {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// forget removes the purged messages from the recent lists of their
+// conversations and drops the cached reaction counts of direct ones.
+func (p *RetentionPurger) forget(ctx context.Context, purged map[string][]int) {
+	for conversation, ids := range purged {
+		gone := make(map[int]bool, len(ids))
+		keys := make([]string, 0, len(ids))
+		for _, id := range ids {
+			gone[id] = true
+			keys = append(keys, reactionsKey(id))
+		}
+		if err := removeRecentMessages(ctx, conversation, gone); err != nil {
+			log.Println("retention: failed to trim recent messages:", err)
+		}
+		// Reaction counts are keyed by direct message ID alone.
+		if strings.HasPrefix(conversation, "room:") {
+			continue
+		}
+		if err := redisCli.Del(ctx, keys...).Err(); err != nil {
+			log.Println("retention: failed to drop reaction counts:", err)
+		}
+	}
+}
+
+// removeRecentMessages drops the messages with the given ids from the
+// conversation's recent list.
+func removeRecentMessages(ctx context.Context, conversation string, ids map[int]bool) error {
+	key := recentMessagesKey(conversation)
+	values, err := redisCli.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := redisCli.Pipeline()
+	for _, value := range values {
+		var msg Message
+		if err := json.Unmarshal([]byte(value), &msg); err == nil && ids[msg.ID] {
+			pipe.LRem(ctx, key, 1, value)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// setLegalHold puts the message in the path under legal hold, or with
+// DELETE releases it, so that the retention purge skips it or no longer
+// does.
+func setLegalHold(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.setLegalHold")
+	defer span.End()
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid message id")
+		return
+	}
+	hold := r.Method != http.MethodDelete
+	span.SetAttributes(attribute.Int("chat.message_id", messageID), attribute.Bool("chat.legal_hold", hold))
+
+	res, err := db.ExecContext(ctx, "UPDATE messages SET legal_hold = $2 WHERE message_id = $1", messageID, hold)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	}
+	if claims := claimsFromContext(ctx); claims != nil {
+		action := "legal_hold"
+		if !hold {
+			action = "legal_hold_release"
+		}
+		recordAudit(ctx, claims.UserID, action, "message:"+strconv.Itoa(messageID))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
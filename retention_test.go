@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// retainedMessage is a stored message as the retention purge sees it.
+type retainedMessage struct {
+	msg       Message
+	createdAt time.Time
+	pinned    bool
+	held      bool
+}
+
+// retentionStore answers the purge's delete the way Postgres would, and
+// counts the batches it was asked for.
+type retentionStore struct {
+	mu       sync.Mutex
+	messages []retainedMessage
+	batches  int
+}
+
+func (s *retentionStore) Connect(context.Context) (driver.Conn, error) {
+	return retentionConn{store: s}, nil
+}
+
+func (s *retentionStore) Driver() driver.Driver { return nil }
+
+type retentionConn struct {
+	fakeConn
+	store *retentionStore
+}
+
+func (c retentionConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	room := strings.HasPrefix(query, "DELETE FROM room_messages")
+	if !room && !strings.HasPrefix(query, "DELETE FROM messages") {
+		return nil, errors.New("not supported")
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.batches++
+	cutoff, limit := args[0].Value.(time.Time), int(args[1].Value.(int64))
+	rows := &purgedRows{}
+	remaining := c.store.messages[:0]
+	for _, m := range c.store.messages {
+		if (m.msg.RoomID != 0) == room && len(rows.messages) < limit && m.createdAt.Before(cutoff) && !m.pinned && !m.held {
+			rows.messages = append(rows.messages, m.msg)
+		} else {
+			remaining = append(remaining, m)
+		}
+	}
+	c.store.messages = remaining
+	return rows, nil
+}
+
+func (s *retentionStore) remaining() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int
+	for _, m := range s.messages {
+		ids = append(ids, m.msg.ID)
+	}
+	return ids
+}
+
+type purgedRows struct {
+	messages []Message
+}
+
+func (r *purgedRows) Columns() []string {
+	return []string{"message_id", "sender_id", "receiver_id", "room_id"}
+}
+
+func (r *purgedRows) Close() error { return nil }
+
+func (r *purgedRows) Next(dest []driver.Value) error {
+	if len(r.messages) == 0 {
+		return io.EOF
+	}
+	msg := r.messages[0]
+	dest[0], dest[1], dest[2], dest[3] = int64(msg.ID), int64(msg.SenderID), int64(msg.RecipientID), int64(msg.RoomID)
+	r.messages = r.messages[1:]
+	return nil
+}
+
+func TestRetentionPurgeSparesPinnedAndHeld(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	clock := newFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	old, recent := clock.Now().Add(-31*24*time.Hour), clock.Now().Add(-time.Hour)
+
+	store := &retentionStore{}
+	for id := 1; id <= 9; id++ {
+		m := retainedMessage{msg: Message{ID: id, SenderID: 1, RecipientID: 2, Text: "hi"}, createdAt: old}
+		switch id {
+		case 6:
+			m.pinned = true
+		case 7:
+			m.held = true
+		case 8, 9:
+			m.createdAt = recent
+		}
+		store.messages = append(store.messages, m)
+		if err := cacheRecentMessage(ctx, m.msg); err != nil {
+			t.Fatal(err)
+		}
+		redisCli.HSet(ctx, reactionsKey(id), "👍", 1)
+	}
+	// Of the room messages, 11 is pinned and 12 recent; rooms have no
+	// legal hold.
+	for id := 10; id <= 12; id++ {
+		m := retainedMessage{msg: Message{ID: id, SenderID: 1, RoomID: 7, Text: "hi"}, createdAt: old}
+		switch id {
+		case 11:
+			m.pinned = true
+		case 12:
+			m.createdAt = recent
+		}
+		store.messages = append(store.messages, m)
+		if err := cacheRecentMessage(ctx, m.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	purger := NewRetentionPurger(30 * 24 * time.Hour)
+	purger.Batch = 2
+	purger.Clock = clock
+	before := testutil.ToFloat64(retentionPurged)
+
+	purged, err := purger.purge(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, purged)
+	assert.Equal(t, float64(6), testutil.ToFloat64(retentionPurged)-before)
+	assert.Equal(t, 4, store.batches, "five direct rows in batches of two, then one room row")
+	assert.Equal(t, []int{6, 7, 8, 9, 11, 12}, store.remaining())
+
+	cached, err := GetRecentMessages(ctx, "dm:1:2", 0, 20)
+	assert.NoError(t, err)
+	var ids []int
+	for _, msg := range cached {
+		ids = append(ids, msg.ID)
+	}
+	assert.ElementsMatch(t, []int{6, 7, 8, 9}, ids)
+	assert.Zero(t, redisCli.Exists(ctx, reactionsKey(1)).Val())
+	assert.Equal(t, int64(1), redisCli.Exists(ctx, reactionsKey(6)).Val())
+
+	cached, err = GetRecentMessages(ctx, "room:7", 0, 20)
+	assert.NoError(t, err)
+	ids = nil
+	for _, msg := range cached {
+		ids = append(ids, msg.ID)
+	}
+	assert.ElementsMatch(t, []int{11, 12}, ids)
+
+	// Nothing else is old enough.
+	purged, err = purger.purge(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, purged)
+}
+
+func TestRetentionPurge(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	a, b := insertTestUser(t, "hash"), insertTestUser(t, "hash")
+	store := func(text string, age time.Duration) Message {
+		msg, err := storeMessage(ctx, Message{SenderID: a, RecipientID: b, Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE messages SET created_at = NOW() - $2 * INTERVAL '1 second' WHERE message_id = $1", msg.ID, int(age.Seconds())); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	const day = 24 * time.Hour
+	expired := store("expired", 40*day)
+	pinned := store("pinned", 40*day)
+	held := store("held", 40*day)
+	kept := store("kept", day)
+	if _, err := db.Exec("INSERT INTO pins (conversation_key, message_id, pinned_by, position) VALUES ($1, $2, $3, 1)",
+		conversationKey(pinned), pinned.ID, a); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, a, "POST", "/rooms", createRoomRequest{Name: "retention"}))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var room Room
+	if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	storeRoom := func(text string) Message {
+		msg, err := storeRoomMessage(ctx, Message{SenderID: a, RoomID: room.ID, Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE room_messages SET created_at = NOW() - INTERVAL '40 days' WHERE message_id = $1", msg.ID); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	expiredRoom, pinnedRoom := storeRoom("expired"), storeRoom("pinned")
+	if _, err := db.Exec("INSERT INTO pins (conversation_key, room_message_id, pinned_by, position) VALUES ($1, $2, $3, 1)",
+		conversationKey(pinnedRoom), pinnedRoom.ID, a); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := createSession(ctx, insertTestUser(t, "hash"), RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/admin/messages/%d/hold", held.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	purged, err := NewRetentionPurger(30 * day).purge(ctx)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, purged, 1)
+
+	exists := func(id int) bool {
+		var found bool
+		db.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE message_id = $1)", id).Scan(&found)
+		return found
+	}
+	assert.False(t, exists(expired.ID))
+	assert.True(t, exists(pinned.ID), "pinned messages are exempt")
+	assert.True(t, exists(held.ID), "messages under legal hold are exempt")
+	assert.True(t, exists(kept.ID))
+
+	roomExists := func(id int) bool {
+		var found bool
+		db.QueryRow("SELECT EXISTS (SELECT 1 FROM room_messages WHERE message_id = $1)", id).Scan(&found)
+		return found
+	}
+	assert.False(t, roomExists(expiredRoom.ID))
+	assert.True(t, roomExists(pinnedRoom.ID), "pinned room messages are exempt")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy bounds how long startup waits for a backend. The delay doubles
+// after every failed attempt up to MaxBackoff.
+type retryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func startupRetryPolicy(c Config) retryPolicy {
+	return retryPolicy{
+		Attempts:   c.StartupAttempts,
+		Backoff:    c.StartupBackoff,
+		MaxBackoff: c.StartupMaxBackoff,
+	}
+}
+
+// jitter picks a delay between half and all of d so that instances started
+// together do not retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// connectWithRetry calls ping until it succeeds or the policy runs out of
+// attempts, logging each failure, and returns the last error.
+func connectWithRetry(ctx context.Context, name string, policy retryPolicy, ping func(context.Context) error) error {
+	backoff := policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = ping(ctx); err == nil {
+			if attempt > 1 {
+				log.Printf("%s: connected after %d attempts", name, attempt)
+			}
+			return nil
+		}
+		log.Printf("%s: attempt %d/%d failed: %v", name, attempt, policy.Attempts, err)
+		if attempt >= policy.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = retryPolicy{Attempts: 20, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestConnectWithRetryWaitsForDelayedRedis(t *testing.T) {
+	addr := freeAddr(t)
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+
+	mr := miniredis.NewMiniRedis()
+	defer mr.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := mr.StartAddr(addr); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	err := connectWithRetry(context.Background(), "redis", testRetryPolicy, func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	})
+	assert.NoError(t, err)
+}
+
+func TestConnectWithRetryWaitsForDelayedPostgres(t *testing.T) {
+	healthy := &atomic.Bool{}
+	testDB := sql.OpenDB(fakeConnector{healthy: healthy})
+	defer testDB.Close()
+
+	time.AfterFunc(100*time.Millisecond, func() { healthy.Store(true) })
+
+	assert.NoError(t, connectWithRetry(context.Background(), "postgres", testRetryPolicy, testDB.PingContext))
+}
+
+func TestConnectWithRetryGivesUp(t *testing.T) {
+	testDB := sql.OpenDB(fakeConnector{healthy: &atomic.Bool{}})
+	defer testDB.Close()
+
+	var attempts int
+	err := connectWithRetry(context.Background(), "postgres", retryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		func(ctx context.Context) error {
+			attempts++
+			return testDB.PingContext(ctx)
+		})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestJitterStaysWithinBounds(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.GreaterOrEqual(t, d, 500*time.Millisecond)
+		assert.LessOrEqual(t, d, time.Second)
+	}
+	assert.Zero(t, jitter(0))
+}
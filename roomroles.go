@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Roles of room members, from the highest down.
+const (
+	RoomOwner  = "owner"
+	RoomAdmin  = "admin"
+	RoomMember = "member"
+)
+
+var roomRoleRank = map[string]int{RoomMember: 1, RoomAdmin: 2, RoomOwner: 3}
+
+var errOwnerMustTransfer = errors.New("the owner must transfer ownership before leaving")
+
+// RoomEvent tells a room's members that someone joined, left or changed
+// role, or that the room was updated or deleted.
+type RoomEvent struct {
+	Type   string `json:"type"`
+	RoomID int    `json:"room_id"`
+	UserID int    `json:"user_id,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Name   string `json:"name,omitempty"`
+	// Description is set on room_updated, even when it is empty.
+	Description *string `json:"description,omitempty"`
+}
+
+// updateRoomRequest changes the fields that are present and leaves the
+// others alone.
+type updateRoomRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+type roomRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// isRoomAdmin reports whether the role may update and delete the room and
+// remove members.
+func isRoomAdmin(role string) bool {
+	return roomRoleRank[role] >= roomRoleRank[RoomAdmin]
+}
+
+// outranks reports whether a member with role a may act on one with role b.
+func outranks(a, b string) bool {
+	return roomRoleRank[a] > roomRoleRank[b]
+}
+
+// roomRole returns the user's role in the room, or errNotRoomMember.
+func roomRole(ctx context.Context, roomID, userID int) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, "SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", errNotRoomMember
+	}
+	return role, err
+}
+
+// actingRoomRole returns the role the caller acts with in the room. Admins
+// of the service act as owners of every room.
+func actingRoomRole(ctx context.Context, roomID int, claims *Claims) (string, error) {
+	if claims.Role == RoleAdmin {
+		return RoomOwner, nil
+	}
+	return roomRole(ctx, roomID, claims.UserID)
+}
+
+// requireRoomAdmin answers the request and returns false unless the caller
+// is an admin or the owner of the room.
+func requireRoomAdmin(ctx context.Context, w http.ResponseWriter, roomID int, claims *Claims) (string, bool) {
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return "", false
+	}
+	role, err := actingRoomRole(ctx, roomID, claims)
+	if err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return "", false
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return "", false
+	}
+	if !isRoomAdmin(role) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return "", false
+	}
+	return role, true
+}
+
+// notifyRoom sends the event to the room's connected members and to the
+// users in also, who may just have left.
+func notifyRoom(ctx context.Context, event RoomEvent, also ...int) {
+	if err := (RoomConversation{RoomID: event.RoomID}).Broadcast(ctx, event); err != nil {
+		logger(ctx).Println("Failed to notify room members:", err)
+	}
+	registry.BroadcastToMany(userIDStrings(also), event)
+}
+
+// updateRoom lets the room's admins and owner change its name and
+// description. The room's connected members get the result in a
+// room_updated event.
+func updateRoom(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updateRoom")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	var req updateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.Name == nil && req.Description == nil {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "name or description is required")
+		return
+	}
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if *req.Name == "" || utf8.RuneCountInString(*req.Name) > maxRoomNameLength {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("name must be 1 to %d characters", maxRoomNameLength))
+			return
+		}
+	}
+	if req.Description != nil {
+		*req.Description = strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(*req.Description) > maxRoomDescriptionLength {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("description must be at most %d characters", maxRoomDescriptionLength))
+			return
+		}
+	}
+
+	claims := claimsFromContext(ctx)
+	if _, ok := requireRoomAdmin(ctx, w, roomID, claims); !ok {
+		return
+	}
+	event := RoomEvent{Type: "room_updated", RoomID: roomID, Description: new(string)}
+	err = db.QueryRowContext(ctx,
+		`UPDATE rooms SET name = COALESCE($2, name), description = COALESCE($3, description)
+		WHERE room_id = $1 RETURNING name, description`,
+		roomID, req.Name, req.Description).Scan(&event.Name, event.Description)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Room not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	forgetRoomLists(ctx, roomID)
+	notifyRoom(ctx, event)
+	if req.Name != nil {
+		announceRoomChange(ctx, roomID, claims.UserID, 0, "%[1]s renamed the room to %[3]s", *req.Name)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteRoom lets the room's admins and owner delete it along with its
+// invites, mentions and cached messages.
+func deleteRoom(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.deleteRoom")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	if _, ok := requireRoomAdmin(ctx, w, roomID, claimsFromContext(ctx)); !ok {
+		return
+	}
+	members, err := roomMembers(ctx, roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	conversation := conversationKey(Message{RoomID: roomID})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "DELETE FROM rooms WHERE room_id = $1", roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Room not found")
+		return
+	}
+	for _, table := range []string{"conversation_archives", "notification_prefs"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE conversation_key = $1", conversation); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	pipe := redisCli.TxPipeline()
+	pipe.Del(ctx, roomMembersKey(roomID), recentMessagesKey(conversation), conversationMutesKey(conversation))
+	for _, id := range members {
+		pipe.ZRem(ctx, userRoomsKey(id), roomID)
+		if userID, err := strconv.Atoi(id); err == nil {
+			pipe.SRem(ctx, archivedConversationsKey(userID), conversation)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to clear deleted room:", err)
+	}
+	forgetUserRoomLists(ctx, members)
+	registry.BroadcastToMany(members, RoomEvent{Type: "room_deleted", RoomID: roomID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setRoomMemberRole lets the room's owner make a member an admin or a plain
+// member again, or hand the room over. The previous owner becomes an admin.
+func setRoomMemberRole(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.setRoomMemberRole")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	userID, err := strconv.Atoi(vars["uid"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID), attribute.Int("chat.user_id", userID))
+
+	var req roomRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if _, ok := roomRoleRank[req.Role]; !ok {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, "role must be owner, admin or member")
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	role, ok := requireRoomAdmin(ctx, w, roomID, claims)
+	if !ok {
+		return
+	}
+	if role != RoomOwner {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	current, err := roomRole(ctx, roomID, userID)
+	if err == errNotRoomMember {
+		WriteError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if current == RoomOwner {
+		if req.Role != RoomOwner {
+			WriteError(w, http.StatusConflict, codeConflict, errOwnerMustTransfer.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var previousOwner int
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if req.Role == RoomOwner {
+		err := tx.QueryRowContext(ctx,
+			"UPDATE room_members SET role = 'admin' WHERE room_id = $1 AND role = 'owner' RETURNING user_id",
+			roomID).Scan(&previousOwner)
+		if err != nil && err != sql.ErrNoRows {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE room_members SET role = $3 WHERE room_id = $1 AND user_id = $2", roomID, userID, req.Role); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if previousOwner != 0 {
+		notifyRoom(ctx, RoomEvent{Type: "room_role_changed", RoomID: roomID, UserID: previousOwner, Role: RoomAdmin})
+	}
+	notifyRoom(ctx, RoomEvent{Type: "room_role_changed", RoomID: roomID, UserID: userID, Role: req.Role})
+	announceRoomChange(ctx, roomID, claims.UserID, userID, "%[1]s made %[2]s %[3]s", roleTitles[req.Role])
+
+	w.WriteHeader(http.StatusNoContent)
+}
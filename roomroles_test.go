@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// roleStore keeps the roles of room 7's members, and its name and
+// description, in memory. Deletions of the room and revoked invites
+// succeed; every other query fails.
+type roleStore struct {
+	mu          sync.Mutex
+	roles       map[int64]string
+	name        string
+	description string
+}
+
+func (s *roleStore) Connect(context.Context) (driver.Conn, error) {
+	return roleConn{store: s}, nil
+}
+
+func (s *roleStore) Driver() driver.Driver { return nil }
+
+func (s *roleStore) role(userID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roles[userID]
+}
+
+type roleConn struct {
+	fakeConn
+	store *roleStore
+}
+
+func (roleConn) Begin() (driver.Tx, error) { return noopTx{}, nil }
+
+func (c roleConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT role FROM room_members"):
+		role, ok := s.roles[args[1].Value.(int64)]
+		return &valueRows{column: "role", value: role, done: !ok}, nil
+	case strings.HasPrefix(query, "UPDATE room_members SET role = 'admin'"):
+		for id, role := range s.roles {
+			if role == RoomOwner {
+				s.roles[id] = RoomAdmin
+				return &valueRows{column: "user_id", value: id}, nil
+			}
+		}
+		return &valueRows{column: "user_id", done: true}, nil
+	case strings.HasPrefix(query, "UPDATE rooms SET name"):
+		if name, ok := args[1].Value.(string); ok {
+			s.name = name
+		}
+		if description, ok := args[2].Value.(string); ok {
+			s.description = description
+		}
+		return &tableRows{columns: []string{"name", "description"}, rows: [][]driver.Value{{s.name, s.description}}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c roleConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "UPDATE room_members SET role"):
+		s.roles[args[1].Value.(int64)] = args[2].Value.(string)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "DELETE FROM room_members"):
+		delete(s.roles, args[1].Value.(int64))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "UPDATE invites SET revoked_at"),
+		strings.HasPrefix(query, "DELETE FROM"):
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("not supported")
+}
+
+// initRoleStore makes user 1 the owner of room 7, 2 and 6 admins and 3 and
+// 5 plain members.
+func initRoleStore(t *testing.T) *roleStore {
+	mr := initRedis(t)
+	mr.SAdd(roomMembersKey(7), "1", "2", "3", "5", "6")
+	store := &roleStore{roles: map[int64]string{1: RoomOwner, 2: RoomAdmin, 3: RoomMember, 5: RoomMember, 6: RoomAdmin}, name: "general"}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func TestRoomRoleRanks(t *testing.T) {
+	t.Parallel()
+	assert.True(t, isRoomAdmin(RoomOwner))
+	assert.True(t, isRoomAdmin(RoomAdmin))
+	assert.False(t, isRoomAdmin(RoomMember))
+	assert.False(t, isRoomAdmin(""))
+
+	assert.True(t, outranks(RoomOwner, RoomAdmin))
+	assert.True(t, outranks(RoomAdmin, RoomMember))
+	assert.False(t, outranks(RoomAdmin, RoomAdmin))
+	assert.False(t, outranks(RoomMember, RoomOwner))
+}
+
+func TestRoomActionPermissions(t *testing.T) {
+	const outsider = 4
+	cases := []struct {
+		name   string
+		actor  int
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{"owner updates", 1, "PATCH", "/rooms/7", updateRoomRequest{Name: stringPtr("new")}, http.StatusNoContent},
+		{"admin updates", 2, "PATCH", "/rooms/7", updateRoomRequest{Name: stringPtr("new")}, http.StatusNoContent},
+		{"member updates", 3, "PATCH", "/rooms/7", updateRoomRequest{Name: stringPtr("new")}, http.StatusForbidden},
+		{"outsider updates", outsider, "PATCH", "/rooms/7", updateRoomRequest{Name: stringPtr("new")}, http.StatusForbidden},
+
+		{"owner deletes", 1, "DELETE", "/rooms/7", nil, http.StatusNoContent},
+		{"admin deletes", 2, "DELETE", "/rooms/7", nil, http.StatusNoContent},
+		{"member deletes", 3, "DELETE", "/rooms/7", nil, http.StatusForbidden},
+		{"outsider deletes", outsider, "DELETE", "/rooms/7", nil, http.StatusForbidden},
+
+		{"owner removes admin", 1, "DELETE", "/rooms/7/members/6", nil, http.StatusNoContent},
+		{"admin removes member", 2, "DELETE", "/rooms/7/members/5", nil, http.StatusNoContent},
+		{"admin removes admin", 2, "DELETE", "/rooms/7/members/6", nil, http.StatusForbidden},
+		{"admin removes owner", 2, "DELETE", "/rooms/7/members/1", nil, http.StatusConflict},
+		{"member removes member", 3, "DELETE", "/rooms/7/members/5", nil, http.StatusForbidden},
+		{"member leaves", 3, "DELETE", "/rooms/7/members/3", nil, http.StatusNoContent},
+		{"admin leaves", 2, "DELETE", "/rooms/7/members/2", nil, http.StatusNoContent},
+		{"owner leaves", 1, "DELETE", "/rooms/7/members/1", nil, http.StatusConflict},
+		{"owner removes outsider", 1, "DELETE", "/rooms/7/members/4", nil, http.StatusNotFound},
+
+		{"owner revokes invite", 1, "DELETE", "/rooms/7/invites/abc", nil, http.StatusNoContent},
+		{"admin revokes invite", 2, "DELETE", "/rooms/7/invites/abc", nil, http.StatusNoContent},
+		{"member revokes invite", 3, "DELETE", "/rooms/7/invites/abc", nil, http.StatusForbidden},
+		{"outsider revokes invite", outsider, "DELETE", "/rooms/7/invites/abc", nil, http.StatusForbidden},
+
+		{"owner promotes member", 1, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: RoomAdmin}, http.StatusNoContent},
+		{"owner demotes admin", 1, "PUT", "/rooms/7/members/2/role", roomRoleRequest{Role: RoomMember}, http.StatusNoContent},
+		{"owner transfers", 1, "PUT", "/rooms/7/members/2/role", roomRoleRequest{Role: RoomOwner}, http.StatusNoContent},
+		{"owner demotes self", 1, "PUT", "/rooms/7/members/1/role", roomRoleRequest{Role: RoomAdmin}, http.StatusConflict},
+		{"admin promotes member", 2, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: RoomAdmin}, http.StatusForbidden},
+		{"member promotes self", 3, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: RoomAdmin}, http.StatusForbidden},
+		{"unknown role", 1, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: "king"}, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			initRoleStore(t)
+			rr := httptest.NewRecorder()
+			newRouter().ServeHTTP(rr, authedRequest(t, tc.actor, tc.method, tc.path, tc.body))
+			assert.Equal(t, tc.want, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func TestRoomOwnershipTransferEvents(t *testing.T) {
+	store := initRoleStore(t)
+	server := newTestServer(t, newRouter())
+
+	owner := dialTestUser(t, server, 1)
+	member := dialTestUser(t, server, 3)
+	waitForClients(t, 2)
+
+	rr := httptest.NewRecorder()
+	server.Config.Handler.ServeHTTP(rr, authedRequest(t, 1, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: RoomOwner}))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, RoomAdmin, store.role(1))
+	assert.Equal(t, RoomOwner, store.role(3))
+
+	want := []RoomEvent{
+		{Type: "room_role_changed", RoomID: 7, UserID: 1, Role: RoomAdmin},
+		{Type: "room_role_changed", RoomID: 7, UserID: 3, Role: RoomOwner},
+	}
+	for _, conn := range []*websocket.Conn{owner, member} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for _, event := range want {
+			var got RoomEvent
+			if err := conn.ReadJSON(&got); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, event, got)
+		}
+	}
+
+	// The former owner can leave now, and the members hear of it.
+	rr = httptest.NewRecorder()
+	server.Config.Handler.ServeHTTP(rr, authedRequest(t, 1, "DELETE", "/rooms/7/members/1", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var left RoomEvent
+	if err := member.ReadJSON(&left); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, RoomEvent{Type: "room_member_removed", RoomID: 7, UserID: 1}, left)
+}
+
+func TestUpdateRoom(t *testing.T) {
+	store := initRoleStore(t)
+	server := newTestServer(t, newRouter())
+	member := dialTestUser(t, server, 3)
+	waitForClients(t, 1)
+	patch := func(actor int, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.Config.Handler.ServeHTTP(rr, authedRequest(t, actor, "PATCH", "/rooms/7", body))
+		return rr
+	}
+
+	for _, body := range []interface{}{
+		map[string]string{},
+		updateRoomRequest{Name: stringPtr("  ")},
+		updateRoomRequest{Name: stringPtr(strings.Repeat("n", maxRoomNameLength+1))},
+		updateRoomRequest{Description: stringPtr(strings.Repeat("d", maxRoomDescriptionLength+1))},
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, patch(1, body).Code, body)
+	}
+	assert.Equal(t, http.StatusForbidden, patch(3, updateRoomRequest{Description: stringPtr("mine now")}).Code)
+
+	rr := patch(2, updateRoomRequest{Description: stringPtr(" Where the team talks ")})
+	assert.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	store.mu.Lock()
+	assert.Equal(t, "general", store.name, "a field left out is kept")
+	assert.Equal(t, "Where the team talks", store.description)
+	store.mu.Unlock()
+
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got RoomEvent
+	if err := member.ReadJSON(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := RoomEvent{Type: "room_updated", RoomID: 7, Name: "general", Description: stringPtr("Where the team talks")}
+	assert.Equal(t, want, got)
+
+	// Clearing the description still sends it, empty.
+	assert.Equal(t, http.StatusNoContent, patch(1, updateRoomRequest{Description: stringPtr("")}).Code)
+	var raw map[string]interface{}
+	if err := member.ReadJSON(&raw); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", raw["description"])
+}
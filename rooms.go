@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	maxRoomNameLength        = 100
+	maxRoomDescriptionLength = 500
+
+	defaultRoomListLimit = 20
+	maxRoomListLimit     = 100
+)
+
+var errNotRoomMember = errors.New("not a member of this room")
+
+type Room struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	CreatedBy int    `json:"created_by"`
+	MemberIDs []int  `json:"member_ids"`
+}
+
+// RoomInfo describes a room without listing its members.
+type RoomInfo struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   int       `json:"created_by"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Role is the caller's role in the room, in lists of their rooms.
+	Role string `json:"role,omitempty"`
+}
+
+type createRoomRequest struct {
+	Name      string `json:"name"`
+	MemberIDs []int  `json:"member_ids"`
+}
+
+type addRoomMemberRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// roomMembersKey holds the IDs of a room's members. Postgres is the source
+// of truth; the set spares a query for every message sent to the room.
+func roomMembersKey(roomID int) string {
+	return fmt.Sprintf("room:%d:members", roomID)
+}
+
+// userRoomsKey ranks the rooms a user belongs to by their last activity,
+// scored with the Unix time of the latest message or, before the first
+// one, of joining.
+func userRoomsKey(userID string) string {
+	return fmt.Sprintf("user:%s:rooms", userID)
+}
+
+func createRoom(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createRoom")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var req createRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxRoomNameLength {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("name must be 1 to %d characters", maxRoomNameLength))
+		return
+	}
+
+	room := Room{Name: req.Name, CreatedBy: claims.UserID, MemberIDs: []int{claims.UserID}}
+	for _, id := range req.MemberIDs {
+		if id != claims.UserID {
+			room.MemberIDs = append(room.MemberIDs, id)
+		}
+	}
+	for _, id := range room.MemberIDs[1:] {
+		if err := checkUserExists(ctx, id); err == errInvalidRecipient {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("user %d does not exist", id))
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "INSERT INTO rooms (name, created_by) VALUES ($1, $2) RETURNING room_id", room.Name, room.CreatedBy).Scan(&room.ID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int64, len(room.MemberIDs))
+	for i, id := range room.MemberIDs {
+		ids[i] = int64(id)
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO room_members (room_id, user_id, role)
+		SELECT $1, id, CASE WHEN id = $3 THEN 'owner'::room_role ELSE 'member' END FROM UNNEST($2::int[]) AS id
+		ON CONFLICT DO NOTHING`, room.ID, ids, room.CreatedBy)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	members := make([]interface{}, len(room.MemberIDs))
+	for i, id := range room.MemberIDs {
+		members[i] = id
+	}
+	if err := redisCli.SAdd(ctx, roomMembersKey(room.ID), members...).Err(); err != nil {
+		logger(ctx).Println("Failed to cache room members:", err)
+	}
+	userIDs := make([]string, len(room.MemberIDs))
+	for i, id := range room.MemberIDs {
+		userIDs[i] = strconv.Itoa(id)
+	}
+	touchRoom(ctx, room.ID, userIDs, time.Now())
+	forgetUserRoomLists(ctx, userIDs)
+	watchJoinedRoom(room.ID, userIDs)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// addRoomMember lets a member of the room add someone to it.
+func addRoomMember(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.addRoomMember")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	var req addRoomMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if claims.Role != RoleAdmin {
+		if err := checkRoomMember(ctx, roomID, claims.UserID); err == errNotRoomMember {
+			WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := checkUserExists(ctx, req.UserID); err == errInvalidRecipient {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", roomID, req.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := redisCli.SAdd(ctx, roomMembersKey(roomID), req.UserID).Err(); err != nil {
+		forgetRoomMembers(ctx, roomID, err)
+	}
+	touchRoom(ctx, roomID, []string{strconv.Itoa(req.UserID)}, time.Now())
+	forgetRoomLists(ctx, roomID)
+	watchJoinedRoom(roomID, []string{strconv.Itoa(req.UserID)})
+	if n, _ := res.RowsAffected(); n > 0 {
+		notifyRoom(ctx, RoomEvent{Type: "room_member_added", RoomID: roomID, UserID: req.UserID, Role: RoomMember})
+		announceRoomChange(ctx, roomID, claims.UserID, req.UserID, "%[1]s added %[2]s")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeRoomMember takes a user out of a room. Users may leave on their
+// own, except the owner; removing someone else takes a room admin who
+// outranks them.
+func removeRoomMember(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.removeRoomMember")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	userID, err := strconv.Atoi(vars["uid"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID), attribute.Int("chat.user_id", userID))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	var actor string
+	if claims.UserID != userID {
+		var ok bool
+		if actor, ok = requireRoomAdmin(ctx, w, roomID, claims); !ok {
+			return
+		}
+	}
+	role, err := roomRole(ctx, roomID, userID)
+	if err == errNotRoomMember {
+		WriteError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if role == RoomOwner {
+		WriteError(w, http.StatusConflict, codeConflict, errOwnerMustTransfer.Error())
+		return
+	}
+	if claims.UserID != userID && !outranks(actor, role) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, errNotRoomMember.Error())
+		return
+	}
+	if err := redisCli.SRem(ctx, roomMembersKey(roomID), userID).Err(); err != nil {
+		forgetRoomMembers(ctx, roomID, err)
+	}
+	if err := redisCli.ZRem(ctx, userRoomsKey(strconv.Itoa(userID)), roomID).Err(); err != nil {
+		logger(ctx).Println("Failed to update room activity:", err)
+	}
+	forgetRoomLists(ctx, roomID, userID)
+	notifyRoom(ctx, RoomEvent{Type: "room_member_removed", RoomID: roomID, UserID: userID}, userID)
+	if claims.UserID == userID {
+		announceRoomChange(ctx, roomID, userID, userID, "%[1]s left the room")
+	} else {
+		announceRoomChange(ctx, roomID, claims.UserID, userID, "%[1]s removed %[2]s")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetRoomMembers drops a room's member set after an update to it failed,
+// so that the next lookup reloads it from Postgres instead of trusting a
+// stale copy.
+func forgetRoomMembers(ctx context.Context, roomID int, cause error) {
+	logger(ctx).Println("Failed to update room members:", cause)
+	if err := redisCli.Del(ctx, roomMembersKey(roomID)).Err(); err != nil {
+		logger(ctx).Println("Failed to drop room members:", err)
+	}
+}
+
+// roomMembers returns the IDs of the room's members from Redis, loading
+// them from Postgres when the set is missing. A room always has members,
+// so an empty set means nothing is cached.
+func roomMembers(ctx context.Context, roomID int) ([]string, error) {
+	key := roomMembersKey(roomID)
+	members, err := redisCli.SMembers(ctx, key).Result()
+	if err == nil && len(members) > 0 {
+		return members, nil
+	}
+	if err != nil {
+		logger(ctx).Println("Failed to read room members:", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT user_id FROM room_members WHERE room_id = $1", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members = nil
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		members = append(members, strconv.Itoa(id))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(members) > 0 {
+		values := make([]interface{}, len(members))
+		for i, id := range members {
+			values[i] = id
+		}
+		if err := redisCli.SAdd(ctx, key, values...).Err(); err != nil {
+			logger(ctx).Println("Failed to cache room members:", err)
+		}
+	}
+	return members, nil
+}
+
+// checkRoomMember returns errNotRoomMember unless userID is in the room.
+func checkRoomMember(ctx context.Context, roomID, userID int) error {
+	members, err := roomMembers(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	for _, id := range members {
+		if id == strconv.Itoa(userID) {
+			return nil
+		}
+	}
+	return errNotRoomMember
+}
+
+// relayRoomMessage stores a message sent to a room and fans it out to every
+// connected member of the room except the sender, and notifies the members
+// it mentions. It returns the message as stored. A message that could not
+// be stored still goes out, and the error is returned after.
+func relayRoomMessage(ctx context.Context, msg Message) (Message, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "ws.roomMessage",
+		trace.WithAttributes(
+			attribute.Int("chat.sender_id", msg.SenderID),
+			attribute.Int("chat.room_id", msg.RoomID),
+		))
+	defer span.End()
+
+	members, err := roomMembers(ctx, msg.RoomID)
+	if err != nil {
+		return msg, err
+	}
+	sender := strconv.Itoa(msg.SenderID)
+	isMember := false
+	recipients := make([]string, 0, len(members))
+	for _, id := range members {
+		if id == sender {
+			isMember = true
+		} else {
+			recipients = append(recipients, id)
+		}
+	}
+	if !isMember {
+		return msg, errNotRoomMember
+	}
+
+	renderMessage(&msg)
+	msg, err = storeRoomMessage(ctx, msg)
+	if err != nil {
+		return msg, err
+	}
+	countSentMessage(ctx, msg, time.Now())
+	if err := cacheRecentMessage(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to cache recent message:", err)
+	}
+	touchRoom(ctx, msg.RoomID, members, time.Now())
+	recordRoomActivity(ctx, msg, time.Now())
+	msg.TraceParent = traceParent(ctx)
+	if _, err := recordMentions(ctx, msg, members); err != nil {
+		logger(ctx).Println("Failed to record mentions:", err)
+	}
+	countUnread(ctx, msg, recipients)
+	return msg, conversationOf(msg).Broadcast(ctx, msg)
+}
+
+// storeRoomMessage inserts a message a user sent to a room.
+func storeRoomMessage(ctx context.Context, msg Message) (Message, error) {
+	now := time.Now()
+	setExpiry(&msg, now)
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO room_messages (room_id, kind, sender_id, text, expires_at) VALUES ($1, 'text', $2, $3, $4) RETURNING message_id, created_at",
+		msg.RoomID, msg.SenderID, msg.Text, msg.ExpiresAt).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		return msg, err
+	}
+	msg.CreatedAt = msg.CreatedAt.UTC()
+	msg.UpdatedAt = msg.CreatedAt
+	sampleMessage(ctx, msg, now)
+	return msg, nil
+}
+
+// warmRoomMembers loads every room's member set into Redis, replacing what
+// was there.
+func warmRoomMembers(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT room_id, user_id FROM room_members ORDER BY room_id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pipe := redisCli.Pipeline()
+	current := 0
+	for rows.Next() {
+		var roomID, userID int
+		if err := rows.Scan(&roomID, &userID); err != nil {
+			return err
+		}
+		if roomID != current {
+			pipe.Del(ctx, roomMembersKey(roomID))
+			current = roomID
+		}
+		pipe.SAdd(ctx, roomMembersKey(roomID), userID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// touchRoom moves the room to the top of each user's room list. Failures
+// are only logged: the lists fall back to the time each user joined.
+func touchRoom(ctx context.Context, roomID int, userIDs []string, at time.Time) {
+	score := float64(at.UnixNano()) / float64(time.Second)
+	pipe := redisCli.Pipeline()
+	for _, id := range userIDs {
+		pipe.ZAdd(ctx, userRoomsKey(id), &redis.Z{Score: score, Member: roomID})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to update room activity:", err)
+	}
+}
+
+// getRoom returns a room's details to its members and to admins.
+func getRoom(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getRoom")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	// Membership is checked first so that outsiders cannot probe which
+	// rooms exist.
+	if claims.Role != RoleAdmin {
+		if err := checkRoomMember(ctx, roomID, claims.UserID); err == errNotRoomMember {
+			WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	room, err := loadRoomInfo(ctx, roomID)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Room not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+func loadRoomInfo(ctx context.Context, roomID int) (RoomInfo, error) {
+	room := RoomInfo{ID: roomID}
+	err := db.QueryRowContext(ctx,
+		`SELECT r.name, r.description, r.created_by, r.created_at, COUNT(m.user_id) FROM rooms r
+		LEFT JOIN room_members m ON m.room_id = r.room_id
+		WHERE r.room_id = $1
+		GROUP BY r.room_id`, roomID).Scan(&room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.MemberCount)
+	return room, err
+}
+
+// listRooms returns a page of the rooms the caller belongs to, most
+// recently active first. q keeps the rooms whose name contains it, ignoring
+// case. cursor, the next_cursor of the previous page, starts the page after
+// that room. All matching rooms are read to be ordered, so they are counted
+// as they are.
+func listRooms(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listRooms")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, cursor, err := roomListPage(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT r.room_id, r.name, r.description, r.created_by, r.created_at, m.role, m.joined_at,
+			(SELECT COUNT(*) FROM room_members c WHERE c.room_id = r.room_id)
+		FROM rooms r
+		JOIN room_members m ON m.room_id = r.room_id
+		WHERE m.user_id = $1 AND r.name ILIKE '%' || $2 || '%'`,
+		claims.UserID, escapeLike(strings.TrimSpace(query.Get("q"))))
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rooms := []RoomInfo{}
+	activity := make(map[int]float64)
+	for rows.Next() {
+		var room RoomInfo
+		var joinedAt time.Time
+		if err := rows.Scan(&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.Role, &joinedAt, &room.MemberCount); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		rooms = append(rooms, room)
+		activity[room.ID] = float64(joinedAt.UnixNano()) / float64(time.Second)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	scores, err := redisCli.ZRangeWithScores(ctx, userRoomsKey(strconv.Itoa(claims.UserID)), 0, -1).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read room activity:", err)
+	}
+	for _, z := range scores {
+		id, _ := strconv.Atoi(z.Member.(string))
+		if _, ok := activity[id]; ok {
+			activity[id] = z.Score
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		a, b := activity[rooms[i].ID], activity[rooms[j].ID]
+		if a != b {
+			return a > b
+		}
+		return rooms[i].ID > rooms[j].ID
+	})
+
+	total := int64(len(rooms))
+	if cursor != nil {
+		i := slices.IndexFunc(rooms, func(room RoomInfo) bool { return room.ID == *cursor })
+		if i < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidRequest, errInvalidCursor.Error())
+			return
+		}
+		rooms = rooms[i+1:]
+	}
+	if len(rooms) > limit+1 {
+		rooms = rooms[:limit+1]
+	}
+
+	writePage(w, newPage(rooms, limit, total, func(room RoomInfo) int { return room.ID }))
+}
+
+// roomListPage reads the limit and cursor of a page of rooms.
+func roomListPage(query url.Values) (limit int, cursor *int, err error) {
+	if limit, err = parseLimit(query, defaultRoomListLimit, maxRoomListLimit); err != nil {
+		return 0, nil, err
+	}
+	cursor, err = parseCursor(query)
+	return limit, cursor, err
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern so that s only
+// matches itself.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func authedRequest(t *testing.T, userID int, method, path string, body interface{}) *http.Request {
+	token, err := createSession(context.Background(), userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// asUser is req as requireAuth passes it on for the user, for calling
+// handlers directly.
+func asUser(req *http.Request, userID int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), claimsKey, &Claims{UserID: userID, Role: RoleUser}))
+}
+
+func TestRoomMessageFanOut(t *testing.T) {
+	mr := initRedis(t)
+	// Every query but storing the message fails, so the members can only
+	// come from Redis.
+	db = sql.OpenDB(&roomMessageStore{})
+	t.Cleanup(func() { db.Close() })
+	mr.SAdd(roomMembersKey(9), "801", "802", "803")
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 801)
+	member := dialTestUser(t, server, 802)
+	outsider := dialTestUser(t, server, 804)
+	waitForClients(t, 3)
+
+	if err := sender.WriteJSON(Message{SenderID: 801, RoomID: 9, Text: "hello room"}); err != nil {
+		t.Fatal(err)
+	}
+	member.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := member.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 9, msg.RoomID)
+	assert.Equal(t, "hello room", msg.Text)
+	for _, id := range []string{"801", "802", "803"} {
+		_, err := mr.ZScore(userRoomsKey(id), "9")
+		assert.NoError(t, err, "the room moves up the list of user %s", id)
+	}
+
+	if err := outsider.WriteJSON(Message{SenderID: 804, RoomID: 9, Text: "let me in"}); err != nil {
+		t.Fatal(err)
+	}
+	outsider.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ErrorEvent
+	if err := outsider.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "not_a_member", event.Code)
+}
+
+func TestRoomMessageForgedSender(t *testing.T) {
+	mr := initRedis(t)
+	db = sql.OpenDB(&roomMessageStore{})
+	t.Cleanup(func() { db.Close() })
+	mr.SAdd(roomMembersKey(9), "801", "802")
+	server := newTestServer(t, newRouter())
+
+	member := dialTestUser(t, server, 801)
+	reader := dialTestUser(t, server, 802)
+	outsider := dialTestUser(t, server, 804)
+	waitForClients(t, 3)
+
+	// Claiming to be a member does not get an outsider into the room.
+	if err := outsider.WriteJSON(Message{SenderID: 801, RoomID: 9, Text: "let me in"}); err != nil {
+		t.Fatal(err)
+	}
+	outsider.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ErrorEvent
+	if err := outsider.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "not_a_member", event.Code)
+
+	if err := member.WriteJSON(Message{SenderID: 802, RoomID: 9, Text: "hello room"}); err != nil {
+		t.Fatal(err)
+	}
+	reader.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := reader.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello room", msg.Text, "the outsider's message must not have gone out")
+	assert.Equal(t, 801, msg.SenderID)
+}
+
+func TestRoomMessageNotRelayedUnstored(t *testing.T) {
+	mr := initRedis(t)
+	// Every query fails, storing the message too.
+	initFakeDB(t)
+	mr.SAdd(roomMembersKey(9), "801", "802")
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 801)
+	member := dialTestUser(t, server, 802)
+	waitForClients(t, 2)
+
+	if err := sender.WriteJSON(Message{RoomID: 9, Text: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	member.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	var msg Message
+	assert.Error(t, member.ReadJSON(&msg), "a message that was not stored must not go out")
+
+	ctx := context.Background()
+	cached, err := GetRecentMessages(ctx, "room:9", 0, 20)
+	assert.NoError(t, err)
+	assert.Empty(t, cached)
+	assert.False(t, mr.Exists(userRoomsKey("802")), "the room does not move up")
+}
+
+func TestRoomMembershipLifecycle(t *testing.T) {
+	setupTestContainers(t)
+	initRedis(t)
+	ctx := context.Background()
+
+	owner := insertTestUser(t, "hash")
+	friend := insertTestUser(t, "hash")
+	latecomer := insertTestUser(t, "hash")
+
+	rr := httptest.NewRecorder()
+	requireAuth(createRoom)(rr, authedRequest(t, owner, "POST", "/rooms", createRoomRequest{Name: "general", MemberIDs: []int{friend}}))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var room Room
+	if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	roomPath := "/rooms/" + strconv.Itoa(room.ID) + "/members"
+	members, _ := redisCli.SMembers(ctx, roomMembersKey(room.ID)).Result()
+	assert.ElementsMatch(t, []string{strconv.Itoa(owner), strconv.Itoa(friend)}, members)
+
+	req := mux.SetURLVars(authedRequest(t, friend, "POST", roomPath, addRoomMemberRequest{UserID: latecomer}), map[string]string{"id": strconv.Itoa(room.ID)})
+	rr = httptest.NewRecorder()
+	requireAuth(addRoomMember)(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.NoError(t, checkRoomMember(ctx, room.ID, latecomer))
+
+	req = mux.SetURLVars(authedRequest(t, latecomer, "DELETE", roomPath+"/"+strconv.Itoa(friend), nil),
+		map[string]string{"id": strconv.Itoa(room.ID), "uid": strconv.Itoa(friend)})
+	rr = httptest.NewRecorder()
+	requireAuth(removeRoomMember)(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only the creator may remove someone else")
+
+	req = mux.SetURLVars(authedRequest(t, owner, "DELETE", roomPath+"/"+strconv.Itoa(friend), nil),
+		map[string]string{"id": strconv.Itoa(room.ID), "uid": strconv.Itoa(friend)})
+	rr = httptest.NewRecorder()
+	requireAuth(removeRoomMember)(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, errNotRoomMember, checkRoomMember(ctx, room.ID, friend))
+
+	// A flushed cache is rebuilt from Postgres, at startup or on demand.
+	redisCli.FlushAll(ctx)
+	if err := warmRoomMembers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	members, _ = redisCli.SMembers(ctx, roomMembersKey(room.ID)).Result()
+	assert.ElementsMatch(t, []string{strconv.Itoa(owner), strconv.Itoa(latecomer)}, members)
+
+	redisCli.FlushAll(ctx)
+	assert.NoError(t, checkRoomMember(ctx, room.ID, owner))
+}
+
+func listRoomsRequest(t *testing.T, userID int, query string) []RoomInfo {
+	return listRoomsPage(t, userID, query).Items
+}
+
+func listRoomsPage(t *testing.T, userID int, query string) Page[RoomInfo] {
+	rr := httptest.NewRecorder()
+	requireAuth(listRooms)(rr, authedRequest(t, userID, "GET", "/rooms"+query, nil))
+	assert.Equal(t, http.StatusOK, rr.Code, query)
+	var page Page[RoomInfo]
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func roomNames(rooms []RoomInfo) []string {
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.Name
+	}
+	return names
+}
+
+func TestListRoomsRejectsBadParams(t *testing.T) {
+	initRedis(t)
+
+	for _, query := range []string{"?limit=0", "?limit=" + strconv.Itoa(maxRoomListLimit+1), "?cursor=-1", "?cursor=x"} {
+		rr := httptest.NewRecorder()
+		requireAuth(listRooms)(rr, authedRequest(t, 1, "GET", "/rooms"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestListRooms(t *testing.T) {
+	setupTestContainers(t)
+	mr := initRedis(t)
+
+	owner := insertTestUser(t, "hash")
+	friend := insertTestUser(t, "hash")
+	loner := insertTestUser(t, "hash")
+
+	assert.Empty(t, listRoomsRequest(t, loner, ""))
+
+	ids := make(map[string]int)
+	for _, name := range []string{"General", "random", "general_2", "100% offtopic"} {
+		rr := httptest.NewRecorder()
+		requireAuth(createRoom)(rr, authedRequest(t, owner, "POST", "/rooms", createRoomRequest{Name: name, MemberIDs: []int{friend}}))
+		var room Room
+		if err := json.NewDecoder(rr.Body).Decode(&room); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = room.ID
+	}
+	assert.Empty(t, listRoomsRequest(t, loner, ""))
+
+	// Pin the activity so the order does not depend on timing.
+	key := userRoomsKey(strconv.Itoa(owner))
+	mr.ZAdd(key, 400, strconv.Itoa(ids["random"]))
+	mr.ZAdd(key, 300, strconv.Itoa(ids["100% offtopic"]))
+	mr.ZAdd(key, 200, strconv.Itoa(ids["General"]))
+	mr.ZAdd(key, 100, strconv.Itoa(ids["general_2"]))
+
+	page := listRoomsPage(t, owner, "?limit=2")
+	assert.Equal(t, []string{"random", "100% offtopic"}, roomNames(page.Items))
+	assert.EqualValues(t, 4, page.Total)
+	if assert.True(t, page.HasNext) {
+		assert.Equal(t, strconv.Itoa(ids["100% offtopic"]), *page.NextCursor)
+	}
+	page = listRoomsPage(t, owner, "?limit=2&cursor="+*page.NextCursor)
+	assert.Equal(t, []string{"General", "general_2"}, roomNames(page.Items))
+	assert.False(t, page.HasNext)
+	assert.Nil(t, page.NextCursor)
+	assert.Empty(t, listRoomsRequest(t, owner, "?cursor="+strconv.Itoa(ids["general_2"])))
+
+	rr := httptest.NewRecorder()
+	requireAuth(listRooms)(rr, authedRequest(t, loner, "GET", "/rooms?cursor="+strconv.Itoa(ids["random"]), nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "a room the caller is not in is no cursor")
+
+	assert.Equal(t, []string{"General", "general_2"}, roomNames(listRoomsRequest(t, owner, "?q=GEN")))
+	assert.Equal(t, []string{"general_2"}, roomNames(listRoomsRequest(t, owner, "?q=l_")), "_ is not a wildcard")
+	assert.Equal(t, []string{"100% offtopic"}, roomNames(listRoomsRequest(t, owner, "?q=%25")), "% is not a wildcard")
+
+	// Sending to a room makes it the most recent for every member.
+	if _, err := relayRoomMessage(context.Background(), Message{SenderID: friend, RoomID: ids["general_2"], Text: "bump"}); err != nil {
+		t.Fatal(err)
+	}
+	rooms := listRoomsRequest(t, owner, "?limit=1")
+	if assert.Len(t, rooms, 1) {
+		assert.Equal(t, "general_2", rooms[0].Name)
+		assert.Equal(t, 2, rooms[0].MemberCount)
+		assert.Equal(t, owner, rooms[0].CreatedBy)
+	}
+
+	roomPath := "/rooms/" + strconv.Itoa(ids["random"])
+	rr = httptest.NewRecorder()
+	requireAuth(getRoom)(rr, mux.SetURLVars(authedRequest(t, friend, "GET", roomPath, nil), map[string]string{"id": strconv.Itoa(ids["random"])}))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var room RoomInfo
+	json.NewDecoder(rr.Body).Decode(&room)
+	assert.Equal(t, "random", room.Name)
+	assert.Equal(t, 2, room.MemberCount)
+	assert.False(t, room.CreatedAt.IsZero())
+
+	rr = httptest.NewRecorder()
+	requireAuth(getRoom)(rr, mux.SetURLVars(authedRequest(t, loner, "GET", roomPath, nil), map[string]string{"id": strconv.Itoa(ids["random"])}))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
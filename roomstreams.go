@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// roomStreamMaxLen caps each room's stream, approximately.
+	roomStreamMaxLen = 10000
+
+	// roomStreamBlock is how long a consumer waits for new entries before
+	// checking whether the room still has members connected here.
+	roomStreamBlock = 5 * time.Second
+
+	roomStreamBatch = 100
+)
+
+// roomStreams is nil unless CHAT_ROOM_STREAMS is set, in which case room
+// messages reach their members through the room's Redis stream, so that
+// every server delivers them to the members connected to it.
+var roomStreams *RoomStreams
+
+func roomStreamKey(roomID int) string {
+	return fmt.Sprintf("room:%d:stream", roomID)
+}
+
+// RoomStreams publishes room messages to a Redis stream per room and runs a
+// consumer for every room with members connected to this server. Each
+// server reads a stream in a consumer group of its own, so that it sees
+// every entry, and acknowledges an entry once it delivered it; entries read
+// but not acknowledged when the server stopped are delivered again when it
+// comes back.
+type RoomStreams struct {
+	// Group names this server's consumer group. It must stay the same
+	// across restarts.
+	Group string
+	Block time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	consumers map[int]bool
+}
+
+func NewRoomStreams(group string) *RoomStreams {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RoomStreams{
+		Group:     group,
+		Block:     roomStreamBlock,
+		ctx:       ctx,
+		cancel:    cancel,
+		consumers: make(map[int]bool),
+	}
+}
+
+// Close stops the consumers and waits for them to return.
+func (s *RoomStreams) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Publish adds a room message to the room's stream, with the members to
+// deliver it to and those among them who muted the room.
+func (s *RoomStreams) Publish(ctx context.Context, msg Message, recipients, muted []string) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return redisCli.XAdd(ctx, &redis.XAddArgs{
+		Stream: roomStreamKey(msg.RoomID),
+		MaxLen: roomStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"message":    payload,
+			"recipients": strings.Join(recipients, ","),
+			"muted":      strings.Join(muted, ","),
+		},
+	}).Err()
+}
+
+// WatchUser makes sure the rooms of a user who just connected here have a
+// consumer.
+func (s *RoomStreams) WatchUser(ctx context.Context, userID string) {
+	rooms, err := redisCli.ZRange(ctx, userRoomsKey(userID), 0, -1).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to look up rooms to watch:", err)
+		return
+	}
+	for _, room := range rooms {
+		if roomID, err := strconv.Atoi(room); err == nil {
+			s.Watch(roomID)
+		}
+	}
+}
+
+// Watch starts a consumer for the room unless it has one.
+func (s *RoomStreams) Watch(roomID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.consumers[roomID] || s.ctx.Err() != nil {
+		return
+	}
+	// The group is created before Watch returns, so that it takes in
+	// whatever is published from then on.
+	err := redisCli.XGroupCreateMkStream(s.ctx, roomStreamKey(roomID), s.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("room streams: failed to create group for room %d: %v", roomID, err)
+		return
+	}
+	s.consumers[roomID] = true
+	s.wg.Add(1)
+	go s.consume(roomID)
+}
+
+// consume delivers the room's entries to the members connected here until
+// none is left, starting with those read but not acknowledged before.
+func (s *RoomStreams) consume(roomID int) {
+	defer s.wg.Done()
+	key := roomStreamKey(roomID)
+	start := "0"
+	for {
+		streams, err := redisCli.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+			Group:    s.Group,
+			Consumer: s.Group,
+			Streams:  []string{key, start},
+			Count:    roomStreamBatch,
+			Block:    s.Block,
+		}).Result()
+		if s.ctx.Err() != nil {
+			s.stop(roomID)
+			return
+		}
+		if err != nil && err != redis.Nil {
+			log.Printf("room streams: failed to read room %d: %v", roomID, err)
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(s.Block):
+			}
+			continue
+		}
+
+		var ids []string
+		for _, stream := range streams {
+			for _, entry := range stream.Messages {
+				deliverRoomEntry(entry)
+				ids = append(ids, entry.ID)
+			}
+		}
+		if len(ids) > 0 {
+			// Acknowledge even when closing, as the entries went out.
+			if err := redisCli.XAck(context.Background(), key, s.Group, ids...).Err(); err != nil {
+				log.Printf("room streams: failed to acknowledge room %d: %v", roomID, err)
+			}
+			continue
+		}
+		if start == "0" {
+			// The backlog is done; carry on with new entries.
+			start = ">"
+			continue
+		}
+		if s.idle(roomID) {
+			return
+		}
+	}
+}
+
+// idle stops the room's consumer and reports true if none of its members
+// is connected here anymore.
+func (s *RoomStreams) idle(roomID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, err := roomMembers(s.ctx, roomID)
+	if err != nil {
+		log.Printf("room streams: failed to look up members of room %d: %v", roomID, err)
+		return false
+	}
+	for _, id := range members {
+		if len(registry.Connections(id)) > 0 {
+			return false
+		}
+	}
+	delete(s.consumers, roomID)
+	return true
+}
+
+func (s *RoomStreams) stop(roomID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.consumers, roomID)
+}
+
+// deliverRoomEntry hands a stream entry to the recipients connected here.
+func deliverRoomEntry(entry redis.XMessage) {
+	payload, _ := entry.Values["message"].(string)
+	var msg Message
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("room streams: dropping malformed entry %s: %v", entry.ID, err)
+		return
+	}
+	deliverLocally(context.Background(), msg, splitIDs(entry.Values["recipients"]), splitIDs(entry.Values["muted"]))
+}
+
+func splitIDs(v interface{}) []string {
+	s, _ := v.(string)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// fanOutRoomMessage delivers a room message to its recipients, marking it
+// muted for those in muted, through the room's stream when there are room
+// streams and straight to the local connections otherwise.
+func fanOutRoomMessage(ctx context.Context, msg Message, recipients, muted []string) {
+	if roomStreams != nil {
+		if err := roomStreams.Publish(ctx, msg, recipients, muted); err != nil {
+			logger(ctx).Println("Failed to publish room message:", err)
+		}
+		return
+	}
+	deliverLocally(ctx, msg, recipients, muted)
+}
+
+// watchUserRooms starts the consumers for the rooms of a user who just
+// connected, if there are room streams.
+func watchUserRooms(ctx context.Context, userID string) {
+	if roomStreams != nil {
+		roomStreams.WatchUser(ctx, userID)
+	}
+}
+
+// watchJoinedRoom starts the room's consumer, if there are room streams,
+// when one of the users who just joined it is connected here.
+func watchJoinedRoom(roomID int, userIDs []string) {
+	if roomStreams == nil {
+		return
+	}
+	for _, id := range userIDs {
+		if len(registry.Connections(id)) > 0 {
+			roomStreams.Watch(roomID)
+			return
+		}
+	}
+}
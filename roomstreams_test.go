@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// initRoomStreams switches room messages over to streams read in the given
+// consumer group, with a short block so that idle consumers notice quickly.
+func initRoomStreams(t testing.TB, group string) *RoomStreams {
+	streams := NewRoomStreams(group)
+	streams.Block = 20 * time.Millisecond
+	roomStreams = streams
+	t.Cleanup(func() {
+		roomStreams = nil
+		streams.Close()
+	})
+	return streams
+}
+
+// connectRecorder registers a recording connection for the user.
+func connectRecorder(t testing.TB, userID string) (*recordingTransport, *client) {
+	rec := &recordingTransport{}
+	c := registry.RegisterTransport(userID, rec, false)
+	go c.writePump()
+	t.Cleanup(func() {
+		registry.Deregister(c)
+		c.close()
+	})
+	return rec, c
+}
+
+func (t *recordingTransport) messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []Message
+	for _, v := range t.written {
+		if m, ok := v.(Message); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func waitForMessages(t *testing.T, rec *recordingTransport, n int) []Message {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := rec.messages(); len(got) >= n {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d messages, got %d", n, len(rec.messages()))
+	return nil
+}
+
+func (s *RoomStreams) watching(roomID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consumers[roomID]
+}
+
+func TestRoomStreamsFanOut(t *testing.T) {
+	initRoleStore(t)
+	streams := initRoomStreams(t, "server-a")
+	ctx := context.Background()
+	redisCli.ZAdd(ctx, userRoomsKey("3"), &redis.Z{Score: 1, Member: "7"})
+
+	member, _ := connectRecorder(t, "3")
+	muted, _ := connectRecorder(t, "6")
+	outsider, _ := connectRecorder(t, "4")
+	streams.WatchUser(ctx, "3")
+	assert.True(t, streams.watching(7))
+
+	fanOutRoomMessage(ctx, Message{ID: 1, SenderID: 1, RoomID: 7, Text: "hello"}, []string{"3"}, []string{"6"})
+
+	got := waitForMessages(t, member, 1)
+	assert.Equal(t, "hello", got[0].Text)
+	assert.False(t, got[0].Muted)
+	got = waitForMessages(t, muted, 1)
+	assert.True(t, got[0].Muted)
+	assert.Empty(t, outsider.messages())
+
+	// Every delivered entry ends up acknowledged.
+	assert.Eventually(t, func() bool {
+		pending, err := redisCli.XPending(ctx, roomStreamKey(7), "server-a").Result()
+		return err == nil && pending.Count == 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestRoomStreamsRedeliverUnacknowledged(t *testing.T) {
+	initRoleStore(t)
+	ctx := context.Background()
+	key := roomStreamKey(7)
+	if err := redisCli.XGroupCreateMkStream(ctx, key, "server-a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	streams := initRoomStreams(t, "server-a")
+	if err := streams.Publish(ctx, Message{ID: 1, RoomID: 7, Text: "in flight"}, []string{"3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The server read the entry and stopped before delivering it.
+	_, err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "server-a", Consumer: "server-a", Streams: []string{key, ">"}}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, _ := connectRecorder(t, "3")
+	streams.Watch(7)
+	got := waitForMessages(t, rec, 1)
+	assert.Equal(t, "in flight", got[0].Text)
+	assert.Eventually(t, func() bool {
+		pending, err := redisCli.XPending(ctx, key, "server-a").Result()
+		return err == nil && pending.Count == 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestRoomStreamsConsumerStopsWhenIdle(t *testing.T) {
+	initRoleStore(t)
+	streams := initRoomStreams(t, "server-a")
+
+	_, c := connectRecorder(t, "5")
+	streams.Watch(7)
+	assert.True(t, streams.watching(7))
+	time.Sleep(3 * streams.Block)
+	assert.True(t, streams.watching(7), "a member is still connected")
+
+	registry.Deregister(c)
+	assert.Eventually(t, func() bool { return !streams.watching(7) }, 2*time.Second, 5*time.Millisecond)
+}
+
+// countingTransport reports every message written to it.
+type countingTransport struct {
+	written func()
+}
+
+func (t countingTransport) write(v interface{}) error {
+	if _, ok := v.(Message); ok {
+		t.written()
+	}
+	return nil
+}
+
+func (t countingTransport) shutdown(int, string) {}
+func (t countingTransport) abort()               {}
+
+// BenchmarkRoomFanOut measures the time from publishing a room message to
+// its delivery to every member.
+func BenchmarkRoomFanOut(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("members=%d", size), func(b *testing.B) {
+			mr := initRedis(b)
+			streams := initRoomStreams(b, "bench")
+			ctx := context.Background()
+
+			var (
+				mu   sync.Mutex
+				left int
+				done = make(chan struct{}, 1)
+			)
+			written := func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if left--; left == 0 {
+					done <- struct{}{}
+				}
+			}
+			members := make([]string, size)
+			for i := range members {
+				members[i] = strconv.Itoa(10000 + i)
+				mr.SAdd(roomMembersKey(7), members[i])
+				c := registry.RegisterTransport(members[i], countingTransport{written: written}, false)
+				go c.writePump()
+				b.Cleanup(func() {
+					registry.Deregister(c)
+					c.close()
+				})
+			}
+			streams.Watch(7)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mu.Lock()
+				left = size
+				mu.Unlock()
+				fanOutRoomMessage(ctx, Message{ID: i, RoomID: 7, Text: "bench"}, members, nil)
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					b.Fatal("message not delivered to every member")
+				}
+			}
+		})
+	}
+}
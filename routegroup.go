@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware wraps a handler with checks or changes to the request that
+// run before it.
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// RouteGroup registers routes on a mux.Router behind a common middleware
+// chain, so that routes needing the same guards, such as a signed in
+// caller, do not each wrap their handler in them.
+type RouteGroup struct {
+	router     *mux.Router
+	middleware []Middleware
+}
+
+// NewRouteGroup returns a group adding routes to router. The first
+// middleware given is the outermost, and runs first.
+func NewRouteGroup(router *mux.Router, middleware ...Middleware) *RouteGroup {
+	return &RouteGroup{router: router, middleware: middleware}
+}
+
+// Handle registers h for path and, if any are given, only those methods.
+// The middleware given here runs inside the group's.
+func (g *RouteGroup) Handle(methods []string, path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		h = g.middleware[i](h)
+	}
+	route := g.router.HandleFunc(path, h)
+	if len(methods) > 0 {
+		route.Methods(methods...)
+	}
+	return route
+}
+
+// GET registers h for GET requests to path.
+func (g *RouteGroup) GET(path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	return g.Handle([]string{http.MethodGet}, path, h, middleware...)
+}
+
+// POST registers h for POST requests to path.
+func (g *RouteGroup) POST(path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	return g.Handle([]string{http.MethodPost}, path, h, middleware...)
+}
+
+// PUT registers h for PUT requests to path.
+func (g *RouteGroup) PUT(path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	return g.Handle([]string{http.MethodPut}, path, h, middleware...)
+}
+
+// PATCH registers h for PATCH requests to path.
+func (g *RouteGroup) PATCH(path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	return g.Handle([]string{http.MethodPatch}, path, h, middleware...)
+}
+
+// DELETE registers h for DELETE requests to path.
+func (g *RouteGroup) DELETE(path string, h http.HandlerFunc, middleware ...Middleware) *mux.Route {
+	return g.Handle([]string{http.MethodDelete}, path, h, middleware...)
+}
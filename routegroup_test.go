@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// tag is middleware noting its name in the X-Chain header on the way in.
+func tag(name string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Chain", name)
+			next(w, r)
+		}
+	}
+}
+
+func TestRouteGroupChain(t *testing.T) {
+	r := mux.NewRouter()
+	g := NewRouteGroup(r, tag("outer"), tag("inner"))
+	g.PUT("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Chain", "handler "+mux.Vars(r)["id"])
+	}, tag("route"))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/things/7", nil))
+	assert.Equal(t, []string{"outer", "inner", "route", "handler 7"}, rr.Header().Values("X-Chain"))
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/things/7", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Empty(t, rr.Header().Values("X-Chain"), "the chain only runs for a matching route")
+}
+
+func TestRouteGroupsGuardRoutes(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	router := newRouter()
+	serve := func(req *http.Request) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/rooms", nil)))
+	assert.Equal(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/admin/stats", nil)))
+	assert.Equal(t, http.StatusForbidden, serve(authedRequest(t, 1, "GET", "/admin/stats", nil)))
+	assert.NotEqual(t, http.StatusUnauthorized, serve(httptest.NewRequest("GET", "/users/check?username=someone_new", nil)), "public routes take anyone")
+}
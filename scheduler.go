@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	schedulerInterval = time.Second
+	schedulerBatch    = 100
+
+	// maxScheduleAhead is how far in the future a message may be scheduled.
+	maxScheduleAhead = 365 * 24 * time.Hour
+
+	defaultScheduledListLimit = 50
+	maxScheduledListLimit     = 200
+)
+
+// Final statuses of a scheduled message. Before it gets one, a message is
+// "scheduled", then "sending" from the moment the scheduler claims it.
+const (
+	scheduledSent      = "sent"
+	scheduledCancelled = "cancelled"
+)
+
+const scheduledColumns = `scheduled_id, sender_id, receiver_id, text, format, encrypted, ttl_seconds,
+	client_msg_id, send_at, status, COALESCE(message_id, 0), created_at`
+
+type ScheduledMessage struct {
+	ID          int       `json:"id"`
+	SenderID    int       `json:"sender_id"`
+	RecipientID int       `json:"recipient_id"`
+	Text        string    `json:"text"`
+	Format      string    `json:"format"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	TTLSeconds  int       `json:"ttl_seconds,omitempty"`
+	ClientMsgID string    `json:"client_msg_id"`
+	SendAt      time.Time `json:"send_at"`
+	Status      string    `json:"status"`
+	// MessageID is the stored message once it has been sent.
+	MessageID int       `json:"message_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func scanScheduled(row interface{ Scan(...interface{}) error }) (ScheduledMessage, error) {
+	var s ScheduledMessage
+	err := row.Scan(&s.ID, &s.SenderID, &s.RecipientID, &s.Text, &s.Format, &s.Encrypted, &s.TTLSeconds,
+		&s.ClientMsgID, &s.SendAt, &s.Status, &s.MessageID, &s.CreatedAt)
+	return s, err
+}
+
+// scheduler is run by main. Handlers read the time from its clock, so that
+// tests moving it decide both what is due and what is in the future.
+var scheduler = NewScheduler()
+
+// Scheduler promotes scheduled messages to normal delivery once their
+// send_at has passed, polling Postgres every Interval.
+type Scheduler struct {
+	Interval time.Duration
+	Batch    int
+	Clock    Clock
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		Interval: schedulerInterval,
+		Batch:    schedulerBatch,
+		Clock:    realClock{},
+	}
+}
+
+// Run promotes due messages once every Interval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Clock.After(s.Interval):
+			if err := s.promoteDue(ctx); err != nil {
+				log.Println("scheduler: failed to promote messages:", err)
+			}
+		}
+	}
+}
+
+type dueMessage struct {
+	id      int
+	msg     Message
+	flagged bool
+}
+
+// promoteDue sends the scheduled messages whose time has come. Rows still
+// marked sending were claimed by a pass that did not finish, and are picked
+// up again: the message is stored under the row's client_msg_id, so one
+// that made it into messages is not stored or delivered a second time.
+func (s *Scheduler) promoteDue(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT scheduled_id, sender_id, receiver_id, text, format, encrypted, ttl_seconds, client_msg_id, flagged
+		FROM scheduled_messages
+		WHERE status IN ('scheduled', 'sending') AND send_at <= $1
+		ORDER BY send_at LIMIT $2`,
+		s.Clock.Now(), s.Batch)
+	if err != nil {
+		return err
+	}
+	var due []dueMessage
+	for rows.Next() {
+		var d dueMessage
+		err := rows.Scan(&d.id, &d.msg.SenderID, &d.msg.RecipientID, &d.msg.Text, &d.msg.Format,
+			&d.msg.Encrypted, &d.msg.TTLSeconds, &d.msg.ClientMsgID, &d.flagged)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if d.msg.Format == formatPlain {
+			d.msg.Format = ""
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		if err := s.promote(ctx, d); err != nil {
+			log.Printf("scheduler: failed to send scheduled message %d: %v", d.id, err)
+		}
+	}
+	return nil
+}
+
+// promote claims a due message and sends it the way a message relayed from
+// a socket is sent. Claiming first means a cancel that comes in meanwhile
+// finds the message no longer pending.
+func (s *Scheduler) promote(ctx context.Context, d dueMessage) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "scheduler.promote",
+		trace.WithAttributes(
+			attribute.Int("chat.scheduled_id", d.id),
+			attribute.Int("chat.sender_id", d.msg.SenderID),
+			attribute.Int("chat.recipient_id", d.msg.RecipientID),
+		))
+	defer span.End()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE scheduled_messages SET status = 'sending' WHERE scheduled_id = $1 AND status IN ('scheduled', 'sending')",
+		d.id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+	dropScheduledTotal(ctx, d.msg.SenderID)
+
+	// The sender or the recipient may have been banned or deleted, or the
+	// recipient may have declined the sender, since the message was
+	// scheduled.
+	if err := checkSender(ctx, d.msg.SenderID); err == errSenderBanned {
+		return setScheduledStatus(ctx, d.id, scheduledCancelled, 0)
+	} else if err != nil {
+		return err
+	}
+	if err := checkRecipient(ctx, d.msg.RecipientID); err == errInvalidRecipient || err == errRecipientBanned {
+		return setScheduledStatus(ctx, d.id, scheduledCancelled, 0)
+	} else if err != nil {
+		return err
+	}
+	if err := screenContact(ctx, &d.msg); err == errContactDeclined {
+		return setScheduledStatus(ctx, d.id, scheduledCancelled, 0)
+	} else if err != nil {
+		return err
+	}
+
+	renderMessage(&d.msg)
+	msg, err := storeMessage(ctx, d.msg)
+	if err == nil {
+		storeRender(ctx, msg)
+		if d.flagged {
+			flagMessage(ctx, msg)
+		}
+		publishMessage(ctx, msg)
+	} else if err != errDuplicateMessage {
+		return err
+	}
+	return setScheduledStatus(ctx, d.id, scheduledSent, msg.ID)
+}
+
+func setScheduledStatus(ctx context.Context, id int, status string, messageID int) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE scheduled_messages SET status = $2, message_id = NULLIF($3, 0) WHERE scheduled_id = $1",
+		id, status, messageID)
+	return err
+}
+
+// sendsLater reports whether msg is to be scheduled rather than sent now. A
+// send_at that is not in the future sends the message right away.
+func sendsLater(msg Message, hasFiles bool) (bool, error) {
+	now := scheduler.Clock.Now()
+	if msg.SendAt == nil || !msg.SendAt.After(now) {
+		return false, nil
+	}
+	if msg.SendAt.After(now.Add(maxScheduleAhead)) {
+		return false, fmt.Errorf("send_at must be within %d days", int(maxScheduleAhead.Hours()/24))
+	}
+	if hasFiles {
+		return false, errors.New("scheduled messages cannot carry attachments")
+	}
+	return true, nil
+}
+
+// scheduleMessage stores msg to be sent at its send_at. Scheduling the same
+// client_msg_id again returns the message already scheduled.
+func scheduleMessage(ctx context.Context, msg Message, flagged bool) (ScheduledMessage, error) {
+	clientMsgID := msg.ClientMsgID
+	if clientMsgID == "" {
+		clientMsgID = uuid.NewString()
+	}
+	format := msg.Format
+	if format == "" {
+		format = formatPlain
+	}
+	scheduled, err := scanScheduled(db.QueryRowContext(ctx,
+		`INSERT INTO scheduled_messages (sender_id, receiver_id, text, format, encrypted, client_msg_id, flagged, send_at, ttl_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (sender_id, client_msg_id) DO UPDATE SET sender_id = EXCLUDED.sender_id
+		RETURNING `+scheduledColumns,
+		msg.SenderID, msg.RecipientID, msg.Text, format, msg.Encrypted, clientMsgID, flagged, msg.SendAt.UTC(), msg.TTLSeconds))
+	if err == nil {
+		dropScheduledTotal(ctx, msg.SenderID)
+	}
+	return scheduled, err
+}
+
+func scheduledList(senderID int) string {
+	return "scheduled:" + strconv.Itoa(senderID)
+}
+
+// dropScheduledTotal drops the cached count of the sender's scheduled
+// messages once one is added or leaves the list.
+func dropScheduledTotal(ctx context.Context, senderID int) {
+	if err := redisCli.Del(ctx, pageTotalKey(scheduledList(senderID))).Err(); err != nil {
+		logger(ctx).Println("Failed to drop scheduled count:", err)
+	}
+}
+
+// listScheduled returns a page of the caller's messages still waiting to be
+// sent, soonest first.
+func listScheduled(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listScheduled")
+	defer span.End()
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultScheduledListLimit, maxScheduledListLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	claims := claimsFromContext(ctx)
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE sender_id = $1 AND status = 'scheduled'
+		AND ($2::int IS NULL OR (send_at, scheduled_id) > (SELECT send_at, scheduled_id FROM scheduled_messages WHERE scheduled_id = $2))
+		ORDER BY send_at, scheduled_id
+		LIMIT $3`,
+		claims.UserID, cursor, limit+1)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scheduled := []ScheduledMessage{}
+	for rows.Next() {
+		s, err := scanScheduled(rows)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		scheduled = append(scheduled, s)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, scheduledList(claims.UserID),
+		"SELECT COUNT(*) FROM scheduled_messages WHERE sender_id = $1 AND status = 'scheduled'", claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(scheduled, limit, total, func(s ScheduledMessage) int { return s.ID }))
+}
+
+// cancelScheduled cancels one of the caller's scheduled messages. A message
+// the scheduler has already picked up can no longer be cancelled.
+func cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.cancelScheduled")
+	defer span.End()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid scheduled message id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.scheduled_id", id))
+
+	claims := claimsFromContext(ctx)
+	res, err := db.ExecContext(ctx,
+		"UPDATE scheduled_messages SET status = 'cancelled' WHERE scheduled_id = $1 AND sender_id = $2 AND status = 'scheduled'",
+		id, claims.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	} else if n > 0 {
+		dropScheduledTotal(ctx, claims.UserID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var status string
+	err = db.QueryRowContext(ctx,
+		"SELECT status FROM scheduled_messages WHERE scheduled_id = $1 AND sender_id = $2",
+		id, claims.UserID).Scan(&status)
+	if err == sql.ErrNoRows {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Scheduled message not found")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteError(w, http.StatusConflict, codeConflict, "Scheduled message is already "+status)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type scheduledRow struct {
+	ScheduledMessage
+	flagged bool
+}
+
+// scheduleStore keeps scheduled_messages in memory. Everything else goes
+// to a recipientStore, which stores the messages the rows turn into.
+type scheduleStore struct {
+	recipients *recipientStore
+
+	mu     sync.Mutex
+	rows   map[int64]*scheduledRow
+	nextID int64
+}
+
+func (s *scheduleStore) Connect(context.Context) (driver.Conn, error) {
+	return scheduleConn{recipientConn: recipientConn{store: s.recipients}, store: s}, nil
+}
+
+func (s *scheduleStore) Driver() driver.Driver { return nil }
+
+func (s *scheduleStore) row(id int64) scheduledRow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.rows[id]
+}
+
+// add puts a row in the table as an earlier run of the server left it.
+func (s *scheduleStore) add(row scheduledRow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	row.ID = int(s.nextID)
+	s.rows[s.nextID] = &row
+}
+
+type scheduleConn struct {
+	recipientConn
+	store *scheduleStore
+}
+
+func (c scheduleConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "scheduled_messages") {
+		return c.recipientConn.QueryContext(ctx, query, args)
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(query, "INSERT") {
+		senderID, clientMsgID := args[0].Value.(int64), args[5].Value.(string)
+		for _, row := range s.rows {
+			if int64(row.SenderID) == senderID && row.ClientMsgID == clientMsgID {
+				return &scheduledRows{rows: []ScheduledMessage{row.ScheduledMessage}}, nil
+			}
+		}
+		s.nextID++
+		row := &scheduledRow{
+			ScheduledMessage: ScheduledMessage{
+				ID:          int(s.nextID),
+				SenderID:    int(senderID),
+				RecipientID: int(args[1].Value.(int64)),
+				Text:        args[2].Value.(string),
+				Format:      args[3].Value.(string),
+				Encrypted:   args[4].Value.(bool),
+				TTLSeconds:  int(args[8].Value.(int64)),
+				ClientMsgID: clientMsgID,
+				SendAt:      args[7].Value.(time.Time),
+				Status:      "scheduled",
+				CreatedAt:   insertedAt,
+			},
+			flagged: args[6].Value.(bool),
+		}
+		s.rows[s.nextID] = row
+		return &scheduledRows{rows: []ScheduledMessage{row.ScheduledMessage}}, nil
+	}
+	if strings.HasPrefix(query, "SELECT COUNT(*)") {
+		var n int64
+		for _, row := range s.rows {
+			if row.Status == "scheduled" && int64(row.SenderID) == args[0].Value.(int64) {
+				n++
+			}
+		}
+		return &valueRows{column: "count", value: n}, nil
+	}
+	if strings.HasPrefix(query, "SELECT status") {
+		row, ok := s.rows[args[0].Value.(int64)]
+		if !ok || int64(row.SenderID) != args[1].Value.(int64) {
+			return &valueRows{column: "status", done: true}, nil
+		}
+		return &valueRows{column: "status", value: row.Status}, nil
+	}
+
+	var matched []scheduledRow
+	due := strings.Contains(query, "send_at <= $1")
+	for _, row := range s.rows {
+		if due && (row.Status == "scheduled" || row.Status == "sending") && !row.SendAt.After(args[0].Value.(time.Time)) {
+			matched = append(matched, *row)
+		}
+		if !due && row.Status == "scheduled" && int64(row.SenderID) == args[0].Value.(int64) {
+			matched = append(matched, *row)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].SendAt.Before(matched[j].SendAt) })
+	if due {
+		return &dueRows{rows: matched}, nil
+	}
+	// A page of the sender's list: after the cursor, up to the limit.
+	if cursor, ok := args[1].Value.(int64); ok {
+		for i, row := range matched {
+			if int64(row.ID) == cursor {
+				matched = matched[i+1:]
+				break
+			}
+		}
+	}
+	rows := &scheduledRows{}
+	for _, row := range matched[:min(len(matched), int(args[2].Value.(int64)))] {
+		rows.rows = append(rows.rows, row.ScheduledMessage)
+	}
+	return rows, nil
+}
+
+func (c scheduleConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "scheduled_messages") {
+		return c.recipientConn.ExecContext(ctx, query, args)
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.rows[args[0].Value.(int64)]
+	switch {
+	case strings.Contains(query, "status = 'sending'"):
+		if !ok || (row.Status != "scheduled" && row.Status != "sending") {
+			return driver.RowsAffected(0), nil
+		}
+		row.Status = "sending"
+	case strings.Contains(query, "status = 'cancelled'"):
+		if !ok || row.Status != "scheduled" || int64(row.SenderID) != args[1].Value.(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.Status = "cancelled"
+	default:
+		row.Status = args[1].Value.(string)
+		row.MessageID = int(args[2].Value.(int64))
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type scheduledRows struct {
+	rows []ScheduledMessage
+}
+
+func (r *scheduledRows) Columns() []string {
+	return []string{"scheduled_id", "sender_id", "receiver_id", "text", "format", "encrypted", "ttl_seconds",
+		"client_msg_id", "send_at", "status", "message_id", "created_at"}
+}
+func (r *scheduledRows) Close() error { return nil }
+
+func (r *scheduledRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	s := r.rows[0]
+	dest[0], dest[1], dest[2], dest[3], dest[4], dest[5] = int64(s.ID), int64(s.SenderID), int64(s.RecipientID), s.Text, s.Format, s.Encrypted
+	dest[6], dest[7], dest[8], dest[9], dest[10], dest[11] = int64(s.TTLSeconds), s.ClientMsgID, s.SendAt, s.Status, int64(s.MessageID), s.CreatedAt
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type dueRows struct {
+	rows []scheduledRow
+}
+
+func (r *dueRows) Columns() []string {
+	return []string{"scheduled_id", "sender_id", "receiver_id", "text", "format", "encrypted", "ttl_seconds", "client_msg_id", "flagged"}
+}
+func (r *dueRows) Close() error { return nil }
+
+func (r *dueRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	s := r.rows[0]
+	dest[0], dest[1], dest[2], dest[3] = int64(s.ID), int64(s.SenderID), int64(s.RecipientID), s.Text
+	dest[4], dest[5], dest[6], dest[7], dest[8] = s.Format, s.Encrypted, int64(s.TTLSeconds), s.ClientMsgID, s.flagged
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func initScheduleStore(t *testing.T, active ...int64) *scheduleStore {
+	recipients := initRecipientStore(t, active...)
+	db.Close()
+	store := &scheduleStore{recipients: recipients, rows: make(map[int64]*scheduledRow)}
+	db = sql.OpenDB(store)
+	return store
+}
+
+// useSchedulerClock swaps in a scheduler running on a fake clock.
+func useSchedulerClock(t *testing.T) *fakeClock {
+	clock := newFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC))
+	saved := scheduler
+	scheduler = &Scheduler{Interval: schedulerInterval, Batch: schedulerBatch, Clock: clock}
+	t.Cleanup(func() { scheduler = saved })
+	return clock
+}
+
+func scheduleAt(t *testing.T, msg Message, at time.Time) ScheduledMessage {
+	msg.SendAt = &at
+	rr := postMessage(msg)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("scheduling returned %d: %s", rr.Code, rr.Body)
+	}
+	var scheduled ScheduledMessage
+	if err := json.NewDecoder(rr.Body).Decode(&scheduled); err != nil {
+		t.Fatal(err)
+	}
+	return scheduled
+}
+
+func TestScheduledMessageDeliveredWhenDue(t *testing.T) {
+	initRedis(t)
+	store := initScheduleStore(t, 921, 922)
+	clock := useSchedulerClock(t)
+	server := newTestServer(t, newRouter())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := dialTestUser(t, server, 922)
+	waitForClients(t, 1)
+
+	scheduled := scheduleAt(t, Message{SenderID: 921, RecipientID: 922, Text: "good morning"}, clock.Now().Add(time.Hour))
+	assert.Equal(t, "scheduled", scheduled.Status)
+	assert.Zero(t, store.recipients.nextID.Load(), "the message is not stored before it is due")
+
+	go scheduler.Run(ctx)
+	clock.waitForTimers(t, 1)
+	clock.Advance(30 * time.Minute)
+	clock.waitForTimers(t, 1)
+	assert.Equal(t, "scheduled", store.row(int64(scheduled.ID)).Status)
+
+	clock.Advance(30 * time.Minute)
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := receiver.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "good morning", msg.Text)
+	assert.Equal(t, 921, msg.SenderID)
+	assert.NotZero(t, msg.ID)
+
+	assert.Eventually(t, func() bool {
+		row := store.row(int64(scheduled.ID))
+		return row.Status == "sent" && row.MessageID == msg.ID
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestScheduledMessageSentOnceAcrossRestarts(t *testing.T) {
+	initRedis(t)
+	store := initScheduleStore(t, 1, 2)
+	clock := useSchedulerClock(t)
+	ctx := context.Background()
+
+	// A previous run claimed this one and stored it, then died before
+	// marking it sent.
+	stored := uuid.NewString()
+	store.recipients.clientMsgs[stored] = Message{ID: 7, RecipientID: 2, Text: "one"}
+	store.add(scheduledRow{ScheduledMessage: ScheduledMessage{SenderID: 1, RecipientID: 2, Text: "one", Format: formatPlain,
+		ClientMsgID: stored, SendAt: clock.Now().Add(-time.Minute), Status: "sending"}})
+	// And this one it never got to.
+	store.add(scheduledRow{ScheduledMessage: ScheduledMessage{SenderID: 1, RecipientID: 2, Text: "two", Format: formatPlain,
+		ClientMsgID: uuid.NewString(), SendAt: clock.Now(), Status: "scheduled"}})
+
+	assert.NoError(t, scheduler.promoteDue(ctx))
+	assert.NoError(t, scheduler.promoteDue(ctx))
+
+	assert.EqualValues(t, 1, store.recipients.nextID.Load(), "each message is stored once")
+	assert.Equal(t, scheduledRow{ScheduledMessage: ScheduledMessage{ID: 1, SenderID: 1, RecipientID: 2, Text: "one",
+		Format: formatPlain, ClientMsgID: stored, SendAt: clock.Now().Add(-time.Minute), Status: "sent", MessageID: 7}}, store.row(1))
+	assert.Equal(t, "sent", store.row(2).Status)
+	assert.Equal(t, 1, store.row(2).MessageID)
+}
+
+func TestListAndCancelScheduledMessages(t *testing.T) {
+	initRedis(t)
+	store := initScheduleStore(t, 1, 2)
+	clock := useSchedulerClock(t)
+	router := newRouter()
+
+	later := scheduleAt(t, Message{SenderID: 1, RecipientID: 2, Text: "later"}, clock.Now().Add(2*time.Hour))
+	sooner := scheduleAt(t, Message{SenderID: 1, RecipientID: 2, Text: "sooner"}, clock.Now().Add(time.Hour))
+	scheduleAt(t, Message{SenderID: 2, RecipientID: 1, Text: "not yours"}, clock.Now().Add(time.Hour))
+
+	listPage := func(query string) Page[ScheduledMessage] {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 1, "GET", "/messages/scheduled"+query, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var page Page[ScheduledMessage]
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page
+	}
+	list := func() []ScheduledMessage {
+		page := listPage("")
+		assert.EqualValues(t, len(page.Items), page.Total)
+		return page.Items
+	}
+	cancel := func(id string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, 1, "DELETE", "/messages/scheduled/"+id, nil))
+		return rr.Code
+	}
+
+	scheduled := list()
+	if assert.Len(t, scheduled, 2) {
+		assert.Equal(t, []string{"sooner", "later"}, []string{scheduled[0].Text, scheduled[1].Text})
+	}
+	page := listPage("?limit=1")
+	if assert.Len(t, page.Items, 1) && assert.NotNil(t, page.NextCursor) {
+		assert.Equal(t, sooner.ID, page.Items[0].ID)
+		assert.EqualValues(t, 2, page.Total)
+		page = listPage("?limit=1&cursor=" + *page.NextCursor)
+		if assert.Len(t, page.Items, 1) {
+			assert.Equal(t, later.ID, page.Items[0].ID)
+		}
+		assert.False(t, page.HasNext)
+	}
+
+	assert.Equal(t, http.StatusNoContent, cancel(strconv.Itoa(later.ID)))
+	assert.Equal(t, http.StatusConflict, cancel(strconv.Itoa(later.ID)))
+	assert.Equal(t, http.StatusNotFound, cancel("3"), "other users' messages cannot be cancelled")
+	assert.Equal(t, http.StatusNotFound, cancel("99"))
+	if scheduled := list(); assert.Len(t, scheduled, 1) {
+		assert.Equal(t, sooner.ID, scheduled[0].ID)
+	}
+
+	clock.Advance(3 * time.Hour)
+	assert.NoError(t, scheduler.promoteDue(context.Background()))
+	assert.EqualValues(t, 2, store.recipients.nextID.Load(), "the cancelled message is not sent")
+	assert.Equal(t, "cancelled", store.row(int64(later.ID)).Status)
+	assert.Equal(t, http.StatusConflict, cancel(strconv.Itoa(sooner.ID)))
+	assert.Empty(t, list())
+}
+
+func TestScheduleRejectsBadSendAt(t *testing.T) {
+	initRedis(t)
+	store := initScheduleStore(t, 1, 2)
+	clock := useSchedulerClock(t)
+
+	tooFar := clock.Now().Add(maxScheduleAhead + time.Hour)
+	assert.Equal(t, http.StatusUnprocessableEntity, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi", SendAt: &tooFar}).Code)
+
+	past := clock.Now().Add(-time.Minute)
+	assert.Equal(t, http.StatusCreated, postMessage(Message{SenderID: 1, RecipientID: 2, Text: "hi", SendAt: &past}).Code,
+		"a send_at that has passed sends right away")
+	assert.Empty(t, store.rows)
+}
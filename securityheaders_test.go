@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	router := newRouter()
+
+	for _, endpoint := range []struct{ method, path string }{
+		{"GET", "/readyz"},
+		{"GET", "/metrics"},
+		{"POST", "/auth/login"},
+		{"POST", "/token/refresh"},
+		{"GET", "/sessions"},
+		{"POST", "/users"},
+		{"GET", "/users/1"},
+		{"GET", "/rooms"},
+		{"GET", "/messages"},
+		{"POST", "/messages"},
+		{"GET", "/ws/1"},
+		{"GET", "/admin/users"},
+		{"GET", "/no/such/path"},
+		{"PATCH", "/auth/login"},
+	} {
+		req := httptest.NewRequest(endpoint.method, endpoint.path, strings.NewReader("{}"))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		name := endpoint.method + " " + endpoint.path
+		for header, value := range securityHeaders {
+			assert.Equal(t, value, rr.Header().Get(header), "%s: %s", name, header)
+		}
+		assert.Empty(t, rr.Header().Get("Strict-Transport-Security"), "%s: HSTS over plain HTTP", name)
+	}
+}
+
+func TestSecurityHeadersHSTSOverTLS(t *testing.T) {
+	handler := SecurityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "https://chat.example.com/readyz", nil)
+	req.TLS = &tls.ConnectionState{}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "max-age=31536000; includeSubDomains", rr.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "DENY", rr.Header().Get("X-Frame-Options"))
+}
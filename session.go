@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+// sessionInfoKey holds what GET /sessions shows of a session: when it
+// started and was last used, and the client that started it.
+func sessionInfoKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:info", sessionID)
+}
+
+func userSessionsKey(userID int) string {
+	return fmt.Sprintf("user:%d:sessions", userID)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// refreshTokenKey is where a refresh token is kept. Only its SHA-256 is
+// stored, so what is in Redis cannot be used to refresh.
+func refreshTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("refresh:%s", hex.EncodeToString(sum[:]))
+}
+
+// sessionRefreshTokensKey lists the keys of the refresh tokens issued for a
+// session, its token family, so that they go with it.
+func sessionRefreshTokensKey(sessionID string) string {
+	return fmt.Sprintf("session:%s:refresh", sessionID)
+}
+
+// touchLastSeen records that a session was used, unless it is gone.
+var touchLastSeen = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], "last_seen", ARGV[1])
+end
+return 0`)
+
+// newSession records a new login session for the user and returns its ID.
+// The client the request in ctx came from is kept with it. A session lasts
+// cfg.RefreshTokenTTL from when it was last refreshed.
+func newSession(ctx context.Context, userID int) (string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	info, _ := ctx.Value(clientInfoKey).(clientInfo)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	pipe := redisCli.TxPipeline()
+	pipe.Set(ctx, sessionKey(sessionID), userID, cfg.RefreshTokenTTL)
+	pipe.HSet(ctx, sessionInfoKey(sessionID), "created_at", now, "last_seen", now, "user_agent", info.UserAgent, "ip", info.IP)
+	pipe.Expire(ctx, sessionInfoKey(sessionID), cfg.RefreshTokenTTL)
+	pipe.SAdd(ctx, userSessionsKey(userID), sessionID)
+	pipe.Expire(ctx, userSessionsKey(userID), cfg.RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// createSession starts a session and returns an access token bound to it.
+// Revoking the session invalidates the token.
+func createSession(ctx context.Context, userID int, role string) (string, error) {
+	sessionID, err := newSession(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return newAccessToken(userID, role, sessionID)
+}
+
+// createRefreshToken issues an opaque token for the user's session. It is
+// good for one refresh within cfg.RefreshTokenTTL.
+func createRefreshToken(ctx context.Context, sessionID string, userID int) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	key := refreshTokenKey(token)
+	family := sessionRefreshTokensKey(sessionID)
+	pipe := redisCli.TxPipeline()
+	pipe.HSet(ctx, key, "session", sessionID, "user_id", userID)
+	pipe.Expire(ctx, key, cfg.RefreshTokenTTL)
+	pipe.SAdd(ctx, family, key)
+	pipe.Expire(ctx, family, cfg.RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// extendSession makes the user's session last cfg.RefreshTokenTTL from now.
+func extendSession(ctx context.Context, userID int, sessionID string) error {
+	pipe := redisCli.TxPipeline()
+	for _, key := range []string{sessionKey(sessionID), sessionInfoKey(sessionID), sessionRefreshTokensKey(sessionID), userSessionsKey(userID)} {
+		pipe.Expire(ctx, key, cfg.RefreshTokenTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func sessionActive(ctx context.Context, sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+	n, err := redisCli.Exists(ctx, sessionKey(sessionID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// touchSession moves the session's last_seen to now.
+func touchSession(ctx context.Context, sessionID string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return touchLastSeen.Run(ctx, redisCli, []string{sessionInfoKey(sessionID)}, now).Err()
+}
+
+// sessionKeys returns the keys that make up the sessions: each session, its
+// info and its refresh tokens.
+func sessionKeys(ctx context.Context, sessionIDs []string) ([]string, error) {
+	if len(sessionIDs) == 0 {
+		return nil, nil
+	}
+	pipe := redisCli.Pipeline()
+	families := make([]*redis.StringSliceCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		families[i] = pipe.SMembers(ctx, sessionRefreshTokensKey(sessionID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for i, sessionID := range sessionIDs {
+		keys = append(keys, sessionKey(sessionID), sessionInfoKey(sessionID), sessionRefreshTokensKey(sessionID))
+		keys = append(keys, families[i].Val()...)
+	}
+	return keys, nil
+}
+
+// revokeSession deletes one session of the user with its refresh tokens.
+func revokeSession(ctx context.Context, userID int, sessionID string) error {
+	keys, err := sessionKeys(ctx, []string{sessionID})
+	if err != nil {
+		return err
+	}
+	pipe := redisCli.TxPipeline()
+	pipe.Del(ctx, keys...)
+	pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// revokeUserSessions deletes every session of the user except keepSessionID,
+// which may be empty to revoke them all.
+func revokeUserSessions(ctx context.Context, userID int, keepSessionID string) error {
+	sessionIDs, err := redisCli.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	var revoked []interface{}
+	var revokedIDs []string
+	for _, sessionID := range sessionIDs {
+		if sessionID != keepSessionID {
+			revoked = append(revoked, sessionID)
+			revokedIDs = append(revokedIDs, sessionID)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	keys, err := sessionKeys(ctx, revokedIDs)
+	if err != nil {
+		return err
+	}
+
+	pipe := redisCli.TxPipeline()
+	pipe.Del(ctx, keys...)
+	pipe.SRem(ctx, userSessionsKey(userID), revoked...)
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SessionInfo describes one of the caller's login sessions. Current marks
+// the session the request was made with.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+// listSessions returns the caller's active sessions, most recently used
+// first.
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listSessions")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	sessionIDs, err := redisCli.SMembers(ctx, userSessionsKey(claims.UserID)).Result()
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to list sessions")
+		return
+	}
+
+	pipe := redisCli.Pipeline()
+	exists := make([]*redis.IntCmd, len(sessionIDs))
+	infos := make([]*redis.StringStringMapCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		exists[i] = pipe.Exists(ctx, sessionKey(sessionID))
+		infos[i] = pipe.HGetAll(ctx, sessionInfoKey(sessionID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to list sessions")
+		return
+	}
+
+	sessions := []SessionInfo{}
+	for i, sessionID := range sessionIDs {
+		// Sessions that expired stay in the set until revoked.
+		if exists[i].Val() == 0 {
+			continue
+		}
+		info := infos[i].Val()
+		session := SessionInfo{
+			ID:        sessionID,
+			UserAgent: info["user_agent"],
+			IP:        info["ip"],
+			Current:   sessionID == claims.ID,
+		}
+		session.CreatedAt, _ = time.Parse(time.RFC3339Nano, info["created_at"])
+		session.LastSeen, _ = time.Parse(time.RFC3339Nano, info["last_seen"])
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	span.SetAttributes(attribute.Int("chat.sessions", len(sessions)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// deleteSession revokes one of the caller's sessions and closes the
+// connections opened with it. Revoking the current session logs out.
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.deleteSession")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	sessionID := mux.Vars(r)["id"]
+
+	owned, err := redisCli.SIsMember(ctx, userSessionsKey(claims.UserID), sessionID).Result()
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to revoke session")
+		return
+	}
+	if !owned {
+		WriteError(w, http.StatusNotFound, codeNotFound, "Session not found")
+		return
+	}
+	if err := revokeSession(ctx, claims.UserID, sessionID); err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to revoke session")
+		return
+	}
+
+	disconnected := registry.DisconnectSession(strconv.Itoa(claims.UserID), sessionID, websocket.ClosePolicyViolation, "session revoked")
+	span.SetAttributes(attribute.Int("chat.disconnected", disconnected))
+
+	if sessionID == claims.ID {
+		clearRefreshCookie(w)
+		auditCaller(ctx, "logout", userTarget(claims.UserID))
+	} else {
+		auditCaller(ctx, "session_revoke", userTarget(claims.UserID))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
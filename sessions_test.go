@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionFrom starts a session for the user as if logged in from the client.
+func sessionFrom(t *testing.T, userID int, ip, userAgent string) (token, sessionID string) {
+	ctx := context.WithValue(context.Background(), clientInfoKey, clientInfo{IP: ip, UserAgent: userAgent})
+	token, err := createSession(ctx, userID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, claims.ID
+}
+
+func dialWithToken(t *testing.T, server *httptest.Server, userID int, token string) *websocket.Conn {
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + strconv.Itoa(userID) + "?token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sessionRequest(method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func listedSessions(t *testing.T, token string) []SessionInfo {
+	rr := sessionRequest("GET", "/sessions", token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /sessions: %d %s", rr.Code, rr.Body.String())
+	}
+	var sessions []SessionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func assertClosedWith(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			assert.True(t, websocket.IsCloseError(err, code), "expected close %d, got %v", code, err)
+			return
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	laptop, laptopID := sessionFrom(t, 7, "192.0.2.1", "laptop")
+	time.Sleep(time.Millisecond)
+	_, phoneID := sessionFrom(t, 7, "198.51.100.2", "phone")
+	sessionFrom(t, 8, "203.0.113.3", "someone else")
+
+	// Using the laptop makes it the most recently seen.
+	time.Sleep(time.Millisecond)
+	sessions := listedSessions(t, laptop)
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, laptopID, sessions[0].ID)
+		assert.True(t, sessions[0].Current)
+		assert.Equal(t, "laptop", sessions[0].UserAgent)
+		assert.Equal(t, "192.0.2.1", sessions[0].IP)
+		assert.True(t, sessions[0].LastSeen.After(sessions[0].CreatedAt))
+
+		assert.Equal(t, phoneID, sessions[1].ID)
+		assert.False(t, sessions[1].Current)
+		assert.Equal(t, "phone", sessions[1].UserAgent)
+		assert.False(t, sessions[1].CreatedAt.IsZero())
+	}
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/sessions", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRevokeSessionClosesItsSockets(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	laptop, laptopID := sessionFrom(t, 7, "192.0.2.1", "laptop")
+	phone, phoneID := sessionFrom(t, 7, "198.51.100.2", "phone")
+	laptopConn := dialWithToken(t, server, 7, laptop)
+	phoneConn := dialWithToken(t, server, 7, phone)
+	waitForClients(t, 2)
+
+	assert.Equal(t, http.StatusNoContent, sessionRequest("DELETE", "/sessions/"+phoneID, laptop).Code)
+	assertClosedWith(t, phoneConn, websocket.ClosePolicyViolation)
+	waitForClients(t, 1)
+	if clients := registry.Connections("7"); assert.Len(t, clients, 1) {
+		assert.Equal(t, laptopID, clients[0].sessionID, "the laptop's socket stays open")
+	}
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest("GET", "/sessions", phone).Code)
+	assert.Len(t, listedSessions(t, laptop), 1)
+
+	// Revoking the current session logs out.
+	rr := sessionRequest("DELETE", "/sessions/"+laptopID, laptop)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	if cookies := rr.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.Equal(t, refreshTokenCookie, cookies[0].Name)
+		assert.Negative(t, cookies[0].MaxAge)
+	}
+	assertClosedWith(t, laptopConn, websocket.ClosePolicyViolation)
+	waitForClients(t, 0)
+	assert.Equal(t, http.StatusUnauthorized, sessionRequest("GET", "/sessions", laptop).Code)
+}
+
+func TestRevokeSessionOfAnotherUser(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	mine, _ := sessionFrom(t, 7, "192.0.2.1", "laptop")
+	theirs, theirID := sessionFrom(t, 8, "198.51.100.2", "phone")
+
+	assert.Equal(t, http.StatusNotFound, sessionRequest("DELETE", "/sessions/"+theirID, mine).Code)
+	assert.Equal(t, http.StatusNotFound, sessionRequest("DELETE", "/sessions/nonexistent", mine).Code)
+	assert.Len(t, listedSessions(t, theirs), 1, "their session is untouched")
+}
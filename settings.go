@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	// Quiet hours are kept in the user's timezone, which must load on hosts
+	// without a zoneinfo database too.
+	_ "time/tzdata"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+// notificationSettingsTTL bounds how long a user's settings stay in Redis
+// when nobody asks for them.
+const notificationSettingsTTL = 24 * time.Hour
+
+// quietHoursLayout is how quiet hours are written, in 24-hour time.
+const quietHoursLayout = "15:04"
+
+// NotificationSettings are a user's do-not-disturb settings. While DND is on
+// or the quiet hours last, the user gets no push notifications or mention
+// alerts; messages still reach their connections, marked dnd.
+type NotificationSettings struct {
+	DND        bool        `json:"dnd"`
+	QuietHours *QuietHours `json:"quiet_hours"`
+}
+
+// QuietHours is a daily do-not-disturb window, from Start to End in
+// Timezone. It ends the next day when End is before Start.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// dndAt reports whether the settings keep the user from being disturbed at
+// now.
+func (s NotificationSettings) dndAt(now time.Time) bool {
+	if s.DND {
+		return true
+	}
+	if s.QuietHours == nil {
+		return false
+	}
+	start, end, loc, err := s.QuietHours.parse()
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return start <= minute && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// parse returns the minutes after midnight the window starts and ends at,
+// and its timezone.
+func (q QuietHours) parse() (start, end int, loc *time.Location, err error) {
+	s, err := time.Parse(quietHoursLayout, q.Start)
+	if err != nil {
+		return 0, 0, nil, errors.New(`quiet_hours.start must be a time like "22:00"`)
+	}
+	e, err := time.Parse(quietHoursLayout, q.End)
+	if err != nil {
+		return 0, 0, nil, errors.New(`quiet_hours.end must be a time like "07:00"`)
+	}
+	start, end = s.Hour()*60+s.Minute(), e.Hour()*60+e.Minute()
+	if start == end {
+		return 0, 0, nil, errors.New("quiet_hours must not start and end at the same time")
+	}
+	loc, err = time.LoadLocation(q.Timezone)
+	if err != nil || q.Timezone == "" || q.Timezone == "Local" {
+		return 0, 0, nil, fmt.Errorf("unknown timezone %q", q.Timezone)
+	}
+	return start, end, loc, nil
+}
+
+// minutesClock writes minutes after midnight the way quiet hours are
+// written.
+func minutesClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func notificationSettingsKey(userID string) string {
+	return fmt.Sprintf("user:%s:notification_settings", userID)
+}
+
+// notificationSettings returns the settings of the users, from Redis for
+// those it has. Users who never set any get the zero settings.
+func notificationSettings(ctx context.Context, userIDs []string) (map[string]NotificationSettings, error) {
+	settings := make(map[string]NotificationSettings, len(userIDs))
+	if len(userIDs) == 0 {
+		return settings, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = notificationSettingsKey(id)
+	}
+	values, err := redisCli.MGet(ctx, keys...).Result()
+	if err != nil {
+		logger(ctx).Println("Failed to read notification settings:", err)
+		values = make([]interface{}, len(userIDs))
+	}
+	var missing []int64
+	for i, id := range userIDs {
+		var s NotificationSettings
+		if value, ok := values[i].(string); ok && json.Unmarshal([]byte(value), &s) == nil {
+			settings[id] = s
+		} else if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) == 0 {
+		return settings, nil
+	}
+
+	loaded, err := loadNotificationSettings(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	pipe := redisCli.Pipeline()
+	for _, n := range missing {
+		id := strconv.FormatInt(n, 10)
+		settings[id] = loaded[id]
+		body, _ := json.Marshal(loaded[id])
+		pipe.Set(ctx, notificationSettingsKey(id), body, notificationSettingsTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to cache notification settings:", err)
+	}
+	return settings, nil
+}
+
+func loadNotificationSettings(ctx context.Context, userIDs []int64) (map[string]NotificationSettings, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT user_id, dnd, quiet_start, quiet_end, timezone FROM user_settings WHERE user_id = ANY($1)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	settings := make(map[string]NotificationSettings)
+	for rows.Next() {
+		var userID int
+		var s NotificationSettings
+		var start, end *int
+		var timezone *string
+		if err := rows.Scan(&userID, &s.DND, &start, &end, &timezone); err != nil {
+			return nil, err
+		}
+		if start != nil && end != nil && timezone != nil {
+			s.QuietHours = &QuietHours{Start: minutesClock(*start), End: minutesClock(*end), Timezone: *timezone}
+		}
+		settings[strconv.Itoa(userID)] = s
+	}
+	return settings, rows.Err()
+}
+
+// usersInDND returns which of the users are not to be disturbed now. When
+// that cannot be told, nobody is taken to be.
+func usersInDND(ctx context.Context, userIDs []string) map[string]bool {
+	settings, err := notificationSettings(ctx, userIDs)
+	if err != nil {
+		logger(ctx).Println("Failed to look up notification settings:", err)
+		return nil
+	}
+	now := muteClock.Now()
+	dnd := make(map[string]bool)
+	for id, s := range settings {
+		if s.dndAt(now) {
+			dnd[id] = true
+		}
+	}
+	return dnd
+}
+
+// getNotificationSettings returns the settings of the user in the path, to
+// that user and to admins.
+func getNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getNotificationSettings")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	id := strconv.Itoa(userID)
+	settings, err := notificationSettings(ctx, []string{id})
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings[id])
+}
+
+// updateNotificationSettings replaces the settings of the user in the path.
+// Leaving quiet_hours out or null removes them.
+func updateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updateNotificationSettings")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var settings NotificationSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		decodeError(w, err)
+		return
+	}
+	var start, end *int
+	var timezone *string
+	if q := settings.QuietHours; q != nil {
+		if q.Timezone == "" {
+			q.Timezone = "UTC"
+		}
+		s, e, _, err := q.parse()
+		if err != nil {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
+			return
+		}
+		q.Start, q.End = minutesClock(s), minutesClock(e)
+		start, end, timezone = &s, &e, &q.Timezone
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO user_settings (user_id, dnd, quiet_start, quiet_end, timezone) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET dnd = EXCLUDED.dnd, quiet_start = EXCLUDED.quiet_start,
+			quiet_end = EXCLUDED.quiet_end, timezone = EXCLUDED.timezone, updated_at = NOW()`,
+		userID, settings.DND, start, end, timezone)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := redisCli.Del(ctx, notificationSettingsKey(strconv.Itoa(userID))).Err(); err != nil {
+		logger(ctx).Println("Failed to drop notification settings:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// settingsStore keeps user_settings rows by user ID.
+type settingsStore struct {
+	mu    sync.Mutex
+	rows  map[int64][]driver.Value
+	loads int
+}
+
+func (s *settingsStore) Connect(context.Context) (driver.Conn, error) {
+	return settingsConn{store: s}, nil
+}
+
+func (s *settingsStore) Driver() driver.Driver { return nil }
+
+type settingsConn struct {
+	fakeConn
+	store *settingsStore
+}
+
+func (settingsConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+func (c settingsConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT user_id, dnd, quiet_start, quiet_end, timezone FROM user_settings") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	rows := &tableRows{columns: []string{"user_id", "dnd", "quiet_start", "quiet_end", "timezone"}}
+	for _, id := range args[0].Value.([]int64) {
+		if row, ok := s.rows[id]; ok {
+			rows.rows = append(rows.rows, append([]driver.Value{id}, row...))
+		}
+	}
+	return rows, nil
+}
+
+func (c settingsConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "INSERT INTO user_settings") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row := make([]driver.Value, 4)
+	for i := range row {
+		row[i] = args[i+1].Value
+	}
+	s.rows[args[0].Value.(int64)] = row
+	return driver.RowsAffected(1), nil
+}
+
+func initSettingsStore(t *testing.T) *settingsStore {
+	store := &settingsStore{rows: make(map[int64][]driver.Value)}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+// cacheNotificationSettings puts the user's settings in Redis, for tests
+// whose database knows nothing of them.
+func cacheNotificationSettings(t *testing.T, userID string, settings NotificationSettings) {
+	body, _ := json.Marshal(settings)
+	if err := redisCli.Set(context.Background(), notificationSettingsKey(userID), body, time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	t.Parallel()
+	night := NotificationSettings{QuietHours: &QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin"}}
+	lunch := NotificationSettings{QuietHours: &QuietHours{Start: "12:00", End: "13:30", Timezone: "UTC"}}
+	// Berlin is two hours ahead of UTC in June.
+	at := func(hour, minute int) time.Time { return time.Date(2024, 6, 1, hour, minute, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		name     string
+		settings NotificationSettings
+		now      time.Time
+		want     bool
+	}{
+		{"before night", night, at(19, 59), false},
+		{"night starts", night, at(20, 0), true},
+		{"after midnight", night, at(23, 30), true},
+		{"early morning", night, at(4, 59), true},
+		{"night ends", night, at(5, 0), false},
+		{"midday", night, at(12, 0), false},
+		{"lunch", lunch, at(12, 45), true},
+		{"after lunch", lunch, at(13, 30), false},
+		{"before lunch", lunch, at(11, 59), false},
+		{"dnd", NotificationSettings{DND: true}, at(12, 0), true},
+		{"nothing set", NotificationSettings{}, at(23, 0), false},
+	} {
+		assert.Equal(t, tc.want, tc.settings.dndAt(tc.now), tc.name)
+	}
+}
+
+func TestNotificationSettingsEndpoints(t *testing.T) {
+	initRedis(t)
+	store := initSettingsStore(t)
+	router := newRouter()
+	serve := func(userID int, method, path string, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, method, path, body))
+		return rr
+	}
+	get := func() NotificationSettings {
+		rr := serve(7, "GET", "/users/7/settings", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var settings NotificationSettings
+		json.NewDecoder(rr.Body).Decode(&settings)
+		return settings
+	}
+
+	assert.Equal(t, NotificationSettings{}, get())
+
+	rr := serve(7, "PUT", "/users/7/settings", map[string]interface{}{
+		"dnd":         false,
+		"quiet_hours": map[string]string{"start": "22:00", "end": "7:00"},
+	})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	want := NotificationSettings{QuietHours: &QuietHours{Start: "22:00", End: "07:00", Timezone: "UTC"}}
+	assert.Equal(t, want, get(), "the cached settings are dropped")
+
+	for _, quiet := range []map[string]string{
+		{"start": "22:00", "end": "22:00"},
+		{"start": "25:00", "end": "07:00"},
+		{"start": "22:00", "end": "07:00", "timezone": "Mars/Olympus_Mons"},
+	} {
+		rr := serve(7, "PUT", "/users/7/settings", map[string]interface{}{"quiet_hours": quiet})
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, quiet)
+	}
+	assert.Equal(t, http.StatusForbidden, serve(8, "PUT", "/users/7/settings", NotificationSettings{DND: true}).Code)
+	assert.Equal(t, http.StatusForbidden, serve(8, "GET", "/users/7/settings", nil).Code)
+
+	assert.Equal(t, http.StatusOK, serve(7, "PUT", "/users/7/settings", NotificationSettings{DND: true}).Code)
+	assert.Equal(t, NotificationSettings{DND: true}, get())
+	get()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 3, store.loads, "settings are read from Redis until they change")
+}
+
+func TestDNDMarksDeliveredMessages(t *testing.T) {
+	mr := initRedis(t)
+	store := initSettingsStore(t)
+	// Quiet hours from 22:00 to 07:00 in New York, four hours behind UTC in
+	// June.
+	store.rows[902] = []driver.Value{false, int64(22 * 60), int64(7 * 60), "America/New_York"}
+	clock := newFakeClock(time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC))
+	useMuteClock(t, clock)
+	mr.SAdd(roomMembersKey(31), "901", "902", "903")
+	quiet, _ := connectRecorder(t, "902")
+	other, _ := connectRecorder(t, "903")
+
+	send := func(text string) {
+		if err := (RoomConversation{RoomID: 31}).Broadcast(context.Background(), Message{SenderID: 901, RoomID: 31, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dnd := func(rec *recordingTransport, n int) []bool {
+		var flags []bool
+		assert.Eventually(t, func() bool { return len(rec.messages()) == n }, time.Second, 5*time.Millisecond)
+		for _, msg := range rec.messages() {
+			flags = append(flags, msg.DND)
+		}
+		return flags
+	}
+
+	send("late at night")
+	assert.Equal(t, []bool{true}, dnd(quiet, 1), "messages still arrive in quiet hours")
+	assert.Equal(t, []bool{false}, dnd(other, 1))
+
+	clock.Advance(9 * time.Hour)
+	send("at noon")
+	assert.Equal(t, []bool{true, false}, dnd(quiet, 2))
+}
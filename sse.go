@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sseKeepAliveInterval keeps proxies from closing an event stream that has
+// been quiet for a while.
+const sseKeepAliveInterval = 25 * time.Second
+
+// sseKeepAlive is queued on an event stream to write a comment line.
+type sseKeepAlive struct{}
+
+// sseTransport writes a client's events to a text/event-stream response.
+type sseTransport struct {
+	w          io.Writer
+	flusher    http.Flusher
+	remoteAddr string
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newSSETransport(w http.ResponseWriter, flusher http.Flusher, remoteAddr string) *sseTransport {
+	return &sseTransport{w: w, flusher: flusher, remoteAddr: remoteAddr, done: make(chan struct{})}
+}
+
+func (t *sseTransport) describe() transportInfo {
+	return transportInfo{remoteAddr: t.remoteAddr, protocol: "sse", codec: "json"}
+}
+
+// write sends v as one event. Its name is the "type" of the JSON payload,
+// or "message"; messages carry their ID so that a reconnecting EventSource
+// reports it in Last-Event-ID.
+func (t *sseTransport) write(v interface{}) error {
+	if _, ok := v.(sseKeepAlive); ok {
+		return t.flush(": keep-alive\n\n")
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(payload, &envelope)
+	if envelope.Type == "" {
+		envelope.Type = "message"
+	}
+
+	var event strings.Builder
+	if msg, ok := v.(Message); ok && msg.ID != 0 {
+		fmt.Fprintf(&event, "id: %d\n", msg.ID)
+	}
+	// json.Marshal never emits a newline, so the payload fits one data line.
+	fmt.Fprintf(&event, "event: %s\ndata: %s\n\n", envelope.Type, payload)
+	return t.flush(event.String())
+}
+
+func (t *sseTransport) flush(s string) error {
+	if _, err := io.WriteString(t.w, s); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// shutdown ends the stream. Event streams have no close frame, so the
+// reason is lost.
+func (t *sseTransport) shutdown(int, string) {
+	t.abort()
+}
+
+func (t *sseTransport) abort() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// streamEvents delivers the caller's events as Server-Sent Events, for
+// clients whose network breaks WebSockets. The stream is receive only:
+// messages are sent with POST /messages. An EventSource that reconnects
+// with Last-Event-ID gets the messages it missed first.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.streamEvents")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", claims.UserID))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Streaming unsupported")
+		return
+	}
+	lastID, resume, err := parseResumeParam(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid Last-Event-ID")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	announcements, err := pendingAnnouncements(ctx)
+	if err != nil {
+		logger(ctx).Println("Failed to look up announcements:", err)
+	}
+	stream := newSSETransport(w, flusher, r.RemoteAddr)
+	c := registry.RegisterSession(strconv.Itoa(claims.UserID), claims.ID, stream, resume)
+	c.logger = logger(ctx)
+	if resume {
+		resumeClient(ctx, c, claims.UserID, lastID)
+	}
+	watchUserRooms(ctx, c.userID)
+	if err := deliverInbox(ctx, c); err != nil {
+		logger(ctx).Println("Failed to deliver queued events:", err)
+	}
+	if err := deliverAnnouncements(ctx, c, announcements); err != nil {
+		logger(ctx).Println("Failed to deliver announcements:", err)
+	}
+
+	go func() {
+		defer func() {
+			registry.Deregister(c)
+			c.close()
+		}()
+		keepAlive := time.NewTicker(sseKeepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-keepAlive.C:
+				c.tryEnqueue(sseKeepAlive{})
+			case <-r.Context().Done():
+				return
+			case <-stream.done:
+				return
+			}
+		}
+	}()
+	// The pump returns once the client is closed, and the response must
+	// not be written to after this handler returns.
+	c.writePump()
+}
+
+// acceptsEventStream reports whether r comes from an EventSource.
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
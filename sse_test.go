@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushRecorder is a ResponseWriter whose body can be read while the
+// handler is still running. Writes only show up in it once flushed.
+type flushRecorder struct {
+	header http.Header
+
+	mu      sync.Mutex
+	code    int
+	pending bytes.Buffer
+	body    bytes.Buffer
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{header: make(http.Header)}
+}
+
+func (r *flushRecorder) Header() http.Header { return r.header }
+
+func (r *flushRecorder) WriteHeader(code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.code = code
+}
+
+func (r *flushRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pending.Write(p)
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending.WriteTo(&r.body)
+}
+
+// waitForEvents returns the events flushed so far once there are n.
+func (r *flushRecorder) waitForEvents(t *testing.T, n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		events := strings.SplitAfter(r.body.String(), "\n\n")
+		r.mu.Unlock()
+		if events = events[:len(events)-1]; len(events) >= n {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d events", n)
+	return nil
+}
+
+// openEventStream runs streamEvents until the test ends.
+func openEventStream(t *testing.T, req *http.Request) *flushRecorder {
+	ctx, cancel := context.WithCancel(req.Context())
+	rec := newFlushRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		requireAuth(streamEvents)(rec, req.WithContext(ctx))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return rec
+}
+
+// mailboxStore answers the replay query with the messages it holds.
+type mailboxStore struct {
+	messages []Message
+}
+
+func (s *mailboxStore) Connect(context.Context) (driver.Conn, error) {
+	return mailboxConn{store: s}, nil
+}
+
+func (s *mailboxStore) Driver() driver.Driver { return nil }
+
+type mailboxConn struct {
+	fakeConn
+	store *mailboxStore
+}
+
+func (c mailboxConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	recipientID, lastID := args[0].Value.(int64), args[1].Value.(int64)
+	rows := &mailboxRows{}
+	for _, msg := range c.store.messages {
+		if int64(msg.RecipientID) == recipientID && int64(msg.ID) > lastID {
+			rows.messages = append(rows.messages, msg)
+		}
+	}
+	return rows, nil
+}
+
+type mailboxRows struct {
+	messages []Message
+}
+
+func (r *mailboxRows) Columns() []string {
+	return []string{"message_id", "seq", "sender_id", "receiver_id", "text", "expires_at", "created_at", "updated_at"}
+}
+func (r *mailboxRows) Close() error { return nil }
+
+func (r *mailboxRows) Next(dest []driver.Value) error {
+	if len(r.messages) == 0 {
+		return io.EOF
+	}
+	msg := r.messages[0]
+	dest[0], dest[1], dest[2], dest[3] = int64(msg.ID), int64(msg.ID), int64(msg.SenderID), int64(msg.RecipientID)
+	dest[4], dest[5], dest[6], dest[7] = msg.Text, nil, insertedAt, insertedAt
+	if msg.ExpiresAt != nil {
+		dest[5] = *msg.ExpiresAt
+	}
+	r.messages = r.messages[1:]
+	return nil
+}
+
+// parseEvent splits an event into its fields and decodes its data.
+func parseEvent(t *testing.T, event string, data interface{}) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(event, "\n\n"), "\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Fatalf("malformed event line %q", line)
+		}
+		fields[name] = value
+	}
+	if err := json.Unmarshal([]byte(fields["data"]), data); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestStreamEventsFraming(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+
+	rec := openEventStream(t, authedRequest(t, 1101, "GET", "/events", nil))
+	waitForClients(t, 1)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	registry.Send("1101", Message{ID: 7, SenderID: 1102, RecipientID: 1101, Text: "hi\nthere"})
+	registry.Send("1101", SystemEvent{Type: "system", Text: "maintenance"})
+	events := rec.waitForEvents(t, 2)
+
+	var msg Message
+	fields := parseEvent(t, events[0], &msg)
+	assert.Equal(t, map[string]string{"id": "7", "event": "message", "data": fields["data"]}, fields)
+	assert.Equal(t, "hi\nthere", msg.Text)
+
+	var system SystemEvent
+	fields = parseEvent(t, events[1], &system)
+	assert.Equal(t, "system", fields["event"])
+	assert.NotContains(t, fields, "id", "only messages carry an ID")
+	assert.Equal(t, "maintenance", system.Text)
+}
+
+func TestStreamEventsReplaysOnReconnect(t *testing.T) {
+	initRedis(t)
+	db = sql.OpenDB(&mailboxStore{messages: []Message{
+		{ID: 5, SenderID: 1202, RecipientID: 1201, Text: "seen"},
+		{ID: 6, SenderID: 1202, RecipientID: 1201, Text: "missed"},
+		{ID: 7, SenderID: 1201, RecipientID: 1202, Text: "sent by me"},
+		{ID: 8, SenderID: 1202, RecipientID: 1201, Text: "missed too"},
+	}})
+	t.Cleanup(func() { db.Close() })
+
+	// EventSource cannot set headers, so it passes the token in the URL.
+	token, err := createSession(context.Background(), 1201, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/events?token="+token, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "5")
+	rec := openEventStream(t, req)
+	waitForClients(t, 1)
+
+	registry.Send("1201", Message{ID: 9, SenderID: 1202, RecipientID: 1201, Text: "live"})
+	events := rec.waitForEvents(t, 4)
+
+	var ids []string
+	for _, event := range events {
+		var data map[string]interface{}
+		fields := parseEvent(t, event, &data)
+		ids = append(ids, fields["event"]+":"+fields["id"])
+	}
+	assert.Equal(t, []string{"message:6", "message:8", "resume_complete:", "message:9"}, ids)
+
+	var complete ResumeCompleteEvent
+	parseEvent(t, events[2], &complete)
+	assert.Equal(t, ResumeCompleteEvent{Type: "resume_complete", Replayed: 2, LastMessageID: 8}, complete)
+}
+
+func TestStreamEventsRejectsBadLastEventID(t *testing.T) {
+	initRedis(t)
+
+	req := authedRequest(t, 1301, "GET", "/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	rr := httptest.NewRecorder()
+	requireAuth(streamEvents)(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
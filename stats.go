@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+
+	// topRoomsLimit is how many of the busiest rooms GET /admin/stats lists.
+	topRoomsLimit = 10
+	// dbAggregatesTTL is how long the counts of users and messages are
+	// served from Redis before Postgres is asked again.
+	dbAggregatesTTL = time.Minute
+
+	dbAggregatesKey = "stats:db"
+	topRoomsKey     = "stats:rooms:top"
+)
+
+var (
+	startTime = time.Now()
+
+	// messagesSent counts chat messages accepted from senders over REST
+	// or WebSocket; messagesDelivered counts those handed to a recipient's
+	// connection.
+	messagesSent      atomic.Int64
+	messagesDelivered atomic.Int64
+)
+
+type backendHealth struct {
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type serverStats struct {
+	UptimeSeconds      float64          `json:"uptime_seconds"`
+	Connections        int              `json:"connections"`
+	ConnectionsPerUser map[string]int   `json:"connections_per_user"`
+	MessagesSent       int64            `json:"messages_sent"`
+	MessagesDelivered  int64            `json:"messages_delivered"`
+	MessagesLastHour   int64            `json:"messages_last_hour"`
+	TopRooms           []roomActivity   `json:"top_rooms"`
+	SlowConnections    []slowConnection `json:"slow_connections"`
+	Redis              backendHealth    `json:"redis"`
+	RedisMemory        *redisMemory     `json:"redis_memory,omitempty"`
+	Postgres           backendHealth    `json:"postgres"`
+	DBPool             dbPoolStats      `json:"db_pool"`
+	dbAggregates
+}
+
+// dbAggregates are the counts that need a scan of Postgres tables.
+type dbAggregates struct {
+	TotalUsers    int64 `json:"total_users"`
+	TotalMessages int64 `json:"total_messages"`
+}
+
+// roomActivity is how many messages were sent to a room in the last day.
+type roomActivity struct {
+	RoomID   int   `json:"room_id"`
+	Messages int64 `json:"messages"`
+}
+
+type redisMemory struct {
+	UsedBytes int64 `json:"used_bytes"`
+	PeakBytes int64 `json:"peak_bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+type dbPoolStats struct {
+	MaxOpen   int     `json:"max_open"`
+	Open      int     `json:"open"`
+	InUse     int     `json:"in_use"`
+	Idle      int     `json:"idle"`
+	WaitCount int64   `json:"wait_count"`
+	WaitMs    float64 `json:"wait_ms"`
+}
+
+// slowConnection is a connection that has had events dropped because its
+// send queue was full.
+type slowConnection struct {
+	UserID  string `json:"user_id"`
+	Queued  int    `json:"queued"`
+	Dropped int64  `json:"dropped"`
+}
+
+// messageCountKey counts the messages sent in the minute that contains at.
+func messageCountKey(at time.Time) string {
+	return fmt.Sprintf("stats:messages:%d", at.Unix()/60)
+}
+
+// roomActivityKey ranks rooms by the messages sent to them in the hour that
+// contains at.
+func roomActivityKey(at time.Time) string {
+	return fmt.Sprintf("stats:rooms:%d", at.Unix()/3600)
+}
+
+// countSentMessage bumps the counters behind GET /admin/stats for a message
+// accepted from its sender.
+func countSentMessage(ctx context.Context, msg Message, now time.Time) {
+	messagesSent.Add(1)
+
+	pipe := redisCli.Pipeline()
+	key := messageCountKey(now)
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, time.Hour+time.Minute)
+	if msg.RoomID != 0 {
+		key := roomActivityKey(now)
+		pipe.ZIncrBy(ctx, key, 1, strconv.Itoa(msg.RoomID))
+		pipe.Expire(ctx, key, 25*time.Hour)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to count message:", err)
+	}
+}
+
+// messagesInLastHour sums the per-minute counts of the hour up to now.
+func messagesInLastHour(ctx context.Context, now time.Time) (int64, error) {
+	keys := make([]string, 60)
+	for i := range keys {
+		keys[i] = messageCountKey(now.Add(-time.Duration(i) * time.Minute))
+	}
+	values, err := redisCli.MGet(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			n, _ := strconv.ParseInt(s, 10, 64)
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// topRooms returns the rooms with the most messages over the last 24 hours,
+// counted by the hour, busiest first.
+func topRooms(ctx context.Context, now time.Time) ([]roomActivity, error) {
+	keys := make([]string, 24)
+	for i := range keys {
+		keys[i] = roomActivityKey(now.Add(-time.Duration(i) * time.Hour))
+	}
+	pipe := redisCli.TxPipeline()
+	pipe.ZUnionStore(ctx, topRoomsKey, &redis.ZStore{Keys: keys})
+	top := pipe.ZRevRangeWithScores(ctx, topRoomsKey, 0, topRoomsLimit-1)
+	pipe.Del(ctx, topRoomsKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	rooms := make([]roomActivity, 0, topRoomsLimit)
+	for _, z := range top.Val() {
+		id, err := strconv.Atoi(fmt.Sprint(z.Member))
+		if err != nil {
+			continue
+		}
+		rooms = append(rooms, roomActivity{RoomID: id, Messages: int64(z.Score)})
+	}
+	// Rooms with as many messages are listed by ID so the order is stable.
+	sort.SliceStable(rooms, func(i, j int) bool {
+		return rooms[i].Messages > rooms[j].Messages ||
+			rooms[i].Messages == rooms[j].Messages && rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms, nil
+}
+
+// loadDBAggregates counts the users and messages, from Redis if they were
+// counted in the last minute.
+func loadDBAggregates(ctx context.Context) (dbAggregates, error) {
+	var aggregates dbAggregates
+	cached, err := redisCli.Get(ctx, dbAggregatesKey).Bytes()
+	if err == nil && json.Unmarshal(cached, &aggregates) == nil {
+		return aggregates, nil
+	} else if err != nil && err != redis.Nil {
+		logger(ctx).Println("Failed to read cached stats:", err)
+	}
+
+	err = db.QueryRowContext(ctx,
+		"SELECT (SELECT COUNT(*) FROM users WHERE deleted_at IS NULL), (SELECT COUNT(*) FROM messages)").
+		Scan(&aggregates.TotalUsers, &aggregates.TotalMessages)
+	if err != nil {
+		return aggregates, err
+	}
+	body, _ := json.Marshal(aggregates)
+	if err := redisCli.Set(ctx, dbAggregatesKey, body, dbAggregatesTTL).Err(); err != nil {
+		logger(ctx).Println("Failed to cache stats:", err)
+	}
+	return aggregates, nil
+}
+
+// parseRedisMemory reads the memory section of INFO.
+func parseRedisMemory(info string) redisMemory {
+	var memory redisMemory
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch name {
+		case "used_memory":
+			memory.UsedBytes = n
+		case "used_memory_peak":
+			memory.PeakBytes = n
+		case "maxmemory":
+			memory.MaxBytes = n
+		}
+	}
+	return memory
+}
+
+func checkHealth(ctx context.Context, ping func(context.Context) error) backendHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := ping(ctx)
+	health := backendHealth{OK: err == nil, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+func getStats(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.getStats")
+	defer span.End()
+
+	now := time.Now()
+	stats := serverStats{
+		UptimeSeconds:      time.Since(startTime).Seconds(),
+		ConnectionsPerUser: make(map[string]int),
+		MessagesSent:       messagesSent.Load(),
+		MessagesDelivered:  messagesDelivered.Load(),
+		TopRooms:           []roomActivity{},
+		SlowConnections:    []slowConnection{},
+	}
+
+	registry.Range(func(userID string, clients []*client) bool {
+		stats.ConnectionsPerUser[userID] = len(clients)
+		stats.Connections += len(clients)
+		for _, c := range clients {
+			if dropped := c.dropped.Load(); dropped > 0 {
+				stats.SlowConnections = append(stats.SlowConnections, slowConnection{UserID: userID, Queued: len(c.send), Dropped: dropped})
+			}
+		}
+		return true
+	})
+
+	stats.Redis = checkHealth(ctx, func(ctx context.Context) error {
+		return redisCli.Ping(ctx).Err()
+	})
+	stats.Postgres = checkHealth(ctx, db.PingContext)
+
+	var err error
+	if stats.MessagesLastHour, err = messagesInLastHour(ctx, now); err != nil {
+		logger(ctx).Println("Failed to count recent messages:", err)
+	}
+	if rooms, err := topRooms(ctx, now); err != nil {
+		logger(ctx).Println("Failed to rank rooms:", err)
+	} else {
+		stats.TopRooms = rooms
+	}
+	if info, err := redisCli.Info(ctx, "memory").Result(); err != nil {
+		logger(ctx).Println("Failed to read Redis memory:", err)
+	} else {
+		memory := parseRedisMemory(info)
+		stats.RedisMemory = &memory
+	}
+	if stats.dbAggregates, err = loadDBAggregates(ctx); err != nil {
+		logger(ctx).Println("Failed to count users and messages:", err)
+	}
+
+	pool := db.Stats()
+	stats.DBPool = dbPoolStats{
+		MaxOpen:   pool.MaxOpenConnections,
+		Open:      pool.OpenConnections,
+		InUse:     pool.InUse,
+		Idle:      pool.Idle,
+		WaitCount: pool.WaitCount,
+		WaitMs:    float64(pool.WaitDuration.Microseconds()) / 1000,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
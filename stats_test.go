@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fetchStats(t *testing.T) serverStats {
+	rr := httptest.NewRecorder()
+	getStats(rr, httptest.NewRequest("GET", "/admin/stats", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var stats serverStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStatsCountersMove(t *testing.T) {
+	initRedis(t)
+	healthy := &atomic.Bool{}
+	healthy.Store(true)
+	db = sql.OpenDB(breakerConnector{Connector: fakeConnector{healthy: healthy}, cb: newBreaker("postgres", time.Minute)})
+	defer db.Close()
+
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 301)
+	recipient := dialTestUser(t, server, 302)
+	waitForClients(t, 2)
+
+	before := fetchStats(t)
+	assert.Equal(t, 2, before.Connections)
+	assert.Equal(t, 1, before.ConnectionsPerUser[strconv.Itoa(301)])
+	assert.True(t, before.Redis.OK)
+	assert.True(t, before.Postgres.OK)
+
+	for i := 0; i < 3; i++ {
+		if err := sender.WriteJSON(Message{SenderID: 301, RecipientID: 302, Text: "ping"}); err != nil {
+			t.Fatal(err)
+		}
+		recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg Message
+		if err := recipient.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The counters are bumped after the frame is queued, so the recipient
+	// can see the last message a moment before they move.
+	assert.Eventually(t, func() bool {
+		after := fetchStats(t)
+		return after.MessagesSent == before.MessagesSent+3 &&
+			after.MessagesDelivered == before.MessagesDelivered+3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Greater(t, fetchStats(t).UptimeSeconds, 0.0)
+}
+
+// countStore answers the users and messages counts of GET /admin/stats and
+// records how often it was asked.
+type countStore struct {
+	queries atomic.Int32
+}
+
+func (s *countStore) Connect(context.Context) (driver.Conn, error) {
+	return countConn{store: s}, nil
+}
+
+func (s *countStore) Driver() driver.Driver { return nil }
+
+type countConn struct {
+	fakeConn
+	store *countStore
+}
+
+func (c countConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT (SELECT COUNT(*) FROM users") {
+		return nil, errors.New("not supported")
+	}
+	c.store.queries.Add(1)
+	return &countRows{}, nil
+}
+
+type countRows struct {
+	done bool
+}
+
+func (r *countRows) Columns() []string { return []string{"users", "messages"} }
+func (r *countRows) Close() error      { return nil }
+
+func (r *countRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], dest[1] = int64(42), int64(1234)
+	r.done = true
+	return nil
+}
+
+func TestStatsSlidingWindows(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	countSentMessage(ctx, Message{SenderID: 1, RecipientID: 2}, start)
+	for i := 0; i < 3; i++ {
+		countSentMessage(ctx, Message{SenderID: 1, RoomID: 8}, start.Add(30*time.Minute))
+	}
+	countSentMessage(ctx, Message{SenderID: 1, RoomID: 9}, start.Add(61*time.Minute))
+	countSentMessage(ctx, Message{SenderID: 1, RoomID: 9}, start.Add(20*time.Hour))
+	countSentMessage(ctx, Message{SenderID: 1, RoomID: 10}, start.Add(20*time.Hour))
+
+	n, err := messagesInLastHour(ctx, start.Add(61*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n, "the message of the first minute has left the window")
+
+	rooms, err := topRooms(ctx, start.Add(20*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []roomActivity{{RoomID: 8, Messages: 3}, {RoomID: 9, Messages: 2}, {RoomID: 10, Messages: 1}}, rooms)
+
+	rooms, err = topRooms(ctx, start.Add(25*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []roomActivity{{RoomID: 9, Messages: 1}, {RoomID: 10, Messages: 1}}, rooms)
+}
+
+func TestStatsStructure(t *testing.T) {
+	initRedis(t)
+	store := &countStore{}
+	db = sql.OpenDB(store)
+	defer db.Close()
+
+	server := newTestServer(t, newRouter())
+
+	rr := httptest.NewRecorder()
+	server.Config.Handler.ServeHTTP(rr, authedRequest(t, 311, "GET", "/admin/stats", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code, "only admins see the stats")
+
+	first := dialTestUser(t, server, 311)
+	dialTestUser(t, server, 311)
+	dialTestUser(t, server, 312)
+	waitForClients(t, 3)
+
+	var body map[string]interface{}
+	rr = httptest.NewRecorder()
+	getStats(rr, httptest.NewRequest("GET", "/admin/stats", nil))
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"uptime_seconds", "connections", "connections_per_user", "messages_sent",
+		"messages_delivered", "messages_last_hour", "top_rooms", "slow_connections", "redis", "postgres",
+		"db_pool", "total_users", "total_messages"} {
+		assert.Contains(t, body, field)
+	}
+
+	stats := fetchStats(t)
+	assert.Equal(t, registry.Count(), stats.Connections)
+	assert.Equal(t, 3, stats.Connections)
+	assert.Equal(t, map[string]int{"311": 2, "312": 1}, stats.ConnectionsPerUser)
+	assert.Equal(t, int64(42), stats.TotalUsers)
+	assert.Equal(t, int64(1234), stats.TotalMessages)
+	assert.Equal(t, int32(1), store.queries.Load(), "the counts are served from Redis for a minute")
+
+	first.Close()
+	assert.Eventually(t, func() bool {
+		return fetchStats(t).Connections == 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestParseRedisMemory(t *testing.T) {
+	t.Parallel()
+	info := "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\nused_memory_peak:2097152\r\nmaxmemory:0\r\n"
+	assert.Equal(t, redisMemory{UsedBytes: 1048576, PeakBytes: 2097152}, parseRedisMemory(info))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	availabilityAvailable = "available"
+	availabilityBusy      = "busy"
+	availabilityAway      = "away"
+
+	maxStatusRunes   = 100
+	maxStatusMinutes = 30 * 24 * 60
+)
+
+// statusClock decides whether a status has expired.
+var statusClock Clock = realClock{}
+
+// UserStatus is what a user says about their availability. ExpiresAt is nil
+// for a status that stays until it is changed.
+type UserStatus struct {
+	Text         string     `json:"status_text,omitempty"`
+	Availability string     `json:"availability"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// StatusEvent tells a user's contacts that their status changed. A cleared
+// status is sent as available with no text.
+type StatusEvent struct {
+	Type   string     `json:"type"`
+	UserID int        `json:"user_id"`
+	Status UserStatus `json:"status"`
+}
+
+type statusRequest struct {
+	Text            string `json:"status_text"`
+	Availability    string `json:"availability"`
+	DurationMinutes int    `json:"duration_minutes"`
+}
+
+// activeStatus returns s, or nil if it has expired at now.
+func activeStatus(s *UserStatus, now time.Time) *UserStatus {
+	if s == nil || s.ExpiresAt != nil && !now.Before(*s.ExpiresAt) {
+		return nil
+	}
+	return s
+}
+
+// expireStatuses drops the expired statuses from the profiles.
+func expireStatuses(users map[int]User) {
+	now := statusClock.Now()
+	for id, user := range users {
+		if user.Status != nil {
+			user.Status = activeStatus(user.Status, now)
+			users[id] = user
+		}
+	}
+}
+
+// statusContacts returns the IDs of the user's accepted contacts.
+func statusContacts(ctx context.Context, userID int) ([]string, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT CASE WHEN requester_id = $1 THEN addressee_id ELSE requester_id END FROM contacts
+		WHERE (requester_id = $1 OR addressee_id = $1) AND status = 'accepted'`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return ids, rows.Err()
+}
+
+// updateStatus sets the status of the user in the path and tells their
+// contacts who are online. With duration_minutes the status clears itself
+// after that long; being available with no text clears it now.
+func updateStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.updateStatus")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	if !canAccessUser(claimsFromContext(ctx), userID) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var req statusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	status := UserStatus{Text: strings.TrimSpace(req.Text), Availability: req.Availability}
+	if status.Availability == "" {
+		status.Availability = availabilityAvailable
+	}
+	switch {
+	case status.Availability != availabilityAvailable && status.Availability != availabilityBusy && status.Availability != availabilityAway:
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, `availability must be "available", "busy" or "away"`)
+		return
+	case utf8.RuneCountInString(status.Text) > maxStatusRunes:
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("status_text must be at most %d characters", maxStatusRunes))
+		return
+	case req.DurationMinutes < 0 || req.DurationMinutes > maxStatusMinutes:
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("duration_minutes must be between 0 and %d", maxStatusMinutes))
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID), attribute.String("chat.availability", status.Availability))
+
+	var text, availability sql.NullString
+	cleared := status.Availability == availabilityAvailable && status.Text == ""
+	if !cleared {
+		text = sql.NullString{String: status.Text, Valid: status.Text != ""}
+		availability = sql.NullString{String: status.Availability, Valid: true}
+		if req.DurationMinutes > 0 {
+			expires := statusClock.Now().Add(time.Duration(req.DurationMinutes) * time.Minute).UTC()
+			status.ExpiresAt = &expires
+		}
+	}
+	res, err := db.ExecContext(ctx,
+		`UPDATE users SET status_text = $2, availability = $3, status_expires_at = $4, updated_at = NOW()
+		WHERE user_id = $1 AND deleted_at IS NULL`, userID, text, availability, status.ExpiresAt)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		WriteError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err := redisCli.Del(ctx, userCacheKey(userID)).Err(); err != nil {
+		logger(ctx).Println("Failed to invalidate cached user:", err)
+	}
+
+	if contacts, err := statusContacts(ctx, userID); err != nil {
+		logger(ctx).Println("Failed to look up contacts for status:", err)
+	} else {
+		registry.BroadcastToMany(contacts, StatusEvent{Type: "status", UserID: userID, Status: status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
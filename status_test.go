@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// statusStore records status updates and knows the contacts of one user.
+type statusStore struct {
+	contacts []int64
+
+	mu      sync.Mutex
+	updates [][]driver.Value
+}
+
+func (s *statusStore) Connect(context.Context) (driver.Conn, error) {
+	return statusConn{store: s}, nil
+}
+
+func (s *statusStore) Driver() driver.Driver { return nil }
+
+type statusConn struct {
+	fakeConn
+	store *statusStore
+}
+
+func (c statusConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT CASE WHEN requester_id") {
+		return nil, errors.New("not supported")
+	}
+	rows := &tableRows{columns: []string{"user_id"}}
+	for _, id := range c.store.contacts {
+		rows.rows = append(rows.rows, []driver.Value{id})
+	}
+	return rows, nil
+}
+
+func (c statusConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "UPDATE users SET status_text") {
+		return nil, errors.New("not supported")
+	}
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var update []driver.Value
+	for _, arg := range args {
+		update = append(update, arg.Value)
+	}
+	s.updates = append(s.updates, update)
+	return driver.RowsAffected(1), nil
+}
+
+func useStatusClock(t *testing.T, clock Clock) {
+	previous := statusClock
+	statusClock = clock
+	t.Cleanup(func() { statusClock = previous })
+}
+
+func (t *recordingTransport) statusEvents() []StatusEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []StatusEvent
+	for _, v := range t.written {
+		if e, ok := v.(StatusEvent); ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestStatusExpires(t *testing.T) {
+	initRedis(t)
+	clock := newFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC))
+	useStatusClock(t, clock)
+	expires := clock.Now().Add(30 * time.Minute)
+	status := &UserStatus{Text: "In a meeting", Availability: availabilityBusy, ExpiresAt: &expires}
+	initUserStore(t, User{ID: 7, Username: "vishnu", Status: status})
+
+	rr, user := getUserRequest(7)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, status, user.Status)
+
+	clock.Advance(30 * time.Minute)
+	_, user = getUserRequest(7)
+	assert.Nil(t, user.Status, "the cached status expired")
+	users, err := loadUsers(context.Background(), []int{7})
+	assert.NoError(t, err)
+	assert.Nil(t, users[7].Status)
+}
+
+func TestUpdateStatusReachesContacts(t *testing.T) {
+	initRedis(t)
+	store := &statusStore{contacts: []int64{902}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	clock := newFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC))
+	useStatusClock(t, clock)
+	contact, _ := connectRecorder(t, "902")
+	stranger, _ := connectRecorder(t, "903")
+	router := newRouter()
+	serve := func(userID int, body interface{}) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, authedRequest(t, userID, "PUT", "/users/901/status", body))
+		return rr
+	}
+
+	rr := serve(901, statusRequest{Text: " In a meeting ", Availability: availabilityBusy, DurationMinutes: 60})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	expires := clock.Now().Add(time.Hour)
+	want := UserStatus{Text: "In a meeting", Availability: availabilityBusy, ExpiresAt: &expires}
+	var got UserStatus
+	json.NewDecoder(rr.Body).Decode(&got)
+	assert.Equal(t, want, got)
+
+	assert.Eventually(t, func() bool { return len(contact.statusEvents()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, StatusEvent{Type: "status", UserID: 901, Status: want}, contact.statusEvents()[0])
+	assert.Empty(t, stranger.statusEvents(), "only contacts hear of the status")
+
+	assert.Equal(t, http.StatusOK, serve(901, statusRequest{}).Code)
+	assert.Eventually(t, func() bool { return len(contact.statusEvents()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, UserStatus{Availability: availabilityAvailable}, contact.statusEvents()[1].Status)
+	store.mu.Lock()
+	assert.Equal(t, []driver.Value{int64(901), nil, nil, nil}, store.updates[1], "being available with no text clears the status")
+	store.mu.Unlock()
+
+	for _, req := range []statusRequest{
+		{Availability: "asleep"},
+		{Text: strings.Repeat("z", maxStatusRunes+1)},
+		{Availability: availabilityAway, DurationMinutes: -1},
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, serve(901, req).Code, req)
+	}
+	assert.Equal(t, http.StatusForbidden, serve(902, statusRequest{Availability: availabilityAway}).Code)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MessageKindSystem is the Kind of the messages the server posts to a room
+// when its members or settings change.
+const MessageKindSystem = "system"
+
+// roomMessageKind is the Kind of a room message stored with the given
+// kind. Messages users send are stored as 'text' and have none.
+func roomMessageKind(kind string) string {
+	if kind == "text" {
+		return ""
+	}
+	return kind
+}
+
+// roleTitles name a role in a system message.
+var roleTitles = map[string]string{RoomOwner: "the owner", RoomAdmin: "an admin", RoomMember: "a member"}
+
+// usernames returns the names of the given users.
+func usernames(ctx context.Context, userIDs ...int) (map[int]string, error) {
+	ids := make([]int64, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT user_id, username FROM users WHERE user_id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make(map[int]string, len(userIDs))
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// announceRoomChange stores a system message telling what the actor changed
+// in the room and delivers it to the room's members. format is given the
+// actor's name, the name of the member the change is about, if any, and
+// then args. The change has been made already, so failures are only
+// logged.
+func announceRoomChange(ctx context.Context, roomID, actorID, userID int, format string, args ...interface{}) {
+	names, err := usernames(ctx, actorID, userID)
+	if err != nil {
+		logger(ctx).Println("Failed to look up names for system message:", err)
+		return
+	}
+	msg := Message{
+		SenderID: actorID,
+		RoomID:   roomID,
+		Text:     fmt.Sprintf(format, append([]interface{}{names[actorID], names[userID]}, args...)...),
+		Kind:     MessageKindSystem,
+	}
+
+	var subject *int
+	if userID != 0 {
+		subject = &userID
+	}
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO room_messages (room_id, kind, sender_id, user_id, text) VALUES ($1, $2, $3, $4, $5) RETURNING message_id, created_at",
+		roomID, msg.Kind, actorID, subject, msg.Text).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		logger(ctx).Println("Failed to store system message:", err)
+		msg.CreatedAt = time.Now()
+	}
+	msg.CreatedAt = msg.CreatedAt.UTC()
+	msg.UpdatedAt = msg.CreatedAt
+	recordRoomActivity(ctx, msg, msg.CreatedAt)
+
+	if err := cacheRecentMessage(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to cache system message:", err)
+	}
+	members, err := roomMembers(ctx, roomID)
+	if err != nil {
+		logger(ctx).Println("Failed to look up room members:", err)
+		return
+	}
+	others := make([]string, 0, len(members))
+	for _, id := range members {
+		if id != strconv.Itoa(actorID) {
+			others = append(others, id)
+		}
+	}
+	countUnread(ctx, msg, others)
+	if err := conversationOf(msg).Broadcast(ctx, msg); err != nil {
+		logger(ctx).Println("Failed to send system message:", err)
+	}
+}
+
+// listRoomMessages returns a page of the room's stored messages, newest
+// first: those its members sent that have not expired, and the record of
+// who joined, left and changed the room.
+func listRoomMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listRoomMessages")
+	defer span.End()
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid room id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.room_id", roomID))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	if claims.Role != RoleAdmin {
+		if err := checkRoomMember(ctx, roomID, claims.UserID); err == errNotRoomMember {
+			WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultHistoryLimit, maxHistoryLimit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(query)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT message_id, kind, sender_id, text, created_at FROM room_messages
+		WHERE room_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+		AND ($3::int IS NULL OR (created_at, message_id) < (SELECT created_at, message_id FROM room_messages WHERE message_id = $3))
+		ORDER BY created_at DESC, message_id DESC
+		LIMIT $2`, roomID, limit+1, cursor)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg := Message{RoomID: roomID}
+		if err := rows.Scan(&msg.ID, &msg.Kind, &msg.SenderID, &msg.Text, &msg.CreatedAt); err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		msg.Kind = roomMessageKind(msg.Kind)
+		msg.UpdatedAt = msg.CreatedAt
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	total, err := countTotal(ctx, fmt.Sprintf("room_messages:%d", roomID),
+		`SELECT COUNT(*) FROM room_messages
+		WHERE room_id = $1 AND (expires_at IS NULL OR expires_at > NOW())`, roomID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, newPage(messages, limit, total, func(msg Message) int { return msg.ID }))
+}
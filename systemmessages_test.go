@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// systemStore is a roleStore that also names users "user{id}" and keeps the
+// text of the system messages stored, which it lists newest first.
+type systemStore struct {
+	*roleStore
+
+	mu     sync.Mutex
+	texts  []string
+	nextID int64
+}
+
+func (s *systemStore) Connect(context.Context) (driver.Conn, error) {
+	return systemConn{roleConn: roleConn{store: s.roleStore}, store: s}, nil
+}
+
+type systemConn struct {
+	roleConn
+	store *systemStore
+}
+
+func (c systemConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT user_id, username FROM users"):
+		return &usernameRows{ids: args[0].Value.([]int64)}, nil
+	case strings.HasPrefix(query, "INSERT INTO room_messages"):
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.texts = append(c.store.texts, args[4].Value.(string))
+		c.store.nextID++
+		return &insertedRows{id: c.store.nextID}, nil
+	case strings.HasPrefix(query, "SELECT message_id, kind, sender_id, text, created_at FROM room_messages"):
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		limit := int(args[1].Value.(int64))
+		rows := &tableRows{columns: []string{"message_id", "kind", "sender_id", "text", "created_at"}}
+		for id := len(c.store.texts); id > 0 && len(rows.rows) < limit; id-- {
+			if cursor, ok := args[2].Value.(int64); ok && int64(id) >= cursor {
+				continue
+			}
+			rows.rows = append(rows.rows, []driver.Value{int64(id), MessageKindSystem, int64(1), c.store.texts[id-1], insertedAt})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT COUNT(*) FROM room_messages"):
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		return &valueRows{column: "count", value: int64(len(c.store.texts))}, nil
+	}
+	return c.roleConn.QueryContext(ctx, query, args)
+}
+
+func (systemConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = v
+	}
+	return nil
+}
+
+// insertedRows is the message_id and created_at of an inserted row.
+type insertedRows struct {
+	id   int64
+	done bool
+}
+
+func (r *insertedRows) Columns() []string { return []string{"message_id", "created_at"} }
+func (r *insertedRows) Close() error      { return nil }
+
+func (r *insertedRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.id, insertedAt
+	r.done = true
+	return nil
+}
+
+type usernameRows struct {
+	ids []int64
+}
+
+func (r *usernameRows) Columns() []string { return []string{"user_id", "username"} }
+func (r *usernameRows) Close() error      { return nil }
+
+func (r *usernameRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.ids[0], fmt.Sprintf("user%d", r.ids[0])
+	r.ids = r.ids[1:]
+	return nil
+}
+
+// initSystemStore sets up room 7 as initRoleStore does.
+func initSystemStore(t *testing.T) *systemStore {
+	roles := initRoleStore(t)
+	db.Close()
+	store := &systemStore{roleStore: roles}
+	db = sql.OpenDB(store)
+	return store
+}
+
+// readSystemMessage returns the next system message on the connection,
+// skipping other events.
+func readSystemMessage(t *testing.T, conn *websocket.Conn) Message {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Kind == MessageKindSystem {
+			return msg
+		}
+	}
+}
+
+func TestRoomChangesPostSystemMessages(t *testing.T) {
+	cases := []struct {
+		actor  int
+		method string
+		path   string
+		body   interface{}
+		text   string
+	}{
+		{1, "PATCH", "/rooms/7", updateRoomRequest{Name: stringPtr("lounge")}, "user1 renamed the room to lounge"},
+		{2, "DELETE", "/rooms/7/members/5", nil, "user2 removed user5"},
+		{3, "DELETE", "/rooms/7/members/3", nil, "user3 left the room"},
+		{1, "PUT", "/rooms/7/members/3/role", roomRoleRequest{Role: RoomAdmin}, "user1 made user3 an admin"},
+		{1, "PUT", "/rooms/7/members/2/role", roomRoleRequest{Role: RoomOwner}, "user1 made user2 the owner"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text, func(t *testing.T) {
+			store := initSystemStore(t)
+			server := newTestServer(t, newRouter())
+			member := dialTestUser(t, server, 6)
+			waitForClients(t, 1)
+
+			rr := httptest.NewRecorder()
+			server.Config.Handler.ServeHTTP(rr, authedRequest(t, tc.actor, tc.method, tc.path, tc.body))
+			assert.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+
+			msg := readSystemMessage(t, member)
+			assert.Equal(t, tc.text, msg.Text)
+			assert.Equal(t, tc.actor, msg.SenderID)
+			assert.Equal(t, 7, msg.RoomID)
+			assert.Equal(t, 1, msg.ID)
+			assert.Equal(t, insertedAt, msg.CreatedAt)
+
+			store.mu.Lock()
+			assert.Equal(t, []string{tc.text}, store.texts)
+			store.mu.Unlock()
+
+			recent, err := GetRecentMessages(context.Background(), "room:7", 0, 10)
+			assert.NoError(t, err)
+			if assert.Len(t, recent, 1, "the history has the system message") {
+				assert.Equal(t, MessageKindSystem, recent[0].Kind)
+				assert.Equal(t, tc.text, recent[0].Text)
+			}
+		})
+	}
+}
+
+func TestSystemMessagesNotUnread(t *testing.T) {
+	initSystemStore(t)
+	ctx := context.Background()
+	unread := func(userID int) string {
+		return redisCli.HGet(ctx, unreadKey(fmt.Sprint(userID)), "room:7").Val()
+	}
+
+	countUnread(ctx, Message{SenderID: 1, RoomID: 7, Text: "hi"}, []string{"2", "3"})
+	announceRoomChange(ctx, 7, 1, 0, "%[1]s renamed the room to %[3]s", "lounge")
+	assert.Equal(t, "1", unread(2), "system messages are not unread by default")
+	assert.Equal(t, "1", unread(3))
+
+	defer func(enabled bool) { cfg.SystemMessagesUnread = enabled }(cfg.SystemMessagesUnread)
+	cfg.SystemMessagesUnread = true
+	announceRoomChange(ctx, 7, 1, 0, "%[1]s renamed the room to %[3]s", "den")
+	assert.Equal(t, "2", unread(2))
+	assert.Equal(t, "1", unread(6))
+	assert.Empty(t, unread(1), "the actor has read their own change")
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, 2, "POST", "/conversations/room:7/read", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, unread(2))
+	assert.Equal(t, "2", unread(3))
+}
+
+func TestListRoomMessagesPages(t *testing.T) {
+	store := initSystemStore(t)
+	store.texts = []string{"one", "two", "three"}
+	list := func(userID int, query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, authedRequest(t, userID, "GET", "/rooms/7/messages"+query, nil))
+		return rr
+	}
+
+	var page Page[Message]
+	rr := list(2, "?limit=2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.NewDecoder(rr.Body).Decode(&page)
+	assert.EqualValues(t, 3, page.Total)
+	assert.True(t, page.HasNext)
+	if assert.Len(t, page.Items, 2) && assert.NotNil(t, page.NextCursor) {
+		assert.Equal(t, "three", page.Items[0].Text, "newest first")
+		assert.Equal(t, 7, page.Items[0].RoomID)
+		assert.Equal(t, "2", *page.NextCursor, "the cursor is the last message on the page")
+	}
+
+	page = Page[Message]{}
+	json.NewDecoder(list(2, "?limit=2&cursor=2").Body).Decode(&page)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "one", page.Items[0].Text)
+	}
+	assert.False(t, page.HasNext)
+	assert.Nil(t, page.NextCursor)
+
+	assert.Equal(t, http.StatusBadRequest, list(2, "?cursor=x").Code)
+	assert.Equal(t, http.StatusForbidden, list(4, "").Code, "only members read the room")
+}
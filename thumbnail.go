@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	thumbnailSize = 200
+
+	// maxThumbnailSourcePixels keeps a small file that claims huge
+	// dimensions from being decoded into gigabytes of memory.
+	maxThumbnailSourcePixels = 40_000_000
+)
+
+var errImageTooLarge = errors.New("image is too large to thumbnail")
+
+// hasThumbnail reports whether attachments of contentType get a thumbnail.
+func hasThumbnail(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+func thumbnailKey(objectKey string) string {
+	return objectKey + "_thumb"
+}
+
+// makeThumbnail scales the image in r to thumbnailSize pixels square,
+// cropping the longer side around the centre. It keeps the format of the
+// original so that PNGs keep their transparency, and returns the encoded
+// thumbnail with its content type.
+func makeThumbnail(r io.ReadSeeker) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, "", errImageTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbnailSize, thumbnailSize))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), src, centreSquare(src.Bounds()), draw.Src, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	case "png":
+		err = png.Encode(&buf, thumb)
+		return buf.Bytes(), "image/png", err
+	}
+	return nil, "", fmt.Errorf("cannot thumbnail %s images", format)
+}
+
+// centreSquare returns the largest square in the middle of b.
+func centreSquare(b image.Rectangle) image.Rectangle {
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeTestImage returns a width×height image in format whose left half
+// is red and right half blue.
+func encodeTestImage(t *testing.T, format string, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumbnailDimensions(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		format        string
+		width, height int
+	}{
+		{"jpeg", 800, 400},
+		{"jpeg", 120, 900},
+		{"png", 1000, 1000},
+		{"png", 50, 30},
+	} {
+		thumb, contentType, err := makeThumbnail(bytes.NewReader(encodeTestImage(t, tc.format, tc.width, tc.height)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "image/"+tc.format, contentType)
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.format, format, "the thumbnail keeps the original's format")
+		assert.Equal(t, thumbnailSize, config.Width, "%dx%d", tc.width, tc.height)
+		assert.Equal(t, thumbnailSize, config.Height, "%dx%d", tc.width, tc.height)
+	}
+}
+
+func TestMakeThumbnailCropsCentre(t *testing.T) {
+	t.Parallel()
+	// Cropping a 400x100 image to its centre square keeps both halves.
+	thumb, _, err := makeThumbnail(bytes.NewReader(encodeTestImage(t, "png", 400, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := color.NRGBAModel.Convert(img.At(10, 100)).(color.NRGBA)
+	right := color.NRGBAModel.Convert(img.At(190, 100)).(color.NRGBA)
+	assert.Equal(t, uint8(255), left.R)
+	assert.Equal(t, uint8(255), right.B)
+}
+
+func TestMakeThumbnailRejectsBadInput(t *testing.T) {
+	t.Parallel()
+	_, _, err := makeThumbnail(bytes.NewReader([]byte("GIF89a but not really")))
+	assert.Error(t, err)
+
+	// A valid header claiming 100000x100000 pixels must not be decoded.
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	header := buf.Bytes()
+	header[16], header[17], header[18], header[19] = 0, 1, 0x86, 0xa0
+	header[20], header[21], header[22], header[23] = 0, 1, 0x86, 0xa0
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	_, _, err = makeThumbnail(bytes.NewReader(header))
+	assert.Equal(t, errImageTooLarge, err)
+}
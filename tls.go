@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (t TLSConfig) enabled() bool {
+	return t.AutoTLS || t.CertFile != "" || t.KeyFile != ""
+}
+
+// newServers builds the server for handler. With TLS configured it listens
+// on c.TLSAddr and a second, plain server on c.Addr redirects to it (and
+// answers ACME challenges when certificates come from Let's Encrypt).
+// Without TLS redirect is nil and the app server speaks plain HTTP on c.Addr.
+func newServers(c Config, handler http.Handler) (app, redirect *http.Server, err error) {
+	if !c.TLS.enabled() {
+		log.Println("WARNING: TLS is not configured, serving plain HTTP")
+		return &http.Server{Addr: c.Addr, Handler: handler}, nil, nil
+	}
+
+	var tlsConfig *tls.Config
+	var redirectHandler http.Handler = httpsRedirect(c.TLSAddr)
+	if c.TLS.AutoTLS {
+		if c.TLS.AutoTLSDomain == "" {
+			return nil, nil, errors.New("CHAT_AUTO_TLS_DOMAIN is required with CHAT_AUTO_TLS")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.TLS.AutoTLSDomain),
+			Cache:      autocert.DirCache(c.TLS.AutoTLSCache),
+		}
+		tlsConfig = m.TLSConfig()
+		redirectHandler = m.HTTPHandler(redirectHandler)
+	} else {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	app = &http.Server{Addr: c.TLSAddr, Handler: handler, TLSConfig: tlsConfig}
+	redirect = &http.Server{Addr: c.Addr, Handler: redirectHandler}
+	return app, redirect, nil
+}
+
+// httpsRedirect sends plain HTTP requests to the same host and path on the
+// TLS port.
+func httpsRedirect(tlsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+func serve(srv *http.Server) {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
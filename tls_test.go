@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSelfSignedCert creates a certificate for 127.0.0.1 and returns the
+// paths of the certificate and key files along with a pool trusting it.
+func writeSelfSignedCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLSWithCertificateFiles(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t)
+	c := cfg
+	c.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile}
+
+	app, redirect, err := newServers(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, redirect)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.ServeTLS(ln, "", "")
+	defer app.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "secure", string(body))
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+}
+
+func TestNewServersWithoutTLS(t *testing.T) {
+	c := cfg
+	c.TLS = TLSConfig{}
+
+	app, redirect, err := newServers(c, http.NotFoundHandler())
+
+	assert.NoError(t, err)
+	assert.Nil(t, redirect)
+	assert.Nil(t, app.TLSConfig)
+	assert.Equal(t, c.Addr, app.Addr)
+}
+
+func TestNewServersAutoTLS(t *testing.T) {
+	c := cfg
+	c.TLS = TLSConfig{AutoTLS: true, AutoTLSDomain: "chat.example.com", AutoTLSCache: t.TempDir()}
+
+	app, redirect, err := newServers(c, http.NotFoundHandler())
+
+	assert.NoError(t, err)
+	assert.NotNil(t, app.TLSConfig.GetCertificate)
+	assert.NotNil(t, redirect)
+
+	c.TLS.AutoTLSDomain = ""
+	_, _, err = newServers(c, http.NotFoundHandler())
+	assert.Error(t, err)
+}
+
+func TestNewServersRejectsMissingKey(t *testing.T) {
+	c := cfg
+	c.TLS = TLSConfig{CertFile: "missing.pem", KeyFile: "missing-key.pem"}
+
+	_, _, err := newServers(c, http.NotFoundHandler())
+
+	assert.Error(t, err)
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	rr := httptest.NewRecorder()
+	httpsRedirect(":8443")(rr, httptest.NewRequest("GET", "http://chat.example.com:8080/users/1?x=y", nil))
+
+	assert.Equal(t, http.StatusMovedPermanently, rr.Code)
+	assert.Equal(t, "https://chat.example.com:8443/users/1?x=y", rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	httpsRedirect(":443")(rr, httptest.NewRequest("GET", "http://chat.example.com/", nil))
+	assert.Equal(t, "https://chat.example.com/", rr.Header().Get("Location"))
+}
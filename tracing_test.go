@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func initTestTracing(t *testing.T) (*tracetest.SpanRecorder, *sdktrace.TracerProvider) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder, tp
+}
+
+// waitForSpan returns the ended span with the given name, waiting briefly
+// since spans may end after the response they cover has gone out.
+func waitForSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestHandlerSpan(t *testing.T) {
+	recorder, _ := initTestTracing(t)
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBufferString("not json"))
+	rr := httptest.NewRecorder()
+
+	CreateUser(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NotNil(t, waitForSpan(recorder, "handler.CreateUser"), "handler span was not recorded")
+}
+
+func TestWebSocketTracePropagation(t *testing.T) {
+	recorder, tp := initTestTracing(t)
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 201)
+	recipient := dialTestUser(t, server, 202)
+	waitForClients(t, 2)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "client.send")
+	parent.End()
+
+	msg := Message{SenderID: 201, RecipientID: 202, Text: "traced", TraceParent: traceParent(ctx)}
+	if err := sender.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var received Message
+	if err := recipient.ReadJSON(&received); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "traced", received.Text)
+
+	receivedSpan := trace.SpanContextFromContext(contextWithTraceParent(context.Background(), received.TraceParent))
+	assert.Equal(t, parent.SpanContext().TraceID(), receivedSpan.TraceID(), "frame did not carry the trace")
+
+	span := waitForSpan(recorder, "ws.message")
+	if assert.NotNil(t, span, "ws.message span was not recorded") {
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Contains(t, span.Attributes(), attribute.Int("chat.sender_id", 201))
+		assert.Contains(t, span.Attributes(), attribute.Int("chat.recipient_id", 202))
+	}
+}
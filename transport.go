@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport carries a client's events to its device: a WebSocket, or an
+// event stream for clients that can only receive. write is only called by
+// the client's write pump; the other methods may be called from anywhere.
+type transport interface {
+	write(v interface{}) error
+	// shutdown ends the connection, telling the device why if the
+	// protocol has a way to.
+	shutdown(code int, reason string)
+	// abort ends the connection after a failed write.
+	abort()
+}
+
+// transportInfo is what the admin connection listing shows of a
+// transport.
+type transportInfo struct {
+	remoteAddr string
+	protocol   string
+	codec      string
+}
+
+// describer is implemented by transports that can tell where their device
+// connected from.
+type describer interface {
+	describe() transportInfo
+}
+
+type wsTransport struct {
+	conn  *websocket.Conn
+	codec Codec
+}
+
+func newWSTransport(conn *websocket.Conn) *wsTransport {
+	return &wsTransport{conn: conn, codec: codecFor(conn.Subprotocol())}
+}
+
+// write sends v in the connection's codec. Frames smaller than
+// cfg.WSCompressionThreshold go out uncompressed: deflating a few bytes
+// costs more CPU than it saves on the wire. Compression only applies if the
+// client negotiated permessage-deflate, and never to control frames.
+func (t *wsTransport) write(v interface{}) error {
+	payload, err := t.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.conn.EnableWriteCompression(len(payload) >= cfg.WSCompressionThreshold)
+	return t.conn.WriteMessage(t.codec.FrameType(), payload)
+}
+
+// shutdown sends a close frame and closes the connection. The handler's
+// read loop then fails and deregisters the client.
+func (t *wsTransport) shutdown(code int, reason string) {
+	frame := websocket.FormatCloseMessage(code, reason)
+	if err := t.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeWriteTimeout)); err != nil {
+		log.Printf("error sending close frame: %v", err)
+	}
+	t.conn.Close()
+}
+
+func (t *wsTransport) abort() {
+	t.conn.Close()
+}
+
+func (t *wsTransport) describe() transportInfo {
+	codec := "json"
+	if t.conn.Subprotocol() == subprotocolMsgpack {
+		codec = "msgpack"
+	}
+	return transportInfo{remoteAddr: t.conn.RemoteAddr().String(), protocol: "websocket", codec: codec}
+}
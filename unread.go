@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// unreadKey counts the user's unread messages, as a hash from conversation
+// key to count.
+func unreadKey(userID string) string {
+	return fmt.Sprintf("user:%s:unread", userID)
+}
+
+// countUnread adds msg to the unread count of its conversation for each of
+// the users. System messages are only counted with SystemMessagesUnread.
+func countUnread(ctx context.Context, msg Message, userIDs []string) {
+	if msg.Kind == MessageKindSystem && !cfg.SystemMessagesUnread {
+		return
+	}
+	conversation := conversationKey(msg)
+	pipe := redisCli.Pipeline()
+	for _, id := range userIDs {
+		pipe.HIncrBy(ctx, unreadKey(id), conversation, 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger(ctx).Println("Failed to count unread messages:", err)
+	}
+}
+
+// markConversationRead clears the caller's unread count of the
+// conversation in the path.
+func markConversationRead(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.markConversationRead")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	conversation := mux.Vars(r)["key"]
+	span.SetAttributes(attribute.String("chat.conversation", conversation))
+	if err := canReadConversation(ctx, conversation, claims.UserID); err == errInvalidConversationKey {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	} else if err == errNotRoomMember {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	} else if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := redisCli.HDel(ctx, unreadKey(strconv.Itoa(claims.UserID)), conversation).Err(); err != nil {
+		WriteError(w, http.StatusServiceUnavailable, codeUnavailable, "Failed to mark conversation read")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
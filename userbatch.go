@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// maxBatchUsers is how many users one POST /users/batch may ask for.
+const maxBatchUsers = 100
+
+type batchUsersRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// userNotFound stands in for a user that does not exist in a batch
+// response.
+var userNotFound = map[string]string{"error": "not_found"}
+
+// loadUsers returns the profiles of the active users among userIDs, taking
+// those it can from the cache and the rest from one query, which it then
+// caches. Unknown users are missing from the result.
+func loadUsers(ctx context.Context, userIDs []int) (map[int]User, error) {
+	users, err := cachedUsers(ctx, userIDs)
+	if err != nil {
+		logger(ctx).Println("Failed to read cached users:", err)
+	}
+	var missing []int64
+	for _, id := range userIDs {
+		if _, ok := users[id]; !ok {
+			missing = append(missing, int64(id))
+		}
+	}
+	if len(missing) == 0 {
+		expireStatuses(users)
+		return users, nil
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE user_id = ANY($1) AND deleted_at IS NULL",
+		missing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var loaded []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users[user.ID] = user
+		loaded = append(loaded, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := redisCli.Pipeline()
+	for _, user := range loaded {
+		data, err := json.Marshal(user)
+		if err != nil {
+			continue
+		}
+		pipe.Set(ctx, userCacheKey(user.ID), data, userCacheTTL)
+	}
+	if len(loaded) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			logger(ctx).Println("Failed to cache users:", err)
+		}
+	}
+	expireStatuses(users)
+	return users, nil
+}
+
+// batchUsers returns the profiles of up to maxBatchUsers users keyed by
+// their ID, with userNotFound for those that do not exist, so that clients
+// need not fetch them one by one.
+func batchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.batchUsers")
+	defer span.End()
+
+	var req batchUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBatchUsers {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("ids must list between 1 and %d users", maxBatchUsers))
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_count", len(req.IDs)))
+
+	seen := make(map[int]bool, len(req.IDs))
+	ids := make([]int, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	users, err := loadUsers(ctx, ids)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	result := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		if user, ok := users[id]; ok {
+			result[strconv.Itoa(id)] = user
+		} else {
+			result[strconv.Itoa(id)] = userNotFound
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
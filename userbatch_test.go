@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchUserStore answers the batch lookup with the users it knows and
+// records the IDs each lookup asked for.
+type batchUserStore struct {
+	users map[int]User
+
+	mu      sync.Mutex
+	queries [][]int64
+}
+
+func (s *batchUserStore) Connect(context.Context) (driver.Conn, error) {
+	return batchUserConn{store: s}, nil
+}
+
+func (s *batchUserStore) Driver() driver.Driver { return nil }
+
+type batchUserConn struct {
+	fakeConn
+	store *batchUserStore
+}
+
+func (c batchUserConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	ids := args[0].Value.([]int64)
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.queries = append(c.store.queries, ids)
+	rows := &multiUserRows{}
+	for _, id := range ids {
+		if user, ok := c.store.users[int(id)]; ok {
+			rows.users = append(rows.users, user)
+		}
+	}
+	return rows, nil
+}
+
+func (batchUserConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type multiUserRows struct {
+	users []User
+}
+
+func (r *multiUserRows) Columns() []string { return (&userRows{}).Columns() }
+func (r *multiUserRows) Close() error      { return nil }
+
+func (r *multiUserRows) Next(dest []driver.Value) error {
+	if len(r.users) == 0 {
+		return (&userRows{}).Next(dest)
+	}
+	user := r.users[0]
+	r.users = r.users[1:]
+	return (&userRows{user: &user}).Next(dest)
+}
+
+func initBatchUserStore(t *testing.T, users ...User) *batchUserStore {
+	store := &batchUserStore{users: make(map[int]User)}
+	for _, user := range users {
+		store.users[user.ID] = user
+	}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func batchUsersRequestRecorded(t *testing.T, ids []int) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, authedRequest(t, 1, "POST", "/users/batch", batchUsersRequest{IDs: ids}))
+	var result map[string]json.RawMessage
+	json.NewDecoder(rr.Body).Decode(&result)
+	return rr, result
+}
+
+func TestBatchUsersCacheHitsAndMisses(t *testing.T) {
+	initRedis(t)
+	ctx := context.Background()
+	ann, bob, cat := User{ID: 3, Username: "ann"}, User{ID: 4, Username: "bob"}, User{ID: 5, Username: "cat"}
+	store := initBatchUserStore(t, ann, bob, cat)
+	assert.NoError(t, cacheUser(ctx, ann))
+
+	rr, result := batchUsersRequestRecorded(t, []int{3, 4, 4, 9})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Len(t, result, 3)
+	var got User
+	assert.NoError(t, json.Unmarshal(result["3"], &got))
+	assert.Equal(t, "ann", got.Username)
+	assert.NoError(t, json.Unmarshal(result["4"], &got))
+	assert.Equal(t, "bob", got.Username)
+	assert.JSONEq(t, `{"error":"not_found"}`, string(result["9"]))
+	assert.Equal(t, [][]int64{{4, 9}}, store.queries, "only the misses are looked up, in one query")
+
+	cached, err := cachedUser(ctx, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, &bob, cached, "looked up users are cached")
+
+	rr, result = batchUsersRequestRecorded(t, []int{3, 4})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, result, 2)
+	assert.Len(t, store.queries, 1, "all cache hits need no query")
+}
+
+func TestBatchUsersLimit(t *testing.T) {
+	initRedis(t)
+	store := initBatchUserStore(t)
+
+	ids := make([]int, maxBatchUsers+1)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	rr, _ := batchUsersRequestRecorded(t, ids)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	rr, _ = batchUsersRequestRecorded(t, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Empty(t, store.queries)
+
+	rr, result := batchUsersRequestRecorded(t, ids[:maxBatchUsers])
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, result, maxBatchUsers)
+	assert.Len(t, store.queries, 1)
+}
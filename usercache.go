@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const userCacheTTL = time.Hour
+
+func userCacheKey(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// cacheUser stores the public profile of user. The password is never
+// serialised, so it does not end up in Redis.
+func cacheUser(ctx context.Context, user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return redisCli.Set(ctx, userCacheKey(user.ID), data, userCacheTTL).Err()
+}
+
+// cachedUser returns the cached profile, or nil on a miss. A value that does
+// not decode is reported as an error so the caller reloads and rewrites it.
+func cachedUser(ctx context.Context, userID int) (*User, error) {
+	data, err := redisCli.Get(ctx, userCacheKey(userID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("corrupted cache entry for user %d: %w", userID, err)
+	}
+	return &user, nil
+}
+
+// cachedUsers reads the cached profiles of the users in one round trip. IDs
+// missing from the result were not cached or did not decode.
+func cachedUsers(ctx context.Context, userIDs []int) (map[int]User, error) {
+	users := make(map[int]User, len(userIDs))
+	if len(userIDs) == 0 {
+		return users, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = userCacheKey(id)
+	}
+	values, err := redisCli.MGet(ctx, keys...).Result()
+	if err != nil {
+		return users, err
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var user User
+		if err := json.Unmarshal([]byte(data), &user); err == nil {
+			users[userIDs[i]] = user
+		}
+	}
+	return users, nil
+}
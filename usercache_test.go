@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// userStore serves every query with the same user row and counts how often
+// it was asked.
+type userStore struct {
+	user    User
+	queries atomic.Int64
+}
+
+func (s *userStore) Connect(context.Context) (driver.Conn, error) {
+	return userStoreConn{store: s}, nil
+}
+
+func (s *userStore) Driver() driver.Driver { return nil }
+
+type userStoreConn struct {
+	fakeConn
+	store *userStore
+}
+
+func (c userStoreConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	c.store.queries.Add(1)
+	return &userRows{user: &c.store.user}, nil
+}
+
+type userRows struct {
+	user *User
+}
+
+func (r *userRows) Columns() []string {
+	return []string{"user_id", "username", "email", "avatar_url", "created_at", "updated_at", "status_text", "availability", "status_expires_at"}
+}
+func (r *userRows) Close() error { return nil }
+
+func (r *userRows) Next(dest []driver.Value) error {
+	if r.user == nil {
+		return io.EOF
+	}
+	dest[0], dest[1], dest[2], dest[3] = int64(r.user.ID), r.user.Username, r.user.Email, r.user.AvatarURL
+	dest[4], dest[5] = r.user.CreatedAt, r.user.UpdatedAt
+	dest[6], dest[7], dest[8] = nil, nil, nil
+	if status := r.user.Status; status != nil {
+		dest[7] = status.Availability
+		if status.Text != "" {
+			dest[6] = status.Text
+		}
+		if status.ExpiresAt != nil {
+			dest[8] = *status.ExpiresAt
+		}
+	}
+	r.user = nil
+	return nil
+}
+
+func initUserStore(t *testing.T, user User) *userStore {
+	store := &userStore{user: user}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func getUserRequest(userID int) (*httptest.ResponseRecorder, User) {
+	req := httptest.NewRequest("GET", "/users/"+strconv.Itoa(userID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(userID)})
+	rr := httptest.NewRecorder()
+	getUser(rr, req)
+
+	var user User
+	json.NewDecoder(rr.Body).Decode(&user)
+	return rr, user
+}
+
+func TestGetUserCacheHitSkipsStore(t *testing.T) {
+	initRedis(t)
+	want := User{ID: 7, Username: "vishnu", Email: "vishnu@gmail.com"}
+	store := initUserStore(t, want)
+
+	rr, got := getUserRequest(want.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, want, got)
+	assert.Equal(t, int64(1), store.queries.Load())
+
+	rr, got = getUserRequest(want.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, want, got)
+	assert.Equal(t, int64(1), store.queries.Load(), "cache hit should not query the store")
+}
+
+func TestGetUserCorruptedCacheEntry(t *testing.T) {
+	mr := initRedis(t)
+	want := User{ID: 8, Username: "reddy", Email: "reddy@gmail.com"}
+	store := initUserStore(t, want)
+	mr.Set(userCacheKey(want.ID), "{not json")
+
+	rr, got := getUserRequest(want.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, want, got)
+	assert.Equal(t, int64(1), store.queries.Load())
+
+	cached, err := cachedUser(context.Background(), want.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &want, cached, "corrupted entry should have been rewritten")
+}
+
+func TestCachedUserOmitsPassword(t *testing.T) {
+	mr := initRedis(t)
+	assert.NoError(t, cacheUser(context.Background(), User{ID: 9, Username: "u", Password: "secret"}))
+
+	value, err := mr.Get(userCacheKey(9))
+	assert.NoError(t, err)
+	assert.NotContains(t, value, "secret")
+}
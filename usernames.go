@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+)
+
+// usernameAvailabilityTTL is how long an availability answer is cached.
+// Signup forms ask on every keystroke; CreateUser still refuses a name
+// taken in the meantime.
+const usernameAvailabilityTTL = 30 * time.Second
+
+// reservedUsernames cannot be signed up for, so that nobody poses as the
+// service. They are compared like usernames, ignoring case.
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+}
+
+type usernameAvailability struct {
+	Available bool `json:"available"`
+}
+
+// normalizeUsername is the username as it is stored: without the spaces
+// around it.
+func normalizeUsername(username string) string {
+	return strings.TrimSpace(username)
+}
+
+// usernameFold is the form usernames are compared in.
+func usernameFold(username string) string {
+	return strings.ToLower(normalizeUsername(username))
+}
+
+func usernameReserved(username string) bool {
+	return reservedUsernames[usernameFold(username)]
+}
+
+func usernameAvailabilityKey(username string) string {
+	return "username_available:" + usernameFold(username)
+}
+
+// checkUsername tells whether a username can be signed up for. It only
+// looks at usernames, so it tells nothing about who has which email.
+func checkUsername(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.checkUsername")
+	defer span.End()
+
+	username := normalizeUsername(r.URL.Query().Get("username"))
+	if username == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "username is required")
+		return
+	}
+	if err := validateUser(User{Username: username}); err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	available, err := usernameAvailable(ctx, username)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usernameAvailability{Available: available})
+}
+
+// usernameAvailable tells whether nobody has the username, in any case, and
+// it is not reserved. Answers are cached for usernameAvailabilityTTL.
+func usernameAvailable(ctx context.Context, username string) (bool, error) {
+	if usernameReserved(username) {
+		return false, nil
+	}
+
+	key := usernameAvailabilityKey(username)
+	cached, err := redisCli.Get(ctx, key).Result()
+	if err == nil {
+		return cached == "1", nil
+	} else if err != redis.Nil {
+		logger(ctx).Println("Failed to read username availability:", err)
+	}
+
+	var taken bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1))", username).Scan(&taken)
+	if err != nil {
+		return false, err
+	}
+	value := "1"
+	if taken {
+		value = "0"
+	}
+	if err := redisCli.Set(ctx, key, value, usernameAvailabilityTTL).Err(); err != nil {
+		logger(ctx).Println("Failed to cache username availability:", err)
+	}
+	return !taken, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// usernameStore answers the availability query from a list of usernames,
+// comparing them like lower() would, and counts the queries. Signups are
+// added to the list unless the unique index on lower(username) would
+// refuse them.
+type usernameStore struct {
+	mu        sync.Mutex
+	usernames []string
+	queries   int
+}
+
+func (s *usernameStore) Connect(context.Context) (driver.Conn, error) {
+	return usernameConn{store: s}, nil
+}
+
+func (s *usernameStore) Driver() driver.Driver { return nil }
+
+type usernameConn struct {
+	fakeConn
+	store *usernameStore
+}
+
+func (c usernameConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taken := false
+	for _, username := range s.usernames {
+		taken = taken || strings.ToLower(username) == strings.ToLower(args[0].Value.(string))
+	}
+	if strings.HasPrefix(query, "INSERT INTO users") {
+		if taken {
+			return nil, &pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_username_lower_unique"}
+		}
+		s.usernames = append(s.usernames, args[0].Value.(string))
+		return &tableRows{columns: []string{"user_id", "created_at", "updated_at"},
+			rows: [][]driver.Value{{int64(len(s.usernames)), insertedAt, insertedAt}}}, nil
+	}
+	if strings.Contains(query, "email") {
+		panic("the availability check must not look at emails")
+	}
+	s.queries++
+	return &tableRows{columns: []string{"exists"}, rows: [][]driver.Value{{taken}}}, nil
+}
+
+func initUsernameStore(t *testing.T, usernames ...string) *usernameStore {
+	store := &usernameStore{usernames: usernames}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+	return store
+}
+
+func getUsernameCheck(t *testing.T, username string) (int, bool) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/users/check?"+url.Values{"username": {username}}.Encode(), nil))
+	var resp usernameAvailability
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, resp.Available
+}
+
+func TestCheckUsername(t *testing.T) {
+	initRedis(t)
+	initUsernameStore(t, "vishnu")
+
+	for username, available := range map[string]bool{
+		"vishnu":     false,
+		"Vishnu":     false,
+		"  VISHNU  ": false,
+		"vishnu2":    true,
+		"Admin":      false,
+		" system ":   false,
+	} {
+		code, got := getUsernameCheck(t, username)
+		assert.Equal(t, http.StatusOK, code, username)
+		assert.Equal(t, available, got, username)
+	}
+
+	code, _ := getUsernameCheck(t, "   ")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getUsernameCheck(t, strings.Repeat("x", cfg.MaxUsernameLength+1))
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCheckUsernameCached(t *testing.T) {
+	mr := initRedis(t)
+	store := initUsernameStore(t)
+
+	for _, username := range []string{"vishnu", "Vishnu", "vishnu "} {
+		_, available := getUsernameCheck(t, username)
+		assert.True(t, available)
+	}
+	assert.Equal(t, 1, store.queries, "spellings of the same username should share the cached answer")
+	assert.True(t, mr.Exists(usernameAvailabilityKey("vishnu")))
+
+	mr.FastForward(usernameAvailabilityTTL)
+	getUsernameCheck(t, "vishnu")
+	assert.Equal(t, 2, store.queries)
+}
+
+func TestCreateUserReservedUsername(t *testing.T) {
+	initRedis(t)
+	jsonData, _ := json.Marshal(createUserRequest{Username: " Admin ", Email: "admin@example.com", Password: "password123"})
+	rr := httptest.NewRecorder()
+	CreateUser(rr, httptest.NewRequest("POST", "/users", bytes.NewBuffer(jsonData)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "username_reserved")
+}
+
+func TestCreateUserMixedCaseDuplicate(t *testing.T) {
+	initRedis(t)
+	store := initUsernameStore(t, "vishnu")
+
+	for _, username := range []string{"Vishnu", "VISHNU", " vishnu "} {
+		rr := postCreateUser(username)
+		assert.Equal(t, http.StatusConflict, rr.Code, username)
+		assert.JSONEq(t, `{"error":{"code":"username_already_taken","message":"That username is already taken"}}`, rr.Body.String())
+	}
+	assert.Equal(t, http.StatusOK, postCreateUser("Vishnu2").Code)
+	assert.Equal(t, []string{"vishnu", "Vishnu2"}, store.usernames, "usernames keep the case they were signed up with")
+}
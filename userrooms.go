@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// userRoomListTTL is how long a page of a user's rooms is cached. Joining
+// and leaving drop the cached pages sooner; a newer last message may take
+// that long to show.
+const userRoomListTTL = 30 * time.Second
+
+// UserRoom is a room in the listing of a user's rooms.
+type UserRoom struct {
+	RoomID      int              `json:"room_id"`
+	Name        string           `json:"name"`
+	MemberCount int              `json:"member_count"`
+	LastMessage *RoomLastMessage `json:"last_message"`
+}
+
+// RoomLastMessage is the latest message sent to a room.
+type RoomLastMessage struct {
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+// userRoomListKey caches a page of the user's rooms.
+func userRoomListKey(userID, limit, offset int) string {
+	return fmt.Sprintf("user:%d:room_list:%d:%d", userID, limit, offset)
+}
+
+// userRoomListsKey holds the keys of the user's cached pages, so that they
+// can be dropped together.
+func userRoomListsKey(userID int) string {
+	return fmt.Sprintf("user:%d:room_lists", userID)
+}
+
+// listUserRooms returns the rooms the user in the path belongs to, most
+// recently active first, to that user and to admins.
+func listUserRooms(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.listUserRooms")
+	defer span.End()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	}
+	span.SetAttributes(attribute.Int("chat.user_id", userID))
+
+	claims := claimsFromContext(ctx)
+	if claims == nil || (claims.UserID != userID && claims.Role != RoleAdmin) {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+	limit, offset, err := userRoomListPage(r.URL.Query())
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	key := userRoomListKey(userID, limit, offset)
+	body, err := redisCli.Get(ctx, key).Bytes()
+	if err != nil {
+		rooms, err := loadUserRooms(ctx, userID, limit, offset)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError)
+			return
+		}
+		body, _ = json.Marshal(rooms)
+		pipe := redisCli.TxPipeline()
+		pipe.Set(ctx, key, body, userRoomListTTL)
+		pipe.SAdd(ctx, userRoomListsKey(userID), key)
+		pipe.Expire(ctx, userRoomListsKey(userID), userRoomListTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			logger(ctx).Println("Failed to cache room list:", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// userRoomListPage reads the limit and offset of a page of a user's rooms.
+func userRoomListPage(query url.Values) (limit, offset int, err error) {
+	if limit, err = parseLimit(query, defaultRoomListLimit, maxRoomListLimit); err != nil {
+		return 0, 0, err
+	}
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("Invalid offset")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+func loadUserRooms(ctx context.Context, userID, limit, offset int) ([]UserRoom, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT r.room_id, r.name, r.last_message_text, r.last_message_at,
+			(SELECT COUNT(*) FROM room_members c WHERE c.room_id = r.room_id)
+		FROM room_members m
+		JOIN rooms r ON r.room_id = m.room_id
+		WHERE m.user_id = $1
+		ORDER BY r.last_activity_at DESC, r.room_id DESC
+		LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []UserRoom{}
+	for rows.Next() {
+		var room UserRoom
+		var text *string
+		var at *time.Time
+		if err := rows.Scan(&room.RoomID, &room.Name, &text, &at, &room.MemberCount); err != nil {
+			return nil, err
+		}
+		if text != nil && at != nil {
+			room.LastMessage = &RoomLastMessage{Text: *text, At: at.UTC()}
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// forgetUserRoomLists drops the cached room pages of the users, after they
+// joined or left a room or its members changed.
+func forgetUserRoomLists(ctx context.Context, userIDs []string) {
+	pipe := redisCli.Pipeline()
+	var keys []string
+	var pages []*redis.StringSliceCmd
+	for _, id := range userIDs {
+		if userID, err := strconv.Atoi(id); err == nil {
+			keys = append(keys, userRoomListsKey(userID))
+			pages = append(pages, pipe.SMembers(ctx, userRoomListsKey(userID)))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	_, err := pipe.Exec(ctx)
+	if err == nil {
+		for _, cmd := range pages {
+			keys = append(keys, cmd.Val()...)
+		}
+		err = redisCli.Del(ctx, keys...).Err()
+	}
+	if err != nil {
+		logger(ctx).Println("Failed to drop cached room lists:", err)
+	}
+}
+
+// forgetRoomLists drops the cached room pages of the room's members and of
+// the users in also, who may just have left.
+func forgetRoomLists(ctx context.Context, roomID int, also ...int) {
+	members, err := roomMembers(ctx, roomID)
+	if err != nil {
+		logger(ctx).Println("Failed to look up room members:", err)
+	}
+	forgetUserRoomLists(ctx, append(members, userIDStrings(also)...))
+}
+
+// recordRoomActivity keeps the room's latest message for listings.
+func recordRoomActivity(ctx context.Context, msg Message, at time.Time) {
+	_, err := db.ExecContext(ctx,
+		"UPDATE rooms SET last_activity_at = $2, last_message_text = $3, last_message_at = $2 WHERE room_id = $1",
+		msg.RoomID, at, msg.Text)
+	if err != nil {
+		logger(ctx).Println("Failed to record room activity:", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// userRoomsStore answers the room listing with its rooms, paged, and counts
+// the queries.
+type userRoomsStore struct {
+	mu      sync.Mutex
+	rooms   []UserRoom
+	queries int
+}
+
+func (s *userRoomsStore) Connect(context.Context) (driver.Conn, error) {
+	return userRoomsConn{store: s}, nil
+}
+
+func (s *userRoomsStore) Driver() driver.Driver { return nil }
+
+type userRoomsConn struct {
+	fakeConn
+	store *userRoomsStore
+}
+
+func (c userRoomsConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.queries++
+	limit, offset := int(args[1].Value.(int64)), int(args[2].Value.(int64))
+	rooms := c.store.rooms[min(offset, len(c.store.rooms)):]
+	return &userRoomRows{rooms: rooms[:min(limit, len(rooms))]}, nil
+}
+
+func (s *userRoomsStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+type userRoomRows struct {
+	rooms []UserRoom
+}
+
+func (r *userRoomRows) Columns() []string {
+	return []string{"room_id", "name", "last_message_text", "last_message_at", "count"}
+}
+func (r *userRoomRows) Close() error { return nil }
+
+func (r *userRoomRows) Next(dest []driver.Value) error {
+	if len(r.rooms) == 0 {
+		return io.EOF
+	}
+	room := r.rooms[0]
+	dest[0], dest[1], dest[2], dest[3], dest[4] = int64(room.RoomID), room.Name, nil, nil, int64(room.MemberCount)
+	if room.LastMessage != nil {
+		dest[2], dest[3] = room.LastMessage.Text, room.LastMessage.At
+	}
+	r.rooms = r.rooms[1:]
+	return nil
+}
+
+func listUserRoomsRecorded(t *testing.T, userID int, role, path string) *httptest.ResponseRecorder {
+	token, err := createSession(context.Background(), userID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestListUserRooms(t *testing.T) {
+	initRedis(t)
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := &userRoomsStore{rooms: []UserRoom{
+		{RoomID: 9, Name: "busy", MemberCount: 4, LastMessage: &RoomLastMessage{Text: "latest", At: at}},
+		{RoomID: 7, Name: "quiet", MemberCount: 2},
+	}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	rr := listUserRoomsRecorded(t, 3, RoleUser, "/users/3/rooms")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[
+		{"room_id":9,"name":"busy","member_count":4,"last_message":{"text":"latest","at":"2024-06-01T12:00:00Z"}},
+		{"room_id":7,"name":"quiet","member_count":2,"last_message":null}
+	]`, rr.Body.String())
+
+	var page []UserRoom
+	rr = listUserRoomsRecorded(t, 1, RoleAdmin, "/users/3/rooms?limit=1&offset=1")
+	assert.Equal(t, http.StatusOK, rr.Code, "admins see anyone's rooms")
+	json.NewDecoder(rr.Body).Decode(&page)
+	if assert.Len(t, page, 1) {
+		assert.Equal(t, 7, page[0].RoomID)
+	}
+
+	assert.Equal(t, http.StatusForbidden, listUserRoomsRecorded(t, 4, RoleUser, "/users/3/rooms").Code)
+	assert.Equal(t, http.StatusBadRequest, listUserRoomsRecorded(t, 3, RoleUser, "/users/3/rooms?limit=0").Code)
+	assert.Equal(t, http.StatusBadRequest, listUserRoomsRecorded(t, 3, RoleUser, "/users/3/rooms?offset=-1").Code)
+}
+
+func TestListUserRoomsCache(t *testing.T) {
+	mr := initRedis(t)
+	store := &userRoomsStore{rooms: []UserRoom{{RoomID: 7, Name: "general", MemberCount: 2}}}
+	db = sql.OpenDB(store)
+	t.Cleanup(func() { db.Close() })
+
+	list := func() string {
+		rr := listUserRoomsRecorded(t, 3, RoleUser, "/users/3/rooms")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	first := list()
+	assert.Equal(t, first, list())
+	assert.Equal(t, 1, store.count(), "the second listing comes from the cache")
+
+	store.mu.Lock()
+	store.rooms = append(store.rooms, UserRoom{RoomID: 8, Name: "joined", MemberCount: 1})
+	store.mu.Unlock()
+	forgetUserRoomLists(context.Background(), []string{"3"})
+	assert.Contains(t, list(), "joined", "joining drops the cached pages")
+	assert.Equal(t, 2, store.count())
+
+	list()
+	mr.FastForward(userRoomListTTL)
+	list()
+	assert.Equal(t, 3, store.count(), "cached pages expire")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// wsFrameOverhead leaves room for the JSON around the text in a WebSocket
+// frame: the other fields plus escaped quotes and backslashes.
+const wsFrameOverhead = 4096
+
+// maxEmojiBytes matches the emoji column of reactions, and leaves room for
+// sequences joined with zero width joiners.
+const maxEmojiBytes = 32
+
+// ErrorEvent is sent over a WebSocket when a frame from the client is
+// rejected. The connection stays open. Code is stable for clients to match
+// on; Error is meant for humans.
+type ErrorEvent struct {
+	Type  string `json:"type"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+func newErrorEvent(code string, err error) ErrorEvent {
+	return ErrorEvent{Type: "error", Code: code, Error: err.Error()}
+}
+
+func validateMessage(msg Message) error {
+	if strings.TrimSpace(msg.Text) == "" {
+		return errors.New("message text is required")
+	}
+	if len(msg.Text) > cfg.MaxMessageBytes {
+		return fmt.Errorf("message text must be at most %d bytes", cfg.MaxMessageBytes)
+	}
+	if utf8.RuneCountInString(msg.Text) > cfg.MaxMessageRunes {
+		return fmt.Errorf("message text must be at most %d characters", cfg.MaxMessageRunes)
+	}
+	if msg.Format != "" && msg.Format != formatPlain && msg.Format != formatMarkdown {
+		return errors.New(`format must be "plain" or "markdown"`)
+	}
+	if msg.TTLSeconds < 0 || msg.TTLSeconds > int(maxMessageTTL/time.Second) {
+		return fmt.Errorf("ttl_seconds must be between 0 and %d", int(maxMessageTTL.Seconds()))
+	}
+	if msg.ClientMsgID != "" {
+		if _, err := uuid.Parse(msg.ClientMsgID); err != nil || len(msg.ClientMsgID) != 36 {
+			return errors.New("client_msg_id must be a UUID")
+		}
+	}
+	return nil
+}
+
+// validateEmoji checks a reaction: one short string without spaces.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return fmt.Errorf("emoji must be 1 to %d bytes of UTF-8", maxEmojiBytes)
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("emoji must not contain spaces or control characters")
+		}
+	}
+	return nil
+}
+
+// maxFrameBytes is the WebSocket read limit. Frames over it close the
+// connection with 1009; anything smaller is decoded and validated, so a
+// text just over the limit gets an error event instead.
+func maxFrameBytes() int64 {
+	return int64(2*cfg.MaxMessageBytes + wsFrameOverhead)
+}
+
+// validateUser checks the profile fields against the configured limits.
+// Lengths are in characters, matching the VARCHAR columns they are stored in.
+func validateUser(user User) error {
+	if utf8.RuneCountInString(user.Username) > cfg.MaxUsernameLength {
+		return fmt.Errorf("username must be at most %d characters", cfg.MaxUsernameLength)
+	}
+	if utf8.RuneCountInString(user.Email) > cfg.MaxEmailLength {
+		return fmt.Errorf("email must be at most %d characters", cfg.MaxEmailLength)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func withMessageLimits(t *testing.T, maxBytes, maxRunes int) {
+	saved := cfg
+	cfg.MaxMessageBytes = maxBytes
+	cfg.MaxMessageRunes = maxRunes
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestValidateMessageBoundary(t *testing.T) {
+	withMessageLimits(t, 16, 8)
+
+	assert.NoError(t, validateMessage(Message{Text: strings.Repeat("a", 8)}))
+	assert.Error(t, validateMessage(Message{Text: strings.Repeat("a", 9)}), "over the character limit")
+
+	// Two-byte characters hit both limits at once.
+	assert.NoError(t, validateMessage(Message{Text: strings.Repeat("é", 8)}))
+	assert.Error(t, validateMessage(Message{Text: strings.Repeat("é", 8) + "a"}))
+
+	// Four-byte characters hit the byte limit first.
+	assert.NoError(t, validateMessage(Message{Text: strings.Repeat("🚀", 4)}))
+	assert.Error(t, validateMessage(Message{Text: strings.Repeat("🚀", 5)}), "over the byte limit")
+}
+
+func TestValidateMessageRejectsBlankText(t *testing.T) {
+	for _, text := range []string{"", "   ", "\n\t "} {
+		assert.Error(t, validateMessage(Message{Text: text}), "%q should be rejected", text)
+	}
+	assert.NoError(t, validateMessage(Message{Text: " hi "}))
+}
+
+func TestValidateUserBoundary(t *testing.T) {
+	email := "a@example.com"
+	assert.NoError(t, validateUser(User{Username: strings.Repeat("ü", cfg.MaxUsernameLength), Email: email}))
+	assert.Error(t, validateUser(User{Username: strings.Repeat("ü", cfg.MaxUsernameLength+1), Email: email}))
+
+	domain := "@example.com"
+	local := strings.Repeat("a", cfg.MaxEmailLength-len(domain))
+	assert.NoError(t, validateUser(User{Username: "vishnu", Email: local + domain}))
+	assert.Error(t, validateUser(User{Username: "vishnu", Email: local + "a" + domain}))
+}
+
+func TestSendMessageTooLarge(t *testing.T) {
+	jsonData, _ := json.Marshal(Message{SenderID: 1, RecipientID: 2, Text: strings.Repeat("a", cfg.MaxMessageBytes+1)})
+	req := httptest.NewRequest("POST", "/messages", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+
+	sendMessage(rr, asUser(req, 1))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, "handler returned wrong status code")
+	assert.Contains(t, rr.Body.String(), strconv.Itoa(cfg.MaxMessageBytes), "error should state the limit")
+}
+
+func TestCreateUserUsernameTooLong(t *testing.T) {
+	jsonData, _ := json.Marshal(map[string]string{
+		"username": strings.Repeat("a", cfg.MaxUsernameLength+1),
+		"email":    "long@example.com",
+		"password": "password123",
+	})
+	req := httptest.NewRequest("POST", "/users", bytes.NewBuffer(jsonData))
+	rr := httptest.NewRecorder()
+
+	CreateUser(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "handler returned wrong status code")
+}
+
+func TestWebSocketRejectsLargeMessage(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 401)
+	recipient := dialTestUser(t, server, 402)
+	waitForClients(t, 2)
+
+	err := sender.WriteJSON(Message{SenderID: 401, RecipientID: 402, Text: strings.Repeat("a", cfg.MaxMessageBytes+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event ErrorEvent
+	if err := sender.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "error", event.Type)
+	assert.Equal(t, "invalid_message", event.Code)
+
+	// The socket stays usable and nothing oversized reached the recipient.
+	if err := sender.WriteJSON(Message{SenderID: 401, RecipientID: 402, Text: "small"}); err != nil {
+		t.Fatal(err)
+	}
+	recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := recipient.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "small", msg.Text)
+}
+
+func TestWebSocketClosesOnOversizedFrame(t *testing.T) {
+	initRedis(t)
+	initFakeDB(t)
+	server := newTestServer(t, newRouter())
+
+	sender := dialTestUser(t, server, 403)
+	waitForClients(t, 1)
+	// The server hangs up right after its close frame, so don't try to
+	// answer it.
+	sender.SetCloseHandler(func(int, string) error { return nil })
+
+	err := sender.WriteJSON(Message{SenderID: 403, RecipientID: 404, Text: strings.Repeat("a", int(maxFrameBytes()))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = sender.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "expected 1009 close, got %v", err)
+}
+
+func TestValidateEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "🎉", "👩‍👩‍👧‍👦", "+1"} {
+		assert.NoError(t, validateEmoji(emoji), emoji)
+	}
+	for _, emoji := range []string{"", " ", "👍 👍", "a\nb", strings.Repeat("👍", maxEmojiBytes/4+1), "\xff"} {
+		assert.Error(t, validateEmoji(emoji), "%q should be rejected", emoji)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	eventMessageCreated = "message.created"
+
+	webhookSignatureHeader = "X-Chat-Signature"
+	webhookEventHeader     = "X-Chat-Event"
+	webhookDeliveryHeader  = "X-Chat-Delivery"
+
+	webhookQueueSize = 1024
+)
+
+var webhookEventTypes = []string{eventMessageCreated}
+
+var webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_webhook_deliveries_total",
+	Help: "Webhook deliveries by outcome, after retries.",
+}, []string{"result"})
+
+// webhooks is started in main; without it no webhook is called.
+var webhooks *WebhookDispatcher
+
+// Webhook is where a bot or integration account wants its events POSTed.
+// The secret is only shown when the webhook is registered.
+type Webhook struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type createWebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// webhookPayload is the body POSTed to a webhook.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// createWebhook registers a webhook for the caller's own events. The
+// response carries the secret that deliveries are signed with.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "handler.createWebhook")
+	defer span.End()
+
+	claims := claimsFromContext(ctx)
+	if claims == nil {
+		WriteError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+		return
+	}
+
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, err.Error())
+		return
+	}
+	if len(req.EventTypes) == 0 {
+		req.EventTypes = webhookEventTypes
+	}
+	for _, event := range req.EventTypes {
+		if !slices.Contains(webhookEventTypes, event) {
+			WriteError(w, http.StatusUnprocessableEntity, codeValidationFailed, fmt.Sprintf("unknown event type %q", event))
+			return
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "Failed to create secret")
+		return
+	}
+	hook := Webhook{UserID: claims.UserID, URL: req.URL, Secret: secret, EventTypes: req.EventTypes}
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO webhooks (user_id, url, secret, event_types) VALUES ($1, $2, $3, $4) RETURNING webhook_id, created_at",
+		hook.UserID, hook.URL, hook.Secret, hook.EventTypes).Scan(&hook.ID, &hook.CreatedAt)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// signWebhook returns the value of the signature header for body: the hex
+// HMAC-SHA256 of the body under the webhook's secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks hands a stored message to the dispatcher, if it runs.
+func notifyWebhooks(msg Message) {
+	if webhooks != nil {
+		webhooks.Notify(msg)
+	}
+}
+
+type webhookDelivery struct {
+	id      string
+	hook    Webhook
+	event   string
+	payload []byte
+}
+
+// WebhookDispatcher POSTs events to the webhooks of the users they are
+// addressed to, off the request path. A delivery that gets no 2xx answer is
+// retried with exponential backoff; a webhook whose deliveries fail
+// disableAfter times in a row is disabled.
+type WebhookDispatcher struct {
+	db           *sql.DB
+	client       *http.Client
+	policy       retryPolicy
+	disableAfter int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu         sync.RWMutex
+	closed     bool
+	messages   chan Message
+	deliveries chan webhookDelivery
+}
+
+func webhookRetryPolicy(c Config) retryPolicy {
+	return retryPolicy{
+		Attempts:   c.WebhookAttempts,
+		Backoff:    c.WebhookBackoff,
+		MaxBackoff: c.WebhookMaxBackoff,
+	}
+}
+
+func NewWebhookDispatcher(d *sql.DB, workers int, timeout time.Duration, policy retryPolicy, disableAfter int) *WebhookDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wd := &WebhookDispatcher{
+		db:           d,
+		client:       &http.Client{Timeout: timeout},
+		policy:       policy,
+		disableAfter: disableAfter,
+		ctx:          ctx,
+		cancel:       cancel,
+		messages:     make(chan Message, webhookQueueSize),
+		deliveries:   make(chan webhookDelivery, webhookQueueSize),
+	}
+	wd.wg.Add(1)
+	go wd.route()
+	for i := 0; i < workers; i++ {
+		wd.wg.Add(1)
+		go wd.work()
+	}
+	return wd
+}
+
+// Notify queues a message.created event for the recipient's webhooks. It
+// never blocks: when the queue is full the event is dropped.
+func (d *WebhookDispatcher) Notify(msg Message) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.messages <- msg:
+	default:
+		webhookDeliveries.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Close stops accepting events and abandons retries, returning once every
+// worker has stopped.
+func (d *WebhookDispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.messages)
+	}
+	d.mu.Unlock()
+	d.cancel()
+	d.wg.Wait()
+}
+
+// route looks up the webhooks of each message's recipient and queues a
+// delivery for each of them.
+func (d *WebhookDispatcher) route() {
+	defer d.wg.Done()
+	defer close(d.deliveries)
+	for msg := range d.messages {
+		if d.ctx.Err() != nil {
+			return
+		}
+		hooks, err := d.subscribers(d.ctx, msg.RecipientID, eventMessageCreated, conversationKey(msg))
+		if err != nil {
+			log.Println("Failed to look up webhooks:", err)
+			continue
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+		id := uuid.NewString()
+		payload, err := json.Marshal(webhookPayload{
+			ID:        id,
+			Event:     eventMessageCreated,
+			CreatedAt: msg.CreatedAt,
+			Data:      msg,
+		})
+		if err != nil {
+			log.Println("Failed to encode webhook payload:", err)
+			continue
+		}
+		for _, hook := range hooks {
+			select {
+			case d.deliveries <- webhookDelivery{id: id, hook: hook, event: eventMessageCreated, payload: payload}:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// subscribers returns the user's webhooks for the event, or none while the
+// user has the conversation muted.
+func (d *WebhookDispatcher) subscribers(ctx context.Context, userID int, event, conversation string) ([]Webhook, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT webhook_id, url, secret FROM webhooks
+		WHERE user_id = $1 AND disabled_at IS NULL AND $2 = ANY(event_types)
+		AND NOT EXISTS (
+			SELECT 1 FROM notification_prefs
+			WHERE user_id = $1 AND conversation_key = $3
+			AND (muted_until IS NULL OR muted_until > NOW())
+		)`, userID, event, conversation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hooks []Webhook
+	for rows.Next() {
+		hook := Webhook{UserID: userID}
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Secret); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (d *WebhookDispatcher) work() {
+	defer d.wg.Done()
+	for delivery := range d.deliveries {
+		err := d.deliver(d.ctx, delivery)
+		if errors.Is(err, context.Canceled) {
+			continue
+		}
+		d.recordResult(delivery.hook, err)
+	}
+}
+
+// deliver POSTs the payload until the webhook answers with a 2xx or the
+// policy runs out of attempts, and returns the last error.
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) error {
+	backoff := d.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := d.post(ctx, delivery)
+		if err == nil || attempt >= d.policy.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = min(backoff*2, d.policy.MaxBackoff)
+	}
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, delivery webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.hook.URL, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.event)
+	req.Header.Set(webhookDeliveryHeader, delivery.id)
+	req.Header.Set(webhookSignatureHeader, signWebhook(delivery.hook.Secret, delivery.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %d answered %s", delivery.hook.ID, resp.Status)
+	}
+	return nil
+}
+
+// recordResult resets the webhook's failure count after a delivery, or
+// counts a failed one and disables the webhook once too many failed in a
+// row.
+func (d *WebhookDispatcher) recordResult(hook Webhook, deliveryErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if deliveryErr == nil {
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+		if _, err := d.db.ExecContext(ctx, "UPDATE webhooks SET failure_count = 0 WHERE webhook_id = $1 AND failure_count > 0", hook.ID); err != nil {
+			log.Println("Failed to reset webhook failures:", err)
+		}
+		return
+	}
+
+	webhookDeliveries.WithLabelValues("failed").Inc()
+	log.Printf("Webhook delivery failed after %d attempts: %v", d.policy.Attempts, deliveryErr)
+	var disabled bool
+	err := d.db.QueryRowContext(ctx,
+		`UPDATE webhooks SET failure_count = failure_count + 1,
+			disabled_at = CASE WHEN failure_count + 1 >= $2 THEN NOW() END
+		WHERE webhook_id = $1 RETURNING disabled_at IS NOT NULL`, hook.ID, d.disableAfter).Scan(&disabled)
+	if err != nil {
+		log.Println("Failed to record webhook failure:", err)
+		return
+	}
+	if disabled {
+		log.Printf("Webhook %d of user %d disabled after %d failed deliveries", hook.ID, hook.UserID, d.disableAfter)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookStore holds one webhook and answers the dispatcher's lookup and
+// its failure bookkeeping the way the webhooks table would.
+type webhookStore struct {
+	hook Webhook
+
+	mu       sync.Mutex
+	failures int
+	disabled bool
+}
+
+func (s *webhookStore) Connect(context.Context) (driver.Conn, error) {
+	return webhookConn{store: s}, nil
+}
+
+func (s *webhookStore) Driver() driver.Driver { return nil }
+
+func (s *webhookStore) state() (failures int, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures, s.disabled
+}
+
+type webhookConn struct {
+	fakeConn
+	store *webhookStore
+}
+
+func (c webhookConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(query, "SELECT webhook_id") {
+		rows := &webhookRows{}
+		if userID, _ := args[0].Value.(int64); int(userID) == s.hook.UserID && !s.disabled {
+			rows.hooks = []Webhook{s.hook}
+		}
+		return rows, nil
+	}
+	if strings.HasPrefix(query, "UPDATE webhooks SET failure_count = failure_count + 1") {
+		disableAfter, _ := args[1].Value.(int64)
+		s.failures++
+		s.disabled = s.failures >= int(disableAfter)
+		return &valueRows{column: "disabled", value: s.disabled}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c webhookConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if strings.HasPrefix(query, "UPDATE webhooks SET failure_count = 0") {
+		c.store.mu.Lock()
+		defer c.store.mu.Unlock()
+		c.store.failures = 0
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("not supported")
+}
+
+type webhookRows struct {
+	hooks []Webhook
+}
+
+func (r *webhookRows) Columns() []string { return []string{"webhook_id", "url", "secret"} }
+func (r *webhookRows) Close() error      { return nil }
+
+func (r *webhookRows) Next(dest []driver.Value) error {
+	if len(r.hooks) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1], dest[2] = int64(r.hooks[0].ID), r.hooks[0].URL, r.hooks[0].Secret
+	r.hooks = r.hooks[1:]
+	return nil
+}
+
+// webhookReceiver is a bot's endpoint. It answers with the queued status
+// codes, then 200, and keeps every request it got.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []capturedDelivery
+}
+
+type capturedDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, capturedDelivery{header: r.Header, body: body})
+	if len(rcv.statuses) > 0 {
+		w.WriteHeader(rcv.statuses[0])
+		rcv.statuses = rcv.statuses[1:]
+	}
+}
+
+func (rcv *webhookReceiver) waitForRequests(t *testing.T, n int) []capturedDelivery {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rcv.mu.Lock()
+		requests := rcv.requests
+		rcv.mu.Unlock()
+		if len(requests) >= n {
+			return requests
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d webhook requests", n)
+	return nil
+}
+
+func startWebhookDispatcher(t *testing.T, rcv *webhookReceiver, attempts, disableAfter int) *webhookStore {
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+	store := &webhookStore{hook: Webhook{ID: 1, UserID: 42, URL: server.URL + "/hook", Secret: "s3cret"}}
+	testDB := sql.OpenDB(store)
+	t.Cleanup(func() { testDB.Close() })
+
+	policy := retryPolicy{Attempts: attempts, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	d := NewWebhookDispatcher(testDB, 2, time.Second, policy, disableAfter)
+	t.Cleanup(d.Close)
+	webhooks = d
+	t.Cleanup(func() { webhooks = nil })
+	return store
+}
+
+func TestWebhookDeliverySignedAndRetried(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	store := startWebhookDispatcher(t, rcv, 5, 10)
+	store.failures = 3
+
+	notifyWebhooks(Message{ID: 7, SenderID: 1, RecipientID: 42, Text: "ping bot"})
+	notifyWebhooks(Message{ID: 8, SenderID: 1, RecipientID: 43, Text: "not for the bot"})
+	requests := rcv.waitForRequests(t, 3)
+
+	for _, req := range requests {
+		assert.Equal(t, signWebhook("s3cret", req.body), req.header.Get(webhookSignatureHeader))
+		assert.Equal(t, eventMessageCreated, req.header.Get(webhookEventHeader))
+		assert.Equal(t, requests[0].header.Get(webhookDeliveryHeader), req.header.Get(webhookDeliveryHeader), "retries keep the delivery ID")
+		assert.Equal(t, requests[0].body, req.body)
+	}
+	assert.NotEqual(t, signWebhook("other", requests[0].body), requests[0].header.Get(webhookSignatureHeader))
+
+	var payload struct {
+		Event string  `json:"event"`
+		Data  Message `json:"data"`
+	}
+	if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, eventMessageCreated, payload.Event)
+	assert.Equal(t, "ping bot", payload.Data.Text)
+
+	assert.Eventually(t, func() bool {
+		failures, _ := store.state()
+		return failures == 0
+	}, time.Second, 5*time.Millisecond, "a delivery resets the failure count")
+	time.Sleep(20 * time.Millisecond)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	assert.Len(t, rcv.requests, 3, "only the bot's message is delivered, once")
+}
+
+func TestWebhookDisabledAfterRepeatedFailures(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{500, 500, 500, 500, 500, 500}}
+	store := startWebhookDispatcher(t, rcv, 2, 2)
+
+	notifyWebhooks(Message{ID: 1, RecipientID: 42, Text: "one"})
+	rcv.waitForRequests(t, 2)
+	notifyWebhooks(Message{ID: 2, RecipientID: 42, Text: "two"})
+	rcv.waitForRequests(t, 4)
+
+	assert.Eventually(t, func() bool {
+		_, disabled := store.state()
+		return disabled
+	}, time.Second, 5*time.Millisecond)
+
+	notifyWebhooks(Message{ID: 3, RecipientID: 42, Text: "three"})
+	time.Sleep(50 * time.Millisecond)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	assert.Len(t, rcv.requests, 4, "a disabled webhook is not called")
+}
+
+func TestCreateWebhookRejectsBadInput(t *testing.T) {
+	initRedis(t)
+	token, err := createSession(context.Background(), 1, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"url": "ftp://bot.example.com/hook"}`,
+		`{"url": "/hook"}`,
+		`{"url": "https://bot.example.com/hook", "event_types": ["message.deleted"]}`,
+	} {
+		req := httptest.NewRequest("POST", "/webhooks", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		requireAuth(createWebhook)(rr, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, body)
+	}
+}